@@ -17,11 +17,11 @@ limitations under the License.
 package app
 
 import (
-	"compress/gzip"
 	"fmt"
 	"os"
 
 	"github.com/heptio/sonobuoy/pkg/client"
+	"github.com/heptio/sonobuoy/pkg/client/results"
 	"github.com/heptio/sonobuoy/pkg/errlog"
 	"github.com/pkg/errors"
 	"github.com/spf13/cobra"
@@ -70,12 +70,12 @@ func e2es(cmd *cobra.Command, args []string) {
 	if e2eflags.rerun {
 		e2eflags.show = "failed"
 	}
-	gzr, err := gzip.NewReader(f)
+	tr, err := results.Decompress(f)
 	if err != nil {
-		errlog.LogError(errors.Wrap(err, "could not make a gzip reader"))
+		errlog.LogError(errors.Wrap(err, "could not read sonobuoy archive"))
 		os.Exit(1)
 	}
-	defer gzr.Close()
+	defer tr.Close()
 
 	var cfg *rest.Config
 	// If we are doing a rerun, only then, we need kubeconfig
@@ -91,7 +91,7 @@ func e2es(cmd *cobra.Command, args []string) {
 		errlog.LogError(errors.Wrap(err, "could not create sonobuoy client"))
 		os.Exit(1)
 	}
-	testCases, err := sonobuoy.GetTests(gzr, e2eflags.show)
+	testCases, err := sonobuoy.GetTests(tr, e2eflags.show)
 	if err != nil {
 		errlog.LogError(errors.Wrap(err, "could not get tests from archive"))
 		os.Exit(1)
@@ -22,6 +22,7 @@ import (
 	"path/filepath"
 
 	"github.com/heptio/sonobuoy/pkg/client"
+	"github.com/heptio/sonobuoy/pkg/encryption"
 	"github.com/heptio/sonobuoy/pkg/errlog"
 	"github.com/pkg/errors"
 	"github.com/spf13/cobra"
@@ -37,6 +38,9 @@ var (
 type receiveFlags struct {
 	namespace string
 	kubecfg   Kubeconfig
+	plugin    string
+	node      string
+	keyFile   string
 }
 
 var rcvFlags receiveFlags
@@ -51,6 +55,18 @@ func NewCmdRetrieve() *cobra.Command {
 
 	AddKubeconfigFlag(&rcvFlags.kubecfg, cmd.Flags())
 	AddNamespaceFlag(&rcvFlags.namespace, cmd.Flags())
+	cmd.Flags().StringVar(
+		&rcvFlags.plugin, "plugin", "",
+		"Only retrieve the results of this plugin, rather than the whole results tarball",
+	)
+	cmd.Flags().StringVar(
+		&rcvFlags.node, "node", "",
+		"Only retrieve the plugin's results from this node. Requires --plugin",
+	)
+	cmd.Flags().StringVar(
+		&rcvFlags.keyFile, "decryption-key-file", "",
+		"File with the secret the results were encrypted with, if the aggregator encrypted them",
+	)
 
 	return cmd
 }
@@ -67,6 +83,23 @@ func retrieveResults(cmd *cobra.Command, args []string) {
 		os.Exit(1)
 	}
 
+	var key []byte
+	if rcvFlags.keyFile != "" {
+		if key, err = encryption.ReadKeyFile(rcvFlags.keyFile); err != nil {
+			errlog.LogError(err)
+			os.Exit(1)
+		}
+	}
+
+	if rcvFlags.plugin != "" {
+		retrieveResultFiles(sbc, outDir, key)
+		return
+	}
+	if rcvFlags.node != "" {
+		errlog.LogError(errors.New("--node can only be used with --plugin"))
+		os.Exit(1)
+	}
+
 	// Get a reader that contains the tar output of the results directory.
 	reader, ec := sbc.RetrieveResults(&client.RetrieveConfig{Namespace: rcvFlags.namespace})
 	if err != nil {
@@ -82,6 +115,11 @@ func retrieveResults(cmd *cobra.Command, args []string) {
 			return err
 		}
 		for _, name := range filesCreated {
+			if key != nil {
+				if err := client.DecryptResults(name, key); err != nil {
+					return err
+				}
+			}
 			fmt.Println(name)
 		}
 		return nil
@@ -97,3 +135,24 @@ func retrieveResults(cmd *cobra.Command, args []string) {
 		os.Exit(2)
 	}
 }
+
+// retrieveResultFiles retrieves just the files of one plugin's results,
+// printing the name of each file written.
+func retrieveResultFiles(sbc client.Interface, outDir string, key []byte) {
+	filenames, err := sbc.RetrieveResultFiles(&client.RetrieveConfig{
+		Namespace:     rcvFlags.namespace,
+		Plugin:        rcvFlags.plugin,
+		Node:          rcvFlags.node,
+		DecryptionKey: key,
+	}, outDir)
+	for _, name := range filenames {
+		fmt.Println(name)
+	}
+	if _, ok := errors.Cause(err).(exec.CodeExitError); ok {
+		fmt.Fprintln(os.Stderr, "Results not ready yet. Check `sonobuoy status` for status.")
+		os.Exit(1)
+	} else if err != nil {
+		fmt.Fprintf(os.Stderr, "error retrieving results: %v\n", err)
+		os.Exit(2)
+	}
+}
@@ -0,0 +1,61 @@
+/*
+Copyright 2018 Heptio Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package app
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/heptio/sonobuoy/pkg/errlog"
+	"github.com/heptio/sonobuoy/pkg/plugin"
+	"github.com/heptio/sonobuoy/pkg/plugin/aggregation"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+)
+
+var selfTestFlags struct {
+	config SonobuoyConfig
+}
+
+func NewCmdSelfTest() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "selftest",
+		Short: "Checks the aggregator's certificates and TLS work in this environment",
+		Long:  "Generates a certificate authority, serves an aggregator on the loopback interface and submits a result to it over TLS with a client certificate, as a run would but without scheduling any pods. Use it to catch crypto libraries which can't use the certificates Sonobuoy generates (e.g. some FIPS builds) before a run.",
+		Run:   runSelfTest,
+		Args:  cobra.ExactArgs(0),
+	}
+	cmd.Flags().Var(
+		&selfTestFlags.config, "config",
+		"Path to a sonobuoy configuration JSON file whose key type and TLS settings are tested.",
+	)
+	return cmd
+}
+
+func runSelfTest(cmd *cobra.Command, args []string) {
+	var cfg plugin.AggregationConfig
+	if sbCfg := selfTestFlags.config.Get(); sbCfg != nil {
+		cfg = sbCfg.Aggregation
+	}
+
+	if err := aggregation.SelfTest(cfg, logrus.StandardLogger()); err != nil {
+		errlog.LogError(errors.Wrap(err, "self test failed"))
+		os.Exit(1)
+	}
+	fmt.Println("Self test passed")
+}
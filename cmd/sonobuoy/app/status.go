@@ -22,6 +22,7 @@ import (
 	"os"
 	"sort"
 	"text/tabwriter"
+	"time"
 
 	"github.com/pkg/errors"
 	"github.com/spf13/cobra"
@@ -110,16 +111,35 @@ func humanReadableStatus(str string) string {
 func printAll(w io.Writer, status *aggregation.Status) error {
 	tw := tabwriter.NewWriter(w, 1, 8, 1, '\t', tabwriter.AlignRight)
 
-	fmt.Fprintf(tw, "PLUGIN\tNODE\tSTATUS\n")
+	// Only plugins which report their progress have any, so the column is
+	// left out if none of them do.
+	showProgress := false
 	for _, pluginStatus := range status.Plugins {
-		fmt.Fprintf(tw, "%s\t%s\t%s\n", pluginStatus.Plugin, pluginStatus.Node, pluginStatus.Status)
+		showProgress = showProgress || pluginStatus.Progress != nil
+	}
+
+	if showProgress {
+		fmt.Fprintf(tw, "PLUGIN\tNODE\tSTATUS\tPROGRESS\n")
+	} else {
+		fmt.Fprintf(tw, "PLUGIN\tNODE\tSTATUS\n")
+	}
+	for _, pluginStatus := range status.Plugins {
+		if !showProgress {
+			fmt.Fprintf(tw, "%s\t%s\t%s\n", pluginStatus.Plugin, pluginStatus.Node, pluginStatus.Status)
+			continue
+		}
+		progress := ""
+		if pluginStatus.Progress != nil {
+			progress = pluginStatus.Progress.String()
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\n", pluginStatus.Plugin, pluginStatus.Node, pluginStatus.Status, progress)
 	}
 
 	if err := tw.Flush(); err != nil {
 		return errors.Wrap(err, "couldn't write status out")
 	}
 
-	fmt.Fprintf(w, "\n%s\n", humanReadableStatus(status.Status))
+	printFooter(w, status)
 	return nil
 }
 
@@ -154,10 +174,44 @@ func printSummary(w io.Writer, status *aggregation.Status) error {
 		return errors.Wrap(err, "couldn't write status out")
 	}
 
-	fmt.Fprintf(w, "\n%s\n", humanReadableStatus(status.Status))
+	printFooter(w, status)
 	return nil
 }
 
+// printFooter prints the progress of the run, if known, and what its status
+// means.
+func printFooter(w io.Writer, status *aggregation.Status) {
+	fmt.Fprintln(w)
+	if status.Progress != nil {
+		fmt.Fprintln(w, status.Progress)
+	}
+	if len(status.Missing) > 0 {
+		fmt.Fprintf(w, "Timed out waiting for %v results:\n", len(status.Missing))
+		for _, missing := range status.Missing {
+			if missing.Node == "" {
+				fmt.Fprintf(w, "  %v\n", missing.Plugin)
+			} else {
+				fmt.Fprintf(w, "  %v on node %v\n", missing.Plugin, missing.Node)
+			}
+		}
+	}
+	if len(status.Stalled) > 0 {
+		fmt.Fprintf(w, "No heartbeats from the workers of %v results:\n", len(status.Stalled))
+		for _, stalled := range status.Stalled {
+			since := stalled.LastHeartbeat.Format(time.RFC3339)
+			if stalled.Node == "" {
+				fmt.Fprintf(w, "  %v since %v\n", stalled.Plugin, since)
+			} else {
+				fmt.Fprintf(w, "  %v on node %v since %v\n", stalled.Plugin, stalled.Node, since)
+			}
+		}
+	}
+	if status.DiskFull != "" {
+		fmt.Fprintf(w, "Results are being lost because the aggregator's disk is full: %v\n", status.DiskFull)
+	}
+	fmt.Fprintln(w, humanReadableStatus(status.Status))
+}
+
 type pluginSummaries []pluginSummary
 
 type pluginSummary struct {
@@ -19,7 +19,9 @@ package app
 import (
 	"bytes"
 	"io"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/heptio/sonobuoy/pkg/plugin/aggregation"
 )
@@ -67,6 +69,105 @@ var exampleStatus = aggregation.Status{
 	},
 }
 
+var expectedSummaryWithProgress = `PLUGIN		STATUS		COUNT
+e2e		complete	1
+systemd_logs	complete	1
+systemd_logs	running		2
+
+2/4 results (50%)
+Sonobuoy is still running. Runs can take up to 60 minutes.
+`
+
+func TestPrintStatus_progress(t *testing.T) {
+	status := exampleStatus
+	progress := aggregation.NewProgress(2, 4)
+	status.Progress = &progress
+
+	var b bytes.Buffer
+	if err := printSummary(&b, &status); err != nil {
+		t.Fatalf("expected err to be nil, got %v", err)
+	}
+	if b.String() != expectedSummaryWithProgress {
+		t.Errorf("expected output to be %q, got %q", expectedSummaryWithProgress, b.String())
+	}
+}
+
+func TestPrintAll_pluginProgress(t *testing.T) {
+	status := exampleStatus
+	status.Plugins = append([]aggregation.PluginStatus{}, exampleStatus.Plugins...)
+	status.Plugins[0].Progress = &aggregation.PluginProgress{Completed: 120, Failed: 2, Total: 340}
+
+	var b bytes.Buffer
+	if err := printAll(&b, &status); err != nil {
+		t.Fatalf("expected err to be nil, got %v", err)
+	}
+	lines := strings.Split(b.String(), "\n")
+	if !strings.Contains(lines[0], "PROGRESS") {
+		t.Errorf("expected a progress column, got %q", lines[0])
+	}
+	if !strings.HasSuffix(lines[1], "120/340 tests, 2 failed") {
+		t.Errorf("expected the plugin's progress, got %q", lines[1])
+	}
+}
+
+var expectedSummaryWithMissing = `PLUGIN		STATUS		COUNT
+e2e		complete	1
+systemd_logs	complete	1
+systemd_logs	running		2
+
+Timed out waiting for 2 results:
+  systemd_logs on node node01
+  systemd_logs on node node03
+Sonobuoy is still running. Runs can take up to 60 minutes.
+`
+
+func TestPrintStatus_missing(t *testing.T) {
+	status := exampleStatus
+	status.Missing = []aggregation.MissingResult{
+		{Plugin: "systemd_logs", Node: "node01"},
+		{Plugin: "systemd_logs", Node: "node03"},
+	}
+
+	var b bytes.Buffer
+	if err := printSummary(&b, &status); err != nil {
+		t.Fatalf("expected err to be nil, got %v", err)
+	}
+	if b.String() != expectedSummaryWithMissing {
+		t.Errorf("expected output to be %q, got %q", expectedSummaryWithMissing, b.String())
+	}
+}
+
+func TestPrintStatus_diskFull(t *testing.T) {
+	status := exampleStatus
+	status.DiskFull = "the aggregator's results directory is full: write /tmp/sonobuoy/plugins/e2e: no space left on device"
+
+	var b bytes.Buffer
+	if err := printSummary(&b, &status); err != nil {
+		t.Fatalf("expected err to be nil, got %v", err)
+	}
+	expected := "Results are being lost because the aggregator's disk is full: " + status.DiskFull + "\n"
+	if !strings.Contains(b.String(), expected) {
+		t.Errorf("expected output to include %q, got %q", expected, b.String())
+	}
+}
+
+func TestPrintStatus_stalled(t *testing.T) {
+	status := exampleStatus
+	status.Stalled = []aggregation.StalledResult{
+		{Plugin: "systemd_logs", Node: "node1", LastHeartbeat: time.Date(2018, 6, 1, 12, 0, 0, 0, time.UTC)},
+		{Plugin: "e2e", LastHeartbeat: time.Date(2018, 6, 1, 12, 5, 0, 0, time.UTC)},
+	}
+
+	var b bytes.Buffer
+	if err := printSummary(&b, &status); err != nil {
+		t.Fatalf("expected err to be nil, got %v", err)
+	}
+	expected := "No heartbeats from the workers of 2 results:\n  systemd_logs on node node1 since 2018-06-01T12:00:00Z\n  e2e since 2018-06-01T12:05:00Z\n"
+	if !strings.Contains(b.String(), expected) {
+		t.Errorf("expected output to include %q, got %q", expected, b.String())
+	}
+}
+
 func TestPrintStatus(t *testing.T) {
 	tests := []struct {
 		expected string
@@ -17,9 +17,7 @@ limitations under the License.
 package app
 
 import (
-	"crypto/tls"
-	"crypto/x509"
-	"encoding/pem"
+	"fmt"
 	"net/http"
 	"os"
 	"os/signal"
@@ -27,8 +25,10 @@ import (
 	"syscall"
 	"time"
 
+	"github.com/heptio/sonobuoy/pkg/backplane/ca"
 	"github.com/heptio/sonobuoy/pkg/errlog"
 	"github.com/heptio/sonobuoy/pkg/plugin"
+	"github.com/heptio/sonobuoy/pkg/plugin/aggregation"
 	"github.com/heptio/sonobuoy/pkg/worker"
 	"github.com/pkg/errors"
 	"github.com/sirupsen/logrus"
@@ -45,6 +45,30 @@ func NewCmdWorker() *cobra.Command {
 		Args:   cobra.ExactArgs(0),
 	}
 
+	workerCmd.PersistentFlags().BoolVar(
+		&streamPartial, "stream-partial", false,
+		"Submit files the plugin writes to the partial directory of its results dir before the final results",
+	)
+	workerCmd.PersistentFlags().BoolVar(
+		&streamResults, "stream", false,
+		"Stream the file the plugin writes to stream in its results dir as it's written, instead of submitting its final results",
+	)
+	workerCmd.PersistentFlags().BoolVar(
+		&uploadArtifacts, "artifacts", false,
+		"Submit the files the plugin writes to the artifacts directory of its results dir, and the final results, as separate artifacts (requires an aggregator which supports artifacts)",
+	)
+	workerCmd.PersistentFlags().BoolVar(
+		&keepFilenames, "keep-filenames", false,
+		"Send the name of each file submitted so the aggregator keeps it (requires an aggregator which supports named results)",
+	)
+	workerCmd.PersistentFlags().BoolVar(
+		&compressResults, "compress", false,
+		"Compress results before submitting them, with a codec negotiated with the aggregator",
+	)
+	workerCmd.PersistentFlags().BoolVar(
+		&checksumResults, "checksum", false,
+		"Send the checksum of results so the aggregator can reject corrupted uploads",
+	)
 	workerCmd.AddCommand(singleNodeCmd)
 	workerCmd.AddCommand(globalCmd)
 
@@ -53,6 +77,24 @@ func NewCmdWorker() *cobra.Command {
 
 
 
+// streamPartial is set by the --stream-partial flag.
+var streamPartial bool
+
+// streamResults is set by the --stream flag.
+var streamResults bool
+
+// uploadArtifacts is set by the --artifacts flag.
+var uploadArtifacts bool
+
+// keepFilenames is set by the --keep-filenames flag.
+var keepFilenames bool
+
+// compressResults is set by the --compress flag.
+var compressResults bool
+
+// checksumResults is set by the --checksum flag.
+var checksumResults bool
+
 var globalCmd = &cobra.Command{
 	Use:   "global",
 	Short: "Submit results scoped to the whole cluster",
@@ -93,6 +135,24 @@ func loadAndValidateConfig() (*plugin.WorkerConfig, error) {
 	if err != nil {
 		return nil, errors.Wrap(err, "error loading agent configuration")
 	}
+	if streamPartial {
+		cfg.StreamPartial = true
+	}
+	if streamResults {
+		cfg.StreamResults = true
+	}
+	if uploadArtifacts {
+		cfg.UploadArtifacts = true
+	}
+	if keepFilenames {
+		cfg.KeepFilenames = true
+	}
+	if compressResults {
+		cfg.CompressResults = true
+	}
+	if checksumResults {
+		cfg.ChecksumResults = true
+	}
 
 	var errlst []string
 	if cfg.MasterURL == "" {
@@ -104,6 +164,28 @@ func loadAndValidateConfig() (*plugin.WorkerConfig, error) {
 	if cfg.ResultType == "" {
 		errlst = append(errlst, "ResultsType not set")
 	}
+	if _, err := ca.ParseTLSOptions(cfg.MinTLSVersion, cfg.CipherSuiteList()); err != nil {
+		errlst = append(errlst, err.Error())
+	}
+	if cfg.ProxyURL != "" {
+		if _, err := plugin.ParseProxyURL(cfg.ProxyURL); err != nil {
+			errlst = append(errlst, err.Error())
+		}
+	}
+	if prefix, err := plugin.CleanPathPrefix(cfg.UploadPathPrefix); err != nil {
+		errlst = append(errlst, err.Error())
+	} else {
+		cfg.UploadPathPrefix = prefix
+	}
+	if cfg.UploadRetries < 0 {
+		errlst = append(errlst, fmt.Sprintf("UploadRetries must not be negative, got %v", cfg.UploadRetries))
+	}
+	if cfg.UploadTimeoutSeconds < 0 {
+		errlst = append(errlst, fmt.Sprintf("UploadTimeoutSeconds must not be negative, got %v", cfg.UploadTimeoutSeconds))
+	}
+	if cfg.HeartbeatIntervalSeconds < 0 {
+		errlst = append(errlst, fmt.Sprintf("HeartbeatIntervalSeconds must not be negative, got %v", cfg.HeartbeatIntervalSeconds))
+	}
 
 	if len(errlst) > 0 {
 		joinedErrs := strings.Join(errlst, ", ")
@@ -120,17 +202,22 @@ func runGatherSingleNode(cmd *cobra.Command, args []string) {
 		os.Exit(1)
 	}
 
-	client, err := getHTTPClient(cfg)
+	client, err := worker.NewClient(cfg, worker.ClientOptions{})
 	if err != nil {
 		errlog.LogError(err)
 		os.Exit(1)
 	}
+	checkConnectivity(cfg, client)
 
 	// A single-node results URL looks like:
 	// http://sonobuoy-master:8080/api/v1/results/by-node/node1/systemd_logs
-	url := cfg.MasterURL + "/" + cfg.NodeName + "/" + cfg.ResultType
+	urls, err := resultURLs(cfg, cfg.NodeName+"/"+cfg.ResultType)
+	if err != nil {
+		errlog.LogError(err)
+		os.Exit(1)
+	}
 
-	err = worker.GatherResults(cfg.ResultsDir+"/done", url, client, sigHandler(plugin.GracefulShutdownPeriod*time.Second))
+	err = worker.GatherResultsWithOptions(cfg.ResultsDir+"/done", urls, client, sigHandler(plugin.GracefulShutdownPeriod*time.Second), gatherOptions(cfg))
 	if err != nil {
 		errlog.LogError(err)
 		os.Exit(1)
@@ -144,65 +231,81 @@ func runGatherGlobal(cmd *cobra.Command, args []string) {
 		os.Exit(1)
 	}
 
-	client, err := getHTTPClient(cfg)
+	client, err := worker.NewClient(cfg, worker.ClientOptions{})
 	if err != nil {
 		errlog.LogError(err)
 		os.Exit(1)
 	}
+	checkConnectivity(cfg, client)
 
 	// A global results URL looks like:
 	// http://sonobuoy-master:8080/api/v1/results/global/systemd_logs
-	url := cfg.MasterURL + "/" + cfg.ResultType
+	urls, err := resultURLs(cfg, cfg.ResultType)
+	if err != nil {
+		errlog.LogError(err)
+		os.Exit(1)
+	}
 
-	err = worker.GatherResults(cfg.ResultsDir+"/done", url, client, sigHandler(plugin.GracefulShutdownPeriod*time.Second))
+	err = worker.GatherResultsWithOptions(cfg.ResultsDir+"/done", urls, client, sigHandler(plugin.GracefulShutdownPeriod*time.Second), gatherOptions(cfg))
 	if err != nil {
 		errlog.LogError(err)
 		os.Exit(1)
 	}
 }
 
-func getHTTPClient(cfg *plugin.WorkerConfig) (*http.Client, error) {
-	caCertDER, _ := pem.Decode([]byte(cfg.CACert))
-	if caCertDER == nil {
-		return nil, errors.New("Couldn't parse CaCert PEM")
-	}
-	clientCertDER, _ := pem.Decode([]byte(cfg.ClientCert))
-	if clientCertDER == nil {
-		return nil, errors.New("Couldn't parse ClientCert PEM")
+// checkConnectivity logs whether the aggregator can be reached, and through
+// which proxy, before any results are submitted, so that a worker which
+// can't reach it is easy to tell apart from one whose plugin never finished.
+func checkConnectivity(cfg *plugin.WorkerConfig, client *http.Client) {
+	var proxy worker.Proxy
+	if cfg.AggregatorSocket == "" {
+		var err error
+		if proxy, err = worker.NewProxy(cfg.ProxyURL); err != nil {
+			logrus.WithError(err).Warn("Couldn't check the aggregator is reachable")
+			return
+		}
 	}
-	clientKeyDER, _ := pem.Decode([]byte(cfg.ClientKey))
-	if clientKeyDER == nil {
-		return nil, errors.New("Couldn't parse ClientKey PEM")
+	if err := worker.CheckConnectivity(cfg.MasterURLs(), cfg.UploadPathPrefix, client, proxy); err != nil {
+		logrus.WithError(err).Warn("The aggregator isn't reachable yet, submitting results will be retried")
 	}
+}
 
-	caCert, err := x509.ParseCertificate(caCertDER.Bytes)
-	if err != nil {
-		return nil, errors.Wrap(err, "couldn't parse CaCert")
+// gatherOptions returns the options for gathering results from the plugin.
+func gatherOptions(cfg *plugin.WorkerConfig) worker.GatherOptions {
+	opts := worker.GatherOptions{
+		Checksum:        cfg.ChecksumResults,
+		Filenames:       cfg.KeepFilenames,
+		ProgressFile:    cfg.ResultsDir + "/progress.json",
+		AnnotationsFile: cfg.ResultsDir + "/annotations.json",
+		Upload: worker.UploadPolicy{
+			Retries: cfg.UploadRetries,
+			Timeout: time.Duration(cfg.UploadTimeoutSeconds) * time.Second,
+		},
+		HeartbeatInterval: time.Duration(cfg.HeartbeatIntervalSeconds) * time.Second,
 	}
-	clientCert, err := x509.ParseCertificate(clientCertDER.Bytes)
-	if err != nil {
-		return nil, errors.Wrap(err, "couldn't parse ClientCert")
+	if cfg.StreamPartial {
+		opts.PartialDir = cfg.ResultsDir + "/partial"
 	}
-	clientKey, err := x509.ParseECPrivateKey(clientKeyDER.Bytes)
-	if err != nil {
-		return nil, errors.Wrap(err, "couldn't parse ClientKey")
-	}
-
-	certPool := x509.NewCertPool()
-	certPool.AddCert(caCert)
-
-	return &http.Client{
-		Transport: &http.Transport{
-			TLSClientConfig: &tls.Config{
-				Certificates: []tls.Certificate{
-					{
-						Certificate: [][]byte{clientCertDER.Bytes},
-						PrivateKey:  clientKey,
-						Leaf:        clientCert,
-					},
-				},
-				RootCAs: certPool,
-			},
-		},
-	}, nil
+	if cfg.UploadArtifacts {
+		opts.ArtifactsDir = cfg.ResultsDir + "/artifacts"
+	}
+	if cfg.StreamResults {
+		opts.StreamFile = cfg.ResultsDir + "/stream"
+	}
+	return opts
+}
+
+// resultURLs returns the results URL under each of the configured master URLs,
+// in the order they should be tried.
+func resultURLs(cfg *plugin.WorkerConfig, resultPath string) ([]string, error) {
+	masterURLs := cfg.MasterURLs()
+	urls := make([]string, len(masterURLs))
+	for i, masterURL := range masterURLs {
+		url, err := aggregation.WithPathPrefix(masterURL+"/"+resultPath, cfg.UploadPathPrefix)
+		if err != nil {
+			return nil, err
+		}
+		urls[i] = url
+	}
+	return urls, nil
 }
@@ -61,6 +61,11 @@ func NewTLSServer(handle http.Handler, t *testing.T) *Server {
 	}
 }
 
+// ClientKeyPair issues a client cert signed by the server's CA.
+func (s *Server) ClientKeyPair(name string) (*tls.Certificate, error) {
+	return s.auth.ClientKeyPair(name)
+}
+
 // Client wraps httptest.Server.Client(), injecting our CA and client cert
 func (s *Server) Client() *http.Client {
 	if s.auth == nil {
@@ -17,13 +17,17 @@ limitations under the License.
 package ca
 
 import (
+	"bytes"
 	"crypto"
 	"crypto/ecdsa"
 	"crypto/elliptic"
 	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
 	"crypto/tls"
 	"crypto/x509"
 	"crypto/x509/pkix"
+	"encoding/pem"
 	"math/big"
 	"net"
 	"sync"
@@ -33,11 +37,23 @@ import (
 )
 
 const (
-	rsaBits  = 2048
-	validFor = 48 * time.Hour
-	caName   = "sonobuoy-ca"
+	rsaBits = 2048
+	caName  = "sonobuoy-ca"
+
+	// DefaultValidity is how long certificates issued by an Authority are
+	// valid for unless configured otherwise.
+	DefaultValidity = 48 * time.Hour
+
+	// KeyTypeECDSA keys use the P-256 curve. They're far cheaper to sign and
+	// verify with than RSA keys, which makes for faster TLS handshakes.
+	KeyTypeECDSA KeyType = "ecdsa"
+	// KeyTypeRSA keys are 2048 bits long, for clients which can't use ECDSA.
+	KeyTypeRSA KeyType = "rsa"
 )
 
+// KeyType is the type of the keys an Authority generates.
+type KeyType string
+
 var (
 	pkixName = pkix.Name{
 		Organization:       []string{"Heptio"},
@@ -54,20 +70,42 @@ var (
 // Sonobuoy issues every worker a client certificate
 type Authority struct {
 	sync.Mutex
-	privKey    *ecdsa.PrivateKey
+	privKey    crypto.Signer
 	cert       *x509.Certificate
 	lastSerial *big.Int
+	// validFor is how long leaf certificates are valid for.
+	validFor time.Duration
+	// randomSerials is set for externally provided CAs, which issue
+	// certificates across many runs and so can't count serials from 1.
+	randomSerials bool
+	// keyType is the type of key generated for each certificate.
+	keyType KeyType
 }
 
-// NewAuthority creates a new certificate authority. A new private key and root certificate will
-// be generated but not returned.
+// NewAuthority creates a new certificate authority whose certificates are all valid for
+// DefaultValidity. A new private key and root certificate will be generated but not returned.
 func NewAuthority() (*Authority, error) {
-	privKey, err := ecdsa.GenerateKey(elliptic.P256(), randReader)
+	return NewAuthorityWithValidity(DefaultValidity, DefaultValidity)
+}
+
+// NewAuthorityWithValidity creates a new certificate authority whose root certificate is valid
+// for caValidity and which issues certificates valid for certValidity. Certificates never
+// outlive the root certificate.
+func NewAuthorityWithValidity(caValidity, certValidity time.Duration) (*Authority, error) {
+	return NewAuthorityWithKeyType(KeyTypeECDSA, caValidity, certValidity)
+}
+
+// NewAuthorityWithKeyType is NewAuthorityWithValidity, generating keys of the given type for
+// the root certificate and every certificate it issues.
+func NewAuthorityWithKeyType(keyType KeyType, caValidity, certValidity time.Duration) (*Authority, error) {
+	privKey, err := generateKey(keyType)
 	if err != nil {
-		return nil, errors.Wrap(err, "couldn't generate private key")
+		return nil, err
 	}
 	auth := &Authority{
-		privKey: privKey,
+		privKey:  privKey,
+		validFor: caValidity,
+		keyType:  keyType,
 	}
 	cert, err := auth.makeCert(privKey.Public(), func(cert *x509.Certificate) {
 		cert.IsCA = true
@@ -78,9 +116,120 @@ func NewAuthority() (*Authority, error) {
 		return nil, errors.Wrap(err, "couldn't create certificate authority root certificate")
 	}
 	auth.cert = cert
+	auth.validFor = certValidity
 	return auth, nil
 }
 
+// NewAuthorityFromPEM creates a certificate authority from an existing PEM encoded CA
+// certificate and private key, which issues certificates valid for certValidity. The key may
+// be an ECDSA or RSA key in PKCS #1, PKCS #8 or SEC 1 form. An error is returned if the
+// certificate can't be used to issue client and server certificates.
+func NewAuthorityFromPEM(certPEM, keyPEM []byte, certValidity time.Duration) (*Authority, error) {
+	certBlock, _ := pem.Decode(certPEM)
+	if certBlock == nil || certBlock.Type != "CERTIFICATE" {
+		return nil, errors.New("no PEM encoded CA certificate found")
+	}
+	cert, err := x509.ParseCertificate(certBlock.Bytes)
+	if err != nil {
+		return nil, errors.Wrap(err, "couldn't parse CA certificate")
+	}
+	privKey, err := ParsePrivateKey(keyPEM)
+	if err != nil {
+		return nil, errors.Wrap(err, "invalid CA private key")
+	}
+
+	auth := &Authority{
+		privKey:       privKey,
+		cert:          cert,
+		validFor:      certValidity,
+		randomSerials: true,
+	}
+	if err := auth.check(); err != nil {
+		return nil, errors.Wrapf(err, "CA certificate %q can't be used", cert.Subject.CommonName)
+	}
+	return auth, nil
+}
+
+// ParsePrivateKey parses a PEM encoded ECDSA or RSA private key in PKCS #1, PKCS #8 or SEC 1
+// form, such as those encoded by EncodePEM.
+func ParsePrivateKey(keyPEM []byte) (crypto.Signer, error) {
+	block, _ := pem.Decode(keyPEM)
+	if block == nil {
+		return nil, errors.New("no PEM encoded private key found")
+	}
+
+	var key interface{}
+	var err error
+	switch block.Type {
+	case "EC PRIVATE KEY":
+		key, err = x509.ParseECPrivateKey(block.Bytes)
+	case "RSA PRIVATE KEY":
+		key, err = x509.ParsePKCS1PrivateKey(block.Bytes)
+	case "PRIVATE KEY":
+		key, err = x509.ParsePKCS8PrivateKey(block.Bytes)
+	default:
+		return nil, errors.Errorf("unsupported private key PEM block %q", block.Type)
+	}
+	if err != nil {
+		return nil, errors.Wrap(err, "couldn't parse private key")
+	}
+
+	signer, ok := key.(crypto.Signer)
+	if !ok {
+		return nil, errors.Errorf("private key of type %T can't be used for signing", key)
+	}
+	return signer, nil
+}
+
+// check makes sure the authority's certificate and key can issue certificates which verify
+// against it, so a misconfigured CA fails up front rather than when workers connect.
+func (a *Authority) check() error {
+	keyPub, err := x509.MarshalPKIXPublicKey(a.privKey.Public())
+	if err != nil {
+		return errors.Wrap(err, "couldn't marshal the private key's public key")
+	}
+	certPub, err := x509.MarshalPKIXPublicKey(a.cert.PublicKey)
+	if err != nil {
+		return errors.Wrap(err, "couldn't marshal the certificate's public key")
+	}
+	if !bytes.Equal(keyPub, certPub) {
+		return errors.New("private key doesn't match the certificate")
+	}
+	if !a.cert.BasicConstraintsValid || !a.cert.IsCA {
+		return errors.New("certificate isn't a CA certificate")
+	}
+	if a.cert.KeyUsage != 0 && a.cert.KeyUsage&x509.KeyUsageCertSign == 0 {
+		return errors.New("certificate isn't allowed to sign certificates")
+	}
+	now := time.Now()
+	if now.Before(a.cert.NotBefore) || now.After(a.cert.NotAfter) {
+		return errors.Errorf("certificate is only valid from %v to %v", a.cert.NotBefore, a.cert.NotAfter)
+	}
+
+	// Issuing a certificate catches anything else, such as extended key
+	// usages or name constraints on the CA which exclude client certs.
+	return a.CheckClientNames("sonobuoy")
+}
+
+// CheckClientNames issues a client certificate for each of the given names and makes sure
+// it verifies against the CA, returning an error for the first which doesn't.
+func (a *Authority) CheckClientNames(names ...string) error {
+	for _, name := range names {
+		cert, err := a.ClientKeyPair(name)
+		if err != nil {
+			return err
+		}
+		_, err = cert.Leaf.Verify(x509.VerifyOptions{
+			Roots:     a.CACertPool(),
+			KeyUsages: []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+		})
+		if err != nil {
+			return errors.Wrapf(err, "client certificate for %v doesn't verify against the CA", name)
+		}
+	}
+	return nil
+}
+
 // makeCert takes a public key and a function to mutate the certificate template with updated parameters
 func (a *Authority) makeCert(pub crypto.PublicKey, mut func(*x509.Certificate)) (*x509.Certificate, error) {
 
@@ -90,7 +239,7 @@ func (a *Authority) makeCert(pub crypto.PublicKey, mut func(*x509.Certificate))
 		SerialNumber:          serialNumber,
 		Subject:               pkixName,
 		NotBefore:             validFrom,
-		NotAfter:              validFrom.Add(validFor),
+		NotAfter:              validFrom.Add(a.validFor),
 		KeyUsage:              0,
 		ExtKeyUsage:           []x509.ExtKeyUsage{},
 		BasicConstraintsValid: true,
@@ -100,6 +249,8 @@ func (a *Authority) makeCert(pub crypto.PublicKey, mut func(*x509.Certificate))
 	// NewAuthority case
 	if a.cert == nil {
 		parent = &tmpl
+	} else if tmpl.NotAfter.After(a.cert.NotAfter) {
+		tmpl.NotAfter = a.cert.NotAfter
 	}
 
 	newDERCert, err := x509.CreateCertificate(randReader, &tmpl, parent, pub, a.privKey)
@@ -111,10 +262,25 @@ func (a *Authority) makeCert(pub crypto.PublicKey, mut func(*x509.Certificate))
 	return cert, errors.Wrap(err, "couldn't re-parse created certificate")
 }
 
+// generateKey generates a new private key of the given type, defaulting to ECDSA.
+func generateKey(keyType KeyType) (crypto.Signer, error) {
+	var key crypto.Signer
+	var err error
+	switch keyType {
+	case "", KeyTypeECDSA:
+		key, err = ecdsa.GenerateKey(elliptic.P256(), randReader)
+	case KeyTypeRSA:
+		key, err = rsa.GenerateKey(randReader, rsaBits)
+	default:
+		return nil, errors.Errorf("unsupported key type %q", keyType)
+	}
+	return key, errors.Wrap(err, "couldn't generate private key")
+}
+
 func (a *Authority) makeLeafCert(mut func(*x509.Certificate)) (*tls.Certificate, error) {
-	privKey, err := ecdsa.GenerateKey(elliptic.P256(), randReader)
+	privKey, err := generateKey(a.keyType)
 	if err != nil {
-		return nil, errors.Wrap(err, "couldn't generate private key")
+		return nil, err
 	}
 
 	cert, err := a.makeCert(privKey.Public(), mut)
@@ -130,6 +296,13 @@ func (a *Authority) makeLeafCert(mut func(*x509.Certificate)) (*tls.Certificate,
 func (a *Authority) nextSerial() *big.Int {
 	a.Lock()
 	defer a.Unlock()
+	if a.randomSerials {
+		// Serials must be unique across runs, so use 128 random bits.
+		serial, err := rand.Int(randReader, new(big.Int).Lsh(big.NewInt(1), 128))
+		if err == nil {
+			return serial
+		}
+	}
 	if a.lastSerial == nil {
 		num := big.NewInt(1)
 		a.lastSerial = num
@@ -151,25 +324,43 @@ func (a *Authority) CACertPool() *x509.CertPool {
 	return pool
 }
 
-// ServerKeyPair makes a TLS server cert signed by our root CA. The returned certificate
+// ServerKeyPair makes a TLS server cert signed by our root CA, valid for each of the given
+// hostnames or IPs. Names given more than once are only added once. The returned certificate
 // has a chain including the root CA cert.
-func (a *Authority) ServerKeyPair(name string) (*tls.Certificate, error) {
+func (a *Authority) ServerKeyPair(names ...string) (*tls.Certificate, error) {
 	cert, err := a.makeLeafCert(func(cert *x509.Certificate) {
 		cert.ExtKeyUsage = []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth}
-		ip := net.ParseIP(name)
-		if ip != nil {
-			cert.IPAddresses = []net.IP{ip}
-		} else {
-			cert.DNSNames = []string{name}
+		seen := map[string]bool{}
+		for _, name := range names {
+			if name == "" || seen[name] {
+				continue
+			}
+			seen[name] = true
+			if ip := net.ParseIP(name); ip != nil {
+				cert.IPAddresses = append(cert.IPAddresses, ip)
+			} else {
+				cert.DNSNames = append(cert.DNSNames, name)
+			}
 		}
 	})
 	return cert, errors.Wrap(err, "couldn't make server certificate")
 }
 
-// MakeServerConfig makes a new server certificate, then returns a TLS config that uses it
-// and will verify peer certificates
-func (a *Authority) MakeServerConfig(name string) (*tls.Config, error) {
-	cert, err := a.ServerKeyPair(name)
+// MakeServerConfig makes a new server certificate for the given names, then returns a TLS
+// config that uses it and will verify peer certificates. The first name is the server's own;
+// the rest are extra SANs, such as the DNS name of a service clients reach the server through.
+func (a *Authority) MakeServerConfig(names ...string) (*tls.Config, error) {
+	return a.MakeServerConfigWithOptions(TLSOptions{}, names...)
+}
+
+// MakeServerConfigWithOptions is MakeServerConfig, restricting connections with the given
+// TLS options.
+func (a *Authority) MakeServerConfigWithOptions(opts TLSOptions, names ...string) (*tls.Config, error) {
+	if len(names) == 0 {
+		return nil, errors.New("no server names given")
+	}
+
+	cert, err := a.ServerKeyPair(names...)
 	if err != nil {
 		return nil, err
 	}
@@ -177,12 +368,14 @@ func (a *Authority) MakeServerConfig(name string) (*tls.Config, error) {
 	pool := x509.NewCertPool()
 	pool.AddCert(a.cert)
 
-	return &tls.Config{
+	cfg := &tls.Config{
 		Certificates: []tls.Certificate{*cert},
-		ServerName:   name,
+		ServerName:   names[0],
 		ClientAuth:   tls.RequireAndVerifyClientCert,
 		ClientCAs:    pool,
-	}, nil
+	}
+	opts.Apply(cfg)
+	return cfg, nil
 }
 
 // ClientKeyPair makes a client cert signed by our root CA. The returned certificate
@@ -194,3 +387,39 @@ func (a *Authority) ClientKeyPair(name string) (*tls.Certificate, error) {
 	})
 	return cert, errors.Wrap(err, "couldn't make client certificate")
 }
+
+// Sign signs the SHA-256 digest of data with the CA's private key, returning
+// an ASN.1 encoded ECDSA signature, or a PKCS #1 v1.5 signature for an RSA
+// CA. It can be verified against the CA certificate with
+// CheckSignature(x509.ECDSAWithSHA256, data, signature), or
+// x509.SHA256WithRSA respectively.
+func (a *Authority) Sign(data []byte) ([]byte, error) {
+	digest := sha256.Sum256(data)
+	sig, err := a.privKey.Sign(randReader, digest[:], crypto.SHA256)
+	return sig, errors.Wrap(err, "couldn't sign data")
+}
+
+// EncodePEM PEM encodes the leaf certificate and ECDSA or RSA private key of the given certificate.
+func EncodePEM(cert *tls.Certificate) (certPEM, keyPEM []byte, err error) {
+	if len(cert.Certificate) == 0 {
+		return nil, nil, errors.New("no certs in tls.certificate")
+	}
+
+	var keyBlock *pem.Block
+	switch key := cert.PrivateKey.(type) {
+	case *ecdsa.PrivateKey:
+		keyDER, err := x509.MarshalECPrivateKey(key)
+		if err != nil {
+			return nil, nil, errors.Wrap(err, "couldn't marshal private key")
+		}
+		keyBlock = &pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}
+	case *rsa.PrivateKey:
+		keyBlock = &pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)}
+	default:
+		return nil, nil, errors.Errorf("unsupported private key type %T", cert.PrivateKey)
+	}
+
+	certPEM = pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Certificate[0]})
+	keyPEM = pem.EncodeToMemory(keyBlock)
+	return certPEM, keyPEM, nil
+}
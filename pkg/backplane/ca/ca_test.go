@@ -17,15 +17,24 @@ limitations under the License.
 package ca
 
 import (
+	"encoding/pem"
 	"fmt"
 	"io/ioutil"
 	"math/big"
 	"net/http"
 	"net/http/httptest"
+	"strings"
 	"testing"
+	"time"
 
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
 	"crypto/tls"
 	"crypto/x509"
+	"crypto/x509/pkix"
 )
 
 func TestSerial(t *testing.T) {
@@ -85,6 +94,45 @@ func TestCA(t *testing.T) {
 	}
 }
 
+func TestServerKeyPair_multipleNames(t *testing.T) {
+	auth, err := NewAuthority()
+	if err != nil {
+		t.Fatalf("Couldn't create certificate authority")
+	}
+
+	names := []string{"master.sonobuoy.local", "10.0.0.1", "fd00::1"}
+	srvCert, err := auth.ServerKeyPair(names...)
+	if err != nil {
+		t.Fatalf("couldn't get server cert: %v", err)
+	}
+
+	for _, name := range names {
+		_, err = srvCert.Leaf.Verify(x509.VerifyOptions{
+			Roots:     auth.CACertPool(),
+			DNSName:   name,
+			KeyUsages: []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		})
+		if err != nil {
+			t.Errorf("Expected server key to verify for %v, got error %v", name, err)
+		}
+	}
+}
+
+func TestServerKeyPair_duplicateNames(t *testing.T) {
+	auth, err := NewAuthority()
+	if err != nil {
+		t.Fatalf("Couldn't create certificate authority")
+	}
+
+	srvCert, err := auth.ServerKeyPair("10.0.0.1", "sonobuoy.heptio-sonobuoy.svc", "10.0.0.1", "", "sonobuoy.heptio-sonobuoy.svc")
+	if err != nil {
+		t.Fatalf("couldn't get server cert: %v", err)
+	}
+	if len(srvCert.Leaf.IPAddresses) != 1 || len(srvCert.Leaf.DNSNames) != 1 {
+		t.Errorf("expected each name to be added once, got IPs %v and DNS names %v", srvCert.Leaf.IPAddresses, srvCert.Leaf.DNSNames)
+	}
+}
+
 func TestServer(t *testing.T) {
 	auth, err := NewAuthority()
 	if err != nil {
@@ -140,3 +188,285 @@ func TestServer(t *testing.T) {
 		t.Errorf("expected %s, got %s", testString, respBody)
 	}
 }
+
+func TestNewAuthorityWithValidity(t *testing.T) {
+	auth, err := NewAuthorityWithValidity(2*time.Hour, time.Hour)
+	if err != nil {
+		t.Fatalf("Couldn't create certificate authority: %v", err)
+	}
+
+	if lifetime := auth.CACert().NotAfter.Sub(auth.CACert().NotBefore); lifetime != 2*time.Hour {
+		t.Errorf("expected CA to be valid for 2h, got %v", lifetime)
+	}
+
+	clientCert, err := auth.ClientKeyPair("worker1.sonobuoy.local")
+	if err != nil {
+		t.Fatalf("couldn't get client cert: %v", err)
+	}
+	if lifetime := clientCert.Leaf.NotAfter.Sub(clientCert.Leaf.NotBefore); lifetime != time.Hour {
+		t.Errorf("expected client cert to be valid for 1h, got %v", lifetime)
+	}
+}
+
+func TestNewAuthorityWithValidity_capped(t *testing.T) {
+	auth, err := NewAuthorityWithValidity(time.Hour, 2*time.Hour)
+	if err != nil {
+		t.Fatalf("Couldn't create certificate authority: %v", err)
+	}
+
+	clientCert, err := auth.ClientKeyPair("worker1.sonobuoy.local")
+	if err != nil {
+		t.Fatalf("couldn't get client cert: %v", err)
+	}
+	if clientCert.Leaf.NotAfter.After(auth.CACert().NotAfter) {
+		t.Errorf("expected client cert to expire no later than the CA at %v, got %v", auth.CACert().NotAfter, clientCert.Leaf.NotAfter)
+	}
+}
+
+func TestSign(t *testing.T) {
+	auth, err := NewAuthority()
+	if err != nil {
+		t.Fatalf("Couldn't create certificate authority: %v", err)
+	}
+
+	data := []byte(`{"plugin":"e2e","status":"complete"}`)
+	sig, err := auth.Sign(data)
+	if err != nil {
+		t.Fatalf("couldn't sign data: %v", err)
+	}
+	if err := auth.CACert().CheckSignature(x509.ECDSAWithSHA256, data, sig); err != nil {
+		t.Errorf("expected signature to verify against the CA certificate: %v", err)
+	}
+	if err := auth.CACert().CheckSignature(x509.ECDSAWithSHA256, []byte("tampered"), sig); err == nil {
+		t.Error("expected signature not to verify for different data")
+	}
+}
+
+// externalCA returns a PEM encoded self-signed certificate and key for the
+// given key, after applying mut to the certificate template.
+func externalCA(t *testing.T, key crypto.Signer, mut func(*x509.Certificate)) (certPEM, keyPEM []byte) {
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(42),
+		Subject:               pkix.Name{CommonName: "corp-ca"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(24 * time.Hour),
+		IsCA:                  true,
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageDigitalSignature,
+		BasicConstraintsValid: true,
+	}
+	mut(tmpl)
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, key.Public(), key)
+	if err != nil {
+		t.Fatalf("couldn't create CA certificate: %v", err)
+	}
+	keyDER, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		t.Fatalf("couldn't marshal CA key: %v", err)
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+		pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keyDER})
+}
+
+func TestNewAuthorityFromPEM(t *testing.T) {
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("couldn't generate key: %v", err)
+	}
+	rsaKey, err := rsa.GenerateKey(rand.Reader, rsaBits)
+	if err != nil {
+		t.Fatalf("couldn't generate key: %v", err)
+	}
+
+	for name, key := range map[string]crypto.Signer{"ecdsa": ecKey, "rsa": rsaKey} {
+		t.Run(name, func(t *testing.T) {
+			certPEM, keyPEM := externalCA(t, key, func(*x509.Certificate) {})
+			auth, err := NewAuthorityFromPEM(certPEM, keyPEM, time.Hour)
+			if err != nil {
+				t.Fatalf("couldn't load certificate authority: %v", err)
+			}
+			if auth.CACert().Subject.CommonName != "corp-ca" {
+				t.Errorf("expected the provided CA certificate, got %v", auth.CACert().Subject)
+			}
+
+			cfg, err := auth.MakeServerConfig("127.0.0.1")
+			if err != nil {
+				t.Fatalf("couldn't get server config: %v", err)
+			}
+			if _, err := cfg.Certificates[0].Leaf.Verify(x509.VerifyOptions{
+				Roots:     auth.CACertPool(),
+				KeyUsages: []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+			}); err != nil {
+				t.Errorf("expected server cert to verify, got error %v", err)
+			}
+
+			c1, err := auth.ClientKeyPair("e2e")
+			if err != nil {
+				t.Fatalf("couldn't get client cert: %v", err)
+			}
+			c2, err := auth.ClientKeyPair("e2e")
+			if err != nil {
+				t.Fatalf("couldn't get client cert: %v", err)
+			}
+			if c1.Leaf.SerialNumber.Cmp(c2.Leaf.SerialNumber) == 0 {
+				t.Errorf("expected certificates to have different serials, both got %v", c1.Leaf.SerialNumber)
+			}
+		})
+	}
+}
+
+func TestNewAuthorityFromPEM_invalid(t *testing.T) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("couldn't generate key: %v", err)
+	}
+	otherKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("couldn't generate key: %v", err)
+	}
+	_, otherKeyPEM := externalCA(t, otherKey, func(*x509.Certificate) {})
+	otherRSAKey, err := rsa.GenerateKey(rand.Reader, rsaBits)
+	if err != nil {
+		t.Fatalf("couldn't generate key: %v", err)
+	}
+	_, otherRSAKeyPEM := externalCA(t, otherRSAKey, func(*x509.Certificate) {})
+
+	testCases := []struct {
+		desc      string
+		mut       func(*x509.Certificate)
+		keyPEM    []byte
+		expectErr string
+	}{
+		{
+			desc:      "not a CA",
+			mut:       func(c *x509.Certificate) { c.IsCA = false },
+			expectErr: "isn't a CA certificate",
+		}, {
+			desc:      "no cert signing usage",
+			mut:       func(c *x509.Certificate) { c.KeyUsage = x509.KeyUsageDigitalSignature },
+			expectErr: "isn't allowed to sign certificates",
+		}, {
+			desc:      "expired",
+			mut:       func(c *x509.Certificate) { c.NotAfter = time.Now().Add(-time.Minute) },
+			expectErr: "is only valid from",
+		}, {
+			desc:      "server auth only",
+			mut:       func(c *x509.Certificate) { c.ExtKeyUsage = []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth} },
+			expectErr: "doesn't verify against the CA",
+		}, {
+			desc:      "mismatched key",
+			mut:       func(*x509.Certificate) {},
+			keyPEM:    otherKeyPEM,
+			expectErr: "doesn't match the certificate",
+		}, {
+			desc:      "mismatched key type",
+			mut:       func(*x509.Certificate) {},
+			keyPEM:    otherRSAKeyPEM,
+			expectErr: "doesn't match the certificate",
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.desc, func(t *testing.T) {
+			certPEM, keyPEM := externalCA(t, key, tc.mut)
+			if tc.keyPEM != nil {
+				keyPEM = tc.keyPEM
+			}
+			_, err := NewAuthorityFromPEM(certPEM, keyPEM, time.Hour)
+			if err == nil || !strings.Contains(err.Error(), tc.expectErr) {
+				t.Errorf("expected error containing %q, got %v", tc.expectErr, err)
+			}
+		})
+	}
+}
+
+func TestSign_rsa(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, rsaBits)
+	if err != nil {
+		t.Fatalf("couldn't generate key: %v", err)
+	}
+	certPEM, keyPEM := externalCA(t, key, func(*x509.Certificate) {})
+	auth, err := NewAuthorityFromPEM(certPEM, keyPEM, time.Hour)
+	if err != nil {
+		t.Fatalf("couldn't load certificate authority: %v", err)
+	}
+
+	data := []byte(`{"plugin":"e2e","status":"complete"}`)
+	sig, err := auth.Sign(data)
+	if err != nil {
+		t.Fatalf("couldn't sign data: %v", err)
+	}
+	if err := auth.CACert().CheckSignature(x509.SHA256WithRSA, data, sig); err != nil {
+		t.Errorf("expected signature to verify against the CA certificate: %v", err)
+	}
+}
+
+func TestNewAuthorityWithKeyType(t *testing.T) {
+	for _, keyType := range []KeyType{KeyTypeECDSA, KeyTypeRSA} {
+		t.Run(string(keyType), func(t *testing.T) {
+			auth, err := NewAuthorityWithKeyType(keyType, time.Hour, time.Hour)
+			if err != nil {
+				t.Fatalf("Couldn't create certificate authority: %v", err)
+			}
+
+			cfg, err := auth.MakeServerConfig("127.0.0.1")
+			if err != nil {
+				t.Fatalf("Couldn't get server config %v", err)
+			}
+			srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				fmt.Fprint(w, r.TLS.PeerCertificates[0].Subject.CommonName)
+			}))
+			srv.TLS = cfg
+			srv.StartTLS()
+			defer srv.Close()
+
+			clientCert, err := auth.ClientKeyPair("client1.local")
+			if err != nil {
+				t.Fatalf("couldn't get client cert %v", err)
+			}
+			for _, cert := range []*x509.Certificate{auth.CACert(), cfg.Certificates[0].Leaf, clientCert.Leaf} {
+				if got := publicKeyType(cert.PublicKey); got != keyType {
+					t.Errorf("expected %v certificate to have a %v key, got %v", cert.Subject.CommonName, keyType, got)
+				}
+			}
+
+			// The client uses its certificate as a worker would, after
+			// being PEM encoded into the plugin's secret.
+			certPEM, keyPEM, err := EncodePEM(clientCert)
+			if err != nil {
+				t.Fatalf("couldn't encode client cert: %v", err)
+			}
+			pair, err := tls.X509KeyPair(certPEM, keyPEM)
+			if err != nil {
+				t.Fatalf("couldn't parse encoded client cert: %v", err)
+			}
+			client := &http.Client{Transport: &http.Transport{
+				TLSClientConfig: &tls.Config{
+					Certificates: []tls.Certificate{pair},
+					RootCAs:      auth.CACertPool(),
+				},
+			}}
+			resp, err := client.Get(srv.URL)
+			if err != nil {
+				t.Fatalf("expected handshake to succeed, got %v", err)
+			}
+			defer resp.Body.Close()
+			body, err := ioutil.ReadAll(resp.Body)
+			if err != nil {
+				t.Fatalf("couldn't read body: %v", err)
+			}
+			if string(body) != "client1.local" {
+				t.Errorf("expected server to see client1.local, got %q", body)
+			}
+		})
+	}
+}
+
+func publicKeyType(pub crypto.PublicKey) KeyType {
+	switch pub.(type) {
+	case *ecdsa.PublicKey:
+		return KeyTypeECDSA
+	case *rsa.PublicKey:
+		return KeyTypeRSA
+	}
+	return ""
+}
@@ -0,0 +1,133 @@
+/*
+Copyright 2018 Heptio Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package ca
+
+import (
+	"crypto/tls"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+var (
+	// tlsVersions are the TLS versions which may be configured.
+	tlsVersions = map[string]uint16{
+		"1.2": tls.VersionTLS12,
+		"1.3": tls.VersionTLS13,
+	}
+
+	// DefaultCipherSuites are the TLS 1.2 cipher suites used unless
+	// configured otherwise: ECDHE key exchange with AEAD ciphers only.
+	DefaultCipherSuites = []uint16{
+		tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256,
+		tls.TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384,
+		tls.TLS_ECDHE_ECDSA_WITH_CHACHA20_POLY1305,
+		tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256,
+		tls.TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384,
+		tls.TLS_ECDHE_RSA_WITH_CHACHA20_POLY1305,
+	}
+
+	// cipherSuites are the cipher suites Go implements which aren't
+	// insecure, by name. The ChaCha20-Poly1305 suites can be named with or
+	// without the _SHA256 suffix later Go releases added.
+	cipherSuites = map[string]uint16{
+		"TLS_RSA_WITH_AES_128_CBC_SHA":                  tls.TLS_RSA_WITH_AES_128_CBC_SHA,
+		"TLS_RSA_WITH_AES_256_CBC_SHA":                  tls.TLS_RSA_WITH_AES_256_CBC_SHA,
+		"TLS_RSA_WITH_AES_128_GCM_SHA256":               tls.TLS_RSA_WITH_AES_128_GCM_SHA256,
+		"TLS_RSA_WITH_AES_256_GCM_SHA384":               tls.TLS_RSA_WITH_AES_256_GCM_SHA384,
+		"TLS_ECDHE_ECDSA_WITH_AES_128_CBC_SHA":          tls.TLS_ECDHE_ECDSA_WITH_AES_128_CBC_SHA,
+		"TLS_ECDHE_ECDSA_WITH_AES_256_CBC_SHA":          tls.TLS_ECDHE_ECDSA_WITH_AES_256_CBC_SHA,
+		"TLS_ECDHE_RSA_WITH_AES_128_CBC_SHA":            tls.TLS_ECDHE_RSA_WITH_AES_128_CBC_SHA,
+		"TLS_ECDHE_RSA_WITH_AES_256_CBC_SHA":            tls.TLS_ECDHE_RSA_WITH_AES_256_CBC_SHA,
+		"TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256":       tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256,
+		"TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384":       tls.TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384,
+		"TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256":         tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256,
+		"TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384":         tls.TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384,
+		"TLS_ECDHE_ECDSA_WITH_CHACHA20_POLY1305":        tls.TLS_ECDHE_ECDSA_WITH_CHACHA20_POLY1305,
+		"TLS_ECDHE_ECDSA_WITH_CHACHA20_POLY1305_SHA256": tls.TLS_ECDHE_ECDSA_WITH_CHACHA20_POLY1305,
+		"TLS_ECDHE_RSA_WITH_CHACHA20_POLY1305":          tls.TLS_ECDHE_RSA_WITH_CHACHA20_POLY1305,
+		"TLS_ECDHE_RSA_WITH_CHACHA20_POLY1305_SHA256":   tls.TLS_ECDHE_RSA_WITH_CHACHA20_POLY1305,
+		"TLS_AES_128_GCM_SHA256":                        tls.TLS_AES_128_GCM_SHA256,
+		"TLS_AES_256_GCM_SHA384":                        tls.TLS_AES_256_GCM_SHA384,
+		"TLS_CHACHA20_POLY1305_SHA256":                  tls.TLS_CHACHA20_POLY1305_SHA256,
+	}
+
+	// insecureCipherSuites are the cipher suites Go implements which have
+	// known weaknesses, such as RC4, 3DES and CBC with SHA-256.
+	insecureCipherSuites = map[string]bool{
+		"TLS_RSA_WITH_RC4_128_SHA":                true,
+		"TLS_RSA_WITH_3DES_EDE_CBC_SHA":           true,
+		"TLS_RSA_WITH_AES_128_CBC_SHA256":         true,
+		"TLS_ECDHE_ECDSA_WITH_RC4_128_SHA":        true,
+		"TLS_ECDHE_RSA_WITH_RC4_128_SHA":          true,
+		"TLS_ECDHE_RSA_WITH_3DES_EDE_CBC_SHA":     true,
+		"TLS_ECDHE_ECDSA_WITH_AES_128_CBC_SHA256": true,
+		"TLS_ECDHE_RSA_WITH_AES_128_CBC_SHA256":   true,
+	}
+)
+
+// TLSOptions restrict the TLS connections made between the aggregator and
+// workers. The zero value uses TLS 1.2 or later with DefaultCipherSuites.
+type TLSOptions struct {
+	// MinVersion is the minimum TLS version, e.g. tls.VersionTLS12.
+	MinVersion uint16
+	// CipherSuites are the cipher suites allowed for TLS 1.2. Go doesn't
+	// allow the TLS 1.3 suites to be configured, they're all secure.
+	CipherSuites []uint16
+}
+
+// ParseTLSOptions parses a minimum TLS version ("1.2" or "1.3") and the Go
+// names of cipher suites, e.g. "TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256".
+// Empty values are left as the defaults. Versions before TLS 1.2, suites Go
+// considers insecure and suites without forward secrecy are rejected.
+func ParseTLSOptions(minVersion string, suites []string) (TLSOptions, error) {
+	var opts TLSOptions
+	if minVersion != "" {
+		version, ok := tlsVersions[minVersion]
+		if !ok {
+			return TLSOptions{}, errors.Errorf("minimum TLS version must be 1.2 or 1.3, got %q", minVersion)
+		}
+		opts.MinVersion = version
+	}
+
+	for _, name := range suites {
+		id, ok := cipherSuites[name]
+		switch {
+		case insecureCipherSuites[name]:
+			return TLSOptions{}, errors.Errorf("cipher suite %v is insecure", name)
+		case !ok:
+			return TLSOptions{}, errors.Errorf("unknown cipher suite %q", name)
+		case strings.HasPrefix(name, "TLS_RSA_"):
+			return TLSOptions{}, errors.Errorf("cipher suite %v doesn't provide forward secrecy", name)
+		}
+		opts.CipherSuites = append(opts.CipherSuites, id)
+	}
+	return opts, nil
+}
+
+// Apply sets the minimum version and cipher suites on the given config,
+// using the defaults for any which aren't set.
+func (o TLSOptions) Apply(cfg *tls.Config) {
+	cfg.MinVersion = o.MinVersion
+	if cfg.MinVersion == 0 {
+		cfg.MinVersion = tls.VersionTLS12
+	}
+	cfg.CipherSuites = o.CipherSuites
+	if len(cfg.CipherSuites) == 0 {
+		cfg.CipherSuites = DefaultCipherSuites
+	}
+}
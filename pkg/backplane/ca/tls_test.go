@@ -0,0 +1,134 @@
+/*
+Copyright 2018 Heptio Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package ca
+
+import (
+	"crypto/tls"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestParseTLSOptions(t *testing.T) {
+	testCases := []struct {
+		desc         string
+		minVersion   string
+		cipherSuites []string
+		expected     TLSOptions
+		expectErr    bool
+	}{
+		{
+			desc: "defaults",
+		}, {
+			desc:         "configured",
+			minVersion:   "1.3",
+			cipherSuites: []string{"TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384"},
+			expected: TLSOptions{
+				MinVersion:   tls.VersionTLS13,
+				CipherSuites: []uint16{tls.TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384},
+			},
+		}, {
+			desc:         "ChaCha20-Poly1305 by either name",
+			cipherSuites: []string{"TLS_ECDHE_ECDSA_WITH_CHACHA20_POLY1305", "TLS_ECDHE_RSA_WITH_CHACHA20_POLY1305_SHA256"},
+			expected: TLSOptions{
+				CipherSuites: []uint16{tls.TLS_ECDHE_ECDSA_WITH_CHACHA20_POLY1305, tls.TLS_ECDHE_RSA_WITH_CHACHA20_POLY1305},
+			},
+		}, {
+			desc:       "TLS 1.1",
+			minVersion: "1.1",
+			expectErr:  true,
+		}, {
+			desc:         "insecure suite",
+			cipherSuites: []string{"TLS_ECDHE_RSA_WITH_RC4_128_SHA"},
+			expectErr:    true,
+		}, {
+			desc:         "insecure CBC suite",
+			cipherSuites: []string{"TLS_ECDHE_RSA_WITH_AES_128_CBC_SHA256"},
+			expectErr:    true,
+		}, {
+			desc:         "no forward secrecy",
+			cipherSuites: []string{"TLS_RSA_WITH_AES_128_GCM_SHA256"},
+			expectErr:    true,
+		}, {
+			desc:         "unknown suite",
+			cipherSuites: []string{"TLS_MADE_UP"},
+			expectErr:    true,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.desc, func(t *testing.T) {
+			opts, err := ParseTLSOptions(tc.minVersion, tc.cipherSuites)
+			if tc.expectErr != (err != nil) {
+				t.Fatalf("expected error %v, got %v", tc.expectErr, err)
+			}
+			if opts.MinVersion != tc.expected.MinVersion || len(opts.CipherSuites) != len(tc.expected.CipherSuites) {
+				t.Fatalf("expected %+v, got %+v", tc.expected, opts)
+			}
+			for i := range opts.CipherSuites {
+				if opts.CipherSuites[i] != tc.expected.CipherSuites[i] {
+					t.Errorf("expected %+v, got %+v", tc.expected, opts)
+				}
+			}
+		})
+	}
+}
+
+func TestMakeServerConfigWithOptions(t *testing.T) {
+	auth, err := NewAuthority()
+	if err != nil {
+		t.Fatalf("Couldn't create certificate authority: %v", err)
+	}
+
+	cfg, err := auth.MakeServerConfig("127.0.0.1")
+	if err != nil {
+		t.Fatalf("Couldn't get server config %v", err)
+	}
+	if cfg.MinVersion != tls.VersionTLS12 || len(cfg.CipherSuites) != len(DefaultCipherSuites) {
+		t.Errorf("expected TLS 1.2 and the default cipher suites, got %x and %x", cfg.MinVersion, cfg.CipherSuites)
+	}
+
+	cfg, err = auth.MakeServerConfigWithOptions(TLSOptions{MinVersion: tls.VersionTLS13}, "127.0.0.1")
+	if err != nil {
+		t.Fatalf("Couldn't get server config %v", err)
+	}
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(http.ResponseWriter, *http.Request) {}))
+	srv.TLS = cfg
+	srv.StartTLS()
+	defer srv.Close()
+
+	clientCert, err := auth.ClientKeyPair("client1.local")
+	if err != nil {
+		t.Fatalf("couldn't get client cert %v", err)
+	}
+	for _, version := range []uint16{tls.VersionTLS12, tls.VersionTLS13} {
+		client := &http.Client{Transport: &http.Transport{
+			TLSClientConfig: &tls.Config{
+				Certificates: []tls.Certificate{*clientCert},
+				RootCAs:      auth.CACertPool(),
+				MaxVersion:   version,
+			},
+		}}
+		resp, err := client.Get(srv.URL)
+		if err == nil {
+			resp.Body.Close()
+		}
+		if ok := version == tls.VersionTLS13; ok != (err == nil) {
+			t.Errorf("expected a TLS %x client to connect: %v, got error %v", version, ok, err)
+		}
+	}
+}
@@ -96,6 +96,15 @@ type DeleteConfig struct {
 type RetrieveConfig struct {
 	// Namespace is the namespace the sonobuoy aggregator is running in.
 	Namespace string
+	// Plugin is the name of the plugin whose results RetrieveResultFiles
+	// retrieves.
+	Plugin string
+	// Node, if set, limits RetrieveResultFiles to the plugin's results from
+	// that node.
+	Node string
+	// DecryptionKey is the secret the results were encrypted with, if the
+	// aggregator was configured to encrypt them.
+	DecryptionKey []byte
 }
 
 // PreflightConfig are the options passed to PreflightChecks.
@@ -154,6 +163,12 @@ type Interface interface {
 	GenerateManifest(cfg *GenConfig) ([]byte, error)
 	// RetrieveResults copies results from a sonobuoy run into a Reader in tar format.
 	RetrieveResults(cfg *RetrieveConfig) (io.Reader, <-chan error)
+	// RetrieveFile copies a single file of the results tarball into a
+	// Reader, starting at the given offset.
+	RetrieveFile(cfg *RetrieveConfig, name string, offset int64) (io.Reader, <-chan error)
+	// RetrieveResultFiles copies the files of one plugin's results, or just
+	// those of one node, into a directory without the rest of the tarball.
+	RetrieveResultFiles(cfg *RetrieveConfig, outDir string) ([]string, error)
 	// GetStatus determines the status of the sonobuoy run in order to assist the user.
 	GetStatus(namespace string) (*aggregation.Status, error)
 	// LogReader returns a reader that contains a merged stream of sonobuoy logs.
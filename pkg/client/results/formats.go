@@ -0,0 +1,123 @@
+/*
+Copyright 2018 Heptio Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package results
+
+import (
+	"encoding/json"
+	"encoding/xml"
+	"io"
+	"io/ioutil"
+	"sync"
+
+	"github.com/heptio/sonobuoy/pkg/plugin"
+	"github.com/onsi/ginkgo/reporters"
+	"github.com/pkg/errors"
+)
+
+// FormatReader parses a result file of a particular format, as recorded in
+// the results manifest.
+type FormatReader func(r io.Reader) (interface{}, error)
+
+var formatReaders = struct {
+	sync.RWMutex
+	readers map[string]FormatReader
+}{
+	readers: map[string]FormatReader{
+		plugin.ResultFormatRaw:   ReadRaw,
+		plugin.ResultFormatJUnit: ReadJUnit,
+		plugin.ResultFormatSARIF: ReadSARIF,
+	},
+}
+
+// RegisterFormat registers the reader for results of the given format,
+// replacing any reader already registered for it.
+func RegisterFormat(format string, reader FormatReader) {
+	formatReaders.Lock()
+	defer formatReaders.Unlock()
+	formatReaders.readers[format] = reader
+}
+
+// FormatReaderFor returns the reader registered for the given format.
+// Formats without a reader are read as raw results.
+func FormatReaderFor(format string) FormatReader {
+	formatReaders.RLock()
+	defer formatReaders.RUnlock()
+	if reader, ok := formatReaders.readers[format]; ok {
+		return reader
+	}
+	return ReadRaw
+}
+
+// ReadResult parses a result file with the reader for its format.
+func ReadResult(format string, r io.Reader) (interface{}, error) {
+	return FormatReaderFor(format)(r)
+}
+
+// ReadRaw reads a raw result, returning its contents as a []byte.
+func ReadRaw(r io.Reader) (interface{}, error) {
+	blob, err := ioutil.ReadAll(r)
+	return blob, errors.Wrap(err, "couldn't read result")
+}
+
+// ReadJUnit reads a JUnit XML result, returning a reporters.JUnitTestSuite.
+func ReadJUnit(r io.Reader) (interface{}, error) {
+	var suite reporters.JUnitTestSuite
+	if err := xml.NewDecoder(r).Decode(&suite); err != nil {
+		return nil, errors.Wrap(err, "couldn't decode JUnit result")
+	}
+	return suite, nil
+}
+
+// SARIFLog is the subset of a SARIF static analysis report needed to
+// summarize what was found.
+type SARIFLog struct {
+	Version string     `json:"version"`
+	Runs    []SARIFRun `json:"runs"`
+}
+
+// SARIFRun is a single run of an analysis tool.
+type SARIFRun struct {
+	Tool struct {
+		Driver struct {
+			Name    string `json:"name"`
+			Version string `json:"version,omitempty"`
+		} `json:"driver"`
+	} `json:"tool"`
+	Results []SARIFResult `json:"results"`
+}
+
+// SARIFResult is a single issue found by an analysis tool.
+type SARIFResult struct {
+	RuleID string `json:"ruleId"`
+	// Level is "error", "warning", "note" or "none".
+	Level   string `json:"level,omitempty"`
+	Message struct {
+		Text string `json:"text"`
+	} `json:"message"`
+}
+
+// ReadSARIF reads a SARIF result, returning a SARIFLog.
+func ReadSARIF(r io.Reader) (interface{}, error) {
+	var log SARIFLog
+	if err := json.NewDecoder(r).Decode(&log); err != nil {
+		return nil, errors.Wrap(err, "couldn't decode SARIF result")
+	}
+	if log.Version == "" {
+		return nil, errors.New("couldn't decode SARIF result: missing version")
+	}
+	return log, nil
+}
@@ -0,0 +1,76 @@
+/*
+Copyright 2018 Heptio Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package results_test
+
+import (
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/heptio/sonobuoy/pkg/client/results"
+	"github.com/heptio/sonobuoy/pkg/plugin"
+	"github.com/onsi/ginkgo/reporters"
+)
+
+const sarifResult = `{
+  "version": "2.1.0",
+  "runs": [{
+    "tool": {"driver": {"name": "kube-scan", "version": "1.2.0"}},
+    "results": [{"ruleId": "privileged-container", "level": "error", "message": {"text": "Container runs as privileged"}}]
+  }]
+}`
+
+func TestReadResult(t *testing.T) {
+	junit, err := results.ReadResult(plugin.ResultFormatJUnit, strings.NewReader(`<testsuite tests="1"><testcase name="passes"></testcase></testsuite>`))
+	if suite, ok := junit.(reporters.JUnitTestSuite); err != nil || !ok || len(suite.TestCases) != 1 || suite.TestCases[0].Name != "passes" {
+		t.Errorf("expected a JUnit test suite, got %+v: %v", junit, err)
+	}
+
+	sarif, err := results.ReadResult(plugin.ResultFormatSARIF, strings.NewReader(sarifResult))
+	log, ok := sarif.(results.SARIFLog)
+	if err != nil || !ok || len(log.Runs) != 1 || log.Runs[0].Tool.Driver.Name != "kube-scan" {
+		t.Fatalf("expected a SARIF log, got %+v: %v", sarif, err)
+	}
+	if issues := log.Runs[0].Results; len(issues) != 1 || issues[0].RuleID != "privileged-container" || issues[0].Level != "error" || issues[0].Message.Text != "Container runs as privileged" {
+		t.Errorf("unexpected SARIF results %+v", issues)
+	}
+
+	if _, err := results.ReadResult(plugin.ResultFormatSARIF, strings.NewReader(`{"runs": []}`)); err == nil {
+		t.Error("expected an error for a SARIF result without a version")
+	}
+
+	// Formats without a reader are passed through
+	raw, err := results.ReadResult("journald", strings.NewReader("some logs"))
+	if blob, ok := raw.([]byte); err != nil || !ok || string(blob) != "some logs" {
+		t.Errorf("expected an unknown format to be read as raw, got %+v: %v", raw, err)
+	}
+}
+
+func TestRegisterFormat(t *testing.T) {
+	results.RegisterFormat("lines", func(r io.Reader) (interface{}, error) {
+		blob, err := results.ReadRaw(r)
+		if err != nil {
+			return nil, err
+		}
+		return strings.Split(string(blob.([]byte)), "\n"), nil
+	})
+
+	lines, err := results.ReadResult("lines", strings.NewReader("a\nb"))
+	if got, ok := lines.([]string); err != nil || !ok || len(got) != 2 {
+		t.Errorf("expected the registered reader to be used, got %+v: %v", lines, err)
+	}
+}
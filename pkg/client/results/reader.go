@@ -18,16 +18,20 @@ package results
 
 import (
 	"archive/tar"
+	"bufio"
 	"bytes"
 	"compress/gzip"
 	"encoding/json"
 	"encoding/xml"
 	"io"
+	"io/ioutil"
 	"os"
 	"path/filepath"
 	"strings"
 
 	"github.com/heptio/sonobuoy/pkg/config"
+	"github.com/heptio/sonobuoy/pkg/encryption"
+	"github.com/klauspost/compress/zstd"
 	"github.com/pkg/errors"
 )
 
@@ -75,27 +79,92 @@ func NewReaderWithVersion(reader io.Reader, version string) *Reader {
 // NewReaderFromBytes is a helper constructor that will discover the version of the archive
 // and return a new Reader with the correct version already populated.
 func NewReaderFromBytes(data []byte) (*Reader, error) {
-	r := bytes.NewReader(data)
-	gzipReader, err := gzip.NewReader(r)
+	tr, err := Decompress(bytes.NewReader(data))
 	if err != nil {
-		return nil, errors.Wrap(err, "error creating new gzip reader")
+		return nil, err
 	}
-	version, err := DiscoverVersion(gzipReader)
+	version, err := DiscoverVersion(tr)
 	if err != nil {
 		return nil, errors.Wrap(err, "error discovering version")
 	}
-	if _, err = r.Seek(0, io.SeekStart); err != nil {
-		return nil, errors.Wrap(err, "error seeking to start")
-	}
-	if err = gzipReader.Reset(r); err != nil {
-		return nil, errors.Wrap(err, "error reseting gzip reader")
+	if tr, err = Decompress(bytes.NewReader(data)); err != nil {
+		return nil, err
 	}
 	return &Reader{
-		Reader:  gzipReader,
+		Reader:  tr,
 		Version: version,
 	}, nil
 }
 
+var (
+	gzipMagic = []byte{0x1f, 0x8b}
+	zstdMagic = []byte{0x28, 0xb5, 0x2f, 0xfd}
+)
+
+// DetectCompression returns how a results archive starting with the given
+// bytes was compressed (see config.ResultsCompression). Archives which don't
+// start with a known magic number are taken to be uncompressed tarballs.
+func DetectCompression(magic []byte) string {
+	switch {
+	case bytes.HasPrefix(magic, gzipMagic):
+		return config.CompressionGzip
+	case bytes.HasPrefix(magic, zstdMagic):
+		return config.CompressionZstd
+	default:
+		return config.CompressionNone
+	}
+}
+
+// Decompress returns a reader of the tar stream in a results archive,
+// detecting how the archive was compressed from its first bytes.
+func Decompress(r io.Reader) (io.ReadCloser, error) {
+	br := bufio.NewReader(r)
+	magic, err := br.Peek(len(zstdMagic))
+	if err != nil && err != io.EOF {
+		return nil, errors.Wrap(err, "couldn't read results archive")
+	}
+	switch DetectCompression(magic) {
+	case config.CompressionGzip:
+		gz, err := gzip.NewReader(br)
+		return gz, errors.Wrap(err, "error creating new gzip reader")
+	case config.CompressionZstd:
+		zr, err := zstd.NewReader(br)
+		if err != nil {
+			return nil, errors.Wrap(err, "error creating new zstd reader")
+		}
+		return zr.IOReadCloser(), nil
+	default:
+		return ioutil.NopCloser(br), nil
+	}
+}
+
+// Compress returns a writer which compresses what's written to it into w
+// with the given compression (see config.ResultsCompression). It must be
+// closed to flush the compressed stream, which doesn't close w.
+func Compress(w io.Writer, compression string) (io.WriteCloser, error) {
+	switch compression {
+	case "", config.CompressionGzip:
+		return gzip.NewWriter(w), nil
+	case config.CompressionZstd:
+		zw, err := zstd.NewWriter(w)
+		if err != nil {
+			return nil, errors.Wrap(err, "error creating new zstd writer")
+		}
+		return zw, nil
+	case config.CompressionNone:
+		return nopWriteCloser{w}, nil
+	default:
+		return nil, errors.Errorf("unknown results compression %q", compression)
+	}
+}
+
+// nopWriteCloser is a WriteCloser whose Close does nothing.
+type nopWriteCloser struct {
+	io.Writer
+}
+
+func (nopWriteCloser) Close() error { return nil }
+
 // DiscoverVersion takes a Sonobuoy archive stream and extracts just the
 // version of the archive.
 func DiscoverVersion(reader io.Reader) (string, error) {
@@ -140,7 +209,8 @@ func (t *tarFileInfo) Sys() interface{} {
 	return t.Reader
 }
 
-// WalkFiles walks all of the files in the archive.
+// WalkFiles walks all of the files in the archive, stopping at the first
+// error walkfn returns.
 func (r *Reader) WalkFiles(walkfn filepath.WalkFunc) error {
 	tr := tar.NewReader(r)
 	var err error
@@ -157,7 +227,9 @@ func (r *Reader) WalkFiles(walkfn filepath.WalkFunc) error {
 			header.FileInfo(),
 			tr,
 		}
-		err = walkfn(filepath.Clean(header.Name), info, err)
+		if err = walkfn(filepath.Clean(header.Name), info, err); err != nil {
+			return err
+		}
 	}
 	return nil
 }
@@ -167,11 +239,11 @@ func (r *Reader) WalkFiles(walkfn filepath.WalkFunc) error {
 // ExtractBytes pulls out bytes into a buffer for any path matching file.
 func ExtractBytes(file string, path string, info os.FileInfo, buf *bytes.Buffer) error {
 	if file == path {
-		reader, ok := info.Sys().(io.Reader)
-		if !ok {
-			return errors.New("info.Sys() is not a reader")
+		reader, err := fileReader(path, info)
+		if err != nil {
+			return err
 		}
-		_, err := buf.ReadFrom(reader)
+		_, err = buf.ReadFrom(reader)
 		if err != nil {
 			return errors.Wrap(err, "could not read from buffer")
 		}
@@ -184,9 +256,9 @@ func ExtractBytes(file string, path string, info os.FileInfo, buf *bytes.Buffer)
 // interface passed in (generally a pointer to a struct/slice).
 func ExtractIntoStruct(predicate func(string) bool, path string, info os.FileInfo, object interface{}) error {
 	if predicate(path) {
-		reader, ok := info.Sys().(io.Reader)
-		if !ok {
-			return errors.New("info.Sys() is not a reader")
+		reader, err := fileReader(path, info)
+		if err != nil {
+			return err
 		}
 		// TODO(chuckha) Perhaps find a more robust way to handle different data formats.
 		if strings.HasSuffix(path, "xml") {
@@ -206,6 +278,24 @@ func ExtractIntoStruct(predicate func(string) bool, path string, info os.FileInf
 	return nil
 }
 
+// fileReader returns a reader of the contents of a file in the archive. It
+// fails if the file was encrypted, since it can't be read as it is.
+func fileReader(path string, info os.FileInfo) (io.Reader, error) {
+	reader, ok := info.Sys().(io.Reader)
+	if !ok {
+		return nil, errors.New("info.Sys() is not a reader")
+	}
+	br := bufio.NewReader(reader)
+	encrypted, err := encryption.IsEncrypted(br)
+	if err != nil {
+		return nil, errors.Wrapf(err, "couldn't read %v", path)
+	}
+	if encrypted {
+		return nil, errors.Errorf("%v is encrypted, decrypt the results with the key they were encrypted with to read it", path)
+	}
+	return br, nil
+}
+
 // ExtractFileIntoStruct is a helper for a common use case of extracting
 // the contents of one file into the object.
 func ExtractFileIntoStruct(file, path string, info os.FileInfo, object interface{}) error {
@@ -261,6 +351,18 @@ func (r *Reader) NodesFile() string {
 	return filepath.Join(r.NonNamespacedResources(), defaultNodesFile)
 }
 
+// ExpectedResultsFile returns the path to the file listing every plugin result
+// the run expected, including the node for node-specific results.
+func (r *Reader) ExpectedResultsFile() string {
+	return filepath.Join(metadataDir, "expected.json")
+}
+
+// ResultsManifestFile returns the path to the file describing each plugin
+// result the aggregator received, including its files, size and status.
+func (r *Reader) ResultsManifestFile() string {
+	return filepath.Join(metadataDir, "results.json")
+}
+
 // ServerGroupsFile returns the path to the groups the Kubernetes API supported at the time of the run.
 func (r *Reader) ServerGroupsFile() string {
 	return defaultServerGroupsFile
@@ -17,6 +17,7 @@ limitations under the License.
 package results_test
 
 import (
+	"archive/tar"
 	"bytes"
 	"compress/gzip"
 	"fmt"
@@ -24,11 +25,14 @@ import (
 	"io/ioutil"
 	"os"
 	"path/filepath"
+	"strings"
 	"testing"
 
 	v1 "k8s.io/api/core/v1"
 
 	"github.com/heptio/sonobuoy/pkg/client/results"
+	"github.com/heptio/sonobuoy/pkg/config"
+	"github.com/heptio/sonobuoy/pkg/encryption"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	k8sver "k8s.io/apimachinery/pkg/version"
 )
@@ -343,6 +347,116 @@ func TestExtractBytes(t *testing.T) {
 	}
 }
 
+func TestExtractBytes_encrypted(t *testing.T) {
+	r, err := encryption.NewEncrypter(strings.NewReader("<testsuite/>"), []byte("s3cret"))
+	if err != nil {
+		t.Fatalf("couldn't encrypt: %v", err)
+	}
+	sealed, err := ioutil.ReadAll(r)
+	if err != nil {
+		t.Fatalf("couldn't encrypt: %v", err)
+	}
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	tw.WriteHeader(&tar.Header{Name: "plugins/e2e/results/junit.xml", Mode: 0644, Size: int64(len(sealed)), Typeflag: tar.TypeReg})
+	tw.Write(sealed)
+	tw.Close()
+
+	reader := results.NewReaderWithVersion(&buf, results.VersionTen)
+	var out bytes.Buffer
+	err = reader.WalkFiles(func(path string, info os.FileInfo, err error) error {
+		return results.ExtractBytes("plugins/e2e/results/junit.xml", path, info, &out)
+	})
+	if err == nil || !strings.Contains(err.Error(), "is encrypted") {
+		t.Errorf("expected an error reading an encrypted file, got %v", err)
+	}
+}
+
+func TestNewReaderFromBytes_compression(t *testing.T) {
+	gzipped, err := ioutil.ReadFile("testdata/results-0.10.tar.gz")
+	if err != nil {
+		t.Fatalf("Failed to read tarball data: %v", err)
+	}
+	gzr, err := gzip.NewReader(bytes.NewReader(gzipped))
+	if err != nil {
+		t.Fatalf("failed to get a gzip reader: %v", err)
+	}
+	uncompressed, err := ioutil.ReadAll(gzr)
+	if err != nil {
+		t.Fatalf("failed to decompress tarball: %v", err)
+	}
+
+	var zstded bytes.Buffer
+	zw, err := results.Compress(&zstded, config.CompressionZstd)
+	if err != nil {
+		t.Fatalf("failed to get a zstd writer: %v", err)
+	}
+	zw.Write(uncompressed)
+	if err := zw.Close(); err != nil {
+		t.Fatalf("failed to compress tarball: %v", err)
+	}
+
+	for desc, data := range map[string][]byte{"gzip": gzipped, "zstd": zstded.Bytes(), "none": uncompressed} {
+		r, err := results.NewReaderFromBytes(data)
+		if err != nil {
+			t.Errorf("unexpected error reading %v archive: %v", desc, err)
+			continue
+		}
+		if r.Version != results.VersionTen {
+			t.Errorf("expected version %v of %v archive, got %v", results.VersionTen, desc, r.Version)
+		}
+	}
+}
+
+func TestCompress(t *testing.T) {
+	data := []byte(strings.Repeat("results of a plugin\n", 1000))
+	testCases := []struct {
+		compression string
+		detected    string
+	}{
+		{compression: "", detected: config.CompressionGzip},
+		{compression: config.CompressionGzip, detected: config.CompressionGzip},
+		{compression: config.CompressionZstd, detected: config.CompressionZstd},
+		{compression: config.CompressionNone, detected: config.CompressionNone},
+	}
+
+	for _, tc := range testCases {
+		t.Run(fmt.Sprintf("%q", tc.compression), func(t *testing.T) {
+			var buf bytes.Buffer
+			w, err := results.Compress(&buf, tc.compression)
+			if err != nil {
+				t.Fatalf("unexpected error getting writer: %v", err)
+			}
+			if _, err := w.Write(data); err != nil {
+				t.Fatalf("unexpected error writing: %v", err)
+			}
+			if err := w.Close(); err != nil {
+				t.Fatalf("unexpected error closing writer: %v", err)
+			}
+
+			if got := results.DetectCompression(buf.Bytes()); got != tc.detected {
+				t.Errorf("expected compression %v to be detected, got %v", tc.detected, got)
+			}
+			r, err := results.Decompress(&buf)
+			if err != nil {
+				t.Fatalf("unexpected error decompressing: %v", err)
+			}
+			defer r.Close()
+			got, err := ioutil.ReadAll(r)
+			if err != nil {
+				t.Fatalf("unexpected error reading: %v", err)
+			}
+			if !bytes.Equal(got, data) {
+				t.Errorf("expected %v bytes to round-trip, got %v different bytes", len(data), len(got))
+			}
+		})
+	}
+
+	if _, err := results.Compress(ioutil.Discard, "bzip2"); err == nil {
+		t.Error("expected an error compressing with an unknown compression")
+	}
+}
+
 func ExampleNewReaderFromBytes() {
 	path := "testdata/results-0.8.tar.gz"
 	data, err := ioutil.ReadFile(path)
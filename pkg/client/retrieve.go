@@ -18,14 +18,20 @@ package client
 
 import (
 	"archive/tar"
+	"bufio"
+	"encoding/json"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"os"
 	"path"
 	"path/filepath"
+	"strings"
 
+	"github.com/heptio/sonobuoy/pkg/client/results"
 	"github.com/heptio/sonobuoy/pkg/config"
+	"github.com/heptio/sonobuoy/pkg/encryption"
+	"github.com/heptio/sonobuoy/pkg/plugin/aggregation"
 	"github.com/pkg/errors"
 
 	corev1 "k8s.io/api/core/v1"
@@ -37,10 +43,293 @@ var tarCommand = []string{
 	"/usr/bin/env",
 	"bash",
 	"-c",
-	fmt.Sprintf("tar cf - %s/*.tar.gz", config.MasterResultsPath),
+	// The results may be gzipped, zstd-compressed or not compressed at all,
+	// depending on their compression.
+	fmt.Sprintf("shopt -s nullglob; tar cf - %[1]s/*.tar.gz %[1]s/*.tar.zst %[1]s/*.tar", config.MasterResultsPath),
 }
 
 func (c *SonobuoyClient) RetrieveResults(cfg *RetrieveConfig) (io.Reader, <-chan error) {
+	return c.execAggregator(cfg.Namespace, tarCommand)
+}
+
+// RetrieveFile copies a single file of the results, at the given
+// slash-separated path within the results tarball, into a Reader, skipping
+// the first offset bytes so that a partial copy can be resumed. Only the
+// file is sent from the aggregator's pod, rather than the whole tarball. The
+// aggregator's tar can't read zstd tarballs, so files can't be retrieved from
+// results compressed with zstd.
+func (c *SonobuoyClient) RetrieveFile(cfg *RetrieveConfig, name string, offset int64) (io.Reader, <-chan error) {
+	if strings.Contains(name, "'") || offset < 0 {
+		ec := make(chan error, 1)
+		ec <- errors.Errorf("can't retrieve %q from offset %v", name, offset)
+		return nil, ec
+	}
+	command := []string{
+		"/usr/bin/env",
+		"bash",
+		"-c",
+		fmt.Sprintf("set -o pipefail; f=\"$(ls %v/*.tar* | head -n 1)\"; case \"$f\" in *.zst) exit 1;; esac; tar xOf \"$f\" '%v' | tail -c +%v", config.MasterResultsPath, name, offset+1),
+	}
+	return c.execAggregator(cfg.Namespace, command)
+}
+
+// RetrieveResultFiles copies the files of the results of cfg.Plugin, only
+// those of cfg.Node if it's set, into outDir, laid out as they are in the
+// results tarball. The files are found from the results manifest, and files
+// which were partly copied before are resumed where they stopped. It returns
+// the names of the files written.
+func (c *SonobuoyClient) RetrieveResultFiles(cfg *RetrieveConfig, outDir string) ([]string, error) {
+	if cfg.Plugin == "" {
+		return nil, errors.New("a plugin must be given to retrieve its results")
+	}
+
+	reader, ec := c.RetrieveFile(cfg, path.Join("meta", aggregation.ResultsManifestFile), 0)
+	if reader == nil {
+		return nil, <-ec
+	}
+	var manifest aggregation.ResultsManifest
+	decodeErr := json.NewDecoder(reader).Decode(&manifest)
+	io.Copy(ioutil.Discard, reader)
+	if err := <-ec; err != nil {
+		return nil, err
+	}
+	if decodeErr != nil {
+		return nil, errors.Wrap(decodeErr, "couldn't decode the results manifest")
+	}
+	if err := checkDecryptionKey(manifest.Encryption, cfg.DecryptionKey); err != nil {
+		return nil, err
+	}
+
+	files := resultFiles(manifest, cfg.Plugin, cfg.Node)
+	if len(files) == 0 {
+		if cfg.Node != "" {
+			return nil, errors.Errorf("no results of plugin %v from node %v were found", cfg.Plugin, cfg.Node)
+		}
+		return nil, errors.Errorf("no results of plugin %v were found", cfg.Plugin)
+	}
+
+	var filenames []string
+	for _, file := range files {
+		filename := filepath.Join(outDir, filepath.FromSlash(file.Path))
+		if manifest.Encryption != nil {
+			// The file is copied as it's stored, so that an interrupted
+			// copy can be resumed, and decrypted once it's complete.
+			encrypted := filename + encryptedSuffix
+			if err := c.retrieveResultFile(cfg, file, encrypted); err != nil {
+				return filenames, err
+			}
+			if err := decryptFile(encrypted, filename, cfg.DecryptionKey); err != nil {
+				return filenames, err
+			}
+		} else if err := c.retrieveResultFile(cfg, file, filename); err != nil {
+			return filenames, err
+		}
+		filenames = append(filenames, filename)
+	}
+	return filenames, nil
+}
+
+// encryptedSuffix is added to the name of encrypted files while they're being
+// retrieved.
+const encryptedSuffix = ".encrypted"
+
+// checkDecryptionKey returns an error if results encrypted as described
+// can't be decrypted with the key.
+func checkDecryptionKey(enc *aggregation.ManifestEncryption, key []byte) error {
+	switch {
+	case enc == nil:
+		return nil
+	case len(key) == 0:
+		return errors.New("the results are encrypted, the key they were encrypted with is needed to retrieve them")
+	case enc.KeyID != encryption.KeyID(key):
+		return errors.Errorf("the results were encrypted with a different key (ID %v) than the one given (ID %v)", enc.KeyID, encryption.KeyID(key))
+	}
+	return nil
+}
+
+// decryptFile decrypts the encrypted file into filename, removing the
+// encrypted file afterwards. Files which aren't encrypted, such as the errors
+// recorded for failed results, are just renamed.
+func decryptFile(encrypted, filename string, key []byte) error {
+	in, err := os.Open(encrypted)
+	if err != nil {
+		return errors.Wrapf(err, "couldn't open %v", encrypted)
+	}
+	defer in.Close()
+
+	body, err := encryption.NewDecrypter(in, key)
+	if err == encryption.ErrNotEncrypted {
+		in.Close()
+		return errors.Wrapf(os.Rename(encrypted, filename), "couldn't rename %v", encrypted)
+	}
+	if err != nil {
+		return errors.Wrapf(err, "couldn't decrypt %v", encrypted)
+	}
+
+	out, err := os.Create(filename)
+	if err != nil {
+		return errors.Wrapf(err, "couldn't create %v", filename)
+	}
+	if _, err := io.Copy(out, body); err != nil {
+		out.Close()
+		os.Remove(filename)
+		return errors.Wrapf(err, "couldn't decrypt %v", encrypted)
+	}
+	if err := out.Close(); err != nil {
+		return errors.Wrapf(err, "couldn't write %v", filename)
+	}
+	in.Close()
+	return errors.Wrapf(os.Remove(encrypted), "couldn't remove %v", encrypted)
+}
+
+// DecryptResults decrypts the encrypted files in the results tarball, which
+// is replaced with the decrypted version. It's compressed the same way as it
+// was before. The results manifest is left as it was, so the sizes it lists
+// are still those of the encrypted files.
+func DecryptResults(filename string, key []byte) error {
+	in, err := os.Open(filename)
+	if err != nil {
+		return errors.Wrapf(err, "couldn't open %v", filename)
+	}
+	defer in.Close()
+	br := bufio.NewReader(in)
+	magic, err := br.Peek(4)
+	if err != nil && err != io.EOF {
+		return errors.Wrapf(err, "couldn't read %v", filename)
+	}
+	compression := results.DetectCompression(magic)
+	tarball, err := results.Decompress(br)
+	if err != nil {
+		return errors.Wrapf(err, "couldn't read %v", filename)
+	}
+	defer tarball.Close()
+
+	tmp := filename + ".tmp"
+	out, err := os.Create(tmp)
+	if err != nil {
+		return errors.Wrapf(err, "couldn't create %v", tmp)
+	}
+	if err := decryptTarball(tar.NewReader(tarball), out, compression, key); err != nil {
+		out.Close()
+		os.Remove(tmp)
+		return errors.Wrapf(err, "couldn't decrypt %v", filename)
+	}
+	if err := out.Close(); err != nil {
+		os.Remove(tmp)
+		return errors.Wrapf(err, "couldn't write %v", tmp)
+	}
+	return errors.Wrapf(os.Rename(tmp, filename), "couldn't replace %v", filename)
+}
+
+// decryptTarball copies the tarball to w, compressed as given by
+// compression, decrypting each encrypted file.
+func decryptTarball(tr *tar.Reader, w io.Writer, compression string, key []byte) error {
+	cw, err := results.Compress(w, compression)
+	if err != nil {
+		return err
+	}
+	tw := tar.NewWriter(cw)
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return errors.Wrap(err, "couldn't read tarball")
+		}
+
+		var body io.Reader = tr
+		if header.Typeflag == tar.TypeReg {
+			br := bufio.NewReader(tr)
+			body = br
+			encrypted, err := encryption.IsEncrypted(br)
+			if err != nil {
+				return errors.Wrapf(err, "couldn't read %v", header.Name)
+			}
+			if encrypted {
+				if len(key) == 0 {
+					return errors.Errorf("%v is encrypted, the key it was encrypted with is needed to decrypt it", header.Name)
+				}
+				if header.Size, err = encryption.PlaintextSize(header.Size); err != nil {
+					return errors.Wrapf(err, "couldn't decrypt %v", header.Name)
+				}
+				if body, err = encryption.NewDecrypter(br, key); err != nil {
+					return errors.Wrapf(err, "couldn't decrypt %v", header.Name)
+				}
+			}
+		}
+		if err := tw.WriteHeader(header); err != nil {
+			return errors.Wrapf(err, "couldn't write %v", header.Name)
+		}
+		if _, err := io.Copy(tw, body); err != nil {
+			return errors.Wrapf(err, "couldn't decrypt %v", header.Name)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		return errors.Wrap(err, "couldn't write tarball")
+	}
+	return errors.Wrap(cw.Close(), "couldn't write tarball")
+}
+
+// retrieveResultFile copies the file into filename, resuming from the end of
+// filename if it's a partial copy.
+func (c *SonobuoyClient) retrieveResultFile(cfg *RetrieveConfig, file aggregation.ManifestFile, filename string) error {
+	offset := resumeOffset(filename, file.Size)
+	if offset == file.Size {
+		return nil
+	}
+	if err := os.MkdirAll(filepath.Dir(filename), 0755); err != nil {
+		return errors.Wrapf(err, "couldn't create directory for %v", filename)
+	}
+	flags := os.O_WRONLY | os.O_CREATE | os.O_TRUNC
+	if offset > 0 {
+		flags = os.O_WRONLY | os.O_APPEND
+	}
+	f, err := os.OpenFile(filename, flags, 0644)
+	if err != nil {
+		return errors.Wrapf(err, "couldn't open %v", filename)
+	}
+	defer f.Close()
+
+	reader, ec := c.RetrieveFile(cfg, file.Path, offset)
+	if reader == nil {
+		return <-ec
+	}
+	_, copyErr := io.Copy(f, reader)
+	if err := <-ec; err != nil {
+		return err
+	}
+	return errors.Wrapf(copyErr, "couldn't write %v", filename)
+}
+
+// resultFiles returns the files of the results of the plugin in the
+// manifest, only those of the node if it isn't empty.
+func resultFiles(manifest aggregation.ResultsManifest, plugin, node string) []aggregation.ManifestFile {
+	var files []aggregation.ManifestFile
+	for _, entry := range manifest.Results {
+		if entry.Plugin != plugin || (node != "" && entry.Node != node) {
+			continue
+		}
+		files = append(files, entry.Files...)
+	}
+	return files
+}
+
+// resumeOffset returns how much of a file of the given size was already
+// copied to filename. A file which doesn't exist, or is larger than it should
+// be, is copied again from the start.
+func resumeOffset(filename string, size int64) int64 {
+	info, err := os.Stat(filename)
+	if err != nil || !info.Mode().IsRegular() || info.Size() > size {
+		return 0
+	}
+	return info.Size()
+}
+
+// execAggregator runs the command in the aggregator's container, returning a
+// Reader of its output. Any error running it is sent on the channel, which
+// is closed once the command finishes.
+func (c *SonobuoyClient) execAggregator(namespace string, command []string) (io.Reader, <-chan error) {
 	ec := make(chan error, 1)
 	client, err := c.Client()
 	if err != nil {
@@ -51,12 +340,12 @@ func (c *SonobuoyClient) RetrieveResults(cfg *RetrieveConfig) (io.Reader, <-chan
 	req := restClient.Post().
 		Resource("pods").
 		Name(config.MasterPodName).
-		Namespace(cfg.Namespace).
+		Namespace(namespace).
 		SubResource("exec").
 		Param("container", config.MasterContainerName)
 	req.VersionedParams(&corev1.PodExecOptions{
 		Container: config.MasterContainerName,
-		Command:   tarCommand,
+		Command:   command,
 		Stdin:     false,
 		Stdout:    true,
 		Stderr:    false,
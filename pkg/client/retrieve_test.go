@@ -0,0 +1,247 @@
+/*
+Copyright 2018 Heptio Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package client
+
+import (
+	"archive/tar"
+	"bytes"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/heptio/sonobuoy/pkg/client/results"
+	"github.com/heptio/sonobuoy/pkg/config"
+	"github.com/heptio/sonobuoy/pkg/encryption"
+	"github.com/heptio/sonobuoy/pkg/plugin/aggregation"
+)
+
+func TestResultFiles(t *testing.T) {
+	node1 := aggregation.ManifestFile{Path: "plugins/systemd_logs/results/node1", Size: 10}
+	node2 := aggregation.ManifestFile{Path: "plugins/systemd_logs/results/node2", Size: 20}
+	e2e := aggregation.ManifestFile{Path: "plugins/e2e/results/junit_01.xml", Size: 30}
+	manifest := aggregation.ResultsManifest{Results: []aggregation.ManifestEntry{
+		{Plugin: "systemd_logs", Node: "node1", Files: []aggregation.ManifestFile{node1}},
+		{Plugin: "systemd_logs", Node: "node2", Files: []aggregation.ManifestFile{node2}},
+		{Plugin: "e2e", Files: []aggregation.ManifestFile{e2e}},
+	}}
+
+	testCases := []struct {
+		desc     string
+		plugin   string
+		node     string
+		expected []aggregation.ManifestFile
+	}{
+		{desc: "every node", plugin: "systemd_logs", expected: []aggregation.ManifestFile{node1, node2}},
+		{desc: "one node", plugin: "systemd_logs", node: "node2", expected: []aggregation.ManifestFile{node2}},
+		{desc: "global plugin", plugin: "e2e", expected: []aggregation.ManifestFile{e2e}},
+		{desc: "unknown node", plugin: "systemd_logs", node: "node3"},
+		{desc: "unknown plugin", plugin: "custom"},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.desc, func(t *testing.T) {
+			if files := resultFiles(manifest, tc.plugin, tc.node); !reflect.DeepEqual(files, tc.expected) {
+				t.Errorf("expected files %v, got %v", tc.expected, files)
+			}
+		})
+	}
+}
+
+func TestResumeOffset(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sonobuoy_retrieve_test")
+	if err != nil {
+		t.Fatalf("Could not create temp directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	partial := filepath.Join(dir, "partial")
+	if err := ioutil.WriteFile(partial, []byte("12345"), 0644); err != nil {
+		t.Fatalf("couldn't write file: %v", err)
+	}
+
+	testCases := []struct {
+		desc     string
+		filename string
+		size     int64
+		expected int64
+	}{
+		{desc: "missing file", filename: filepath.Join(dir, "missing"), size: 10, expected: 0},
+		{desc: "partial file", filename: partial, size: 10, expected: 5},
+		{desc: "complete file", filename: partial, size: 5, expected: 5},
+		{desc: "file larger than expected", filename: partial, size: 3, expected: 0},
+		{desc: "directory", filename: dir, size: 10, expected: 0},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.desc, func(t *testing.T) {
+			if offset := resumeOffset(tc.filename, tc.size); offset != tc.expected {
+				t.Errorf("expected offset %v, got %v", tc.expected, offset)
+			}
+		})
+	}
+}
+
+func encrypt(t *testing.T, plain string, key []byte) []byte {
+	r, err := encryption.NewEncrypter(strings.NewReader(plain), key)
+	if err != nil {
+		t.Fatalf("couldn't encrypt: %v", err)
+	}
+	sealed, err := ioutil.ReadAll(r)
+	if err != nil {
+		t.Fatalf("couldn't encrypt: %v", err)
+	}
+	return sealed
+}
+
+func TestCheckDecryptionKey(t *testing.T) {
+	key := []byte("s3cret")
+	enc := &aggregation.ManifestEncryption{Cipher: encryption.Cipher, KeyID: encryption.KeyID(key)}
+	if err := checkDecryptionKey(nil, nil); err != nil {
+		t.Errorf("unexpected error for unencrypted results: %v", err)
+	}
+	if err := checkDecryptionKey(enc, key); err != nil {
+		t.Errorf("unexpected error for the right key: %v", err)
+	}
+	if err := checkDecryptionKey(enc, nil); err == nil {
+		t.Error("expected an error without a key")
+	}
+	if err := checkDecryptionKey(enc, []byte("wrong")); err == nil {
+		t.Error("expected an error for the wrong key")
+	}
+}
+
+func TestDecryptFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sonobuoy_retrieve_test")
+	if err != nil {
+		t.Fatalf("Could not create temp directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	key := []byte("s3cret")
+
+	for desc, contents := range map[string][]byte{"encrypted": encrypt(t, "results", key), "plain": []byte("results")} {
+		encrypted := filepath.Join(dir, desc+encryptedSuffix)
+		filename := filepath.Join(dir, desc)
+		if err := ioutil.WriteFile(encrypted, contents, 0644); err != nil {
+			t.Fatalf("couldn't write file: %v", err)
+		}
+		if err := decryptFile(encrypted, filename, key); err != nil {
+			t.Fatalf("%v: unexpected error: %v", desc, err)
+		}
+		if got, err := ioutil.ReadFile(filename); err != nil || string(got) != "results" {
+			t.Errorf("%v: expected the decrypted file, got %q: %v", desc, got, err)
+		}
+		if _, err := os.Stat(encrypted); !os.IsNotExist(err) {
+			t.Errorf("%v: expected the encrypted file to be removed, got %v", desc, err)
+		}
+	}
+
+	encrypted := filepath.Join(dir, "wrong"+encryptedSuffix)
+	if err := ioutil.WriteFile(encrypted, encrypt(t, "results", key), 0644); err != nil {
+		t.Fatalf("couldn't write file: %v", err)
+	}
+	if err := decryptFile(encrypted, filepath.Join(dir, "wrong"), []byte("wrong")); err == nil {
+		t.Error("expected an error decrypting with the wrong key")
+	}
+	if _, err := os.Stat(filepath.Join(dir, "wrong")); !os.IsNotExist(err) {
+		t.Errorf("expected nothing to be left from the failed decryption, got %v", err)
+	}
+}
+
+func TestDecryptResults(t *testing.T) {
+	for _, compression := range []string{config.CompressionGzip, config.CompressionZstd, config.CompressionNone} {
+		t.Run(compression, func(t *testing.T) {
+			testDecryptResults(t, compression)
+		})
+	}
+}
+
+func testDecryptResults(t *testing.T, compression string) {
+	dir, err := ioutil.TempDir("", "sonobuoy_retrieve_test")
+	if err != nil {
+		t.Fatalf("Could not create temp directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	key := []byte("s3cret")
+
+	files := map[string][]byte{
+		"plugins/e2e/results/junit.xml":   encrypt(t, "<testsuite/>", key),
+		"plugins/e2e/results/errors.json": []byte(`{"error": "foo"}`),
+	}
+	var buf bytes.Buffer
+	cw, err := results.Compress(&buf, compression)
+	if err != nil {
+		t.Fatalf("couldn't compress tarball: %v", err)
+	}
+	tw := tar.NewWriter(cw)
+	for name, contents := range files {
+		if err := tw.WriteHeader(&tar.Header{Name: name, Mode: 0644, Size: int64(len(contents)), Typeflag: tar.TypeReg}); err != nil {
+			t.Fatal(err)
+		}
+		tw.Write(contents)
+	}
+	tw.Close()
+	cw.Close()
+	tarball := filepath.Join(dir, "results.tar")
+	if err := ioutil.WriteFile(tarball, buf.Bytes(), 0644); err != nil {
+		t.Fatalf("couldn't write tarball: %v", err)
+	}
+
+	if err := DecryptResults(tarball, nil); err == nil || !strings.Contains(err.Error(), "is encrypted") {
+		t.Errorf("expected an error decrypting without a key, got %v", err)
+	}
+	if err := DecryptResults(tarball, key); err != nil {
+		t.Fatalf("unexpected error decrypting: %v", err)
+	}
+
+	data, err := ioutil.ReadFile(tarball)
+	if err != nil {
+		t.Fatalf("couldn't read tarball: %v", err)
+	}
+	if got := results.DetectCompression(data); got != compression {
+		t.Errorf("expected the tarball to still be compressed with %v, got %v", compression, got)
+	}
+	rc, err := results.Decompress(bytes.NewReader(data))
+	if err != nil {
+		t.Fatalf("couldn't decompress tarball: %v", err)
+	}
+	defer rc.Close()
+	got := map[string]string{}
+	tr := tar.NewReader(rc)
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatalf("couldn't read tarball: %v", err)
+		}
+		contents, err := ioutil.ReadAll(tr)
+		if err != nil {
+			t.Fatalf("couldn't read %v: %v", header.Name, err)
+		}
+		got[header.Name] = string(contents)
+	}
+	want := map[string]string{
+		"plugins/e2e/results/junit.xml":   "<testsuite/>",
+		"plugins/e2e/results/errors.json": `{"error": "foo"}`,
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("expected decrypted files %v, got %v", want, got)
+	}
+}
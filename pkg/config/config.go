@@ -43,6 +43,8 @@ const (
 	DefaultAggregationServerBindAddress = "0.0.0.0"
 	// DefaultAggregationServerTimeoutSeconds is the default amount of time the aggregation server will wait for all plugins to complete.
 	DefaultAggregationServerTimeoutSeconds = 10800 // 180 min
+	// DefaultAggregationServerMaxResultSizeBytes is the default limit on the size of each result submitted to the aggregation server.
+	DefaultAggregationServerMaxResultSizeBytes = 1 << 30 // 1 GiB
 	// MasterPodName is the name of the main pod that runs plugins and collects results.
 	MasterPodName = "sonobuoy"
 	// MasterContainerName is the name of the main container in the master pod.
@@ -55,6 +57,14 @@ const (
 	DefaultQueryQPS = 30
 	// DefaultQueryBurst is the peak number of queries per second Sonobuoy will make when gathering data.
 	DefaultQueryBurst = 50
+
+	// CompressionGzip gzips the results tarball, which is the default.
+	CompressionGzip = "gzip"
+	// CompressionNone leaves the results tarball uncompressed.
+	CompressionNone = "none"
+	// CompressionZstd compresses the results tarball with zstd, which
+	// compresses large results better and faster than gzip.
+	CompressionZstd = "zstd"
 )
 
 var (
@@ -133,6 +143,9 @@ type Config struct {
 	UUID        string `json:"UUID" mapstructure:"UUID"`
 	Version     string `json:"Version" mapstructure:"Version"`
 	ResultsDir  string `json:"ResultsDir" mapstructure:"ResultsDir"`
+	// ResultsCompression is how the results tarball is compressed, gzip if
+	// it isn't set.
+	ResultsCompression string `json:"ResultsCompression,omitempty" mapstructure:"ResultsCompression"`
 
 	///////////////////////////////////////////////
 	// Query options
@@ -192,6 +205,20 @@ func (cfg *Config) OutputDir() string {
 	return path.Join(cfg.ResultsDir, cfg.UUID)
 }
 
+// ResultsTarball returns the file name of the results tarball for a run
+// started at t, with the extension of its compression.
+func (cfg *Config) ResultsTarball(t time.Time) string {
+	name := t.Format("200601021504") + "_sonobuoy_" + cfg.UUID + ".tar"
+	switch cfg.ResultsCompression {
+	case CompressionNone:
+	case CompressionZstd:
+		name += ".zst"
+	default:
+		name += ".gz"
+	}
+	return path.Join(cfg.ResultsDir, name)
+}
+
 // SizeLimitBytes returns how many bytes the configuration is set to limit,
 // returning defaultVal if not set.
 func (c SizeOrTimeLimitConfig) SizeLimitBytes(defaultVal int64) int64 {
@@ -258,6 +285,7 @@ func New() *Config {
 	cfg.Aggregation.BindAddress = DefaultAggregationServerBindAddress
 	cfg.Aggregation.BindPort = DefaultAggregationServerBindPort
 	cfg.Aggregation.TimeoutSeconds = DefaultAggregationServerTimeoutSeconds
+	cfg.Aggregation.MaxResultSizeBytes = DefaultAggregationServerMaxResultSizeBytes
 
 	cfg.PluginSearchPath = []string{
 		"./plugins.d",
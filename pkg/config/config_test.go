@@ -20,6 +20,7 @@ import (
 	"encoding/json"
 	"reflect"
 	"testing"
+	"time"
 
 	"github.com/heptio/sonobuoy/pkg/config"
 	"github.com/heptio/sonobuoy/pkg/plugin"
@@ -79,3 +80,20 @@ func TestEmptySlicePreservation(t *testing.T) {
 		})
 	}
 }
+
+func TestResultsTarball(t *testing.T) {
+	start := time.Date(2018, 7, 4, 13, 5, 0, 0, time.UTC)
+	for compression, expected := range map[string]string{
+		"":                     "/tmp/sonobuoy/201807041305_sonobuoy_0xDEADBEEF.tar.gz",
+		config.CompressionGzip: "/tmp/sonobuoy/201807041305_sonobuoy_0xDEADBEEF.tar.gz",
+		config.CompressionNone: "/tmp/sonobuoy/201807041305_sonobuoy_0xDEADBEEF.tar",
+		config.CompressionZstd: "/tmp/sonobuoy/201807041305_sonobuoy_0xDEADBEEF.tar.zst",
+	} {
+		cfg := config.New()
+		cfg.UUID = "0xDEADBEEF"
+		cfg.ResultsCompression = compression
+		if got := cfg.ResultsTarball(start); got != expected {
+			t.Errorf("expected tarball %v with compression %q, got %v", expected, compression, got)
+		}
+	}
+}
@@ -20,13 +20,18 @@ import (
 	"encoding/json"
 	"fmt"
 	"io/ioutil"
+	"net/url"
 	"os"
+	"path/filepath"
 	"strings"
 
+	"github.com/heptio/sonobuoy/pkg/backplane/ca"
 	"github.com/heptio/sonobuoy/pkg/buildinfo"
 	"github.com/heptio/sonobuoy/pkg/plugin"
 	pluginloader "github.com/heptio/sonobuoy/pkg/plugin/loader"
 	"github.com/pkg/errors"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/util/validation"
 )
 
 const (
@@ -61,8 +66,13 @@ func LoadConfig() (*Config, error) {
 
 	// 3 - figure out what address we will tell pods to dial for aggregation
 	if cfg.Aggregation.AdvertiseAddress == "" {
-		if ip := os.Getenv("SONOBUOY_ADVERTISE_IP"); ip != "" {
-			cfg.Aggregation.AdvertiseAddress = fmt.Sprintf("[%v]:%d", ip, cfg.Aggregation.BindPort)
+		if ips := os.Getenv("SONOBUOY_ADVERTISE_IP"); ips != "" {
+			// Multiple IPs may be given for dual-stack clusters
+			var addresses []string
+			for _, ip := range strings.Split(ips, ",") {
+				addresses = append(addresses, fmt.Sprintf("[%v]:%d", strings.TrimSpace(ip), cfg.Aggregation.BindPort))
+			}
+			cfg.Aggregation.AdvertiseAddress = strings.Join(addresses, ",")
 		} else {
 			hostname, _ := os.Hostname()
 			if hostname != "" {
@@ -109,6 +119,257 @@ func (cfg *Config) Validate() (errors []error) {
 		errors = append(errors, err)
 	}
 
+	switch cfg.ResultsCompression {
+	case "", CompressionGzip, CompressionNone, CompressionZstd:
+	default:
+		errors = append(errors, fmt.Errorf("results compression must be %q, %q or %q, got %q", CompressionGzip, CompressionZstd, CompressionNone, cfg.ResultsCompression))
+	}
+
+	if cfg.Aggregation.AnnotationUpdateFreqSeconds < 0 {
+		errors = append(errors, fmt.Errorf("annotation update frequency must be positive, got %v", cfg.Aggregation.AnnotationUpdateFreqSeconds))
+	}
+
+	if cfg.Aggregation.JitterFactor != 0 && cfg.Aggregation.JitterFactor < 1.0 {
+		errors = append(errors, fmt.Errorf("jitter factor must be at least 1.0, got %v", cfg.Aggregation.JitterFactor))
+	}
+
+	if cfg.Aggregation.PluginRunAttempts < 0 {
+		errors = append(errors, fmt.Errorf("plugin run attempts must not be negative, got %v", cfg.Aggregation.PluginRunAttempts))
+	}
+
+	if cfg.Aggregation.PluginStartupTimeoutSeconds < 0 {
+		errors = append(errors, fmt.Errorf("plugin startup timeout must not be negative, got %v", cfg.Aggregation.PluginStartupTimeoutSeconds))
+	}
+
+	if cfg.Aggregation.PluginLaunchDelaySeconds < 0 {
+		errors = append(errors, fmt.Errorf("plugin launch delay must not be negative, got %v", cfg.Aggregation.PluginLaunchDelaySeconds))
+	}
+
+	if gate := cfg.Aggregation.ReadyGate; gate != nil {
+		if gate.APIVersion == "" || gate.Resource == "" || gate.Name == "" || gate.Condition == "" {
+			errors = append(errors, fmt.Errorf("ready gate must set the apiversion, resource, name and condition to check"))
+		}
+		if gate.TimeoutSeconds < 0 {
+			errors = append(errors, fmt.Errorf("ready gate timeout must not be negative, got %v", gate.TimeoutSeconds))
+		}
+		if gate.IntervalSeconds < 0 {
+			errors = append(errors, fmt.Errorf("ready gate interval must not be negative, got %v", gate.IntervalSeconds))
+		}
+	}
+
+	if cfg.Aggregation.ResourceUsageIntervalSeconds < 0 {
+		errors = append(errors, fmt.Errorf("resource usage interval must not be negative, got %v", cfg.Aggregation.ResourceUsageIntervalSeconds))
+	}
+
+	if cfg.Aggregation.ResultsTTLSeconds < 0 {
+		errors = append(errors, fmt.Errorf("results TTL must not be negative, got %v", cfg.Aggregation.ResultsTTLSeconds))
+	}
+
+	if cfg.Aggregation.MaxRunSeconds < 0 {
+		errors = append(errors, fmt.Errorf("max run time must not be negative, got %v", cfg.Aggregation.MaxRunSeconds))
+	} else if cfg.Aggregation.MaxRunSeconds > 0 && cfg.Aggregation.MaxRunSeconds < cfg.Aggregation.TimeoutSeconds {
+		errors = append(errors, fmt.Errorf("max run time must not be shorter than the timeout of %v seconds, got %v", cfg.Aggregation.TimeoutSeconds, cfg.Aggregation.MaxRunSeconds))
+	}
+
+	// Plugins are shut down their graceful period before the run times out,
+	// which has to leave them some time to run.
+	checkGracefulShutdown := func(desc string, secs int) {
+		if secs < 0 {
+			errors = append(errors, fmt.Errorf("%v must not be negative, got %v", desc, secs))
+		} else if secs > 0 && cfg.Aggregation.TimeoutSeconds > 0 && secs >= cfg.Aggregation.TimeoutSeconds {
+			errors = append(errors, fmt.Errorf("%v must be smaller than the timeout of %v seconds, got %v", desc, cfg.Aggregation.TimeoutSeconds, secs))
+		}
+	}
+	checkGracefulShutdown("graceful shutdown period", cfg.Aggregation.GracefulShutdownSeconds)
+	for name, secs := range cfg.Aggregation.PluginGracefulShutdownSeconds {
+		checkGracefulShutdown(fmt.Sprintf("graceful shutdown period of plugin %v", name), secs)
+	}
+
+	switch cfg.Aggregation.ResultSink {
+	case "":
+	case plugin.ResultSinkFilesystem:
+		if !filepath.IsAbs(cfg.Aggregation.ResultSinkDir) {
+			errors = append(errors, fmt.Errorf("filesystem result sink directory must be an absolute path, got %q", cfg.Aggregation.ResultSinkDir))
+		}
+	case plugin.ResultSinkS3:
+		if cfg.Aggregation.S3Bucket == "" || cfg.Aggregation.S3Region == "" {
+			errors = append(errors, fmt.Errorf("S3 result sink needs a bucket and region, got bucket %q and region %q", cfg.Aggregation.S3Bucket, cfg.Aggregation.S3Region))
+		}
+		if cfg.Aggregation.S3Endpoint != "" {
+			if u, err := url.Parse(cfg.Aggregation.S3Endpoint); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+				errors = append(errors, fmt.Errorf("S3 endpoint must be an http or https URL, got %q", cfg.Aggregation.S3Endpoint))
+			}
+		}
+	default:
+		errors = append(errors, fmt.Errorf("result sink must be %q or %q, got %q", plugin.ResultSinkFilesystem, plugin.ResultSinkS3, cfg.Aggregation.ResultSink))
+	}
+
+	if cfg.Aggregation.NodeCacheTTLSeconds < 0 {
+		errors = append(errors, fmt.Errorf("node cache TTL must not be negative, got %v", cfg.Aggregation.NodeCacheTTLSeconds))
+	}
+	if cfg.Aggregation.NodeListTimeoutSeconds < 0 {
+		errors = append(errors, fmt.Errorf("node list timeout must not be negative, got %v", cfg.Aggregation.NodeListTimeoutSeconds))
+	}
+
+	if cfg.Aggregation.MinFreeDiskBytes < 0 {
+		errors = append(errors, fmt.Errorf("minimum free disk space must not be negative, got %v", cfg.Aggregation.MinFreeDiskBytes))
+	}
+
+	if cfg.Aggregation.CertValiditySeconds < 0 {
+		errors = append(errors, fmt.Errorf("certificate validity must not be negative, got %v", cfg.Aggregation.CertValiditySeconds))
+	}
+
+	if (cfg.Aggregation.CACertFile == "") != (cfg.Aggregation.CAKeyFile == "") {
+		errors = append(errors, fmt.Errorf("CA certificate and key files must be set together, got certificate %q and key %q", cfg.Aggregation.CACertFile, cfg.Aggregation.CAKeyFile))
+	}
+
+	switch ca.KeyType(cfg.Aggregation.KeyType) {
+	case "", ca.KeyTypeECDSA, ca.KeyTypeRSA:
+		if cfg.Aggregation.KeyType != "" && cfg.Aggregation.CACertFile != "" {
+			errors = append(errors, fmt.Errorf("key type can't be set when using an existing CA, which issues ECDSA certificates"))
+		}
+	default:
+		errors = append(errors, fmt.Errorf("key type must be %q or %q, got %q", ca.KeyTypeECDSA, ca.KeyTypeRSA, cfg.Aggregation.KeyType))
+	}
+
+	if _, err := ca.ParseTLSOptions(cfg.Aggregation.MinTLSVersion, cfg.Aggregation.CipherSuites); err != nil {
+		errors = append(errors, err)
+	}
+	if cfg.Aggregation.WorkerProxyURL != "" {
+		if _, err := plugin.ParseProxyURL(cfg.Aggregation.WorkerProxyURL); err != nil {
+			errors = append(errors, err)
+		}
+	}
+	for _, prefix := range []string{cfg.Aggregation.BasePath, cfg.Aggregation.WorkerUploadPathPrefix} {
+		if _, err := plugin.CleanPathPrefix(prefix); err != nil {
+			errors = append(errors, err)
+		}
+	}
+	if cfg.Aggregation.WorkerUploadRetries < 0 {
+		errors = append(errors, fmt.Errorf("worker upload retries must not be negative, got %v", cfg.Aggregation.WorkerUploadRetries))
+	}
+	if cfg.Aggregation.WorkerUploadTimeoutSeconds < 0 {
+		errors = append(errors, fmt.Errorf("worker upload timeout must not be negative, got %v", cfg.Aggregation.WorkerUploadTimeoutSeconds))
+	}
+	// Stalls are detected from heartbeats, so they need to be sent, and
+	// often enough that one late heartbeat isn't taken for a stall.
+	heartbeat := cfg.Aggregation.HeartbeatIntervalSeconds
+	switch stall := cfg.Aggregation.HeartbeatStallSeconds; {
+	case heartbeat < 0:
+		errors = append(errors, fmt.Errorf("heartbeat interval must not be negative, got %v", heartbeat))
+	case stall < 0:
+		errors = append(errors, fmt.Errorf("heartbeat stall threshold must not be negative, got %v", stall))
+	case heartbeat == 0 && (stall > 0 || cfg.Aggregation.FailStalledResults):
+		errors = append(errors, fmt.Errorf("detecting stalled results requires a heartbeat interval"))
+	case stall > 0 && stall < 2*heartbeat:
+		errors = append(errors, fmt.Errorf("heartbeat stall threshold must be at least twice the heartbeat interval of %v seconds, got %v", heartbeat, stall))
+	}
+	for _, codec := range cfg.Aggregation.UploadCodecs {
+		switch codec {
+		case plugin.UploadCodecGzip, plugin.UploadCodecIdentity:
+		default:
+			errors = append(errors, fmt.Errorf("upload codecs must be %q or %q, got %q", plugin.UploadCodecGzip, plugin.UploadCodecIdentity, codec))
+		}
+	}
+
+	switch cfg.Aggregation.LogFormat {
+	case "", plugin.LogFormatText, plugin.LogFormatJSON:
+	default:
+		errors = append(errors, fmt.Errorf("log format must be %q or %q, got %q", plugin.LogFormatText, plugin.LogFormatJSON, cfg.Aggregation.LogFormat))
+	}
+
+	if cfg.Aggregation.BindSocket != "" && !filepath.IsAbs(cfg.Aggregation.BindSocket) {
+		errors = append(errors, fmt.Errorf("bind socket must be an absolute path, got %q", cfg.Aggregation.BindSocket))
+	}
+
+	if cfg.Aggregation.DiagnosticsLogLines < 0 {
+		errors = append(errors, fmt.Errorf("diagnostics log lines must not be negative, got %v", cfg.Aggregation.DiagnosticsLogLines))
+	}
+	if cfg.Aggregation.DiagnosticsMaxEvents < 0 {
+		errors = append(errors, fmt.Errorf("diagnostics max events must not be negative, got %v", cfg.Aggregation.DiagnosticsMaxEvents))
+	}
+
+	if cfg.Aggregation.MonitorBufferSize < 0 {
+		errors = append(errors, fmt.Errorf("monitor buffer size must not be negative, got %v", cfg.Aggregation.MonitorBufferSize))
+	}
+
+	if cfg.Aggregation.CompletionThreshold < 0 || cfg.Aggregation.CompletionThreshold > 1 {
+		errors = append(errors, fmt.Errorf("completion threshold must be between 0 and 1, got %v", cfg.Aggregation.CompletionThreshold))
+	}
+	if cfg.Aggregation.MaxConnections < 0 {
+		errors = append(errors, fmt.Errorf("maximum connections must not be negative, got %v", cfg.Aggregation.MaxConnections))
+	}
+	if cfg.Aggregation.MaxConcurrentWrites < 0 {
+		errors = append(errors, fmt.Errorf("maximum concurrent writes must not be negative, got %v", cfg.Aggregation.MaxConcurrentWrites))
+	}
+
+	if cfg.Aggregation.MetricsBindPort < 0 || cfg.Aggregation.MetricsBindPort > 65535 {
+		errors = append(errors, fmt.Errorf("metrics bind port must be between 1 and 65535, got %v", cfg.Aggregation.MetricsBindPort))
+	} else if cfg.Aggregation.MetricsBindPort != 0 && cfg.Aggregation.MetricsBindPort == cfg.Aggregation.BindPort {
+		errors = append(errors, fmt.Errorf("metrics bind port must differ from the aggregation server's port %v", cfg.Aggregation.BindPort))
+	}
+
+	if cfg.Aggregation.MaxResultSizeBytes < 0 {
+		errors = append(errors, fmt.Errorf("maximum result size must not be negative, got %v", cfg.Aggregation.MaxResultSizeBytes))
+	}
+
+	switch cfg.Aggregation.DuplicateResults {
+	case "", plugin.DuplicateResultsIgnore, plugin.DuplicateResultsOverwrite:
+	default:
+		errors = append(errors, fmt.Errorf("duplicate results policy must be %q or %q, got %q", plugin.DuplicateResultsIgnore, plugin.DuplicateResultsOverwrite, cfg.Aggregation.DuplicateResults))
+	}
+
+	switch cfg.Aggregation.ResultsLayout {
+	case "", plugin.ResultsLayoutNested, plugin.ResultsLayoutFlat:
+	case plugin.ResultsLayoutTopology:
+		if cfg.Aggregation.TopologyLabel == "" {
+			errors = append(errors, fmt.Errorf("results layout %q needs a topology label", plugin.ResultsLayoutTopology))
+		}
+	default:
+		errors = append(errors, fmt.Errorf("results layout must be %q, %q or %q, got %q", plugin.ResultsLayoutNested, plugin.ResultsLayoutFlat, plugin.ResultsLayoutTopology, cfg.Aggregation.ResultsLayout))
+	}
+	if label := cfg.Aggregation.TopologyLabel; label != "" {
+		if msgs := validation.IsQualifiedName(label); len(msgs) > 0 {
+			errors = append(errors, fmt.Errorf("invalid topology label %q: %v", label, strings.Join(msgs, ", ")))
+		}
+	}
+
+	switch cfg.Aggregation.KeepPluginResources {
+	case "", plugin.KeepPluginResourcesNone, plugin.KeepPluginResourcesOnFailure, plugin.KeepPluginResourcesAll:
+	default:
+		errors = append(errors, fmt.Errorf("keep plugin resources policy must be %q, %q or %q, got %q", plugin.KeepPluginResourcesNone, plugin.KeepPluginResourcesOnFailure, plugin.KeepPluginResourcesAll, cfg.Aggregation.KeepPluginResources))
+	}
+
+	switch cfg.Aggregation.OrphanedResources {
+	case "", plugin.OrphanedResourcesReport, plugin.OrphanedResourcesDelete:
+	default:
+		errors = append(errors, fmt.Errorf("orphaned resources policy must be %q or %q, got %q", plugin.OrphanedResourcesReport, plugin.OrphanedResourcesDelete, cfg.Aggregation.OrphanedResources))
+	}
+
+	if cfg.Aggregation.WebhookURL != "" {
+		if u, err := url.Parse(cfg.Aggregation.WebhookURL); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			errors = append(errors, fmt.Errorf("webhook URL must be an http or https URL, got %q", cfg.Aggregation.WebhookURL))
+		}
+	}
+
+	if cfg.Aggregation.WebhookAttempts < 0 {
+		errors = append(errors, fmt.Errorf("webhook attempts must not be negative, got %v", cfg.Aggregation.WebhookAttempts))
+	}
+
+	if cfg.Aggregation.WebhookTimeoutSeconds < 0 {
+		errors = append(errors, fmt.Errorf("webhook timeout must not be negative, got %v", cfg.Aggregation.WebhookTimeoutSeconds))
+	}
+
+	if _, err := labels.Parse(cfg.Aggregation.NodeSelector); err != nil {
+		errors = append(errors, fmt.Errorf("invalid node selector %q: %v", cfg.Aggregation.NodeSelector, err))
+	}
+
+	for name, override := range cfg.Aggregation.PluginExpectedResults {
+		if err := override.Validate(); err != nil {
+			errors = append(errors, fmt.Errorf("invalid expected results for plugin %v: %v", name, err))
+		}
+	}
+
 	return errors
 }
 
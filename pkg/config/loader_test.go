@@ -218,3 +218,370 @@ func TestLoadAllPlugins(t *testing.T) {
 		}
 	}
 }
+
+func TestValidateAggregation(t *testing.T) {
+	testCases := []struct {
+		desc      string
+		aggr      plugin.AggregationConfig
+		expectErr bool
+	}{
+		{
+			desc: "Defaults are valid",
+		}, {
+			desc: "Configured update frequency and jitter",
+			aggr: plugin.AggregationConfig{AnnotationUpdateFreqSeconds: 30, JitterFactor: 1.5},
+		}, {
+			desc:      "Negative update frequency",
+			aggr:      plugin.AggregationConfig{AnnotationUpdateFreqSeconds: -1},
+			expectErr: true,
+		}, {
+			desc:      "Jitter factor below 1.0",
+			aggr:      plugin.AggregationConfig{JitterFactor: 0.5},
+			expectErr: true,
+		}, {
+			desc:      "Negative plugin run attempts",
+			aggr:      plugin.AggregationConfig{PluginRunAttempts: -1},
+			expectErr: true,
+		}, {
+			desc: "Node selector",
+			aggr: plugin.AggregationConfig{NodeSelector: "kubernetes.io/os=linux,node-role.kubernetes.io/master!="},
+		}, {
+			desc:      "Malformed node selector",
+			aggr:      plugin.AggregationConfig{NodeSelector: "kubernetes.io/os in (linux"},
+			expectErr: true,
+		}, {
+			desc: "Plugin expected results",
+			aggr: plugin.AggregationConfig{PluginExpectedResults: map[string]plugin.ExpectedResultsOverride{
+				"control-plane-logs": {NodeSelector: "node-role.kubernetes.io/control-plane"},
+				"e2e":                {Global: true},
+			}},
+		}, {
+			desc: "Plugin expected results listing a node twice",
+			aggr: plugin.AggregationConfig{PluginExpectedResults: map[string]plugin.ExpectedResultsOverride{
+				"control-plane-logs": {Nodes: []string{"master-1", "master-1"}},
+			}},
+			expectErr: true,
+		}, {
+			desc: "Plugin expected results overridden more than one way",
+			aggr: plugin.AggregationConfig{PluginExpectedResults: map[string]plugin.ExpectedResultsOverride{
+				"control-plane-logs": {Nodes: []string{"master-1"}, Global: true},
+			}},
+			expectErr: true,
+		}, {
+			desc: "JSON log format",
+			aggr: plugin.AggregationConfig{LogFormat: plugin.LogFormatJSON},
+		}, {
+			desc:      "Unknown log format",
+			aggr:      plugin.AggregationConfig{LogFormat: "xml"},
+			expectErr: true,
+		}, {
+			desc: "Overwrite duplicate results",
+			aggr: plugin.AggregationConfig{DuplicateResults: plugin.DuplicateResultsOverwrite},
+		}, {
+			desc:      "Unknown duplicate results policy",
+			aggr:      plugin.AggregationConfig{DuplicateResults: "merge"},
+			expectErr: true,
+		}, {
+			desc: "Unlimited result size",
+			aggr: plugin.AggregationConfig{MaxResultSizeBytes: 0},
+		}, {
+			desc:      "Negative maximum result size",
+			aggr:      plugin.AggregationConfig{MaxResultSizeBytes: -1},
+			expectErr: true,
+		}, {
+			desc:      "Negative plugin startup timeout",
+			aggr:      plugin.AggregationConfig{PluginStartupTimeoutSeconds: -1},
+			expectErr: true,
+		}, {
+			desc: "Ready gate",
+			aggr: plugin.AggregationConfig{ReadyGate: &plugin.ReadyGate{APIVersion: "batch/v1", Resource: "jobs", Namespace: "default", Name: "setup", Condition: "Complete"}},
+		}, {
+			desc:      "Ready gate without a condition",
+			aggr:      plugin.AggregationConfig{ReadyGate: &plugin.ReadyGate{APIVersion: "batch/v1", Resource: "jobs", Name: "setup"}},
+			expectErr: true,
+		}, {
+			desc:      "Negative ready gate timeout",
+			aggr:      plugin.AggregationConfig{ReadyGate: &plugin.ReadyGate{APIVersion: "batch/v1", Resource: "jobs", Name: "setup", Condition: "Complete", TimeoutSeconds: -1}},
+			expectErr: true,
+		}, {
+			desc: "Flat results layout",
+			aggr: plugin.AggregationConfig{ResultsLayout: plugin.ResultsLayoutFlat},
+		}, {
+			desc:      "Unknown results layout",
+			aggr:      plugin.AggregationConfig{ResultsLayout: "per-node"},
+			expectErr: true,
+		}, {
+			desc: "Topology results layout",
+			aggr: plugin.AggregationConfig{ResultsLayout: plugin.ResultsLayoutTopology, TopologyLabel: "topology.kubernetes.io/zone"},
+		}, {
+			desc:      "Topology results layout without a label",
+			aggr:      plugin.AggregationConfig{ResultsLayout: plugin.ResultsLayoutTopology},
+			expectErr: true,
+		}, {
+			desc:      "Invalid topology label",
+			aggr:      plugin.AggregationConfig{TopologyLabel: "not a label"},
+			expectErr: true,
+		}, {
+			desc: "Keep resources on failure",
+			aggr: plugin.AggregationConfig{KeepPluginResources: plugin.KeepPluginResourcesOnFailure},
+		}, {
+			desc:      "Unknown keep resources policy",
+			aggr:      plugin.AggregationConfig{KeepPluginResources: "always"},
+			expectErr: true,
+		}, {
+			desc: "Delete orphaned resources",
+			aggr: plugin.AggregationConfig{OrphanedResources: plugin.OrphanedResourcesDelete},
+		}, {
+			desc:      "Unknown orphaned resources policy",
+			aggr:      plugin.AggregationConfig{OrphanedResources: "purge"},
+			expectErr: true,
+		}, {
+			desc: "Webhook",
+			aggr: plugin.AggregationConfig{WebhookURL: "https://example.com/hook", WebhookAttempts: 5, WebhookTimeoutSeconds: 30},
+		}, {
+			desc:      "Webhook URL without scheme",
+			aggr:      plugin.AggregationConfig{WebhookURL: "example.com/hook"},
+			expectErr: true,
+		}, {
+			desc:      "Negative webhook attempts",
+			aggr:      plugin.AggregationConfig{WebhookURL: "https://example.com/hook", WebhookAttempts: -1},
+			expectErr: true,
+		}, {
+			desc: "Diagnostics limits",
+			aggr: plugin.AggregationConfig{CollectDiagnostics: true, DiagnosticsLogLines: 100, DiagnosticsMaxEvents: 10},
+		}, {
+			desc:      "Negative diagnostics log lines",
+			aggr:      plugin.AggregationConfig{DiagnosticsLogLines: -1},
+			expectErr: true,
+		}, {
+			desc:      "Negative diagnostics max events",
+			aggr:      plugin.AggregationConfig{DiagnosticsMaxEvents: -1},
+			expectErr: true,
+		}, {
+			desc: "Monitor buffer size",
+			aggr: plugin.AggregationConfig{MonitorBufferSize: 1000},
+		}, {
+			desc:      "Negative monitor buffer size",
+			aggr:      plugin.AggregationConfig{MonitorBufferSize: -1},
+			expectErr: true,
+		}, {
+			desc: "Max connections",
+			aggr: plugin.AggregationConfig{MaxConnections: 512},
+		}, {
+			desc:      "Negative max connections",
+			aggr:      plugin.AggregationConfig{MaxConnections: -1},
+			expectErr: true,
+		}, {
+			desc: "Concurrent writes",
+			aggr: plugin.AggregationConfig{MaxConcurrentWrites: 64},
+		}, {
+			desc:      "Negative concurrent writes",
+			aggr:      plugin.AggregationConfig{MaxConcurrentWrites: -1},
+			expectErr: true,
+		}, {
+			desc: "Metrics port",
+			aggr: plugin.AggregationConfig{BindPort: 8080, MetricsBindPort: 9090},
+		}, {
+			desc:      "Metrics port out of range",
+			aggr:      plugin.AggregationConfig{MetricsBindPort: 70000},
+			expectErr: true,
+		}, {
+			desc:      "Metrics port same as bind port",
+			aggr:      plugin.AggregationConfig{BindPort: 8080, MetricsBindPort: 8080},
+			expectErr: true,
+		}, {
+			desc: "CA files",
+			aggr: plugin.AggregationConfig{CACertFile: "/etc/sonobuoy/ca.crt", CAKeyFile: "/etc/sonobuoy/ca.key"},
+		}, {
+			desc:      "CA certificate without key",
+			aggr:      plugin.AggregationConfig{CACertFile: "/etc/sonobuoy/ca.crt"},
+			expectErr: true,
+		}, {
+			desc: "RSA keys",
+			aggr: plugin.AggregationConfig{KeyType: "rsa"},
+		}, {
+			desc:      "Unknown key type",
+			aggr:      plugin.AggregationConfig{KeyType: "dsa"},
+			expectErr: true,
+		}, {
+			desc:      "Key type with an existing CA",
+			aggr:      plugin.AggregationConfig{KeyType: "rsa", CACertFile: "/etc/sonobuoy/ca.crt", CAKeyFile: "/etc/sonobuoy/ca.key"},
+			expectErr: true,
+		}, {
+			desc: "TLS settings",
+			aggr: plugin.AggregationConfig{MinTLSVersion: "1.3", CipherSuites: []string{"TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256"}},
+		}, {
+			desc:      "TLS 1.0",
+			aggr:      plugin.AggregationConfig{MinTLSVersion: "1.0"},
+			expectErr: true,
+		}, {
+			desc:      "Weak cipher suite",
+			aggr:      plugin.AggregationConfig{CipherSuites: []string{"TLS_ECDHE_RSA_WITH_3DES_EDE_CBC_SHA"}},
+			expectErr: true,
+		}, {
+			desc: "Worker proxy",
+			aggr: plugin.AggregationConfig{WorkerProxyURL: "http://egress.example.com:3128"},
+		}, {
+			desc: "Completion threshold",
+			aggr: plugin.AggregationConfig{CompletionThreshold: 0.95},
+		}, {
+			desc:      "Completion threshold above 1",
+			aggr:      plugin.AggregationConfig{CompletionThreshold: 1.5},
+			expectErr: true,
+		}, {
+			desc:      "HTTPS worker proxy",
+			aggr:      plugin.AggregationConfig{WorkerProxyURL: "https://egress.example.com"},
+			expectErr: true,
+		}, {
+			desc:      "Worker proxy without a host",
+			aggr:      plugin.AggregationConfig{WorkerProxyURL: "http://"},
+			expectErr: true,
+		}, {
+			desc: "Base path",
+			aggr: plugin.AggregationConfig{BasePath: "/sonobuoy/", WorkerUploadPathPrefix: "/"},
+		}, {
+			desc:      "Relative base path",
+			aggr:      plugin.AggregationConfig{BasePath: "sonobuoy"},
+			expectErr: true,
+		}, {
+			desc:      "Worker upload path prefix with a query",
+			aggr:      plugin.AggregationConfig{WorkerUploadPathPrefix: "/sonobuoy?x=1"},
+			expectErr: true,
+		}, {
+			desc: "Worker upload retries",
+			aggr: plugin.AggregationConfig{WorkerUploadRetries: 5, WorkerUploadTimeoutSeconds: 600},
+		}, {
+			desc:      "Negative worker upload retries",
+			aggr:      plugin.AggregationConfig{WorkerUploadRetries: -1},
+			expectErr: true,
+		}, {
+			desc:      "Negative worker upload timeout",
+			aggr:      plugin.AggregationConfig{WorkerUploadTimeoutSeconds: -1},
+			expectErr: true,
+		}, {
+			desc:      "Negative node list timeout",
+			aggr:      plugin.AggregationConfig{NodeListTimeoutSeconds: -1},
+			expectErr: true,
+		}, {
+			desc:      "Negative plugin launch delay",
+			aggr:      plugin.AggregationConfig{PluginLaunchDelaySeconds: -1},
+			expectErr: true,
+		}, {
+			desc:      "Negative resource usage interval",
+			aggr:      plugin.AggregationConfig{ResourceUsageIntervalSeconds: -1},
+			expectErr: true,
+		}, {
+			desc: "Upload codecs",
+			aggr: plugin.AggregationConfig{UploadCodecs: []string{plugin.UploadCodecIdentity, plugin.UploadCodecGzip}},
+		}, {
+			desc:      "Unknown upload codec",
+			aggr:      plugin.AggregationConfig{UploadCodecs: []string{"zstd"}},
+			expectErr: true,
+		}, {
+			desc: "Heartbeats",
+			aggr: plugin.AggregationConfig{HeartbeatIntervalSeconds: 30, HeartbeatStallSeconds: 120, FailStalledResults: true},
+		}, {
+			desc:      "Negative heartbeat interval",
+			aggr:      plugin.AggregationConfig{HeartbeatIntervalSeconds: -1},
+			expectErr: true,
+		}, {
+			desc:      "Stall threshold without heartbeats",
+			aggr:      plugin.AggregationConfig{HeartbeatStallSeconds: 120},
+			expectErr: true,
+		}, {
+			desc:      "Failing stalled results without heartbeats",
+			aggr:      plugin.AggregationConfig{FailStalledResults: true},
+			expectErr: true,
+		}, {
+			desc:      "Stall threshold too close to the heartbeat interval",
+			aggr:      plugin.AggregationConfig{HeartbeatIntervalSeconds: 30, HeartbeatStallSeconds: 45},
+			expectErr: true,
+		}, {
+			desc: "Results TTL",
+			aggr: plugin.AggregationConfig{ResultsTTLSeconds: 86400},
+		}, {
+			desc:      "Negative results TTL",
+			aggr:      plugin.AggregationConfig{ResultsTTLSeconds: -1},
+			expectErr: true,
+		}, {
+			desc: "Max run time longer than the timeout",
+			aggr: plugin.AggregationConfig{TimeoutSeconds: 600, MaxRunSeconds: 900},
+		}, {
+			desc:      "Negative max run time",
+			aggr:      plugin.AggregationConfig{MaxRunSeconds: -1},
+			expectErr: true,
+		}, {
+			desc:      "Max run time shorter than the timeout",
+			aggr:      plugin.AggregationConfig{TimeoutSeconds: 600, MaxRunSeconds: 300},
+			expectErr: true,
+		}, {
+			desc: "Graceful shutdown period within the timeout",
+			aggr: plugin.AggregationConfig{TimeoutSeconds: 600, GracefulShutdownSeconds: 120, PluginGracefulShutdownSeconds: map[string]int{"e2e": 300}},
+		}, {
+			desc:      "Negative graceful shutdown period",
+			aggr:      plugin.AggregationConfig{GracefulShutdownSeconds: -1},
+			expectErr: true,
+		}, {
+			desc:      "Graceful shutdown period as long as the timeout",
+			aggr:      plugin.AggregationConfig{TimeoutSeconds: 600, GracefulShutdownSeconds: 600},
+			expectErr: true,
+		}, {
+			desc:      "Plugin graceful shutdown period longer than the timeout",
+			aggr:      plugin.AggregationConfig{TimeoutSeconds: 600, PluginGracefulShutdownSeconds: map[string]int{"e2e": 900}},
+			expectErr: true,
+		}, {
+			desc: "Filesystem result sink",
+			aggr: plugin.AggregationConfig{ResultSink: plugin.ResultSinkFilesystem, ResultSinkDir: "/mnt/results"},
+		}, {
+			desc:      "Filesystem result sink without a directory",
+			aggr:      plugin.AggregationConfig{ResultSink: plugin.ResultSinkFilesystem},
+			expectErr: true,
+		}, {
+			desc: "S3 result sink",
+			aggr: plugin.AggregationConfig{ResultSink: plugin.ResultSinkS3, S3Bucket: "results", S3Region: "us-east-1", S3Endpoint: "https://storage.googleapis.com"},
+		}, {
+			desc:      "S3 result sink without a bucket",
+			aggr:      plugin.AggregationConfig{ResultSink: plugin.ResultSinkS3, S3Region: "us-east-1"},
+			expectErr: true,
+		}, {
+			desc:      "Unknown result sink",
+			aggr:      plugin.AggregationConfig{ResultSink: "gcs"},
+			expectErr: true,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.desc, func(t *testing.T) {
+			cfg := New()
+			cfg.Aggregation = tc.aggr
+			errs := cfg.Validate()
+			if tc.expectErr != (len(errs) > 0) {
+				t.Errorf("expected error %v, got %v", tc.expectErr, errs)
+			}
+		})
+	}
+}
+
+func TestValidateResultsCompression(t *testing.T) {
+	testCases := []struct {
+		compression string
+		expectErr   bool
+	}{
+		{compression: ""},
+		{compression: CompressionGzip},
+		{compression: CompressionNone},
+		{compression: CompressionZstd},
+		{compression: "bzip2", expectErr: true},
+	}
+
+	for _, tc := range testCases {
+		t.Run(fmt.Sprintf("%q", tc.compression), func(t *testing.T) {
+			cfg := New()
+			cfg.ResultsCompression = tc.compression
+			errs := cfg.Validate()
+			if tc.expectErr != (len(errs) > 0) {
+				t.Errorf("expected error %v, got %v", tc.expectErr, errs)
+			}
+		})
+	}
+}
@@ -17,8 +17,10 @@ limitations under the License.
 package discovery
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"os"
 	"path"
@@ -28,6 +30,7 @@ import (
 	"github.com/heptio/sonobuoy/pkg/dynamic"
 	"github.com/heptio/sonobuoy/pkg/errlog"
 
+	"github.com/klauspost/compress/zstd"
 	"github.com/pkg/errors"
 	"github.com/rifflock/lfshook"
 	"github.com/sirupsen/logrus"
@@ -59,9 +62,13 @@ func Run(restConf *rest.Config, cfg *config.Config) (errCount int) {
 
 	t := time.Now()
 
-	// 1. Create the directory which will store the results, including the
-	// `meta` directory inside it (which we always need regardless of
-	// config)
+	// 1. Purge the results of previous runs which have expired, in case the
+	// results volume is shared between runs, then create the directory
+	// which will store the results, including the `meta` directory inside
+	// it (which we always need regardless of config)
+	if _, err := pluginaggregation.PurgeExpiredRuns(cfg.ResultsDir, cfg.UUID, t, logrus.StandardLogger()); err != nil {
+		errlog.LogError(errors.Wrap(err, "could not purge expired results"))
+	}
 	outpath := path.Join(cfg.ResultsDir, cfg.UUID)
 	metapath := path.Join(outpath, MetaLocation)
 	err = os.MkdirAll(metapath, 0755)
@@ -123,52 +130,111 @@ func Run(restConf *rest.Config, cfg *config.Config) (errCount int) {
 		}
 	}
 
-	// 4. Run the plugin aggregator
-	trackErrorsFor("running plugins")(
-		pluginaggregation.Run(kubeClient, cfg.LoadedPlugins, cfg.Aggregation, cfg.Namespace, outpath),
-	)
-
-	// 5. Run the queries
-	recorder := NewQueryRecorder()
-	clusterResources, nsResources, err := getAllFilteredResources(apiHelper, cfg.Resources)
+	// Results are written to the result sink, if any, as they come in so
+	// they aren't lost if this pod is.
+	sink, err := pluginaggregation.NewResultSink(cfg.Aggregation, cfg.UUID)
+	if err != nil {
+		errlog.LogError(errors.Wrap(err, "could not create result sink"))
+		return errCount + 1
+	}
 
-	trackErrorsFor("querying cluster resources")(
-		QueryHostData(kubeClient, recorder, cfg),
-	)
+	// 4. Run the plugin aggregator. The results directory is only there
+	// already if this container restarted during the run, in which case
+	// the run picks up where it left off.
+	// Annotation updates can be paused with a signal, e.g. while the API
+	// server rejects writes during maintenance.
+	pause := &pluginaggregation.AnnotationPause{}
+	stopPauseSignals := handlePauseSignals(pause)
+	summary, err := pluginaggregation.Run(context.Background(), kubeClient, cfg.LoadedPlugins, cfg.Aggregation, cfg.Namespace, outpath, pluginaggregation.RunOptions{Sink: sink, Resume: true, PauseAnnotations: pause, RunID: cfg.UUID})
+	stopPauseSignals()
+	trackErrorsFor("running plugins")(err)
+	dryRun := summary != nil && summary.Plan != nil
+	if dryRun {
+		// Nothing was run, so record the plan in place of any results
+		if blob, err := json.Marshal(summary.Plan); err == nil {
+			trackErrorsFor("writing run plan")(
+				ioutil.WriteFile(path.Join(metapath, "plan.json"), blob, 0644),
+			)
+		}
+	} else if summary != nil {
+		logrus.WithFields(logrus.Fields{
+			"expected":    summary.Expected,
+			"completed":   len(summary.Completed),
+			"failed":      len(summary.Failed),
+			"timedout":    len(summary.TimedOut),
+			"removed":     len(summary.Removed),
+			"notreported": len(summary.NotReported),
+			"skipped":     len(summary.Skipped),
+		}).Info("Plugin aggregation finished")
+		if err == nil && !summary.Succeeded() {
+			trackErrorsFor("running plugins")(
+				errors.Errorf("%v of %v plugin results failed or timed out", len(summary.Failed)+len(summary.TimedOut), summary.Expected),
+			)
+		}
+	}
 
-	trackErrorsFor("querying cluster resources")(
-		QueryResources(apiHelper, recorder, clusterResources, nil, cfg),
-	)
+	// Dry runs skip straight to packaging up the plan
+	if !dryRun {
+		// 5. Run the queries
+		recorder := NewQueryRecorder()
+		clusterResources, nsResources, _ := getAllFilteredResources(apiHelper, cfg.Resources)
 
-	trackErrorsFor("querying server info")(
-		QueryServerData(kubeClient, recorder, cfg),
-	)
+		trackErrorsFor("querying cluster resources")(
+			QueryHostData(kubeClient, recorder, cfg),
+		)
 
-	for _, ns := range nslist {
-		trackErrorsFor("querying resources under namespace " + ns)(
-			QueryResources(apiHelper, recorder, nsResources, &ns, cfg),
+		trackErrorsFor("querying cluster resources")(
+			QueryResources(apiHelper, recorder, clusterResources, nil, cfg),
 		)
 
-		trackErrorsFor("querying pod logs under namespace " + ns)(
-			QueryPodLogs(kubeClient, recorder, ns, cfg),
+		trackErrorsFor("querying server info")(
+			QueryServerData(kubeClient, recorder, cfg),
 		)
-	}
 
-	// 6. Dump the query times
-	trackErrorsFor("recording query times")(
-		recorder.DumpQueryData(path.Join(metapath, "query-time.json")),
-	)
+		for _, ns := range nslist {
+			trackErrorsFor("querying resources under namespace " + ns)(
+				QueryResources(apiHelper, recorder, nsResources, &ns, cfg),
+			)
+
+			trackErrorsFor("querying pod logs under namespace " + ns)(
+				QueryPodLogs(kubeClient, recorder, ns, cfg),
+			)
+		}
+
+		// 6. Dump the query times
+		trackErrorsFor("recording query times")(
+			recorder.DumpQueryData(path.Join(metapath, "query-time.json")),
+		)
 
-	// 7. Clean up after the plugins
-	pluginaggregation.Cleanup(kubeClient, cfg.LoadedPlugins)
+		// 7. Clean up after the plugins, other than those whose resources
+		// are kept for debugging
+		trackErrorsFor("cleaning up after the plugins")(
+			pluginaggregation.CleanupPlugins(context.Background(), kubeClient, cfg.LoadedPlugins, cfg.Aggregation, summary, outpath, logrus.StandardLogger()),
+		)
+	}
 
-	// 8. tarball up results YYYYMMDDHHMM_sonobuoy_UID.tar.gz
-	tb := cfg.ResultsDir + "/" + t.Format("200601021504") + "_sonobuoy_" + cfg.UUID + ".tar.gz"
-	err = tarx.Compress(tb, outpath, &tarx.CompressOptions{Compression: tarx.Gzip})
+	// 8. tarball up results YYYYMMDDHHMM_sonobuoy_UID.tar.gz (or .tar.zst, or
+	// .tar, depending on their compression)
+	tb := cfg.ResultsTarball(t)
+	err = writeResultsTarball(tb, outpath, cfg.ResultsCompression)
 	if err == nil {
 		defer os.RemoveAll(outpath)
 	}
 	trackErrorsFor("assembling results tarball")(err)
+	if err == nil && cfg.Aggregation.ResultsTTLSeconds > 0 {
+		trackErrorsFor("stamping results tarball")(
+			stampTarball(cfg, tb, metapath, t),
+		)
+	}
+
+	if sink != nil {
+		if err == nil {
+			trackErrorsFor("writing results tarball to the result sink")(
+				pluginaggregation.WriteFileToSink(sink, path.Base(tb), tb),
+			)
+		}
+		trackErrorsFor("finalizing the result sink")(sink.Finalize())
+	}
 
 	// 9. Mark final annotation stating the results are available and status is completed.
 	trackErrorsFor("updating pod status")(
@@ -180,6 +246,71 @@ func Run(restConf *rest.Config, cfg *config.Config) (errCount int) {
 	return errCount
 }
 
+// writeResultsTarball tarballs up the results in dir, compressed as given by
+// compression (see config.ResultsCompression).
+func writeResultsTarball(tarball, dir, compression string) error {
+	switch compression {
+	case config.CompressionNone:
+		return tarx.Compress(tarball, dir, &tarx.CompressOptions{Compression: tarx.Uncompressed})
+	case config.CompressionZstd:
+		return writeZstdTarball(tarball, dir)
+	default:
+		return tarx.Compress(tarball, dir, &tarx.CompressOptions{Compression: tarx.Gzip})
+	}
+}
+
+// writeZstdTarball tarballs up dir, compressed with zstd. tarx can only gzip
+// tarballs, so the tarball is written uncompressed first and then compressed.
+func writeZstdTarball(tarball, dir string) error {
+	tmp := tarball + ".tmp"
+	if err := tarx.Compress(tmp, dir, &tarx.CompressOptions{Compression: tarx.Uncompressed}); err != nil {
+		return err
+	}
+	defer os.Remove(tmp)
+	in, err := os.Open(tmp)
+	if err != nil {
+		return errors.Wrapf(err, "couldn't open %v", tmp)
+	}
+	defer in.Close()
+
+	out, err := os.Create(tarball)
+	if err != nil {
+		return errors.Wrapf(err, "couldn't create %v", tarball)
+	}
+	if err := zstdCompress(out, in); err != nil {
+		out.Close()
+		os.Remove(tarball)
+		return errors.Wrapf(err, "couldn't write %v", tarball)
+	}
+	return errors.Wrapf(out.Close(), "couldn't write %v", tarball)
+}
+
+// zstdCompress copies r to w, compressed with zstd.
+func zstdCompress(w io.Writer, r io.Reader) error {
+	zw, err := zstd.NewWriter(w)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(zw, r); err != nil {
+		zw.Close()
+		return err
+	}
+	return zw.Close()
+}
+
+// stampTarball writes the stamp of the run alongside its tarball, so that the
+// tarball is purged once it expires even though the results directory, with
+// the stamp in it, is removed. The stamp is copied from the results directory
+// so the tarball expires along with the results.
+func stampTarball(cfg *config.Config, tarball, metapath string, started time.Time) error {
+	stamp, err := pluginaggregation.ReadRunStamp(path.Join(metapath, pluginaggregation.RunStampFile))
+	if err != nil {
+		stamp = pluginaggregation.NewRunStamp(cfg.UUID, started, cfg.Aggregation)
+	}
+	stamp.Artifacts = []string{path.Base(tarball)}
+	return pluginaggregation.WriteRunStamp(path.Join(cfg.ResultsDir, cfg.UUID+pluginaggregation.RunStampSuffix), stamp)
+}
+
 // updateStatus changes the summary status of the sonobuoy pod in order to
 // effect the finalized status the user sees. This does not change the status
 // of individual plugins.
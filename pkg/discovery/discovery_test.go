@@ -0,0 +1,120 @@
+/*
+Copyright 2018 Heptio Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package discovery
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/heptio/sonobuoy/pkg/config"
+	"github.com/klauspost/compress/zstd"
+)
+
+func TestWriteResultsTarball(t *testing.T) {
+	files := map[string]string{
+		"meta/config.json":                  `{"UUID": "0xDEADBEEF"}`,
+		"plugins/e2e/results/junit_01.xml":  "<testsuite/>",
+		"plugins/systemd_logs/results/node": "logs",
+	}
+
+	testCases := []struct {
+		compression string
+		decompress  func(io.Reader) (io.Reader, error)
+	}{
+		{
+			compression: "",
+			decompress:  func(r io.Reader) (io.Reader, error) { return gzip.NewReader(r) },
+		}, {
+			compression: config.CompressionGzip,
+			decompress:  func(r io.Reader) (io.Reader, error) { return gzip.NewReader(r) },
+		}, {
+			compression: config.CompressionZstd,
+			decompress:  func(r io.Reader) (io.Reader, error) { return zstd.NewReader(r) },
+		}, {
+			compression: config.CompressionNone,
+			decompress:  func(r io.Reader) (io.Reader, error) { return r, nil },
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.compression, func(t *testing.T) {
+			dir, err := ioutil.TempDir("", "sonobuoy_discovery_test")
+			if err != nil {
+				t.Fatalf("couldn't create temp directory: %v", err)
+			}
+			defer os.RemoveAll(dir)
+
+			results := filepath.Join(dir, "results")
+			for name, contents := range files {
+				path := filepath.Join(results, filepath.FromSlash(name))
+				if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+					t.Fatalf("couldn't create directory for %v: %v", name, err)
+				}
+				if err := ioutil.WriteFile(path, []byte(contents), 0644); err != nil {
+					t.Fatalf("couldn't write %v: %v", name, err)
+				}
+			}
+
+			tarball := filepath.Join(dir, "results.tar")
+			if err := writeResultsTarball(tarball, results, tc.compression); err != nil {
+				t.Fatalf("unexpected error writing tarball: %v", err)
+			}
+			if leftover, _ := filepath.Glob(filepath.Join(dir, "*.tmp")); len(leftover) != 0 {
+				t.Errorf("expected no temporary files to be left, got %v", leftover)
+			}
+
+			f, err := os.Open(tarball)
+			if err != nil {
+				t.Fatalf("couldn't open tarball: %v", err)
+			}
+			defer f.Close()
+			r, err := tc.decompress(f)
+			if err != nil {
+				t.Fatalf("couldn't decompress tarball: %v", err)
+			}
+
+			got := map[string]string{}
+			tr := tar.NewReader(r)
+			for {
+				header, err := tr.Next()
+				if err == io.EOF {
+					break
+				}
+				if err != nil {
+					t.Fatalf("couldn't read tarball: %v", err)
+				}
+				if header.Typeflag != tar.TypeReg {
+					continue
+				}
+				contents, err := ioutil.ReadAll(tr)
+				if err != nil {
+					t.Fatalf("couldn't read %v: %v", header.Name, err)
+				}
+				got[filepath.ToSlash(header.Name)] = string(contents)
+			}
+			if !reflect.DeepEqual(got, files) {
+				t.Errorf("expected files %v, got %v", files, got)
+			}
+		})
+	}
+}
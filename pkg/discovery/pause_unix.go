@@ -0,0 +1,60 @@
+//go:build !windows
+// +build !windows
+
+/*
+Copyright 2018 Heptio Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package discovery
+
+import (
+	"os"
+	"os/signal"
+	"syscall"
+
+	"github.com/sirupsen/logrus"
+
+	pluginaggregation "github.com/heptio/sonobuoy/pkg/plugin/aggregation"
+)
+
+// handlePauseSignals pauses the annotation updates on SIGUSR1 and resumes
+// them on SIGUSR2, e.g. with kubectl exec sonobuoy -- kill -USR1 1, until
+// the returned function is called.
+func handlePauseSignals(pause *pluginaggregation.AnnotationPause) (stop func()) {
+	sigc := make(chan os.Signal, 1)
+	done := make(chan struct{})
+	signal.Notify(sigc, syscall.SIGUSR1, syscall.SIGUSR2)
+	go func() {
+		for {
+			select {
+			case <-done:
+				return
+			case sig := <-sigc:
+				log := logrus.WithField("signal", sig)
+				if sig == syscall.SIGUSR1 {
+					if pause.Pause() {
+						log.Info("Pausing annotation updates")
+					}
+				} else if pause.Resume() {
+					log.Info("Resuming annotation updates")
+				}
+			}
+		}
+	}()
+	return func() {
+		signal.Stop(sigc)
+		close(done)
+	}
+}
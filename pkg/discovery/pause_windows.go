@@ -0,0 +1,27 @@
+/*
+Copyright 2018 Heptio Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package discovery
+
+import (
+	pluginaggregation "github.com/heptio/sonobuoy/pkg/plugin/aggregation"
+)
+
+// handlePauseSignals does nothing on Windows, which has no SIGUSR1 or
+// SIGUSR2 and where the aggregator isn't run.
+func handlePauseSignals(pause *pluginaggregation.AnnotationPause) (stop func()) {
+	return func() {}
+}
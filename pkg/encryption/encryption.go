@@ -0,0 +1,259 @@
+/*
+Copyright 2018 Heptio Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package encryption encrypts result files at rest. Each file is encrypted
+// with AES-256-GCM in chunks, with a key derived from a secret shared by the
+// aggregator and whoever retrieves the results using HKDF-SHA256 and a salt
+// kept in the file's header, so that each file can be decrypted on its own.
+package encryption
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"io"
+	"io/ioutil"
+	"math"
+
+	"github.com/pkg/errors"
+)
+
+// Cipher names how files are encrypted, as recorded in the results manifest.
+const Cipher = "AES-256-GCM"
+
+const (
+	// chunkSize is how much of a file is sealed at a time. Every chunk but
+	// the last is full, so the last may be empty.
+	chunkSize = 64 * 1024
+	saltSize  = 16
+	// noncePrefixSize is the random part of each chunk's nonce, followed by
+	// a 4 byte chunk counter and a byte marking the last chunk.
+	noncePrefixSize = 7
+	keySize         = 32
+	tagSize         = 16
+)
+
+var (
+	magic      = []byte("sonobuoy-encrypted-v1\n")
+	headerSize = len(magic) + saltSize + noncePrefixSize
+	// hkdfInfo binds derived keys to their use.
+	hkdfInfo = []byte("sonobuoy results")
+)
+
+// ErrNotEncrypted is returned when decrypting a file which wasn't encrypted.
+var ErrNotEncrypted = errors.New("file isn't encrypted")
+
+// ReadKeyFile returns the secret in the file, ignoring whitespace around it
+// such as a trailing newline.
+func ReadKeyFile(filename string) ([]byte, error) {
+	secret, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, errors.Wrapf(err, "couldn't read encryption key file %v", filename)
+	}
+	secret = bytes.TrimSpace(secret)
+	if len(secret) == 0 {
+		return nil, errors.Errorf("encryption key file %v is empty", filename)
+	}
+	return secret, nil
+}
+
+// KeyID identifies the secret without revealing it, so that a wrong key can
+// be told apart from a corrupt file.
+func KeyID(secret []byte) string {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte("sonobuoy key id"))
+	return hex.EncodeToString(mac.Sum(nil)[:8])
+}
+
+// IsEncrypted returns true if what r reads next is an encrypted file. Nothing
+// is consumed from r.
+func IsEncrypted(r *bufio.Reader) (bool, error) {
+	prefix, err := r.Peek(len(magic))
+	if err != nil && err != io.EOF {
+		return false, errors.Wrap(err, "couldn't read file")
+	}
+	return bytes.Equal(prefix, magic), nil
+}
+
+// PlaintextSize returns the size of the decrypted contents of an encrypted
+// file of the given size.
+func PlaintextSize(size int64) (int64, error) {
+	body := size - int64(headerSize)
+	sealed := int64(chunkSize + tagSize)
+	if body < tagSize || body%sealed < tagSize {
+		return 0, errors.Errorf("%v bytes isn't a valid size for an encrypted file", size)
+	}
+	return body/sealed*chunkSize + body%sealed - tagSize, nil
+}
+
+// deriveKey derives the file's key from the secret and its salt with HKDF,
+// which only needs the one block of output for AES-256.
+func deriveKey(secret, salt []byte) []byte {
+	extract := hmac.New(sha256.New, salt)
+	extract.Write(secret)
+	expand := hmac.New(sha256.New, extract.Sum(nil))
+	expand.Write(hkdfInfo)
+	expand.Write([]byte{1})
+	return expand.Sum(nil)[:keySize]
+}
+
+func newAEAD(secret, salt []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(deriveKey(secret, salt))
+	if err != nil {
+		return nil, errors.Wrap(err, "couldn't create cipher")
+	}
+	aead, err := cipher.NewGCM(block)
+	return aead, errors.Wrap(err, "couldn't create cipher")
+}
+
+// chunkNonce returns the nonce of the given chunk. Marking the last chunk
+// means a file cut short at a chunk boundary doesn't decrypt.
+func chunkNonce(prefix []byte, counter uint32, last bool) []byte {
+	nonce := make([]byte, noncePrefixSize+5)
+	copy(nonce, prefix)
+	binary.BigEndian.PutUint32(nonce[noncePrefixSize:], counter)
+	if last {
+		nonce[len(nonce)-1] = 1
+	}
+	return nonce
+}
+
+// NewEncrypter returns a reader of the encrypted contents of r.
+func NewEncrypter(r io.Reader, secret []byte) (io.Reader, error) {
+	header := make([]byte, headerSize)
+	copy(header, magic)
+	if _, err := io.ReadFull(rand.Reader, header[len(magic):]); err != nil {
+		return nil, errors.Wrap(err, "couldn't generate salt")
+	}
+	salt := header[len(magic) : len(magic)+saltSize]
+	aead, err := newAEAD(secret, salt)
+	if err != nil {
+		return nil, err
+	}
+	return &encrypter{
+		src:    r,
+		aead:   aead,
+		prefix: header[len(magic)+saltSize:],
+		plain:  make([]byte, chunkSize),
+		out:    make([]byte, 0, chunkSize+tagSize),
+		buf:    header,
+	}, nil
+}
+
+type encrypter struct {
+	src     io.Reader
+	aead    cipher.AEAD
+	prefix  []byte
+	counter uint32
+	plain   []byte
+	out     []byte
+	// buf is what has been encrypted but not read yet
+	buf  []byte
+	done bool
+}
+
+func (e *encrypter) Read(p []byte) (int, error) {
+	for len(e.buf) == 0 {
+		if e.done {
+			return 0, io.EOF
+		}
+		n, err := io.ReadFull(e.src, e.plain)
+		last := err == io.EOF || err == io.ErrUnexpectedEOF
+		if err != nil && !last {
+			return 0, err
+		}
+		if e.counter == math.MaxUint32 {
+			return 0, errors.New("file is too large to encrypt")
+		}
+		e.buf = e.aead.Seal(e.out[:0], chunkNonce(e.prefix, e.counter, last), e.plain[:n], nil)
+		e.counter++
+		e.done = last
+	}
+	n := copy(p, e.buf)
+	e.buf = e.buf[n:]
+	return n, nil
+}
+
+// NewDecrypter returns a reader of the decrypted contents of r, which must
+// have been encrypted with the same secret. ErrNotEncrypted is returned if r
+// isn't encrypted. Reading fails if the secret is wrong or the file has been
+// tampered with or cut short.
+func NewDecrypter(r io.Reader, secret []byte) (io.Reader, error) {
+	header := make([]byte, headerSize)
+	n, err := io.ReadFull(r, header)
+	if !bytes.HasPrefix(header[:n], magic) {
+		return nil, ErrNotEncrypted
+	}
+	if err != nil {
+		return nil, errors.Wrap(err, "couldn't read encryption header")
+	}
+	aead, err := newAEAD(secret, header[len(magic):len(magic)+saltSize])
+	if err != nil {
+		return nil, err
+	}
+	return &decrypter{
+		src:    r,
+		aead:   aead,
+		prefix: header[len(magic)+saltSize:],
+		sealed: make([]byte, chunkSize+tagSize),
+		out:    make([]byte, 0, chunkSize),
+	}, nil
+}
+
+type decrypter struct {
+	src     io.Reader
+	aead    cipher.AEAD
+	prefix  []byte
+	counter uint32
+	sealed  []byte
+	out     []byte
+	// buf is what has been decrypted but not read yet
+	buf  []byte
+	done bool
+}
+
+func (d *decrypter) Read(p []byte) (int, error) {
+	for len(d.buf) == 0 {
+		if d.done {
+			return 0, io.EOF
+		}
+		// Only the last chunk is short, so a full one is never the last.
+		n, err := io.ReadFull(d.src, d.sealed)
+		last := err == io.ErrUnexpectedEOF
+		if err == io.EOF {
+			return 0, errors.New("encrypted file is truncated")
+		}
+		if err != nil && !last {
+			return 0, err
+		}
+		plain, err := d.aead.Open(d.out[:0], chunkNonce(d.prefix, d.counter, last), d.sealed[:n], nil)
+		if err != nil {
+			return 0, errors.New("couldn't decrypt file, either the key is wrong or the file is corrupt or truncated")
+		}
+		d.buf = plain
+		d.counter++
+		d.done = last
+	}
+	n := copy(p, d.buf)
+	d.buf = d.buf[n:]
+	return n, nil
+}
@@ -0,0 +1,149 @@
+/*
+Copyright 2018 Heptio Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package encryption
+
+import (
+	"bufio"
+	"bytes"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+var secret = []byte("correct horse battery staple")
+
+func encrypt(t *testing.T, plain []byte) []byte {
+	r, err := NewEncrypter(bytes.NewReader(plain), secret)
+	if err != nil {
+		t.Fatalf("unexpected error creating encrypter: %v", err)
+	}
+	sealed, err := ioutil.ReadAll(r)
+	if err != nil {
+		t.Fatalf("unexpected error encrypting: %v", err)
+	}
+	return sealed
+}
+
+func TestRoundTrip(t *testing.T) {
+	for _, size := range []int{0, 1, chunkSize - 1, chunkSize, chunkSize + 1, 3*chunkSize + 17} {
+		plain := make([]byte, size)
+		rand.Read(plain)
+		sealed := encrypt(t, plain)
+		if size > 16 && bytes.Contains(sealed, plain) {
+			t.Errorf("size %v: expected the encrypted file not to contain the plaintext", size)
+		}
+
+		if encrypted, err := IsEncrypted(bufio.NewReader(bytes.NewReader(sealed))); err != nil || !encrypted {
+			t.Errorf("size %v: expected the file to be detected as encrypted, got %v, %v", size, encrypted, err)
+		}
+		if got, err := PlaintextSize(int64(len(sealed))); err != nil || got != int64(size) {
+			t.Errorf("size %v: expected the plaintext size from %v bytes to be %v, got %v, %v", size, len(sealed), size, got, err)
+		}
+
+		r, err := NewDecrypter(bytes.NewReader(sealed), secret)
+		if err != nil {
+			t.Fatalf("size %v: unexpected error creating decrypter: %v", size, err)
+		}
+		got, err := ioutil.ReadAll(r)
+		if err != nil {
+			t.Fatalf("size %v: unexpected error decrypting: %v", size, err)
+		}
+		if !bytes.Equal(got, plain) {
+			t.Errorf("size %v: decrypted file doesn't match the original", size)
+		}
+	}
+}
+
+func TestDecryptFailures(t *testing.T) {
+	plain := make([]byte, 2*chunkSize+100)
+	rand.Read(plain)
+	sealed := encrypt(t, plain)
+
+	tampered := append([]byte(nil), sealed...)
+	tampered[len(tampered)/2] ^= 1
+
+	testCases := []struct {
+		desc   string
+		sealed []byte
+		secret []byte
+	}{
+		{desc: "wrong key", sealed: sealed, secret: []byte("wrong")},
+		{desc: "tampered", sealed: tampered, secret: secret},
+		{desc: "truncated mid-chunk", sealed: sealed[:len(sealed)-10], secret: secret},
+		{desc: "truncated at a chunk boundary", sealed: sealed[:headerSize+2*(chunkSize+tagSize)], secret: secret},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.desc, func(t *testing.T) {
+			r, err := NewDecrypter(bytes.NewReader(tc.sealed), tc.secret)
+			if err != nil {
+				t.Fatalf("unexpected error creating decrypter: %v", err)
+			}
+			if _, err := ioutil.ReadAll(r); err == nil {
+				t.Error("expected an error decrypting")
+			}
+		})
+	}
+
+	if _, err := NewDecrypter(strings.NewReader("plain text"), secret); err != ErrNotEncrypted {
+		t.Errorf("expected ErrNotEncrypted for a plain file, got %v", err)
+	}
+	if encrypted, err := IsEncrypted(bufio.NewReader(strings.NewReader("plain"))); err != nil || encrypted {
+		t.Errorf("expected a plain file not to be detected as encrypted, got %v, %v", encrypted, err)
+	}
+}
+
+func TestPlaintextSize_invalid(t *testing.T) {
+	for _, size := range []int64{0, int64(headerSize), int64(headerSize + tagSize + chunkSize + 1)} {
+		if _, err := PlaintextSize(size); err == nil {
+			t.Errorf("expected an error for an encrypted file of %v bytes", size)
+		}
+	}
+}
+
+func TestReadKeyFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sonobuoy_encryption_test")
+	if err != nil {
+		t.Fatalf("Could not create temp directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	keyFile := filepath.Join(dir, "key")
+	if err := ioutil.WriteFile(keyFile, []byte("s3cret\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if key, err := ReadKeyFile(keyFile); err != nil || string(key) != "s3cret" {
+		t.Errorf("expected key s3cret, got %q, %v", key, err)
+	}
+
+	emptyFile := filepath.Join(dir, "empty")
+	if err := ioutil.WriteFile(emptyFile, []byte("\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ReadKeyFile(emptyFile); err == nil {
+		t.Error("expected an error for an empty key file")
+	}
+	if _, err := ReadKeyFile(filepath.Join(dir, "missing")); err == nil {
+		t.Error("expected an error for a missing key file")
+	}
+
+	if KeyID(secret) == KeyID([]byte("other")) {
+		t.Error("expected different keys to have different IDs")
+	}
+}
@@ -23,12 +23,17 @@ package aggregation
 import (
 	"fmt"
 	"io"
+	"math"
 	"net/http"
 	"os"
 	"path"
+	"sort"
+	"strings"
 	"sync"
+	"time"
 
 	"github.com/heptio/sonobuoy/pkg/plugin"
+	"github.com/heptio/sonobuoy/pkg/plugin/driver/utils"
 	"github.com/heptio/sonobuoy/pkg/tarball"
 	"github.com/pkg/errors"
 	"github.com/sirupsen/logrus"
@@ -36,6 +41,10 @@ import (
 
 const (
 	gzipMimeType = "application/gzip"
+
+	// defaultMaxConcurrentWrites is how many results are written at once
+	// if MaxConcurrentWrites is unset.
+	defaultMaxConcurrentWrites = 16
 )
 
 // Aggregator is responsible for taking results from an HTTP server (configured
@@ -49,15 +58,124 @@ type Aggregator struct {
 	Results map[string]*plugin.Result
 	// ExpectedResults stores a map of results the server should expect
 	ExpectedResults map[string]*plugin.ExpectedResult
+	// DuplicatePolicy is what happens to results submitted after one was
+	// already recorded for the same expected result: they are ignored
+	// (plugin.DuplicateResultsIgnore, the default) or replace the recorded
+	// result (plugin.DuplicateResultsOverwrite). Either way a result only
+	// counts once towards completion.
+	DuplicatePolicy string
+	// MaxResultSizeBytes limits the size of each result submitted over
+	// HTTP. Larger results are rejected with a 413 and recorded as errors.
+	// Results aren't limited if it is 0.
+	MaxResultSizeBytes int64
+	// Layout decides where results are written within OutputDir. Defaults
+	// to NestedLayout if unset.
+	Layout ResultsLayout
+	// Transforms are applied in order to the body of each result before it
+	// is written out. If one fails, an error is recorded for the result.
+	Transforms []ResultTransform
+	// Sink, if set, is sent each of the files written for a result as soon
+	// as it's recorded, named by their path relative to the parent of
+	// OutputDir. Files of a result which is replaced by a duplicate are
+	// left in the sink unless the new result overwrites them.
+	Sink ResultSink
+	// ClientNames maps result types to the name of the client certificate
+	// issued to the plugin which submits them. Results submitted with a
+	// certificate issued to another plugin are rejected with a 403.
+	ClientNames map[string]string
+	// Priorities are the priorities of results, by result type. When more
+	// results are waiting to be written out than MaxConcurrentWrites, or
+	// to be ingested by IngestResults, those of higher priority go first;
+	// results of the same priority go in the order they arrived. Result
+	// types without a priority have priority 0.
+	Priorities map[string]int
+	// Log is where the aggregator logs to. Defaults to the standard logrus
+	// logger if unset.
+	Log logrus.FieldLogger
+	// MaxConcurrentWrites limits how many results submitted over HTTP are
+	// written out at once, other than streamed results since those last as
+	// long as the plugin runs. Further results wait for one to finish.
+	// Defaults to 16 if unset.
+	MaxConcurrentWrites int
+	// CompletionThreshold is the fraction of each plugin's expected results
+	// which must be recorded for the run to be complete. Once every plugin
+	// reaches it, the results still missing are recorded as not reported,
+	// which doesn't count as a failure. Defaults to 1, every result, if
+	// unset.
+	CompletionThreshold float64
+	// Schemas are the JSON Schemas results must match, by result type.
+	// Results which don't are recorded as errors listing how they don't.
+	// Results of types without a schema are recorded as they are.
+	Schemas map[string]*ResultSchema
+	// Reducers merge the results of each result type which has one into
+	// one more artifact, once they've all been recorded.
+	Reducers map[string]Reducer
+	// Observer, if set, is called when each expected result starts to
+	// arrive and when it completes, e.g. to show finer grained progress.
+	// It's called on a goroutine of its own, in the order results were
+	// observed, so a slow observer never holds up the results.
+	Observer func(Observation)
 
 	// resultEvents is a channel that is written to when results are seen
 	// by the server, so we can block until we're done.
 	resultEvents chan *plugin.Result
 	// resultsMutex prevents race conditions if two identical results
-	// come in at the same time.
+	// come in at the same time. It guards the results and the manifest,
+	// but isn't held while the body of a result is received.
 	resultsMutex sync.Mutex
+	// writes hands out the MaxConcurrentWrites slots for writing results
+	writes     *writeQueue
+	writesOnce sync.Once
+	// resultHooks are called each time a result is recorded.
+	resultHooks []resultHook
+	// reducible has the results to be merged by their Reducer, by result
+	// type and ID.
+	reducible map[string]map[string]ReducerInput
+	// partials stores the paths of the partial results seen so far
+	partials map[string]bool
+	// artifacts stores the paths of the artifacts seen so far
+	artifacts map[string]bool
+	// receiving stores the IDs of the results being received, which
+	// happens without holding resultsMutex
+	receiving map[string]bool
+	// writing stores the paths of the partial results and artifacts being
+	// received, which also happens without holding resultsMutex
+	writing map[string]bool
+	// uploaded stores the IDs of the results recorded from uploads, which
+	// may be replaced by uploading them again with Replace set
+	uploaded map[string]bool
+	// notReported is set once the results missing when the completion
+	// threshold was reached have been recorded as not reported
+	notReported bool
+	// progress stores the latest progress reported for each result, by ID
+	progress map[string]ProgressReport
+	// heartbeats stores when the last heartbeat for each result arrived,
+	// by ID
+	heartbeats map[string]time.Time
+	// manifest, if set, is updated each time a result is recorded
+	manifest *resultsManifest
+	// monitors, if set, is the queue of results from the plugins' monitors
+	// which is reported on in the metrics
+	monitors *monitorQueue
+	// diagnostics, if set, collects diagnostics for plugins which fail
+	diagnostics *diagnosticsCollector
+	// topologies are the topologies of the nodes results are expected from
+	topologies nodeTopologies
+	// observations, if set, delivers observations to the Observer
+	observations     *observations
+	observationsOnce sync.Once
+	// skipped are the plugins which were never launched
+	skipped []SkippedPlugin
+	// connections, if set, counts the connections to the aggregation
+	// server for the metrics
+	connections *connLimitListener
 }
 
+// resultHook is called with resultsMutex held each time the aggregator
+// records a result. pluginDone is true if no more results of the same result
+// type are expected.
+type resultHook func(result *plugin.Result, pluginDone bool)
+
 // NewAggregator constructs a new Aggregator object to write the given result
 // set out to the given output directory.
 func NewAggregator(outputDir string, expected []plugin.ExpectedResult) *Aggregator {
@@ -65,12 +183,21 @@ func NewAggregator(outputDir string, expected []plugin.ExpectedResult) *Aggregat
 		OutputDir:       outputDir,
 		Results:         make(map[string]*plugin.Result, len(expected)),
 		ExpectedResults: make(map[string]*plugin.ExpectedResult, len(expected)),
-		resultEvents:    make(chan *plugin.Result, len(expected)),
+		// Buffered so that non-blocking sends can't be missed by Wait
+		resultEvents: make(chan *plugin.Result, len(expected)+1),
+		partials:     map[string]bool{},
+		artifacts:    map[string]bool{},
+		receiving:    map[string]bool{},
+		writing:      map[string]bool{},
+		uploaded:     map[string]bool{},
+		progress:     map[string]ProgressReport{},
+		heartbeats:   map[string]time.Time{},
 	}
 
 	for i, expResult := range expected {
 		aggr.ExpectedResults[expResult.ID()] = &expected[i]
 	}
+	aggr.topologies.add(expected)
 
 	return aggr
 }
@@ -86,35 +213,297 @@ func (a *Aggregator) Wait(stop chan bool) {
 	}
 }
 
-// isComplete returns true if sure all expected results have checked in.
+// isComplete returns true once enough of the expected results have checked
+// in: every one of them, unless CompletionThreshold is less than 1.
 func (a *Aggregator) isComplete() bool {
 	a.resultsMutex.Lock()
 	defer a.resultsMutex.Unlock()
 
-	for _, result := range a.ExpectedResults {
-		if _, ok := a.Results[result.ID()]; !ok {
-			return false
+	return a.thresholdReached()
+}
+
+// thresholdReached returns true if every plugin has recorded at least
+// CompletionThreshold of its expected results. resultsMutex must be held by
+// the caller.
+func (a *Aggregator) thresholdReached() bool {
+	expected := map[string]int{}
+	recorded := map[string]int{}
+	for id, result := range a.ExpectedResults {
+		expected[result.ResultType]++
+		if _, ok := a.Results[id]; ok {
+			recorded[result.ResultType]++
 		}
 	}
 
+	for resultType, n := range expected {
+		if recorded[resultType] < requiredResults(n, a.CompletionThreshold) {
+			return false
+		}
+	}
 	return true
 }
 
+// requiredResults returns how many of a plugin's n expected results must be
+// recorded for it to reach the threshold. It rounds up, so a plugin with a
+// single result, such as a job, always needs it.
+func requiredResults(n int, threshold float64) int {
+	if threshold <= 0 || threshold >= 1 {
+		return n
+	}
+	// Allow for rounding errors, e.g. 0.95*100 shouldn't need 96 results
+	return int(math.Ceil(threshold*float64(n) - 1e-9))
+}
+
+// recordNotReported records an error result, counted as not reported rather
+// than failed, for each expected result still missing once the completion
+// threshold is reached, so that the run completes without them.
+// resultsMutex must be held by the caller.
+func (a *Aggregator) recordNotReported() {
+	a.notReported = true
+
+	var missing []*plugin.ExpectedResult
+	for id, result := range a.ExpectedResults {
+		if _, ok := a.Results[id]; !ok {
+			missing = append(missing, result)
+		}
+	}
+	sort.Slice(missing, func(i, j int) bool { return missing[i].ID() < missing[j].ID() })
+
+	for _, result := range missing {
+		a.logger().WithFields(logrus.Fields{
+			"plugin": result.ResultType,
+			"node":   result.NodeName,
+		}).Info("Completion threshold reached, no longer expecting result")
+		a.handleResult(utils.MakeErrorResult(result.ResultType, map[string]interface{}{
+			"error": fmt.Sprintf("%v: node %v hadn't reported when the completion threshold was reached", notReportedErrorPrefix, result.NodeName),
+		}, result.NodeName))
+	}
+}
+
+// pendingResults returns the expected results of the given result type which
+// have not checked in yet.
+func (a *Aggregator) pendingResults(resultType string) []plugin.ExpectedResult {
+	a.resultsMutex.Lock()
+	defer a.resultsMutex.Unlock()
+
+	var pending []plugin.ExpectedResult
+	for id, result := range a.ExpectedResults {
+		if result.ResultType != resultType {
+			continue
+		}
+		if _, ok := a.Results[id]; !ok {
+			pending = append(pending, *result)
+		}
+	}
+
+	return pending
+}
+
+// pendingNodeResults returns the node-specific expected results which have
+// not checked in yet.
+func (a *Aggregator) pendingNodeResults() []plugin.ExpectedResult {
+	a.resultsMutex.Lock()
+	defer a.resultsMutex.Unlock()
+
+	var pending []plugin.ExpectedResult
+	for id, result := range a.ExpectedResults {
+		if result.NodeName == "" {
+			continue
+		}
+		if _, ok := a.Results[id]; !ok {
+			pending = append(pending, *result)
+		}
+	}
+
+	return pending
+}
+
+// health returns the status of the run for health checks.
+func (a *Aggregator) health() HealthStatus {
+	a.resultsMutex.Lock()
+	defer a.resultsMutex.Unlock()
+
+	status := HealthStatus{Status: RunningStatus, Expected: len(a.ExpectedResults)}
+	for id := range a.ExpectedResults {
+		if _, ok := a.Results[id]; ok {
+			status.Received++
+		}
+	}
+	if status.Received == status.Expected {
+		status.Status = CompleteStatus
+	}
+	return status
+}
+
+// MissingResults returns the expected results which have not checked in yet,
+// sorted by ID.
+func (a *Aggregator) MissingResults() []plugin.ExpectedResult {
+	a.resultsMutex.Lock()
+	defer a.resultsMutex.Unlock()
+
+	var missing []plugin.ExpectedResult
+	for id, result := range a.ExpectedResults {
+		if _, ok := a.Results[id]; !ok {
+			missing = append(missing, *result)
+		}
+	}
+	sort.Slice(missing, func(i, j int) bool { return missing[i].ID() < missing[j].ID() })
+
+	return missing
+}
+
 func (a *Aggregator) isResultExpected(result *plugin.Result) bool {
 	_, ok := a.ExpectedResults[result.ExpectedResultID()]
 	return ok
 }
 
+// isClient returns false if a request about the result type was made with a
+// client certificate other than the one issued to its plugin. Requests made
+// without a certificate, such as results submitted in process, were already
+// authenticated some other way.
+func (a *Aggregator) isClient(resultType, clientName string) bool {
+	name, ok := a.ClientNames[resultType]
+	return !ok || clientName == "" || clientName == name
+}
+
+// isRetry returns whether the result replaces the one recorded for it, which
+// must have been uploaded. Streams aren't replaced, since they're received
+// with resultsMutex released.
+func (a *Aggregator) isRetry(result *plugin.Result) bool {
+	return result.Replace && !result.Streamed && a.uploaded[result.ExpectedResultID()]
+}
+
 func (a *Aggregator) isResultDuplicate(result *plugin.Result) bool {
 	_, ok := a.Results[result.ExpectedResultID()]
 	return ok
 }
 
+// copyResults returns a copy of the results seen so far, which can be read
+// while more results are recorded.
+func (a *Aggregator) copyResults() map[string]*plugin.Result {
+	a.resultsMutex.Lock()
+	defer a.resultsMutex.Unlock()
+
+	results := make(map[string]*plugin.Result, len(a.Results))
+	for id, result := range a.Results {
+		results[id] = result
+	}
+	return results
+}
+
+// logger returns the logger the aggregator logs to.
+func (a *Aggregator) logger() logrus.FieldLogger {
+	if a.Log == nil {
+		return logrus.StandardLogger()
+	}
+	return a.Log
+}
+
+// resultFields returns the fields identifying a result in log entries.
+func resultFields(result *plugin.Result) logrus.Fields {
+	return logrus.Fields{
+		"plugin": result.ResultType,
+		"node":   result.NodeName,
+	}
+}
+
+// expectResults adds any of the given results which aren't already expected,
+// returning the ones which were added.
+func (a *Aggregator) expectResults(expected []plugin.ExpectedResult) []plugin.ExpectedResult {
+	a.resultsMutex.Lock()
+	defer a.resultsMutex.Unlock()
+
+	var added []plugin.ExpectedResult
+	for i := range expected {
+		id := expected[i].ID()
+		if _, ok := a.ExpectedResults[id]; ok {
+			continue
+		}
+		a.ExpectedResults[id] = &expected[i]
+		added = append(added, expected[i])
+	}
+	a.topologies.add(added)
+
+	return added
+}
+
+// pluginStarted records that the plugin with the given result type was
+// launched at the given time.
+func (a *Aggregator) pluginStarted(resultType string, started time.Time) {
+	a.resultsMutex.Lock()
+	defer a.resultsMutex.Unlock()
+	a.manifest.start(resultType, started)
+}
+
+// recordParameters records what a plugin was launched with.
+func (a *Aggregator) recordParameters(params PluginParameters) {
+	a.resultsMutex.Lock()
+	defer a.resultsMutex.Unlock()
+	a.manifest.recordParameters(params)
+}
+
+// recordUsage records the resource usage of a plugin's pods.
+func (a *Aggregator) recordUsage(usage PluginUsage) {
+	a.resultsMutex.Lock()
+	defer a.resultsMutex.Unlock()
+	a.manifest.recordUsage(usage)
+}
+
+// addResultHook registers a function to be called each time a result is
+// recorded. It must be called before any results are handled.
+func (a *Aggregator) addResultHook(hook resultHook) {
+	a.resultHooks = append(a.resultHooks, hook)
+}
+
+// isPluginDone returns true if all the results of the given type have been
+// recorded. resultsMutex must be held by the caller.
+func (a *Aggregator) isPluginDone(resultType string) bool {
+	for id, result := range a.ExpectedResults {
+		if result.ResultType != resultType {
+			continue
+		}
+		if _, ok := a.Results[id]; !ok {
+			return false
+		}
+	}
+	return true
+}
+
+// firstError returns the error of a failed result of the given type, or an
+// empty string if none of its results have failed.
+func (a *Aggregator) firstError(resultType string) string {
+	a.resultsMutex.Lock()
+	defer a.resultsMutex.Unlock()
+
+	for _, result := range a.Results {
+		if result.ResultType == resultType && !result.IsSuccess() {
+			return result.Error
+		}
+	}
+	return ""
+}
+
 // HandleHTTPResult is called every time the HTTP server gets a well-formed
 // request with results. This method is responsible for returning with things
 // like a 409 conflict if a node has checked in twice (or a 403 forbidden if a
 // node isn't expected), as well as actually calling handleResult to write the
 // results to OutputDir.
+//
+// Partial results are written out as they arrive, but only the final result
+// is recorded. Duplicates get a 409 unless the DuplicatePolicy is
+// plugin.DuplicateResultsOverwrite, in which case they replace the recorded
+// result. Retries, results with Replace set, replace what was uploaded to the
+// same path before whatever the policy, as long as it was uploaded rather than
+// recorded by the aggregator, such as a timeout.
+//
+// Results may also be made up of any number of artifacts, which are kept in
+// the result's directory until the plugin marks it done, at which point
+// they're recorded together. Streamed results are appended to their file as
+// they arrive and recorded once the request ends, as failures if it ended
+// early.
+//
+// Results are received concurrently, up to MaxConcurrentWrites at a time, and
+// a result submitted again while it's being received gets a 409.
 func (a *Aggregator) HandleHTTPResult(result *plugin.Result, w http.ResponseWriter) {
 	a.resultsMutex.Lock()
 	defer a.resultsMutex.Unlock()
@@ -131,9 +520,280 @@ func (a *Aggregator) HandleHTTPResult(result *plugin.Result, w http.ResponseWrit
 		return
 	}
 
-	// Don't allow duplicates
+	// Make sure the result was submitted by the plugin it claims to be from
+	if !a.isClient(result.ResultType, result.ClientName) {
+		a.logger().WithFields(resultFields(result)).WithField("client_cert", result.ClientName).Warning("Rejecting result submitted with another plugin's client certificate")
+		http.Error(
+			w,
+			fmt.Sprintf("Result %v can't be submitted by %v", resultID, result.ClientName),
+			http.StatusForbidden,
+		)
+		return
+	}
+
+	a.wrapResultBody(result, w)
+
+	if result.Partial {
+		a.handleHTTPPartialResult(result, w)
+		return
+	}
+
+	if result.Artifact {
+		a.handleHTTPArtifact(result, w)
+		return
+	}
+
+	if result.Done {
+		a.handleHTTPDone(result, w)
+		return
+	}
+
+	if a.receiving[resultID] {
+		http.Error(
+			w,
+			fmt.Sprintf("Result %v is already being received", resultID),
+			http.StatusConflict,
+		)
+		return
+	}
+
+	// Don't allow duplicates, unless they replace the recorded result
+	if a.isResultDuplicate(result) && a.DuplicatePolicy != plugin.DuplicateResultsOverwrite && !a.isRetry(result) {
+		a.logger().WithFields(resultFields(result)).Warning("Got a duplicate result")
+		http.Error(
+			w,
+			fmt.Sprintf("Result %v already received", resultID),
+			http.StatusConflict,
+		)
+		return
+	}
+
+	a.receiveHTTPResult(result, w)
+}
+
+// receiveHTTPResult saves a result, or replaces the recorded one, releasing
+// resultsMutex while the body is received as in receiveUnlocked.
+// resultsMutex must be held by the caller, and is held again when this
+// returns.
+func (a *Aggregator) receiveHTTPResult(result *plugin.Result, w http.ResponseWriter) {
+	resultID := result.ExpectedResultID()
+	log := a.logger().WithFields(resultFields(result))
+	if result.Streamed {
+		log.Info("Receiving streamed result")
+	}
+
+	prev, replacing := a.Results[resultID]
+	action := "handling"
+	if replacing {
+		action = "replacing"
+		if err := a.removeRecorded(result); err != nil {
+			log.WithError(err).Info("Error replacing duplicate result")
+			http.Error(
+				w,
+				fmt.Sprintf("Error replacing result %v: %v", resultID, err),
+				resultErrorStatus(err),
+			)
+			return
+		}
+	}
+
+	a.receiving[resultID] = true
+	var saved *plugin.Result
+	var err error
+	a.receiveUnlocked(result, func() {
+		saved, err = a.saveResult(result)
+	})
+	delete(a.receiving, resultID)
+
+	// The plugin may have been timed out while its result was received, in
+	// which case its error is already recorded.
+	if a.Results[resultID] != prev {
+		log.Warning("Discarding result, a result was recorded while it was received")
+		if written := a.resultPath(saved); written != a.resultPath(a.Results[resultID]) {
+			os.RemoveAll(written)
+		}
+		http.Error(
+			w,
+			fmt.Sprintf("Result %v already received", resultID),
+			http.StatusConflict,
+		)
+		return
+	}
+
+	if replacing {
+		a.replaceResult(saved)
+	} else {
+		a.recordResult(saved)
+	}
+	a.uploaded[resultID] = true
+	if err != nil {
+		log.WithError(err).Infof("Error %v result", action)
+		http.Error(
+			w,
+			fmt.Sprintf("Error %v result %v: %v", action, resultID, err),
+			resultErrorStatus(err),
+		)
+	}
+}
+
+// receiveUnlocked calls receive, which receives the body of the result, with
+// resultsMutex released so that other results can be received at the same
+// time. Other than streamed results, which last as long as the plugin runs,
+// it waits for one of the MaxConcurrentWrites slots first. resultsMutex must
+// be held by the caller, and is held again when this returns.
+func (a *Aggregator) receiveUnlocked(result *plugin.Result, receive func()) {
+	a.resultsMutex.Unlock()
+	defer a.resultsMutex.Lock()
+	if !result.Streamed {
+		release := a.acquireWriteSlot(a.priority(result))
+		defer release()
+	}
+	receive()
+}
+
+// acquireWriteSlot waits until one of the MaxConcurrentWrites slots is free
+// for a result of the given priority, returning a func which frees the slot
+// taken.
+func (a *Aggregator) acquireWriteSlot(priority int) (release func()) {
+	a.writesOnce.Do(func() {
+		size := a.MaxConcurrentWrites
+		if size <= 0 {
+			size = defaultMaxConcurrentWrites
+		}
+		a.writes = newWriteQueue(size)
+	})
+	return a.writes.acquire(priority)
+}
+
+// priority returns the priority of the result, going by its type.
+func (a *Aggregator) priority(result *plugin.Result) int {
+	return a.Priorities[result.ResultType]
+}
+
+// handleHTTPPartialResult writes out a partial result, returning a 409
+// conflict if the same chunk was already received, unless it's replaced, or
+// the final result is already in. The chunk is received without holding
+// resultsMutex, which must be held by the caller.
+func (a *Aggregator) handleHTTPPartialResult(result *plugin.Result, w http.ResponseWriter) {
+	resultID := result.ExpectedResultID()
+
+	if a.isResultDuplicate(result) {
+		http.Error(
+			w,
+			fmt.Sprintf("Result %v already complete", resultID),
+			http.StatusConflict,
+		)
+		return
+	}
+
+	file := a.resultPath(result)
+	if a.writing[file] {
+		http.Error(
+			w,
+			fmt.Sprintf("Partial result %v of %v is already being received", result.Sequence, resultID),
+			http.StatusConflict,
+		)
+		return
+	}
+	if a.partials[file] && !result.Replace {
+		a.logger().WithFields(resultFields(result)).WithField("sequence", result.Sequence).Warning("Got a duplicate partial result")
+		http.Error(
+			w,
+			fmt.Sprintf("Partial result %v of %v already received", result.Sequence, resultID),
+			http.StatusConflict,
+		)
+		return
+	}
+
+	if err := a.writeUnlocked(result); err != nil {
+		delete(a.partials, file)
+		a.logger().WithFields(resultFields(result)).WithError(err).Info("Error handling partial result")
+		http.Error(
+			w,
+			fmt.Sprintf("Error handling partial result %v of %v: %v", result.Sequence, resultID, err),
+			resultErrorStatus(err),
+		)
+		return
+	}
+	a.partials[file] = true
+	a.sinkResult(result)
+}
+
+// handleHTTPArtifact writes out an artifact of a result, returning a 409
+// conflict if an artifact with the same name was already received, unless
+// it's replaced, or the result has been marked done. Artifacts are sent to
+// the Sink along with the rest of the result once it's done. The artifact is
+// received without holding resultsMutex, which must be held by the caller.
+func (a *Aggregator) handleHTTPArtifact(result *plugin.Result, w http.ResponseWriter) {
+	resultID := result.ExpectedResultID()
+	log := a.logger().WithFields(resultFields(result)).WithField("artifact", result.Filename)
+
+	if a.isResultDuplicate(result) {
+		http.Error(
+			w,
+			fmt.Sprintf("Result %v already complete", resultID),
+			http.StatusConflict,
+		)
+		return
+	}
+
+	file := a.resultPath(result)
+	if a.writing[file] {
+		http.Error(
+			w,
+			fmt.Sprintf("Artifact %v of %v is already being received", result.Filename, resultID),
+			http.StatusConflict,
+		)
+		return
+	}
+	if a.artifacts[file] && !result.Replace {
+		log.Warning("Got a duplicate artifact")
+		http.Error(
+			w,
+			fmt.Sprintf("Artifact %v of %v already received", result.Filename, resultID),
+			http.StatusConflict,
+		)
+		return
+	}
+
+	err := a.writeUnlocked(result)
+	// The plugin may have been timed out while the artifact was received
+	if a.isResultDuplicate(result) {
+		log.Warning("Discarding artifact, a result was recorded while it was received")
+		os.Remove(file)
+		http.Error(
+			w,
+			fmt.Sprintf("Result %v already complete", resultID),
+			http.StatusConflict,
+		)
+		return
+	}
+	if err != nil {
+		delete(a.artifacts, file)
+		log.WithError(err).Info("Error handling artifact")
+		http.Error(
+			w,
+			fmt.Sprintf("Error handling artifact %v of %v: %v", result.Filename, resultID, err),
+			resultErrorStatus(err),
+		)
+		return
+	}
+	a.artifacts[file] = true
+}
+
+// handleHTTPDone records a result made up of the artifacts which were
+// submitted for it, returning a 409 conflict if the result was already
+// recorded, unless it's a retry, which has nothing to replace.
+// resultsMutex must be held by the caller.
+func (a *Aggregator) handleHTTPDone(result *plugin.Result, w http.ResponseWriter) {
+	resultID := result.ExpectedResultID()
+
+	if a.isResultDuplicate(result) && a.isRetry(result) {
+		a.logger().WithFields(resultFields(result)).Info("Got the done marker again")
+		return
+	}
 	if a.isResultDuplicate(result) {
-		logrus.Warningf("Got a duplicate result %v", resultID)
+		a.logger().WithFields(resultFields(result)).Warning("Got a duplicate done marker")
 		http.Error(
 			w,
 			fmt.Sprintf("Result %v already received", resultID),
@@ -142,16 +802,70 @@ func (a *Aggregator) HandleHTTPResult(result *plugin.Result, w http.ResponseWrit
 		return
 	}
 
-	if err := a.handleResult(result); err != nil {
-		errMsg := fmt.Sprintf("Error handling result %v: %v", resultID, err)
-		logrus.Info(errMsg)
+	// A result without any artifacts is an empty directory
+	dir := a.resultPath(result)
+	if a.isWritingUnder(dir) {
 		http.Error(
 			w,
-			errMsg,
+			fmt.Sprintf("Artifacts of result %v are still being received", resultID),
+			http.StatusConflict,
+		)
+		return
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		a.logger().WithFields(resultFields(result)).WithError(err).Info("Error handling done marker")
+		http.Error(
+			w,
+			fmt.Sprintf("Error handling result %v: couldn't create directory %v: %v", resultID, dir, err),
 			http.StatusInternalServerError,
 		)
 		return
 	}
+
+	a.recordResult(result)
+	a.uploaded[resultID] = true
+}
+
+// writeUnrecorded writes out a partial result or an artifact, which aren't
+// recorded as results themselves. What was written is removed if it was
+// truncated or corrupt.
+func (a *Aggregator) writeUnrecorded(result *plugin.Result) error {
+	err := a.writeResult(result)
+	if isDiskFull(err) {
+		err = diskFullError(err)
+	} else if err == nil || bodyIncomplete(result) {
+		err = a.checkResultBody(result)
+	}
+	if err != nil {
+		os.Remove(a.resultPath(result))
+	}
+	return err
+}
+
+// writeUnlocked is writeUnrecorded, receiving the body with resultsMutex
+// released as in receiveUnlocked. The path written is marked as being written
+// meanwhile. resultsMutex must be held by the caller, and is held again when
+// this returns.
+func (a *Aggregator) writeUnlocked(result *plugin.Result) error {
+	file := a.resultPath(result)
+	a.writing[file] = true
+	var err error
+	a.receiveUnlocked(result, func() {
+		err = a.writeUnrecorded(result)
+	})
+	delete(a.writing, file)
+	return err
+}
+
+// isWritingUnder returns true if a partial result or artifact is being
+// written in dir. resultsMutex must be held by the caller.
+func (a *Aggregator) isWritingUnder(dir string) bool {
+	for file := range a.writing {
+		if strings.HasPrefix(file, dir+"/") {
+			return true
+		}
+	}
+	return false
 }
 
 // IngestResults takes a channel of results and handles them as they come in.
@@ -160,26 +874,34 @@ func (a *Aggregator) HandleHTTPResult(result *plugin.Result, w http.ResponseWrit
 //
 // If we support plugins that are just simple commands that the sonobuoy master
 // runs, those plugins can submit results through the same channel.
+//
+// Duplicates are handled according to the DuplicatePolicy, as for
+// HandleHTTPResult.
 func (a *Aggregator) IngestResults(resultsCh <-chan *plugin.Result) {
 	for {
 		result, more := <-resultsCh
 		if !more {
 			break
 		}
-		// Don't consume results we're not expecting, unless they're
-		// errors (see below.)
-		if !a.isResultExpected(result) {
-			logrus.Warningf("Result unexpected: %v", result)
-			continue
-		}
-
 		func() {
 			a.resultsMutex.Lock()
 			defer a.resultsMutex.Unlock()
 
+			// Don't consume results we're not expecting
+			if !a.isResultExpected(result) {
+				a.logger().WithFields(resultFields(result)).Warning("Result unexpected")
+				return
+			}
+
 			// Don't consume results we've already seen
 			if a.isResultDuplicate(result) {
-				logrus.Warningf("Duplicate result: %v", result)
+				if a.DuplicatePolicy != plugin.DuplicateResultsOverwrite {
+					a.logger().WithFields(resultFields(result)).Warning("Duplicate result")
+					return
+				}
+				if err := a.overwriteResult(result); err != nil {
+					a.logger().WithFields(resultFields(result)).WithError(err).Info("Error replacing duplicate result")
+				}
 				return
 			}
 
@@ -194,19 +916,116 @@ func (a *Aggregator) IngestResults(resultsCh <-chan *plugin.Result) {
 func (a *Aggregator) handleResult(result *plugin.Result) error {
 	// Send an event that we got this result even if we get an error, so
 	// that Wait() doesn't hang forever on problems.
-	defer func() {
-		a.Results[result.ExpectedResultID()] = result
-		a.resultEvents <- result
-	}()
+	defer func() { a.recordResult(result) }()
+
+	var err error
+	result, err = a.saveResult(result)
+	return err
+}
+
+// recordResult records a result which was saved, notifying the manifest,
+// sink, result hooks and Wait. resultsMutex must be held by the caller.
+func (a *Aggregator) recordResult(result *plugin.Result) {
+	a.Results[result.ExpectedResultID()] = result
+	a.observe(ResultCompleted, result)
+	pluginDone := a.isPluginDone(result.ResultType)
+	a.manifest.record(a.resultPath(result), a.withTopology(result), pluginDone)
+	a.reduceResult(result, pluginDone)
+	a.sinkResult(result)
+	for _, hook := range a.resultHooks {
+		hook(result, pluginDone)
+	}
+	if !a.notReported && a.CompletionThreshold > 0 && a.CompletionThreshold < 1 && a.thresholdReached() {
+		a.recordNotReported()
+	}
+	// Wait only needs to know that something changed, so don't block if
+	// it already has events to process.
+	select {
+	case a.resultEvents <- result:
+	default:
+	}
+}
 
+// saveResult writes a result out to OutputDir. If its body was larger than
+// MaxResultSizeBytes, wasn't received in full, didn't match its checksum,
+// couldn't be transformed or couldn't be written because the disk is full,
+// what was written is removed, unless it was streamed and cut short, and an
+// error result is saved and returned in its place, along with a
+// rejectedResultError.
+func (a *Aggregator) saveResult(result *plugin.Result) (*plugin.Result, error) {
+	var err error
 	if result.MimeType == gzipMimeType {
-		return a.handleArchiveResult(result)
+		err = a.handleArchiveResult(result)
+		if err == nil {
+			err = a.transformArchive(result)
+		}
+	} else {
+		err = a.writeResult(result)
+	}
+	if isDiskFull(err) {
+		err = diskFullError(err)
+	}
+	_, rejected := err.(*rejectedResultError)
+	if err != nil && !rejected && !bodyIncomplete(result) {
+		return result, err
+	}
+
+	if !rejected {
+		err = a.checkResultBody(result)
+		if err == nil {
+			err = a.checkResultSchema(result)
+		}
+		if _, rejected = err.(*rejectedResultError); !rejected {
+			return result, err
+		}
 	}
 
+	// What a plugin streamed before its connection dropped is kept to help
+	// debug it, alongside the error recorded in its place.
+	written := a.resultPath(result)
+	if result.Streamed && uploadInterrupted(result) {
+		a.logger().WithFields(resultFields(result)).WithField("path", written).Info("Keeping what was received of interrupted stream")
+	} else if err := os.RemoveAll(written); err != nil {
+		a.logger().WithFields(resultFields(result)).WithError(err).Info("Couldn't remove rejected result")
+	}
+	category := plugin.ErrorCategoryUnknown
+	if uploadInterrupted(result) {
+		category = plugin.ErrorCategoryNetwork
+	}
+	errData := map[string]interface{}{
+		"error":    err.Error(),
+		"category": category,
+	}
+	if rejectedErr, ok := err.(*rejectedResultError); ok && len(rejectedErr.violations) > 0 {
+		errData["violations"] = rejectedErr.violations
+	}
+	errResult := utils.MakeErrorResult(result.ResultType, errData, result.NodeName)
+	if err := a.writeBody(errResult, errResult.Body); err != nil {
+		a.logger().WithFields(resultFields(result)).WithError(err).Info("Couldn't write error for rejected result")
+	}
+	return errResult, err
+}
+
+// writeResult writes the body of a result to a file in OutputDir, passing it
+// through the Transforms first.
+func (a *Aggregator) writeResult(result *plugin.Result) error {
+	body, err := a.transform(result, result.Body)
+	if err != nil {
+		return err
+	}
+	err = a.writeBody(result, body)
+	if err != nil && len(a.Transforms) > 0 && !bodyIncomplete(result) {
+		return transformError(err)
+	}
+	return err
+}
+
+// writeBody writes the given body of a result to a file in OutputDir.
+func (a *Aggregator) writeBody(result *plugin.Result, body io.Reader) error {
 	// Create the output directory for the result.  Will be of the
 	// form .../plugins/:results_type/:node.json (for DaemonSet plugins) or
 	// .../plugins/:results_type.json (for Job plugins)
-	resultsFile := path.Join(a.OutputDir, result.Path())
+	resultsFile := a.resultPath(result)
 	resultsDir := path.Dir(resultsFile)
 
 	if err := os.MkdirAll(resultsDir, 0755); err != nil {
@@ -220,7 +1039,7 @@ func (a *Aggregator) handleResult(result *plugin.Result) error {
 	}
 	defer outFile.Close()
 
-	if _, err = io.Copy(outFile, result.Body); err != nil {
+	if _, err = io.Copy(outFile, body); err != nil {
 		err = errors.Wrapf(err, "could not write body to file %v", outFile.Name())
 		return err
 	}
@@ -229,11 +1048,55 @@ func (a *Aggregator) handleResult(result *plugin.Result) error {
 
 }
 
+// overwriteResult replaces a recorded result with a new one for the same
+// expected result, removing what was written out for the old one. Since the
+// result was already counted, the result hooks and Wait aren't notified.
+// resultsMutex must be held by the caller.
+func (a *Aggregator) overwriteResult(result *plugin.Result) error {
+	if err := a.removeRecorded(result); err != nil {
+		return err
+	}
+	saved, err := a.saveResult(result)
+	a.replaceResult(saved)
+	return err
+}
+
+// removeRecorded removes what was written out for the result recorded for
+// the same expected result as the given one, which is about to replace it.
+// resultsMutex must be held by the caller.
+func (a *Aggregator) removeRecorded(result *plugin.Result) error {
+	a.logger().WithFields(resultFields(result)).Info("Replacing duplicate result")
+	prevPath := a.resultPath(a.Results[result.ExpectedResultID()])
+	return errors.Wrapf(os.RemoveAll(prevPath), "couldn't remove previous result %v", prevPath)
+}
+
+// replaceResult records a result which was saved in place of the one
+// recorded for the same expected result. Since the result was already
+// counted, the result hooks and Wait aren't notified. resultsMutex must be
+// held by the caller.
+func (a *Aggregator) replaceResult(saved *plugin.Result) {
+	a.Results[saved.ExpectedResultID()] = saved
+	a.manifest.record(a.resultPath(saved), a.withTopology(saved), false)
+	// The results are merged again if they already were.
+	a.reduceResult(saved, a.isPluginDone(saved.ResultType))
+	a.sinkResult(saved)
+}
+
 func (a *Aggregator) handleArchiveResult(result *plugin.Result) error {
-	resultsDir := path.Join(a.OutputDir, result.Path())
+	resultsDir := a.resultPath(result)
 
 	return errors.Wrapf(
 		tarball.DecodeTarball(result.Body, resultsDir),
-		"couldn't decode result %v", result.Path(),
+		"couldn't decode result %v", resultsDir,
 	)
 }
+
+// resultPath returns where the result is written, according to the Layout.
+// The layout is given the result with the topology of its node set.
+func (a *Aggregator) resultPath(result *plugin.Result) string {
+	layout := a.Layout
+	if layout == nil {
+		layout = NestedLayout{}
+	}
+	return path.Join(a.OutputDir, layout.ResultPath(a.withTopology(result)))
+}
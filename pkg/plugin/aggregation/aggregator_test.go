@@ -18,16 +18,28 @@ package aggregation
 
 import (
 	"bytes"
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"io"
 	"io/ioutil"
 	"net/http"
+	"net/http/httptest"
 	"os"
 	"os/exec"
 	"path"
+	"reflect"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/heptio/sonobuoy/pkg/backplane/ca/authtest"
 	"github.com/heptio/sonobuoy/pkg/plugin"
 	pluginutils "github.com/heptio/sonobuoy/pkg/plugin/driver/utils"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	testhook "github.com/sirupsen/logrus/hooks/test"
 	"github.com/viniciuschiele/tarx"
 )
 
@@ -59,6 +71,308 @@ func TestAggregation(t *testing.T) {
 	})
 }
 
+func TestAggregation_partial(t *testing.T) {
+	expected := []plugin.ExpectedResult{
+		plugin.ExpectedResult{NodeName: "node1", ResultType: "systemd_logs"},
+	}
+
+	withAggregator(t, expected, func(agg *Aggregator, srv *authtest.Server) {
+		URL, err := NodeResultURL(srv.URL, "node1", "systemd_logs")
+		if err != nil {
+			t.Fatalf("couldn't get test server URL: %v", err)
+		}
+
+		for seq, chunk := range []string{"foo", "bar"} {
+			resp := doRequest(t, srv.Client(), "PUT", PartialResultURL(URL, seq), []byte(chunk))
+			if resp.StatusCode != 200 {
+				body, _ := ioutil.ReadAll(resp.Body)
+				t.Errorf("Got (%v) response from server: %v", resp.StatusCode, string(body))
+			}
+
+			bytes, err := ioutil.ReadFile(path.Join(agg.OutputDir, "systemd_logs", "partial", "node1", fmt.Sprintf("%08d", seq)))
+			if string(bytes) != chunk {
+				t.Errorf("partial result %v for node1 incorrect (got %v): %v", seq, string(bytes), err)
+			}
+		}
+		if agg.isComplete() {
+			t.Error("expected partial results not to complete the aggregation")
+		}
+
+		resp := doRequest(t, srv.Client(), "PUT", PartialResultURL(URL, 1), []byte("bar"))
+		if resp.StatusCode != 409 {
+			t.Errorf("Expected a 409 for a duplicate partial result, got %v", resp.StatusCode)
+		}
+
+		resp = doRequest(t, srv.Client(), "PUT", URL, []byte("done"))
+		if resp.StatusCode != 200 {
+			body, _ := ioutil.ReadAll(resp.Body)
+			t.Errorf("Got (%v) response from server: %v", resp.StatusCode, string(body))
+		}
+		if !agg.isComplete() {
+			t.Error("expected the final result to complete the aggregation")
+		}
+
+		resp = doRequest(t, srv.Client(), "PUT", PartialResultURL(URL, 2), []byte("baz"))
+		if resp.StatusCode != 409 {
+			t.Errorf("Expected a 409 for a partial result after the final one, got %v", resp.StatusCode)
+		}
+	})
+}
+
+func TestAggregation_partialUnexpected(t *testing.T) {
+	expected := []plugin.ExpectedResult{
+		plugin.ExpectedResult{NodeName: "node1", ResultType: "systemd_logs"},
+	}
+
+	withAggregator(t, expected, func(agg *Aggregator, srv *authtest.Server) {
+		URL, err := NodeResultURL(srv.URL, "node12", "systemd_logs")
+		if err != nil {
+			t.Fatalf("couldn't get test server URL: %v", err)
+		}
+
+		resp := doRequest(t, srv.Client(), "PUT", PartialResultURL(URL, 0), []byte("foo"))
+		if resp.StatusCode != 403 {
+			t.Errorf("Expected a 403 for an unexpected partial result, got %v", resp.StatusCode)
+		}
+	})
+}
+
+func TestAggregation_streamed(t *testing.T) {
+	expected := []plugin.ExpectedResult{
+		plugin.ExpectedResult{NodeName: "node1", ResultType: "systemd_logs"},
+		plugin.ExpectedResult{NodeName: "node2", ResultType: "systemd_logs"},
+		plugin.ExpectedResult{ResultType: "e2e"},
+	}
+
+	withAggregator(t, expected, func(agg *Aggregator, srv *authtest.Server) {
+		stream := func(node string) (*io.PipeWriter, <-chan *http.Response) {
+			URL, err := NodeResultURL(srv.URL, node, "systemd_logs")
+			if err != nil {
+				t.Fatalf("couldn't get test server URL: %v", err)
+			}
+			pr, pw := io.Pipe()
+			req, err := http.NewRequest("PUT", StreamURL(URL), pr)
+			if err != nil {
+				t.Fatalf("error constructing request: %v", err)
+			}
+			respc := make(chan *http.Response, 1)
+			go func() {
+				resp, _ := srv.Client().Do(req)
+				respc <- resp
+			}()
+			return pw, respc
+		}
+		waitForFile := func(file, want string) {
+			deadline := time.Now().Add(5 * time.Second)
+			for {
+				got, _ := ioutil.ReadFile(path.Join(agg.OutputDir, file))
+				if string(got) == want {
+					return
+				}
+				if time.Now().After(deadline) {
+					t.Fatalf("timed out waiting for %v to be %q, got %q", file, want, got)
+				}
+				time.Sleep(10 * time.Millisecond)
+			}
+		}
+
+		pw, respc := stream("node1")
+		pw.Write([]byte("foo"))
+		waitForFile("systemd_logs/results/node1", "foo")
+
+		// Other results aren't held up while the stream is open
+		URL, err := GlobalResultURL(srv.URL, "e2e")
+		if err != nil {
+			t.Fatalf("couldn't get test server URL: %v", err)
+		}
+		if resp := doRequest(t, srv.Client(), "PUT", URL, []byte("done")); resp.StatusCode != 200 {
+			t.Errorf("Got (%v) response from server for e2e", resp.StatusCode)
+		}
+		URL, err = NodeResultURL(srv.URL, "node1", "systemd_logs")
+		if err != nil {
+			t.Fatalf("couldn't get test server URL: %v", err)
+		}
+		if resp := doRequest(t, srv.Client(), "PUT", StreamURL(URL), []byte("again")); resp.StatusCode != 409 {
+			t.Errorf("Expected a 409 for a second stream of the same result, got %v", resp.StatusCode)
+		}
+		if _, ok := agg.copyResults()["systemd_logs/node1"]; ok {
+			t.Error("expected the streamed result not to be recorded before the stream is closed")
+		}
+
+		pw.Write([]byte("bar"))
+		pw.Close()
+		if resp := <-respc; resp == nil || resp.StatusCode != 200 {
+			t.Fatalf("expected a 200 response once the stream closed, got %+v", resp)
+		}
+		if result := agg.copyResults()["systemd_logs/node1"]; result == nil || !result.IsSuccess() {
+			t.Errorf("expected the streamed result to succeed, got %+v", result)
+		}
+		waitForFile("systemd_logs/results/node1", "foobar")
+
+		// A dropped stream is a failure, keeping what was received
+		pw, respc = stream("node2")
+		pw.Write([]byte("half"))
+		waitForFile("systemd_logs/results/node2", "half")
+		pw.CloseWithError(errors.New("connection dropped"))
+		<-respc
+		deadline := time.Now().Add(5 * time.Second)
+		var result *plugin.Result
+		for result == nil && time.Now().Before(deadline) {
+			time.Sleep(10 * time.Millisecond)
+			result = agg.copyResults()["systemd_logs/node2"]
+		}
+		if result == nil || result.IsSuccess() {
+			t.Fatalf("expected the dropped stream to be recorded as a failure, got %+v", result)
+		}
+		if !strings.Contains(result.Error, "ended before it was complete") {
+			t.Errorf("expected the error to say the upload ended early, got %q", result.Error)
+		}
+		waitForFile("systemd_logs/results/node2", "half")
+		if _, err := os.Stat(path.Join(agg.OutputDir, "systemd_logs", "errors", "node2")); err != nil {
+			t.Errorf("expected an error to be written for node2: %v", err)
+		}
+	})
+}
+
+func TestAggregation_filenames(t *testing.T) {
+	expected := []plugin.ExpectedResult{
+		plugin.ExpectedResult{NodeName: "node1", ResultType: "systemd_logs"},
+	}
+
+	withAggregator(t, expected, func(agg *Aggregator, srv *authtest.Server) {
+		URL, err := NodeResultURL(srv.URL, "node1", "systemd_logs")
+		if err != nil {
+			t.Fatalf("couldn't get test server URL: %v", err)
+		}
+		named := func(filename string) http.Header {
+			return http.Header{dispositionHeader: []string{fmt.Sprintf("attachment; filename=%q", filename)}}
+		}
+
+		for _, filename := range []string{"../../escaped", "screenshots/../../../escaped", "/tmp/escaped"} {
+			resp := doRequestWithHeaders(t, srv.Client(), "PUT", PartialResultURL(URL, 0), []byte("bad"), named(filename))
+			if resp.StatusCode != 400 {
+				t.Errorf("Expected a 400 for filename %q, got %v", filename, resp.StatusCode)
+			}
+		}
+		resp := doRequestWithHeaders(t, srv.Client(), "PUT", URL, []byte("bad"), named("../escaped"))
+		if resp.StatusCode != 400 {
+			t.Errorf("Expected a 400 for a result named ../escaped, got %v", resp.StatusCode)
+		}
+		if _, err := os.Stat(path.Join(path.Dir(agg.OutputDir), "escaped")); err == nil {
+			t.Error("expected nothing to be written outside the output directory")
+		}
+		if agg.isComplete() {
+			t.Error("expected rejected results not to complete the aggregation")
+		}
+
+		resp = doRequestWithHeaders(t, srv.Client(), "PUT", PartialResultURL(URL, 0), []byte("<png>"), named("screenshots/login.png"))
+		if resp.StatusCode != 200 {
+			t.Errorf("Got (%v) response from server for a named partial result", resp.StatusCode)
+		}
+		resp = doRequestWithHeaders(t, srv.Client(), "PUT", URL, []byte("<testsuite/>"), named("junit.xml"))
+		if resp.StatusCode != 200 {
+			t.Errorf("Got (%v) response from server for a named result", resp.StatusCode)
+		}
+
+		for file, want := range map[string]string{
+			"systemd_logs/partial/node1/screenshots/login.png": "<png>",
+			"systemd_logs/results/node1/junit.xml":             "<testsuite/>",
+		} {
+			got, err := ioutil.ReadFile(path.Join(agg.OutputDir, file))
+			if string(got) != want {
+				t.Errorf("expected %v to be %q, got %q: %v", file, want, got, err)
+			}
+		}
+	})
+}
+
+func TestAggregation_artifacts(t *testing.T) {
+	expected := []plugin.ExpectedResult{
+		plugin.ExpectedResult{NodeName: "node1", ResultType: "systemd_logs"},
+		plugin.ExpectedResult{ResultType: "e2e"},
+	}
+
+	withAggregator(t, expected, func(agg *Aggregator, srv *authtest.Server) {
+		agg.manifest = newResultsManifest(agg.OutputDir, nil)
+		URL, err := NodeResultURL(srv.URL, "node1", "systemd_logs")
+		if err != nil {
+			t.Fatalf("couldn't get test server URL: %v", err)
+		}
+		named := func(filename string) http.Header {
+			return http.Header{dispositionHeader: []string{fmt.Sprintf("attachment; filename=%q", filename)}}
+		}
+
+		artifacts := map[string]string{
+			"junit.xml":             "<testsuite/>",
+			"cluster-dump.json":     "{}",
+			"screenshots/login.png": "<png>",
+		}
+		for name, body := range artifacts {
+			resp := doRequestWithHeaders(t, srv.Client(), "PUT", ArtifactURL(URL), []byte(body), named(name))
+			if resp.StatusCode != 200 {
+				body, _ := ioutil.ReadAll(resp.Body)
+				t.Errorf("Got (%v) response from server for artifact %v: %v", resp.StatusCode, name, string(body))
+			}
+		}
+		if resp := doRequestWithHeaders(t, srv.Client(), "PUT", ArtifactURL(URL), []byte("{}"), named("cluster-dump.json")); resp.StatusCode != 409 {
+			t.Errorf("Expected a 409 for a duplicate artifact, got %v", resp.StatusCode)
+		}
+		if resp := doRequest(t, srv.Client(), "PUT", ArtifactURL(URL), []byte("{}")); resp.StatusCode != 400 {
+			t.Errorf("Expected a 400 for an artifact without a name, got %v", resp.StatusCode)
+		}
+		if _, ok := agg.copyResults()["systemd_logs/node1"]; ok {
+			t.Error("expected artifacts not to complete the result")
+		}
+
+		if resp := doRequest(t, srv.Client(), "PUT", DoneURL(URL), nil); resp.StatusCode != 200 {
+			t.Errorf("Got (%v) response from server marking the result done", resp.StatusCode)
+		}
+		if result := agg.copyResults()["systemd_logs/node1"]; result == nil || !result.IsSuccess() {
+			t.Fatalf("expected the done marker to complete the result, got %+v", result)
+		}
+		if resp := doRequest(t, srv.Client(), "PUT", DoneURL(URL), nil); resp.StatusCode != 409 {
+			t.Errorf("Expected a 409 marking the result done twice, got %v", resp.StatusCode)
+		}
+		if resp := doRequestWithHeaders(t, srv.Client(), "PUT", ArtifactURL(URL), []byte("late"), named("late.txt")); resp.StatusCode != 409 {
+			t.Errorf("Expected a 409 for an artifact after the result is done, got %v", resp.StatusCode)
+		}
+
+		manifest := readManifest(t, agg.OutputDir)
+		if len(manifest.Results) != 1 {
+			t.Fatalf("expected 1 result in the manifest, got %+v", manifest.Results)
+		}
+		files := map[string]bool{}
+		for _, file := range manifest.Results[0].Files {
+			files[file.Path] = true
+		}
+		for name, want := range artifacts {
+			file := path.Join("systemd_logs", "results", "node1", name)
+			if !files[file] {
+				t.Errorf("expected the manifest to list %v, got %+v", file, manifest.Results[0].Files)
+			}
+			got, err := ioutil.ReadFile(path.Join(agg.OutputDir, file))
+			if string(got) != want {
+				t.Errorf("expected artifact %v to be %q, got %q: %v", name, want, got, err)
+			}
+		}
+		if agg.isComplete() {
+			t.Error("expected e2e to still be outstanding")
+		}
+
+		// A result can be marked done without any artifacts
+		URL, err = GlobalResultURL(srv.URL, "e2e")
+		if err != nil {
+			t.Fatalf("couldn't get test server URL: %v", err)
+		}
+		if resp := doRequest(t, srv.Client(), "PUT", DoneURL(URL), nil); resp.StatusCode != 200 {
+			t.Errorf("Got (%v) response from server marking e2e done", resp.StatusCode)
+		}
+		if !agg.isComplete() {
+			t.Error("expected the aggregation to be complete")
+		}
+	})
+}
+
 func TestAggregation_noExtension(t *testing.T) {
 	expected := []plugin.ExpectedResult{
 		plugin.ExpectedResult{NodeName: "node1", ResultType: "systemd_logs"},
@@ -145,6 +459,35 @@ func TestAggregation_wrongnodes(t *testing.T) {
 	})
 }
 
+func TestAggregation_clientNames(t *testing.T) {
+	expected := []plugin.ExpectedResult{
+		plugin.ExpectedResult{NodeName: "node1", ResultType: "systemd_logs"},
+	}
+
+	withAggregator(t, expected, func(agg *Aggregator, srv *authtest.Server) {
+		URL, err := NodeResultURL(srv.URL, "node1", "systemd_logs")
+		if err != nil {
+			t.Fatalf("couldn't get test server URL: %v", err)
+		}
+
+		// srv.Client() has a certificate for client1.local
+		agg.ClientNames = map[string]string{"systemd_logs": "systemd_logs"}
+		resp := doRequest(t, srv.Client(), "PUT", URL, []byte("foo"))
+		if resp.StatusCode != 403 {
+			t.Errorf("Expected a 403 forbidden for checking in with another plugin's certificate, got %v", resp.StatusCode)
+		}
+		if _, ok := agg.Results["systemd_logs/node1"]; ok {
+			t.Fatal("Aggregator accepted a result submitted with another plugin's certificate")
+		}
+
+		agg.ClientNames = map[string]string{"systemd_logs": "client1.local"}
+		resp = doRequest(t, srv.Client(), "PUT", URL, []byte("foo"))
+		if resp.StatusCode != 200 {
+			t.Errorf("Got non-200 response from server: %v", resp.StatusCode)
+		}
+	})
+}
+
 func TestAggregation_duplicates(t *testing.T) {
 	expected := []plugin.ExpectedResult{
 		plugin.ExpectedResult{NodeName: "node1", ResultType: "systemd_logs"},
@@ -174,6 +517,352 @@ func TestAggregation_duplicates(t *testing.T) {
 	})
 }
 
+func TestAggregation_duplicatePolicy(t *testing.T) {
+	testCases := []struct {
+		policy     string
+		wantStatus int
+		wantBody   string
+	}{
+		{policy: "", wantStatus: 409, wantBody: "first"},
+		{policy: plugin.DuplicateResultsIgnore, wantStatus: 409, wantBody: "first"},
+		{policy: plugin.DuplicateResultsOverwrite, wantStatus: 200, wantBody: "second"},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.policy, func(t *testing.T) {
+			expected := []plugin.ExpectedResult{
+				plugin.ExpectedResult{NodeName: "node1", ResultType: "systemd_logs"},
+				plugin.ExpectedResult{NodeName: "node2", ResultType: "systemd_logs"},
+			}
+			withAggregator(t, expected, func(agg *Aggregator, srv *authtest.Server) {
+				agg.DuplicatePolicy = tc.policy
+				URL, err := NodeResultURL(srv.URL, "node1", "systemd_logs")
+				if err != nil {
+					t.Fatalf("couldn't get test server URL: %v", err)
+				}
+
+				if resp := doRequest(t, srv.Client(), "PUT", URL, []byte("first")); resp.StatusCode != 200 {
+					t.Errorf("Got non-200 response from server: %v", resp.StatusCode)
+				}
+				if resp := doRequest(t, srv.Client(), "PUT", URL, []byte("second")); resp.StatusCode != tc.wantStatus {
+					t.Errorf("Expected a %v response for a duplicate result, got %v", tc.wantStatus, resp.StatusCode)
+				}
+
+				if agg.isComplete() {
+					t.Error("expected a duplicate result not to complete the aggregation")
+				}
+				if len(agg.Results) != 1 {
+					t.Errorf("expected 1 result, got %v", len(agg.Results))
+				}
+				body, err := ioutil.ReadFile(path.Join(agg.OutputDir, "systemd_logs", "results", "node1"))
+				if string(body) != tc.wantBody {
+					t.Errorf("expected result %q, got %q: %v", tc.wantBody, string(body), err)
+				}
+
+				URL, err = NodeResultURL(srv.URL, "node2", "systemd_logs")
+				if err != nil {
+					t.Fatalf("couldn't get test server URL: %v", err)
+				}
+				if resp := doRequest(t, srv.Client(), "PUT", URL, []byte("first")); resp.StatusCode != 200 {
+					t.Errorf("Got non-200 response from server: %v", resp.StatusCode)
+				}
+				if !agg.isComplete() {
+					t.Error("expected the aggregation to be complete")
+				}
+			})
+		})
+	}
+}
+
+func TestAggregation_retries(t *testing.T) {
+	expected := []plugin.ExpectedResult{
+		plugin.ExpectedResult{NodeName: "node1", ResultType: "systemd_logs"},
+		plugin.ExpectedResult{NodeName: "node2", ResultType: "systemd_logs"},
+		plugin.ExpectedResult{ResultType: "e2e"},
+	}
+	withAggregator(t, expected, func(agg *Aggregator, srv *authtest.Server) {
+		node1, err := NodeResultURL(srv.URL, "node1", "systemd_logs")
+		if err != nil {
+			t.Fatalf("couldn't get test server URL: %v", err)
+		}
+		node2, err := NodeResultURL(srv.URL, "node2", "systemd_logs")
+		if err != nil {
+			t.Fatalf("couldn't get test server URL: %v", err)
+		}
+		replace := func(retry bool, filename string) http.Header {
+			header := http.Header{}
+			if retry {
+				header.Set(ReplaceHeader, "true")
+			}
+			if filename != "" {
+				header.Set(dispositionHeader, fmt.Sprintf("attachment; filename=%q", filename))
+			}
+			return header
+		}
+
+		// Results, partial results and artifacts retried with the replace
+		// header replace what was uploaded before, whatever the duplicate
+		// policy.
+		for i, body := range []string{"first", "second"} {
+			if resp := doRequestWithHeaders(t, srv.Client(), "PUT", PartialResultURL(node1, 0), []byte("partial "+body), replace(i > 0, "")); resp.StatusCode != 200 {
+				t.Errorf("Got (%v) response from server for partial result %q", resp.StatusCode, body)
+			}
+		}
+		for i, body := range []string{"first", "second"} {
+			retry := i > 0
+			if resp := doRequestWithHeaders(t, srv.Client(), "PUT", node1, []byte(body), replace(retry, "")); resp.StatusCode != 200 {
+				t.Errorf("Got (%v) response from server for result %q", resp.StatusCode, body)
+			}
+			if resp := doRequestWithHeaders(t, srv.Client(), "PUT", ArtifactURL(node2), []byte("artifact "+body), replace(retry, "junit.xml")); resp.StatusCode != 200 {
+				t.Errorf("Got (%v) response from server for artifact %q", resp.StatusCode, body)
+			}
+		}
+		for i := 0; i < 2; i++ {
+			if resp := doRequestWithHeaders(t, srv.Client(), "PUT", DoneURL(node2), nil, replace(i > 0, "")); resp.StatusCode != 200 {
+				t.Errorf("Got (%v) response from server marking the result done", resp.StatusCode)
+			}
+		}
+
+		// Without the header, duplicates are still rejected.
+		if resp := doRequest(t, srv.Client(), "PUT", node1, []byte("third")); resp.StatusCode != 409 {
+			t.Errorf("Expected a 409 for a duplicate result which isn't a retry, got %v", resp.StatusCode)
+		}
+
+		for file, want := range map[string]string{
+			path.Join("systemd_logs", "partial", "node1", "00000000"):  "partial second",
+			path.Join("systemd_logs", "results", "node1"):              "second",
+			path.Join("systemd_logs", "results", "node2", "junit.xml"): "artifact second",
+		} {
+			got, err := ioutil.ReadFile(path.Join(agg.OutputDir, file))
+			if string(got) != want {
+				t.Errorf("expected %v to be %q, got %q: %v", file, want, got, err)
+			}
+		}
+		if len(agg.copyResults()) != 2 {
+			t.Errorf("expected 2 results, got %v", agg.copyResults())
+		}
+
+		// Results the aggregator recorded itself aren't replaced.
+		resultsCh := make(chan *plugin.Result, 1)
+		resultsCh <- pluginutils.MakeErrorResult("e2e", map[string]interface{}{"error": "timed out"}, "")
+		close(resultsCh)
+		agg.IngestResults(resultsCh)
+		e2e, err := GlobalResultURL(srv.URL, "e2e")
+		if err != nil {
+			t.Fatalf("couldn't get test server URL: %v", err)
+		}
+		if resp := doRequestWithHeaders(t, srv.Client(), "PUT", e2e, []byte("late"), replace(true, "")); resp.StatusCode != 409 {
+			t.Errorf("Expected a 409 for a result after the aggregator recorded one, got %v", resp.StatusCode)
+		}
+		if got := agg.copyResults()["e2e"].Error; got != "timed out" {
+			t.Errorf("expected the recorded error to be kept, got error %q", got)
+		}
+	})
+}
+
+func TestAggregation_ingestDuplicates(t *testing.T) {
+	expected := []plugin.ExpectedResult{
+		plugin.ExpectedResult{NodeName: "node1", ResultType: "systemd_logs"},
+	}
+	withAggregator(t, expected, func(agg *Aggregator, srv *authtest.Server) {
+		agg.DuplicatePolicy = plugin.DuplicateResultsOverwrite
+
+		resultsCh := make(chan *plugin.Result, 2)
+		resultsCh <- pluginutils.MakeErrorResult("systemd_logs", map[string]interface{}{"error": "first"}, "node1")
+		resultsCh <- pluginutils.MakeErrorResult("systemd_logs", map[string]interface{}{"error": "second"}, "node1")
+		close(resultsCh)
+		agg.IngestResults(resultsCh)
+
+		if !agg.isComplete() {
+			t.Error("expected the aggregation to be complete")
+		}
+		if got := agg.Results["systemd_logs/node1"].Error; got != "second" {
+			t.Errorf("expected the latest result to be recorded, got error %q", got)
+		}
+	})
+}
+
+func TestAggregation_completionThreshold(t *testing.T) {
+	var expected []plugin.ExpectedResult
+	for i := 1; i <= 10; i++ {
+		expected = append(expected, plugin.ExpectedResult{NodeName: fmt.Sprintf("node%v", i), ResultType: "systemd_logs"})
+	}
+	expected = append(expected, plugin.ExpectedResult{ResultType: "e2e"})
+
+	withAggregator(t, expected, func(agg *Aggregator, srv *authtest.Server) {
+		agg.CompletionThreshold = 0.8
+
+		resultsCh := make(chan *plugin.Result, len(expected))
+		for i := 1; i <= 8; i++ {
+			resultsCh <- &plugin.Result{ResultType: "systemd_logs", NodeName: fmt.Sprintf("node%v", i), MimeType: "application/json", Body: strings.NewReader("{}")}
+		}
+		close(resultsCh)
+		agg.IngestResults(resultsCh)
+
+		// Every plugin needs its threshold, and a job's only result can't
+		// be left out.
+		if agg.isComplete() {
+			t.Fatal("expected the aggregation not to be complete without the e2e result")
+		}
+
+		resultsCh = make(chan *plugin.Result, 1)
+		resultsCh <- &plugin.Result{ResultType: "e2e", MimeType: "application/json", Body: strings.NewReader("{}")}
+		close(resultsCh)
+		agg.IngestResults(resultsCh)
+
+		if !agg.isComplete() {
+			t.Fatal("expected the aggregation to be complete once the threshold was reached")
+		}
+		summary := agg.summarize()
+		if want := []string{"systemd_logs/node10", "systemd_logs/node9"}; !reflect.DeepEqual(summary.NotReported, want) {
+			t.Errorf("expected not reported %v, got %v", want, summary.NotReported)
+		}
+		if !summary.Succeeded() {
+			t.Errorf("expected the run to succeed, got %+v", summary)
+		}
+		if status := resultStatus(agg.Results["systemd_logs/node9"]); status != NotReportedStatus {
+			t.Errorf("expected the missing result to have status %v, got %v", NotReportedStatus, status)
+		}
+	})
+}
+
+func TestRequiredResults(t *testing.T) {
+	testCases := []struct {
+		n         int
+		threshold float64
+		expected  int
+	}{
+		{n: 10, threshold: 0, expected: 10},
+		{n: 10, threshold: 1, expected: 10},
+		{n: 100, threshold: 0.95, expected: 95},
+		{n: 10, threshold: 0.95, expected: 10},
+		{n: 21, threshold: 0.9, expected: 19},
+		{n: 1, threshold: 0.5, expected: 1},
+	}
+	for _, tc := range testCases {
+		if got := requiredResults(tc.n, tc.threshold); got != tc.expected {
+			t.Errorf("expected %v of %v results to be required at %v, got %v", tc.expected, tc.n, tc.threshold, got)
+		}
+	}
+}
+
+func TestAggregation_tooLarge(t *testing.T) {
+	expected := []plugin.ExpectedResult{
+		plugin.ExpectedResult{NodeName: "node1", ResultType: "systemd_logs"},
+		plugin.ExpectedResult{ResultType: "e2e"},
+	}
+	withAggregator(t, expected, func(agg *Aggregator, srv *authtest.Server) {
+		agg.MaxResultSizeBytes = 8
+
+		URL, err := NodeResultURL(srv.URL, "node1", "systemd_logs")
+		if err != nil {
+			t.Fatalf("couldn't get test server URL: %v", err)
+		}
+
+		resp := doRequest(t, srv.Client(), "PUT", PartialResultURL(URL, 0), []byte("way too large"))
+		if resp.StatusCode != 413 {
+			t.Errorf("Expected a 413 for a partial result which is too large, got %v", resp.StatusCode)
+		}
+		if _, err := os.Stat(path.Join(agg.OutputDir, "systemd_logs", "partial", "node1", "00000000")); err == nil {
+			t.Error("expected a partial result which is too large not to be kept")
+		}
+
+		resp = doRequest(t, srv.Client(), "PUT", URL, []byte("way too large"))
+		if resp.StatusCode != 413 {
+			t.Errorf("Expected a 413 for a result which is too large, got %v", resp.StatusCode)
+		}
+		result, ok := agg.Results["systemd_logs/node1"]
+		if !ok || result.IsSuccess() {
+			t.Fatalf("expected an error result to be recorded for node1, got %+v", result)
+		}
+		if _, err := os.Stat(path.Join(agg.OutputDir, "systemd_logs", "results", "node1")); err == nil {
+			t.Error("expected a result which is too large not to be kept")
+		}
+		if _, err := os.Stat(path.Join(agg.OutputDir, "systemd_logs", "errors", "node1")); err != nil {
+			t.Errorf("expected an error to be written for node1: %v", err)
+		}
+
+		URL, err = GlobalResultURL(srv.URL, "e2e")
+		if err != nil {
+			t.Fatalf("couldn't get test server URL: %v", err)
+		}
+		resp = doRequest(t, srv.Client(), "PUT", URL, []byte("small"))
+		if resp.StatusCode != 200 {
+			t.Errorf("Got non-200 response from server: %v", resp.StatusCode)
+		}
+		if !agg.isComplete() {
+			t.Error("expected the aggregation to be complete")
+		}
+	})
+}
+
+func TestAggregation_checksum(t *testing.T) {
+	digest := func(b []byte) string {
+		sum := sha256.Sum256(b)
+		return "SHA-256=" + base64.StdEncoding.EncodeToString(sum[:])
+	}
+	tarBytes := makeTarWithContents(t, "inside_tar.txt", []byte("foo"))
+
+	testCases := []struct {
+		desc        string
+		body        []byte
+		mimeType    string
+		digest      string
+		wantStatus  int
+		wantSuccess bool
+	}{
+		{desc: "no checksum", body: []byte("foo"), wantStatus: 200, wantSuccess: true},
+		{desc: "matching checksum", body: []byte("foo"), digest: digest([]byte("foo")), wantStatus: 200, wantSuccess: true},
+		{desc: "matching archive checksum", body: tarBytes, mimeType: gzipMimeType, digest: digest(tarBytes), wantStatus: 200, wantSuccess: true},
+		{desc: "other algorithms are ignored", body: []byte("foo"), digest: "MD5=rL0Y20zC+Fzt72VPzMSk2A==", wantStatus: 200, wantSuccess: true},
+		{desc: "mismatched checksum", body: []byte("fo"), digest: digest([]byte("foo")), wantStatus: 422},
+		{desc: "malformed checksum", body: []byte("foo"), digest: "SHA-256=???", wantStatus: 400},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.desc, func(t *testing.T) {
+			expected := []plugin.ExpectedResult{
+				plugin.ExpectedResult{NodeName: "node1", ResultType: "systemd_logs"},
+			}
+			withAggregator(t, expected, func(agg *Aggregator, srv *authtest.Server) {
+				URL, err := NodeResultURL(srv.URL, "node1", "systemd_logs")
+				if err != nil {
+					t.Fatalf("couldn't get test server URL: %v", err)
+				}
+
+				headers := http.Header{}
+				if tc.digest != "" {
+					headers.Set("digest", tc.digest)
+				}
+				if tc.mimeType != "" {
+					headers.Set("content-type", tc.mimeType)
+				}
+				resp := doRequestWithHeaders(t, srv.Client(), "PUT", URL, tc.body, headers)
+				if resp.StatusCode != tc.wantStatus {
+					body, _ := ioutil.ReadAll(resp.Body)
+					t.Fatalf("expected a %v response, got %v: %v", tc.wantStatus, resp.StatusCode, string(body))
+				}
+
+				result, ok := agg.Results["systemd_logs/node1"]
+				if tc.wantStatus == 400 {
+					if ok {
+						t.Errorf("expected a malformed request not to be recorded, got %+v", result)
+					}
+					return
+				}
+				if !ok || result.IsSuccess() != tc.wantSuccess {
+					t.Fatalf("expected a result with success %v to be recorded, got %+v", tc.wantSuccess, result)
+				}
+				if !tc.wantSuccess {
+					if _, err := os.Stat(path.Join(agg.OutputDir, "systemd_logs", "results", "node1")); err == nil {
+						t.Error("expected a result which doesn't match its checksum not to be kept")
+					}
+				}
+			})
+		})
+	}
+}
+
 func TestAggregation_errors(t *testing.T) {
 	expected := []plugin.ExpectedResult{
 		plugin.ExpectedResult{ResultType: "e2e"},
@@ -192,6 +881,9 @@ func TestAggregation_errors(t *testing.T) {
 			if err != nil || string(bytes) != `{"error":"foo"}` {
 				t.Errorf("results for e2e plugin incorrect (got %v): %v", string(bytes), err)
 			}
+			if result.ErrorCategory != plugin.ErrorCategoryUnknown {
+				t.Errorf("expected an error without a category to be unknown, got %q", result.ErrorCategory)
+			}
 		} else {
 			t.Errorf("Aggregator didn't record error result from e2e plugin, got %v", agg.Results)
 		}
@@ -257,3 +949,343 @@ func makeTarWithContents(t *testing.T, filename string, fileContents []byte) (ta
 
 	return tarbytes
 }
+
+func TestAggregation_concurrentUploads(t *testing.T) {
+	const nodes = 50
+	expected := make([]plugin.ExpectedResult, nodes)
+	for i := range expected {
+		expected[i] = plugin.ExpectedResult{ResultType: "systemd_logs", NodeName: fmt.Sprintf("node%d", i)}
+	}
+	dir, err := ioutil.TempDir("", "sonobuoy_server_test")
+	if err != nil {
+		t.Fatalf("Could not create temp directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	agg := NewAggregator(path.Join(dir, "plugins"), expected)
+	agg.MaxConcurrentWrites = 4
+	agg.manifest = newResultsManifest(dir, nil)
+
+	var mu sync.Mutex
+	var writing, mostWriting int
+	agg.Transforms = []ResultTransform{func(plugin string, r io.Reader) (io.Reader, error) {
+		mu.Lock()
+		defer mu.Unlock()
+		if writing++; writing > mostWriting {
+			mostWriting = writing
+		}
+		return &eofHook{Reader: r, hook: func() {
+			mu.Lock()
+			defer mu.Unlock()
+			writing--
+		}}, nil
+	}}
+
+	var wg sync.WaitGroup
+	for _, e := range expected {
+		wg.Add(1)
+		go func(node string) {
+			defer wg.Done()
+			w := httptest.NewRecorder()
+			agg.HandleHTTPResult(&plugin.Result{
+				ResultType: "systemd_logs",
+				NodeName:   node,
+				MimeType:   "application/octet-stream",
+				Body:       &slowReader{data: []byte("logs from " + node), chunk: 4, delay: time.Millisecond},
+			}, w)
+			if w.Code != http.StatusOK {
+				t.Errorf("expected a 200 response for %v, got %v: %v", node, w.Code, w.Body.String())
+			}
+		}(e.NodeName)
+	}
+	wg.Wait()
+
+	if mostWriting > 4 {
+		t.Errorf("expected at most 4 results to be written at once, got %v", mostWriting)
+	}
+	if mostWriting < 2 {
+		t.Errorf("expected results to be written concurrently, got %v at most", mostWriting)
+	}
+	if !agg.isComplete() {
+		t.Errorf("expected every result to be recorded, missing %v", agg.MissingResults())
+	}
+	for _, e := range expected {
+		contents, err := ioutil.ReadFile(path.Join(dir, "plugins", "systemd_logs", "results", e.NodeName))
+		if err != nil {
+			t.Errorf("couldn't read the result of %v: %v", e.NodeName, err)
+		} else if string(contents) != "logs from "+e.NodeName {
+			t.Errorf("expected the result of %v to be written in full, got %q", e.NodeName, contents)
+		}
+	}
+	if manifest := readManifest(t, dir); len(manifest.Results) != nodes {
+		t.Errorf("expected %v results in the manifest, got %v", nodes, len(manifest.Results))
+	}
+}
+
+// TestAggregation_concurrentUnrecordedUploads checks that partial results,
+// artifacts and results replacing duplicates are received concurrently too,
+// within the MaxConcurrentWrites limit.
+func TestAggregation_concurrentUnrecordedUploads(t *testing.T) {
+	const nodes = 20
+	expected := make([]plugin.ExpectedResult, nodes)
+	for i := range expected {
+		expected[i] = plugin.ExpectedResult{ResultType: "systemd_logs", NodeName: fmt.Sprintf("node%d", i)}
+	}
+	testCases := []struct {
+		desc string
+		// record records the results already in before the uploads, if any
+		record bool
+		upload func(node string) *plugin.Result
+		// file is where the upload from the node is written
+		file func(node string) string
+	}{
+		{
+			desc:   "Partial results",
+			upload: func(node string) *plugin.Result { return &plugin.Result{Partial: true} },
+			file:   func(node string) string { return path.Join("systemd_logs", "partial", node, "00000000") },
+		}, {
+			desc:   "Artifacts",
+			upload: func(node string) *plugin.Result { return &plugin.Result{Artifact: true, Filename: "logs.txt"} },
+			file:   func(node string) string { return path.Join("systemd_logs", "results", node, "logs.txt") },
+		}, {
+			desc:   "Replaced results",
+			record: true,
+			upload: func(node string) *plugin.Result { return &plugin.Result{Replace: true} },
+			file:   func(node string) string { return path.Join("systemd_logs", "results", node) },
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.desc, func(t *testing.T) {
+			dir, err := ioutil.TempDir("", "sonobuoy_server_test")
+			if err != nil {
+				t.Fatalf("Could not create temp directory: %v", err)
+			}
+			defer os.RemoveAll(dir)
+
+			agg := NewAggregator(path.Join(dir, "plugins"), expected)
+			agg.MaxConcurrentWrites = 4
+			agg.manifest = newResultsManifest(dir, nil)
+			if tc.record {
+				for _, e := range expected {
+					w := httptest.NewRecorder()
+					agg.HandleHTTPResult(&plugin.Result{ResultType: e.ResultType, NodeName: e.NodeName, Body: strings.NewReader("first")}, w)
+					if w.Code != http.StatusOK {
+						t.Fatalf("expected a 200 response recording %v, got %v: %v", e.NodeName, w.Code, w.Body.String())
+					}
+				}
+			}
+
+			var mu sync.Mutex
+			var writing, mostWriting int
+			agg.Transforms = []ResultTransform{func(plugin string, r io.Reader) (io.Reader, error) {
+				mu.Lock()
+				defer mu.Unlock()
+				if writing++; writing > mostWriting {
+					mostWriting = writing
+				}
+				return &eofHook{Reader: r, hook: func() {
+					mu.Lock()
+					defer mu.Unlock()
+					writing--
+				}}, nil
+			}}
+
+			var wg sync.WaitGroup
+			for _, e := range expected {
+				wg.Add(1)
+				go func(node string) {
+					defer wg.Done()
+					result := tc.upload(node)
+					result.ResultType = "systemd_logs"
+					result.NodeName = node
+					result.Body = &slowReader{data: []byte("logs from " + node), chunk: 4, delay: time.Millisecond}
+					w := httptest.NewRecorder()
+					agg.HandleHTTPResult(result, w)
+					if w.Code != http.StatusOK {
+						t.Errorf("expected a 200 response for %v, got %v: %v", node, w.Code, w.Body.String())
+					}
+				}(e.NodeName)
+			}
+			wg.Wait()
+
+			if mostWriting > 4 {
+				t.Errorf("expected at most 4 uploads to be written at once, got %v", mostWriting)
+			}
+			if mostWriting < 2 {
+				t.Errorf("expected uploads to be written concurrently, got %v at most", mostWriting)
+			}
+			for _, e := range expected {
+				contents, err := ioutil.ReadFile(path.Join(dir, "plugins", tc.file(e.NodeName)))
+				if err != nil {
+					t.Errorf("couldn't read the upload of %v: %v", e.NodeName, err)
+				} else if string(contents) != "logs from "+e.NodeName {
+					t.Errorf("expected the upload of %v to be written in full, got %q", e.NodeName, contents)
+				}
+			}
+		})
+	}
+}
+
+// TestAggregation_doneWhileArtifactReceived checks that a result isn't
+// marked done while one of its artifacts is still being received.
+func TestAggregation_doneWhileArtifactReceived(t *testing.T) {
+	expected := []plugin.ExpectedResult{{ResultType: "systemd_logs", NodeName: "node1"}}
+	dir, err := ioutil.TempDir("", "sonobuoy_server_test")
+	if err != nil {
+		t.Fatalf("Could not create temp directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	agg := NewAggregator(dir, expected)
+	agg.manifest = newResultsManifest(dir, nil)
+
+	pr, pw := io.Pipe()
+	received := make(chan int)
+	go func() {
+		w := httptest.NewRecorder()
+		agg.HandleHTTPResult(&plugin.Result{ResultType: "systemd_logs", NodeName: "node1", Artifact: true, Filename: "logs.txt", Body: pr}, w)
+		received <- w.Code
+	}()
+	// The artifact's body is being received once it's read from
+	if _, err := pw.Write([]byte("logs")); err != nil {
+		t.Fatalf("couldn't write artifact: %v", err)
+	}
+
+	done := make(chan int)
+	go func() {
+		w := httptest.NewRecorder()
+		agg.HandleHTTPResult(&plugin.Result{ResultType: "systemd_logs", NodeName: "node1", Done: true, Body: http.NoBody}, w)
+		done <- w.Code
+	}()
+	select {
+	case code := <-done:
+		if code != http.StatusConflict {
+			t.Errorf("expected a 409 marking the result done while its artifact is received, got %v", code)
+		}
+	case <-time.After(5 * time.Second):
+		pw.Close()
+		t.Fatal("marking the result done waited for its artifact to be received")
+	}
+
+	pw.Close()
+	if code := <-received; code != http.StatusOK {
+		t.Errorf("expected a 200 response for the artifact, got %v", code)
+	}
+	w := httptest.NewRecorder()
+	agg.HandleHTTPResult(&plugin.Result{ResultType: "systemd_logs", NodeName: "node1", Done: true, Body: http.NoBody}, w)
+	if w.Code != http.StatusOK {
+		t.Errorf("expected a 200 response marking the result done, got %v: %v", w.Code, w.Body.String())
+	}
+}
+
+// eofHook calls hook once the reader returns io.EOF.
+type eofHook struct {
+	io.Reader
+	hook func()
+}
+
+func (e *eofHook) Read(p []byte) (int, error) {
+	n, err := e.Reader.Read(p)
+	if err == io.EOF && e.hook != nil {
+		e.hook()
+		e.hook = nil
+	}
+	return n, err
+}
+
+// slowReader returns its data a chunk at a time, pausing before each one as
+// an upload over the network would.
+type slowReader struct {
+	data  []byte
+	chunk int
+	delay time.Duration
+}
+
+func (r *slowReader) Read(p []byte) (int, error) {
+	if len(r.data) == 0 {
+		return 0, io.EOF
+	}
+	time.Sleep(r.delay)
+	n := r.chunk
+	if n > len(p) {
+		n = len(p)
+	}
+	if n > len(r.data) {
+		n = len(r.data)
+	}
+	copy(p, r.data[:n])
+	r.data = r.data[n:]
+	return n, nil
+}
+
+// BenchmarkAggregation_concurrentUploads measures how quickly the results of
+// a large daemonset plugin are received when every node uploads at once,
+// whether they're results, partial results, artifacts or results replacing
+// the ones already recorded.
+func BenchmarkAggregation_concurrentUploads(b *testing.B) {
+	const nodes = 500
+	body := bytes.Repeat([]byte("x"), 64*1024)
+	expected := make([]plugin.ExpectedResult, nodes)
+	for i := range expected {
+		expected[i] = plugin.ExpectedResult{ResultType: "systemd_logs", NodeName: fmt.Sprintf("node%d", i)}
+	}
+	benchmarks := []struct {
+		name   string
+		record bool
+		upload plugin.Result
+	}{
+		{name: "results"},
+		{name: "partials", upload: plugin.Result{Partial: true}},
+		{name: "artifacts", upload: plugin.Result{Artifact: true, Filename: "logs.txt"}},
+		{name: "overwrites", record: true, upload: plugin.Result{Replace: true}},
+	}
+
+	for _, bm := range benchmarks {
+		b.Run(bm.name, func(b *testing.B) {
+			b.SetBytes(int64(nodes * len(body)))
+			for i := 0; i < b.N; i++ {
+				b.StopTimer()
+				dir, err := ioutil.TempDir("", "sonobuoy_server_bench")
+				if err != nil {
+					b.Fatalf("Could not create temp directory: %v", err)
+				}
+				agg := NewAggregator(dir, expected)
+				agg.manifest = newResultsManifest(dir, nil)
+				agg.manifest.log = logrus.New()
+				agg.Log, _ = testhook.NewNullLogger()
+				if bm.record {
+					for _, e := range expected {
+						agg.HandleHTTPResult(&plugin.Result{ResultType: e.ResultType, NodeName: e.NodeName, Body: strings.NewReader("first")}, httptest.NewRecorder())
+					}
+				}
+				b.StartTimer()
+
+				var wg sync.WaitGroup
+				for _, e := range expected {
+					wg.Add(1)
+					go func(node string) {
+						defer wg.Done()
+						result := bm.upload
+						result.ResultType = "systemd_logs"
+						result.NodeName = node
+						result.MimeType = "application/octet-stream"
+						result.Body = &slowReader{data: body, chunk: 16 * 1024, delay: time.Millisecond}
+						w := httptest.NewRecorder()
+						agg.HandleHTTPResult(&result, w)
+						if w.Code != http.StatusOK {
+							b.Errorf("expected a 200 response for %v, got %v", node, w.Code)
+						}
+					}(e.NodeName)
+				}
+				wg.Wait()
+
+				b.StopTimer()
+				if !bm.upload.Partial && !bm.upload.Artifact && len(agg.Results) != nodes {
+					b.Errorf("expected %v results, got %v", nodes, len(agg.Results))
+				}
+				os.RemoveAll(dir)
+				b.StartTimer()
+			}
+		})
+	}
+}
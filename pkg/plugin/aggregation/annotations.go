@@ -0,0 +1,61 @@
+/*
+Copyright 2018 Heptio Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package aggregation
+
+import (
+	"encoding/json"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	// AnnotationsHeader is the header workers may send with a result to
+	// annotate it with metadata, such as the version of the test suite,
+	// which is recorded with the result in the manifest. Its value is a
+	// JSON object of strings, e.g. {"suite-version":"1.2.3"}.
+	AnnotationsHeader = "Sonobuoy-Annotations"
+	// MaxAnnotationsBytes limits the size of the annotations of a result,
+	// as sent in the AnnotationsHeader.
+	MaxAnnotationsBytes = 8 * 1024
+)
+
+// ParseAnnotations returns the annotations in the value of an
+// AnnotationsHeader, or nil if it's empty. Annotations larger than
+// MaxAnnotationsBytes, or which aren't a JSON object of strings with
+// non-empty keys, are rejected.
+func ParseAnnotations(header string) (map[string]string, error) {
+	if header == "" {
+		return nil, nil
+	}
+	if len(header) > MaxAnnotationsBytes {
+		return nil, errors.Errorf("annotations are %v bytes, more than the limit of %v", len(header), MaxAnnotationsBytes)
+	}
+
+	var annotations map[string]string
+	if err := json.Unmarshal([]byte(header), &annotations); err != nil || annotations == nil {
+		return nil, errors.New("annotations must be a JSON object of strings")
+	}
+	for key := range annotations {
+		if key == "" {
+			return nil, errors.New("annotation keys must not be empty")
+		}
+	}
+	if len(annotations) == 0 {
+		return nil, nil
+	}
+	return annotations, nil
+}
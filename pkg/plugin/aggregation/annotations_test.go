@@ -0,0 +1,104 @@
+/*
+Copyright 2018 Heptio Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package aggregation
+
+import (
+	"net/http"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/heptio/sonobuoy/pkg/backplane/ca/authtest"
+	"github.com/heptio/sonobuoy/pkg/plugin"
+)
+
+func TestParseAnnotations(t *testing.T) {
+	testCases := []struct {
+		desc      string
+		header    string
+		expected  map[string]string
+		expectErr bool
+	}{
+		{desc: "none"},
+		{desc: "empty object", header: "{}"},
+		{
+			desc:     "annotations",
+			header:   `{"suite-version":"1.2.3","image-sha":"abc123"}`,
+			expected: map[string]string{"suite-version": "1.2.3", "image-sha": "abc123"},
+		},
+		{desc: "not an object", header: `["1.2.3"]`, expectErr: true},
+		{desc: "null", header: "null", expectErr: true},
+		{desc: "non-string value", header: `{"retries":3}`, expectErr: true},
+		{desc: "empty key", header: `{"":"1.2.3"}`, expectErr: true},
+		{desc: "too large", header: `{"a":"` + strings.Repeat("x", MaxAnnotationsBytes) + `"}`, expectErr: true},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.desc, func(t *testing.T) {
+			annotations, err := ParseAnnotations(tc.header)
+			if tc.expectErr != (err != nil) {
+				t.Fatalf("expected error %v, got %v", tc.expectErr, err)
+			}
+			if !reflect.DeepEqual(annotations, tc.expected) {
+				t.Errorf("expected annotations %v, got %v", tc.expected, annotations)
+			}
+		})
+	}
+}
+
+func TestAggregation_annotations(t *testing.T) {
+	expected := []plugin.ExpectedResult{
+		{NodeName: "node1", ResultType: "systemd_logs"},
+		{ResultType: "e2e"},
+	}
+
+	withAggregator(t, expected, func(agg *Aggregator, srv *authtest.Server) {
+		agg.manifest = newResultsManifest(agg.OutputDir, nil)
+		node1, err := NodeResultURL(srv.URL, "node1", "systemd_logs")
+		if err != nil {
+			t.Fatalf("couldn't get test server URL: %v", err)
+		}
+		e2e, err := GlobalResultURL(srv.URL, "e2e")
+		if err != nil {
+			t.Fatalf("couldn't get test server URL: %v", err)
+		}
+		annotated := func(annotations string) http.Header {
+			return http.Header{AnnotationsHeader: []string{annotations}}
+		}
+
+		if resp := doRequestWithHeaders(t, srv.Client(), "PUT", node1, []byte("{}"), annotated(`{"suite-version":`)); resp.StatusCode != 400 {
+			t.Errorf("expected a 400 for invalid annotations, got %v", resp.StatusCode)
+		}
+		if resp := doRequestWithHeaders(t, srv.Client(), "PUT", node1, []byte("{}"), annotated(`{"suite-version":"1.2.3"}`)); resp.StatusCode != 200 {
+			t.Errorf("expected a 200 for an annotated result, got %v", resp.StatusCode)
+		}
+		if resp := doRequest(t, srv.Client(), "PUT", e2e, []byte("{}")); resp.StatusCode != 200 {
+			t.Errorf("expected a 200 for a result without annotations, got %v", resp.StatusCode)
+		}
+
+		entries := map[string]ManifestEntry{}
+		for _, entry := range readManifest(t, agg.OutputDir).Results {
+			entries[entry.ResultType] = entry
+		}
+		if got, want := entries["systemd_logs"].Annotations, map[string]string{"suite-version": "1.2.3"}; !reflect.DeepEqual(got, want) {
+			t.Errorf("expected annotations %v in the manifest, got %v", want, got)
+		}
+		if got := entries["e2e"].Annotations; got != nil {
+			t.Errorf("expected no annotations for e2e, got %v", got)
+		}
+	})
+}
@@ -0,0 +1,182 @@
+/*
+Copyright 2018 Heptio Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package aggregation
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"io"
+	"io/ioutil"
+	"net/http"
+
+	"github.com/heptio/sonobuoy/pkg/plugin"
+	"github.com/pkg/errors"
+)
+
+// rejectedResultError is returned for results which were received but are
+// rejected, such as results which are too large. It carries the HTTP status
+// to respond with.
+type rejectedResultError struct {
+	status int
+	msg    string
+	// violations lists how a result doesn't match its schema.
+	violations []string
+}
+
+func (e *rejectedResultError) Error() string { return e.msg }
+
+// resultBody is the body of a result submitted over HTTP. It stops reading
+// after the size limit, remembering whether the limit was hit or the upload
+// failed part way through, such as when the connection drops, since decoding
+// archives can hide the error returned by the reader. It also computes the
+// checksum of the body if the result has one to verify, and keeps a copy of
+// it if it has a schema to validate or is to be merged by a reducer.
+type resultBody struct {
+	io.Reader
+	exceeded bool
+	readErr  error
+	// limited, if set, counts the body as it's read to tell whether the
+	// size limit was hit
+	limited *limitedReader
+	hash    hash.Hash
+	copy    *bytes.Buffer
+	// size counts the bytes read, after the body was decompressed
+	size int64
+	// firstByte, if set, is called once the first byte has been read
+	firstByte func()
+}
+
+func (b *resultBody) Read(p []byte) (int, error) {
+	n, err := b.Reader.Read(p)
+	b.size += int64(n)
+	if n > 0 && b.firstByte != nil {
+		firstByte := b.firstByte
+		b.firstByte = nil
+		firstByte()
+	}
+	if err != nil && err != io.EOF && b.limited != nil && b.limited.exceeded() {
+		b.exceeded = true
+	} else if err != nil && err != io.EOF && b.readErr == nil {
+		b.readErr = err
+	}
+	if b.hash != nil {
+		b.hash.Write(p[:n])
+	}
+	if b.copy != nil {
+		b.copy.Write(p[:n])
+	}
+	return n, err
+}
+
+// wrapResultBody limits the body of the result to MaxResultSizeBytes, if set,
+// hashes it if it has a checksum, copies it if it has a schema or a reducer
+// and observes the result starting once its first byte arrives. Only whole
+// results submitted in a single upload are validated against their schema or
+// merged.
+func (a *Aggregator) wrapResultBody(result *plugin.Result, w http.ResponseWriter) {
+	body := &resultBody{Reader: result.Body}
+	if a.Observer != nil {
+		started := &plugin.Result{ResultType: result.ResultType, NodeName: result.NodeName}
+		body.firstByte = func() { a.observe(ResultStarted, started) }
+	}
+	body.Reader, body.limited = a.limitResultSize(result.Body, w)
+	if result.Checksum != "" {
+		body.hash = sha256.New()
+	}
+	if (a.Schemas[result.ResultType] != nil || a.Reducers[result.ResultType] != nil) && validatable(result) {
+		body.copy = &bytes.Buffer{}
+	}
+	result.Body = body
+}
+
+// checkResultBody returns a rejectedResultError if the body of the result
+// was too large, wasn't received in full or doesn't match its checksum. It
+// must be called once the result has been written.
+func (a *Aggregator) checkResultBody(result *plugin.Result) error {
+	body, ok := result.Body.(*resultBody)
+	if !ok {
+		return nil
+	}
+	if body.exceeded {
+		return &rejectedResultError{
+			status: http.StatusRequestEntityTooLarge,
+			msg:    fmt.Sprintf("result is larger than the maximum of %v bytes", a.MaxResultSizeBytes),
+		}
+	}
+	if body.readErr != nil {
+		return &rejectedResultError{
+			status: http.StatusBadRequest,
+			msg:    fmt.Sprintf("result upload ended before it was complete: %v", body.readErr),
+		}
+	}
+	if body.hash == nil {
+		return nil
+	}
+
+	// Archives may not be read to the end when they are extracted, but
+	// the checksum covers all of the body.
+	if _, err := io.Copy(ioutil.Discard, body); err != nil && body.readErr == nil && !body.exceeded {
+		return errors.Wrap(err, "couldn't read the rest of the result")
+	}
+	if body.exceeded || body.readErr != nil {
+		return a.checkResultBody(result)
+	}
+	if sum := hex.EncodeToString(body.hash.Sum(nil)); sum != result.Checksum {
+		return &rejectedResultError{
+			status: http.StatusUnprocessableEntity,
+			msg:    fmt.Sprintf("result has SHA-256 checksum %v, expected %v", sum, result.Checksum),
+		}
+	}
+	return nil
+}
+
+// bodyIncomplete returns true if reading the body of the result hit the size
+// limit or failed before the end, in which case errors writing the result
+// are down to its body.
+func bodyIncomplete(result *plugin.Result) bool {
+	body, ok := result.Body.(*resultBody)
+	return ok && (body.exceeded || body.readErr != nil)
+}
+
+// originalSize returns the size of the body of the result as it was read,
+// once decompressed but before any transforms, or false if it wasn't
+// uploaded.
+func originalSize(result *plugin.Result) (int64, bool) {
+	body, ok := result.Body.(*resultBody)
+	if !ok {
+		return 0, false
+	}
+	return body.size, true
+}
+
+// uploadInterrupted returns true if the body of the result stopped before the
+// end for reasons other than its size, such as the connection dropping.
+func uploadInterrupted(result *plugin.Result) bool {
+	body, ok := result.Body.(*resultBody)
+	return ok && body.readErr != nil
+}
+
+// resultErrorStatus returns the HTTP status for an error handling a result.
+func resultErrorStatus(err error) int {
+	if rejected, ok := errors.Cause(err).(*rejectedResultError); ok {
+		return rejected.status
+	}
+	return http.StatusInternalServerError
+}
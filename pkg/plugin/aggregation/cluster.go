@@ -0,0 +1,165 @@
+/*
+Copyright 2018 Heptio Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package aggregation
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/version"
+	"k8s.io/client-go/kubernetes"
+)
+
+// ClusterInfoFile is the name of the file in the meta directory describing
+// the cluster the run was made against.
+const ClusterInfoFile = "cluster.json"
+
+// featureEnabledMetric is the API server metric with a sample for each
+// feature gate, which is 1 if the gate is enabled.
+const featureEnabledMetric = "kubernetes_feature_enabled"
+
+// featureNameLabel matches the name label of a featureEnabledMetric sample.
+var featureNameLabel = regexp.MustCompile(`\bname="([^"]*)"`)
+
+// ClusterInfo describes the cluster a run was made against, as it was when
+// the run started, so that results can be traced back to it. Anything which
+// couldn't be found out has its error recorded instead.
+type ClusterInfo struct {
+	Collected     time.Time     `json:"collected"`
+	ServerVersion *version.Info `json:"serverversion,omitempty"`
+	// ServerVersionError is set if the server version couldn't be fetched.
+	ServerVersionError string `json:"serverversionerror,omitempty"`
+	// NodeSelector limits the nodes which were counted, as in the
+	// aggregation config.
+	NodeSelector string `json:"nodeselector,omitempty"`
+	Nodes        int    `json:"nodes"`
+	// Platforms counts the nodes of each OS and architecture, e.g.
+	// "linux/amd64".
+	Platforms map[string]int `json:"platforms"`
+	// OSImages and KubeletVersions count the nodes running each OS image
+	// and version of kubelet.
+	OSImages        map[string]int `json:"osimages"`
+	KubeletVersions map[string]int `json:"kubeletversions"`
+	// FeatureGates maps the API server's feature gates to whether they're
+	// enabled. They're read from its metrics, which only have them from
+	// Kubernetes 1.26.
+	FeatureGates map[string]bool `json:"featuregates,omitempty"`
+	// FeatureGatesError is set if the feature gates couldn't be read.
+	FeatureGatesError string `json:"featuregateserror,omitempty"`
+}
+
+// gatherClusterInfo describes the cluster which the nodes are from. Since
+// it's only recorded for reference, what can't be found out is noted in
+// place of an error.
+func gatherClusterInfo(ctx context.Context, client kubernetes.Interface, nodes []v1.Node, nodeSelector string) *ClusterInfo {
+	info := &ClusterInfo{
+		Collected:       time.Now().UTC(),
+		NodeSelector:    nodeSelector,
+		Nodes:           len(nodes),
+		Platforms:       map[string]int{},
+		OSImages:        map[string]int{},
+		KubeletVersions: map[string]int{},
+	}
+	for _, node := range nodes {
+		nodeInfo := node.Status.NodeInfo
+		info.Platforms[nodeInfo.OperatingSystem+"/"+nodeInfo.Architecture]++
+		info.OSImages[nodeInfo.OSImage]++
+		info.KubeletVersions[nodeInfo.KubeletVersion]++
+	}
+
+	discovery := client.Discovery()
+	serverVersion, err := discovery.ServerVersion()
+	if err != nil {
+		info.ServerVersionError = errors.Wrap(err, "couldn't get the server version").Error()
+	} else {
+		info.ServerVersion = serverVersion
+	}
+
+	restClient := discovery.RESTClient()
+	if restClient == nil {
+		info.FeatureGatesError = "there's no client for the API server's metrics"
+		return info
+	}
+	metrics, err := restClient.Get().AbsPath("/metrics").Context(ctx).DoRaw()
+	if err != nil {
+		info.FeatureGatesError = errors.Wrap(err, "couldn't get the API server's metrics").Error()
+		return info
+	}
+	gates := parseFeatureGates(metrics)
+	if len(gates) == 0 {
+		info.FeatureGatesError = "the API server's metrics don't include its feature gates"
+		return info
+	}
+	info.FeatureGates = gates
+	return info
+}
+
+// parseFeatureGates returns the feature gates in the API server's metrics,
+// which are in the Prometheus text format, mapped to whether they're
+// enabled.
+func parseFeatureGates(metrics []byte) map[string]bool {
+	gates := map[string]bool{}
+	scanner := bufio.NewScanner(bytes.NewReader(metrics))
+	for scanner.Scan() {
+		line := scanner.Text()
+		if !strings.HasPrefix(line, featureEnabledMetric+"{") {
+			continue
+		}
+		end := strings.LastIndex(line, "}")
+		if end < 0 {
+			continue
+		}
+		name := featureNameLabel.FindStringSubmatch(line[:end])
+		fields := strings.Fields(line[end+1:])
+		if name == nil || len(fields) == 0 {
+			continue
+		}
+		value, err := strconv.ParseFloat(fields[0], 64)
+		if err != nil {
+			continue
+		}
+		gates[name[1]] = value == 1
+	}
+	return gates
+}
+
+// writeClusterInfo records the cluster info in the meta directory of outdir.
+func writeClusterInfo(outdir string, info *ClusterInfo) error {
+	metapath := path.Join(outdir, metaDir)
+	if err := os.MkdirAll(metapath, 0755); err != nil {
+		return errors.Wrapf(err, "couldn't create directory %v", metapath)
+	}
+
+	blob, err := json.Marshal(info)
+	if err != nil {
+		return errors.Wrap(err, "couldn't marshal cluster info")
+	}
+
+	file := path.Join(metapath, ClusterInfoFile)
+	return errors.Wrapf(ioutil.WriteFile(file, blob, 0644), "couldn't write cluster info to %v", file)
+}
@@ -0,0 +1,141 @@
+/*
+Copyright 2018 Heptio Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package aggregation
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/heptio/sonobuoy/pkg/plugin"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
+)
+
+const testMetrics = `# HELP kubernetes_feature_enabled [BETA] This metric records the data about the stage and enablement of a k8s feature.
+# TYPE kubernetes_feature_enabled gauge
+kubernetes_feature_enabled{name="APIListChunking",stage=""} 1
+kubernetes_feature_enabled{name="InPlacePodVerticalScaling",stage="ALPHA"} 0
+apiserver_request_total{code="200",verb="GET"} 12
+`
+
+func testNode(name, os, arch, image, kubelet string) v1.Node {
+	return v1.Node{
+		ObjectMeta: metav1.ObjectMeta{Name: name},
+		Status: v1.NodeStatus{NodeInfo: v1.NodeSystemInfo{
+			OperatingSystem: os,
+			Architecture:    arch,
+			OSImage:         image,
+			KubeletVersion:  kubelet,
+		}},
+	}
+}
+
+func TestGatherClusterInfo(t *testing.T) {
+	metrics := testMetrics
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/version":
+			w.Header().Set("Content-Type", "application/json")
+			w.Write([]byte(`{"major":"1","minor":"27","gitVersion":"v1.27.3"}`))
+		case "/metrics":
+			w.Write([]byte(metrics))
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer srv.Close()
+	client, err := kubernetes.NewForConfig(&rest.Config{Host: srv.URL})
+	if err != nil {
+		t.Fatalf("couldn't make client: %v", err)
+	}
+
+	nodes := []v1.Node{
+		testNode("node1", "linux", "amd64", "Ubuntu 18.04", "v1.27.3"),
+		testNode("node2", "linux", "arm64", "Ubuntu 18.04", "v1.27.3"),
+		testNode("node3", "linux", "amd64", "Ubuntu 20.04", "v1.27.2"),
+	}
+	info := gatherClusterInfo(context.Background(), client, nodes, "pool=default")
+
+	if info.ServerVersion == nil || info.ServerVersion.GitVersion != "v1.27.3" {
+		t.Errorf("expected server version v1.27.3, got %+v (%v)", info.ServerVersion, info.ServerVersionError)
+	}
+	if info.Nodes != 3 || info.NodeSelector != "pool=default" {
+		t.Errorf("expected 3 nodes selected by pool=default, got %v selected by %q", info.Nodes, info.NodeSelector)
+	}
+	if want := map[string]int{"linux/amd64": 2, "linux/arm64": 1}; !reflect.DeepEqual(info.Platforms, want) {
+		t.Errorf("expected platforms %v, got %v", want, info.Platforms)
+	}
+	if want := map[string]int{"Ubuntu 18.04": 2, "Ubuntu 20.04": 1}; !reflect.DeepEqual(info.OSImages, want) {
+		t.Errorf("expected OS images %v, got %v", want, info.OSImages)
+	}
+	if want := map[string]int{"v1.27.3": 2, "v1.27.2": 1}; !reflect.DeepEqual(info.KubeletVersions, want) {
+		t.Errorf("expected kubelet versions %v, got %v", want, info.KubeletVersions)
+	}
+	if want := map[string]bool{"APIListChunking": true, "InPlacePodVerticalScaling": false}; !reflect.DeepEqual(info.FeatureGates, want) {
+		t.Errorf("expected feature gates %v, got %v (%v)", want, info.FeatureGates, info.FeatureGatesError)
+	}
+
+	// Clusters older than 1.26 don't have the feature gates metric
+	metrics = "apiserver_request_total 12\n"
+	info = gatherClusterInfo(context.Background(), client, nodes, "")
+	if info.FeatureGates != nil || info.FeatureGatesError == "" {
+		t.Errorf("expected the missing feature gates to be noted, got %v", info.FeatureGates)
+	}
+}
+
+func TestRun_clusterInfo(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sonobuoy_cluster_test")
+	if err != nil {
+		t.Fatalf("Could not create temp directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	srv := NewInProcessServer()
+	p := &fakePlugin{name: "e2e", run: func(string) error {
+		go srv.Submit("", "e2e", "application/json", strings.NewReader("{}"))
+		return nil
+	}}
+	client := &fakeClient{nodes: []v1.Node{testNode("node1", "linux", "amd64", "Ubuntu 18.04", "v1.14.0")}}
+	if _, err := Run(context.Background(), client, []plugin.Interface{p}, plugin.AggregationConfig{TimeoutSeconds: 600}, "heptio-sonobuoy-test", dir, RunOptions{InProcess: srv}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	blob, err := ioutil.ReadFile(path.Join(dir, metaDir, ClusterInfoFile))
+	if err != nil {
+		t.Fatalf("expected the cluster info to be written: %v", err)
+	}
+	var info ClusterInfo
+	if err := json.Unmarshal(blob, &info); err != nil {
+		t.Fatalf("couldn't unmarshal cluster info: %v", err)
+	}
+	if info.ServerVersion == nil || info.ServerVersion.GitVersion != "v1.14.0" || info.Nodes != 1 {
+		t.Errorf("expected the fake cluster to be described, got %s", blob)
+	}
+	if info.FeatureGatesError == "" {
+		t.Error("expected the feature gates error to be recorded since the fake client has no metrics")
+	}
+}
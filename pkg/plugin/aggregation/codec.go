@@ -0,0 +1,162 @@
+/*
+Copyright 2018 Heptio Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package aggregation
+
+import (
+	"compress/gzip"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/heptio/sonobuoy/pkg/plugin"
+)
+
+// AcceptEncodingHeader carries the codecs of a negotiation. Workers list the
+// codecs they can compress results with, in an OPTIONS request to a result
+// path, and the aggregator responds with the one they should use. It is also
+// sent with the 415 for an upload compressed with a codec the aggregator
+// doesn't support, listing those it does, as described in RFC 7694.
+const AcceptEncodingHeader = "Accept-Encoding"
+
+// DefaultUploadCodecs are the codecs offered to workers, in order of
+// preference, if the handler isn't given any. They are every codec results
+// can be uploaded with.
+var DefaultUploadCodecs = []string{plugin.UploadCodecGzip, plugin.UploadCodecIdentity}
+
+// codecDecoders decode the body of results uploaded with each codec.
+var codecDecoders = map[string]func(io.Reader) (io.ReadCloser, error){
+	plugin.UploadCodecIdentity: func(r io.Reader) (io.ReadCloser, error) { return ioutil.NopCloser(r), nil },
+	plugin.UploadCodecGzip:     func(r io.Reader) (io.ReadCloser, error) { return gzip.NewReader(r) },
+}
+
+// coding is a codec listed in an Accept-Encoding header, with its weight.
+type coding struct {
+	name string
+	q    float64
+}
+
+// parseCodings parses the value of an Accept-Encoding header, in the order
+// it lists the codecs. Codecs with an invalid weight are left out.
+func parseCodings(header string) []coding {
+	var codings []coding
+	for _, part := range strings.Split(header, ",") {
+		params := strings.Split(part, ";")
+		name := strings.ToLower(strings.TrimSpace(params[0]))
+		if name == "" {
+			continue
+		}
+		c := coding{name: name, q: 1}
+		valid := true
+		for _, param := range params[1:] {
+			kv := strings.SplitN(strings.TrimSpace(param), "=", 2)
+			if len(kv) != 2 || strings.ToLower(strings.TrimSpace(kv[0])) != "q" {
+				continue
+			}
+			q, err := strconv.ParseFloat(strings.TrimSpace(kv[1]), 64)
+			if err != nil || q < 0 || q > 1 {
+				valid = false
+				break
+			}
+			c.q = q
+		}
+		if valid {
+			codings = append(codings, c)
+		}
+	}
+	return codings
+}
+
+// chooseCodec picks the codec for a worker offering the given codings from
+// those the aggregator offers, in its order of preference. The worker's
+// weights come first, with ties going to the aggregator's preference.
+// Uncompressed uploads are always acceptable, so identity is chosen if there
+// is nothing better, unless the worker refuses it, in which case there is
+// no codec to choose and an empty string is returned.
+func chooseCodec(offered []coding, codecs []string) string {
+	weight := func(name string) (float64, bool) {
+		wildcard, hasWildcard := 0.0, false
+		for _, c := range offered {
+			switch c.name {
+			case name:
+				return c.q, true
+			case "*":
+				wildcard, hasWildcard = c.q, true
+			}
+		}
+		return wildcard, hasWildcard
+	}
+
+	best, bestQ := "", 0.0
+	for _, codec := range codecs {
+		if q, ok := weight(codec); ok && q > bestQ {
+			best, bestQ = codec, q
+		}
+	}
+	if best != "" {
+		return best
+	}
+	if q, ok := weight(plugin.UploadCodecIdentity); ok && q == 0 {
+		return ""
+	}
+	return plugin.UploadCodecIdentity
+}
+
+// codecs returns the codecs the handler offers, in order of preference,
+// leaving out any it doesn't support.
+func (h *Handler) codecs() []string {
+	if len(h.Codecs) == 0 {
+		return DefaultUploadCodecs
+	}
+	var codecs []string
+	for _, codec := range h.Codecs {
+		if _, ok := codecDecoders[codec]; ok {
+			codecs = append(codecs, codec)
+		}
+	}
+	return codecs
+}
+
+// negotiateHandler responds to a worker's OPTIONS request with the codec it
+// should compress results with, out of those it listed.
+func (h *Handler) negotiateHandler(w http.ResponseWriter, r *http.Request) {
+	codec := chooseCodec(parseCodings(r.Header.Get(AcceptEncodingHeader)), h.codecs())
+	if codec == "" {
+		w.Header().Set(AcceptEncodingHeader, strings.Join(h.codecs(), ", "))
+		http.Error(w, "none of the offered codecs are supported", http.StatusNotAcceptable)
+		return
+	}
+	w.Header().Set(AcceptEncodingHeader, codec)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// decodeBody returns the body of a result uploaded with the given content
+// coding, decompressed, along with the codec it was uploaded with. The
+// returned codec is empty if it isn't supported.
+func decodeBody(body io.Reader, encoding string) (io.ReadCloser, string, error) {
+	codec := strings.ToLower(strings.TrimSpace(encoding))
+	if codec == "" {
+		codec = plugin.UploadCodecIdentity
+	}
+	decode, ok := codecDecoders[codec]
+	if !ok {
+		return nil, "", nil
+	}
+	decoded, err := decode(body)
+	return decoded, codec, err
+}
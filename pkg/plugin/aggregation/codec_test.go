@@ -0,0 +1,87 @@
+/*
+Copyright 2018 Heptio Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package aggregation
+
+import (
+	"net/http"
+	"reflect"
+	"testing"
+
+	"github.com/heptio/sonobuoy/pkg/backplane/ca/authtest"
+	"github.com/heptio/sonobuoy/pkg/plugin"
+)
+
+func TestParseCodings(t *testing.T) {
+	got := parseCodings("zstd, GZIP;q=0.8, identity ; q=0.5, br;q=2, deflate;level=9,")
+	want := []coding{{"zstd", 1}, {"gzip", 0.8}, {"identity", 0.5}, {"deflate", 1}}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("expected codings %v, got %v", want, got)
+	}
+}
+
+func TestChooseCodec(t *testing.T) {
+	testCases := []struct {
+		desc    string
+		offered string
+		codecs  []string
+		want    string
+	}{
+		{desc: "worker's preference", offered: "gzip, identity;q=0.9", codecs: DefaultUploadCodecs, want: "gzip"},
+		{desc: "worker prefers identity", offered: "identity, gzip;q=0.9", codecs: DefaultUploadCodecs, want: "identity"},
+		{desc: "ties go to the aggregator", offered: "identity, gzip", codecs: DefaultUploadCodecs, want: "gzip"},
+		{desc: "codec the aggregator doesn't support", offered: "zstd, gzip;q=0.9, identity;q=0.8", codecs: DefaultUploadCodecs, want: "gzip"},
+		{desc: "compression not offered by the aggregator", offered: "gzip, identity;q=0.9", codecs: []string{"identity"}, want: "identity"},
+		{desc: "identity is always acceptable", offered: "zstd", codecs: DefaultUploadCodecs, want: "identity"},
+		{desc: "wildcard", offered: "*", codecs: DefaultUploadCodecs, want: "gzip"},
+		{desc: "nothing offered", offered: "", codecs: DefaultUploadCodecs, want: "identity"},
+		{desc: "identity refused", offered: "zstd, identity;q=0", codecs: DefaultUploadCodecs, want: ""},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.desc, func(t *testing.T) {
+			if got := chooseCodec(parseCodings(tc.offered), tc.codecs); got != tc.want {
+				t.Errorf("expected %q to be chosen, got %q", tc.want, got)
+			}
+		})
+	}
+}
+
+func TestHandler_negotiate(t *testing.T) {
+	h := NewHandler(func(*plugin.Result, http.ResponseWriter) {})
+	h.Codecs = []string{plugin.UploadCodecIdentity, "zstd"}
+	srv := authtest.NewTLSServer(h, t)
+	defer srv.Close()
+
+	URL, err := NodeResultURL(srv.URL, "testnode", "systemd_logs")
+	if err != nil {
+		t.Fatalf("error getting node result URL %v", err)
+	}
+	negotiate := func(offer string) *http.Response {
+		headers := http.Header{}
+		headers.Set(AcceptEncodingHeader, offer)
+		return doRequestWithHeaders(t, srv.Client(), "OPTIONS", URL, nil, headers)
+	}
+
+	// Only the codecs the handler supports are offered
+	resp := negotiate("zstd, gzip;q=0.9, identity;q=0.8")
+	if resp.StatusCode != http.StatusNoContent || resp.Header.Get(AcceptEncodingHeader) != "identity" {
+		t.Errorf("expected identity to be chosen, got a %v with %q", resp.StatusCode, resp.Header.Get(AcceptEncodingHeader))
+	}
+	resp = negotiate("gzip, identity;q=0")
+	if resp.StatusCode != http.StatusNotAcceptable || resp.Header.Get(AcceptEncodingHeader) != "identity" {
+		t.Errorf("expected a 406 listing the codecs offered, got a %v with %q", resp.StatusCode, resp.Header.Get(AcceptEncodingHeader))
+	}
+}
@@ -0,0 +1,149 @@
+/*
+Copyright 2018 Heptio Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package aggregation
+
+import (
+	"net"
+	"sync"
+	"sync/atomic"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+// errListenerClosed is returned by Accept once the listener is closed. Like
+// the error a closed net.Listener returns, it isn't temporary, so servers
+// stop accepting connections.
+var errListenerClosed = errors.New("use of closed network connection")
+
+// connLimitListener counts the connections accepted by the listener it
+// wraps which are still open and, if it has a limit, accepts no more than
+// that many at once. Once the limit is reached, Accept waits for a
+// connection to close, so that further connections queue in the listen
+// backlog rather than failing or using up file descriptors.
+type connLimitListener struct {
+	net.Listener
+	// slots holds a value for each open connection, up to the limit. It's
+	// nil if there's no limit.
+	slots chan struct{}
+	log   logrus.FieldLogger
+
+	// open is the number of open connections
+	open int64
+	// limitReached counts the times the limit was reached
+	limitReached int64
+	// atLimit is 1 while connections are queued waiting for the limit, so
+	// it's only logged once each time it's reached
+	atLimit int32
+
+	closeOnce sync.Once
+	closed    chan struct{}
+}
+
+// newConnLimitListener wraps the listener to count its connections and
+// limit them to max at once, or not at all if max isn't positive.
+func newConnLimitListener(listener net.Listener, max int, log logrus.FieldLogger) *connLimitListener {
+	l := &connLimitListener{
+		Listener: listener,
+		log:      log,
+		closed:   make(chan struct{}),
+	}
+	if max > 0 {
+		l.slots = make(chan struct{}, max)
+	}
+	return l
+}
+
+// Accept waits for a free slot, if there's a limit, and then for the next
+// connection.
+func (l *connLimitListener) Accept() (net.Conn, error) {
+	if !l.acquire() {
+		return nil, &net.OpError{Op: "accept", Net: l.Addr().Network(), Addr: l.Addr(), Err: errListenerClosed}
+	}
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		l.release()
+		return nil, err
+	}
+	atomic.AddInt64(&l.open, 1)
+	return &limitedConn{Conn: conn, listener: l}, nil
+}
+
+// acquire takes a slot for a connection, waiting for one to be released if
+// they're all taken. It returns false if the listener is closed first.
+func (l *connLimitListener) acquire() bool {
+	if l.slots == nil {
+		return true
+	}
+	select {
+	case l.slots <- struct{}{}:
+		atomic.StoreInt32(&l.atLimit, 0)
+		return true
+	default:
+	}
+
+	atomic.AddInt64(&l.limitReached, 1)
+	if atomic.CompareAndSwapInt32(&l.atLimit, 0, 1) {
+		l.log.WithField("max_connections", cap(l.slots)).Warn("The aggregation server reached its connection limit, new connections will wait for open ones to close")
+	}
+	select {
+	case l.slots <- struct{}{}:
+		return true
+	case <-l.closed:
+		return false
+	}
+}
+
+// release frees the slot of a connection.
+func (l *connLimitListener) release() {
+	if l.slots != nil {
+		<-l.slots
+	}
+}
+
+// Close closes the listener, including for calls to Accept waiting for a
+// slot.
+func (l *connLimitListener) Close() error {
+	l.closeOnce.Do(func() { close(l.closed) })
+	return l.Listener.Close()
+}
+
+// connections returns the number of open connections.
+func (l *connLimitListener) connections() int64 {
+	return atomic.LoadInt64(&l.open)
+}
+
+// timesLimitReached returns how many connections had to wait for the limit.
+func (l *connLimitListener) timesLimitReached() int64 {
+	return atomic.LoadInt64(&l.limitReached)
+}
+
+// limitedConn releases its slot in the listener once it's closed.
+type limitedConn struct {
+	net.Conn
+	listener  *connLimitListener
+	closeOnce sync.Once
+}
+
+func (c *limitedConn) Close() error {
+	err := c.Conn.Close()
+	c.closeOnce.Do(func() {
+		atomic.AddInt64(&c.listener.open, -1)
+		c.listener.release()
+	})
+	return err
+}
@@ -0,0 +1,136 @@
+/*
+Copyright 2018 Heptio Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package aggregation
+
+import (
+	"bytes"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	logtest "github.com/sirupsen/logrus/hooks/test"
+)
+
+func TestConnLimitListener(t *testing.T) {
+	inner, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("couldn't listen: %v", err)
+	}
+	log, hook := logtest.NewNullLogger()
+	l := newConnLimitListener(inner, 2, log)
+	defer l.Close()
+
+	accepted := make(chan net.Conn, 3)
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				close(accepted)
+				return
+			}
+			accepted <- conn
+		}
+	}()
+
+	// The third connection queues rather than failing.
+	var clients []net.Conn
+	for i := 0; i < 3; i++ {
+		conn, err := net.Dial("tcp", inner.Addr().String())
+		if err != nil {
+			t.Fatalf("couldn't dial connection %v: %v", i, err)
+		}
+		defer conn.Close()
+		clients = append(clients, conn)
+	}
+	first := <-accepted
+	<-accepted
+	select {
+	case <-accepted:
+		t.Fatal("expected the third connection to wait for the limit")
+	case <-time.After(100 * time.Millisecond):
+	}
+	if n := l.connections(); n != 2 {
+		t.Errorf("expected 2 open connections, got %v", n)
+	}
+	if n := l.timesLimitReached(); n != 1 {
+		t.Errorf("expected the limit to be reached once, got %v", n)
+	}
+	if entries := hook.AllEntries(); len(entries) != 1 || entries[0].Level != logrus.WarnLevel {
+		t.Errorf("expected a warning that the limit was reached, got %v", entries)
+	}
+
+	first.Close()
+	first.Close()
+	select {
+	case <-accepted:
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected the third connection to be accepted once the first closed")
+	}
+	if n := l.connections(); n != 2 {
+		t.Errorf("expected 2 open connections after one was replaced, got %v", n)
+	}
+
+	// Closing the listener stops Accept waiting for the limit.
+	l.Close()
+	select {
+	case _, ok := <-accepted:
+		if ok {
+			t.Error("expected no more connections to be accepted")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected Accept to return once the listener was closed")
+	}
+}
+
+func TestAggregator_connectionMetrics(t *testing.T) {
+	inner, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("couldn't listen: %v", err)
+	}
+	aggr := NewAggregator("", nil)
+	aggr.connections = newConnLimitListener(inner, 0, logrus.New())
+	defer aggr.connections.Close()
+
+	go func() {
+		if conn, err := aggr.connections.Accept(); err == nil {
+			defer conn.Close()
+			conn.Read(make([]byte, 1))
+		}
+	}()
+	conn, err := net.Dial("tcp", inner.Addr().String())
+	if err != nil {
+		t.Fatalf("couldn't dial: %v", err)
+	}
+	defer conn.Close()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for aggr.connections.connections() != 1 {
+		if time.Now().After(deadline) {
+			t.Fatal("expected the connection to be counted")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	var buf bytes.Buffer
+	aggr.writeMetrics(&buf, time.Second)
+	for _, line := range []string{"sonobuoy_server_connections 1", "sonobuoy_server_connections_queued_total 0"} {
+		if !strings.Contains(buf.String(), line+"\n") {
+			t.Errorf("expected metrics to contain %q, got:\n%v", line, buf.String())
+		}
+	}
+}
@@ -0,0 +1,188 @@
+/*
+Copyright 2018 Heptio Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package aggregation
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/heptio/sonobuoy/pkg/plugin"
+	"github.com/heptio/sonobuoy/pkg/plugin/driver/utils"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+// dependsOn returns the names of the plugins the given plugin depends on.
+func dependsOn(p plugin.Interface) []string {
+	if dep, ok := p.(plugin.Dependent); ok {
+		return dep.GetDependsOn()
+	}
+	return nil
+}
+
+// dependenciesMet returns true if every plugin the given plugin depends on
+// has already completed successfully. completed maps the names of plugins
+// which have completed to their first error, which is empty if they
+// succeeded.
+func dependenciesMet(p plugin.Interface, completed map[string]string) bool {
+	for _, dep := range dependsOn(p) {
+		if failure, done := completed[dep]; !done || failure != "" {
+			return false
+		}
+	}
+	return true
+}
+
+// checkDependencies makes sure every dependency refers to a plugin in the
+// run and that there are no dependency cycles.
+func checkDependencies(plugins []plugin.Interface) error {
+	byName := make(map[string]plugin.Interface, len(plugins))
+	for _, p := range plugins {
+		byName[p.GetName()] = p
+	}
+
+	for _, p := range plugins {
+		for _, dep := range dependsOn(p) {
+			if _, ok := byName[dep]; !ok {
+				return errors.Errorf("plugin %v depends on plugin %v, which isn't being run", p.GetName(), dep)
+			}
+		}
+	}
+
+	// Depth-first search, tracking the current path to report any cycle.
+	const (
+		unvisited = iota
+		visiting
+		visited
+	)
+	state := make(map[string]int, len(plugins))
+	var visit func(name string, path []string) error
+	visit = func(name string, path []string) error {
+		switch state[name] {
+		case visited:
+			return nil
+		case visiting:
+			return errors.Errorf("plugin dependency cycle: %v", strings.Join(append(path, name), " -> "))
+		}
+
+		state[name] = visiting
+		for _, dep := range dependsOn(byName[name]) {
+			if err := visit(dep, append(path, name)); err != nil {
+				return err
+			}
+		}
+		state[name] = visited
+		return nil
+	}
+
+	for _, p := range plugins {
+		if err := visit(p.GetName(), nil); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// pluginDoneHook returns a result hook sending the result type of each of
+// the given plugins on the returned channel the first time all of its results
+// are recorded. Hooks are called with the results lock held, so the hook
+// never blocks: each result type is sent at most once, even if a result is
+// replaced afterwards, and the channel has room for all of them whether or
+// not anything is receiving.
+func pluginDoneHook(plugins []plugin.Interface) (resultHook, <-chan string) {
+	doneCh := make(chan string, len(plugins))
+	pending := make(map[string]bool, len(plugins))
+	for _, p := range plugins {
+		pending[p.GetResultType()] = true
+	}
+	return func(result *plugin.Result, pluginDone bool) {
+		if !pluginDone || !pending[result.ResultType] {
+			return
+		}
+		delete(pending, result.ResultType)
+		select {
+		case doneCh <- result.ResultType:
+		default:
+		}
+	}, doneCh
+}
+
+// runDependents launches each of the waiting plugins once all the plugins it
+// depends on have completed successfully. If a dependency fails, the waiting
+// plugin is never run and an error is submitted for each of its results
+// instead. doneCh receives the result type of each plugin as it completes.
+// completed maps the names of plugins which completed before, such as in a
+// previous run, to their first error, which is empty if they succeeded.
+func runDependents(ctx context.Context, all, waiting []plugin.Interface, completed map[string]string, aggr *Aggregator, doneCh <-chan string, launch func(plugin.Interface), resultsCh chan<- *plugin.Result) {
+	// failures maps completed plugin names to an error, which is empty if
+	// the plugin succeeded.
+	failures := map[string]string{}
+	for name, failure := range completed {
+		failures[name] = failure
+	}
+
+	for {
+		var stillWaiting []plugin.Interface
+		for _, p := range waiting {
+			ready := true
+			failedDep := ""
+			for _, dep := range dependsOn(p) {
+				failure, done := failures[dep]
+				switch {
+				case !done:
+					ready = false
+				case failure != "":
+					failedDep = dep
+				}
+			}
+
+			switch {
+			case failedDep != "":
+				aggr.logger().WithFields(logrus.Fields{
+					"plugin":     p.GetName(),
+					"dependency": failedDep,
+				}).Info("Not running plugin, dependency failed")
+				aggr.skipPlugin(newSkippedPlugin(p, SkippedDependencyFailed, fmt.Sprintf("dependency %v failed: %v", failedDep, failures[failedDep])))
+				for _, expected := range aggr.pendingResults(p.GetResultType()) {
+					resultsCh <- utils.MakeErrorResult(expected.ResultType, map[string]interface{}{
+						"error": fmt.Sprintf("dependency %v of plugin %v failed: %v", failedDep, p.GetName(), failures[failedDep]),
+					}, expected.NodeName)
+				}
+			case ready:
+				launch(p)
+			default:
+				stillWaiting = append(stillWaiting, p)
+			}
+		}
+		waiting = stillWaiting
+		if len(waiting) == 0 {
+			return
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case resultType := <-doneCh:
+			for _, p := range all {
+				if p.GetResultType() == resultType {
+					failures[p.GetName()] = aggr.firstError(resultType)
+				}
+			}
+		}
+	}
+}
@@ -0,0 +1,173 @@
+/*
+Copyright 2018 Heptio Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package aggregation
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/heptio/sonobuoy/pkg/plugin"
+	pluginutils "github.com/heptio/sonobuoy/pkg/plugin/driver/utils"
+)
+
+func TestCheckDependencies(t *testing.T) {
+	testCases := []struct {
+		desc      string
+		plugins   []plugin.Interface
+		expectErr bool
+	}{
+		{
+			desc: "No dependencies",
+			plugins: []plugin.Interface{
+				&fakePlugin{name: "a"},
+				&fakePlugin{name: "b"},
+			},
+		}, {
+			desc: "Chain of dependencies",
+			plugins: []plugin.Interface{
+				&fakePlugin{name: "a", dependsOn: []string{"b"}},
+				&fakePlugin{name: "b", dependsOn: []string{"c"}},
+				&fakePlugin{name: "c"},
+			},
+		}, {
+			desc: "Unknown dependency",
+			plugins: []plugin.Interface{
+				&fakePlugin{name: "a", dependsOn: []string{"missing"}},
+			},
+			expectErr: true,
+		}, {
+			desc: "Dependency cycle",
+			plugins: []plugin.Interface{
+				&fakePlugin{name: "a", dependsOn: []string{"b"}},
+				&fakePlugin{name: "b", dependsOn: []string{"c"}},
+				&fakePlugin{name: "c", dependsOn: []string{"a"}},
+			},
+			expectErr: true,
+		}, {
+			desc: "Self dependency",
+			plugins: []plugin.Interface{
+				&fakePlugin{name: "a", dependsOn: []string{"a"}},
+			},
+			expectErr: true,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.desc, func(t *testing.T) {
+			err := checkDependencies(tc.plugins)
+			if tc.expectErr != (err != nil) {
+				t.Errorf("expected error %v, got %v", tc.expectErr, err)
+			}
+		})
+	}
+}
+
+func TestRunDependents(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sonobuoy_dependencies_test")
+	if err != nil {
+		t.Fatalf("Could not create temp directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	setup := &fakePlugin{name: "setup"}
+	broken := &fakePlugin{name: "broken"}
+	conformance := &fakePlugin{name: "conformance", dependsOn: []string{"setup"}}
+	skipped := &fakePlugin{name: "skipped", dependsOn: []string{"broken"}}
+	all := []plugin.Interface{setup, broken, conformance, skipped}
+
+	var expected []plugin.ExpectedResult
+	for _, p := range all {
+		expected = append(expected, p.ExpectedResults(nil)...)
+	}
+	aggr := NewAggregator(dir, expected)
+
+	doneHook, doneCh := pluginDoneHook(all)
+	aggr.addResultHook(doneHook)
+
+	resultsCh := make(chan *plugin.Result, len(expected))
+	go aggr.IngestResults(resultsCh)
+
+	launched := make(chan string, len(all))
+	launch := func(p plugin.Interface) { launched <- p.GetName() }
+
+	finished := make(chan bool)
+	go func() {
+		runDependents(context.Background(), all, []plugin.Interface{conformance, skipped}, nil, aggr, doneCh, launch, resultsCh)
+		close(finished)
+	}()
+
+	resultsCh <- pluginutils.MakeErrorResult("broken", map[string]interface{}{"error": "foo"}, "")
+	resultsCh <- &plugin.Result{ResultType: "setup", MimeType: "application/json", Body: bytes.NewReader(nil)}
+
+	if name := <-launched; name != "conformance" {
+		t.Fatalf("expected conformance to be launched, got %v", name)
+	}
+	<-finished
+
+	if len(launched) != 0 {
+		t.Errorf("expected only one plugin to be launched, got %v more", len(launched))
+	}
+
+	// The error for the skipped plugin is ingested asynchronously
+	deadline := time.Now().Add(5 * time.Second)
+	for aggr.firstError("skipped") == "" {
+		if time.Now().After(deadline) {
+			t.Fatal("expected an error result for the skipped plugin")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	summary := aggr.summarize()
+	if len(summary.Skipped) != 1 || summary.Skipped[0].Plugin != "skipped" || summary.Skipped[0].Reason != SkippedDependencyFailed {
+		t.Errorf("expected the plugin whose dependency failed to be recorded as skipped, got %+v", summary.Skipped)
+	}
+}
+
+func TestPluginDoneHook_stalledConsumer(t *testing.T) {
+	all := []plugin.Interface{&fakePlugin{name: "setup"}, &fakePlugin{name: "e2e"}}
+	hook, doneCh := pluginDoneHook(all)
+
+	// Nothing receives until every signal has been sent, as when
+	// runDependents has returned or is slow. Replaced results and other
+	// result types signal the plugin as done again.
+	sent := make(chan bool)
+	go func() {
+		for i := 0; i < 10; i++ {
+			for _, resultType := range []string{"setup", "e2e", "unknown"} {
+				hook(&plugin.Result{ResultType: resultType}, true)
+			}
+		}
+		close(sent)
+	}()
+	select {
+	case <-sent:
+	case <-time.After(5 * time.Second):
+		t.Fatal("result hook blocked with nothing receiving")
+	}
+
+	var got []string
+	for len(doneCh) > 0 {
+		got = append(got, <-doneCh)
+	}
+	if !reflect.DeepEqual(got, []string{"setup", "e2e"}) {
+		t.Errorf("expected each plugin to be signalled once, got %v", got)
+	}
+}
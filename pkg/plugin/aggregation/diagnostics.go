@@ -0,0 +1,375 @@
+/*
+Copyright 2018 Heptio Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package aggregation
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"os"
+	"path"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/heptio/sonobuoy/pkg/plugin"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+)
+
+const (
+	// diagnosticsDir is the directory of the results diagnostics are
+	// written to, in a subdirectory for each plugin.
+	diagnosticsDir = "diagnostics"
+	// defaultDiagnosticsLogLines is how many lines of each container's log
+	// are kept if the config doesn't say.
+	defaultDiagnosticsLogLines = 500
+	// defaultDiagnosticsMaxEvents is how many namespace events are kept if
+	// the config doesn't say.
+	defaultDiagnosticsMaxEvents = 100
+	// maxDiagnosticsPods is the most pods of a plugin diagnostics are
+	// collected for, e.g. for a daemonset failing on every node.
+	maxDiagnosticsPods = 10
+	// maxDiagnosticsLogBytes limits each container's log, however long its
+	// lines are.
+	maxDiagnosticsLogBytes = 1 << 20
+	// diagnosticsTimeout is how long diagnostics are waited for before the
+	// plugins are cleaned up anyway.
+	diagnosticsTimeout = time.Minute
+)
+
+// diagnosticsCollector snapshots the pods of plugins whose results fail,
+// along with their logs and the recent events in their namespace, so that
+// the failure can be debugged once the plugins have been cleaned up. Files
+// are passed through the run's transforms, as results are. A nil
+// diagnosticsCollector collects nothing.
+type diagnosticsCollector struct {
+	client    kubernetes.Interface
+	dir       string
+	namespace string
+	// plugins maps result types to their plugin
+	plugins    map[string]plugin.Interface
+	logLines   int64
+	maxEvents  int
+	transforms []ResultTransform
+	log        logrus.FieldLogger
+	// getLogs returns the logs of one of a pod's containers.
+	getLogs func(namespace, pod string, opts *v1.PodLogOptions) ([]byte, error)
+
+	mu sync.Mutex
+	// launched stores the result types of the plugins which were launched,
+	// the only ones which can have anything to collect
+	launched map[string]bool
+	// pods stores the pods collected so far, by plugin name and pod name
+	pods map[string]map[string]bool
+	// events stores the plugins whose namespace events were collected
+	events map[string]bool
+	// running is closed as each collection finishes
+	running []chan struct{}
+}
+
+func newDiagnosticsCollector(client kubernetes.Interface, outdir, namespace string, plugins []plugin.Interface, cfg plugin.AggregationConfig, transforms []ResultTransform, log logrus.FieldLogger) *diagnosticsCollector {
+	byType := make(map[string]plugin.Interface, len(plugins))
+	for _, p := range plugins {
+		byType[p.GetResultType()] = p
+	}
+	d := &diagnosticsCollector{
+		client:     client,
+		dir:        path.Join(outdir, diagnosticsDir),
+		namespace:  namespace,
+		plugins:    byType,
+		logLines:   cfg.DiagnosticsLogLines,
+		maxEvents:  cfg.DiagnosticsMaxEvents,
+		transforms: transforms,
+		log:        log,
+		launched:   map[string]bool{},
+		pods:       map[string]map[string]bool{},
+		events:     map[string]bool{},
+	}
+	if d.logLines <= 0 {
+		d.logLines = defaultDiagnosticsLogLines
+	}
+	if d.maxEvents <= 0 {
+		d.maxEvents = defaultDiagnosticsMaxEvents
+	}
+	d.getLogs = func(namespace, pod string, opts *v1.PodLogOptions) ([]byte, error) {
+		return client.CoreV1().Pods(namespace).GetLogs(pod, opts).DoRaw()
+	}
+	return d
+}
+
+// pluginLaunched records that the plugin with the given result type was
+// launched, so diagnostics are collected if it fails.
+func (d *diagnosticsCollector) pluginLaunched(resultType string) {
+	if d == nil {
+		return
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.launched[resultType] = true
+}
+
+// watch forwards the results from in, starting to collect diagnostics for
+// each which failed before passing it on, so that they're collected before a
+// failure which ends the run leads to the plugins being cleaned up.
+func (d *diagnosticsCollector) watch(in <-chan *plugin.Result) <-chan *plugin.Result {
+	if d == nil {
+		return in
+	}
+	out := make(chan *plugin.Result)
+	go func() {
+		defer close(out)
+		for result := range in {
+			if !result.IsSuccess() {
+				d.collect(result.ResultType, result.NodeName)
+			}
+			out <- result
+		}
+	}()
+	return out
+}
+
+// collect starts collecting diagnostics for the plugin with the given result
+// type from the pods on the given nodes, or from all of its pods if a node is
+// empty or none are given. Pods which were already collected are skipped.
+func (d *diagnosticsCollector) collect(resultType string, nodes ...string) {
+	if d == nil {
+		return
+	}
+	p, ok := d.plugins[resultType]
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if !ok || !d.launched[resultType] {
+		return
+	}
+
+	done := make(chan struct{})
+	d.running = append(d.running, done)
+	go func() {
+		defer close(done)
+		d.collectPlugin(p, nodes)
+	}()
+}
+
+// collectPending starts collecting diagnostics for the pods of the plugin
+// whose results are still pending, e.g. because it timed out.
+func (d *diagnosticsCollector) collectPending(resultType string, pending []plugin.ExpectedResult) {
+	if len(pending) == 0 {
+		return
+	}
+	nodes := make([]string, len(pending))
+	for i, expected := range pending {
+		nodes[i] = expected.NodeName
+	}
+	d.collect(resultType, nodes...)
+}
+
+// wait waits for the diagnostics being collected to be written, giving up
+// after diagnosticsTimeout.
+func (d *diagnosticsCollector) wait() {
+	if d == nil {
+		return
+	}
+	d.mu.Lock()
+	running := d.running
+	d.running = nil
+	d.mu.Unlock()
+
+	timeout := time.After(diagnosticsTimeout)
+	for _, done := range running {
+		select {
+		case <-done:
+		case <-timeout:
+			d.log.WithField("timeout", diagnosticsTimeout.String()).Info("Gave up waiting for diagnostics to be collected")
+			return
+		}
+	}
+}
+
+// collectPlugin writes the diagnostics of the plugin's pods on the nodes,
+// and the events in its namespace the first time it's called for the plugin.
+func (d *diagnosticsCollector) collectPlugin(p plugin.Interface, nodes []string) {
+	namespace := pluginNamespace(p, d.namespace)
+	log := d.log.WithField("plugin", p.GetName())
+
+	var pods []v1.Pod
+	if sessioned, ok := p.(plugin.Sessioned); ok {
+		list, err := d.client.CoreV1().Pods(namespace).List(metav1.ListOptions{
+			LabelSelector: plugin.SessionLabel + "=" + sessioned.GetSessionID(),
+		})
+		if err != nil {
+			log.WithError(err).Info("Couldn't list the plugin's pods to collect diagnostics")
+		} else {
+			pods = list.Items
+		}
+	}
+
+	pods, collectEvents := d.claim(p.GetName(), pods, nodes)
+	for i := range pods {
+		d.writePod(p, &pods[i], log)
+	}
+	if collectEvents {
+		if err := d.writeEvents(p, namespace); err != nil {
+			log.WithError(err).Info("Couldn't collect namespace events for diagnostics")
+		}
+	}
+	log.WithField("pods", len(pods)).Info("Collected diagnostics for failed plugin")
+}
+
+// claim returns the pods on the nodes which haven't been collected yet, up
+// to maxDiagnosticsPods for the plugin, and whether the events in its
+// namespace still need collecting.
+func (d *diagnosticsCollector) claim(name string, pods []v1.Pod, nodes []string) ([]v1.Pod, bool) {
+	onNodes := map[string]bool{}
+	for _, node := range nodes {
+		if node == "" {
+			onNodes = nil
+			break
+		}
+		onNodes[node] = true
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	collected := d.pods[name]
+	if collected == nil {
+		collected = map[string]bool{}
+		d.pods[name] = collected
+	}
+	var claimed []v1.Pod
+	for _, pod := range pods {
+		if len(collected) >= maxDiagnosticsPods {
+			break
+		}
+		if collected[pod.Name] || (len(onNodes) > 0 && !onNodes[pod.Spec.NodeName]) {
+			continue
+		}
+		collected[pod.Name] = true
+		claimed = append(claimed, pod)
+	}
+
+	collectEvents := !d.events[name]
+	d.events[name] = true
+	return claimed, collectEvents
+}
+
+// writePod writes the pod, as it would be described, and the tail of the
+// logs of each of its containers, including those of their previous run if
+// they restarted.
+func (d *diagnosticsCollector) writePod(p plugin.Interface, pod *v1.Pod, log logrus.FieldLogger) {
+	dir := path.Join(d.dir, p.GetName(), pod.Name)
+	log = log.WithField("pod", pod.Name)
+
+	blob, err := json.MarshalIndent(pod, "", "  ")
+	if err == nil {
+		err = d.writeFile(p, path.Join(dir, "pod.json"), blob)
+	}
+	if err != nil {
+		log.WithError(err).Info("Couldn't write pod for diagnostics")
+	}
+
+	restarts := map[string]int32{}
+	for _, status := range append(pod.Status.InitContainerStatuses, pod.Status.ContainerStatuses...) {
+		restarts[status.Name] = status.RestartCount
+	}
+	limitBytes := int64(maxDiagnosticsLogBytes)
+	for _, container := range append(pod.Spec.InitContainers, pod.Spec.Containers...) {
+		previous := []bool{false}
+		if restarts[container.Name] > 0 {
+			previous = append(previous, true)
+		}
+		for _, prev := range previous {
+			name := container.Name + ".log"
+			if prev {
+				name = container.Name + ".previous.log"
+			}
+			logs, err := d.getLogs(pod.Namespace, pod.Name, &v1.PodLogOptions{
+				Container:  container.Name,
+				TailLines:  &d.logLines,
+				LimitBytes: &limitBytes,
+				Previous:   prev,
+			})
+			if err == nil {
+				err = d.writeFile(p, path.Join(dir, name), logs)
+			}
+			if err != nil {
+				log.WithError(err).WithField("container", container.Name).Info("Couldn't collect container logs for diagnostics")
+			}
+		}
+	}
+}
+
+// writeEvents writes the most recent events in the namespace.
+func (d *diagnosticsCollector) writeEvents(p plugin.Interface, namespace string) error {
+	list, err := d.client.CoreV1().Events(namespace).List(metav1.ListOptions{})
+	if err != nil {
+		return errors.Wrapf(err, "couldn't list events in namespace %v", namespace)
+	}
+	events := list.Items
+	sort.SliceStable(events, func(i, j int) bool {
+		return eventTime(&events[j]).Before(eventTime(&events[i]))
+	})
+	if len(events) > d.maxEvents {
+		events = events[:d.maxEvents]
+	}
+
+	blob, err := json.MarshalIndent(events, "", "  ")
+	if err != nil {
+		return errors.Wrap(err, "couldn't marshal events")
+	}
+	return d.writeFile(p, path.Join(d.dir, p.GetName(), "events.json"), blob)
+}
+
+// eventTime returns when the event last happened.
+func eventTime(event *v1.Event) time.Time {
+	switch {
+	case !event.LastTimestamp.IsZero():
+		return event.LastTimestamp.Time
+	case !event.EventTime.IsZero():
+		return event.EventTime.Time
+	}
+	return event.FirstTimestamp.Time
+}
+
+// writeFile writes the data to the file once it's been through the
+// transforms.
+func (d *diagnosticsCollector) writeFile(p plugin.Interface, filename string, data []byte) error {
+	var body io.Reader = bytes.NewReader(data)
+	for _, t := range d.transforms {
+		var err error
+		if body, err = t(p.GetName(), body); err != nil {
+			return transformError(err)
+		}
+	}
+
+	if err := os.MkdirAll(path.Dir(filename), 0755); err != nil {
+		return errors.Wrapf(err, "couldn't create directory for %v", filename)
+	}
+	f, err := os.Create(filename)
+	if err != nil {
+		return errors.Wrapf(err, "couldn't create %v", filename)
+	}
+	if _, err := io.Copy(f, body); err != nil {
+		f.Close()
+		os.Remove(filename)
+		return errors.Wrapf(err, "couldn't write %v", filename)
+	}
+	return errors.Wrapf(f.Close(), "couldn't write %v", filename)
+}
@@ -0,0 +1,191 @@
+/*
+Copyright 2018 Heptio Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package aggregation
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/heptio/sonobuoy/pkg/plugin"
+	"github.com/heptio/sonobuoy/pkg/plugin/driver/utils"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func diagnosticsPod(name, node string, restarts int32) v1.Pod {
+	return v1.Pod{
+		ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: "heptio-sonobuoy"},
+		Spec: v1.PodSpec{
+			NodeName:   node,
+			Containers: []v1.Container{{Name: "plugin"}, {Name: "sonobuoy-worker"}},
+		},
+		Status: v1.PodStatus{
+			ContainerStatuses: []v1.ContainerStatus{{Name: "plugin", RestartCount: restarts}},
+		},
+	}
+}
+
+func event(message string, ago time.Duration) v1.Event {
+	return v1.Event{
+		ObjectMeta:    metav1.ObjectMeta{Name: message},
+		Message:       message,
+		LastTimestamp: metav1.NewTime(time.Now().Add(-ago)),
+	}
+}
+
+func TestDiagnosticsCollector(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sonobuoy_diagnostics_test")
+	if err != nil {
+		t.Fatalf("Could not create temp directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	client := &fakeClient{
+		pods: []v1.Pod{
+			diagnosticsPod("logs-node1", "node1", 2),
+			diagnosticsPod("logs-node2", "node2", 0),
+		},
+		events: []v1.Event{event("old", time.Hour), event("newest", time.Second), event("newer", time.Minute)},
+	}
+	logs := &sessionPlugin{fakePlugin{name: "systemd_logs", nodes: []string{"node1", "node2"}}}
+	e2e := &fakePlugin{name: "e2e"}
+	cfg := plugin.AggregationConfig{DiagnosticsLogLines: 20, DiagnosticsMaxEvents: 2}
+	d := newDiagnosticsCollector(client, dir, "heptio-sonobuoy", []plugin.Interface{logs, e2e}, cfg, []ResultTransform{RedactSecrets}, logrus.New())
+
+	var logRequests []string
+	d.getLogs = func(namespace, pod string, opts *v1.PodLogOptions) ([]byte, error) {
+		if *opts.TailLines != 20 || *opts.LimitBytes != maxDiagnosticsLogBytes {
+			t.Errorf("expected logs to be limited to 20 lines and %v bytes, got %v and %v", maxDiagnosticsLogBytes, *opts.TailLines, *opts.LimitBytes)
+		}
+		logRequests = append(logRequests, fmt.Sprintf("%v/%v previous=%v", pod, opts.Container, opts.Previous))
+		if opts.Container == "sonobuoy-worker" {
+			return nil, errors.New("container not found")
+		}
+		return []byte("token: abc\n"), nil
+	}
+	d.pluginLaunched("systemd_logs")
+
+	in := make(chan *plugin.Result, 3)
+	in <- utils.MakeErrorResult("systemd_logs", map[string]interface{}{"error": "pod crashed"}, "node1")
+	// Another failure on the same node doesn't collect the pod again
+	in <- utils.MakeErrorResult("systemd_logs", map[string]interface{}{"error": "pod crashed again"}, "node1")
+	// e2e was never launched, so there's nothing to collect
+	in <- utils.MakeErrorResult("e2e", map[string]interface{}{"error": "dependency failed"}, "")
+	close(in)
+	forwarded := 0
+	for range d.watch(in) {
+		forwarded++
+	}
+	d.wait()
+	if forwarded != 3 {
+		t.Errorf("expected every result to be passed on, got %v", forwarded)
+	}
+
+	pluginDir := path.Join(dir, diagnosticsDir, "systemd_logs")
+	var pod v1.Pod
+	if blob, err := ioutil.ReadFile(path.Join(pluginDir, "logs-node1", "pod.json")); err != nil || json.Unmarshal(blob, &pod) != nil || pod.Name != "logs-node1" {
+		t.Errorf("expected the failed node's pod to be written, got %+v: %v", pod, err)
+	}
+	for _, name := range []string{"plugin.log", "plugin.previous.log"} {
+		if blob, err := ioutil.ReadFile(path.Join(pluginDir, "logs-node1", name)); err != nil || string(blob) != "token: [REDACTED]\n" {
+			t.Errorf("expected %v to be written through the transforms, got %q: %v", name, blob, err)
+		}
+	}
+	if _, err := os.Stat(path.Join(pluginDir, "logs-node2")); !os.IsNotExist(err) {
+		t.Errorf("expected the pod on the node which didn't fail to be skipped, got %v", err)
+	}
+	if _, err := os.Stat(path.Join(dir, diagnosticsDir, "e2e")); !os.IsNotExist(err) {
+		t.Errorf("expected nothing to be collected for a plugin which wasn't launched, got %v", err)
+	}
+	want := []string{"logs-node1/plugin previous=false", "logs-node1/plugin previous=true", "logs-node1/sonobuoy-worker previous=false"}
+	if strings.Join(logRequests, ",") != strings.Join(want, ",") {
+		t.Errorf("expected log requests %v, got %v", want, logRequests)
+	}
+
+	var events []v1.Event
+	if blob, err := ioutil.ReadFile(path.Join(pluginDir, "events.json")); err != nil || json.Unmarshal(blob, &events) != nil {
+		t.Fatalf("couldn't read events: %v", err)
+	}
+	if len(events) != 2 || events[0].Message != "newest" || events[1].Message != "newer" {
+		t.Errorf("expected the two latest events, newest first, got %+v", events)
+	}
+
+	// A global failure, or a timeout, collects the rest of the pods
+	d.collectPending("systemd_logs", []plugin.ExpectedResult{{ResultType: "systemd_logs", NodeName: "node2"}})
+	d.wait()
+	if _, err := os.Stat(path.Join(pluginDir, "logs-node2", "pod.json")); err != nil {
+		t.Errorf("expected the pending node's pod to be written: %v", err)
+	}
+}
+
+func TestDiagnosticsCollector_maxPods(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sonobuoy_diagnostics_test")
+	if err != nil {
+		t.Fatalf("Could not create temp directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	client := &fakeClient{}
+	for i := 0; i < maxDiagnosticsPods+5; i++ {
+		client.pods = append(client.pods, diagnosticsPod(fmt.Sprintf("pod%d", i), fmt.Sprintf("node%d", i), 0))
+	}
+	p := &sessionPlugin{fakePlugin{name: "systemd_logs"}}
+	d := newDiagnosticsCollector(client, dir, "heptio-sonobuoy", []plugin.Interface{p}, plugin.AggregationConfig{}, nil, logrus.New())
+	d.getLogs = func(string, string, *v1.PodLogOptions) ([]byte, error) { return nil, nil }
+	d.pluginLaunched("systemd_logs")
+
+	d.collect("systemd_logs", "")
+	d.wait()
+	pods, err := ioutil.ReadDir(path.Join(dir, diagnosticsDir, "systemd_logs"))
+	if err != nil {
+		t.Fatalf("couldn't read diagnostics: %v", err)
+	}
+	// The pods' directories and events.json
+	if len(pods) != maxDiagnosticsPods+1 {
+		t.Errorf("expected diagnostics for %v pods, got %v files", maxDiagnosticsPods, len(pods))
+	}
+}
+
+func TestRun_diagnostics(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sonobuoy_run_test")
+	if err != nil {
+		t.Fatalf("Could not create temp directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	client := &fakeClient{events: []v1.Event{event("Failed to pull image", time.Second)}}
+	failing := &fakePlugin{name: "e2e", run: func(string) error {
+		return errors.New("couldn't create pod")
+	}}
+	cfg := plugin.AggregationConfig{CollectDiagnostics: true, PluginRunAttempts: 1}
+	if _, err := Run(context.Background(), client, []plugin.Interface{failing}, cfg, "heptio-sonobuoy-test", dir, RunOptions{InProcess: NewInProcessServer()}); err != nil {
+		t.Fatalf("unexpected error from run: %v", err)
+	}
+	blob, err := ioutil.ReadFile(path.Join(dir, diagnosticsDir, "e2e", "events.json"))
+	if err != nil || !strings.Contains(string(blob), "Failed to pull image") {
+		t.Errorf("expected the namespace's events to be collected when the plugin failed, got %q: %v", blob, err)
+	}
+}
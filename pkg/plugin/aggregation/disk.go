@@ -0,0 +1,90 @@
+/*
+Copyright 2018 Heptio Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package aggregation
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+// diskFullErrorPrefix starts the error of results which couldn't be written
+// because the results directory is full.
+const diskFullErrorPrefix = "the aggregator's results directory is full"
+
+// isDiskFull returns true if the error is from writing to a full disk.
+func isDiskFull(err error) bool {
+	switch err := errors.Cause(err).(type) {
+	case *os.PathError:
+		return err.Err == syscall.ENOSPC
+	case *os.LinkError:
+		return err.Err == syscall.ENOSPC
+	case *os.SyscallError:
+		return err.Err == syscall.ENOSPC
+	case syscall.Errno:
+		return err == syscall.ENOSPC
+	}
+	return false
+}
+
+// diskFullError is the error a result which couldn't be written because the
+// disk is full is rejected with.
+func diskFullError(err error) error {
+	return &rejectedResultError{
+		status: http.StatusInsufficientStorage,
+		msg:    fmt.Sprintf("%v: %v", diskFullErrorPrefix, err),
+	}
+}
+
+// isDiskFullResult returns true if the result was recorded as an error
+// because the results directory is full.
+func isDiskFullResult(errMsg string) bool {
+	return strings.HasPrefix(errMsg, diskFullErrorPrefix)
+}
+
+// checkFreeSpace returns an error if the disk which outdir is on has less
+// than minBytes free. If the free space can't be found out, a warning is
+// logged and the run carries on.
+func checkFreeSpace(outdir string, minBytes int64, log logrus.FieldLogger) error {
+	if minBytes <= 0 {
+		return nil
+	}
+
+	// The results directory may not have been created yet, in which case
+	// it will be on the same disk as the closest directory which has.
+	dir := outdir
+	free, err := freeDiskBytes(dir)
+	for os.IsNotExist(err) && filepath.Dir(dir) != dir {
+		dir = filepath.Dir(dir)
+		free, err = freeDiskBytes(dir)
+	}
+	if err != nil {
+		log.WithError(err).WithField("dir", outdir).Warning("Couldn't check the free space for results")
+		return nil
+	}
+
+	if free < minBytes {
+		return errors.Errorf("the results directory %v has %v bytes free, but at least %v are needed", outdir, free, minBytes)
+	}
+	return nil
+}
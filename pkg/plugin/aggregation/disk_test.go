@@ -0,0 +1,152 @@
+/*
+Copyright 2018 Heptio Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package aggregation
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+
+	"github.com/heptio/sonobuoy/pkg/plugin"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+// fullDiskReader fails like writing a result to a full disk does.
+type fullDiskReader struct{}
+
+func (fullDiskReader) Read(p []byte) (int, error) {
+	return 0, &os.PathError{Op: "write", Path: "/tmp/sonobuoy/plugins/e2e/results", Err: syscall.ENOSPC}
+}
+
+func TestIsDiskFull(t *testing.T) {
+	testCases := []struct {
+		desc     string
+		err      error
+		expected bool
+	}{
+		{desc: "no error"},
+		{desc: "path error", err: &os.PathError{Op: "write", Err: syscall.ENOSPC}, expected: true},
+		{desc: "wrapped", err: errors.Wrap(os.NewSyscallError("write", syscall.ENOSPC), "couldn't write"), expected: true},
+		{desc: "errno", err: syscall.ENOSPC, expected: true},
+		{desc: "other errno", err: &os.PathError{Op: "write", Err: syscall.EACCES}},
+		{desc: "other error", err: errors.New("no space left on device")},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.desc, func(t *testing.T) {
+			if got := isDiskFull(tc.err); got != tc.expected {
+				t.Errorf("expected %v, got %v", tc.expected, got)
+			}
+		})
+	}
+}
+
+func TestHandleHTTPResult_diskFull(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sonobuoy_disk_test")
+	if err != nil {
+		t.Fatalf("Could not create temp directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	aggr := NewAggregator(dir, []plugin.ExpectedResult{{ResultType: "e2e"}})
+	w := httptest.NewRecorder()
+	aggr.HandleHTTPResult(&plugin.Result{ResultType: "e2e", MimeType: "application/json", Body: fullDiskReader{}}, w)
+
+	if w.Code != http.StatusInsufficientStorage {
+		t.Errorf("expected status %v, got %v: %v", http.StatusInsufficientStorage, w.Code, w.Body.String())
+	}
+	result := aggr.Results["e2e"]
+	if result == nil || !isDiskFullResult(result.Error) {
+		t.Fatalf("expected the result to be recorded as lost to a full disk, got %+v", result)
+	}
+	if !aggr.isComplete() {
+		t.Error("expected the failed result to count as received")
+	}
+}
+
+func TestRun_abortOnDiskFull(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sonobuoy_disk_test")
+	if err != nil {
+		t.Fatalf("Could not create temp directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	srv := NewInProcessServer()
+	full := &fakePlugin{name: "systemd_logs", nodes: []string{"node1"}, run: func(string) error {
+		go srv.Submit("node1", "systemd_logs", "application/json", fullDiskReader{})
+		return nil
+	}}
+	// e2e never submits its result, so without aborting the run would wait
+	// for the timeout.
+	waiting := &fakePlugin{name: "e2e"}
+	client := &fakeClient{}
+
+	cfg := plugin.AggregationConfig{AbortOnDiskFull: true, TimeoutSeconds: 600}
+	_, err = Run(context.Background(), client, []plugin.Interface{full, waiting}, cfg, "heptio-sonobuoy-test", dir, RunOptions{InProcess: srv})
+	if err == nil || !strings.Contains(err.Error(), diskFullErrorPrefix) {
+		t.Errorf("expected the run to be aborted by the full disk, got %v", err)
+	}
+	if !waiting.cleanedUp {
+		t.Error("expected the remaining plugin to be cleaned up")
+	}
+
+	annotated := false
+	for _, patch := range client.patches {
+		var p struct {
+			Metadata struct {
+				Annotations map[string]string `json:"annotations"`
+			} `json:"metadata"`
+		}
+		if err := json.Unmarshal(patch, &p); err != nil {
+			t.Fatalf("couldn't decode patch %s: %v", patch, err)
+		}
+		if isDiskFullResult(p.Metadata.Annotations[DiskFullAnnotationName]) {
+			annotated = true
+		}
+	}
+	if !annotated {
+		t.Error("expected the aggregator pod to be annotated with the full disk")
+	}
+}
+
+func TestCheckFreeSpace(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sonobuoy_disk_test")
+	if err != nil {
+		t.Fatalf("Could not create temp directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	outdir := filepath.Join(dir, "not", "created", "yet")
+	log := logrus.StandardLogger()
+
+	if err := checkFreeSpace(outdir, 0, log); err != nil {
+		t.Errorf("expected no check without a minimum, got %v", err)
+	}
+	if err := checkFreeSpace(outdir, 1, log); err != nil {
+		t.Errorf("expected a byte to be free, got %v", err)
+	}
+	if err := checkFreeSpace(outdir, math.MaxInt64, log); err == nil {
+		t.Error("expected an error when too little space is free")
+	}
+}
@@ -0,0 +1,35 @@
+//go:build !windows
+// +build !windows
+
+/*
+Copyright 2018 Heptio Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package aggregation
+
+import (
+	"os"
+	"syscall"
+)
+
+// freeDiskBytes returns how many bytes are available to the aggregator on
+// the disk dir is on.
+func freeDiskBytes(dir string) (int64, error) {
+	var stat syscall.Statfs_t
+	if err := syscall.Statfs(dir, &stat); err != nil {
+		return 0, os.NewSyscallError("statfs", err)
+	}
+	return int64(stat.Bavail) * int64(stat.Bsize), nil
+}
@@ -0,0 +1,24 @@
+/*
+Copyright 2018 Heptio Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package aggregation
+
+import "github.com/pkg/errors"
+
+// freeDiskBytes isn't supported on Windows, where the aggregator isn't run.
+func freeDiskBytes(dir string) (int64, error) {
+	return 0, errors.New("checking free disk space isn't supported on windows")
+}
@@ -0,0 +1,146 @@
+/*
+Copyright 2018 Heptio Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package aggregation
+
+import (
+	"encoding/json"
+	"io"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/heptio/sonobuoy/pkg/plugin"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// PluginStartedEvent is emitted when a plugin has been launched.
+	PluginStartedEvent = "plugin-started"
+	// ResultReceivedEvent is emitted for every result the aggregator records.
+	ResultReceivedEvent = "result-received"
+	// PluginCompletedEvent is emitted once all of a plugin's results are in.
+	PluginCompletedEvent = "plugin-completed"
+	// TimeoutEvent is emitted for each result still missing when the run
+	// times out.
+	TimeoutEvent = "timeout"
+
+	// TimeoutStatus is the status of events for results which timed out.
+	TimeoutStatus = "timeout"
+	// NodeRemovedStatus is the status of events for results which were
+	// dropped because their node was removed from the cluster.
+	NodeRemovedStatus = "node-removed"
+	// NotReportedStatus is the status of events for results which hadn't
+	// arrived when the completion threshold was reached.
+	NotReportedStatus = "not-reported"
+)
+
+// Event is a single entry in the stream of events emitted during a run.
+type Event struct {
+	Time   time.Time `json:"time"`
+	Type   string    `json:"type"`
+	Plugin string    `json:"plugin"`
+	Node   string    `json:"node,omitempty"`
+	Status string    `json:"status,omitempty"`
+}
+
+// flusher is implemented by buffered writers, which are flushed after every
+// event so the stream can be followed while the run is in progress.
+type flusher interface {
+	Flush() error
+}
+
+// eventWriter writes events as newline-delimited JSON. A nil eventWriter
+// discards all events.
+type eventWriter struct {
+	sync.Mutex
+	w   io.Writer
+	enc *json.Encoder
+	log logrus.FieldLogger
+}
+
+func newEventWriter(w io.Writer, log logrus.FieldLogger) *eventWriter {
+	if w == nil {
+		return nil
+	}
+	return &eventWriter{w: w, enc: json.NewEncoder(w), log: log}
+}
+
+// emit writes a single event, logging rather than returning any error since
+// the event stream is informational.
+func (e *eventWriter) emit(eventType, pluginName, node, status string) {
+	if e == nil {
+		return
+	}
+
+	e.Lock()
+	defer e.Unlock()
+
+	err := e.enc.Encode(Event{
+		Time:   time.Now().UTC(),
+		Type:   eventType,
+		Plugin: pluginName,
+		Node:   node,
+		Status: status,
+	})
+	if f, ok := e.w.(flusher); ok && err == nil {
+		err = f.Flush()
+	}
+	if err != nil {
+		e.log.WithError(err).Info("couldn't write aggregation event")
+	}
+}
+
+// resultHook returns a hook which emits events as the aggregator records
+// results.
+func (e *eventWriter) resultHook() resultHook {
+	return func(result *plugin.Result, pluginDone bool) {
+		e.emit(ResultReceivedEvent, result.ResultType, result.NodeName, resultStatus(result))
+		if pluginDone {
+			e.emit(PluginCompletedEvent, result.ResultType, "", "")
+		}
+	}
+}
+
+// errorCategory returns the category of a failed result, which is
+// plugin.ErrorCategoryUnknown if whatever failed it didn't say, or an empty
+// string if it succeeded.
+func errorCategory(result *plugin.Result) string {
+	switch {
+	case result.IsSuccess():
+		return ""
+	case result.ErrorCategory == "":
+		return plugin.ErrorCategoryUnknown
+	default:
+		return result.ErrorCategory
+	}
+}
+
+// resultStatus returns the status of a result as reported in events.
+func resultStatus(result *plugin.Result) string {
+	switch {
+	case strings.HasPrefix(result.Error, timeoutErrorPrefix):
+		return TimeoutStatus
+	case strings.HasPrefix(result.Error, nodeRemovedErrorPrefix):
+		return NodeRemovedStatus
+	case strings.HasPrefix(result.Error, notReportedErrorPrefix):
+		return NotReportedStatus
+	case !result.IsSuccess():
+		return FailedStatus
+	default:
+		return CompleteStatus
+	}
+}
@@ -0,0 +1,88 @@
+/*
+Copyright 2018 Heptio Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package aggregation
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/heptio/sonobuoy/pkg/plugin"
+	pluginutils "github.com/heptio/sonobuoy/pkg/plugin/driver/utils"
+	"github.com/sirupsen/logrus"
+)
+
+func TestEventWriter_results(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sonobuoy_events_test")
+	if err != nil {
+		t.Fatalf("Could not create temp directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	expected := []plugin.ExpectedResult{
+		{NodeName: "node1", ResultType: "systemd_logs"},
+		{NodeName: "node2", ResultType: "systemd_logs"},
+	}
+
+	var buf bytes.Buffer
+	events := newEventWriter(&buf, logrus.StandardLogger())
+	aggr := NewAggregator(dir, expected)
+	aggr.addResultHook(events.resultHook())
+
+	resultsCh := make(chan *plugin.Result, 2)
+	resultsCh <- pluginutils.MakeErrorResult("systemd_logs", map[string]interface{}{"error": "foo"}, "node1")
+	resultsCh <- pluginutils.MakeErrorResult("systemd_logs", map[string]interface{}{"error": timeoutErrorPrefix + " systemd_logs"}, "node2")
+	close(resultsCh)
+	aggr.IngestResults(resultsCh)
+
+	var got []Event
+	scanner := bufio.NewScanner(&buf)
+	for scanner.Scan() {
+		var event Event
+		if err := json.Unmarshal(scanner.Bytes(), &event); err != nil {
+			t.Fatalf("couldn't unmarshal event %q: %v", scanner.Text(), err)
+		}
+		got = append(got, event)
+	}
+
+	want := []Event{
+		{Type: ResultReceivedEvent, Plugin: "systemd_logs", Node: "node1", Status: FailedStatus},
+		{Type: ResultReceivedEvent, Plugin: "systemd_logs", Node: "node2", Status: TimeoutStatus},
+		{Type: PluginCompletedEvent, Plugin: "systemd_logs"},
+	}
+	if len(got) != len(want) {
+		t.Fatalf("expected %v events, got %v: %v", len(want), len(got), got)
+	}
+	for i := range want {
+		if got[i].Time.IsZero() {
+			t.Errorf("expected event %v to have a timestamp", i)
+		}
+		got[i].Time = want[i].Time
+		if got[i] != want[i] {
+			t.Errorf("expected event %v to be %+v, got %+v", i, want[i], got[i])
+		}
+	}
+}
+
+func TestEventWriter_nil(t *testing.T) {
+	// A nil writer should silently discard events
+	events := newEventWriter(nil, nil)
+	events.emit(PluginStartedEvent, "e2e", "", RunningStatus)
+}
@@ -0,0 +1,175 @@
+/*
+Copyright 2018 Heptio Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package aggregation
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/heptio/sonobuoy/pkg/plugin"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// RunStampFile is the name of the file in the meta directory of the
+	// results which identifies the run they're from and when they expire.
+	RunStampFile = "run.json"
+	// RunStampSuffix is the suffix of the stamps written alongside the
+	// artifacts of a run, such as its tarball, once its results directory
+	// is gone.
+	RunStampSuffix = ".run.json"
+)
+
+// RunStamp identifies the run a set of results is from and, if the run was
+// configured with a TTL, when they expire.
+type RunStamp struct {
+	RunID   string    `json:"runid"`
+	Created time.Time `json:"created"`
+	// Expires is unset if the results are kept until they're deleted by
+	// hand.
+	Expires *time.Time `json:"expires,omitempty"`
+	// Artifacts are the files the stamp covers, relative to the directory
+	// it's in. They're only set for stamps written alongside the artifacts.
+	Artifacts []string `json:"artifacts,omitempty"`
+}
+
+// NewRunStamp returns the stamp of a run created at the given time, which
+// expires once the TTL in the config passes, if there is one.
+func NewRunStamp(runID string, created time.Time, cfg plugin.AggregationConfig) RunStamp {
+	stamp := RunStamp{RunID: runID, Created: created.UTC()}
+	if cfg.ResultsTTLSeconds > 0 {
+		expires := stamp.Created.Add(time.Duration(cfg.ResultsTTLSeconds) * time.Second)
+		stamp.Expires = &expires
+	}
+	return stamp
+}
+
+// Expired returns whether the results have expired by the given time.
+func (s RunStamp) Expired(now time.Time) bool {
+	return s.Expires != nil && !now.Before(*s.Expires)
+}
+
+// WriteRunStamp writes the stamp to the given file.
+func WriteRunStamp(file string, stamp RunStamp) error {
+	blob, err := json.Marshal(stamp)
+	if err != nil {
+		return errors.Wrap(err, "couldn't marshal run stamp")
+	}
+	return errors.Wrapf(ioutil.WriteFile(file, blob, 0644), "couldn't write run stamp to %v", file)
+}
+
+// ReadRunStamp reads the stamp in the given file.
+func ReadRunStamp(file string) (RunStamp, error) {
+	var stamp RunStamp
+	blob, err := ioutil.ReadFile(file)
+	if err != nil {
+		return stamp, errors.Wrapf(err, "couldn't read run stamp %v", file)
+	}
+	return stamp, errors.Wrapf(json.Unmarshal(blob, &stamp), "couldn't parse run stamp %v", file)
+}
+
+// writeRunStamp records the stamp in the meta directory of outdir, returning
+// the stamp which is there. A stamp already there for the same run, e.g. one
+// written before the aggregator restarted, is kept so that the results still
+// expire when they first would have.
+func writeRunStamp(outdir string, stamp RunStamp) (RunStamp, error) {
+	metapath := path.Join(outdir, metaDir)
+	if err := os.MkdirAll(metapath, 0755); err != nil {
+		return stamp, errors.Wrapf(err, "couldn't create directory %v", metapath)
+	}
+
+	file := path.Join(metapath, RunStampFile)
+	if existing, err := ReadRunStamp(file); err == nil && existing.RunID == stamp.RunID {
+		return existing, nil
+	}
+	return stamp, WriteRunStamp(file, stamp)
+}
+
+// PurgeExpiredRuns removes the results of each run in dir which have expired
+// by the given time, returning the IDs of the runs which were purged. Run
+// directories are recognised by the stamp in their meta directory, and
+// other artifacts by the stamp written alongside them. The results of the
+// run with the ID given as current are never purged, nor is anything
+// without a stamp, or with one which doesn't expire. A run which can't be
+// purged is logged and skipped.
+func PurgeExpiredRuns(dir, current string, now time.Time, log logrus.FieldLogger) ([]string, error) {
+	entries, err := ioutil.ReadDir(dir)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, errors.Wrapf(err, "couldn't list results directory %v", dir)
+	}
+
+	var purged []string
+	for _, entry := range entries {
+		var stampFile string
+		switch {
+		case entry.IsDir():
+			stampFile = filepath.Join(dir, entry.Name(), metaDir, RunStampFile)
+		case strings.HasSuffix(entry.Name(), RunStampSuffix):
+			stampFile = filepath.Join(dir, entry.Name())
+		default:
+			continue
+		}
+		stamp, err := ReadRunStamp(stampFile)
+		if err != nil {
+			if !os.IsNotExist(errors.Cause(err)) {
+				log.WithError(err).Info("Couldn't read run stamp, leaving the run alone")
+			}
+			continue
+		}
+		if stamp.RunID == current || !stamp.Expired(now) {
+			continue
+		}
+
+		fields := logrus.Fields{"runid": stamp.RunID, "expired": stamp.Expires.Format(time.RFC3339)}
+		if err := purgeRun(dir, entry, stamp); err != nil {
+			log.WithFields(fields).WithError(err).Info("Couldn't purge expired results")
+			continue
+		}
+		log.WithFields(fields).Info("Purged expired results")
+		purged = append(purged, stamp.RunID)
+	}
+	return purged, nil
+}
+
+// purgeRun removes the run directory or the artifacts stamped by entry. The
+// stamp alongside artifacts is removed last, so that the artifacts are
+// purged next time if removing any of them fails.
+func purgeRun(dir string, entry os.FileInfo, stamp RunStamp) error {
+	if entry.IsDir() {
+		return errors.Wrapf(os.RemoveAll(filepath.Join(dir, entry.Name())), "couldn't remove run directory %v", entry.Name())
+	}
+	for _, artifact := range stamp.Artifacts {
+		// Artifacts must be in dir itself, whatever the stamp says.
+		name := filepath.Base(filepath.Clean(artifact))
+		if name != artifact || name == "." || name == ".." || name == entry.Name() {
+			return errors.Errorf("invalid artifact %q", artifact)
+		}
+		if err := os.Remove(filepath.Join(dir, name)); err != nil && !os.IsNotExist(err) {
+			return errors.Wrapf(err, "couldn't remove %v", name)
+		}
+	}
+	return errors.Wrapf(os.Remove(filepath.Join(dir, entry.Name())), "couldn't remove run stamp %v", entry.Name())
+}
@@ -0,0 +1,123 @@
+/*
+Copyright 2018 Heptio Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package aggregation
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/heptio/sonobuoy/pkg/plugin"
+	"github.com/sirupsen/logrus"
+)
+
+func TestNewRunStamp(t *testing.T) {
+	created := time.Date(2018, 6, 1, 12, 0, 0, 0, time.UTC)
+	stamp := NewRunStamp("abc", created, plugin.AggregationConfig{})
+	if stamp.Expires != nil || stamp.Expired(created.Add(24*365*time.Hour)) {
+		t.Errorf("expected results without a TTL to never expire, got %+v", stamp)
+	}
+
+	stamp = NewRunStamp("abc", created, plugin.AggregationConfig{ResultsTTLSeconds: 60})
+	if stamp.Expired(created.Add(59 * time.Second)) {
+		t.Error("expected the results not to have expired before the TTL passed")
+	}
+	if !stamp.Expired(created.Add(time.Minute)) {
+		t.Error("expected the results to have expired once the TTL passed")
+	}
+}
+
+func TestPurgeExpiredRuns(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sonobuoy_expiry_test")
+	if err != nil {
+		t.Fatalf("Could not create temp directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	now := time.Now()
+	expired := plugin.AggregationConfig{ResultsTTLSeconds: 60}
+	stampDir := func(name string, stamp RunStamp) {
+		if _, err := writeRunStamp(path.Join(dir, name), stamp); err != nil {
+			t.Fatal(err)
+		}
+	}
+	touch := func(name string) {
+		if err := ioutil.WriteFile(path.Join(dir, name), []byte("results"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	stampDir("old", NewRunStamp("old", now.Add(-time.Hour), expired))
+	stampDir("fresh", NewRunStamp("fresh", now, expired))
+	stampDir("forever", NewRunStamp("forever", now.Add(-time.Hour), plugin.AggregationConfig{}))
+	stampDir("current", NewRunStamp("current", now.Add(-time.Hour), expired))
+	if err := os.MkdirAll(path.Join(dir, "unstamped", metaDir), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	touch("201806011200_sonobuoy_tarred.tar.gz")
+	tarred := NewRunStamp("tarred", now.Add(-time.Hour), expired)
+	tarred.Artifacts = []string{"201806011200_sonobuoy_tarred.tar.gz"}
+	if err := WriteRunStamp(path.Join(dir, "tarred"+RunStampSuffix), tarred); err != nil {
+		t.Fatal(err)
+	}
+	touch("201806011200_sonobuoy_unstamped.tar.gz")
+	touch("outside")
+	escaping := NewRunStamp("escaping", now.Add(-time.Hour), expired)
+	escaping.Artifacts = []string{"../outside"}
+	if err := WriteRunStamp(path.Join(dir, "escaping"+RunStampSuffix), escaping); err != nil {
+		t.Fatal(err)
+	}
+
+	purged, err := PurgeExpiredRuns(dir, "current", now, logrus.StandardLogger())
+	if err != nil {
+		t.Fatalf("unexpected error purging runs: %v", err)
+	}
+	sort.Strings(purged)
+	if expected := []string{"old", "tarred"}; !reflect.DeepEqual(purged, expected) {
+		t.Errorf("expected runs %v to be purged, got %v", expected, purged)
+	}
+
+	infos, err := ioutil.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var left []string
+	for _, info := range infos {
+		left = append(left, info.Name())
+	}
+	expected := []string{
+		"201806011200_sonobuoy_unstamped.tar.gz",
+		"current",
+		"escaping" + RunStampSuffix,
+		"forever",
+		"fresh",
+		"outside",
+		"unstamped",
+	}
+	if !reflect.DeepEqual(left, expected) {
+		t.Errorf("expected %v to be left, got %v", expected, left)
+	}
+
+	if purged, err := PurgeExpiredRuns(path.Join(dir, "missing"), "", now, logrus.StandardLogger()); err != nil || len(purged) != 0 {
+		t.Errorf("expected nothing to be purged from a missing directory, got %v, %v", purged, err)
+	}
+}
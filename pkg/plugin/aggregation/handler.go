@@ -17,10 +17,22 @@ limitations under the License.
 package aggregation
 
 import (
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime"
 	"net/http"
 	"net/url"
+	"path"
+	"strconv"
+	"strings"
 
 	"github.com/gorilla/mux"
+	"github.com/heptio/sonobuoy/pkg/backplane/ca"
 	"github.com/heptio/sonobuoy/pkg/plugin"
 	"github.com/pkg/errors"
 	"github.com/sirupsen/logrus"
@@ -35,6 +47,64 @@ const (
 	resultsByNode = "/api/v1/results/by-node/{node}/{plugin}"
 	// resultsGlobal is the path for global (non node-specific) results to be PUT
 	resultsGlobal = "/api/v1/results/global/{plugin}"
+	// partialByNode is the path for chunks of node-specific results to be PUT
+	// before the final result
+	partialByNode = resultsByNode + partialSuffix
+	// partialGlobal is the path for chunks of global results to be PUT before
+	// the final result
+	partialGlobal = resultsGlobal + partialSuffix
+	partialSuffix = "/partial/{seq:[0-9]+}"
+	// progressByNode and progressGlobal are the paths plugins may PUT their
+	// progress to while they're running
+	progressByNode = resultsByNode + progressSuffix
+	progressGlobal = resultsGlobal + progressSuffix
+	progressSuffix = "/progress"
+	// heartbeatByNode and heartbeatGlobal are the paths workers PUT
+	// heartbeats to while they wait for their plugin
+	heartbeatByNode = resultsByNode + heartbeatSuffix
+	heartbeatGlobal = resultsGlobal + heartbeatSuffix
+	heartbeatSuffix = "/heartbeat"
+	// streamByNode and streamGlobal are the paths for results which are
+	// streamed as the plugin writes them, with chunked transfer encoding,
+	// instead of being submitted once complete
+	streamByNode = resultsByNode + streamSuffix
+	streamGlobal = resultsGlobal + streamSuffix
+	streamSuffix = "/stream"
+	// artifactByNode and artifactGlobal are the paths for the named files
+	// making up a result to be PUT, one at a time
+	artifactByNode = resultsByNode + artifactSuffix
+	artifactGlobal = resultsGlobal + artifactSuffix
+	artifactSuffix = "/artifacts"
+	// doneByNode and doneGlobal are the paths plugins PUT to once all the
+	// artifacts making up their result have been submitted
+	doneByNode = resultsByNode + doneSuffix
+	doneGlobal = resultsGlobal + doneSuffix
+	doneSuffix = "/done"
+	// maxProgressBytes limits the size of progress reports
+	maxProgressBytes = 64 * 1024
+	// checksumHeader is the header results may be sent with to have their
+	// checksum verified, as described in RFC 3230, e.g.
+	// "Digest: SHA-256=<base64 encoded digest>".
+	checksumHeader = "Digest"
+	// dispositionHeader is the header results may be sent with to name
+	// the file they're written to, e.g.
+	// "Content-Disposition: attachment; filename=junit.xml".
+	dispositionHeader = "Content-Disposition"
+	// dateHeader is the header workers send the time they submitted results
+	// in, by their own clock.
+	dateHeader = "Date"
+	// ReplaceHeader is the header workers retrying an upload send it with,
+	// set to "true", to have it replace what an earlier attempt uploaded to
+	// the same path, rather than be rejected as a duplicate.
+	ReplaceHeader = "Sonobuoy-Replace"
+	// certRenewal is the path clients POST to for a new client certificate
+	certRenewal = "/api/v1/cert"
+	// healthz is the path health checks GET, which doesn't need a client
+	// certificate
+	healthz = "/healthz"
+	// resultsPath is the path every result route is under, after any base
+	// path
+	resultsPath = "/api/v1/results/"
 )
 
 var (
@@ -42,47 +112,404 @@ var (
 	r           = mux.NewRouter()
 	nodeRoute   = r.Path(resultsByNode).BuildOnly()
 	globalRoute = r.Path(resultsGlobal).BuildOnly()
+	certRoute   = r.Path(certRenewal).BuildOnly()
+
+	// Only used to match requests outside of a Handler
+	resultRoutes = newResultRoutes()
 )
 
+func newResultRoutes() *mux.Router {
+	routes := mux.NewRouter()
+	for _, p := range []string{resultsByNode, resultsGlobal, partialByNode, partialGlobal, streamByNode, streamGlobal, artifactByNode, artifactGlobal, doneByNode, doneGlobal} {
+		routes.Path(p)
+	}
+	return routes
+}
+
+// ResultInfo identifies the result a request to the aggregator submits.
+type ResultInfo struct {
+	// Plugin is the result type of the plugin.
+	Plugin string
+	// Node is empty for results which aren't node-specific.
+	Node string
+	// Partial is true for partial results.
+	Partial bool
+	// Streamed is true for results streamed as the plugin writes them.
+	Streamed bool
+	// Artifact is true for artifacts of a result.
+	Artifact bool
+	// Done is true for requests marking a result made of artifacts done.
+	Done bool
+}
+
+// RequestResultInfo returns the result the request submits, or false if it
+// isn't a request to submit results. Unlike mux.Vars, it can be used by
+// middleware wrapping a Handler, before the request is routed, and it
+// recognises results submitted under any base path.
+func RequestResultInfo(req *http.Request) (ResultInfo, bool) {
+	var match mux.RouteMatch
+	if !resultRoutes.Match(req, &match) {
+		i := strings.Index(req.URL.Path, resultsPath)
+		if i <= 0 || !resultRoutes.Match(withPath(req, req.URL.Path[i:]), &match) {
+			return ResultInfo{}, false
+		}
+	}
+	_, partial := match.Vars["seq"]
+	return ResultInfo{
+		Plugin:   match.Vars["plugin"],
+		Node:     match.Vars["node"],
+		Partial:  partial,
+		Streamed: routeHasSuffix(match.Route, streamSuffix),
+		Artifact: routeHasSuffix(match.Route, artifactSuffix),
+		Done:     routeHasSuffix(match.Route, doneSuffix),
+	}, true
+}
+
+// routeHasSuffix returns true if the path of the route ends with the suffix,
+// such as streamSuffix for the routes results are streamed to.
+func routeHasSuffix(route *mux.Route, suffix string) bool {
+	if route == nil {
+		return false
+	}
+	tmpl, err := route.GetPathTemplate()
+	return err == nil && strings.HasSuffix(tmpl, suffix)
+}
+
+// RenewedCert is the response to a certificate renewal request, containing
+// the new PEM encoded client certificate and key.
+type RenewedCert struct {
+	Cert string `json:"cert"`
+	Key  string `json:"key"`
+}
+
+// HealthStatus is the response to health checks of the aggregation server.
+type HealthStatus struct {
+	Status   string `json:"status"`
+	Received int    `json:"received"`
+	Expected int    `json:"expected"`
+}
+
 // Handler is a net/http Handler that can handle API requests for aggregation of
 // results from nodes, calling the provided callback with the results
 type Handler struct {
 	mux.Router
 	// ResultsCallback is the function that is called when a result is checked in.
 	ResultsCallback func(*plugin.Result, http.ResponseWriter)
+	// CertCallback, if set, issues a new client certificate with the given
+	// name when a client asks to renew its certificate.
+	CertCallback func(name string) (*tls.Certificate, error)
+	// HealthCallback, if set, reports the status of the run for health
+	// checks. Otherwise they only report that the server is running.
+	HealthCallback func() HealthStatus
+	// ProgressCallback, if set, is called when a plugin reports its
+	// progress. Otherwise progress reports are rejected with a 404.
+	ProgressCallback func(*ProgressReport, http.ResponseWriter)
+	// HeartbeatCallback, if set, is called when a worker sends a
+	// heartbeat. Otherwise heartbeats are rejected with a 404.
+	HeartbeatCallback func(*HeartbeatReport, http.ResponseWriter)
+	// Codecs are the codecs offered to workers which negotiate how to
+	// compress their results, in order of preference. Uploads with any
+	// supported codec are accepted, whether it's offered or not. Defaults
+	// to DefaultUploadCodecs if unset.
+	Codecs []string
+	// Log is where requests are logged. Defaults to the standard logrus
+	// logger if unset.
+	Log logrus.FieldLogger
+	// BasePath, if set, is the path prefix every route is served under,
+	// including the health check, e.g. "/sonobuoy" for a server behind an
+	// Ingress which keeps the prefix. Requests outside it get a 404.
+	BasePath string
 }
 
 // NewHandler constructs a new aggregation handler which will handler results
 // and pass them to the given results callback.
-func NewHandler(resultsCallback func(*plugin.Result, http.ResponseWriter)) http.Handler {
+func NewHandler(resultsCallback func(*plugin.Result, http.ResponseWriter)) *Handler {
+	return NewHandlerWithCerts(resultsCallback, nil)
+}
+
+// NewHandlerWithCerts constructs a new aggregation handler which also lets
+// clients renew their certificate, issuing new ones with the given callback.
+func NewHandlerWithCerts(resultsCallback func(*plugin.Result, http.ResponseWriter), certCallback func(name string) (*tls.Certificate, error)) *Handler {
 	handler := &Handler{
 		Router:          *mux.NewRouter(),
 		ResultsCallback: resultsCallback,
+		CertCallback:    certCallback,
 	}
 	// We accept PUT because the client is specifying the resource identifier via
 	// the HTTP path. (As opposed to POST, where typically the clients would post
-	// to a base URL and the server picks the final resource path.)
+	// to a base URL and the server picks the final resource path.) A result PUT
+	// again with the ReplaceHeader replaces the one uploaded before, so that
+	// retries are idempotent.
 	handler.HandleFunc(resultsByNode, handler.resultsHandler).Methods("PUT")
 	handler.HandleFunc(resultsGlobal, handler.resultsHandler).Methods("PUT")
+	handler.HandleFunc(partialByNode, handler.resultsHandler).Methods("PUT")
+	handler.HandleFunc(partialGlobal, handler.resultsHandler).Methods("PUT")
+	handler.HandleFunc(streamByNode, handler.resultsHandler).Methods("PUT")
+	handler.HandleFunc(streamGlobal, handler.resultsHandler).Methods("PUT")
+	handler.HandleFunc(artifactByNode, handler.resultsHandler).Methods("PUT")
+	handler.HandleFunc(artifactGlobal, handler.resultsHandler).Methods("PUT")
+	handler.HandleFunc(doneByNode, handler.resultsHandler).Methods("PUT")
+	handler.HandleFunc(doneGlobal, handler.resultsHandler).Methods("PUT")
+	handler.HandleFunc(progressByNode, handler.progressHandler).Methods("PUT")
+	handler.HandleFunc(progressGlobal, handler.progressHandler).Methods("PUT")
+	handler.HandleFunc(heartbeatByNode, handler.heartbeatHandler).Methods("PUT")
+	handler.HandleFunc(heartbeatGlobal, handler.heartbeatHandler).Methods("PUT")
+	// Workers negotiate the codec to compress results with at any of the
+	// paths they submit them to.
+	for _, p := range []string{resultsByNode, resultsGlobal, partialByNode, partialGlobal, streamByNode, streamGlobal, artifactByNode, artifactGlobal, doneByNode, doneGlobal} {
+		handler.HandleFunc(p, handler.negotiateHandler).Methods("OPTIONS")
+	}
+	if certCallback != nil {
+		handler.HandleFunc(certRenewal, handler.certHandler).Methods("POST")
+	}
+	handler.HandleFunc(healthz, handler.healthHandler).Methods("GET")
 	return handler
 }
 
+// ServeHTTP requires requests made over TLS to have a client certificate,
+// other than health checks, so that kubelet probes don't need one.
+func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	r, ok := stripBasePath(r, h.BasePath)
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	if r.TLS != nil && len(r.TLS.PeerCertificates) == 0 && r.URL.Path != healthz {
+		http.Error(w, "a client certificate is required", http.StatusUnauthorized)
+		return
+	}
+	h.Router.ServeHTTP(w, r)
+}
+
+// healthHandler reports that the server is running, along with the status
+// of the run if there is a HealthCallback. Health checks aren't logged since
+// they are made so often.
+func (h *Handler) healthHandler(w http.ResponseWriter, r *http.Request) {
+	status := HealthStatus{Status: RunningStatus}
+	if h.HealthCallback != nil {
+		status = h.HealthCallback()
+	}
+	w.Header().Set("content-type", "application/json")
+	if err := json.NewEncoder(w).Encode(status); err != nil {
+		h.logger().WithError(err).Info("couldn't write health status")
+	}
+}
+
+// certHandler issues a new certificate to a client authenticated by its
+// current certificate, keeping the same name.
+func (h *Handler) certHandler(w http.ResponseWriter, r *http.Request) {
+	if r.TLS == nil || len(r.TLS.PeerCertificates) == 0 {
+		http.Error(w, "a client certificate is required to renew it", http.StatusUnauthorized)
+		return
+	}
+	name := r.TLS.PeerCertificates[0].Subject.CommonName
+	log := h.logger().WithField("client_cert", name)
+
+	cert, err := h.CertCallback(name)
+	if err != nil {
+		log.WithError(err).Info("couldn't renew client certificate")
+		http.Error(w, "couldn't issue certificate", http.StatusInternalServerError)
+		return
+	}
+
+	certPEM, keyPEM, err := ca.EncodePEM(cert)
+	if err != nil {
+		log.WithError(err).Info("couldn't encode client certificate")
+		http.Error(w, "couldn't encode certificate", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("content-type", "application/json")
+	if err := json.NewEncoder(w).Encode(RenewedCert{Cert: string(certPEM), Key: string(keyPEM)}); err != nil {
+		log.WithError(err).Info("couldn't write renewed client certificate")
+		return
+	}
+	log.WithField("expires", cert.Leaf.NotAfter).Info("renewed client certificate")
+}
+
 func (h *Handler) resultsHandler(w http.ResponseWriter, r *http.Request) {
-	logRequest(r)
+	logRequest(h.logger(), r)
 	vars := mux.Vars(r)
+	defer r.Body.Close()
+
+	// Workers may compress results, which are decompressed here so that
+	// they are stored (and size limited) the same as any other result.
+	encoding := r.Header.Get("content-encoding")
+	body, codec, err := decodeBody(r.Body, encoding)
+	if codec == "" {
+		w.Header().Set(AcceptEncodingHeader, strings.Join(DefaultUploadCodecs, ", "))
+		http.Error(w, fmt.Sprintf("unsupported content encoding %q", encoding), http.StatusUnsupportedMediaType)
+		return
+	}
+	if err != nil {
+		http.Error(w, fmt.Sprintf("couldn't decompress result: %v", err), http.StatusBadRequest)
+		return
+	}
+	defer body.Close()
+
+	checksum, err := parseDigest(r.Header.Get(checksumHeader))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	filename, err := parseFilename(r.Header.Get(dispositionHeader))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	annotations, err := ParseAnnotations(r.Header.Get(AnnotationsHeader))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	replace := r.Header.Get(ReplaceHeader) == "true"
 
 	result := &plugin.Result{
-		ResultType: vars["plugin"], // will be empty string in global case
-		NodeName:   vars["node"],
-		Body:       r.Body,
-		MimeType:   r.Header.Get("content-type"),
+		ResultType:  vars["plugin"], // will be empty string in global case
+		NodeName:    vars["node"],
+		Body:        body,
+		MimeType:    r.Header.Get("content-type"),
+		Checksum:    checksum,
+		Filename:    filename,
+		Codec:       codec,
+		Replace:     replace,
+		Annotations: annotations,
+	}
+	// The worker's clock can't be trusted, so the manifest checks the time
+	// before using it. An invalid one is as good as none.
+	if submitted, err := http.ParseTime(r.Header.Get(dateHeader)); err == nil {
+		result.Submitted = submitted.UTC()
+	}
+	result.ClientName = requestClientName(r)
+	route := mux.CurrentRoute(r)
+	result.Streamed = routeHasSuffix(route, streamSuffix)
+	result.Artifact = routeHasSuffix(route, artifactSuffix)
+	result.Done = routeHasSuffix(route, doneSuffix)
+	if result.Artifact && result.Filename == "" {
+		http.Error(w, fmt.Sprintf("artifacts must be named in a %v header", dispositionHeader), http.StatusBadRequest)
+		return
+	}
+	if seq, ok := vars["seq"]; ok {
+		// The route only matches digits, so this can only fail on overflow
+		n, err := strconv.Atoi(seq)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("invalid sequence number %v", seq), http.StatusBadRequest)
+			return
+		}
+		result.Partial = true
+		result.Sequence = n
 	}
 
 	// Trigger our callback with this checkin record (which should write the file
 	// out.) The callback is responsible for doing a 409 conflict if results are
 	// given twice for the same node, etc.
 	h.ResultsCallback(result, w)
-	r.Body.Close()
+}
+
+// progressHandler decodes a plugin's progress report and passes it to the
+// ProgressCallback. Reports aren't logged since plugins may make them often.
+func (h *Handler) progressHandler(w http.ResponseWriter, r *http.Request) {
+	if h.ProgressCallback == nil {
+		http.NotFound(w, r)
+		return
+	}
+	vars := mux.Vars(r)
+	defer r.Body.Close()
+
+	report := &ProgressReport{
+		ResultType: vars["plugin"],
+		NodeName:   vars["node"],
+		ClientName: requestClientName(r),
+	}
+	if err := json.NewDecoder(io.LimitReader(r.Body, maxProgressBytes)).Decode(&report.Progress); err != nil {
+		http.Error(w, fmt.Sprintf("couldn't decode progress: %v", err), http.StatusBadRequest)
+		return
+	}
+	if err := report.Progress.Validate(); err != nil {
+		http.Error(w, fmt.Sprintf("invalid progress: %v", err), http.StatusBadRequest)
+		return
+	}
+	h.ProgressCallback(report, w)
+}
+
+// heartbeatHandler passes a worker's heartbeat to the HeartbeatCallback.
+// Heartbeats have no body, and aren't logged since workers send them often.
+func (h *Handler) heartbeatHandler(w http.ResponseWriter, r *http.Request) {
+	if h.HeartbeatCallback == nil {
+		http.NotFound(w, r)
+		return
+	}
+	vars := mux.Vars(r)
+	defer r.Body.Close()
+
+	h.HeartbeatCallback(&HeartbeatReport{
+		ResultType: vars["plugin"],
+		NodeName:   vars["node"],
+		ClientName: requestClientName(r),
+	}, w)
+}
+
+// requestClientName returns the common name of the verified client
+// certificate the request was made with, or an empty string if there wasn't
+// one.
+func requestClientName(r *http.Request) string {
+	if r.TLS == nil || len(r.TLS.VerifiedChains) == 0 {
+		return ""
+	}
+	return r.TLS.VerifiedChains[0][0].Subject.CommonName
+}
+
+// parseDigest returns the hex encoded SHA-256 checksum from the value of a
+// Digest header, or an empty string if it doesn't have one.
+func parseDigest(header string) (string, error) {
+	for _, digest := range strings.Split(header, ",") {
+		parts := strings.SplitN(strings.TrimSpace(digest), "=", 2)
+		if len(parts) != 2 || !strings.EqualFold(parts[0], "SHA-256") {
+			continue
+		}
+		sum, err := base64.StdEncoding.DecodeString(parts[1])
+		if err != nil || len(sum) != sha256.Size {
+			return "", errors.Errorf("invalid SHA-256 digest %q", parts[1])
+		}
+		return hex.EncodeToString(sum), nil
+	}
+	return "", nil
+}
+
+// parseFilename returns the filename in a Content-Disposition header, or an
+// empty string if there isn't one. It may name subdirectories, separated by
+// slashes, but names which could be written outside the directory of the
+// result are rejected rather than cleaned, so the plugin finds out.
+func parseFilename(header string) (string, error) {
+	if header == "" {
+		return "", nil
+	}
+	_, params, err := mime.ParseMediaType(header)
+	if err != nil {
+		return "", errors.Wrapf(err, "invalid %v header %q", dispositionHeader, header)
+	}
+	name, ok := params["filename"]
+	if !ok {
+		return "", nil
+	}
+
+	switch {
+	case name == "":
+		return "", errors.New("filename is empty")
+	case strings.ContainsAny(name, "\\\x00"):
+		return "", errors.Errorf("filename %q contains a backslash or NUL", name)
+	case path.IsAbs(name):
+		return "", errors.Errorf("filename %q is absolute", name)
+	}
+	for _, part := range strings.Split(name, "/") {
+		if part == ".." {
+			return "", errors.Errorf("filename %q refers to a parent directory", name)
+		}
+	}
+	if name = path.Clean(name); name == "." {
+		return "", errors.Errorf("filename %q doesn't name a file", params["filename"])
+	}
+	return name, nil
 }
 
 // NodeResultURL is the URL for results for a given node result. Takes the baseURL (http[s]://hostname:port/,
@@ -122,9 +549,137 @@ func GlobalResultURL(baseURL, pluginName string) (string, error) {
 
 }
 
-func logRequest(req *http.Request) {
+// PartialResultURL is the URL for the partial result with the given sequence
+// number, given the URL of the final result as returned by NodeResultURL or
+// GlobalResultURL.
+func PartialResultURL(resultURL string, seq int) string {
+	return fmt.Sprintf("%v/partial/%d", strings.TrimSuffix(resultURL, "/"), seq)
+}
+
+// ProgressURL is the URL a plugin reports its progress on a result to, given
+// the URL of the result as returned by NodeResultURL or GlobalResultURL.
+func ProgressURL(resultURL string) string {
+	return strings.TrimSuffix(resultURL, "/") + progressSuffix
+}
+
+// HeartbeatURL is the URL a worker sends heartbeats for a result to, given
+// the URL of the result as returned by NodeResultURL or GlobalResultURL.
+func HeartbeatURL(resultURL string) string {
+	return strings.TrimSuffix(resultURL, "/") + heartbeatSuffix
+}
+
+// StreamURL is the URL a plugin streams its result to as it writes it,
+// given the URL of the result as returned by NodeResultURL or
+// GlobalResultURL.
+func StreamURL(resultURL string) string {
+	return strings.TrimSuffix(resultURL, "/") + streamSuffix
+}
+
+// ArtifactURL is the URL a plugin submits each of the artifacts making up
+// its result to, given the URL of the result as returned by NodeResultURL or
+// GlobalResultURL.
+func ArtifactURL(resultURL string) string {
+	return strings.TrimSuffix(resultURL, "/") + artifactSuffix
+}
+
+// DoneURL is the URL a plugin marks its result done at once it has
+// submitted all of its artifacts, given the URL of the result as returned by
+// NodeResultURL or GlobalResultURL.
+func DoneURL(resultURL string) string {
+	return strings.TrimSuffix(resultURL, "/") + doneSuffix
+}
+
+// CertURL is the URL clients renew their certificate from. Takes the baseURL
+// (http[s]://hostname:port/, with trailing slash).
+func CertURL(baseURL string) (string, error) {
+	base, err := url.Parse(baseURL)
+	if err != nil {
+		return "", errors.Wrap(err, "couldn't get certificate URL")
+	}
+	path, err := certRoute.URLPath()
+	if err != nil {
+		return "", errors.Wrap(err, "couldn't get certificate URL")
+	}
+	path.Scheme = base.Scheme
+	path.Host = base.Host
+	return path.String(), nil
+}
+
+// HealthURL is the URL of the server's health check, which can be reached
+// without a client certificate. Takes the baseURL (http[s]://hostname:port/,
+// with trailing slash).
+func HealthURL(baseURL string) (string, error) {
+	base, err := url.Parse(baseURL)
+	if err != nil {
+		return "", errors.Wrap(err, "couldn't get health check URL")
+	}
+	health := url.URL{Scheme: base.Scheme, Host: base.Host, Path: healthz}
+	return health.String(), nil
+}
+
+// WithPathPrefix returns the URL with the path prefix put before its path,
+// for a server whose routes are under a base path. Takes any of the URLs
+// returned by the functions above, or a master URL. The URL is returned as
+// it is if the prefix is empty or "/".
+func WithPathPrefix(rawURL, prefix string) (string, error) {
+	prefix, err := plugin.CleanPathPrefix(prefix)
+	if err != nil {
+		return "", err
+	}
+	if prefix == "" {
+		return rawURL, nil
+	}
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return "", errors.Wrapf(err, "couldn't add path prefix to %v", rawURL)
+	}
+	if u.RawPath != "" {
+		u.RawPath = (&url.URL{Path: prefix}).EscapedPath() + u.RawPath
+	}
+	u.Path = prefix + u.Path
+	return u.String(), nil
+}
+
+// stripBasePath returns the request with the base path removed from its
+// path, or false if its path isn't under the base path.
+func stripBasePath(r *http.Request, basePath string) (*http.Request, bool) {
+	prefix, err := plugin.CleanPathPrefix(basePath)
+	if err != nil {
+		return r, false
+	}
+	if prefix == "" {
+		return r, true
+	}
+	rest := strings.TrimPrefix(r.URL.Path, prefix)
+	if len(rest) == len(r.URL.Path) || !strings.HasPrefix(rest, "/") {
+		return r, false
+	}
+	return withPath(r, rest), true
+}
+
+// withPath returns a shallow copy of the request with the given path, like
+// http.StripPrefix makes.
+func withPath(r *http.Request, p string) *http.Request {
+	r2 := new(http.Request)
+	*r2 = *r
+	r2.URL = new(url.URL)
+	*r2.URL = *r.URL
+	r2.URL.Path = p
+	r2.URL.RawPath = ""
+	return r2
+}
+
+// logger returns the logger requests are logged to.
+func (h *Handler) logger() logrus.FieldLogger {
+	if h.Log == nil {
+		return logrus.StandardLogger()
+	}
+	return h.Log
+}
+
+func logRequest(logger logrus.FieldLogger, req *http.Request) {
 	vars := mux.Vars(req)
-	log := logrus.WithField("plugin_name", vars["plugin"])
+	log := logger.WithField("plugin_name", vars["plugin"])
 	if node := vars["node"]; node != "" {
 		log = log.WithField("node", node)
 	}
@@ -18,10 +18,15 @@ package aggregation
 
 import (
 	"bytes"
+	"compress/gzip"
+	"crypto/tls"
+	"encoding/json"
 	"io/ioutil"
 	"net/http"
+	"net/http/httptest"
 	"os"
 	"testing"
+	"time"
 
 	"github.com/heptio/sonobuoy/pkg/backplane/ca/authtest"
 	"github.com/heptio/sonobuoy/pkg/plugin"
@@ -77,15 +82,20 @@ func TestStart(t *testing.T) {
 	}
 
 	// Happy path
-	response = doRequest(t, srv.Client(), "PUT", URL, expectedJSON)
+	submitted := time.Date(2018, 6, 1, 12, 0, 0, 0, time.UTC)
+	dateHeaders := http.Header{}
+	dateHeaders.Set("Date", submitted.Format(http.TimeFormat))
+	response = doRequestWithHeaders(t, srv.Client(), "PUT", URL, expectedJSON, dateHeaders)
 	if response.StatusCode != 200 {
 		t.Fatalf("Client got non-200 status from server: %v", response.StatusCode)
 		t.Fail()
 	}
 
-	if _, ok := checkins[expectedResult]; !ok {
+	if checkin, ok := checkins[expectedResult]; !ok {
 		t.Fatalf("Valid request for %v did not get recorded", expectedResult)
 		t.Fail()
+	} else if !checkin.Submitted.Equal(submitted) {
+		t.Errorf("expected the result to be submitted at %v, got %v", submitted, checkin.Submitted)
 	}
 
 	URL, err = GlobalResultURL(srv.URL, "gztest")
@@ -116,6 +126,130 @@ func TestStart(t *testing.T) {
 	}
 }
 
+func TestResultsHandler_contentEncoding(t *testing.T) {
+	var compressed bytes.Buffer
+	gz := gzip.NewWriter(&compressed)
+	gz.Write([]byte(`{"some": "json"}`))
+	gz.Close()
+
+	testCases := []struct {
+		desc       string
+		encoding   string
+		body       []byte
+		wantStatus int
+		wantBody   string
+		wantCodec  string
+	}{
+		{desc: "uncompressed", body: []byte(`{"some": "json"}`), wantStatus: 200, wantBody: `{"some": "json"}`, wantCodec: "identity"},
+		{desc: "identity", encoding: "identity", body: []byte(`{"some": "json"}`), wantStatus: 200, wantBody: `{"some": "json"}`, wantCodec: "identity"},
+		{desc: "gzip", encoding: "gzip", body: compressed.Bytes(), wantStatus: 200, wantBody: `{"some": "json"}`, wantCodec: "gzip"},
+		{desc: "malformed gzip", encoding: "gzip", body: []byte("not gzip"), wantStatus: 400},
+		{desc: "unsupported encoding", encoding: "br", body: []byte("???"), wantStatus: 415},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.desc, func(t *testing.T) {
+			var got []byte
+			var codec string
+			h := NewHandler(func(checkin *plugin.Result, w http.ResponseWriter) {
+				got, _ = ioutil.ReadAll(checkin.Body)
+				codec = checkin.Codec
+			})
+			// Uploads with any supported codec are accepted, even if
+			// it isn't offered.
+			h.Codecs = []string{plugin.UploadCodecIdentity}
+			srv := authtest.NewTLSServer(h, t)
+			defer srv.Close()
+
+			URL, err := NodeResultURL(srv.URL, "testnode", "systemd_logs")
+			if err != nil {
+				t.Fatalf("error getting node result URL %v", err)
+			}
+			headers := http.Header{}
+			if tc.encoding != "" {
+				headers.Set("content-encoding", tc.encoding)
+			}
+
+			resp := doRequestWithHeaders(t, srv.Client(), "PUT", URL, tc.body, headers)
+			if resp.StatusCode != tc.wantStatus {
+				t.Fatalf("expected a %v response, got %v", tc.wantStatus, resp.StatusCode)
+			}
+			if string(got) != tc.wantBody || codec != tc.wantCodec {
+				t.Errorf("expected result body %q with codec %q, got %q with %q", tc.wantBody, tc.wantCodec, string(got), codec)
+			}
+			if accepted := resp.Header.Get(AcceptEncodingHeader); resp.StatusCode == http.StatusUnsupportedMediaType && accepted != "gzip, identity" {
+				t.Errorf("expected the 415 to list the supported codecs, got %q", accepted)
+			}
+		})
+	}
+}
+
+func TestRequestResultInfo(t *testing.T) {
+	testCases := []struct {
+		path   string
+		want   ResultInfo
+		wantOK bool
+	}{
+		{path: "/api/v1/results/by-node/node1/systemd_logs", want: ResultInfo{Plugin: "systemd_logs", Node: "node1"}, wantOK: true},
+		{path: "/api/v1/results/global/e2e", want: ResultInfo{Plugin: "e2e"}, wantOK: true},
+		{path: "/api/v1/results/by-node/node1/systemd_logs/partial/3", want: ResultInfo{Plugin: "systemd_logs", Node: "node1", Partial: true}, wantOK: true},
+		{path: "/api/v1/results/global/e2e/partial/0", want: ResultInfo{Plugin: "e2e", Partial: true}, wantOK: true},
+		{path: "/api/v1/results/by-node/node1/systemd_logs/stream", want: ResultInfo{Plugin: "systemd_logs", Node: "node1", Streamed: true}, wantOK: true},
+		{path: "/api/v1/results/global/stream", want: ResultInfo{Plugin: "stream"}, wantOK: true},
+		{path: "/api/v1/results/by-node/node1/e2e/artifacts", want: ResultInfo{Plugin: "e2e", Node: "node1", Artifact: true}, wantOK: true},
+		{path: "/api/v1/results/global/e2e/done", want: ResultInfo{Plugin: "e2e", Done: true}, wantOK: true},
+		{path: "/sonobuoy/api/v1/results/global/e2e/partial/1", want: ResultInfo{Plugin: "e2e", Partial: true}, wantOK: true},
+		{path: "/api/v1/cert"},
+		{path: "/sonobuoy/api/v1/cert"},
+		{path: "/not/found"},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.path, func(t *testing.T) {
+			req, err := http.NewRequest("PUT", "https://aggregator"+tc.path, nil)
+			if err != nil {
+				t.Fatalf("error constructing request: %v", err)
+			}
+			got, ok := RequestResultInfo(req)
+			if ok != tc.wantOK || got != tc.want {
+				t.Errorf("expected %+v (%v), got %+v (%v)", tc.want, tc.wantOK, got, ok)
+			}
+		})
+	}
+}
+
+func TestParseFilename(t *testing.T) {
+	testCases := []struct {
+		header  string
+		want    string
+		wantErr bool
+	}{
+		{header: "", want: ""},
+		{header: "attachment", want: ""},
+		{header: "attachment; filename=junit.xml", want: "junit.xml"},
+		{header: `attachment; filename="screenshots/login page.png"`, want: "screenshots/login page.png"},
+		{header: `attachment; filename="./a//b/"`, want: "a/b"},
+		{header: `attachment; filename="../../etc/passwd"`, wantErr: true},
+		{header: `attachment; filename="a/../../b"`, wantErr: true},
+		{header: `attachment; filename="a/.."`, wantErr: true},
+		{header: `attachment; filename=".."`, wantErr: true},
+		{header: `attachment; filename="/etc/passwd"`, wantErr: true},
+		{header: `attachment; filename="..\\..\\windows"`, wantErr: true},
+		{header: `attachment; filename="."`, wantErr: true},
+		{header: `attachment; filename=""`, wantErr: true},
+		{header: `attachment; filename="a`, wantErr: true},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.header, func(t *testing.T) {
+			got, err := parseFilename(tc.header)
+			if (err != nil) != tc.wantErr || got != tc.want {
+				t.Errorf("expected %q (error: %v), got %q: %v", tc.want, tc.wantErr, got, err)
+			}
+		})
+	}
+}
+
 func doRequestWithHeaders(t *testing.T, client *http.Client, method, reqURL string, body []byte, headers http.Header) *http.Response {
 	req, err := http.NewRequest(
 		method,
@@ -139,3 +273,107 @@ func doRequestWithHeaders(t *testing.T, client *http.Client, method, reqURL stri
 func doRequest(t *testing.T, client *http.Client, method, reqURL string, body []byte) *http.Response {
 	return doRequestWithHeaders(t, client, method, reqURL, body, http.Header{})
 }
+
+func TestHandler_healthz(t *testing.T) {
+	aggr := NewAggregator("", []plugin.ExpectedResult{{ResultType: "e2e"}, {NodeName: "node1", ResultType: "systemd_logs"}})
+	aggr.Results["e2e"] = &plugin.Result{ResultType: "e2e"}
+
+	submitted := false
+	h := NewHandler(func(*plugin.Result, http.ResponseWriter) { submitted = true })
+	h.HealthCallback = aggr.health
+
+	// Health checks over TLS don't need a client certificate
+	req := httptest.NewRequest("GET", healthz, nil)
+	req.TLS = &tls.ConnectionState{}
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, req)
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected a 200 response, got %v: %v", w.Code, w.Body.String())
+	}
+	var status HealthStatus
+	if err := json.Unmarshal(w.Body.Bytes(), &status); err != nil {
+		t.Fatalf("couldn't unmarshal health status %q: %v", w.Body.String(), err)
+	}
+	if want := (HealthStatus{Status: RunningStatus, Received: 1, Expected: 2}); status != want {
+		t.Errorf("expected health status %+v, got %+v", want, status)
+	}
+	if submitted {
+		t.Error("expected a health check not to submit a result")
+	}
+
+	// Everything else does
+	req = httptest.NewRequest("PUT", "/api/v1/results/by-node/node1/systemd_logs", bytes.NewReader([]byte("foo")))
+	req.TLS = &tls.ConnectionState{}
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, req)
+	if w.Code != http.StatusUnauthorized || submitted {
+		t.Errorf("expected a result without a client certificate to be rejected, got %v", w.Code)
+	}
+}
+
+func TestHandler_basePath(t *testing.T) {
+	var submitted []*plugin.Result
+	h := NewHandler(func(result *plugin.Result, w http.ResponseWriter) { submitted = append(submitted, result) })
+	h.BasePath = "/sonobuoy/"
+
+	nodeURL, err := NodeResultURL("http://aggregator/", "node1", "systemd_logs")
+	if err != nil {
+		t.Fatalf("couldn't get node result URL: %v", err)
+	}
+	prefixed, err := WithPathPrefix(PartialResultURL(nodeURL, 2), h.BasePath)
+	if err != nil {
+		t.Fatalf("couldn't add path prefix: %v", err)
+	}
+	if want := "http://aggregator/sonobuoy/api/v1/results/by-node/node1/systemd_logs/partial/2"; prefixed != want {
+		t.Errorf("expected prefixed URL %v, got %v", want, prefixed)
+	}
+	health, err := HealthURL("http://aggregator/")
+	if err != nil {
+		t.Fatalf("couldn't get health check URL: %v", err)
+	}
+	if health, err = WithPathPrefix(health, "/sonobuoy"); err != nil {
+		t.Fatalf("couldn't add path prefix: %v", err)
+	}
+
+	testCases := []struct {
+		method, url string
+		want        int
+	}{
+		{method: "PUT", url: prefixed, want: http.StatusOK},
+		{method: "GET", url: health, want: http.StatusOK},
+		{method: "PUT", url: nodeURL, want: http.StatusNotFound},
+		{method: "GET", url: "http://aggregator/healthz", want: http.StatusNotFound},
+		{method: "GET", url: "http://aggregator/sonobuoyhealthz", want: http.StatusNotFound},
+	}
+	for _, tc := range testCases {
+		req := httptest.NewRequest(tc.method, tc.url, bytes.NewReader([]byte("foo")))
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, req)
+		if w.Code != tc.want {
+			t.Errorf("expected a %v response to %v %v, got %v: %v", tc.want, tc.method, tc.url, w.Code, w.Body.String())
+		}
+	}
+
+	if len(submitted) != 1 || submitted[0].NodeName != "node1" || !submitted[0].Partial || submitted[0].Sequence != 2 {
+		t.Errorf("expected partial result 2 of node1 to be submitted under the base path, got %+v", submitted)
+	}
+}
+
+func TestWithPathPrefix(t *testing.T) {
+	testCases := []struct {
+		url, prefix, want string
+		expectErr         bool
+	}{
+		{url: "https://aggregator:8080/api/v1/results/by-node", prefix: "", want: "https://aggregator:8080/api/v1/results/by-node"},
+		{url: "https://aggregator:8080/api/v1/results/by-node", prefix: "/", want: "https://aggregator:8080/api/v1/results/by-node"},
+		{url: "https://aggregator:8080/api/v1/results/by-node", prefix: "/sonobuoy/", want: "https://aggregator:8080/sonobuoy/api/v1/results/by-node"},
+		{url: "https://aggregator/api/v1/cert", prefix: "/a/b", want: "https://aggregator/a/b/api/v1/cert"},
+		{url: "https://aggregator/healthz", prefix: "sonobuoy", expectErr: true},
+	}
+	for _, tc := range testCases {
+		got, err := WithPathPrefix(tc.url, tc.prefix)
+		if (err != nil) != tc.expectErr || got != tc.want {
+			t.Errorf("expected %q (error %v) for %v under %q, got %q (%v)", tc.want, tc.expectErr, tc.url, tc.prefix, got, err)
+		}
+	}
+}
@@ -0,0 +1,196 @@
+/*
+Copyright 2018 Heptio Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package aggregation
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sort"
+	"time"
+
+	"github.com/heptio/sonobuoy/pkg/plugin"
+	"github.com/heptio/sonobuoy/pkg/plugin/driver/utils"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// defaultStallFactor is how many heartbeat intervals a result's worker
+	// may go without a heartbeat before the result is stalled, if the run
+	// doesn't configure it.
+	defaultStallFactor = 5
+	// maxStallCheckInterval is the longest time between checks for stalled
+	// results.
+	maxStallCheckInterval = 10 * time.Second
+)
+
+// HeartbeatReport is a heartbeat a worker sent while waiting for its plugin
+// to finish one of its results.
+type HeartbeatReport struct {
+	ResultType string
+	// NodeName is empty for results which aren't node-specific.
+	NodeName string
+	// ClientName is the common name of the verified client certificate the
+	// heartbeat was sent with, if any.
+	ClientName string
+}
+
+func (r *HeartbeatReport) expectedResultID() string {
+	expected := plugin.ExpectedResult{ResultType: r.ResultType, NodeName: r.NodeName}
+	return expected.ID()
+}
+
+// StalledResult is a result whose worker has stopped sending heartbeats.
+type StalledResult struct {
+	Plugin string `json:"plugin"`
+	Node   string `json:"node,omitempty"`
+	// LastHeartbeat is when the last heartbeat for the result arrived.
+	LastHeartbeat time.Time `json:"lastheartbeat"`
+}
+
+// HandleHTTPHeartbeat is called when a worker sends a heartbeat for one of
+// the results it's expected to submit. Like progress reports, heartbeats for
+// results which have already been received are rejected with a 409 conflict.
+func (a *Aggregator) HandleHTTPHeartbeat(report *HeartbeatReport, w http.ResponseWriter) {
+	a.resultsMutex.Lock()
+	defer a.resultsMutex.Unlock()
+
+	id := report.expectedResultID()
+	if _, ok := a.ExpectedResults[id]; !ok {
+		http.Error(w, fmt.Sprintf("Result %v unexpected", id), http.StatusForbidden)
+		return
+	}
+	if !a.isClient(report.ResultType, report.ClientName) {
+		a.logger().WithField("plugin", report.ResultType).WithField("node", report.NodeName).WithField("client_cert", report.ClientName).Warning("Rejecting heartbeat sent with another plugin's client certificate")
+		http.Error(w, fmt.Sprintf("Heartbeats for %v can't be sent by %v", id, report.ClientName), http.StatusForbidden)
+		return
+	}
+	if _, ok := a.Results[id]; ok {
+		http.Error(w, fmt.Sprintf("Result %v already received", id), http.StatusConflict)
+		return
+	}
+	a.heartbeats[id] = time.Now().UTC()
+}
+
+// stalledResults returns the results still expected whose last heartbeat was
+// at least the threshold before now, sorted by plugin and node. Results which
+// have never had a heartbeat can't stall, since their workers may not send
+// them, nor can results which are being received.
+func (a *Aggregator) stalledResults(threshold time.Duration, now time.Time) []StalledResult {
+	a.resultsMutex.Lock()
+	defer a.resultsMutex.Unlock()
+
+	var stalled []StalledResult
+	for id, last := range a.heartbeats {
+		if _, ok := a.Results[id]; ok || a.receiving[id] || now.Sub(last) < threshold {
+			continue
+		}
+		expected, ok := a.ExpectedResults[id]
+		if !ok {
+			continue
+		}
+		stalled = append(stalled, StalledResult{Plugin: expected.ResultType, Node: expected.NodeName, LastHeartbeat: last})
+	}
+	sort.Slice(stalled, func(i, j int) bool {
+		if stalled[i].Plugin != stalled[j].Plugin {
+			return stalled[i].Plugin < stalled[j].Plugin
+		}
+		return stalled[i].Node < stalled[j].Node
+	})
+	return stalled
+}
+
+// heartbeatStall returns how long a result's worker may go without a
+// heartbeat before the result is stalled.
+func heartbeatStall(cfg plugin.AggregationConfig) time.Duration {
+	if cfg.HeartbeatStallSeconds > 0 {
+		return time.Duration(cfg.HeartbeatStallSeconds) * time.Second
+	}
+	return time.Duration(defaultStallFactor*cfg.HeartbeatIntervalSeconds) * time.Second
+}
+
+// watchHeartbeats keeps the stalled annotation on the aggregator pod up to
+// date with the results whose workers haven't sent a heartbeat within the
+// threshold, until ctx is done. Results stop being stalled if their
+// heartbeats resume. If fail is true, stalled results are also recorded as
+// errors, so the run doesn't wait for them until it times out.
+func watchHeartbeats(ctx context.Context, aggr *Aggregator, threshold time.Duration, fail bool, u *updater, resultsCh chan<- *plugin.Result) {
+	interval := threshold / 4
+	if interval > maxStallCheckInterval {
+		interval = maxStallCheckInterval
+	}
+
+	// annotated is what the annotation was last set to, by result ID
+	annotated := map[string]bool{}
+	failed := map[string]bool{}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		stalled := aggr.stalledResults(threshold, time.Now())
+		current := make(map[string]bool, len(stalled))
+		changed := false
+		for _, s := range stalled {
+			id := stalledResultID(s)
+			current[id] = true
+			if annotated[id] {
+				continue
+			}
+			changed = true
+			aggr.logger().WithFields(logrus.Fields{
+				"plugin":        s.Plugin,
+				"node":          s.Node,
+				"lastheartbeat": s.LastHeartbeat,
+			}).Warningf("No heartbeat for the result in %v", threshold)
+		}
+		if len(current) != len(annotated) {
+			changed = true
+		}
+		if changed {
+			if err := u.AnnotateStalled(stalled); err != nil {
+				aggr.logger().WithError(err).Info("couldn't annotate sonobuoy pod with the stalled results, will retry")
+			} else {
+				annotated = current
+			}
+		}
+
+		if !fail {
+			continue
+		}
+		for _, s := range stalled {
+			id := stalledResultID(s)
+			if failed[id] {
+				continue
+			}
+			failed[id] = true
+			resultsCh <- utils.MakeErrorResult(s.Plugin, map[string]interface{}{
+				"error":    fmt.Sprintf("stalled: no heartbeat from the worker in %v, the last was at %v", threshold, s.LastHeartbeat.Format(time.RFC3339)),
+				"category": plugin.ErrorCategoryTimeout,
+			}, s.Node)
+		}
+	}
+}
+
+func stalledResultID(s StalledResult) string {
+	expected := plugin.ExpectedResult{ResultType: s.Plugin, NodeName: s.Node}
+	return expected.ID()
+}
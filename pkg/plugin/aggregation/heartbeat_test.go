@@ -0,0 +1,148 @@
+/*
+Copyright 2018 Heptio Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package aggregation
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/heptio/sonobuoy/pkg/plugin"
+)
+
+func TestHandler_heartbeat(t *testing.T) {
+	aggr := NewAggregator("", []plugin.ExpectedResult{{ResultType: "e2e"}, {NodeName: "node1", ResultType: "systemd_logs"}})
+	h := NewHandler(aggr.HandleHTTPResult)
+	h.HeartbeatCallback = aggr.HandleHTTPHeartbeat
+
+	beat := func(url string) int {
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, httptest.NewRequest("PUT", url, nil))
+		return w.Code
+	}
+
+	if code := beat("/api/v1/results/by-node/node2/systemd_logs/heartbeat"); code != http.StatusForbidden {
+		t.Errorf("expected a 403 response for an unexpected result, got %v", code)
+	}
+	if code := beat("/api/v1/results/by-node/node1/systemd_logs/heartbeat"); code != http.StatusOK {
+		t.Errorf("expected a 200 response, got %v", code)
+	}
+	if last, ok := aggr.heartbeats["systemd_logs/node1"]; !ok || last.IsZero() {
+		t.Errorf("expected the heartbeat to be recorded, got %v", aggr.heartbeats)
+	}
+
+	aggr.Results["e2e"] = &plugin.Result{ResultType: "e2e"}
+	if code := beat("/api/v1/results/global/e2e/heartbeat"); code != http.StatusConflict {
+		t.Errorf("expected a 409 response once the result was received, got %v", code)
+	}
+
+	h.HeartbeatCallback = nil
+	if code := beat("/api/v1/results/global/e2e/heartbeat"); code != http.StatusNotFound {
+		t.Errorf("expected a 404 response without a callback, got %v", code)
+	}
+}
+
+func TestStalledResults(t *testing.T) {
+	aggr := NewAggregator("", []plugin.ExpectedResult{
+		{ResultType: "e2e"},
+		{NodeName: "node1", ResultType: "systemd_logs"},
+		{NodeName: "node2", ResultType: "systemd_logs"},
+		{NodeName: "node3", ResultType: "systemd_logs"},
+		{NodeName: "node4", ResultType: "systemd_logs"},
+	})
+	now := time.Now()
+	aggr.heartbeats["e2e"] = now.Add(-time.Hour)
+	aggr.heartbeats["systemd_logs/node1"] = now.Add(-10 * time.Second)
+	aggr.heartbeats["systemd_logs/node2"] = now.Add(-5 * time.Minute)
+	aggr.heartbeats["systemd_logs/node3"] = now.Add(-5 * time.Minute)
+	// node4 has never sent a heartbeat, e2e has been received and node3 is
+	// being received
+	aggr.Results["e2e"] = &plugin.Result{ResultType: "e2e"}
+	aggr.receiving["systemd_logs/node3"] = true
+
+	stalled := aggr.stalledResults(time.Minute, now)
+	if len(stalled) != 1 || stalled[0].Plugin != "systemd_logs" || stalled[0].Node != "node2" || !stalled[0].LastHeartbeat.Equal(now.Add(-5*time.Minute)) {
+		t.Errorf("expected only node2 to be stalled, got %+v", stalled)
+	}
+}
+
+func TestHeartbeatStall(t *testing.T) {
+	if got := heartbeatStall(plugin.AggregationConfig{HeartbeatIntervalSeconds: 30}); got != 150*time.Second {
+		t.Errorf("expected the default stall threshold to be 5 intervals, got %v", got)
+	}
+	if got := heartbeatStall(plugin.AggregationConfig{HeartbeatIntervalSeconds: 30, HeartbeatStallSeconds: 90}); got != 90*time.Second {
+		t.Errorf("expected the configured stall threshold, got %v", got)
+	}
+}
+
+func TestWatchHeartbeats(t *testing.T) {
+	expected := []plugin.ExpectedResult{{NodeName: "node1", ResultType: "systemd_logs"}, {NodeName: "node2", ResultType: "systemd_logs"}}
+	aggr := NewAggregator("", expected)
+	aggr.heartbeats["systemd_logs/node1"] = time.Now().Add(-time.Hour)
+	aggr.heartbeats["systemd_logs/node2"] = time.Now().Add(time.Hour)
+	client := &fakeClient{}
+	u := newUpdater(expected, "heptio-sonobuoy-test", client)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	resultsCh := make(chan *plugin.Result, 2)
+	done := make(chan struct{})
+	go func() {
+		watchHeartbeats(ctx, aggr, 40*time.Millisecond, true, u, resultsCh)
+		close(done)
+	}()
+
+	var result *plugin.Result
+	select {
+	case result = <-resultsCh:
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected the stalled result to be failed")
+	}
+	if result.ExpectedResultID() != "systemd_logs/node1" || !strings.HasPrefix(result.Error, "stalled: ") || result.ErrorCategory != plugin.ErrorCategoryTimeout {
+		t.Errorf("unexpected error result %+v", result)
+	}
+
+	// Once its heartbeats resume it's no longer stalled, nor failed again
+	aggr.resultsMutex.Lock()
+	aggr.heartbeats["systemd_logs/node1"] = time.Now().Add(time.Hour)
+	aggr.resultsMutex.Unlock()
+	time.Sleep(100 * time.Millisecond)
+	cancel()
+	<-done
+	if len(resultsCh) != 0 {
+		t.Errorf("expected the stalled result to only be failed once, got %v more", len(resultsCh))
+	}
+
+	var annotations []string
+	for _, blob := range client.patches {
+		var patch struct {
+			Metadata struct {
+				Annotations map[string]string `json:"annotations"`
+			} `json:"metadata"`
+		}
+		if err := json.Unmarshal(blob, &patch); err != nil {
+			t.Fatalf("couldn't unmarshal patch: %v", err)
+		}
+		annotations = append(annotations, patch.Metadata.Annotations[StalledAnnotationName])
+	}
+	if len(annotations) != 2 || !strings.Contains(annotations[0], `"node":"node1"`) || annotations[1] != "[]" {
+		t.Errorf("expected the stalled result to be annotated and then cleared, got %q", annotations)
+	}
+}
@@ -0,0 +1,123 @@
+/*
+Copyright 2018 Heptio Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package aggregation
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+
+	"github.com/pkg/errors"
+)
+
+// inProcessBaseURL is the base of the URLs results are routed by in process.
+// Nothing is ever sent to it.
+const inProcessBaseURL = "http://in-process/"
+
+// InProcessServer takes the place of the aggregation HTTP server when a run
+// is given it in RunOptions. Results are submitted by calling Submit, which
+// passes them to the same handler the HTTP server uses, so they're ingested
+// exactly as they would be over the network. It's intended for testing plugin
+// lifecycles without a socket or TLS.
+type InProcessServer struct {
+	mu      sync.RWMutex
+	handler http.Handler
+}
+
+// NewInProcessServer returns an InProcessServer which accepts results once
+// the run using it has started.
+func NewInProcessServer() *InProcessServer {
+	return &InProcessServer{}
+}
+
+// Submit submits a result as if it had been uploaded to the aggregation
+// server. nodeName is empty for global results. It returns the HTTP status
+// code the server responded with, and an error if it wasn't 200 OK.
+func (s *InProcessServer) Submit(nodeName, resultType, mimeType string, body io.Reader) (int, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if s.handler == nil {
+		return 0, errors.New("aggregation server isn't running")
+	}
+
+	var url string
+	var err error
+	if nodeName != "" {
+		url, err = NodeResultURL(inProcessBaseURL, nodeName, resultType)
+	} else {
+		url, err = GlobalResultURL(inProcessBaseURL, resultType)
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	req, err := http.NewRequest(http.MethodPut, url, body)
+	if err != nil {
+		return 0, errors.Wrapf(err, "couldn't make request for result %v", resultType)
+	}
+	req.Header.Set("content-type", mimeType)
+
+	w := &responseRecorder{header: http.Header{}, status: http.StatusOK}
+	s.handler.ServeHTTP(w, req)
+	if w.status != http.StatusOK {
+		return w.status, errors.Errorf("unexpected status code %d: %v", w.status, strings.TrimSpace(w.body.String()))
+	}
+	return w.status, nil
+}
+
+// serve starts passing submitted results to the given handler.
+func (s *InProcessServer) serve(handler http.Handler) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.handler = handler
+}
+
+// stop rejects any further results. It waits for results being submitted to
+// be handled, like the HTTP server draining its requests.
+func (s *InProcessServer) stop() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.handler = nil
+}
+
+// responseRecorder is the http.ResponseWriter for in process submissions,
+// recording the response.
+type responseRecorder struct {
+	header http.Header
+	status int
+	body   bytes.Buffer
+	wrote  bool
+}
+
+func (r *responseRecorder) Header() http.Header {
+	return r.header
+}
+
+func (r *responseRecorder) Write(b []byte) (int, error) {
+	r.wrote = true
+	return r.body.Write(b)
+}
+
+func (r *responseRecorder) WriteHeader(status int) {
+	if r.wrote {
+		return
+	}
+	r.wrote = true
+	r.status = status
+}
@@ -0,0 +1,209 @@
+/*
+Copyright 2018 Heptio Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package aggregation
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path"
+	"strings"
+	"testing"
+
+	"github.com/heptio/sonobuoy/pkg/plugin"
+	"github.com/sirupsen/logrus"
+	testhook "github.com/sirupsen/logrus/hooks/test"
+)
+
+func TestRun_inProcess(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sonobuoy_inprocess_test")
+	if err != nil {
+		t.Fatalf("Could not create temp directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	srv := NewInProcessServer()
+	submitErrs := make(chan error, 3)
+	submit := func(node, resultType string) {
+		_, err := srv.Submit(node, resultType, "application/json", strings.NewReader(`{"some": "json"}`))
+		submitErrs <- err
+	}
+
+	daemonset := &fakePlugin{name: "systemd_logs", nodes: []string{"node1", "node2"}, run: func(string) error {
+		go submit("node1", "systemd_logs")
+		go submit("node2", "systemd_logs")
+		return nil
+	}}
+	job := &fakePlugin{name: "e2e", run: func(string) error {
+		go submit("", "e2e")
+		return nil
+	}}
+
+	summary, err := Run(context.Background(), &fakeClient{}, []plugin.Interface{daemonset, job}, plugin.AggregationConfig{}, "heptio-sonobuoy-test", dir, RunOptions{InProcess: srv})
+	if err != nil {
+		t.Fatalf("unexpected error from run: %v", err)
+	}
+	for i := 0; i < 3; i++ {
+		if err := <-submitErrs; err != nil {
+			t.Errorf("unexpected error submitting result: %v", err)
+		}
+	}
+	if !summary.Succeeded() {
+		t.Errorf("expected all results to complete, got %+v", summary)
+	}
+	for _, file := range []string{"plugins/systemd_logs/results/node1", "plugins/e2e/results"} {
+		if _, err := os.Stat(path.Join(dir, file)); err != nil {
+			t.Errorf("expected result %v to be written: %v", file, err)
+		}
+	}
+
+	if _, err := srv.Submit("", "e2e", "application/json", strings.NewReader("{}")); err == nil {
+		t.Error("expected results submitted after the run to be rejected")
+	}
+}
+
+func TestRun_middleware(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sonobuoy_inprocess_test")
+	if err != nil {
+		t.Fatalf("Could not create temp directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	srv := NewInProcessServer()
+	p := &fakePlugin{name: "e2e", run: func(string) error {
+		go srv.Submit("", "e2e", "application/json", strings.NewReader("{}"))
+		return nil
+	}}
+
+	// Record the order middleware is called in and what it sees
+	var calls []string
+	var seen ResultInfo
+	middleware := func(name string) func(http.Handler) http.Handler {
+		return func(next http.Handler) http.Handler {
+			return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				calls = append(calls, name)
+				seen, _ = RequestResultInfo(r)
+				next.ServeHTTP(w, r)
+			})
+		}
+	}
+
+	opts := RunOptions{InProcess: srv, Middleware: []func(http.Handler) http.Handler{middleware("outer"), middleware("inner")}}
+	summary, err := Run(context.Background(), &fakeClient{}, []plugin.Interface{p}, plugin.AggregationConfig{}, "heptio-sonobuoy-test", dir, opts)
+	if err != nil {
+		t.Fatalf("unexpected error from run: %v", err)
+	}
+	if !summary.Succeeded() {
+		t.Errorf("expected all results to complete, got %+v", summary)
+	}
+	if strings.Join(calls, ",") != "outer,inner" {
+		t.Errorf("expected middleware to be called outermost first, got %v", calls)
+	}
+	if seen.Plugin != "e2e" {
+		t.Errorf("expected middleware to see the e2e result, got %+v", seen)
+	}
+}
+
+func TestRun_logger(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sonobuoy_inprocess_test")
+	if err != nil {
+		t.Fatalf("Could not create temp directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	// Nothing should be logged to the standard logger
+	stdHook := &testhook.Hook{}
+	oldHooks := logrus.StandardLogger().ReplaceHooks(logrus.LevelHooks{})
+	logrus.AddHook(stdHook)
+	defer logrus.StandardLogger().ReplaceHooks(oldHooks)
+
+	logger, hook := testhook.NewNullLogger()
+	srv := NewInProcessServer()
+	p := &fakePlugin{name: "e2e", run: func(string) error {
+		go srv.Submit("", "e2e", "application/json", strings.NewReader("{}"))
+		return nil
+	}}
+
+	opts := RunOptions{InProcess: srv, Logger: logger.WithField("run", "abc")}
+	if _, err := Run(context.Background(), &fakeClient{}, []plugin.Interface{p}, plugin.AggregationConfig{}, "heptio-sonobuoy-test", dir, opts); err != nil {
+		t.Fatalf("unexpected error from run: %v", err)
+	}
+
+	entries := hook.AllEntries()
+	if len(entries) == 0 {
+		t.Fatal("expected the run to log to the given logger")
+	}
+	for _, entry := range entries {
+		if entry.Data["run"] != "abc" {
+			t.Errorf("expected entry %q to have the run field, got %v", entry.Message, entry.Data)
+		}
+	}
+	if n := len(stdHook.AllEntries()); n != 0 {
+		t.Errorf("expected nothing to be logged to the standard logger, got %v entries", n)
+	}
+}
+
+func TestRun_inProcessTimeout(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sonobuoy_inprocess_test")
+	if err != nil {
+		t.Fatalf("Could not create temp directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	srv := NewInProcessServer()
+	p := &fakePlugin{name: "e2e"}
+
+	client := &fakeClient{}
+	cfg := plugin.AggregationConfig{TimeoutSeconds: 1}
+	summary, err := Run(context.Background(), client, []plugin.Interface{p}, cfg, "heptio-sonobuoy-test", dir, RunOptions{InProcess: srv})
+	if err == nil || !strings.Contains(err.Error(), "1 of the expected results never arrived: e2e") {
+		t.Errorf("expected a timeout error listing the missing result, got %v", err)
+	}
+	missing := false
+	for _, patch := range client.patches {
+		if strings.Contains(string(patch), MissingAnnotationName) && strings.Contains(string(patch), `{\"plugin\":\"e2e\"}`) {
+			missing = true
+		}
+	}
+	if !missing {
+		t.Error("expected the missing results to be annotated")
+	}
+	if len(summary.TimedOut) != 1 || summary.TimedOut[0] != "e2e" {
+		t.Errorf("expected e2e to time out, got %v", summary.TimedOut)
+	}
+	if !p.cleanedUp {
+		t.Error("expected plugin to be cleaned up")
+	}
+}
+
+func TestInProcessServer_unexpectedResult(t *testing.T) {
+	srv := NewInProcessServer()
+	if _, err := srv.Submit("", "e2e", "application/json", strings.NewReader("{}")); err == nil {
+		t.Error("expected an error before the server is running")
+	}
+
+	aggr := NewAggregator("", []plugin.ExpectedResult{{ResultType: "e2e"}})
+	srv.serve(NewHandler(aggr.HandleHTTPResult))
+	status, err := srv.Submit("node1", "systemd_logs", "application/json", strings.NewReader("{}"))
+	if err == nil {
+		t.Error("expected an error for an unexpected result")
+	}
+	if status != http.StatusForbidden {
+		t.Errorf("expected status %v, got %v", http.StatusForbidden, status)
+	}
+}
@@ -0,0 +1,134 @@
+/*
+Copyright 2018 Heptio Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package aggregation
+
+import (
+	"encoding/xml"
+	"io"
+	"strconv"
+
+	"github.com/heptio/sonobuoy/pkg/plugin"
+	"github.com/pkg/errors"
+)
+
+// JUnitReducer merges JUnit XML reports into one, with a <testsuites> root
+// holding every suite of each report. Suites are copied as they are, except
+// that those without a hostname are given the node of their result, and the
+// root totals the tests, failures, errors, skipped tests and time of them.
+type JUnitReducer struct{}
+
+// Filename is the name of the merged report (to adhere to Reducer).
+func (JUnitReducer) Filename() string { return "junit.xml" }
+
+// Format is the format of the merged report (to adhere to Reducer).
+func (JUnitReducer) Format() string { return plugin.ResultFormatJUnit }
+
+// junitSuites is the <testsuites> root of a JUnit report.
+type junitSuites struct {
+	XMLName xml.Name     `xml:"testsuites"`
+	Attrs   []xml.Attr   `xml:",any,attr"`
+	Suites  []junitSuite `xml:"testsuite"`
+}
+
+// junitSuite is a <testsuite>, keeping all of its attributes and content.
+type junitSuite struct {
+	XMLName xml.Name   `xml:"testsuite"`
+	Attrs   []xml.Attr `xml:",any,attr"`
+	Inner   []byte     `xml:",innerxml"`
+}
+
+// attr returns the value of the suite's attribute with the given name.
+func (s *junitSuite) attr(name string) (string, bool) {
+	for _, a := range s.Attrs {
+		if a.Name.Local == name {
+			return a.Value, true
+		}
+	}
+	return "", false
+}
+
+// Reduce writes a report with the suites of each of the results (to adhere
+// to Reducer). A result which isn't a JUnit report fails the merge.
+func (JUnitReducer) Reduce(results []ReducerInput, w io.Writer) error {
+	var suites []junitSuite
+	for _, result := range results {
+		parsed, err := parseJUnitSuites(result.Body)
+		if err != nil {
+			return errors.Wrapf(err, "couldn't parse the JUnit report of node %q", result.NodeName)
+		}
+		for _, suite := range parsed {
+			if _, ok := suite.attr("hostname"); !ok && result.NodeName != "" {
+				suite.Attrs = append(suite.Attrs, xml.Attr{Name: xml.Name{Local: "hostname"}, Value: result.NodeName})
+			}
+			suites = append(suites, suite)
+		}
+	}
+
+	merged := junitSuites{Suites: suites}
+	var seconds float64
+	counts := []string{"tests", "failures", "errors", "skipped"}
+	totals := make([]int, len(counts))
+	for i := range suites {
+		for j, name := range counts {
+			if v, ok := suites[i].attr(name); ok {
+				n, _ := strconv.Atoi(v)
+				totals[j] += n
+			}
+		}
+		if v, ok := suites[i].attr("time"); ok {
+			t, _ := strconv.ParseFloat(v, 64)
+			seconds += t
+		}
+	}
+	for j, name := range counts {
+		merged.Attrs = append(merged.Attrs, xml.Attr{Name: xml.Name{Local: name}, Value: strconv.Itoa(totals[j])})
+	}
+	merged.Attrs = append(merged.Attrs, xml.Attr{Name: xml.Name{Local: "time"}, Value: strconv.FormatFloat(seconds, 'f', -1, 64)})
+
+	if _, err := io.WriteString(w, xml.Header); err != nil {
+		return err
+	}
+	enc := xml.NewEncoder(w)
+	enc.Indent("", "  ")
+	return errors.Wrap(enc.Encode(merged), "couldn't encode the merged JUnit report")
+}
+
+// parseJUnitSuites returns the suites of a JUnit report, whose root may be
+// either a <testsuites> or a single <testsuite>.
+func parseJUnitSuites(body []byte) ([]junitSuite, error) {
+	var root struct {
+		XMLName xml.Name
+	}
+	if err := xml.Unmarshal(body, &root); err != nil {
+		return nil, err
+	}
+	switch root.XMLName.Local {
+	case "testsuites":
+		var suites junitSuites
+		if err := xml.Unmarshal(body, &suites); err != nil {
+			return nil, err
+		}
+		return suites.Suites, nil
+	case "testsuite":
+		var suite junitSuite
+		if err := xml.Unmarshal(body, &suite); err != nil {
+			return nil, err
+		}
+		return []junitSuite{suite}, nil
+	}
+	return nil, errors.Errorf("expected a <testsuites> or <testsuite> root, got <%v>", root.XMLName.Local)
+}
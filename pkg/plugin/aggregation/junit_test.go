@@ -0,0 +1,93 @@
+/*
+Copyright 2018 Heptio Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package aggregation
+
+import (
+	"bytes"
+	"encoding/xml"
+	"strings"
+	"testing"
+)
+
+func TestJUnitReducer(t *testing.T) {
+	results := []ReducerInput{
+		{NodeName: "node1", Body: []byte(`<?xml version="1.0" encoding="UTF-8"?>
+<testsuites>
+  <testsuite name="conformance" tests="3" failures="1" skipped="1" time="1.5">
+    <properties><property name="version" value="v1.14"/></properties>
+    <testcase name="passes" time="0.5"/>
+    <testcase name="fails" time="1"><failure type="Failure">expected true</failure></testcase>
+    <testcase name="skips"><skipped/></testcase>
+  </testsuite>
+  <testsuite name="serial" tests="1" time="2"><testcase name="serial"/></testsuite>
+</testsuites>`)},
+		{NodeName: "node2", Body: []byte(`<testsuite name="conformance" hostname="worker-2" tests="2" errors="1" time="0.25"><testcase name="errors"><error/></testcase></testsuite>`)},
+	}
+
+	var merged bytes.Buffer
+	if err := (JUnitReducer{}).Reduce(results, &merged); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	var report struct {
+		XMLName xml.Name `xml:"testsuites"`
+		Tests   int      `xml:"tests,attr"`
+		Fail    int      `xml:"failures,attr"`
+		Errors  int      `xml:"errors,attr"`
+		Skipped int      `xml:"skipped,attr"`
+		Time    float64  `xml:"time,attr"`
+		Suites  []struct {
+			Name     string `xml:"name,attr"`
+			Hostname string `xml:"hostname,attr"`
+			Cases    []struct {
+				Name    string    `xml:"name,attr"`
+				Failure *struct{} `xml:"failure"`
+			} `xml:"testcase"`
+			Properties []struct {
+				Name string `xml:"name,attr"`
+			} `xml:"properties>property"`
+		} `xml:"testsuite"`
+	}
+	if err := xml.Unmarshal(merged.Bytes(), &report); err != nil {
+		t.Fatalf("couldn't decode merged report %s: %v", merged.Bytes(), err)
+	}
+	if report.Tests != 6 || report.Fail != 1 || report.Errors != 1 || report.Skipped != 1 || report.Time != 3.75 {
+		t.Errorf("expected the totals of every suite, got %+v", report)
+	}
+	if len(report.Suites) != 3 {
+		t.Fatalf("expected every suite to be merged, got %s", merged.Bytes())
+	}
+	suite := report.Suites[0]
+	if suite.Name != "conformance" || suite.Hostname != "node1" || len(suite.Cases) != 3 || suite.Cases[1].Failure == nil || len(suite.Properties) != 1 {
+		t.Errorf("expected the first suite to be kept as it was, with its node, got %+v", suite)
+	}
+	if hostname := report.Suites[2].Hostname; hostname != "worker-2" {
+		t.Errorf("expected a suite's own hostname to be kept, got %q", hostname)
+	}
+}
+
+func TestJUnitReducer_invalid(t *testing.T) {
+	for desc, body := range map[string]string{
+		"not XML":       "ok",
+		"not JUnit XML": "<html></html>",
+	} {
+		err := (JUnitReducer{}).Reduce([]ReducerInput{{NodeName: "node1", Body: []byte(body)}}, &bytes.Buffer{})
+		if err == nil || !strings.Contains(err.Error(), `node "node1"`) {
+			t.Errorf("%v: expected an error naming the node, got %v", desc, err)
+		}
+	}
+}
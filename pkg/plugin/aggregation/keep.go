@@ -0,0 +1,218 @@
+/*
+Copyright 2018 Heptio Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package aggregation
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"k8s.io/client-go/kubernetes"
+
+	"github.com/heptio/sonobuoy/pkg/plugin"
+)
+
+// KeptResourcesFile is the name of the file in the meta directory listing
+// the plugins whose resources were kept rather than cleaned up.
+const KeptResourcesFile = "kept-resources.json"
+
+// KeptResources describes where to find the resources of a plugin which
+// were kept after the run, so they can be debugged and deleted by hand.
+type KeptResources struct {
+	Plugin string `json:"plugin"`
+	// Namespace is the namespace the plugin's pods were run in.
+	Namespace string `json:"namespace,omitempty"`
+	// LabelSelector selects the plugin's pods, by their session ID.
+	LabelSelector string `json:"labelselector,omitempty"`
+	// Failed is true if any of the plugin's results failed.
+	Failed bool `json:"failed"`
+}
+
+// resourceKeeper cleans up after plugins according to a KeepPluginResources
+// policy, recording the plugins which are kept instead.
+type resourceKeeper struct {
+	policy string
+	outdir string
+	log    logrus.FieldLogger
+
+	mu   sync.Mutex
+	kept map[string]KeptResources
+}
+
+// newResourceKeeper returns a resourceKeeper which records the plugins it
+// keeps in the meta directory of outdir, along with any already recorded
+// there, e.g. by the run before the plugins were cleaned up.
+func newResourceKeeper(policy, outdir string, log logrus.FieldLogger) *resourceKeeper {
+	k := &resourceKeeper{
+		policy: policy,
+		outdir: outdir,
+		log:    log,
+		kept:   map[string]KeptResources{},
+	}
+	if blob, err := ioutil.ReadFile(path.Join(outdir, metaDir, KeptResourcesFile)); err == nil {
+		var kept []KeptResources
+		if err := json.Unmarshal(blob, &kept); err == nil {
+			for _, resources := range kept {
+				k.kept[resources.Plugin] = resources
+			}
+		}
+	}
+	return k
+}
+
+// keeps returns whether the resources of a plugin are kept, given whether
+// it failed. A nil keeper cleans up after every plugin.
+func (k *resourceKeeper) keeps(failed bool) bool {
+	if k == nil {
+		return false
+	}
+	switch k.policy {
+	case plugin.KeepPluginResourcesAll:
+		return true
+	case plugin.KeepPluginResourcesOnFailure:
+		return failed
+	default:
+		return false
+	}
+}
+
+// cleanup cleans up after the plugin unless its resources are kept, in which
+// case they're logged and recorded in the meta directory.
+func (k *resourceKeeper) cleanup(ctx context.Context, client kubernetes.Interface, p plugin.Interface, failed bool) error {
+	if !k.keeps(failed) {
+		return cleanupPlugin(ctx, client, p)
+	}
+	return k.keep(p, failed)
+}
+
+// keep records that the plugin's resources were kept.
+func (k *resourceKeeper) keep(p plugin.Interface, failed bool) error {
+	kept := KeptResources{Plugin: p.GetName(), Failed: failed}
+	if namespaced, ok := p.(plugin.Namespaced); ok {
+		kept.Namespace = namespaced.GetNamespace()
+	}
+	if sessioned, ok := p.(plugin.Sessioned); ok && sessioned.GetSessionID() != "" {
+		kept.LabelSelector = plugin.SessionLabel + "=" + sessioned.GetSessionID()
+	}
+	k.log.WithFields(logrus.Fields{
+		"plugin":    kept.Plugin,
+		"namespace": kept.Namespace,
+		"selector":  kept.LabelSelector,
+		"policy":    k.policy,
+	}).Info("Keeping plugin's resources instead of cleaning up, they need to be deleted by hand")
+
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	k.kept[kept.Plugin] = kept
+	return k.write()
+}
+
+// write records the kept plugins in the meta directory. k.mu must be held
+// by the caller.
+func (k *resourceKeeper) write() error {
+	kept := make([]KeptResources, 0, len(k.kept))
+	for _, resources := range k.kept {
+		kept = append(kept, resources)
+	}
+	sort.Slice(kept, func(i, j int) bool { return kept[i].Plugin < kept[j].Plugin })
+
+	metapath := path.Join(k.outdir, metaDir)
+	if err := os.MkdirAll(metapath, 0755); err != nil {
+		return errors.Wrapf(err, "couldn't create directory %v", metapath)
+	}
+	blob, err := json.Marshal(kept)
+	if err != nil {
+		return errors.Wrap(err, "couldn't marshal kept resources")
+	}
+	file := path.Join(metapath, KeptResourcesFile)
+	return errors.Wrapf(ioutil.WriteFile(file, blob, 0644), "couldn't write kept resources to %v", file)
+}
+
+// cleanupAll cleans up after the plugins like Cleanup, other than those
+// whose resources are kept. failed holds the result types which failed.
+func (k *resourceKeeper) cleanupAll(ctx context.Context, client kubernetes.Interface, plugins []plugin.Interface, failed map[string]bool) error {
+	var cleaned []plugin.Interface
+	var errs []string
+	for _, p := range plugins {
+		isFailed := failed[p.GetResultType()]
+		if !k.keeps(isFailed) {
+			cleaned = append(cleaned, p)
+			continue
+		}
+		if err := k.keep(p, isFailed); err != nil {
+			errs = append(errs, err.Error())
+		}
+	}
+	if err := Cleanup(ctx, client, cleaned, k.log); err != nil {
+		errs = append(errs, err.Error())
+	}
+	if len(errs) > 0 {
+		return errors.New(strings.Join(errs, "; "))
+	}
+	return nil
+}
+
+// failedResultTypes returns the result types with a result which failed or
+// timed out.
+func failedResultTypes(summary *RunSummary) map[string]bool {
+	failed := map[string]bool{}
+	if summary == nil {
+		return failed
+	}
+	resultType := func(id string) string { return strings.SplitN(id, "/", 2)[0] }
+	for id := range summary.Failed {
+		failed[resultType(id)] = true
+	}
+	for _, id := range summary.TimedOut {
+		failed[resultType(id)] = true
+	}
+	return failed
+}
+
+// failedResultTypes returns the result types with a result recorded which
+// failed, not counting results missing because the run was cut short.
+func (a *Aggregator) failedResultTypes() map[string]bool {
+	a.resultsMutex.Lock()
+	defer a.resultsMutex.Unlock()
+
+	failed := map[string]bool{}
+	for _, result := range a.Results {
+		if result.IsSuccess() || strings.HasPrefix(result.Error, nodeRemovedErrorPrefix) || strings.HasPrefix(result.Error, notReportedErrorPrefix) {
+			continue
+		}
+		failed[result.ResultType] = true
+	}
+	return failed
+}
+
+// CleanupPlugins cleans up after the plugins of a run like Cleanup, except
+// for those whose resources are kept by the KeepPluginResources policy in
+// cfg: all of them, or with "on-failure" those with results which failed or
+// timed out according to summary. The kept plugins are logged, along with
+// the namespace and labels of their pods, and listed in the meta directory
+// of outdir.
+func CleanupPlugins(ctx context.Context, client kubernetes.Interface, plugins []plugin.Interface, cfg plugin.AggregationConfig, summary *RunSummary, outdir string, log logrus.FieldLogger) error {
+	keeper := newResourceKeeper(cfg.KeepPluginResources, outdir, log)
+	return keeper.cleanupAll(ctx, client, plugins, failedResultTypes(summary))
+}
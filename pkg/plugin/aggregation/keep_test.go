@@ -0,0 +1,187 @@
+/*
+Copyright 2018 Heptio Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package aggregation
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+
+	"github.com/heptio/sonobuoy/pkg/plugin"
+)
+
+// keptPlugin is a fakePlugin whose pods can be found by namespace and
+// session ID.
+type keptPlugin struct {
+	sessionPlugin
+}
+
+func (p *keptPlugin) GetNamespace() string { return "debug" }
+
+func readKeptResources(t *testing.T, dir string) []KeptResources {
+	blob, err := ioutil.ReadFile(path.Join(dir, metaDir, KeptResourcesFile))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		t.Fatalf("couldn't read kept resources: %v", err)
+	}
+	var kept []KeptResources
+	if err := json.Unmarshal(blob, &kept); err != nil {
+		t.Fatalf("couldn't decode kept resources %s: %v", blob, err)
+	}
+	return kept
+}
+
+func TestCleanupPlugins(t *testing.T) {
+	summary := &RunSummary{
+		Expected:  4,
+		Completed: []string{"e2e"},
+		Failed:    map[string]string{"systemd_logs/node1": "exit status 1"},
+		TimedOut:  []string{"slow"},
+		Removed:   []string{"gone/node2"},
+	}
+	testCases := []struct {
+		policy   string
+		wantKept []string
+	}{
+		{policy: "", wantKept: nil},
+		{policy: plugin.KeepPluginResourcesNone, wantKept: nil},
+		{policy: plugin.KeepPluginResourcesOnFailure, wantKept: []string{"slow", "systemd_logs"}},
+		{policy: plugin.KeepPluginResourcesAll, wantKept: []string{"e2e", "gone", "slow", "systemd_logs"}},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.policy, func(t *testing.T) {
+			dir, err := ioutil.TempDir("", "sonobuoy_keep_test")
+			if err != nil {
+				t.Fatalf("Could not create temp directory: %v", err)
+			}
+			defer os.RemoveAll(dir)
+
+			plugins := map[string]*fakePlugin{}
+			var ifaces []plugin.Interface
+			for _, name := range []string{"e2e", "systemd_logs", "slow", "gone"} {
+				p := &fakePlugin{name: name}
+				plugins[name] = p
+				ifaces = append(ifaces, p)
+			}
+
+			cfg := plugin.AggregationConfig{KeepPluginResources: tc.policy}
+			if err := CleanupPlugins(context.Background(), &fakeClient{}, ifaces, cfg, summary, dir, logrus.StandardLogger()); err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			var kept []string
+			for _, resources := range readKeptResources(t, dir) {
+				kept = append(kept, resources.Plugin)
+			}
+			if !reflect.DeepEqual(kept, tc.wantKept) {
+				t.Errorf("expected %v to be kept, got %v", tc.wantKept, kept)
+			}
+			keptSet := map[string]bool{}
+			for _, name := range tc.wantKept {
+				keptSet[name] = true
+			}
+			for name, p := range plugins {
+				if p.cleanedUp == keptSet[name] {
+					t.Errorf("expected %v to be cleaned up %v, got %v", name, !keptSet[name], p.cleanedUp)
+				}
+			}
+		})
+	}
+}
+
+func TestResourceKeeper_recordsWhereToFindResources(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sonobuoy_keep_test")
+	if err != nil {
+		t.Fatalf("Could not create temp directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	p := &keptPlugin{sessionPlugin{fakePlugin{name: "e2e"}}}
+	keeper := newResourceKeeper(plugin.KeepPluginResourcesOnFailure, dir, logrus.StandardLogger())
+	if err := keeper.cleanup(context.Background(), &fakeClient{}, p, true); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if p.cleanedUp {
+		t.Error("expected the failed plugin's resources to be kept")
+	}
+
+	// Plugins kept during the run are still listed once the rest are
+	// cleaned up afterwards.
+	other := &fakePlugin{name: "systemd_logs"}
+	summary := &RunSummary{Failed: map[string]string{"e2e": "timed out waiting for plugin e2e", "systemd_logs/node1": "exit status 1"}}
+	cfg := plugin.AggregationConfig{KeepPluginResources: plugin.KeepPluginResourcesOnFailure}
+	if err := CleanupPlugins(context.Background(), &fakeClient{}, []plugin.Interface{other}, cfg, summary, dir, logrus.StandardLogger()); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	want := []KeptResources{
+		{Plugin: "e2e", Namespace: "debug", LabelSelector: plugin.SessionLabel + "=abc123", Failed: true},
+		{Plugin: "systemd_logs", Failed: true},
+	}
+	if kept := readKeptResources(t, dir); !reflect.DeepEqual(kept, want) {
+		t.Errorf("expected kept resources %+v, got %+v", want, kept)
+	}
+}
+
+func TestTimeoutPlugin_keep(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sonobuoy_keep_test")
+	if err != nil {
+		t.Fatalf("Could not create temp directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	p := &fakePlugin{name: "e2e"}
+	aggr := NewAggregator(dir, p.ExpectedResults(nil))
+	keeper := newResourceKeeper(plugin.KeepPluginResourcesOnFailure, dir, logrus.StandardLogger())
+
+	resultsCh := make(chan *plugin.Result, 1)
+	timeoutPlugin(context.Background(), nil, p, aggr, keeper, time.Millisecond, resultsCh)
+
+	if p.cleanedUp {
+		t.Error("expected the resources of a plugin which timed out to be kept")
+	}
+	if len(resultsCh) != 1 {
+		t.Errorf("expected a timeout result, got %v", len(resultsCh))
+	}
+	if kept := readKeptResources(t, dir); len(kept) != 1 || kept[0].Plugin != "e2e" {
+		t.Errorf("expected e2e to be recorded as kept, got %+v", kept)
+	}
+}
+
+func TestAggregator_failedResultTypes(t *testing.T) {
+	aggr := NewAggregator("", nil)
+	aggr.Results = map[string]*plugin.Result{
+		"e2e":                {ResultType: "e2e"},
+		"systemd_logs/node1": {ResultType: "systemd_logs", NodeName: "node1", Error: "exit status 1"},
+		"systemd_logs/node2": {ResultType: "systemd_logs", NodeName: "node2"},
+		"gone/node1":         {ResultType: "gone", NodeName: "node1", Error: nodeRemovedErrorPrefix + ": node1"},
+		"partial/node1":      {ResultType: "partial", NodeName: "node1", Error: notReportedErrorPrefix + ": node1"},
+	}
+	if failed, want := aggr.failedResultTypes(), map[string]bool{"systemd_logs": true}; !reflect.DeepEqual(failed, want) {
+		t.Errorf("expected failed result types %v, got %v", want, failed)
+	}
+}
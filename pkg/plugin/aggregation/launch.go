@@ -0,0 +1,157 @@
+/*
+Copyright 2018 Heptio Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package aggregation
+
+import (
+	"context"
+	"crypto/tls"
+	"sync"
+	"time"
+
+	"github.com/heptio/sonobuoy/pkg/plugin"
+	"github.com/heptio/sonobuoy/pkg/plugin/driver/utils"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"k8s.io/client-go/kubernetes"
+)
+
+// pluginLauncher launches the plugins of a run, then watches each plugin it
+// launched for errors, its timeout, its pods not starting and, if
+// configured, its resource usage until ctx is done.
+type pluginLauncher struct {
+	ctx       context.Context
+	client    kubernetes.Interface
+	namespace string
+	cfg       plugin.AggregationConfig
+	aggr      *Aggregator
+	keeper    *resourceKeeper
+	nodes     *plugin.NodeCache
+	certs     map[string]*tls.Certificate
+	events    *eventWriter
+	stagger   *launchStagger
+	// resultsCh is sent the error results of plugins which couldn't be
+	// launched or which fail once they are.
+	resultsCh chan<- *plugin.Result
+	log       logrus.FieldLogger
+
+	mu sync.Mutex
+	// launched are the plugins which are running, which are the only ones
+	// expected to submit results for nodes joining during the run.
+	launched []plugin.Interface
+	// Resource usage collectors write to the results manifest, so they're
+	// stopped before the run returns. Dependent plugins may be launched
+	// while that happens, so collectors are only started until then.
+	usageCtx  context.Context
+	stopUsage func()
+	usage     sync.WaitGroup
+	stopped   bool
+}
+
+// launch launches the plugin, once its turn comes if launches are staggered.
+// If it can't be launched, each of its pending results fails.
+func (l *pluginLauncher) launch(p plugin.Interface) {
+	if !l.stagger.wait(l.ctx) {
+		return
+	}
+	log := l.log.WithField("plugin", p.GetName())
+	log.Info("Running plugin")
+	l.aggr.pluginStarted(p.GetResultType(), time.Now())
+	l.aggr.recordParameters(launchParameters(l.cfg, p))
+	l.aggr.diagnostics.pluginLaunched(p.GetResultType())
+	if err := runPlugin(l.client, p, l.cfg.AdvertiseAddress, l.certs[p.GetName()], pluginRunAttempts(l.cfg), l.log); err != nil {
+		err = errors.Wrapf(err, "error running plugin %v", p.GetName())
+		log.Error(err)
+		// Fail each expected result so the run doesn't wait on them
+		for _, expected := range l.aggr.pendingResults(p.GetResultType()) {
+			l.resultsCh <- utils.MakeErrorResult(expected.ResultType, map[string]interface{}{
+				"error":    err.Error(),
+				"category": utils.ClassifyError(err),
+			}, expected.NodeName)
+		}
+		return
+	}
+	l.events.emit(PluginStartedEvent, p.GetResultType(), "", RunningStatus)
+
+	l.mu.Lock()
+	l.launched = append(l.launched, p)
+	l.mu.Unlock()
+	l.watch(p)
+}
+
+// watch starts watching a plugin which was launched.
+func (l *pluginLauncher) watch(p plugin.Interface) {
+	// Have the plugin monitor for errors
+	go monitorPlugin(l.client, p, l.nodes, l.aggr, l.resultsCh)
+
+	// Plugins with a timeout of their own are timed out separately, since
+	// the run only ends once the longest timeout passes
+	if secs := l.cfg.PluginTimeouts[p.GetName()]; secs > 0 {
+		go timeoutPlugin(l.ctx, l.client, p, l.aggr, l.keeper, time.Duration(secs)*time.Second, l.resultsCh)
+	}
+	if l.cfg.PluginStartupTimeoutSeconds > 0 {
+		go watchPluginStartup(l.ctx, l.client, p, pluginNamespace(p, l.namespace), l.aggr, time.Duration(l.cfg.PluginStartupTimeoutSeconds)*time.Second, l.resultsCh)
+	}
+	if l.cfg.ResourceUsageIntervalSeconds > 0 {
+		l.mu.Lock()
+		defer l.mu.Unlock()
+		if !l.stopped {
+			if l.usageCtx == nil {
+				l.usageCtx, l.stopUsage = context.WithCancel(l.ctx)
+			}
+			l.usage.Add(1)
+			go func() {
+				defer l.usage.Done()
+				collectPluginUsage(l.usageCtx, metricsAPIUsage(l.client), p, pluginNamespace(p, l.namespace), l.aggr, time.Duration(l.cfg.ResourceUsageIntervalSeconds)*time.Second)
+			}()
+		}
+	}
+}
+
+// launchAll launches each of the plugins in turn. Staggered launches happen
+// in the background so that the run can still time out or be cancelled
+// while they're spread out.
+func (l *pluginLauncher) launchAll(plugins []plugin.Interface) {
+	launch := func() {
+		for _, p := range plugins {
+			l.launch(p)
+		}
+	}
+	if l.stagger.delay > 0 {
+		go launch()
+	} else {
+		launch()
+	}
+}
+
+// running returns the plugins which have been launched.
+func (l *pluginLauncher) running() []plugin.Interface {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return append([]plugin.Interface(nil), l.launched...)
+}
+
+// stop stops the resource usage collectors, waiting for them to return. No
+// more are started for plugins launched afterwards.
+func (l *pluginLauncher) stop() {
+	l.mu.Lock()
+	l.stopped = true
+	if l.stopUsage != nil {
+		l.stopUsage()
+	}
+	l.mu.Unlock()
+	l.usage.Wait()
+}
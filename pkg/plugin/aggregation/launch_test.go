@@ -0,0 +1,119 @@
+/*
+Copyright 2018 Heptio Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package aggregation
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+
+	"github.com/heptio/sonobuoy/pkg/plugin"
+)
+
+func TestPluginLauncher_launch(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sonobuoy_launch_test")
+	if err != nil {
+		t.Fatalf("Could not create temp directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	failing := &fakePlugin{name: "systemd_logs", nodes: []string{"node1", "node2"}, run: func(string) error {
+		return errors.New("couldn't create daemonset")
+	}}
+	ok := &fakePlugin{name: "e2e"}
+	plugins := []plugin.Interface{failing, ok}
+	aggr := NewAggregator(path.Join(dir, "plugins"), append(failing.ExpectedResults(nil), ok.ExpectedResults(nil)...))
+	aggr.manifest = newResultsManifest(dir, plugins)
+
+	resultsCh := make(chan *plugin.Result, 2)
+	l := &pluginLauncher{
+		ctx:       context.Background(),
+		client:    &fakeClient{},
+		cfg:       plugin.AggregationConfig{PluginRunAttempts: 1},
+		aggr:      aggr,
+		stagger:   &launchStagger{},
+		resultsCh: resultsCh,
+		log:       logrus.StandardLogger(),
+	}
+	defer l.stop()
+	l.launchAll(plugins)
+
+	if running := l.running(); len(running) != 1 || running[0] != ok {
+		t.Errorf("expected only e2e to be running, got %v", running)
+	}
+	// Each result of the plugin which couldn't be launched fails
+	if len(resultsCh) != 2 {
+		t.Fatalf("expected an error result for each node of systemd_logs, got %v", len(resultsCh))
+	}
+	for i := 0; i < 2; i++ {
+		result := <-resultsCh
+		if result.ResultType != "systemd_logs" || !strings.Contains(result.Error, "couldn't create daemonset") {
+			t.Errorf("expected systemd_logs to fail with the launch error, got %+v", result)
+		}
+	}
+}
+
+func TestPluginLauncher_stop(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sonobuoy_launch_test")
+	if err != nil {
+		t.Fatalf("Could not create temp directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	sampled := &sessionPlugin{fakePlugin{name: "e2e"}}
+	late := &sessionPlugin{fakePlugin{name: "systemd_logs"}}
+	plugins := []plugin.Interface{sampled, late}
+	aggr := NewAggregator(path.Join(dir, "plugins"), append(sampled.ExpectedResults(nil), late.ExpectedResults(nil)...))
+	aggr.manifest = newResultsManifest(dir, plugins)
+
+	l := &pluginLauncher{
+		ctx:       context.Background(),
+		client:    &fakeClient{},
+		cfg:       plugin.AggregationConfig{ResourceUsageIntervalSeconds: 3600},
+		aggr:      aggr,
+		stagger:   &launchStagger{},
+		resultsCh: make(chan *plugin.Result, 2),
+		log:       logrus.StandardLogger(),
+	}
+	l.launch(sampled)
+
+	stopped := make(chan struct{})
+	go func() {
+		l.stop()
+		close(stopped)
+	}()
+	select {
+	case <-stopped:
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected stopping the launcher to stop its usage collectors")
+	}
+
+	// Plugins launched once it's stopped, e.g. dependents, aren't sampled
+	l.launch(late)
+	l.usage.Wait()
+	manifest := readManifest(t, dir)
+	if len(manifest.Usage) != 1 || manifest.Usage[0].Plugin != "e2e" {
+		t.Errorf("expected only the usage of e2e to be recorded, got %+v", manifest.Usage)
+	}
+}
@@ -0,0 +1,96 @@
+/*
+Copyright 2018 Heptio Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package aggregation
+
+import (
+	"fmt"
+	"path"
+	"strings"
+
+	"github.com/heptio/sonobuoy/pkg/plugin"
+	"github.com/pkg/errors"
+)
+
+// ResultsLayout decides where each result is written within the plugins
+// directory of the results. Archive results are extracted to a directory at
+// the path, other results are written to a file there.
+type ResultsLayout interface {
+	// ResultPath returns the slash separated path of the result relative to
+	// the plugins directory, without a file extension. Every result,
+	// including each partial result, must have a distinct path, and each
+	// artifact must be within the path of the result it's part of.
+	ResultPath(result *plugin.Result) string
+}
+
+// NestedLayout is the default layout, which groups results by result type
+// and then outcome, e.g. systemd_logs/results/node1 or e2e/errors.
+type NestedLayout struct{}
+
+// ResultPath returns result.Path().
+func (NestedLayout) ResultPath(result *plugin.Result) string {
+	return result.Path()
+}
+
+// FlatLayout writes every result directly in the plugins directory, naming
+// it after its result type, node and outcome, e.g. systemd_logs_node1 or
+// e2e_error.
+type FlatLayout struct{}
+
+// ResultPath returns the flat path of the result.
+func (FlatLayout) ResultPath(result *plugin.Result) string {
+	parts := []string{result.ResultType}
+	if result.NodeName != "" {
+		parts = append(parts, result.NodeName)
+	}
+	switch {
+	case result.Artifact:
+		// A result made of artifacts is a directory of them, like an
+		// extracted archive
+		return path.Join(flatName(parts), result.Filename)
+	case result.Partial && result.Filename != "":
+		parts = append(parts, "partial", result.Filename)
+	case result.Partial:
+		parts = append(parts, "partial", fmt.Sprintf("%08d", result.Sequence))
+	case !result.IsSuccess():
+		parts = append(parts, "error")
+	case result.Filename != "":
+		parts = append(parts, result.Filename)
+	}
+	return flatName(parts)
+}
+
+// flatName joins the parts of a flat path. Neither the result type nor the
+// node should contain a slash, but never write outside the plugins directory
+// if they do.
+func flatName(parts []string) string {
+	return strings.Replace(strings.Join(parts, "_"), "/", "_", -1)
+}
+
+// layoutFor returns the ResultsLayout with the given name, as configured by
+// plugin.AggregationConfig.ResultsLayout.
+func layoutFor(name string) (ResultsLayout, error) {
+	switch name {
+	case "", plugin.ResultsLayoutNested:
+		return NestedLayout{}, nil
+	case plugin.ResultsLayoutFlat:
+		return FlatLayout{}, nil
+	case plugin.ResultsLayoutTopology:
+		return TopologyLayout{}, nil
+	default:
+		return nil, errors.Errorf("unknown results layout %q", name)
+	}
+}
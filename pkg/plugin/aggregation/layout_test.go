@@ -0,0 +1,112 @@
+/*
+Copyright 2018 Heptio Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package aggregation
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"testing"
+
+	"github.com/heptio/sonobuoy/pkg/plugin"
+	pluginutils "github.com/heptio/sonobuoy/pkg/plugin/driver/utils"
+)
+
+func TestFlatLayout(t *testing.T) {
+	testCases := []struct {
+		desc   string
+		result *plugin.Result
+		want   string
+	}{
+		{desc: "global", result: &plugin.Result{ResultType: "e2e"}, want: "e2e"},
+		{desc: "global error", result: &plugin.Result{ResultType: "e2e", Error: "foo"}, want: "e2e_error"},
+		{desc: "node", result: &plugin.Result{ResultType: "systemd_logs", NodeName: "node1"}, want: "systemd_logs_node1"},
+		{desc: "node error", result: &plugin.Result{ResultType: "systemd_logs", NodeName: "node1", Error: "foo"}, want: "systemd_logs_node1_error"},
+		{desc: "partial", result: &plugin.Result{ResultType: "systemd_logs", NodeName: "node1", Partial: true, Sequence: 3}, want: "systemd_logs_node1_partial_00000003"},
+		{desc: "slashes", result: &plugin.Result{ResultType: "../e2e"}, want: ".._e2e"},
+		{desc: "named", result: &plugin.Result{ResultType: "e2e", Filename: "reports/junit.xml"}, want: "e2e_reports_junit.xml"},
+		{desc: "artifact", result: &plugin.Result{ResultType: "systemd_logs", NodeName: "node1", Artifact: true, Filename: "screenshots/a.png"}, want: "systemd_logs_node1/screenshots/a.png"},
+		{desc: "done", result: &plugin.Result{ResultType: "systemd_logs", NodeName: "node1", Done: true}, want: "systemd_logs_node1"},
+		{desc: "named partial", result: &plugin.Result{ResultType: "systemd_logs", NodeName: "node1", Partial: true, Filename: "dump.json"}, want: "systemd_logs_node1_partial_dump.json"},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.desc, func(t *testing.T) {
+			if got := (FlatLayout{}).ResultPath(tc.result); got != tc.want {
+				t.Errorf("expected %v, got %v", tc.want, got)
+			}
+		})
+	}
+}
+
+func TestLayoutFor(t *testing.T) {
+	for name, want := range map[string]ResultsLayout{
+		"":                           NestedLayout{},
+		plugin.ResultsLayoutNested:   NestedLayout{},
+		plugin.ResultsLayoutFlat:     FlatLayout{},
+		plugin.ResultsLayoutTopology: TopologyLayout{},
+	} {
+		got, err := layoutFor(name)
+		if err != nil || got != want {
+			t.Errorf("expected layout %q to be %T, got %T: %v", name, want, got, err)
+		}
+	}
+	if _, err := layoutFor("per-node"); err == nil {
+		t.Error("expected an error for an unknown layout")
+	}
+}
+
+// prefixLayout is a custom layout, putting every result in one directory.
+type prefixLayout struct{}
+
+func (prefixLayout) ResultPath(result *plugin.Result) string {
+	return path.Join("custom", FlatLayout{}.ResultPath(result))
+}
+
+func TestAggregation_layout(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sonobuoy_layout_test")
+	if err != nil {
+		t.Fatalf("Could not create temp directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	expected := []plugin.ExpectedResult{
+		{NodeName: "node1", ResultType: "systemd_logs"},
+		{NodeName: "node2", ResultType: "systemd_logs"},
+	}
+	aggr := NewAggregator(path.Join(dir, "plugins"), expected)
+	aggr.Layout = prefixLayout{}
+	aggr.manifest = newResultsManifest(dir, nil)
+
+	resultsCh := make(chan *plugin.Result, 2)
+	resultsCh <- &plugin.Result{ResultType: "systemd_logs", NodeName: "node1", Body: strings.NewReader("foo")}
+	resultsCh <- pluginutils.MakeErrorResult("systemd_logs", map[string]interface{}{"error": "foo"}, "node2")
+	close(resultsCh)
+	aggr.IngestResults(resultsCh)
+
+	for _, p := range []string{"custom/systemd_logs_node1", "custom/systemd_logs_node2_error"} {
+		if _, err := os.Stat(path.Join(dir, "plugins", p)); err != nil {
+			t.Errorf("expected a result at %v: %v", p, err)
+		}
+	}
+
+	manifest := readManifest(t, dir)
+	if len(manifest.Results) != 2 || len(manifest.Results[0].Files) != 1 || manifest.Results[0].Files[0].Path != "plugins/custom/systemd_logs_node1" {
+		t.Errorf("expected the manifest to follow the layout, got %+v", manifest.Results)
+	}
+}
@@ -0,0 +1,57 @@
+/*
+Copyright 2018 Heptio Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package aggregation
+
+import (
+	"io"
+	"io/ioutil"
+	"net/http"
+)
+
+// limitedReader counts the bytes read from the body of a result so that the
+// error http.MaxBytesReader returns once the body passes the size limit can
+// be told apart from an error reading it, since MaxBytesReader's error has
+// no type of its own. MaxBytesReader reads one byte more than the limit to
+// find out whether the body is larger, so more than the limit being read
+// means it was.
+type limitedReader struct {
+	io.Reader
+	limit int64
+	read  int64
+}
+
+func (r *limitedReader) Read(p []byte) (int, error) {
+	n, err := r.Reader.Read(p)
+	r.read += int64(n)
+	return n, err
+}
+
+// exceeded returns true if the body was found to be larger than the limit.
+func (r *limitedReader) exceeded() bool {
+	return r.read > r.limit
+}
+
+// limitResultSize limits body to MaxResultSizeBytes, returning the limited
+// body along with the reader counting it. The body is returned as it is,
+// with a nil reader, if there's no limit.
+func (a *Aggregator) limitResultSize(body io.Reader, w http.ResponseWriter) (io.Reader, *limitedReader) {
+	if a.MaxResultSizeBytes <= 0 {
+		return body, nil
+	}
+	counted := &limitedReader{Reader: body, limit: a.MaxResultSizeBytes}
+	return http.MaxBytesReader(w, ioutil.NopCloser(counted), a.MaxResultSizeBytes), counted
+}
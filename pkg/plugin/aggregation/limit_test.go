@@ -0,0 +1,63 @@
+/*
+Copyright 2018 Heptio Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package aggregation
+
+import (
+	"io"
+	"io/ioutil"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/pkg/errors"
+)
+
+func TestLimitResultSize(t *testing.T) {
+	errDropped := errors.New("connection dropped")
+	testCases := []struct {
+		desc         string
+		body         io.Reader
+		wantExceeded bool
+		wantReadErr  bool
+	}{
+		{desc: "under the limit", body: strings.NewReader("small")},
+		{desc: "at the limit", body: strings.NewReader("8 bytes!")},
+		{desc: "over the limit", body: strings.NewReader("way too large"), wantExceeded: true},
+		{
+			desc:        "upload fails at the limit",
+			body:        io.MultiReader(strings.NewReader("8 bytes!"), dropReader{errDropped}),
+			wantReadErr: true,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.desc, func(t *testing.T) {
+			agg := &Aggregator{MaxResultSizeBytes: 8}
+			body := &resultBody{}
+			body.Reader, body.limited = agg.limitResultSize(tc.body, httptest.NewRecorder())
+			ioutil.ReadAll(body)
+			if body.exceeded != tc.wantExceeded || (body.readErr != nil) != tc.wantReadErr {
+				t.Errorf("expected exceeded %v and read error %v, got %v and %v", tc.wantExceeded, tc.wantReadErr, body.exceeded, body.readErr)
+			}
+		})
+	}
+}
+
+// dropReader fails every read with its error, as a dropped upload would.
+type dropReader struct{ err error }
+
+func (r dropReader) Read([]byte) (int, error) { return 0, r.err }
@@ -0,0 +1,493 @@
+/*
+Copyright 2018 Heptio Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package aggregation
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"github.com/heptio/sonobuoy/pkg/plugin"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+// ResultsManifestFile is the name of the file in the meta directory of the
+// results which describes every result received so far.
+const ResultsManifestFile = "results.json"
+
+// ResultsManifest describes the results received during a run, so that
+// tools can find them without walking the plugins directory.
+type ResultsManifest struct {
+	// RunID and Expires are from the run's stamp, if it has one. Expires
+	// is only set if the results have a TTL.
+	RunID   string          `json:"runid,omitempty"`
+	Expires *time.Time      `json:"expires,omitempty"`
+	Results []ManifestEntry `json:"results"`
+	// Plugins has the timing of each plugin which was launched, sorted by
+	// name.
+	Plugins []PluginTiming `json:"plugins"`
+	// Usage has the resource usage of each plugin's pods, sorted by plugin
+	// name, if it was configured to be collected.
+	Usage []PluginUsage `json:"usage,omitempty"`
+	// Parameters has what each plugin which was launched was launched
+	// with, sorted by name.
+	Parameters []PluginParameters `json:"parameters,omitempty"`
+	// Skipped has each plugin which was never launched and why, sorted by
+	// name.
+	Skipped []SkippedPlugin `json:"skipped,omitempty"`
+	// Encryption is set if result files were encrypted as they were
+	// written. Sizes are those of the encrypted files.
+	Encryption *ManifestEncryption `json:"encryption,omitempty"`
+	// Topology groups the node results by the topology label of their
+	// node, if one was configured.
+	Topology *ManifestTopology `json:"topology,omitempty"`
+	// Merged has the artifact merged from the results of each plugin which
+	// opted in to a reducer, sorted by plugin name.
+	Merged []MergedResults `json:"merged,omitempty"`
+}
+
+// MergedResults describes the artifact a reducer merged from the results of
+// a plugin once they had all arrived.
+type MergedResults struct {
+	Plugin     string `json:"plugin"`
+	ResultType string `json:"resulttype"`
+	// Format is the result format of the merged artifact, such as "junit".
+	Format string       `json:"format"`
+	File   ManifestFile `json:"file"`
+	// Results is how many results were merged. Results which failed or
+	// weren't uploaded whole are left out.
+	Results int `json:"results"`
+}
+
+// ManifestEncryption describes how result files were encrypted. Files
+// written by the aggregator itself, such as the errors recorded for failed
+// results, aren't encrypted.
+type ManifestEncryption struct {
+	Cipher string `json:"cipher"`
+	// KeyID identifies the secret the files were encrypted with, see
+	// encryption.KeyID.
+	KeyID string `json:"keyid"`
+}
+
+// PluginTiming records when a plugin was launched and when its last result
+// was received.
+type PluginTiming struct {
+	Plugin     string    `json:"plugin"`
+	ResultType string    `json:"resulttype"`
+	Started    time.Time `json:"started"`
+	// Finished and DurationSeconds are only set once every result of the
+	// plugin has been received.
+	Finished        *time.Time `json:"finished,omitempty"`
+	DurationSeconds float64    `json:"durationseconds,omitempty"`
+}
+
+// PluginParameters records the settings a plugin was launched with, after
+// defaults were applied, so that its results can be reproduced.
+type PluginParameters struct {
+	Plugin     string `json:"plugin"`
+	ResultType string `json:"resulttype"`
+	// MasterAddress is the address the plugin's workers submit results to.
+	MasterAddress string `json:"masteraddress"`
+	// TimeoutSeconds is how long the plugin had to finish, or 0 if it
+	// wasn't limited.
+	TimeoutSeconds int `json:"timeoutseconds"`
+	RunAttempts    int `json:"runattempts"`
+	// Parameters is only set for plugins which report them, see
+	// plugin.Parameterized.
+	*plugin.Parameters
+}
+
+// ManifestEntry describes a single result received by the aggregator.
+type ManifestEntry struct {
+	Plugin     string `json:"plugin"`
+	ResultType string `json:"resulttype"`
+	// Node is empty for results which aren't node-specific.
+	Node string `json:"node,omitempty"`
+	// Topology is the value of the topology label on the node, if one was
+	// configured and the node has it.
+	Topology string `json:"topology,omitempty"`
+	Status   string `json:"status"`
+	Error    string `json:"error,omitempty"`
+	// ErrorCategory classifies why a failed result failed, one of the
+	// plugin.ErrorCategory constants.
+	ErrorCategory string `json:"errorcategory,omitempty"`
+	// Format is the result format the plugin declared, such as "junit",
+	// or "raw" if it didn't. Results which failed are always "raw", since
+	// their files describe the error.
+	Format string `json:"format"`
+	// Files lists the files written for the result, with paths relative
+	// to the root of the results.
+	Files []ManifestFile `json:"files"`
+	// Size is the total size of the files, in bytes.
+	Size int64 `json:"size"`
+	// Checksum is the verified checksum of the result as it was uploaded,
+	// e.g. "sha256:<hex digest>", if the worker sent one.
+	Checksum string `json:"checksum,omitempty"`
+	// Codec is the codec the result was uploaded with, e.g. "gzip", or
+	// "identity" if it wasn't compressed. Results are always stored
+	// decompressed.
+	Codec string `json:"codec,omitempty"`
+	// OriginalSize is the size of the result in bytes as the plugin wrote
+	// it, before it was compressed for upload and before any transforms,
+	// such as encryption, were applied.
+	OriginalSize int64     `json:"originalsize,omitempty"`
+	Received     time.Time `json:"received"`
+	// DurationSeconds is the time from the plugin being launched to this
+	// result being received, e.g. how long the plugin took on this node.
+	// It is unset if the plugin was never launched.
+	DurationSeconds float64 `json:"durationseconds,omitempty"`
+	// Submitted is when the worker says it submitted the result. Since the
+	// clock of its node may be skewed, it is corrected to be between the
+	// plugin being launched and the result being received if it isn't.
+	Submitted *time.Time `json:"submitted,omitempty"`
+	// ReportedSubmitted is the time the worker sent if it was corrected.
+	ReportedSubmitted *time.Time `json:"reportedsubmitted,omitempty"`
+	// Progress is the last progress the plugin reported for the result
+	// before it was received, if any.
+	Progress *PluginProgress `json:"progress,omitempty"`
+	// Annotations is the metadata the worker sent with the result, if any.
+	Annotations map[string]string `json:"annotations,omitempty"`
+}
+
+// maxClockSkew is how far a worker's time can be out before the aggregator
+// warns that the clock of its node is skewed.
+const maxClockSkew = time.Minute
+
+// ManifestFile is a single file of a result.
+type ManifestFile struct {
+	Path string `json:"path"`
+	Size int64  `json:"size"`
+}
+
+// resultsManifest keeps the manifest in the meta directory up to date as
+// results are recorded. It is only used with the aggregator's resultsMutex
+// held. A nil resultsManifest records nothing.
+type resultsManifest struct {
+	// outdir is the root of the results
+	outdir string
+	// pluginNames maps result types to the name of their plugin
+	pluginNames map[string]string
+	// formats maps result types to the result format their plugin declared
+	formats map[string]string
+	entries map[string]ManifestEntry
+	// timings, usage and params are keyed by result type
+	timings map[string]*PluginTiming
+	usage   map[string]PluginUsage
+	params  map[string]PluginParameters
+	// skipped is keyed by result type
+	skipped map[string]SkippedPlugin
+	// progress is the last progress reported for each result, by ID
+	progress map[string]PluginProgress
+	// encryption, if set, is how result files are encrypted
+	encryption *ManifestEncryption
+	// topologyLabel, if set, is the label node results are grouped by
+	topologyLabel string
+	// merged is keyed by result type
+	merged map[string]MergedResults
+	// stamp, if set, identifies the run
+	stamp *RunStamp
+	log   logrus.FieldLogger
+}
+
+func newResultsManifest(outdir string, plugins []plugin.Interface) *resultsManifest {
+	names := make(map[string]string, len(plugins))
+	formats := map[string]string{}
+	for _, p := range plugins {
+		names[p.GetResultType()] = p.GetName()
+		if f, ok := p.(plugin.Formatted); ok && f.GetResultFormat() != "" {
+			formats[p.GetResultType()] = f.GetResultFormat()
+		}
+	}
+	return &resultsManifest{
+		outdir:      outdir,
+		pluginNames: names,
+		formats:     formats,
+		entries:     map[string]ManifestEntry{},
+		timings:     map[string]*PluginTiming{},
+		usage:       map[string]PluginUsage{},
+		params:      map[string]PluginParameters{},
+		skipped:     map[string]SkippedPlugin{},
+		progress:    map[string]PluginProgress{},
+		merged:      map[string]MergedResults{},
+		log:         logrus.StandardLogger(),
+	}
+}
+
+// pluginName returns the name of the plugin with the given result type.
+func (m *resultsManifest) pluginName(resultType string) string {
+	if name := m.pluginNames[resultType]; name != "" {
+		return name
+	}
+	return resultType
+}
+
+// start records that the plugin with the given result type was launched at
+// the given time. Only the first launch is recorded, so the timing covers
+// any retries.
+func (m *resultsManifest) start(resultType string, started time.Time) {
+	if m == nil || m.timings[resultType] != nil {
+		return
+	}
+	m.timings[resultType] = &PluginTiming{
+		Plugin:     m.pluginName(resultType),
+		ResultType: resultType,
+		Started:    started.UTC(),
+	}
+	if err := m.write(); err != nil {
+		m.log.WithError(err).Info("Couldn't write results manifest")
+	}
+}
+
+// recordParameters records what a plugin was launched with and rewrites the
+// manifest file. Like its timing, only the first launch is recorded.
+func (m *resultsManifest) recordParameters(params PluginParameters) {
+	if m == nil {
+		return
+	}
+	if _, ok := m.params[params.ResultType]; ok {
+		return
+	}
+	m.params[params.ResultType] = params
+	if err := m.write(); err != nil {
+		m.log.WithError(err).Info("Couldn't write results manifest")
+	}
+}
+
+// recordProgress keeps the progress last reported for the result with the
+// given ID, to be recorded along with the result. The manifest file isn't
+// rewritten, since progress may be reported far more often than results.
+func (m *resultsManifest) recordProgress(id string, progress PluginProgress) {
+	if m == nil {
+		return
+	}
+	m.progress[id] = progress
+}
+
+// recordUsage replaces the resource usage of a plugin and rewrites the
+// manifest file.
+func (m *resultsManifest) recordUsage(usage PluginUsage) {
+	if m == nil {
+		return
+	}
+	m.usage[usage.ResultType] = usage
+	if err := m.write(); err != nil {
+		m.log.WithError(err).Info("Couldn't write results manifest")
+	}
+}
+
+// record adds the result, which has been written to resultPath, to the
+// manifest and rewrites the manifest file. If pluginDone is true, it was the
+// plugin's last result so the plugin is recorded as finished. Errors are
+// logged rather than returned since the result itself was already saved.
+func (m *resultsManifest) record(resultPath string, result *plugin.Result, pluginDone bool) {
+	if m == nil {
+		return
+	}
+
+	entry := ManifestEntry{
+		Plugin:        m.pluginName(result.ResultType),
+		ResultType:    result.ResultType,
+		Node:          result.NodeName,
+		Topology:      result.Topology,
+		Status:        resultStatus(result),
+		Error:         result.Error,
+		ErrorCategory: errorCategory(result),
+		Format:        plugin.ResultFormatRaw,
+		Files:         []ManifestFile{},
+		Received:      time.Now().UTC(),
+		Annotations:   result.Annotations,
+	}
+	if format := m.formats[result.ResultType]; format != "" && result.IsSuccess() {
+		entry.Format = format
+	}
+	// Workers' times are only plausible after the epoch, and after the
+	// plugin was launched if it was.
+	earliest := time.Unix(0, 0).UTC()
+	if timing := m.timings[result.ResultType]; timing != nil {
+		// Workers only send times to the second
+		earliest = timing.Started.Truncate(time.Second)
+		entry.DurationSeconds = entry.Received.Sub(timing.Started).Seconds()
+		if pluginDone && timing.Finished == nil {
+			finished := entry.Received
+			timing.Finished = &finished
+			timing.DurationSeconds = entry.DurationSeconds
+		}
+	}
+	if !result.Submitted.IsZero() {
+		submitted, skew := clampSubmitted(result.Submitted, earliest, entry.Received)
+		entry.Submitted = &submitted
+		if skew > 0 {
+			reported := result.Submitted
+			entry.ReportedSubmitted = &reported
+		}
+		if skew > maxClockSkew {
+			m.log.WithFields(resultFields(result)).WithField("submitted", result.Submitted).WithField("skew", skew).Warning("Worker's clock appears to be skewed, check NTP on its node")
+		}
+	}
+	if progress, ok := m.progress[result.ExpectedResultID()]; ok {
+		entry.Progress = &progress
+	}
+	// Results which don't match their checksum are replaced by an error
+	// before they are recorded, so this checksum has been verified.
+	if result.Checksum != "" {
+		entry.Checksum = "sha256:" + result.Checksum
+	}
+	entry.Codec = result.Codec
+	if size, ok := originalSize(result); ok {
+		entry.OriginalSize = size
+	}
+
+	// Archives are extracted to a directory, other results are a single
+	// file.
+	err := filepath.Walk(resultPath, func(p string, info os.FileInfo, err error) error {
+		if err != nil || info.IsDir() {
+			return err
+		}
+		rel, err := filepath.Rel(m.outdir, p)
+		if err != nil {
+			return err
+		}
+		entry.Files = append(entry.Files, ManifestFile{Path: filepath.ToSlash(rel), Size: info.Size()})
+		entry.Size += info.Size()
+		return nil
+	})
+	if err != nil && !os.IsNotExist(err) {
+		m.log.WithFields(resultFields(result)).WithError(err).Info("Couldn't list the files of result for the results manifest")
+	}
+
+	m.entries[result.ExpectedResultID()] = entry
+	if err := m.write(); err != nil {
+		m.log.WithError(err).Info("Couldn't write results manifest")
+	}
+}
+
+// recordMerged records the artifact merged from the results of the given
+// type, which was written to file, and rewrites the manifest file.
+func (m *resultsManifest) recordMerged(file, resultType, format string, results int) {
+	if m == nil {
+		return
+	}
+	merged := MergedResults{
+		Plugin:     m.pluginName(resultType),
+		ResultType: resultType,
+		Format:     format,
+		Results:    results,
+	}
+	rel, err := filepath.Rel(m.outdir, file)
+	if err == nil {
+		var info os.FileInfo
+		if info, err = os.Stat(file); err == nil {
+			merged.File = ManifestFile{Path: filepath.ToSlash(rel), Size: info.Size()}
+		}
+	}
+	if err != nil {
+		m.log.WithField("resulttype", resultType).WithError(err).Info("Couldn't describe the merged results for the results manifest")
+	}
+	m.merged[resultType] = merged
+	if err := m.write(); err != nil {
+		m.log.WithError(err).Info("Couldn't write results manifest")
+	}
+}
+
+// clampSubmitted returns the time a worker submitted a result, corrected to
+// be between earliest and latest, and how far outside of them it was.
+func clampSubmitted(submitted, earliest, latest time.Time) (time.Time, time.Duration) {
+	switch {
+	case submitted.Before(earliest):
+		return earliest, earliest.Sub(submitted)
+	case submitted.After(latest):
+		return latest, submitted.Sub(latest)
+	}
+	return submitted, 0
+}
+
+// write replaces the manifest file with the current entries, sorted by
+// result ID.
+func (m *resultsManifest) write() error {
+	ids := make([]string, 0, len(m.entries))
+	for id := range m.entries {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+
+	manifest := ResultsManifest{
+		Results:    make([]ManifestEntry, 0, len(ids)),
+		Plugins:    make([]PluginTiming, 0, len(m.timings)),
+		Encryption: m.encryption,
+	}
+	if m.stamp != nil {
+		manifest.RunID, manifest.Expires = m.stamp.RunID, m.stamp.Expires
+	}
+	for _, id := range ids {
+		manifest.Results = append(manifest.Results, m.entries[id])
+	}
+	if m.topologyLabel != "" {
+		manifest.Topology = groupByTopology(m.topologyLabel, m.entries)
+	}
+	for _, timing := range m.timings {
+		manifest.Plugins = append(manifest.Plugins, *timing)
+	}
+	sort.Slice(manifest.Plugins, func(i, j int) bool {
+		return manifest.Plugins[i].Plugin < manifest.Plugins[j].Plugin
+	})
+	for _, usage := range m.usage {
+		manifest.Usage = append(manifest.Usage, usage)
+	}
+	sort.Slice(manifest.Usage, func(i, j int) bool {
+		return manifest.Usage[i].Plugin < manifest.Usage[j].Plugin
+	})
+	for _, params := range m.params {
+		manifest.Parameters = append(manifest.Parameters, params)
+	}
+	sort.Slice(manifest.Parameters, func(i, j int) bool {
+		return manifest.Parameters[i].Plugin < manifest.Parameters[j].Plugin
+	})
+	for _, skipped := range m.skipped {
+		manifest.Skipped = append(manifest.Skipped, skipped)
+	}
+	sortSkipped(manifest.Skipped)
+	for _, merged := range m.merged {
+		manifest.Merged = append(manifest.Merged, merged)
+	}
+	sort.Slice(manifest.Merged, func(i, j int) bool {
+		return manifest.Merged[i].Plugin < manifest.Merged[j].Plugin
+	})
+
+	blob, err := json.Marshal(manifest)
+	if err != nil {
+		return errors.Wrap(err, "couldn't marshal results manifest")
+	}
+
+	metapath := path.Join(m.outdir, metaDir)
+	if err := os.MkdirAll(metapath, 0755); err != nil {
+		return errors.Wrapf(err, "couldn't create directory %v", metapath)
+	}
+
+	// Write to a temporary file first so readers never see a partial
+	// manifest.
+	file := path.Join(metapath, ResultsManifestFile)
+	tmp := file + ".tmp"
+	if err := ioutil.WriteFile(tmp, blob, 0644); err != nil {
+		return errors.Wrapf(err, "couldn't write results manifest to %v", tmp)
+	}
+	return errors.Wrapf(os.Rename(tmp, file), "couldn't write results manifest to %v", file)
+}
@@ -0,0 +1,250 @@
+/*
+Copyright 2018 Heptio Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package aggregation
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"net/http/httptest"
+	"os"
+	"path"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/heptio/sonobuoy/pkg/plugin"
+	pluginutils "github.com/heptio/sonobuoy/pkg/plugin/driver/utils"
+	testhook "github.com/sirupsen/logrus/hooks/test"
+)
+
+func readManifest(t *testing.T, outdir string) ResultsManifest {
+	blob, err := ioutil.ReadFile(path.Join(outdir, metaDir, ResultsManifestFile))
+	if err != nil {
+		t.Fatalf("couldn't read results manifest: %v", err)
+	}
+	var manifest ResultsManifest
+	if err := json.Unmarshal(blob, &manifest); err != nil {
+		t.Fatalf("couldn't unmarshal results manifest %q: %v", blob, err)
+	}
+	return manifest
+}
+
+type formattedPlugin struct {
+	fakePlugin
+	format string
+}
+
+func (p *formattedPlugin) GetResultFormat() string { return p.format }
+
+func TestResultsManifest(t *testing.T) {
+	outdir, err := ioutil.TempDir("", "sonobuoy_manifest_test")
+	if err != nil {
+		t.Fatalf("Could not create temp directory: %v", err)
+	}
+	defer os.RemoveAll(outdir)
+
+	p := &formattedPlugin{fakePlugin{name: "systemd_logs", nodes: []string{"node1", "node2"}}, "journald"}
+	aggr := NewAggregator(path.Join(outdir, "plugins"), p.ExpectedResults(nil))
+	aggr.manifest = newResultsManifest(outdir, []plugin.Interface{p})
+	started := time.Now().Add(-time.Minute)
+	aggr.pluginStarted("systemd_logs", started)
+
+	// The plugin's start is recorded when it's launched, before any results
+	manifest := readManifest(t, outdir)
+	if len(manifest.Plugins) != 1 || !manifest.Plugins[0].Started.Equal(started) || manifest.Plugins[0].Finished != nil {
+		t.Fatalf("expected the plugin to have started but not finished, got %+v", manifest.Plugins)
+	}
+
+	sum := sha256.Sum256([]byte("some logs"))
+	checksum := hex.EncodeToString(sum[:])
+	w := httptest.NewRecorder()
+	aggr.HandleHTTPResult(&plugin.Result{
+		NodeName:   "node1",
+		ResultType: "systemd_logs",
+		Body:       strings.NewReader("some logs"),
+		Checksum:   checksum,
+	}, w)
+	if w.Code != 200 {
+		t.Fatalf("expected a 200 response, got %v: %v", w.Code, w.Body.String())
+	}
+
+	// The manifest should be written as soon as the first result arrives
+	manifest = readManifest(t, outdir)
+	if len(manifest.Results) != 1 {
+		t.Fatalf("expected 1 result in the manifest, got %+v", manifest.Results)
+	}
+	entry := manifest.Results[0]
+	if entry.Plugin != "systemd_logs" || entry.Node != "node1" || entry.Status != CompleteStatus {
+		t.Errorf("unexpected manifest entry %+v", entry)
+	}
+	if entry.Format != "journald" {
+		t.Errorf("expected the plugin's result format to be recorded as is, got %q", entry.Format)
+	}
+	if len(entry.Files) != 1 || entry.Files[0].Path != "plugins/systemd_logs/results/node1" || entry.Files[0].Size != 9 {
+		t.Errorf("expected the manifest to list the result file, got %+v", entry.Files)
+	}
+	if entry.Size != 9 {
+		t.Errorf("expected a size of 9 bytes, got %v", entry.Size)
+	}
+	if entry.Checksum != "sha256:"+checksum {
+		t.Errorf("expected the verified checksum in the manifest, got %q", entry.Checksum)
+	}
+	if entry.Received.IsZero() {
+		t.Error("expected the manifest entry to have a timestamp")
+	}
+	if entry.DurationSeconds < 60 {
+		t.Errorf("expected the result to have taken at least a minute, got %vs", entry.DurationSeconds)
+	}
+	if manifest.Plugins[0].Finished != nil {
+		t.Errorf("expected the plugin not to have finished with a result outstanding, got %+v", manifest.Plugins[0])
+	}
+
+	resultsCh := make(chan *plugin.Result, 1)
+	resultsCh <- pluginutils.MakeErrorResult("systemd_logs", map[string]interface{}{"error": "pod failed", "category": plugin.ErrorCategoryCrash}, "node2")
+	close(resultsCh)
+	aggr.IngestResults(resultsCh)
+
+	manifest = readManifest(t, outdir)
+	if len(manifest.Results) != 2 {
+		t.Fatalf("expected 2 results in the manifest, got %+v", manifest.Results)
+	}
+	entry = manifest.Results[1]
+	if entry.Node != "node2" || entry.Status != FailedStatus || entry.Error != "pod failed" || entry.ErrorCategory != plugin.ErrorCategoryCrash || entry.Format != plugin.ResultFormatRaw {
+		t.Errorf("unexpected manifest entry %+v", entry)
+	}
+	if len(entry.Files) != 1 || entry.Files[0].Path != "plugins/systemd_logs/errors/node2" {
+		t.Errorf("expected the manifest to list the error file, got %+v", entry.Files)
+	}
+
+	// The last result finishes the plugin
+	timing := manifest.Plugins[0]
+	if timing.Finished == nil || !timing.Finished.Equal(entry.Received) {
+		t.Fatalf("expected the plugin to finish when its last result was received at %v, got %+v", entry.Received, timing)
+	}
+	if timing.DurationSeconds != entry.DurationSeconds {
+		t.Errorf("expected plugin duration %v, got %v", entry.DurationSeconds, timing.DurationSeconds)
+	}
+}
+
+func TestResultsManifest_submitted(t *testing.T) {
+	outdir, err := ioutil.TempDir("", "sonobuoy_manifest_test")
+	if err != nil {
+		t.Fatalf("Could not create temp directory: %v", err)
+	}
+	defer os.RemoveAll(outdir)
+
+	started := time.Now().Add(-time.Hour).UTC().Truncate(time.Second)
+	testCases := []struct {
+		node         string
+		submitted    time.Time
+		expectRaw    bool
+		expectWarned bool
+	}{
+		{node: "plausible", submitted: started.Add(time.Minute)},
+		{node: "slightly-ahead", submitted: time.Now().Add(time.Second).UTC(), expectRaw: true},
+		{node: "future", submitted: time.Now().Add(time.Hour).UTC(), expectRaw: true, expectWarned: true},
+		{node: "epoch", submitted: time.Unix(0, 0).UTC(), expectRaw: true, expectWarned: true},
+		{node: "unset"},
+	}
+
+	var nodes []string
+	for _, tc := range testCases {
+		nodes = append(nodes, tc.node)
+	}
+	p := &fakePlugin{name: "systemd_logs", nodes: nodes}
+	aggr := NewAggregator(path.Join(outdir, "plugins"), p.ExpectedResults(nil))
+	logger, hook := testhook.NewNullLogger()
+	aggr.manifest = newResultsManifest(outdir, []plugin.Interface{p})
+	aggr.manifest.log = logger
+	aggr.pluginStarted("systemd_logs", started)
+
+	for _, tc := range testCases {
+		t.Run(tc.node, func(t *testing.T) {
+			hook.Reset()
+			w := httptest.NewRecorder()
+			aggr.HandleHTTPResult(&plugin.Result{
+				NodeName:   tc.node,
+				ResultType: "systemd_logs",
+				Body:       strings.NewReader("some logs"),
+				Submitted:  tc.submitted,
+			}, w)
+			if w.Code != 200 {
+				t.Fatalf("expected a 200 response, got %v: %v", w.Code, w.Body.String())
+			}
+
+			var entry ManifestEntry
+			for _, e := range readManifest(t, outdir).Results {
+				if e.Node == tc.node {
+					entry = e
+				}
+			}
+			switch {
+			case tc.submitted.IsZero():
+				if entry.Submitted != nil {
+					t.Errorf("expected no submitted time, got %v", entry.Submitted)
+				}
+			case entry.Submitted == nil:
+				t.Fatal("expected a submitted time")
+			case entry.Submitted.Before(started) || entry.Submitted.After(entry.Received):
+				t.Errorf("expected submitted time %v to be between %v and %v", entry.Submitted, started, entry.Received)
+			}
+			if got := entry.ReportedSubmitted != nil; got != tc.expectRaw {
+				t.Errorf("expected the reported time to be recorded: %v, got %v", tc.expectRaw, entry.ReportedSubmitted)
+			} else if got && !entry.ReportedSubmitted.Equal(tc.submitted) {
+				t.Errorf("expected reported time %v, got %v", tc.submitted, entry.ReportedSubmitted)
+			}
+			if got := len(hook.Entries) > 0; got != tc.expectWarned {
+				t.Errorf("expected a warning: %v, got %+v", tc.expectWarned, hook.Entries)
+			}
+		})
+	}
+}
+
+func TestResultsManifest_parameters(t *testing.T) {
+	outdir, err := ioutil.TempDir("", "sonobuoy_manifest_test")
+	if err != nil {
+		t.Fatalf("Could not create temp directory: %v", err)
+	}
+	defer os.RemoveAll(outdir)
+
+	m := newResultsManifest(outdir, nil)
+	m.recordParameters(PluginParameters{Plugin: "systemd-logs", ResultType: "systemd-logs", RunAttempts: 3})
+	m.recordParameters(PluginParameters{Plugin: "e2e", ResultType: "e2e", Parameters: &plugin.Parameters{Image: "conformance:v1.14.0"}})
+	// Only the first launch is recorded
+	m.recordParameters(PluginParameters{Plugin: "e2e", ResultType: "e2e"})
+
+	params := readManifest(t, outdir).Parameters
+	if len(params) != 2 || params[0].Plugin != "e2e" || params[1].Plugin != "systemd-logs" {
+		t.Fatalf("expected the parameters of both plugins sorted by name, got %+v", params)
+	}
+	if params[0].Parameters == nil || params[0].Image != "conformance:v1.14.0" {
+		t.Errorf("expected the first parameters of e2e to be kept, got %+v", params[0])
+	}
+	if params[1].Parameters != nil || params[1].RunAttempts != 3 {
+		t.Errorf("unexpected parameters for systemd-logs %+v", params[1])
+	}
+}
+
+func TestResultsManifest_nil(t *testing.T) {
+	// A nil manifest should silently record nothing
+	var manifest *resultsManifest
+	manifest.start("e2e", time.Now())
+	manifest.recordParameters(PluginParameters{ResultType: "e2e"})
+	manifest.record("", &plugin.Result{ResultType: "e2e"}, true)
+}
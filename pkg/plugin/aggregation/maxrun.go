@@ -0,0 +1,114 @@
+/*
+Copyright 2018 Heptio Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package aggregation
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+// runTeardown collects what has to be stopped if a run goes on past its
+// maximum run time. The run registers things as it starts them, since it
+// may be anywhere when the time's up.
+type runTeardown struct {
+	mu        sync.Mutex
+	tornDown  bool
+	summarize func() *RunSummary
+	stops     []func()
+}
+
+// setSummary sets how the results gathered so far are summarized.
+func (t *runTeardown) setSummary(summarize func() *RunSummary) {
+	if t == nil {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.summarize = summarize
+}
+
+// onTeardown registers stop to be called once the run is torn down. If it
+// already has been, stop is called straight away.
+func (t *runTeardown) onTeardown(stop func()) {
+	if t == nil {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.tornDown {
+		go stop()
+		return
+	}
+	t.stops = append(t.stops, stop)
+}
+
+// tearDown starts everything registered stopping, without waiting for any
+// of it, and returns the summary of the results so far. The summary is nil
+// if the run hadn't got as far as gathering results.
+func (t *runTeardown) tearDown() *RunSummary {
+	t.mu.Lock()
+	t.tornDown = true
+	stops, summarize := t.stops, t.summarize
+	t.stops = nil
+	t.mu.Unlock()
+
+	for _, stop := range stops {
+		go stop()
+	}
+	if summarize == nil {
+		return nil
+	}
+	return summarize()
+}
+
+// runWithin calls do, tearing it down and returning once max has passed if
+// it's still going. Anything do is still doing then, such as cleaning up
+// after plugins, carries on in the background.
+func runWithin(ctx context.Context, max time.Duration, log logrus.FieldLogger, do func(context.Context, *runTeardown) (*RunSummary, error)) (*RunSummary, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	type outcome struct {
+		summary *RunSummary
+		err     error
+	}
+	teardown := &runTeardown{}
+	done := make(chan outcome, 1)
+	go func() {
+		summary, err := do(ctx, teardown)
+		done <- outcome{summary, err}
+	}()
+
+	timer := time.NewTimer(max)
+	defer timer.Stop()
+	select {
+	case o := <-done:
+		return o.summary, o.err
+	case <-timer.C:
+	}
+
+	log.WithField("max_run_seconds", max.Seconds()).Error("Run exceeded its maximum run time, tearing it down")
+	// Cancelling the run stops its updater and anything else waiting on
+	// it, while the server and plugins are stopped directly in case the run
+	// is stuck.
+	cancel()
+	return teardown.tearDown(), errors.Errorf("the run exceeded its maximum run time of %v, results are incomplete", max)
+}
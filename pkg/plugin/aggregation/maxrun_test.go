@@ -0,0 +1,108 @@
+/*
+Copyright 2018 Heptio Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package aggregation
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/heptio/sonobuoy/pkg/plugin"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"k8s.io/client-go/kubernetes"
+)
+
+// stuckPlugin is a plugin whose cleanup doesn't finish until it's released.
+type stuckPlugin struct {
+	*fakePlugin
+	release chan struct{}
+}
+
+func (s *stuckPlugin) Cleanup(kubeClient kubernetes.Interface) {
+	<-s.release
+}
+
+func TestRun_maxRunTime(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sonobuoy_run_test")
+	if err != nil {
+		t.Fatalf("Could not create temp directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	// The plugin never submits its result, and once the run is cancelled
+	// its cleanup holds the run up.
+	stuck := &stuckPlugin{fakePlugin: &fakePlugin{name: "e2e"}, release: make(chan struct{})}
+	defer close(stuck.release)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	ready := make(chan struct{})
+	go func() {
+		<-ready
+		cancel()
+	}()
+
+	cfg := plugin.AggregationConfig{MaxRunSeconds: 1}
+	start := time.Now()
+	summary, err := Run(ctx, &fakeClient{}, []plugin.Interface{stuck}, cfg, "heptio-sonobuoy-test", dir, RunOptions{InProcess: NewInProcessServer(), Ready: ready})
+	if err == nil || !strings.Contains(err.Error(), "maximum run time") {
+		t.Errorf("expected the run to exceed its maximum run time, got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > 10*time.Second {
+		t.Errorf("expected the run to return once its maximum run time passed, took %v", elapsed)
+	}
+	if summary == nil || len(summary.Completed) != 0 {
+		t.Errorf("expected a summary without completed results, got %+v", summary)
+	}
+}
+
+func TestRunWithin(t *testing.T) {
+	log := logrus.New()
+	log.Out = ioutil.Discard
+
+	want := newRunSummary(nil, nil)
+	summary, err := runWithin(context.Background(), time.Minute, log, func(ctx context.Context, teardown *runTeardown) (*RunSummary, error) {
+		return want, errors.New("run failed")
+	})
+	if summary != want || err == nil || err.Error() != "run failed" {
+		t.Errorf("expected the run's own summary and error, got %+v, %v", summary, err)
+	}
+
+	stopped := make(chan struct{})
+	late := make(chan struct{})
+	summary, err = runWithin(context.Background(), 10*time.Millisecond, log, func(ctx context.Context, teardown *runTeardown) (*RunSummary, error) {
+		teardown.setSummary(func() *RunSummary { return want })
+		teardown.onTeardown(func() { close(stopped) })
+		<-ctx.Done()
+		// What's started after the teardown is stopped straight away.
+		teardown.onTeardown(func() { close(late) })
+		select {}
+	})
+	if summary != want || err == nil {
+		t.Errorf("expected the summary so far and an error, got %+v, %v", summary, err)
+	}
+	for desc, ch := range map[string]chan struct{}{"registered": stopped, "late": late} {
+		select {
+		case <-ch:
+		case <-time.After(5 * time.Second):
+			t.Errorf("expected the %v stop to be called", desc)
+		}
+	}
+}
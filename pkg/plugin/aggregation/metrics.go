@@ -0,0 +1,125 @@
+/*
+Copyright 2018 Heptio Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package aggregation
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	// metricsPath is the path the aggregator's metrics are served on.
+	metricsPath = "/metrics"
+	// metricsContentType is the content type of the Prometheus text format.
+	metricsContentType = "text/plain; version=0.0.4"
+)
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// listenMetrics binds the metrics port. Metrics aren't authenticated, so
+// they are only served on localhost, e.g. for a sidecar or kubectl
+// port-forward.
+func listenMetrics(port int) (net.Listener, error) {
+	if port <= 0 || port > 65535 {
+		return nil, errors.Errorf("invalid metrics bind port %v, it must be between 1 and 65535", port)
+	}
+
+	address := net.JoinHostPort("127.0.0.1", strconv.Itoa(port))
+	listener, err := net.Listen("tcp", address)
+	if err != nil {
+		return nil, errors.Wrapf(err, "couldn't listen on %v for metrics, check that port %v is free", address, port)
+	}
+	return listener, nil
+}
+
+// serveMetrics serves the aggregator's metrics on the listener, under the
+// base path, until the returned function is called.
+func serveMetrics(listener net.Listener, aggr *Aggregator, start time.Time, basePath string) (stop func()) {
+	mux := http.NewServeMux()
+	mux.HandleFunc(basePath+metricsPath, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("content-type", metricsContentType)
+		aggr.writeMetrics(w, time.Since(start))
+	})
+
+	srv := &http.Server{Handler: mux}
+	go func() {
+		if err := srv.Serve(listener); err != nil && err != http.ErrServerClosed {
+			aggr.logger().WithError(err).Info("Metrics server stopped")
+		}
+	}()
+	return func() { srv.Close() }
+}
+
+// writeMetrics writes the progress of the aggregator in the Prometheus text
+// format. runTime is how long the run has been going.
+func (a *Aggregator) writeMetrics(w io.Writer, runTime time.Duration) {
+	a.resultsMutex.Lock()
+	expected := len(a.ExpectedResults)
+	received := len(a.Results)
+	failures := map[string]int{}
+	for _, result := range a.ExpectedResults {
+		failures[result.ResultType] += 0
+	}
+	for _, result := range a.Results {
+		if !result.IsSuccess() {
+			failures[result.ResultType]++
+		}
+	}
+	a.resultsMutex.Unlock()
+
+	plugins := make([]string, 0, len(failures))
+	for p := range failures {
+		plugins = append(plugins, p)
+	}
+	sort.Strings(plugins)
+
+	fmt.Fprintln(w, "# HELP sonobuoy_results_expected Number of results the run expects.")
+	fmt.Fprintln(w, "# TYPE sonobuoy_results_expected gauge")
+	fmt.Fprintf(w, "sonobuoy_results_expected %d\n", expected)
+	fmt.Fprintln(w, "# HELP sonobuoy_results_received Number of results received, including failures.")
+	fmt.Fprintln(w, "# TYPE sonobuoy_results_received gauge")
+	fmt.Fprintf(w, "sonobuoy_results_received %d\n", received)
+	fmt.Fprintln(w, "# HELP sonobuoy_plugin_failures_total Number of failed results of each plugin.")
+	fmt.Fprintln(w, "# TYPE sonobuoy_plugin_failures_total counter")
+	for _, p := range plugins {
+		fmt.Fprintf(w, "sonobuoy_plugin_failures_total{plugin=\"%s\"} %d\n", labelEscaper.Replace(p), failures[p])
+	}
+	fmt.Fprintln(w, "# HELP sonobuoy_run_seconds Time since the run started, in seconds.")
+	fmt.Fprintln(w, "# TYPE sonobuoy_run_seconds gauge")
+	fmt.Fprintf(w, "sonobuoy_run_seconds %v\n", runTime.Seconds())
+	if a.monitors != nil {
+		fmt.Fprintln(w, "# HELP sonobuoy_monitor_queue_high_water Most results from plugins' monitors waiting at once to be handled.")
+		fmt.Fprintln(w, "# TYPE sonobuoy_monitor_queue_high_water gauge")
+		fmt.Fprintf(w, "sonobuoy_monitor_queue_high_water %d\n", a.monitors.highWaterMark())
+	}
+	if a.connections != nil {
+		fmt.Fprintln(w, "# HELP sonobuoy_server_connections Number of open connections to the aggregation server.")
+		fmt.Fprintln(w, "# TYPE sonobuoy_server_connections gauge")
+		fmt.Fprintf(w, "sonobuoy_server_connections %d\n", a.connections.connections())
+		fmt.Fprintln(w, "# HELP sonobuoy_server_connections_queued_total Number of connections which waited for the connection limit.")
+		fmt.Fprintln(w, "# TYPE sonobuoy_server_connections_queued_total counter")
+		fmt.Fprintf(w, "sonobuoy_server_connections_queued_total %d\n", a.connections.timesLimitReached())
+	}
+}
@@ -0,0 +1,162 @@
+/*
+Copyright 2018 Heptio Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package aggregation
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/heptio/sonobuoy/pkg/plugin"
+	pluginutils "github.com/heptio/sonobuoy/pkg/plugin/driver/utils"
+)
+
+func TestWriteMetrics(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sonobuoy_metrics_test")
+	if err != nil {
+		t.Fatalf("Could not create temp directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	expected := []plugin.ExpectedResult{
+		{NodeName: "node1", ResultType: "systemd_logs"},
+		{NodeName: "node2", ResultType: "systemd_logs"},
+		{ResultType: "e2e"},
+	}
+	aggr := NewAggregator(dir, expected)
+
+	resultsCh := make(chan *plugin.Result, 1)
+	resultsCh <- pluginutils.MakeErrorResult("systemd_logs", map[string]interface{}{"error": "foo"}, "node1")
+	close(resultsCh)
+	aggr.IngestResults(resultsCh)
+
+	var buf bytes.Buffer
+	aggr.writeMetrics(&buf, 90*time.Second)
+
+	want := `# HELP sonobuoy_results_expected Number of results the run expects.
+# TYPE sonobuoy_results_expected gauge
+sonobuoy_results_expected 3
+# HELP sonobuoy_results_received Number of results received, including failures.
+# TYPE sonobuoy_results_received gauge
+sonobuoy_results_received 1
+# HELP sonobuoy_plugin_failures_total Number of failed results of each plugin.
+# TYPE sonobuoy_plugin_failures_total counter
+sonobuoy_plugin_failures_total{plugin="e2e"} 0
+sonobuoy_plugin_failures_total{plugin="systemd_logs"} 1
+# HELP sonobuoy_run_seconds Time since the run started, in seconds.
+# TYPE sonobuoy_run_seconds gauge
+sonobuoy_run_seconds 90
+`
+	if buf.String() != want {
+		t.Errorf("expected metrics:\n%v\ngot:\n%v", want, buf.String())
+	}
+}
+
+func TestListenMetrics(t *testing.T) {
+	if _, err := listenMetrics(0); err == nil {
+		t.Error("expected an error for port 0")
+	}
+
+	listener, err := listenMetrics(freePort(t))
+	if err != nil {
+		t.Fatalf("unexpected error listening for metrics: %v", err)
+	}
+	defer listener.Close()
+	if !strings.HasPrefix(listener.Addr().String(), "127.0.0.1:") {
+		t.Errorf("expected metrics to only be served on localhost, got %v", listener.Addr())
+	}
+}
+
+func TestRun_metrics(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sonobuoy_metrics_test")
+	if err != nil {
+		t.Fatalf("Could not create temp directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	port := freePort(t)
+	srv := NewInProcessServer()
+
+	// The plugin scrapes the metrics before submitting its result, so the
+	// server is known to be up and the result not yet received.
+	var metrics string
+	var scrapeErr error
+	p := &fakePlugin{name: "e2e", run: func(string) error {
+		go func() {
+			defer srv.Submit("", "e2e", "application/json", strings.NewReader("{}"))
+			resp, err := http.Get(fmt.Sprintf("http://127.0.0.1:%d/metrics", port))
+			if err != nil {
+				scrapeErr = err
+				return
+			}
+			defer resp.Body.Close()
+			body, err := ioutil.ReadAll(resp.Body)
+			metrics, scrapeErr = string(body), err
+		}()
+		return nil
+	}}
+
+	cfg := plugin.AggregationConfig{MetricsBindPort: port}
+	if _, err := Run(context.Background(), &fakeClient{}, []plugin.Interface{p}, cfg, "heptio-sonobuoy-test", dir, RunOptions{InProcess: srv}); err != nil {
+		t.Fatalf("unexpected error from run: %v", err)
+	}
+	if scrapeErr != nil {
+		t.Fatalf("couldn't scrape metrics: %v", scrapeErr)
+	}
+	for _, line := range []string{"sonobuoy_results_expected 1", "sonobuoy_results_received 0", `sonobuoy_plugin_failures_total{plugin="e2e"} 0`, "sonobuoy_monitor_queue_high_water 0"} {
+		if !strings.Contains(metrics, line+"\n") {
+			t.Errorf("expected metrics to contain %q, got:\n%v", line, metrics)
+		}
+	}
+}
+
+func TestServeMetrics_basePath(t *testing.T) {
+	listener, err := listenMetrics(freePort(t))
+	if err != nil {
+		t.Fatalf("unexpected error listening for metrics: %v", err)
+	}
+	stop := serveMetrics(listener, NewAggregator("", nil), time.Now(), "/sonobuoy")
+	defer stop()
+
+	for path, want := range map[string]int{"/sonobuoy/metrics": http.StatusOK, "/metrics": http.StatusNotFound} {
+		resp, err := http.Get("http://" + listener.Addr().String() + path)
+		if err != nil {
+			t.Fatalf("couldn't scrape metrics: %v", err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != want {
+			t.Errorf("expected a %v response from %v, got %v", want, path, resp.StatusCode)
+		}
+	}
+}
+
+// freePort returns a port on localhost which is free to listen on.
+func freePort(t *testing.T) int {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("couldn't listen: %v", err)
+	}
+	defer l.Close()
+	return l.Addr().(*net.TCPAddr).Port
+}
@@ -0,0 +1,122 @@
+/*
+Copyright 2018 Heptio Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package aggregation
+
+import (
+	"sync"
+
+	"github.com/heptio/sonobuoy/pkg/plugin"
+)
+
+// defaultMonitorBufferSize is how many results can be sent to a monitor
+// queue before it takes them off its channel, if the run doesn't configure it.
+const defaultMonitorBufferSize = 64
+
+// monitorQueue sits between the goroutines which report results on behalf of
+// plugins, such as their monitors and timeouts, and IngestResults. Results are
+// taken off its channel as soon as they're sent and held until IngestResults
+// is ready for them, so senders never wait on results being handled however
+// many more there are than expected. Results waiting for IngestResults are
+// handed over highest priority first, and in the order they were sent among
+// results of the same priority.
+type monitorQueue struct {
+	in  chan *plugin.Result
+	out chan *plugin.Result
+	// priority, if set, returns the priority of a result. It must be set
+	// before run is called.
+	priority func(*plugin.Result) int
+
+	mu sync.Mutex
+	// highWater is the most results that were waiting at once
+	highWater int
+}
+
+// newMonitorQueue returns a queue whose channel buffers size results, or
+// defaultMonitorBufferSize if size isn't positive. Results aren't forwarded
+// until run is called.
+func newMonitorQueue(size int) *monitorQueue {
+	if size <= 0 {
+		size = defaultMonitorBufferSize
+	}
+	return &monitorQueue{
+		in:  make(chan *plugin.Result, size),
+		out: make(chan *plugin.Result),
+	}
+}
+
+// run forwards results from in to out until in is closed and every result
+// has been handed over, then closes out.
+func (q *monitorQueue) run() {
+	var pending []*plugin.Result
+	in := q.in
+	for in != nil || len(pending) > 0 {
+		// Sending on a nil channel blocks, so nothing is sent until
+		// there's something pending.
+		var out chan *plugin.Result
+		var next *plugin.Result
+		i := q.next(pending)
+		if len(pending) > 0 {
+			out, next = q.out, pending[i]
+		}
+
+		select {
+		case result, ok := <-in:
+			if !ok {
+				in = nil
+				continue
+			}
+			pending = append(pending, result)
+			q.record(len(pending) + len(in))
+		case out <- next:
+			copy(pending[i:], pending[i+1:])
+			pending[len(pending)-1] = nil
+			pending = pending[:len(pending)-1]
+		}
+	}
+	close(q.out)
+}
+
+// next returns the index of the pending result to hand over next: the first
+// one of the highest priority.
+func (q *monitorQueue) next(pending []*plugin.Result) int {
+	next := 0
+	if q.priority == nil {
+		return next
+	}
+	for i := 1; i < len(pending); i++ {
+		if q.priority(pending[i]) > q.priority(pending[next]) {
+			next = i
+		}
+	}
+	return next
+}
+
+// record updates the high-water mark with the number of results waiting.
+func (q *monitorQueue) record(waiting int) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if waiting > q.highWater {
+		q.highWater = waiting
+	}
+}
+
+// highWaterMark returns the most results that were waiting at once.
+func (q *monitorQueue) highWaterMark() int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return q.highWater
+}
@@ -0,0 +1,96 @@
+/*
+Copyright 2018 Heptio Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package aggregation
+
+import (
+	"testing"
+	"time"
+
+	"github.com/heptio/sonobuoy/pkg/plugin"
+)
+
+func TestMonitorQueue(t *testing.T) {
+	q := newMonitorQueue(2)
+	go q.run()
+
+	// Nothing is taking results out yet, so they'd block on a channel
+	// buffering only two.
+	sent := make(chan bool)
+	go func() {
+		for i := 0; i < 10; i++ {
+			q.in <- &plugin.Result{ResultType: "e2e", NodeName: string(rune('a' + i))}
+		}
+		close(q.in)
+		close(sent)
+	}()
+	select {
+	case <-sent:
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out sending results to the queue")
+	}
+
+	var got string
+	for result := range q.out {
+		got += result.NodeName
+	}
+	if got != "abcdefghij" {
+		t.Errorf("expected the results in the order they were sent, got %q", got)
+	}
+	// None were taken out until all were sent, so all were waiting at once.
+	if mark := q.highWaterMark(); mark != 10 {
+		t.Errorf("expected a high-water mark of 10, got %v", mark)
+	}
+}
+
+func TestMonitorQueue_priority(t *testing.T) {
+	q := newMonitorQueue(10)
+	q.priority = func(result *plugin.Result) int {
+		return map[string]int{"systemd_logs": 1, "setup": 2}[result.ResultType]
+	}
+	for i, resultType := range []string{"e2e", "systemd_logs", "e2e", "setup", "systemd_logs"} {
+		q.in <- &plugin.Result{ResultType: resultType, NodeName: string(rune('a' + i))}
+	}
+	close(q.in)
+	go q.run()
+
+	// Nothing is taken out until they're all pending, so they're handed
+	// over by priority rather than as they come in.
+	deadline := time.Now().Add(5 * time.Second)
+	for len(q.in) > 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("timed out waiting for the queue to take the results")
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	var got string
+	for result := range q.out {
+		got += result.NodeName
+	}
+	if got != "dbeac" {
+		t.Errorf("expected the results highest priority first, then in the order they were sent, got %q", got)
+	}
+}
+
+func TestNewMonitorQueue_defaultSize(t *testing.T) {
+	if size := cap(newMonitorQueue(0).in); size != defaultMonitorBufferSize {
+		t.Errorf("expected a buffer of %v by default, got %v", defaultMonitorBufferSize, size)
+	}
+	if size := cap(newMonitorQueue(5).in); size != 5 {
+		t.Errorf("expected a buffer of 5, got %v", size)
+	}
+}
@@ -0,0 +1,183 @@
+/*
+Copyright 2018 Heptio Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package aggregation
+
+import (
+	"runtime/debug"
+	"sync"
+	"time"
+
+	"github.com/heptio/sonobuoy/pkg/plugin"
+	"github.com/sirupsen/logrus"
+)
+
+// ObservationKind is what was observed of an expected result.
+type ObservationKind string
+
+const (
+	// ResultStarted is observed when the first byte of a result arrives,
+	// whether it's uploaded whole, as partial results, as artifacts or
+	// streamed. Results which aren't uploaded, such as the errors reported
+	// by a plugin's monitor, are only ever completed.
+	ResultStarted ObservationKind = "started"
+	// ResultCompleted is observed when a result is recorded, whether it
+	// succeeded or not.
+	ResultCompleted ObservationKind = "completed"
+)
+
+// Observation is something observed of an expected result. Each kind is only
+// observed once for each expected result, even if the result is submitted
+// again, and a result is never observed starting after it completed.
+type Observation struct {
+	Kind ObservationKind
+	// Expected is the expected result which was observed.
+	Expected plugin.ExpectedResult
+	Time     time.Time
+	// Error is set for completed results which failed.
+	Error string
+}
+
+// observations delivers observations to the Observer on a goroutine of its
+// own, in the order they were made. Observations are queued without limit
+// rather than blocking, which is safe since there are at most two for each
+// expected result.
+type observations struct {
+	observer func(Observation)
+	log      logrus.FieldLogger
+
+	mu      sync.Mutex
+	pending []Observation
+	closed  bool
+	// started and completed are the IDs of the results observed so far
+	started   map[string]bool
+	completed map[string]bool
+	wake      chan struct{}
+	done      chan struct{}
+}
+
+func newObservations(observer func(Observation), log logrus.FieldLogger) *observations {
+	o := &observations{
+		observer:  observer,
+		log:       log,
+		started:   map[string]bool{},
+		completed: map[string]bool{},
+		wake:      make(chan struct{}, 1),
+		done:      make(chan struct{}),
+	}
+	go o.run()
+	return o
+}
+
+// observe queues the observation of the result, unless it was already made.
+func (o *observations) observe(kind ObservationKind, result *plugin.Result) {
+	id := result.ExpectedResultID()
+	o.mu.Lock()
+	switch {
+	case o.closed, o.completed[id], kind == ResultStarted && o.started[id]:
+		o.mu.Unlock()
+		return
+	case kind == ResultStarted:
+		o.started[id] = true
+	default:
+		o.completed[id] = true
+	}
+	observation := Observation{
+		Kind:     kind,
+		Expected: plugin.ExpectedResult{NodeName: result.NodeName, ResultType: result.ResultType},
+		Time:     time.Now(),
+	}
+	if kind == ResultCompleted {
+		observation.Error = result.Error
+	}
+	o.pending = append(o.pending, observation)
+	o.mu.Unlock()
+
+	select {
+	case o.wake <- struct{}{}:
+	default:
+	}
+}
+
+// run delivers the queued observations until the queue is closed and they've
+// all been delivered.
+func (o *observations) run() {
+	defer close(o.done)
+	for {
+		o.mu.Lock()
+		batch, closed := o.pending, o.closed
+		o.pending = nil
+		o.mu.Unlock()
+
+		for _, observation := range batch {
+			o.deliver(observation)
+		}
+		if len(batch) > 0 {
+			continue
+		}
+		if closed {
+			return
+		}
+		<-o.wake
+	}
+}
+
+// deliver passes the observation to the observer, logging rather than taking
+// down the aggregator if it panics.
+func (o *observations) deliver(observation Observation) {
+	defer func() {
+		if r := recover(); r != nil {
+			o.log.WithFields(logrus.Fields{
+				"panic": r,
+				"stack": string(debug.Stack()),
+			}).Error("Result observer panicked")
+		}
+	}()
+	o.observer(observation)
+}
+
+// wait stops taking observations and waits for those queued to be delivered.
+func (o *observations) wait() {
+	o.mu.Lock()
+	o.closed = true
+	o.mu.Unlock()
+	select {
+	case o.wake <- struct{}{}:
+	default:
+	}
+	<-o.done
+}
+
+// observe passes on the observation of the result to the Observer, if there is
+// one, without waiting for it.
+func (a *Aggregator) observe(kind ObservationKind, result *plugin.Result) {
+	if a.Observer == nil {
+		return
+	}
+	a.observationsOnce.Do(func() {
+		a.observations = newObservations(a.Observer, a.logger())
+	})
+	a.observations.observe(kind, result)
+}
+
+// waitObservations waits for the observations made to be delivered to the
+// Observer. No more are made once it's called.
+func (a *Aggregator) waitObservations() {
+	a.observationsOnce.Do(func() {})
+	if a.observations != nil {
+		a.observations.wait()
+	}
+}
@@ -0,0 +1,121 @@
+/*
+Copyright 2018 Heptio Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package aggregation
+
+import (
+	"reflect"
+	"sync"
+	"testing"
+
+	"github.com/heptio/sonobuoy/pkg/backplane/ca/authtest"
+	"github.com/heptio/sonobuoy/pkg/plugin"
+	pluginutils "github.com/heptio/sonobuoy/pkg/plugin/driver/utils"
+	"github.com/sirupsen/logrus"
+)
+
+func TestAggregation_observations(t *testing.T) {
+	expected := []plugin.ExpectedResult{
+		{NodeName: "node1", ResultType: "systemd_logs"},
+		{NodeName: "node2", ResultType: "systemd_logs"},
+		{ResultType: "e2e"},
+	}
+
+	withAggregator(t, expected, func(agg *Aggregator, srv *authtest.Server) {
+		// The observer is held up until the results are all in, which
+		// mustn't hold up the results themselves.
+		release := make(chan struct{})
+		var mu sync.Mutex
+		var observed []string
+		agg.Observer = func(o Observation) {
+			<-release
+			mu.Lock()
+			defer mu.Unlock()
+			if o.Time.IsZero() {
+				t.Errorf("expected observation %+v to have a time", o)
+			}
+			observed = append(observed, string(o.Kind)+" "+o.Expected.ID()+" "+o.Error)
+		}
+
+		node1, err := NodeResultURL(srv.URL, "node1", "systemd_logs")
+		if err != nil {
+			t.Fatalf("couldn't get test server URL: %v", err)
+		}
+		node2, err := NodeResultURL(srv.URL, "node2", "systemd_logs")
+		if err != nil {
+			t.Fatalf("couldn't get test server URL: %v", err)
+		}
+		for seq, chunk := range []string{"foo", "bar"} {
+			if resp := doRequest(t, srv.Client(), "PUT", PartialResultURL(node1, seq), []byte(chunk)); resp.StatusCode != 200 {
+				t.Errorf("expected a 200 for partial result %v, got %v", seq, resp.StatusCode)
+			}
+		}
+		for _, url := range []string{node1, node2} {
+			if resp := doRequest(t, srv.Client(), "PUT", url, []byte("done")); resp.StatusCode != 200 {
+				t.Errorf("expected a 200 for %v, got %v", url, resp.StatusCode)
+			}
+		}
+		// A duplicate is neither started nor completed again.
+		if resp := doRequest(t, srv.Client(), "PUT", node2, []byte("again")); resp.StatusCode != 409 {
+			t.Errorf("expected a 409 for a duplicate result, got %v", resp.StatusCode)
+		}
+
+		resultsCh := make(chan *plugin.Result, 1)
+		resultsCh <- pluginutils.MakeErrorResult("e2e", map[string]interface{}{"error": "pod crashed"}, "")
+		close(resultsCh)
+		agg.IngestResults(resultsCh)
+
+		if !agg.isComplete() {
+			t.Error("expected the aggregation to complete while the observer was held up")
+		}
+
+		close(release)
+		agg.waitObservations()
+		expectedObserved := []string{
+			"started systemd_logs/node1 ",
+			"completed systemd_logs/node1 ",
+			"started systemd_logs/node2 ",
+			"completed systemd_logs/node2 ",
+			"completed e2e pod crashed",
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		if !reflect.DeepEqual(observed, expectedObserved) {
+			t.Errorf("expected observations %q, got %q", expectedObserved, observed)
+		}
+	})
+}
+
+func TestObservations_panickingObserver(t *testing.T) {
+	var observed []ObservationKind
+	o := newObservations(func(o Observation) {
+		observed = append(observed, o.Kind)
+		if o.Kind == ResultStarted {
+			panic("observer bug")
+		}
+	}, logrus.New())
+
+	result := &plugin.Result{ResultType: "e2e"}
+	o.observe(ResultStarted, result)
+	o.observe(ResultCompleted, result)
+	o.observe(ResultStarted, result)
+	o.wait()
+	o.observe(ResultCompleted, &plugin.Result{ResultType: "systemd_logs"})
+
+	if expected := []ObservationKind{ResultStarted, ResultCompleted}; !reflect.DeepEqual(observed, expected) {
+		t.Errorf("expected observations %v despite the panic, got %v", expected, observed)
+	}
+}
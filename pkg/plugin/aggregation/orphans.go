@@ -0,0 +1,165 @@
+/*
+Copyright 2018 Heptio Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package aggregation
+
+import (
+	"sort"
+
+	"github.com/heptio/sonobuoy/pkg/plugin"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+)
+
+// orphanSelector selects the resources created by plugins, whichever run
+// they're from.
+const orphanSelector = "component=sonobuoy," + plugin.SessionLabel
+
+// Kinds of orphaned resources.
+const (
+	orphanedDaemonSet = "DaemonSet"
+	orphanedPod       = "Pod"
+)
+
+// orphanedResource is a plugin resource left behind by an earlier run, e.g.
+// one whose aggregator crashed before it cleaned up.
+type orphanedResource struct {
+	Kind      string
+	Namespace string
+	Name      string
+	// SessionID is the session of the plugin which created it.
+	SessionID string
+}
+
+func (o orphanedResource) fields() logrus.Fields {
+	return logrus.Fields{
+		"kind":      o.Kind,
+		"namespace": o.Namespace,
+		"name":      o.Name,
+		"session":   o.SessionID,
+	}
+}
+
+// findOrphanedResources lists the daemonsets and pods created by plugins in
+// the given namespaces which aren't from any of the given plugins, sorted by
+// namespace, kind and name. Pods with a controller, such as an orphaned
+// daemonset, aren't listed since they're deleted along with it.
+func findOrphanedResources(client kubernetes.Interface, namespaces []string, plugins []plugin.Interface) ([]orphanedResource, error) {
+	current := map[string]bool{}
+	for _, p := range plugins {
+		if sessioned, ok := p.(plugin.Sessioned); ok && sessioned.GetSessionID() != "" {
+			current[sessioned.GetSessionID()] = true
+		}
+	}
+	opts := metav1.ListOptions{LabelSelector: orphanSelector}
+
+	var orphans []orphanedResource
+	for _, ns := range namespaces {
+		dsets, err := client.AppsV1().DaemonSets(ns).List(opts)
+		if err != nil {
+			return nil, errors.Wrapf(err, "couldn't list daemonsets in namespace %v", ns)
+		}
+		for _, ds := range dsets.Items {
+			if session := ds.Labels[plugin.SessionLabel]; !current[session] {
+				orphans = append(orphans, orphanedResource{Kind: orphanedDaemonSet, Namespace: ns, Name: ds.Name, SessionID: session})
+			}
+		}
+
+		pods, err := client.CoreV1().Pods(ns).List(opts)
+		if err != nil {
+			return nil, errors.Wrapf(err, "couldn't list pods in namespace %v", ns)
+		}
+		for i := range pods.Items {
+			pod := &pods.Items[i]
+			if session := pod.Labels[plugin.SessionLabel]; !current[session] && metav1.GetControllerOf(pod) == nil {
+				orphans = append(orphans, orphanedResource{Kind: orphanedPod, Namespace: ns, Name: pod.Name, SessionID: session})
+			}
+		}
+	}
+
+	sort.Slice(orphans, func(i, j int) bool {
+		a, b := orphans[i], orphans[j]
+		if a.Namespace != b.Namespace {
+			return a.Namespace < b.Namespace
+		}
+		if a.Kind != b.Kind {
+			return a.Kind < b.Kind
+		}
+		return a.Name < b.Name
+	})
+	return orphans, nil
+}
+
+// deleteOrphanedResource deletes the resource, along with anything it
+// controls, giving its pods the graceful shutdown period to finish.
+func deleteOrphanedResource(client kubernetes.Interface, orphan orphanedResource, gracePeriod int64) error {
+	propagation := metav1.DeletePropagationBackground
+	opts := &metav1.DeleteOptions{
+		GracePeriodSeconds: &gracePeriod,
+		PropagationPolicy:  &propagation,
+	}
+	switch orphan.Kind {
+	case orphanedDaemonSet:
+		return errors.Wrapf(client.AppsV1().DaemonSets(orphan.Namespace).Delete(orphan.Name, opts), "couldn't delete daemonset %v/%v", orphan.Namespace, orphan.Name)
+	default:
+		return errors.Wrapf(client.CoreV1().Pods(orphan.Namespace).Delete(orphan.Name, opts), "couldn't delete pod %v/%v", orphan.Namespace, orphan.Name)
+	}
+}
+
+// handleOrphanedResources finds the resources earlier runs left behind in the
+// aggregator's namespace and the namespaces of the plugins, and logs each
+// one, deleting them too if the OrphanedResources policy says to. Problems
+// are logged rather than failing the run, which the orphans may not get in
+// the way of. It returns the resources which were found.
+func handleOrphanedResources(client kubernetes.Interface, plugins []plugin.Interface, namespace string, cfg plugin.AggregationConfig, log logrus.FieldLogger) []orphanedResource {
+	namespaces := []string{namespace}
+	seen := map[string]bool{namespace: true}
+	for _, p := range plugins {
+		namespaced, ok := p.(plugin.Namespaced)
+		if !ok || namespaced.GetNamespace() == "" || seen[namespaced.GetNamespace()] {
+			continue
+		}
+		seen[namespaced.GetNamespace()] = true
+		namespaces = append(namespaces, namespaced.GetNamespace())
+	}
+
+	orphans, err := findOrphanedResources(client, namespaces, plugins)
+	if err != nil {
+		log.WithError(err).Warning("Couldn't look for resources left behind by earlier runs")
+		return nil
+	}
+	if len(orphans) == 0 {
+		log.WithField("namespaces", namespaces).Info("No resources left behind by earlier runs")
+		return nil
+	}
+
+	gracePeriod := int64(gracefulShutdownSeconds(cfg, ""))
+	for _, orphan := range orphans {
+		entry := log.WithFields(orphan.fields())
+		if cfg.OrphanedResources != plugin.OrphanedResourcesDelete {
+			entry.Warning("Found resource left behind by an earlier run, which would be deleted with orphanedresources set to delete")
+			continue
+		}
+		if err := deleteOrphanedResource(client, orphan, gracePeriod); err != nil {
+			entry.WithError(err).Warning("Couldn't delete resource left behind by an earlier run")
+			continue
+		}
+		entry.Info("Deleted resource left behind by an earlier run")
+	}
+	return orphans
+}
@@ -0,0 +1,231 @@
+/*
+Copyright 2018 Heptio Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package aggregation
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/heptio/sonobuoy/pkg/plugin"
+	"github.com/sirupsen/logrus"
+	logtest "github.com/sirupsen/logrus/hooks/test"
+	appsv1 "k8s.io/api/apps/v1"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/client-go/kubernetes"
+	appsv1client "k8s.io/client-go/kubernetes/typed/apps/v1"
+	corev1 "k8s.io/client-go/kubernetes/typed/core/v1"
+)
+
+// orphanClient lists the daemonsets and pods it's given, by namespace, and
+// records what's deleted.
+type orphanClient struct {
+	kubernetes.Interface
+	dsets   map[string][]appsv1.DaemonSet
+	pods    map[string][]v1.Pod
+	deleted []string
+}
+
+func (c *orphanClient) AppsV1() appsv1client.AppsV1Interface {
+	return &orphanApps{client: c}
+}
+
+func (c *orphanClient) CoreV1() corev1.CoreV1Interface {
+	return &orphanCore{client: c}
+}
+
+type orphanApps struct {
+	appsv1client.AppsV1Interface
+	client *orphanClient
+}
+
+func (a *orphanApps) DaemonSets(namespace string) appsv1client.DaemonSetInterface {
+	return &orphanDaemonSets{client: a.client, namespace: namespace}
+}
+
+type orphanDaemonSets struct {
+	appsv1client.DaemonSetInterface
+	client    *orphanClient
+	namespace string
+}
+
+func (d *orphanDaemonSets) List(opts metav1.ListOptions) (*appsv1.DaemonSetList, error) {
+	selector, err := labels.Parse(opts.LabelSelector)
+	if err != nil {
+		return nil, err
+	}
+	list := &appsv1.DaemonSetList{}
+	for _, ds := range d.client.dsets[d.namespace] {
+		if selector.Matches(labels.Set(ds.Labels)) {
+			list.Items = append(list.Items, ds)
+		}
+	}
+	return list, nil
+}
+
+func (d *orphanDaemonSets) Delete(name string, opts *metav1.DeleteOptions) error {
+	d.client.deleted = append(d.client.deleted, "DaemonSet "+d.namespace+"/"+name)
+	return nil
+}
+
+type orphanCore struct {
+	corev1.CoreV1Interface
+	client *orphanClient
+}
+
+func (c *orphanCore) Pods(namespace string) corev1.PodInterface {
+	return &orphanPods{client: c.client, namespace: namespace}
+}
+
+type orphanPods struct {
+	corev1.PodInterface
+	client    *orphanClient
+	namespace string
+}
+
+func (p *orphanPods) List(opts metav1.ListOptions) (*v1.PodList, error) {
+	selector, err := labels.Parse(opts.LabelSelector)
+	if err != nil {
+		return nil, err
+	}
+	list := &v1.PodList{}
+	for _, pod := range p.client.pods[p.namespace] {
+		if selector.Matches(labels.Set(pod.Labels)) {
+			list.Items = append(list.Items, pod)
+		}
+	}
+	return list, nil
+}
+
+func (p *orphanPods) Delete(name string, opts *metav1.DeleteOptions) error {
+	p.client.deleted = append(p.client.deleted, "Pod "+p.namespace+"/"+name)
+	return nil
+}
+
+// orphanTestPlugin is a fakePlugin with a session, in a namespace of its
+// own if one is set.
+type orphanTestPlugin struct {
+	fakePlugin
+	session   string
+	namespace string
+}
+
+func (p *orphanTestPlugin) GetSessionID() string { return p.session }
+func (p *orphanTestPlugin) GetNamespace() string { return p.namespace }
+
+func pluginMeta(name, session string) metav1.ObjectMeta {
+	return metav1.ObjectMeta{Name: name, Labels: map[string]string{"component": "sonobuoy", plugin.SessionLabel: session}}
+}
+
+func TestHandleOrphanedResources(t *testing.T) {
+	newClient := func() *orphanClient {
+		controlled := pluginMeta("sonobuoy-old-daemon-set-old1-abcde", "old1")
+		isController := true
+		controlled.OwnerReferences = []metav1.OwnerReference{{Kind: "DaemonSet", Name: "sonobuoy-old-daemon-set-old1", Controller: &isController}}
+		return &orphanClient{
+			dsets: map[string][]appsv1.DaemonSet{
+				"heptio-sonobuoy": {
+					{ObjectMeta: pluginMeta("sonobuoy-logs-daemon-set-abc123", "abc123")},
+					{ObjectMeta: pluginMeta("sonobuoy-old-daemon-set-old1", "old1")},
+				},
+			},
+			pods: map[string][]v1.Pod{
+				"heptio-sonobuoy": {
+					{ObjectMeta: metav1.ObjectMeta{Name: "sonobuoy", Labels: map[string]string{"component": "sonobuoy"}}},
+					{ObjectMeta: controlled},
+					{ObjectMeta: pluginMeta("sonobuoy-e2e-job-old2", "old2")},
+				},
+				"plugins": {
+					{ObjectMeta: pluginMeta("sonobuoy-e2e-job-def456", "def456")},
+					{ObjectMeta: pluginMeta("sonobuoy-e2e-job-old3", "old3")},
+				},
+				"elsewhere": {
+					{ObjectMeta: pluginMeta("sonobuoy-e2e-job-old4", "old4")},
+				},
+			},
+		}
+	}
+	plugins := []plugin.Interface{
+		&orphanTestPlugin{fakePlugin: fakePlugin{name: "logs"}, session: "abc123"},
+		&orphanTestPlugin{fakePlugin: fakePlugin{name: "e2e"}, session: "def456", namespace: "plugins"},
+	}
+	expected := []orphanedResource{
+		{Kind: orphanedDaemonSet, Namespace: "heptio-sonobuoy", Name: "sonobuoy-old-daemon-set-old1", SessionID: "old1"},
+		{Kind: orphanedPod, Namespace: "heptio-sonobuoy", Name: "sonobuoy-e2e-job-old2", SessionID: "old2"},
+		{Kind: orphanedPod, Namespace: "plugins", Name: "sonobuoy-e2e-job-old3", SessionID: "old3"},
+	}
+
+	testCases := []struct {
+		policy      string
+		wantDeleted []string
+		wantLevel   logrus.Level
+	}{
+		{policy: plugin.OrphanedResourcesReport, wantLevel: logrus.WarnLevel},
+		{
+			policy: plugin.OrphanedResourcesDelete,
+			wantDeleted: []string{
+				"DaemonSet heptio-sonobuoy/sonobuoy-old-daemon-set-old1",
+				"Pod heptio-sonobuoy/sonobuoy-e2e-job-old2",
+				"Pod plugins/sonobuoy-e2e-job-old3",
+			},
+			wantLevel: logrus.InfoLevel,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.policy, func(t *testing.T) {
+			client := newClient()
+			log, hook := logtest.NewNullLogger()
+			cfg := plugin.AggregationConfig{OrphanedResources: tc.policy}
+
+			orphans := handleOrphanedResources(client, plugins, "heptio-sonobuoy", cfg, log)
+			if !reflect.DeepEqual(orphans, expected) {
+				t.Errorf("expected orphans %+v, got %+v", expected, orphans)
+			}
+			if !reflect.DeepEqual(client.deleted, tc.wantDeleted) {
+				t.Errorf("expected %q to be deleted, got %q", tc.wantDeleted, client.deleted)
+			}
+
+			entries := hook.AllEntries()
+			if len(entries) != len(expected) {
+				t.Fatalf("expected an entry logged for each orphan, got %v", len(entries))
+			}
+			for i, entry := range entries {
+				if entry.Level != tc.wantLevel || entry.Data["name"] != expected[i].Name || entry.Data["kind"] != expected[i].Kind {
+					t.Errorf("expected orphan %+v to be logged at %v, got %v %v", expected[i], tc.wantLevel, entry.Level, entry.Data)
+				}
+			}
+		})
+	}
+}
+
+func TestHandleOrphanedResources_none(t *testing.T) {
+	client := &orphanClient{}
+	log, hook := logtest.NewNullLogger()
+	cfg := plugin.AggregationConfig{OrphanedResources: plugin.OrphanedResourcesDelete}
+
+	if orphans := handleOrphanedResources(client, nil, "heptio-sonobuoy", cfg, log); len(orphans) != 0 {
+		t.Errorf("expected no orphans, got %+v", orphans)
+	}
+	if len(client.deleted) != 0 {
+		t.Errorf("expected nothing to be deleted, got %q", client.deleted)
+	}
+	if entry := hook.LastEntry(); entry == nil || entry.Level != logrus.InfoLevel {
+		t.Errorf("expected it to be logged that there are no orphans, got %v", entry)
+	}
+}
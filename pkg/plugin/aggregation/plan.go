@@ -0,0 +1,110 @@
+/*
+Copyright 2018 Heptio Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package aggregation
+
+import (
+	"github.com/heptio/sonobuoy/pkg/plugin"
+	"github.com/sirupsen/logrus"
+	v1 "k8s.io/api/core/v1"
+)
+
+// RunPlan describes what a run would do, as computed for a dry run.
+type RunPlan struct {
+	// NodeSelector limits which nodes are expected to report results.
+	NodeSelector string `json:"nodeselector,omitempty"`
+	// Nodes are the nodes matching the node selector.
+	Nodes []string `json:"nodes"`
+	// TimeoutSeconds is how long the run waits for all results, or 0 if
+	// it waits forever.
+	TimeoutSeconds int `json:"timeoutseconds"`
+	// ExpectedResults is the total number of results the run expects.
+	ExpectedResults int          `json:"expectedresults"`
+	Plugins         []PluginPlan `json:"plugins"`
+}
+
+// PluginPlan describes how a single plugin would be run.
+type PluginPlan struct {
+	Name       string `json:"name"`
+	ResultType string `json:"resulttype"`
+	// DependsOn lists the plugins which must complete first.
+	DependsOn []string `json:"dependson,omitempty"`
+	// ExpectedResults are the results the plugin is expected to submit,
+	// one per node for node-specific plugins.
+	ExpectedResults []plugin.ExpectedResult `json:"expectedresults"`
+	// TimeoutSeconds is the plugin's own timeout, or the run's if it
+	// doesn't have one.
+	TimeoutSeconds int `json:"timeoutseconds"`
+	// StartupTimeoutSeconds is how long the plugin's pods may stay pending,
+	// or 0 if they aren't checked.
+	StartupTimeoutSeconds int `json:"startuptimeoutseconds,omitempty"`
+	// RunAttempts is how many times launching the plugin is attempted.
+	RunAttempts int `json:"runattempts"`
+}
+
+// newRunPlan returns the plan for running the plugins on the given nodes.
+func newRunPlan(plugins []plugin.Interface, nodes []v1.Node, cfg plugin.AggregationConfig) *RunPlan {
+	plan := &RunPlan{
+		NodeSelector:   cfg.NodeSelector,
+		Nodes:          make([]string, 0, len(nodes)),
+		TimeoutSeconds: runTimeoutSeconds(cfg, plugins),
+		Plugins:        make([]PluginPlan, 0, len(plugins)),
+	}
+	for _, node := range nodes {
+		plan.Nodes = append(plan.Nodes, node.Name)
+	}
+
+	for _, p := range plugins {
+		expected := pluginExpectedResults(p, nodes, cfg)
+		plan.ExpectedResults += len(expected)
+		plan.Plugins = append(plan.Plugins, PluginPlan{
+			Name:                  p.GetName(),
+			ResultType:            p.GetResultType(),
+			DependsOn:             dependsOn(p),
+			ExpectedResults:       expected,
+			TimeoutSeconds:        pluginTimeoutSeconds(cfg, p.GetName()),
+			StartupTimeoutSeconds: cfg.PluginStartupTimeoutSeconds,
+			RunAttempts:           pluginRunAttempts(cfg),
+		})
+	}
+	return plan
+}
+
+// log logs the plan, including each expected result.
+func (p *RunPlan) log(log logrus.FieldLogger) {
+	log.WithFields(logrus.Fields{
+		"nodes":            len(p.Nodes),
+		"node_selector":    p.NodeSelector,
+		"expected_results": p.ExpectedResults,
+		"timeout_seconds":  p.TimeoutSeconds,
+	}).Info("Dry run, not launching any plugins")
+
+	for _, pp := range p.Plugins {
+		pluginLog := log.WithField("plugin", pp.Name)
+		pluginLog.WithFields(logrus.Fields{
+			"result_type":      pp.ResultType,
+			"depends_on":       pp.DependsOn,
+			"expected_results": len(pp.ExpectedResults),
+			"timeout_seconds":  pp.TimeoutSeconds,
+			"run_attempts":     pp.RunAttempts,
+		}).Info("Plugin would be run")
+		for _, expected := range pp.ExpectedResults {
+			if expected.NodeName != "" {
+				pluginLog.WithField("node", expected.NodeName).Info("Result would be expected")
+			}
+		}
+	}
+}
@@ -0,0 +1,108 @@
+/*
+Copyright 2018 Heptio Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package aggregation
+
+import (
+	"context"
+	"io/ioutil"
+	"net"
+	"os"
+	"reflect"
+	"testing"
+
+	"github.com/heptio/sonobuoy/pkg/plugin"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestRun_dryRun(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sonobuoy_plan_test")
+	if err != nil {
+		t.Fatalf("Could not create temp directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	// A dry run mustn't bind the server's port
+	inUse, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("couldn't listen on a free port: %v", err)
+	}
+	defer inUse.Close()
+
+	ran := false
+	run := func(string) error {
+		ran = true
+		return nil
+	}
+	daemonset := &fakePlugin{name: "systemd_logs", nodes: []string{"node1", "node2"}, run: run}
+	job := &fakePlugin{name: "e2e", dependsOn: []string{"systemd_logs"}, run: run}
+	client := &fakeClient{nodes: []v1.Node{
+		{ObjectMeta: metav1.ObjectMeta{Name: "node1"}},
+		{ObjectMeta: metav1.ObjectMeta{Name: "node2"}},
+	}}
+
+	cfg := plugin.AggregationConfig{
+		BindAddress:    "127.0.0.1",
+		BindPort:       inUse.Addr().(*net.TCPAddr).Port,
+		TimeoutSeconds: 3600,
+		PluginTimeouts: map[string]int{"e2e": 600},
+		NodeSelector:   "role=worker",
+		DryRun:         true,
+	}
+	summary, err := Run(context.Background(), client, []plugin.Interface{daemonset, job}, cfg, "heptio-sonobuoy-test", dir, RunOptions{})
+	if err != nil {
+		t.Fatalf("unexpected error from dry run: %v", err)
+	}
+	if ran {
+		t.Error("expected no plugins to be run")
+	}
+	if files, _ := ioutil.ReadDir(dir); len(files) != 0 {
+		t.Errorf("expected nothing to be written, got %v files", len(files))
+	}
+
+	want := &RunPlan{
+		NodeSelector:    "role=worker",
+		Nodes:           []string{"node1", "node2"},
+		TimeoutSeconds:  3600,
+		ExpectedResults: 3,
+		Plugins: []PluginPlan{
+			{
+				Name:       "systemd_logs",
+				ResultType: "systemd_logs",
+				ExpectedResults: []plugin.ExpectedResult{
+					{NodeName: "node1", ResultType: "systemd_logs"},
+					{NodeName: "node2", ResultType: "systemd_logs"},
+				},
+				TimeoutSeconds: 3600,
+				RunAttempts:    defaultPluginRunAttempts,
+			}, {
+				Name:            "e2e",
+				ResultType:      "e2e",
+				DependsOn:       []string{"systemd_logs"},
+				ExpectedResults: []plugin.ExpectedResult{{ResultType: "e2e"}},
+				TimeoutSeconds:  600,
+				RunAttempts:     defaultPluginRunAttempts,
+			},
+		},
+	}
+	if !reflect.DeepEqual(summary.Plan, want) {
+		t.Errorf("expected plan %+v, got %+v", want, summary.Plan)
+	}
+	if summary.Expected != 3 {
+		t.Errorf("expected the summary to count 3 expected results, got %v", summary.Expected)
+	}
+}
@@ -0,0 +1,94 @@
+/*
+Copyright 2018 Heptio Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package aggregation
+
+import (
+	"sync"
+)
+
+// writeQueue limits how many results are written out at once. Once every
+// slot is taken, waiting results get the next free slot in order of
+// priority, highest first, and in the order they started waiting among
+// results of the same priority.
+type writeQueue struct {
+	mu      sync.Mutex
+	free    int
+	waiting []*writeWaiter
+}
+
+// writeWaiter is a result waiting for a slot, which is handed over by
+// closing ready.
+type writeWaiter struct {
+	priority int
+	ready    chan struct{}
+}
+
+// newWriteQueue returns a queue with size slots.
+func newWriteQueue(size int) *writeQueue {
+	return &writeQueue{free: size}
+}
+
+// acquire waits until a slot is free for a result of the given priority,
+// returning a func which frees it.
+func (q *writeQueue) acquire(priority int) (release func()) {
+	q.mu.Lock()
+	if q.free > 0 && len(q.waiting) == 0 {
+		q.free--
+		q.mu.Unlock()
+		return q.release
+	}
+
+	w := &writeWaiter{priority: priority, ready: make(chan struct{})}
+	// Waiters are kept sorted, so w goes after every waiter of the same
+	// or higher priority.
+	i := len(q.waiting)
+	for j, other := range q.waiting {
+		if other.priority < priority {
+			i = j
+			break
+		}
+	}
+	q.waiting = append(q.waiting, nil)
+	copy(q.waiting[i+1:], q.waiting[i:])
+	q.waiting[i] = w
+	q.mu.Unlock()
+
+	<-w.ready
+	return q.release
+}
+
+// release hands the slot over to the first waiting result, or frees it if
+// none are waiting.
+func (q *writeQueue) release() {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if len(q.waiting) == 0 {
+		q.free++
+		return
+	}
+	next := q.waiting[0]
+	q.waiting[0] = nil
+	q.waiting = q.waiting[1:]
+	close(next.ready)
+}
+
+// waitingCount returns how many results are waiting for a slot.
+func (q *writeQueue) waitingCount() int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return len(q.waiting)
+}
@@ -0,0 +1,71 @@
+/*
+Copyright 2018 Heptio Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package aggregation
+
+import (
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestWriteQueue(t *testing.T) {
+	q := newWriteQueue(1)
+	release := q.acquire(0)
+
+	var mu sync.Mutex
+	var got string
+	var wg sync.WaitGroup
+	for i, priority := range []int{0, 1, 0, 2, 1} {
+		name := string(rune('a' + i))
+		wg.Add(1)
+		go func(priority int) {
+			defer wg.Done()
+			release := q.acquire(priority)
+			mu.Lock()
+			got += name
+			mu.Unlock()
+			release()
+		}(priority)
+
+		// Each one starts waiting before the next is sent.
+		deadline := time.Now().Add(5 * time.Second)
+		for q.waitingCount() != i+1 {
+			if time.Now().After(deadline) {
+				t.Fatalf("timed out waiting for %v to wait for a slot", name)
+			}
+			time.Sleep(time.Millisecond)
+		}
+	}
+
+	release()
+	wg.Wait()
+	if got != "dbeac" {
+		t.Errorf("expected the slot to go highest priority first, then in the order they waited, got %q", got)
+	}
+
+	// With nothing waiting, the slot is free again.
+	done := make(chan struct{})
+	go func() {
+		q.acquire(0)()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out acquiring a free slot")
+	}
+}
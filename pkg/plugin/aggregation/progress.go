@@ -0,0 +1,140 @@
+/*
+Copyright 2018 Heptio Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package aggregation
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"time"
+
+	"github.com/heptio/sonobuoy/pkg/plugin"
+	"github.com/pkg/errors"
+)
+
+// maxCurrentTestLength limits how much of the current test a progress report
+// keeps, so that reports can't bloat the status annotation.
+const maxCurrentTestLength = 256
+
+// PluginProgress is the body of a progress report, which a plugin may PUT
+// while it's running to say how far it has got, e.g.
+//
+//	{"completed": 120, "failed": 2, "total": 340, "currenttest": "[sig-apps] Deployment ..."}
+//
+// Progress is only informational: results still complete a plugin the same
+// way.
+type PluginProgress struct {
+	// Completed is how many tests have finished, including those which
+	// failed.
+	Completed int `json:"completed"`
+	// Failed is how many of the completed tests failed.
+	Failed int `json:"failed"`
+	// Total is how many tests will be run, if known.
+	Total int `json:"total,omitempty"`
+	// CurrentTest is the name of the test being run, if any.
+	CurrentTest string `json:"currenttest,omitempty"`
+	// Updated is when the aggregator received the report, so it is ignored
+	// in reports.
+	Updated time.Time `json:"updated"`
+}
+
+// Validate returns an error if the progress doesn't make sense.
+func (p PluginProgress) Validate() error {
+	switch {
+	case p.Completed < 0 || p.Failed < 0 || p.Total < 0:
+		return errors.New("progress counts must not be negative")
+	case p.Failed > p.Completed:
+		return errors.Errorf("%v tests can't have failed when only %v completed", p.Failed, p.Completed)
+	case p.Total > 0 && p.Completed > p.Total:
+		return errors.Errorf("%v tests can't have completed out of %v", p.Completed, p.Total)
+	}
+	return nil
+}
+
+// String formats the progress like "120/340 tests, 2 failed".
+func (p PluginProgress) String() string {
+	if p.Total > 0 {
+		return fmt.Sprintf("%d/%d tests, %d failed", p.Completed, p.Total, p.Failed)
+	}
+	return fmt.Sprintf("%d tests, %d failed", p.Completed, p.Failed)
+}
+
+// ProgressReport is the progress a plugin reported for one of its results.
+type ProgressReport struct {
+	ResultType string
+	// NodeName is empty for results which aren't node-specific.
+	NodeName string
+	// ClientName is the common name of the verified client certificate the
+	// report was made with, if any.
+	ClientName string
+	Progress   PluginProgress
+}
+
+func (r *ProgressReport) expectedResultID() string {
+	expected := plugin.ExpectedResult{ResultType: r.ResultType, NodeName: r.NodeName}
+	return expected.ID()
+}
+
+// HandleHTTPProgress is called when a plugin reports its progress on one of
+// the results it's expected to submit. Only the latest report is kept, and
+// reports for results which have already been received are rejected with a
+// 409 conflict.
+func (a *Aggregator) HandleHTTPProgress(report *ProgressReport, w http.ResponseWriter) {
+	a.resultsMutex.Lock()
+	defer a.resultsMutex.Unlock()
+
+	id := report.expectedResultID()
+	if _, ok := a.ExpectedResults[id]; !ok {
+		http.Error(w, fmt.Sprintf("Result %v unexpected", id), http.StatusForbidden)
+		return
+	}
+	if !a.isClient(report.ResultType, report.ClientName) {
+		a.logger().WithField("plugin", report.ResultType).WithField("node", report.NodeName).WithField("client_cert", report.ClientName).Warning("Rejecting progress reported with another plugin's client certificate")
+		http.Error(w, fmt.Sprintf("Progress of %v can't be reported by %v", id, report.ClientName), http.StatusForbidden)
+		return
+	}
+	if _, ok := a.Results[id]; ok {
+		http.Error(w, fmt.Sprintf("Result %v already received", id), http.StatusConflict)
+		return
+	}
+
+	report.Progress.Updated = time.Now().UTC()
+	if len(report.Progress.CurrentTest) > maxCurrentTestLength {
+		report.Progress.CurrentTest = report.Progress.CurrentTest[:maxCurrentTestLength]
+	}
+	a.progress[id] = *report
+	a.manifest.recordProgress(id, report.Progress)
+}
+
+// copyProgress returns the latest progress reported for each result, sorted
+// by result ID.
+func (a *Aggregator) copyProgress() []ProgressReport {
+	a.resultsMutex.Lock()
+	defer a.resultsMutex.Unlock()
+
+	ids := make([]string, 0, len(a.progress))
+	for id := range a.progress {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+
+	reports := make([]ProgressReport, len(ids))
+	for i, id := range ids {
+		reports[i] = a.progress[id]
+	}
+	return reports
+}
@@ -0,0 +1,122 @@
+/*
+Copyright 2018 Heptio Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package aggregation
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"strings"
+	"testing"
+
+	"github.com/heptio/sonobuoy/pkg/plugin"
+)
+
+func TestHandler_progress(t *testing.T) {
+	outdir, err := ioutil.TempDir("", "sonobuoy_progress_test")
+	if err != nil {
+		t.Fatalf("Could not create temp directory: %v", err)
+	}
+	defer os.RemoveAll(outdir)
+
+	p := &fakePlugin{name: "e2e"}
+	aggr := NewAggregator(path.Join(outdir, "plugins"), p.ExpectedResults(nil))
+	aggr.manifest = newResultsManifest(outdir, []plugin.Interface{p})
+	h := NewHandler(aggr.HandleHTTPResult)
+	h.ProgressCallback = aggr.HandleHTTPProgress
+
+	report := func(url, body string) int {
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, httptest.NewRequest("PUT", url, strings.NewReader(body)))
+		return w.Code
+	}
+
+	testCases := []struct {
+		desc       string
+		url        string
+		body       string
+		expectCode int
+	}{
+		{desc: "Not JSON", url: "/api/v1/results/global/e2e/progress", body: "120 done", expectCode: http.StatusBadRequest},
+		{desc: "Negative count", url: "/api/v1/results/global/e2e/progress", body: `{"completed": -1}`, expectCode: http.StatusBadRequest},
+		{desc: "More failed than completed", url: "/api/v1/results/global/e2e/progress", body: `{"completed": 1, "failed": 2}`, expectCode: http.StatusBadRequest},
+		{desc: "More completed than total", url: "/api/v1/results/global/e2e/progress", body: `{"completed": 341, "total": 340}`, expectCode: http.StatusBadRequest},
+		{desc: "Unexpected result", url: "/api/v1/results/by-node/node1/e2e/progress", body: `{"completed": 1}`, expectCode: http.StatusForbidden},
+		{desc: "Valid", url: "/api/v1/results/global/e2e/progress", body: `{"completed": 120, "failed": 2, "total": 340, "currenttest": "some test"}`, expectCode: http.StatusOK},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.desc, func(t *testing.T) {
+			if code := report(tc.url, tc.body); code != tc.expectCode {
+				t.Errorf("expected a %v response, got %v", tc.expectCode, code)
+			}
+		})
+	}
+
+	reports := aggr.copyProgress()
+	if len(reports) != 1 {
+		t.Fatalf("expected only the valid report to be kept, got %+v", reports)
+	}
+	progress := reports[0].Progress
+	if progress.Completed != 120 || progress.Failed != 2 || progress.Total != 340 || progress.CurrentTest != "some test" || progress.Updated.IsZero() {
+		t.Errorf("unexpected progress %+v", progress)
+	}
+	if progress.String() != "120/340 tests, 2 failed" {
+		t.Errorf("unexpected progress string %q", progress.String())
+	}
+
+	u := newUpdater(p.ExpectedResults(nil), "heptio-sonobuoy-test", nil)
+	u.ReceiveProgress(reports)
+	if got := u.status.Plugins[0].Progress; got == nil || got.Completed != 120 {
+		t.Errorf("expected the progress in the status, got %+v", got)
+	}
+
+	// The last report is recorded with the result, after which the plugin
+	// can't report any more.
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest("PUT", "/api/v1/results/global/e2e", strings.NewReader("{}")))
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected a 200 response, got %v: %v", w.Code, w.Body.String())
+	}
+	if code := report("/api/v1/results/global/e2e/progress", `{"completed": 340}`); code != http.StatusConflict {
+		t.Errorf("expected a 409 response reporting progress after the result, got %v", code)
+	}
+	manifest := readManifest(t, outdir)
+	if len(manifest.Results) != 1 || manifest.Results[0].Progress == nil || manifest.Results[0].Progress.Completed != 120 {
+		t.Errorf("expected the last progress in the manifest, got %+v", manifest.Results)
+	}
+}
+
+func TestHandler_progressWithoutCallback(t *testing.T) {
+	h := NewHandler(func(*plugin.Result, http.ResponseWriter) {})
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest("PUT", "/api/v1/results/global/e2e/progress", strings.NewReader(`{"completed": 1}`)))
+	if w.Code != http.StatusNotFound {
+		t.Errorf("expected a 404 response, got %v", w.Code)
+	}
+}
+
+func TestProgressURL(t *testing.T) {
+	url, err := NodeResultURL("https://sonobuoy:8080/", "node1", "systemd_logs")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if got, want := ProgressURL(url), "https://sonobuoy:8080/api/v1/results/by-node/node1/systemd_logs/progress"; got != want {
+		t.Errorf("expected %v, got %v", want, got)
+	}
+}
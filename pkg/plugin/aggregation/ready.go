@@ -0,0 +1,168 @@
+/*
+Copyright 2018 Heptio Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package aggregation
+
+import (
+	"context"
+	"encoding/json"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/heptio/sonobuoy/pkg/plugin"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"k8s.io/client-go/kubernetes"
+)
+
+const (
+	// defaultReadyGateTimeout is how long to wait for the ready gate if
+	// the timeout isn't configured.
+	defaultReadyGateTimeout = 10 * time.Minute
+	// defaultReadyGateInterval is how often the ready gate is checked if
+	// the interval isn't configured.
+	defaultReadyGateInterval = 5 * time.Second
+)
+
+// ReadyCheck reports whether plugins may be launched yet. An error doesn't
+// end the wait, since what's checked may not exist yet, but the last one is
+// reported if the check never passes.
+type ReadyCheck func(ctx context.Context) (bool, error)
+
+// waitForReadyGates waits for the ReadyGate in the config and then the
+// ReadyCheck in the options, if they're set.
+func waitForReadyGates(ctx context.Context, client kubernetes.Interface, cfg plugin.AggregationConfig, opts RunOptions, log logrus.FieldLogger) error {
+	var gate plugin.ReadyGate
+	if cfg.ReadyGate != nil {
+		gate = *cfg.ReadyGate
+		if err := waitUntilReady(ctx, conditionCheck(client, gate), gate.String(), readyGateTimeout(gate), readyGateInterval(gate), log); err != nil {
+			return err
+		}
+	}
+	if opts.ReadyCheck != nil {
+		timeout := opts.ReadyTimeout
+		if timeout <= 0 {
+			timeout = defaultReadyGateTimeout
+		}
+		if err := waitUntilReady(ctx, opts.ReadyCheck, "the ready check", timeout, readyGateInterval(gate), log); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// waitUntilReady calls check every interval until it passes, returning an
+// error if it hasn't within the timeout or ctx is done first. desc describes
+// what's being waited for in logs and errors.
+func waitUntilReady(ctx context.Context, check ReadyCheck, desc string, timeout, interval time.Duration, log logrus.FieldLogger) error {
+	log = log.WithField("ready_gate", desc)
+	log.WithField("timeout", timeout).Info("Waiting for the ready gate before launching plugins")
+
+	deadline := time.NewTimer(timeout)
+	defer deadline.Stop()
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	var lastErr error
+	for {
+		ready, err := check(ctx)
+		switch {
+		case ready:
+			log.Info("Ready gate passed")
+			return nil
+		case err != nil:
+			lastErr = err
+			log.WithError(err).Info("Couldn't check the ready gate, will retry")
+		}
+
+		select {
+		case <-ctx.Done():
+			return errors.Wrapf(ctx.Err(), "stopped waiting for %v", desc)
+		case <-deadline.C:
+			err := errors.Errorf("%v wasn't met after %v, no plugins were launched", desc, timeout)
+			if lastErr != nil {
+				err = errors.Wrapf(lastErr, "%v", err)
+			}
+			return err
+		case <-ticker.C:
+		}
+	}
+}
+
+// conditionCheck returns a ReadyCheck which passes once the object named by
+// the gate has the gate's condition with the status wanted.
+func conditionCheck(client kubernetes.Interface, gate plugin.ReadyGate) ReadyCheck {
+	return func(ctx context.Context) (bool, error) {
+		raw, err := client.Discovery().RESTClient().Get().AbsPath(objectPath(gate)).Context(ctx).DoRaw()
+		if err != nil {
+			return false, errors.Wrapf(err, "couldn't get %v/%v", gate.Resource, gate.Name)
+		}
+
+		var obj struct {
+			Status struct {
+				Conditions []struct {
+					Type    string `json:"type"`
+					Status  string `json:"status"`
+					Message string `json:"message"`
+				} `json:"conditions"`
+			} `json:"status"`
+		}
+		if err := json.Unmarshal(raw, &obj); err != nil {
+			return false, errors.Wrapf(err, "couldn't unmarshal %v/%v", gate.Resource, gate.Name)
+		}
+		for _, cond := range obj.Status.Conditions {
+			if cond.Type == gate.Condition {
+				if cond.Status == gate.WantStatus() {
+					return true, nil
+				}
+				return false, errors.Errorf("condition %v is %v: %v", cond.Type, cond.Status, cond.Message)
+			}
+		}
+		return false, errors.Errorf("condition %v isn't set", gate.Condition)
+	}
+}
+
+// objectPath returns the API path of the object named by the gate.
+func objectPath(gate plugin.ReadyGate) string {
+	prefix := "/apis"
+	if !strings.Contains(gate.APIVersion, "/") {
+		prefix = "/api"
+	}
+	p := path.Join(prefix, gate.APIVersion)
+	if gate.Namespace != "" {
+		p = path.Join(p, "namespaces", gate.Namespace)
+	}
+	return path.Join(p, gate.Resource, gate.Name)
+}
+
+// readyGateTimeout returns how long to wait for the ready gate, falling back
+// to the default if it isn't configured.
+func readyGateTimeout(gate plugin.ReadyGate) time.Duration {
+	if gate.TimeoutSeconds <= 0 {
+		return defaultReadyGateTimeout
+	}
+	return time.Duration(gate.TimeoutSeconds) * time.Second
+}
+
+// readyGateInterval returns how often to check the ready gate, falling back
+// to the default if it isn't configured.
+func readyGateInterval(gate plugin.ReadyGate) time.Duration {
+	if gate.IntervalSeconds <= 0 {
+		return defaultReadyGateInterval
+	}
+	return time.Duration(gate.IntervalSeconds) * time.Second
+}
@@ -0,0 +1,159 @@
+/*
+Copyright 2018 Heptio Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package aggregation
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/heptio/sonobuoy/pkg/plugin"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
+)
+
+func TestConditionCheck(t *testing.T) {
+	var job string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/apis/batch/v1/namespaces/default/jobs/setup" || job == "" {
+			http.NotFound(w, r)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(job))
+	}))
+	defer srv.Close()
+	client, err := kubernetes.NewForConfig(&rest.Config{Host: srv.URL})
+	if err != nil {
+		t.Fatalf("couldn't make client: %v", err)
+	}
+
+	check := conditionCheck(client, plugin.ReadyGate{APIVersion: "batch/v1", Resource: "jobs", Namespace: "default", Name: "setup", Condition: "Complete"})
+	testCases := []struct {
+		desc      string
+		job       string
+		expectErr string
+		ready     bool
+	}{
+		{desc: "Missing", expectErr: "couldn't get jobs/setup"},
+		{desc: "No conditions", job: `{"status":{}}`, expectErr: "condition Complete isn't set"},
+		{desc: "Other condition", job: `{"status":{"conditions":[{"type":"Failed","status":"False"}]}}`, expectErr: "condition Complete isn't set"},
+		{desc: "Not met", job: `{"status":{"conditions":[{"type":"Complete","status":"False","message":"still running"}]}}`, expectErr: "condition Complete is False: still running"},
+		{desc: "Met", job: `{"status":{"conditions":[{"type":"Failed","status":"False"},{"type":"Complete","status":"True"}]}}`, ready: true},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.desc, func(t *testing.T) {
+			job = tc.job
+			ready, err := check(context.Background())
+			if ready != tc.ready {
+				t.Errorf("expected ready to be %v", tc.ready)
+			}
+			switch {
+			case tc.expectErr == "" && err != nil:
+				t.Errorf("unexpected error %v", err)
+			case tc.expectErr != "" && (err == nil || !strings.Contains(err.Error(), tc.expectErr)):
+				t.Errorf("expected an error containing %q, got %v", tc.expectErr, err)
+			}
+		})
+	}
+}
+
+func TestObjectPath(t *testing.T) {
+	testCases := []struct {
+		gate plugin.ReadyGate
+		want string
+	}{
+		{gate: plugin.ReadyGate{APIVersion: "batch/v1", Resource: "jobs", Namespace: "default", Name: "setup"}, want: "/apis/batch/v1/namespaces/default/jobs/setup"},
+		{gate: plugin.ReadyGate{APIVersion: "v1", Resource: "pods", Namespace: "default", Name: "setup"}, want: "/api/v1/namespaces/default/pods/setup"},
+		{gate: plugin.ReadyGate{APIVersion: "apiextensions.k8s.io/v1beta1", Resource: "customresourcedefinitions", Name: "widgets.example.com"}, want: "/apis/apiextensions.k8s.io/v1beta1/customresourcedefinitions/widgets.example.com"},
+	}
+
+	for _, tc := range testCases {
+		if got := objectPath(tc.gate); got != tc.want {
+			t.Errorf("expected %v, got %v", tc.want, got)
+		}
+	}
+}
+
+func TestWaitUntilReady(t *testing.T) {
+	log := logrus.New()
+	log.Out = ioutil.Discard
+
+	calls := 0
+	check := func(context.Context) (bool, error) {
+		calls++
+		if calls < 3 {
+			return false, errors.New("not yet")
+		}
+		return true, nil
+	}
+	if err := waitUntilReady(context.Background(), check, "the gate", time.Minute, time.Millisecond, log); err != nil {
+		t.Errorf("unexpected error %v", err)
+	}
+	if calls != 3 {
+		t.Errorf("expected the check to be retried until it passed, got %v calls", calls)
+	}
+
+	err := waitUntilReady(context.Background(), func(context.Context) (bool, error) {
+		return false, errors.New("condition Complete isn't set")
+	}, "the gate", 20*time.Millisecond, time.Millisecond, log)
+	if err == nil || err.Error() != "the gate wasn't met after 20ms, no plugins were launched: condition Complete isn't set" {
+		t.Errorf("expected a timeout with the last error, got %v", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	err = waitUntilReady(ctx, func(context.Context) (bool, error) { return false, nil }, "the gate", time.Minute, time.Minute, log)
+	if errors.Cause(err) != context.Canceled {
+		t.Errorf("expected the wait to stop when cancelled, got %v", err)
+	}
+}
+
+func TestRun_readyGate(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sonobuoy_run_test")
+	if err != nil {
+		t.Fatalf("Could not create temp directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	ran := false
+	e2e := &fakePlugin{name: "e2e", run: func(string) error {
+		ran = true
+		return nil
+	}}
+	neverReady := func(context.Context) (bool, error) { return false, nil }
+
+	_, err = Run(context.Background(), &fakeClient{}, []plugin.Interface{e2e}, plugin.AggregationConfig{}, "heptio-sonobuoy-test", dir, RunOptions{
+		InProcess:    NewInProcessServer(),
+		ReadyCheck:   neverReady,
+		ReadyTimeout: 50 * time.Millisecond,
+	})
+	if err == nil || !strings.Contains(err.Error(), "the ready check wasn't met after 50ms") {
+		t.Errorf("expected the run to fail waiting for the ready check, got %v", err)
+	}
+	if ran {
+		t.Error("expected no plugins to be launched")
+	}
+}
@@ -0,0 +1,159 @@
+/*
+Copyright 2018 Heptio Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package aggregation
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"path"
+	"sort"
+
+	"github.com/heptio/sonobuoy/pkg/plugin"
+	"github.com/pkg/errors"
+)
+
+// mergedDir is the directory, within the directory of a result type, which
+// the artifact merged from its results is written to.
+const mergedDir = "merged"
+
+// Reducer merges the results of a plugin, once they've all arrived, into one
+// more artifact which is written alongside them, such as a single report
+// combining the report of each node.
+type Reducer interface {
+	// Filename is the name the merged artifact is written with.
+	Filename() string
+	// Format is the result format of the merged artifact, recorded in the
+	// results manifest.
+	Format() string
+	// Reduce writes the merged artifact to w, given the plugin's successful
+	// results sorted by node.
+	Reduce(results []ReducerInput, w io.Writer) error
+}
+
+// ReducerInput is a result to be merged by a Reducer.
+type ReducerInput struct {
+	// NodeName is empty for results which aren't node-specific.
+	NodeName string
+	Body     []byte
+}
+
+// reducers are the reducers plugins can opt in to, by name.
+var reducers = map[string]Reducer{
+	plugin.ResultReducerJUnit: JUnitReducer{},
+}
+
+// resultReducers looks up the reducers the plugins opt in to, by result type.
+func resultReducers(plugins []plugin.Interface) (map[string]Reducer, error) {
+	byType := map[string]Reducer{}
+	for _, p := range plugins {
+		r, ok := p.(plugin.Reduced)
+		if !ok || r.GetResultReducer() == "" {
+			continue
+		}
+		reducer, ok := reducers[r.GetResultReducer()]
+		if !ok {
+			return nil, errors.Errorf("unknown result reducer %q for plugin %v", r.GetResultReducer(), p.GetName())
+		}
+		byType[p.GetResultType()] = reducer
+	}
+	return byType, nil
+}
+
+// reduceResult keeps the body of a recorded result for its reducer, if its
+// result type has one, and merges the results of the type once the plugin
+// is done. Only successful results uploaded whole can be merged. Errors are
+// logged rather than returned since the results themselves were already
+// saved. resultsMutex must be held by the caller.
+func (a *Aggregator) reduceResult(result *plugin.Result, pluginDone bool) {
+	reducer := a.Reducers[result.ResultType]
+	if reducer == nil {
+		return
+	}
+	if a.reducible == nil {
+		a.reducible = map[string]map[string]ReducerInput{}
+	}
+	inputs := a.reducible[result.ResultType]
+	if inputs == nil {
+		inputs = map[string]ReducerInput{}
+		a.reducible[result.ResultType] = inputs
+	}
+
+	id := result.ExpectedResultID()
+	body, ok := result.Body.(*resultBody)
+	switch {
+	case ok && body.copy != nil && result.IsSuccess():
+		inputs[id] = ReducerInput{NodeName: result.NodeName, Body: body.copy.Bytes()}
+	case result.IsSuccess():
+		a.logger().WithFields(resultFields(result)).Info("Result wasn't uploaded whole, leaving it out of the merged results")
+		fallthrough
+	default:
+		delete(inputs, id)
+	}
+
+	if !pluginDone {
+		return
+	}
+	if err := a.writeReduced(result.ResultType, reducer, inputs); err != nil {
+		a.logger().WithField("resulttype", result.ResultType).WithError(err).Info("Couldn't merge results")
+	}
+}
+
+// writeReduced merges the results of the given type with the reducer and
+// writes the merged artifact, passing it through the Transforms first.
+// Nothing is written if there are no results to merge.
+func (a *Aggregator) writeReduced(resultType string, reducer Reducer, inputs map[string]ReducerInput) error {
+	if len(inputs) == 0 {
+		return nil
+	}
+	sorted := make([]ReducerInput, 0, len(inputs))
+	for _, input := range inputs {
+		sorted = append(sorted, input)
+	}
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i].NodeName < sorted[j].NodeName })
+
+	var merged bytes.Buffer
+	if err := reducer.Reduce(sorted, &merged); err != nil {
+		return errors.Wrapf(err, "couldn't merge the results of %v", resultType)
+	}
+	body, err := a.transform(&plugin.Result{ResultType: resultType, Filename: reducer.Filename()}, &merged)
+	if err != nil {
+		return err
+	}
+
+	file := a.reducedPath(resultType, reducer)
+	if err := os.MkdirAll(path.Dir(file), 0755); err != nil {
+		return errors.Wrapf(err, "couldn't create directory %v", path.Dir(file))
+	}
+	out, err := os.Create(file)
+	if err != nil {
+		return errors.Wrapf(err, "couldn't create merged results file %v", file)
+	}
+	defer out.Close()
+	if _, err := io.Copy(out, body); err != nil {
+		return errors.Wrapf(err, "couldn't write merged results to %v", file)
+	}
+	a.manifest.recordMerged(file, resultType, reducer.Format(), len(sorted))
+	return nil
+}
+
+// reducedPath returns where the artifact merged from the results of the
+// given type is written. It doesn't depend on the Layout, so it's always in
+// the same place.
+func (a *Aggregator) reducedPath(resultType string, reducer Reducer) string {
+	return path.Join(a.OutputDir, resultType, mergedDir, reducer.Filename())
+}
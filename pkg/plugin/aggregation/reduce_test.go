@@ -0,0 +1,159 @@
+/*
+Copyright 2018 Heptio Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package aggregation
+
+import (
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/heptio/sonobuoy/pkg/backplane/ca/authtest"
+	"github.com/heptio/sonobuoy/pkg/plugin"
+	"github.com/heptio/sonobuoy/pkg/plugin/driver/daemonset"
+	pluginutils "github.com/heptio/sonobuoy/pkg/plugin/driver/utils"
+)
+
+func TestAggregation_reduce(t *testing.T) {
+	expected := []plugin.ExpectedResult{
+		{NodeName: "node1", ResultType: "e2e"},
+		{NodeName: "node2", ResultType: "e2e"},
+		{NodeName: "node3", ResultType: "e2e"},
+	}
+
+	withAggregator(t, expected, func(agg *Aggregator, srv *authtest.Server) {
+		agg.Reducers = map[string]Reducer{"e2e": JUnitReducer{}}
+		agg.manifest = newResultsManifest(agg.OutputDir, nil)
+		put := func(node, body string) {
+			URL, err := NodeResultURL(srv.URL, node, "e2e")
+			if err != nil {
+				t.Fatalf("couldn't get test server URL: %v", err)
+			}
+			if resp := doRequest(t, srv.Client(), "PUT", URL, []byte(body)); resp.StatusCode != http.StatusOK {
+				t.Fatalf("expected the result of %v to be accepted, got a %v", node, resp.StatusCode)
+			}
+		}
+		merged := agg.reducedPath("e2e", JUnitReducer{})
+
+		put("node2", `<testsuite name="e2e" tests="2" failures="1"><testcase name="b"/></testsuite>`)
+		put("node1", `<testsuite name="e2e" tests="1"><testcase name="a"/></testsuite>`)
+		if _, err := os.Stat(merged); !os.IsNotExist(err) {
+			t.Errorf("expected nothing to be merged before every result arrived, got %v", err)
+		}
+		agg.IngestResults(resultsChannel(pluginutils.MakeErrorResult("e2e", map[string]interface{}{"error": "pod failed"}, "node3")))
+
+		blob, err := ioutil.ReadFile(merged)
+		if err != nil {
+			t.Fatalf("expected the results to be merged: %v", err)
+		}
+		report := string(blob)
+		if !strings.Contains(report, `<testsuites tests="3" failures="1"`) {
+			t.Errorf("expected the merged report to total the suites, got %s", blob)
+		}
+		if first, second := strings.Index(report, `hostname="node1"`), strings.Index(report, `hostname="node2"`); first < 0 || second < first {
+			t.Errorf("expected the suites to be in node order, got %s", blob)
+		}
+		if strings.Contains(report, "node3") {
+			t.Errorf("expected the failed result to be left out, got %s", blob)
+		}
+		if n := len(agg.manifest.merged); n != 1 || agg.manifest.merged["e2e"].Results != 2 || agg.manifest.merged["e2e"].File.Path != "e2e/merged/junit.xml" {
+			t.Errorf("expected the merged report to be in the manifest, got %+v", agg.manifest.merged)
+		}
+	})
+}
+
+func resultsChannel(results ...*plugin.Result) <-chan *plugin.Result {
+	ch := make(chan *plugin.Result, len(results))
+	for _, result := range results {
+		ch <- result
+	}
+	close(ch)
+	return ch
+}
+
+func TestResultReducers(t *testing.T) {
+	withReducer := func(name, reducer string) plugin.Interface {
+		return daemonset.NewPlugin(plugin.Definition{Name: name, ResultType: name, ResultReducer: reducer}, "heptio-sonobuoy", "", "", "", nil)
+	}
+	plugins := []plugin.Interface{
+		withReducer("e2e", plugin.ResultReducerJUnit),
+		withReducer("systemd_logs", ""),
+		&fakePlugin{name: "other"},
+	}
+	byType, err := resultReducers(plugins)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if _, ok := byType["e2e"].(JUnitReducer); !ok || len(byType) != 1 {
+		t.Errorf("expected only the e2e plugin to have a reducer, got %v", byType)
+	}
+
+	if _, err := resultReducers([]plugin.Interface{withReducer("bad", "csv")}); err == nil || !strings.Contains(err.Error(), `unknown result reducer "csv" for plugin bad`) {
+		t.Errorf("expected an unknown reducer to be rejected, got %v", err)
+	}
+}
+
+// linesReducer merges results by writing each body on a line of its own.
+type linesReducer struct{}
+
+func (linesReducer) Filename() string { return "results.jsonl" }
+func (linesReducer) Format() string   { return "jsonl" }
+
+func (linesReducer) Reduce(results []ReducerInput, w io.Writer) error {
+	for _, result := range results {
+		if _, err := w.Write(append(result.Body, '\n')); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func TestAggregation_reduceCheckedResults(t *testing.T) {
+	expected := []plugin.ExpectedResult{
+		{NodeName: "node1", ResultType: "checks"},
+		{NodeName: "node2", ResultType: "checks"},
+	}
+
+	withAggregator(t, expected, func(agg *Aggregator, srv *authtest.Server) {
+		schema, err := ParseResultSchema([]byte(`{"type":"object","required":["version"]}`))
+		if err != nil {
+			t.Fatalf("couldn't parse schema: %v", err)
+		}
+		agg.Schemas = map[string]*ResultSchema{"checks": schema}
+		agg.Reducers = map[string]Reducer{"checks": linesReducer{}}
+		agg.manifest = newResultsManifest(agg.OutputDir, nil)
+		for _, node := range []string{"node1", "node2"} {
+			URL, err := NodeResultURL(srv.URL, node, "checks")
+			if err != nil {
+				t.Fatalf("couldn't get test server URL: %v", err)
+			}
+			if resp := doRequest(t, srv.Client(), "PUT", URL, []byte(`{"version":1}`)); resp.StatusCode != http.StatusOK {
+				t.Fatalf("expected the result of %v to match its schema, got a %v", node, resp.StatusCode)
+			}
+		}
+
+		blob, err := ioutil.ReadFile(agg.reducedPath("checks", linesReducer{}))
+		if err != nil {
+			t.Fatalf("expected the validated results to be merged: %v", err)
+		}
+		if want := "{\"version\":1}\n{\"version\":1}\n"; string(blob) != want {
+			t.Errorf("expected merged results %q, got %q", want, blob)
+		}
+	})
+}
@@ -0,0 +1,230 @@
+/*
+Copyright 2018 Heptio Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package aggregation
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+
+	"github.com/heptio/sonobuoy/pkg/plugin"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+// previousRun is what an earlier run recorded in the meta directory of the
+// results it wrote, which is used to resume it or to re-run only the plugins
+// which didn't complete.
+type previousRun struct {
+	outdir   string
+	manifest ResultsManifest
+	expected []plugin.ExpectedResult
+}
+
+// readPreviousRun reads the results manifest and expected results of the run
+// which wrote outdir.
+func readPreviousRun(outdir string) (*previousRun, error) {
+	prev := &previousRun{outdir: outdir}
+	files := map[string]interface{}{
+		ResultsManifestFile: &prev.manifest,
+		ExpectedResultsFile: &prev.expected,
+	}
+	for name, v := range files {
+		file := path.Join(outdir, metaDir, name)
+		blob, err := ioutil.ReadFile(file)
+		if err != nil {
+			return nil, errors.Wrapf(err, "couldn't read the results of the previous run")
+		}
+		if err := json.Unmarshal(blob, v); err != nil {
+			return nil, errors.Wrapf(err, "couldn't unmarshal %v", file)
+		}
+	}
+	return prev, nil
+}
+
+// completed returns true if every result the previous run expected of the
+// result type was received and succeeded.
+func (r *previousRun) completed(resultType string) bool {
+	entries := make(map[string]ManifestEntry, len(r.manifest.Results))
+	for _, entry := range r.manifest.Results {
+		entries[entryID(entry)] = entry
+	}
+
+	found := false
+	for _, expected := range r.expected {
+		if expected.ResultType != resultType {
+			continue
+		}
+		found = true
+		if entries[expected.ID()].Status != CompleteStatus {
+			return false
+		}
+	}
+	return found
+}
+
+// split separates the plugins which need to be run again from those which
+// already completed.
+func (r *previousRun) split(plugins []plugin.Interface, log logrus.FieldLogger) (rerun, skipped []plugin.Interface) {
+	for _, p := range plugins {
+		if r.completed(p.GetResultType()) {
+			log.WithField("plugin", p.GetName()).Info("Skipping plugin, it completed in the previous run")
+			skipped = append(skipped, p)
+			continue
+		}
+		rerun = append(rerun, p)
+	}
+	return rerun, skipped
+}
+
+// removeResults deletes the files of the previous results of every result
+// type which isn't kept, so they can't be mixed up with the new ones. Any
+// directories left empty are removed too.
+func (r *previousRun) removeResults(kept map[string]bool) error {
+	for _, entry := range r.manifest.Results {
+		if kept[entry.ResultType] {
+			continue
+		}
+		for _, file := range entry.Files {
+			filename := filepath.Join(r.outdir, filepath.FromSlash(file.Path))
+			if err := os.Remove(filename); err != nil && !os.IsNotExist(err) {
+				return errors.Wrapf(err, "couldn't remove previous result file %v", filename)
+			}
+			// Removing a directory fails if it isn't empty, which is
+			// where this stops.
+			for dir := filepath.Dir(filename); dir != r.outdir && os.Remove(dir) == nil; dir = filepath.Dir(dir) {
+			}
+		}
+	}
+	return nil
+}
+
+// removeUnrecorded deletes the files in the plugins directory which aren't
+// part of a recorded result, such as results which were only partly written
+// when the previous run stopped, so they can be written again from scratch.
+// Any directories left empty are removed too.
+func (r *previousRun) removeUnrecorded(log logrus.FieldLogger) error {
+	recorded := map[string]bool{}
+	for _, entry := range r.manifest.Results {
+		for _, file := range entry.Files {
+			recorded[filepath.Join(r.outdir, filepath.FromSlash(file.Path))] = true
+		}
+	}
+
+	var dirs []string
+	root := filepath.Join(r.outdir, "plugins")
+	err := filepath.Walk(root, func(filename string, info os.FileInfo, err error) error {
+		switch {
+		case err != nil:
+			return err
+		case info.IsDir():
+			dirs = append(dirs, filename)
+		case !recorded[filename]:
+			log.WithField("file", filename).Info("Removing file which isn't part of a recorded result")
+			return os.Remove(filename)
+		}
+		return nil
+	})
+	if err != nil && !os.IsNotExist(err) {
+		return errors.Wrap(err, "couldn't remove unrecorded results")
+	}
+
+	// Walk visits parents before their children, so going backwards
+	// removes children first. Directories which aren't empty are left.
+	for i := len(dirs) - 1; i > 0; i-- {
+		os.Remove(dirs[i])
+	}
+	return nil
+}
+
+// keptExpectedResults returns the results the previous run expected of the
+// given result types.
+func (r *previousRun) keptExpectedResults(kept map[string]bool) []plugin.ExpectedResult {
+	var expected []plugin.ExpectedResult
+	for _, result := range r.expected {
+		if kept[result.ResultType] {
+			expected = append(expected, result)
+		}
+	}
+	return expected
+}
+
+// restore records the results which the previous run recorded, as well as
+// adding them to the manifest with the timing and usage of their plugins.
+// Results of nodes which joined during the previous run are expected again.
+func (a *Aggregator) restore(prev *previousRun) {
+	a.resultsMutex.Lock()
+	defer a.resultsMutex.Unlock()
+
+	kept := map[string]bool{}
+	for _, entry := range prev.manifest.Results {
+		id := entryID(entry)
+		expected := plugin.ExpectedResult{ResultType: entry.ResultType, NodeName: entry.Node}
+		if a.ExpectedResults[id] == nil {
+			a.ExpectedResults[id] = &expected
+		}
+		a.Results[id] = &plugin.Result{ResultType: entry.ResultType, NodeName: entry.Node, Error: entry.Error, ErrorCategory: entry.ErrorCategory}
+		kept[entry.ResultType] = true
+	}
+	for _, timing := range prev.manifest.Plugins {
+		kept[timing.ResultType] = true
+	}
+	for _, usage := range prev.manifest.Usage {
+		kept[usage.ResultType] = true
+	}
+	a.manifest.keep(prev.manifest, kept)
+}
+
+// keep adds the manifest entries, timings, usage and parameters of the given
+// result types from the previous run to the manifest and rewrites the
+// manifest file, so that it describes all of the results in the directory.
+func (m *resultsManifest) keep(prev ResultsManifest, kept map[string]bool) {
+	if m == nil {
+		return
+	}
+	for _, entry := range prev.Results {
+		if kept[entry.ResultType] {
+			m.entries[entryID(entry)] = entry
+		}
+	}
+	for i, timing := range prev.Plugins {
+		if kept[timing.ResultType] {
+			m.timings[timing.ResultType] = &prev.Plugins[i]
+		}
+	}
+	for _, usage := range prev.Usage {
+		if kept[usage.ResultType] {
+			m.usage[usage.ResultType] = usage
+		}
+	}
+	for _, params := range prev.Parameters {
+		if kept[params.ResultType] {
+			m.params[params.ResultType] = params
+		}
+	}
+	if err := m.write(); err != nil {
+		m.log.WithError(err).Info("Couldn't write results manifest")
+	}
+}
+
+// entryID returns the ID of the result the manifest entry describes.
+func entryID(entry ManifestEntry) string {
+	id := plugin.ExpectedResult{ResultType: entry.ResultType, NodeName: entry.Node}
+	return id.ID()
+}
@@ -0,0 +1,282 @@
+/*
+Copyright 2018 Heptio Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package aggregation
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/heptio/sonobuoy/pkg/plugin"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+func TestRun_rerunFailed(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sonobuoy_rerun_test")
+	if err != nil {
+		t.Fatalf("Could not create temp directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	srv := NewInProcessServer()
+	submit := func(node, resultType string) {
+		go srv.Submit(node, resultType, "application/json", strings.NewReader(`{"some": "json"}`))
+	}
+
+	e2eRuns, logsFail := 0, true
+	e2e := &fakePlugin{name: "e2e", run: func(string) error {
+		e2eRuns++
+		submit("", "e2e")
+		return nil
+	}}
+	logs := &fakePlugin{name: "systemd_logs", nodes: []string{"node1", "node2"}, run: func(string) error {
+		if logsFail {
+			return errors.New("no logs today")
+		}
+		submit("node1", "systemd_logs")
+		submit("node2", "systemd_logs")
+		return nil
+	}}
+	post := &fakePlugin{name: "post", dependsOn: []string{"e2e", "systemd_logs"}, run: func(string) error {
+		submit("", "post")
+		return nil
+	}}
+	plugins := []plugin.Interface{e2e, logs, post}
+	cfg := plugin.AggregationConfig{PluginRunAttempts: 1}
+
+	summary, err := Run(context.Background(), &fakeClient{}, plugins, cfg, "heptio-sonobuoy-test", dir, RunOptions{InProcess: srv})
+	if err != nil {
+		t.Fatalf("unexpected error from run: %v", err)
+	}
+	if summary.Succeeded() {
+		t.Fatalf("expected the first run to fail, got %+v", summary)
+	}
+
+	logsFail = false
+	srv = NewInProcessServer()
+	summary, err = Run(context.Background(), &fakeClient{}, plugins, cfg, "heptio-sonobuoy-test", dir, RunOptions{InProcess: srv, RerunFailed: true})
+	if err != nil {
+		t.Fatalf("unexpected error from re-run: %v", err)
+	}
+	if !summary.Succeeded() || summary.Expected != 3 {
+		t.Errorf("expected the three re-run results to complete, got %+v", summary)
+	}
+	if e2eRuns != 1 {
+		t.Errorf("expected e2e not to be re-run, it ran %v times", e2eRuns)
+	}
+	wantSkipped := []SkippedPlugin{{Plugin: "e2e", ResultType: "e2e", Reason: SkippedCompletedPreviously, Message: "it completed in the previous run"}}
+	if !reflect.DeepEqual(summary.Skipped, wantSkipped) {
+		t.Errorf("expected e2e to be skipped, got %+v", summary.Skipped)
+	}
+
+	// The results directory describes the results of both runs
+	manifest := readManifest(t, dir)
+	if len(manifest.Results) != 4 {
+		t.Fatalf("expected 4 results in the manifest, got %+v", manifest.Results)
+	}
+	for _, entry := range manifest.Results {
+		if entry.Status != CompleteStatus {
+			t.Errorf("expected result %v to be complete, got %v", entryID(entry), entry.Status)
+		}
+		for _, file := range entry.Files {
+			if _, err := os.Stat(filepath.Join(dir, file.Path)); err != nil {
+				t.Errorf("expected file %v of result %v to exist: %v", file.Path, entryID(entry), err)
+			}
+		}
+	}
+	if len(manifest.Plugins) != 3 {
+		t.Errorf("expected the timings of 3 plugins, got %+v", manifest.Plugins)
+	}
+	if !reflect.DeepEqual(manifest.Skipped, wantSkipped) {
+		t.Errorf("expected the manifest to record e2e as skipped, got %+v", manifest.Skipped)
+	}
+
+	blob, err := ioutil.ReadFile(path.Join(dir, metaDir, ExpectedResultsFile))
+	if err != nil {
+		t.Fatalf("couldn't read expected results: %v", err)
+	}
+	var expected []plugin.ExpectedResult
+	if err := json.Unmarshal(blob, &expected); err != nil {
+		t.Fatalf("couldn't unmarshal expected results %q: %v", blob, err)
+	}
+	if len(expected) != 4 {
+		t.Errorf("expected 4 expected results, got %+v", expected)
+	}
+
+	// Nothing is left to re-run
+	summary, err = Run(context.Background(), &fakeClient{}, plugins, cfg, "heptio-sonobuoy-test", dir, RunOptions{InProcess: NewInProcessServer(), RerunFailed: true})
+	if err != nil {
+		t.Fatalf("unexpected error from second re-run: %v", err)
+	}
+	if summary.Expected != 0 || e2eRuns != 1 {
+		t.Errorf("expected nothing to be re-run, got %+v and %v runs of e2e", summary, e2eRuns)
+	}
+	if len(summary.Skipped) != 3 {
+		t.Errorf("expected every plugin to be skipped, got %+v", summary.Skipped)
+	}
+}
+
+func TestRun_rerunFailedWithoutPreviousRun(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sonobuoy_rerun_test")
+	if err != nil {
+		t.Fatalf("Could not create temp directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	_, err = Run(context.Background(), &fakeClient{}, []plugin.Interface{&fakePlugin{name: "e2e"}}, plugin.AggregationConfig{}, "heptio-sonobuoy-test", dir, RunOptions{InProcess: NewInProcessServer(), RerunFailed: true})
+	if err == nil {
+		t.Error("expected an error re-running without a previous run")
+	}
+}
+
+func TestRun_resume(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sonobuoy_rerun_test")
+	if err != nil {
+		t.Fatalf("Could not create temp directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	srv := NewInProcessServer()
+	submit := func(node, resultType string) {
+		go srv.Submit(node, resultType, "application/json", strings.NewReader(`{"some": "json"}`))
+	}
+
+	e2eRuns, logsRuns := 0, 0
+	e2e := &fakePlugin{name: "e2e", run: func(string) error {
+		e2eRuns++
+		submit("", "e2e")
+		return nil
+	}}
+	// node2 never reports before the first run stops
+	logs := &fakePlugin{name: "systemd_logs", nodes: []string{"node1", "node2"}, run: func(string) error {
+		logsRuns++
+		submit("node1", "systemd_logs")
+		if logsRuns > 1 {
+			submit("node2", "systemd_logs")
+		}
+		return nil
+	}}
+	plugins := []plugin.Interface{e2e, logs}
+
+	// Stop the first run once two results are recorded, as if the
+	// aggregator had crashed.
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() {
+		_, err := Run(ctx, &fakeClient{}, plugins, plugin.AggregationConfig{}, "heptio-sonobuoy-test", dir, RunOptions{InProcess: srv, Resume: true})
+		done <- err
+	}()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		blob, _ := ioutil.ReadFile(path.Join(dir, metaDir, ResultsManifestFile))
+		var manifest ResultsManifest
+		if json.Unmarshal(blob, &manifest) == nil && len(manifest.Results) == 2 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("timed out waiting for the first results")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	cancel()
+	if err := <-done; err == nil {
+		t.Fatal("expected the first run to be cancelled")
+	}
+
+	// A result which was only partly written when the run stopped
+	partial := path.Join(dir, "plugins", "systemd_logs", "results", "node2")
+	if err := os.MkdirAll(path.Dir(partial), 0755); err != nil {
+		t.Fatalf("couldn't create results directory: %v", err)
+	}
+	if err := ioutil.WriteFile(partial, []byte(`{"some": `), 0644); err != nil {
+		t.Fatalf("couldn't write partial result: %v", err)
+	}
+
+	srv = NewInProcessServer()
+	summary, err := Run(context.Background(), &fakeClient{}, plugins, plugin.AggregationConfig{}, "heptio-sonobuoy-test", dir, RunOptions{InProcess: srv, Resume: true})
+	if err != nil {
+		t.Fatalf("unexpected error from resumed run: %v", err)
+	}
+	if !summary.Succeeded() || summary.Expected != 3 {
+		t.Errorf("expected all three results to complete, got %+v", summary)
+	}
+	if e2eRuns != 1 || logsRuns != 2 {
+		t.Errorf("expected only systemd_logs to be relaunched, e2e ran %v times and systemd_logs %v times", e2eRuns, logsRuns)
+	}
+
+	blob, err := ioutil.ReadFile(partial)
+	if err != nil {
+		t.Fatalf("couldn't read result: %v", err)
+	}
+	if string(blob) != `{"some": "json"}` {
+		t.Errorf("expected the partial result to be replaced, got %q", blob)
+	}
+	if manifest := readManifest(t, dir); len(manifest.Results) != 3 {
+		t.Errorf("expected 3 results in the manifest, got %+v", manifest.Results)
+	}
+}
+
+func TestPreviousRun_removeUnrecorded(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sonobuoy_rerun_test")
+	if err != nil {
+		t.Fatalf("Could not create temp directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	files := map[string]bool{
+		"plugins/e2e/results/e2e.tar.gz.json": true,
+		"plugins/e2e/results/junit.xml":       true,
+		"plugins/systemd_logs/results/node1":  false,
+		"plugins/systemd_logs/results/a/b":    false,
+	}
+	for file := range files {
+		filename := filepath.Join(dir, filepath.FromSlash(file))
+		if err := os.MkdirAll(filepath.Dir(filename), 0755); err != nil {
+			t.Fatalf("couldn't create directory: %v", err)
+		}
+		if err := ioutil.WriteFile(filename, []byte("{}"), 0644); err != nil {
+			t.Fatalf("couldn't write %v: %v", file, err)
+		}
+	}
+
+	prev := &previousRun{outdir: dir, manifest: ResultsManifest{Results: []ManifestEntry{{
+		ResultType: "e2e",
+		Status:     CompleteStatus,
+		Files:      []ManifestFile{{Path: "plugins/e2e/results/e2e.tar.gz.json"}, {Path: "plugins/e2e/results/junit.xml"}},
+	}}}}
+	if err := prev.removeUnrecorded(logrus.StandardLogger()); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	for file, want := range files {
+		_, err := os.Stat(filepath.Join(dir, filepath.FromSlash(file)))
+		if got := err == nil; got != want {
+			t.Errorf("expected %v to exist: %v, got %v", file, want, got)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(dir, "plugins", "systemd_logs")); !os.IsNotExist(err) {
+		t.Errorf("expected empty directories to be removed, got %v", err)
+	}
+}
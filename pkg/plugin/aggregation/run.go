@@ -19,27 +19,147 @@ package aggregation
 import (
 	"context"
 	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
 	"fmt"
+	"io"
+	"io/ioutil"
 	"net"
 	"net/http"
+	"os"
+	"path"
+	"runtime/debug"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/heptio/sonobuoy/pkg/backplane/ca"
+	"github.com/heptio/sonobuoy/pkg/encryption"
 	"github.com/heptio/sonobuoy/pkg/plugin"
 	"github.com/heptio/sonobuoy/pkg/plugin/driver/utils"
 	"github.com/pkg/errors"
 	"github.com/sirupsen/logrus"
+	"golang.org/x/net/http2"
+	v1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	utilnet "k8s.io/apimachinery/pkg/util/net"
 	"k8s.io/apimachinery/pkg/util/wait"
 
 	"k8s.io/client-go/kubernetes"
 )
 
 const (
-	annotationUpdateFreq = 5 * time.Second
-	jitterFactor         = 1.2
+	defaultAnnotationUpdateFreq = 5 * time.Second
+	defaultJitterFactor         = 1.2
+	// ExpectedResultsFile is the name of the file in the meta directory of
+	// the results which lists every result the run expected.
+	ExpectedResultsFile = "expected.json"
+	// CACertFile is the name of the file in the meta directory of the
+	// results which has the certificate of the CA the run's certificates
+	// were issued by.
+	CACertFile = "ca.crt"
+	metaDir    = "meta"
+	// serverDrainTimeout is how long in-flight result uploads are given to
+	// finish when the aggregation server is shut down.
+	serverDrainTimeout = 10 * time.Second
+	// defaultPluginRunAttempts is how many times a plugin is launched before
+	// giving up on it if it keeps failing with transient errors.
+	defaultPluginRunAttempts = 3
+	// defaultNodeCacheTTL is how long the node list is cached before
+	// checking for nodes which have joined the cluster.
+	defaultNodeCacheTTL = 5 * time.Minute
+	// defaultNodeListTimeout is how long listing the nodes may take if it
+	// isn't configured.
+	defaultNodeListTimeout = time.Minute
 )
 
+// pluginRunBackoff is the backoff between attempts to launch a plugin. Steps
+// is set from the number of attempts configured.
+var pluginRunBackoff = wait.Backoff{
+	Duration: time.Second,
+	Factor:   2,
+	Jitter:   0.1,
+}
+
+// pluginCleanupTimeout is how long each plugin has to clean up after itself,
+// so that one whose resources can't be deleted doesn't hold up the others.
+var pluginCleanupTimeout = time.Minute
+
+// RunOptions are optional settings for an aggregation run which, unlike
+// plugin.AggregationConfig, are provided programmatically by the caller.
+type RunOptions struct {
+	// Ready, if set, is closed once the aggregation server is listening and
+	// before any plugins are launched.
+	Ready chan<- struct{}
+	// Events, if set, receives a newline-delimited JSON stream of events as
+	// the run progresses, in addition to any configured events file.
+	Events io.Writer
+	// InProcess, if set, replaces the HTTP server so that results are
+	// submitted by calling InProcess.Submit, without a socket or TLS.
+	InProcess *InProcessServer
+	// Middleware is applied around the handler results are submitted to,
+	// the first being the outermost. Middleware runs before requests are
+	// routed, so it can use RequestResultInfo to find which result a
+	// request is for.
+	Middleware []func(http.Handler) http.Handler
+	// Layout, if set, overrides the ResultsLayout in the config.
+	Layout ResultsLayout
+	// Transforms are applied to the body of each result before it is
+	// written out, after RedactSecrets if the config enables it and before
+	// the result is encrypted.
+	Transforms []ResultTransform
+	// Authority, if set, issues the run's certificates instead of the CA
+	// files in the config or a newly generated CA.
+	Authority *ca.Authority
+	// Sink, if set, is sent each result as soon as it's recorded. It isn't
+	// finalized, since the caller may have more to write to it.
+	Sink ResultSink
+	// Logger, if set, is where the run logs to, in its own format. Otherwise
+	// the run logs where the standard logrus logger does, in the configured
+	// format, leaving the standard logger alone. Callers running several
+	// aggregations in a process can tell them apart by the fields they add
+	// to it.
+	Logger logrus.FieldLogger
+	// Resume, if set, resumes the run which was writing to outdir, e.g. if
+	// the aggregator restarted during it. The results it recorded are kept
+	// and it only waits for the rest, relaunching the plugins they're
+	// from. If nothing was recorded in outdir, the run starts afresh.
+	Resume bool
+	// RerunFailed, if set, re-runs only the plugins which didn't complete in
+	// the previous run into outdir. The results of plugins which completed
+	// are kept and the new results are merged in with them, while the
+	// returned summary only covers the plugins which were run again.
+	RerunFailed bool
+	// ReadyCheck, if set, must pass before any plugin is launched, after
+	// the ReadyGate in the config if there is one. It's called every
+	// ReadyGate interval, or every 5 seconds without one.
+	ReadyCheck ReadyCheck
+	// ReadyTimeout is how long to wait for ReadyCheck before failing the
+	// run. Defaults to 10 minutes if unset.
+	ReadyTimeout time.Duration
+	// Listening, if set, is called with the address the aggregation server
+	// is listening on before Ready is closed. With a BindPort of 0 this is
+	// how callers find out which port was chosen.
+	Listening func(addr net.Addr)
+	// PauseAnnotations, if set, pauses the regular updates to the status
+	// annotations of the aggregator pod while it's paused. The last update
+	// when the run finishes is still made, so that it's always recorded.
+	PauseAnnotations *AnnotationPause
+	// Observer, if set, is called when each expected result starts to
+	// arrive and when it completes, see Aggregator.Observer. Run returns
+	// once every observation has been passed to it.
+	Observer func(Observation)
+	// RunID, if set, identifies the run in the stamp written to the meta
+	// directory of outdir, the results manifest and the annotations of the
+	// aggregator pod. Runs with a results TTL are always stamped, with the
+	// name of outdir if RunID is unset.
+	RunID string
+}
+
 // Run runs an aggregation server and gathers results, in accordance with the
 // given sonobuoy configuration.
 //
@@ -53,159 +173,1558 @@ const (
 // 4. Hook the shared monitoring channel up to aggr's IngestResults() function
 // 5. Block until aggr shows all results accounted for (results come in through
 //    the HTTP callback), stopping the HTTP server on completion
-func Run(client kubernetes.Interface, plugins []plugin.Interface, cfg plugin.AggregationConfig, namespace, outdir string) error {
+//
+// Cancelling ctx stops the aggregation early, cleaning up the plugins and
+// returning an error since the results will be incomplete.
+//
+// Once the aggregation server has started, a summary of the results is
+// returned even if an error occurs.
+//
+// Run serves the run's results on a server of its own. To make a series of
+// runs against one listener and CA, see Server.
+func Run(ctx context.Context, client kubernetes.Interface, plugins []plugin.Interface, cfg plugin.AggregationConfig, namespace, outdir string, opts RunOptions) (*RunSummary, error) {
+	return run(ctx, client, plugins, cfg, namespace, outdir, opts, nil)
+}
+
+// run is Run, serving results on the shared server if it's set rather than
+// starting a server of its own. If the config has a maximum run time, the run
+// is torn down and run returns once it passes.
+func run(ctx context.Context, client kubernetes.Interface, plugins []plugin.Interface, cfg plugin.AggregationConfig, namespace, outdir string, opts RunOptions, shared *Server) (*RunSummary, error) {
+	opts.Logger = runLogger(cfg, opts)
+	if cfg.MaxRunSeconds <= 0 {
+		return runAggregation(ctx, client, plugins, cfg, namespace, outdir, opts, shared, nil)
+	}
+	return runWithin(ctx, time.Duration(cfg.MaxRunSeconds)*time.Second, opts.Logger, func(ctx context.Context, teardown *runTeardown) (*RunSummary, error) {
+		return runAggregation(ctx, client, plugins, cfg, namespace, outdir, opts, shared, teardown)
+	})
+}
+
+// runAggregation does the work of run, registering what it starts with
+// teardown, if it's set, so it can be stopped when the run takes too long.
+func runAggregation(ctx context.Context, client kubernetes.Interface, plugins []plugin.Interface, cfg plugin.AggregationConfig, namespace, outdir string, opts RunOptions, shared *Server, teardown *runTeardown) (*RunSummary, error) {
+	start := time.Now()
+	log := opts.Logger
+
 	// Construct a list of things we'll need to dispatch
 	if len(plugins) == 0 {
-		logrus.Info("Skipping host data gathering: no plugins defined")
-		return nil
+		log.Info("Skipping host data gathering: no plugins defined")
+		return newRunSummary(nil, nil), nil
+	}
+
+	if err := checkDependencies(plugins); err != nil {
+		return nil, errors.Wrap(err, "invalid plugin dependencies")
+	}
+
+	schemas, err := resultSchemas(plugins)
+	if err != nil {
+		return nil, err
+	}
+	reducers, err := resultReducers(plugins)
+	if err != nil {
+		return nil, err
+	}
+	basePath, err := checkRunConfig(cfg, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	// When re-running, plugins which completed in the previous run are
+	// skipped. They count as having succeeded for plugins depending on them.
+	var previous *previousRun
+	kept := map[string]bool{}
+	completed := map[string]string{}
+	// skipped are the plugins skipped before the aggregator is set up,
+	// which are recorded once it is.
+	var skipped []SkippedPlugin
+	if opts.RerunFailed {
+		var err error
+		if previous, err = readPreviousRun(outdir); err != nil {
+			return nil, err
+		}
+		var done []plugin.Interface
+		plugins, done = previous.split(plugins, log)
+		for _, p := range done {
+			kept[p.GetResultType()] = true
+			completed[p.GetName()] = ""
+			skipped = append(skipped, newSkippedPlugin(p, SkippedCompletedPreviously, "it completed in the previous run"))
+		}
+		if len(plugins) == 0 {
+			log.Info("Every plugin completed in the previous run, nothing to re-run")
+			return skippedRunSummary(skipped), nil
+		}
+	}
+
+	configurePlugins(plugins, cfg)
+
+	layout := opts.Layout
+	if layout == nil {
+		var err error
+		if layout, err = layoutFor(cfg.ResultsLayout); err != nil {
+			return nil, err
+		}
 	}
 
 	// Get a list of nodes so the plugins can properly estimate what
-	// results they'll give.
-	// TODO: there are other places that iterate through the CoreV1.Nodes API
-	// call, we should only do this in one place and cache it.
-	nodes, err := client.CoreV1().Nodes().List(metav1.ListOptions{})
+	// results they'll give. The same list is shared with each plugin's
+	// monitor.
+	nodeCache := plugin.NewNodeCache(client, cfg.NodeSelector, nodeCacheTTL(cfg))
+	nodeCache.SetListTimeout(nodeListTimeout(cfg))
+	nodes, err := nodeCache.Nodes()
 	if err != nil {
-		return errors.WithStack(err)
+		return nil, err
 	}
 
 	// Find out what results we should expect for each of the plugins
-	var expectedResults []plugin.ExpectedResult
-	for _, p := range plugins {
-		expectedResults = append(expectedResults, p.ExpectedResults(nodes.Items)...)
+	expectedResults, noResults := expectResults(plugins, nodes, cfg)
+
+	if cfg.DryRun {
+		plan := newRunPlan(plugins, nodes, cfg)
+		plan.log(log)
+		return &RunSummary{Expected: len(expectedResults), Failed: map[string]string{}, Plan: plan}, nil
+	}
+
+	// Plugins which expect no results, such as daemonsets when no nodes
+	// match the node selector, would never complete, so they aren't
+	// launched. Plugins depending on them are, since there's nothing for
+	// them to wait for. A resumed run launches them as before, since it
+	// may still expect results from them.
+	if len(noResults) > 0 && !opts.Resume {
+		var withoutResults []SkippedPlugin
+		plugins, withoutResults = skipWithoutResults(plugins, noResults, cfg, log)
+		for _, s := range withoutResults {
+			completed[s.Plugin] = ""
+		}
+		skipped = append(skipped, withoutResults...)
+		if len(plugins) == 0 {
+			log.Info("No plugins expect any results, nothing to run")
+			return skippedRunSummary(skipped), nil
+		}
+	}
+
+	var encryptionKey []byte
+	if cfg.EncryptionKeyFile != "" {
+		var err error
+		if encryptionKey, err = encryption.ReadKeyFile(cfg.EncryptionKeyFile); err != nil {
+			return nil, err
+		}
+	}
+
+	// Make sure every plugin can be run before launching any of them
+	if !cfg.SkipPluginValidation {
+		if err := ValidatePlugins(client, plugins, namespace); err != nil {
+			return nil, err
+		}
+	}
+	if err := checkFreeSpace(outdir, cfg.MinFreeDiskBytes, log); err != nil {
+		return nil, err
+	}
+
+	// Plugins left behind by earlier runs, e.g. ones whose aggregator
+	// crashed, may get in the way of this run's, so they're dealt with
+	// before any plugin is launched.
+	if cfg.OrphanedResources != "" {
+		handleOrphanedResources(client, plugins, namespace, cfg, log)
+	}
+
+	// Wait for anything the plugins need outside of the run before
+	// starting, so nothing is scheduled if it never becomes ready.
+	if err := waitForReadyGates(ctx, client, cfg, opts, log); err != nil {
+		return nil, err
+	}
+
+	// A resumed run still expects what it did before the restart, and only
+	// waits for the results which weren't recorded then.
+	var resumed *previousRun
+	if opts.Resume {
+		if resumed, err = readResumedRun(outdir, log); err != nil {
+			return nil, err
+		}
+		if resumed != nil {
+			expectedResults = resumed.expected
+		}
+	}
+
+	// Bind the aggregation server's address up front so that a bad or busy
+	// port fails the run before any plugins are launched which couldn't
+	// submit their results.
+	var listener net.Listener
+	if opts.InProcess == nil && shared == nil {
+		var err error
+		if listener, err = listen(cfg); err != nil {
+			return nil, err
+		}
+		// The server closes the listener once it's serving, this covers
+		// the returns before then. Closing it twice is harmless. Closing
+		// a socket's listener also removes the socket file.
+		defer listener.Close()
+	}
+	// A BindPort of 0 binds whichever port the OS chooses, which workers
+	// are then told to dial instead.
+	boundFreePort := false
+	if addr, ok := listenerPort(listener); ok && cfg.BindPort == 0 {
+		cfg = withBindPort(cfg, addr)
+		boundFreePort = true
+		log.WithField("port", cfg.BindPort).Info("Bound the aggregation server to a free port")
+	}
+	var metricsListener net.Listener
+	if cfg.MetricsBindPort != 0 {
+		var err error
+		if metricsListener, err = listenMetrics(cfg.MetricsBindPort); err != nil {
+			return nil, err
+		}
+		defer metricsListener.Close()
+	}
+
+	// The previous results of the plugins being re-run are replaced, while
+	// those of the other plugins are still expected.
+	recordedResults := expectedResults
+	if resumed != nil {
+		if err := resumed.removeUnrecorded(log); err != nil {
+			return nil, err
+		}
+	}
+	if previous != nil {
+		if err := previous.removeResults(kept); err != nil {
+			return nil, err
+		}
+		recordedResults = append(previous.keptExpectedResults(kept), expectedResults...)
+	}
+	if err := writeExpectedResults(outdir, recordedResults); err != nil {
+		return nil, err
+	}
+	var stamp *RunStamp
+	if runID := runID(cfg, opts, outdir); runID != "" {
+		written, err := writeRunStamp(outdir, NewRunStamp(runID, start, cfg))
+		if err != nil {
+			return nil, err
+		}
+		stamp = &written
+	}
+	if err := describeCluster(ctx, client, nodes, cfg.NodeSelector, outdir, log); err != nil {
+		return nil, err
 	}
 
-	auth, err := ca.NewAuthority()
+	auth, err := newAuthority(cfg, opts, plugins, log)
 	if err != nil {
-		return errors.Wrap(err, "couldn't make new certificate authority for plugin aggregator")
+		return nil, err
+	}
+	if err := writeCACert(outdir, auth.CACert()); err != nil {
+		return nil, err
 	}
 
-	logrus.Infof("Starting server Expected Results: %v", expectedResults)
+	hook := newWebhook(cfg, auth.Sign)
+	if hook != nil {
+		hook.log = log
+		// Give notifications a chance to be sent before the run ends.
+		defer hook.wait()
+	}
+
+	log.WithField("expected_results", expectedResults).Info("Starting server")
 
 	// 1. Await results from each plugin
-	aggr := NewAggregator(outdir+"/plugins", expectedResults)
+	aggr := newRunAggregator(outdir, expectedResults, plugins, cfg, opts, encryptionKey)
+	aggr.Schemas = schemas
+	aggr.Reducers = reducers
+	aggr.Layout = layout
+	aggr.manifest.stamp = stamp
+	defer aggr.waitObservations()
+	teardown.setSummary(aggr.summarize)
+	if cfg.CollectDiagnostics {
+		aggr.diagnostics = newDiagnosticsCollector(client, outdir, namespace, plugins, cfg, aggr.Transforms, log)
+		// Whatever's being collected when the run ends is part of the
+		// results, which are archived once Run returns.
+		defer aggr.diagnostics.wait()
+	}
+	// Plugins whose run is cut short are cleaned up here, unless their
+	// resources are kept for debugging.
+	keeper := newResourceKeeper(cfg.KeepPluginResources, outdir, log)
+	if previous != nil {
+		aggr.manifest.keep(previous.manifest, kept)
+	}
+	if resumed != nil {
+		aggr.restore(resumed)
+	}
+	for _, s := range skipped {
+		aggr.skipPlugin(s)
+	}
+	// Results from the plugins' monitors and the like are queued rather than
+	// sent straight to IngestResults so that reporting them never blocks.
+	monitors := newMonitorQueue(cfg.MonitorBufferSize)
+	monitors.priority = aggr.priority
+	aggr.monitors = monitors
+	go monitors.run()
+	monitorCh := monitors.in
+	if metricsListener != nil {
+		stopMetrics := serveMetrics(metricsListener, aggr, start, basePath)
+		defer stopMetrics()
+	}
 	doneAggr := make(chan bool, 1)
-	monitorCh := make(chan *plugin.Result, len(expectedResults))
 	stopWaitCh := make(chan bool, 1)
 
+	events, closeEvents, err := openEvents(cfg, opts, log)
+	if err != nil {
+		return nil, err
+	}
+	defer closeEvents()
+	if events != nil {
+		aggr.addResultHook(events.resultHook())
+	}
+	if hook != nil {
+		aggr.addResultHook(hook.resultHook(aggr))
+	}
+
+	// Plugins with dependencies are launched as the plugins they depend on
+	// complete, which is signalled by the result types sent on pluginDoneCh.
+	// Plugins whose results were all recorded before a resumed run aren't
+	// relaunched.
+	var toLaunch []plugin.Interface
+	for _, p := range plugins {
+		if resumed != nil && len(aggr.pendingResults(p.GetResultType())) == 0 {
+			log.WithField("plugin", p.GetName()).Info("Not relaunching plugin, all of its results were recorded")
+			completed[p.GetName()] = aggr.firstError(p.GetResultType())
+			aggr.skipPlugin(newSkippedPlugin(p, SkippedAllRecorded, "all of its results were recorded before the run was resumed"))
+			continue
+		}
+		toLaunch = append(toLaunch, p)
+	}
+	launchNow, waiting := splitByDependencies(toLaunch, completed)
+	doneHook, pluginDoneCh := pluginDoneHook(plugins)
+	if len(waiting) > 0 {
+		aggr.addResultHook(doneHook)
+	}
+
+	// In fail fast mode the first failed result ends the run. Results are
+	// written before the hooks are called, so it's already on disk.
+	var failedCh <-chan *plugin.Result
+	if cfg.FailFast {
+		var failedHook resultHook
+		failedHook, failedCh = signalResults(isFailedResult)
+		aggr.addResultHook(failedHook)
+	}
+
+	// Results which are lost to a full disk are surfaced on the pod, and
+	// optionally end the run since the rest would likely be lost too.
+	diskFullHook, diskFullCh := signalResults(func(result *plugin.Result) bool {
+		return isDiskFullResult(result.Error)
+	})
+	aggr.addResultHook(diskFullHook)
+
 	go func() {
 		aggr.Wait(stopWaitCh)
 		doneAggr <- true
 	}()
 
-	// AdvertiseAddress often has a port, split this off if so
-	advertiseAddress := cfg.AdvertiseAddress
-	if host, _, err := net.SplitHostPort(cfg.AdvertiseAddress); err == nil {
-		advertiseAddress = host
+	// 2. Launch the aggregation servers on the address bound above, so the
+	// server is known to be listening before any plugins are launched.
+	handler := newRunHandler(aggr, auth, cfg, basePath, opts.Middleware, log)
+	doneServ, stopServer, err := startRunServer(handler, listener, shared, aggr, cfg, auth, opts, log)
+	if err != nil {
+		return nil, err
+	}
+	teardown.onTeardown(stopServer)
+
+	updater := newUpdater(expectedResults, namespace, client)
+	updater.log = log
+	if boundFreePort {
+		if err := updater.AnnotatePort(cfg.BindPort); err != nil {
+			log.WithError(err).Info("couldn't annotate sonobuoy pod with the aggregation server's port")
+		}
+	}
+	if stamp != nil {
+		if err := updater.AnnotateRunID(stamp.RunID); err != nil {
+			log.WithError(err).Info("couldn't annotate sonobuoy pod with the run ID")
+		}
+	}
+
+	// 3. Regularly annotate the Aggregator pod with the current run status
+	updaterCtx, finishAnnotations := startAnnotations(ctx, cfg, opts.PauseAnnotations, aggr, updater, log)
+	defer finishAnnotations()
+
+	if cfg.HeartbeatIntervalSeconds > 0 {
+		go watchHeartbeats(updaterCtx, aggr, heartbeatStall(cfg), cfg.FailStalledResults, updater, monitorCh)
 	}
 
-	tlsCfg, err := auth.MakeServerConfig(advertiseAddress)
+	// 4. Launch each plugin, to dispatch workers which submit the results back
+	certs, err := clientCerts(auth, plugins)
 	if err != nil {
-		return errors.Wrap(err, "couldn't get a server certificate")
+		return aggr.summarize(), err
 	}
 
-	// 2. Launch the aggregation servers
-	srv := &http.Server{
-		Addr:      fmt.Sprintf("%s:%d", cfg.BindAddress, cfg.BindPort),
-		Handler:   NewHandler(aggr.HandleHTTPResult),
-		TLSConfig: tlsCfg,
+	// 5. Have the aggregator plumb results from each plugins' monitor function
+	go aggr.IngestResults(aggr.diagnostics.watch(monitors.out))
+	teardown.onTeardown(func() {
+		if err := keeper.cleanupAll(context.Background(), client, plugins, aggr.failedResultTypes()); err != nil {
+			log.WithError(err).Info("Couldn't clean up after plugins")
+		}
+	})
+
+	launcher := &pluginLauncher{
+		ctx:       updaterCtx,
+		client:    client,
+		namespace: namespace,
+		cfg:       cfg,
+		aggr:      aggr,
+		keeper:    keeper,
+		nodes:     nodeCache,
+		certs:     certs,
+		events:    events,
+		stagger:   &launchStagger{delay: time.Duration(cfg.PluginLaunchDelaySeconds) * time.Second},
+		resultsCh: monitorCh,
+		log:       log,
+	}
+	defer launcher.stop()
+	launcher.launchAll(launchNow)
+	if len(waiting) > 0 {
+		go runDependents(updaterCtx, plugins, waiting, completed, aggr, pluginDoneCh, launcher.launch, monitorCh)
 	}
 
-	doneServ := make(chan error)
-	go func() {
-		logrus.WithFields(logrus.Fields{
-			"address": cfg.BindAddress,
-			"port":    cfg.BindPort,
-		}).Info("Starting aggregation server")
-		doneServ <- srv.ListenAndServeTLS("", "")
-	}()
+	// Expect results from nodes which join while the plugins are running and,
+	// if configured, stop waiting for nodes which leave
+	go wait.Until(func() {
+		expectNewNodes(nodeCache, launcher.running(), cfg, aggr, updater)
+		if cfg.ReconcileNodes {
+			dropRemovedNodes(nodeCache, aggr, monitorCh)
+		}
+	}, nodeCacheTTL(cfg), updaterCtx.Done())
 
-	updater := newUpdater(expectedResults, namespace, client)
-	ctx, cancel := context.WithCancel(context.TODO())
-	pluginsdone := false
-	defer func() {
-		if pluginsdone == false {
-			logrus.Info("Last update to annotations on exit")
-			// This is the async exit cleanup function.
-			// 1. Stop the annotation updater
-			cancel()
-			// 2. Try one last time to get an update out on exit
-			if err := updater.Annotate(aggr.Results); err != nil {
-				logrus.WithError(err).Info("couldn't annotate sonobuoy pod")
+	// Give each plugin a chance to cleanup before a hard timeout occurs, and
+	// ensure we only wait for results for a certain time
+	shutdownPlugins, timeout, stopTimers := scheduleTimeouts(cfg, plugins)
+	defer stopTimers()
+
+	// 6. Wait for aggr to show that all results are accounted for
+	annotatedDiskFull := false
+	for {
+		select {
+		case p := <-shutdownPlugins:
+			aggr.diagnostics.collectPending(p.GetResultType(), aggr.pendingResults(p.GetResultType()))
+			aggr.diagnostics.wait()
+			// Its pending results are about to time out
+			if err := keeper.cleanup(ctx, client, p, true); err != nil {
+				log.WithError(err).WithField("plugin", p.GetName()).Info("Couldn't clean up after plugin")
+			}
+			log.WithField("plugin", p.GetName()).Info("Gracefully shutting down plugin due to timeout.")
+		case <-ctx.Done():
+			// The run's context is already done, but its plugins still get
+			// to clean up after themselves.
+			cleanupRun(context.Background(), client, plugins, aggr, keeper, log)
+			stopServer()
+			stopWaitCh <- true
+			return aggr.summarize(), errors.Wrap(ctx.Err(), "aggregation cancelled, results are incomplete")
+		case <-timeout:
+			err := reportTimeout(plugins, aggr, updater, events, hook, log)
+			stopServer()
+			stopWaitCh <- true
+			return aggr.summarize(), err
+		case result := <-failedCh:
+			// If that was the last result, the run is over anyway
+			if aggr.isComplete() {
+				continue
 			}
+			log.WithFields(resultFields(result)).Info("Result failed, aborting the run since fail fast is enabled")
+			cleanupRun(ctx, client, plugins, aggr, keeper, log)
+			stopServer()
+			stopWaitCh <- true
+			return aggr.summarize(), errors.Errorf("aborted the run after result %v failed: %v", result.ExpectedResultID(), result.Error)
+		case result := <-diskFullCh:
+			log.WithFields(resultFields(result)).Error("Couldn't write result, the results directory is full")
+			if !annotatedDiskFull {
+				annotatedDiskFull = true
+				if err := updater.AnnotateDiskFull(result.Error); err != nil {
+					log.WithError(err).Info("couldn't annotate sonobuoy pod with the full disk")
+				}
+			}
+			if !cfg.AbortOnDiskFull || aggr.isComplete() {
+				continue
+			}
+			cleanupRun(ctx, client, plugins, aggr, keeper, log)
+			stopServer()
+			stopWaitCh <- true
+			return aggr.summarize(), errors.Errorf("aborted the run after result %v couldn't be written: %v", result.ExpectedResultID(), result.Error)
+		case err := <-doneServ:
+			stopWaitCh <- true
+			return aggr.summarize(), err
+		case <-doneAggr:
+			stopServer()
+			return aggr.summarize(), nil
 		}
-	}()
+	}
+}
 
-	// 3. Regularly annotate the Aggregator pod with the current run status
-	logrus.Info("Starting annotation update routine")
+// checkRunConfig returns an error if a run can't be made with the config and
+// options, or else the base path results are submitted under.
+func checkRunConfig(cfg plugin.AggregationConfig, opts RunOptions) (string, error) {
+	if opts.Resume && opts.RerunFailed {
+		return "", errors.New("a run can't both resume and re-run failed plugins")
+	}
+	basePath, err := plugin.CleanPathPrefix(cfg.BasePath)
+	if err != nil {
+		return "", errors.Wrap(err, "invalid aggregation server base path")
+	}
+	if _, err := plugin.CleanPathPrefix(cfg.WorkerPathPrefix()); err != nil {
+		return "", errors.Wrap(err, "invalid worker upload path prefix")
+	}
+	for name, override := range cfg.PluginExpectedResults {
+		if err := override.Validate(); err != nil {
+			return "", errors.Wrapf(err, "invalid expected results for plugin %v", name)
+		}
+	}
+	return basePath, nil
+}
+
+// configurePlugins passes on the settings in the config which the plugins'
+// workers need. Workers are told the TLS settings so they hold themselves to
+// the same minimums as the server.
+func configurePlugins(plugins []plugin.Interface, cfg plugin.AggregationConfig) {
+	for _, p := range plugins {
+		if t, ok := p.(plugin.TLSConfigurable); ok {
+			t.SetTLSOptions(cfg.MinTLSVersion, cfg.CipherSuites)
+		}
+		if s, ok := p.(plugin.ServerNameConfigurable); ok && cfg.WorkerTLSServerName != "" {
+			s.SetTLSServerName(cfg.WorkerTLSServerName)
+		}
+		if pp, ok := p.(plugin.PathPrefixConfigurable); ok && cfg.WorkerPathPrefix() != "" {
+			pp.SetUploadPathPrefix(cfg.WorkerPathPrefix())
+		}
+		if pc, ok := p.(plugin.ProxyConfigurable); ok && cfg.WorkerProxyURL != "" {
+			pc.SetProxyURL(cfg.WorkerProxyURL)
+		}
+		if u, ok := p.(plugin.UploadConfigurable); ok {
+			u.SetUploadOptions(cfg.WorkerUploadRetries, cfg.WorkerUploadTimeoutSeconds)
+		}
+		if h, ok := p.(plugin.HeartbeatConfigurable); ok {
+			h.SetHeartbeatInterval(cfg.HeartbeatIntervalSeconds)
+		}
+		if g, ok := p.(plugin.GracefulShutdownConfigurable); ok {
+			g.SetGracefulShutdownPeriod(gracefulShutdownSeconds(cfg, p.GetName()))
+		}
+	}
+}
+
+// expectResults returns the results expected from each of the plugins on the
+// given nodes, along with the names of the plugins which expect none.
+func expectResults(plugins []plugin.Interface, nodes []v1.Node, cfg plugin.AggregationConfig) ([]plugin.ExpectedResult, map[string]bool) {
+	var expected []plugin.ExpectedResult
+	noResults := map[string]bool{}
+	for _, p := range plugins {
+		pluginResults := pluginExpectedResults(p, nodes, cfg)
+		if len(pluginResults) == 0 {
+			noResults[p.GetName()] = true
+		}
+		expected = append(expected, pluginResults...)
+	}
+	setTopology(expected, nodes, cfg.TopologyLabel)
+	return expected, noResults
+}
+
+// skipWithoutResults returns the plugins which expect results, along with
+// the rest, which are skipped.
+func skipWithoutResults(plugins []plugin.Interface, noResults map[string]bool, cfg plugin.AggregationConfig, log logrus.FieldLogger) ([]plugin.Interface, []SkippedPlugin) {
+	message := "no nodes to run on"
+	if cfg.NodeSelector != "" {
+		message = fmt.Sprintf("no nodes match the node selector %q", cfg.NodeSelector)
+	}
+	withResults := plugins[:0:0]
+	var skipped []SkippedPlugin
+	for _, p := range plugins {
+		if !noResults[p.GetName()] {
+			withResults = append(withResults, p)
+			continue
+		}
+		log.WithField("plugin", p.GetName()).Info("Skipping plugin, it expects no results")
+		reason := message
+		if _, ok := cfg.PluginExpectedResults[p.GetName()]; ok {
+			reason = "no nodes match its expected results"
+		}
+		skipped = append(skipped, newSkippedPlugin(p, SkippedNoNodes, reason))
+	}
+	return withResults, skipped
+}
+
+// readResumedRun reads the run which was writing to outdir so that it can be
+// resumed, returning nil if nothing was recorded, since there's nothing to
+// resume then.
+func readResumedRun(outdir string, log logrus.FieldLogger) (*previousRun, error) {
+	prev, err := readPreviousRun(outdir)
+	switch {
+	case err == nil:
+		log.WithField("recorded_results", len(prev.manifest.Results)).Info("Resuming the previous run")
+		return prev, nil
+	case os.IsNotExist(errors.Cause(err)):
+		return nil, nil
+	default:
+		return nil, err
+	}
+}
+
+// describeCluster writes what can be found out about the cluster to outdir.
+// The cluster is only described for reference, so what can't be found out
+// about it is logged rather than stopping the run.
+func describeCluster(ctx context.Context, client kubernetes.Interface, nodes []v1.Node, nodeSelector, outdir string, log logrus.FieldLogger) error {
+	clusterInfo := gatherClusterInfo(ctx, client, nodes, nodeSelector)
+	if clusterInfo.ServerVersionError != "" || clusterInfo.FeatureGatesError != "" {
+		log.WithFields(logrus.Fields{
+			"serverversion": clusterInfo.ServerVersionError,
+			"featuregates":  clusterInfo.FeatureGatesError,
+		}).Info("Couldn't find out everything about the cluster")
+	}
+	return writeClusterInfo(outdir, clusterInfo)
+}
+
+// newRunAggregator returns the aggregator of a run's results, set up from the
+// run's config and options. Results are encrypted with encryptionKey if it's
+// set.
+func newRunAggregator(outdir string, expected []plugin.ExpectedResult, plugins []plugin.Interface, cfg plugin.AggregationConfig, opts RunOptions, encryptionKey []byte) *Aggregator {
+	aggr := NewAggregator(outdir+"/plugins", expected)
+	aggr.DuplicatePolicy = cfg.DuplicateResults
+	aggr.MaxResultSizeBytes = cfg.MaxResultSizeBytes
+	aggr.MaxConcurrentWrites = cfg.MaxConcurrentWrites
+	aggr.CompletionThreshold = cfg.CompletionThreshold
+	if cfg.RedactSecrets {
+		aggr.Transforms = append(aggr.Transforms, RedactSecrets)
+	}
+	aggr.Transforms = append(aggr.Transforms, opts.Transforms...)
+	if encryptionKey != nil {
+		aggr.Transforms = append(aggr.Transforms, EncryptResults(encryptionKey))
+	}
+	aggr.Sink = opts.Sink
+	aggr.Log = opts.Logger
+	aggr.Observer = opts.Observer
+	aggr.ClientNames = make(map[string]string, len(plugins))
+	aggr.Priorities = make(map[string]int, len(plugins))
+	for _, p := range plugins {
+		aggr.ClientNames[p.GetResultType()] = p.GetName()
+		if prioritized, ok := p.(plugin.Prioritized); ok {
+			aggr.Priorities[p.GetResultType()] = prioritized.GetResultPriority()
+		}
+	}
+	aggr.manifest = newResultsManifest(outdir, plugins)
+	aggr.manifest.log = opts.Logger
+	aggr.manifest.topologyLabel = cfg.TopologyLabel
+	if encryptionKey != nil {
+		aggr.manifest.encryption = &ManifestEncryption{Cipher: encryption.Cipher, KeyID: encryption.KeyID(encryptionKey)}
+	}
+	return aggr
+}
+
+// openEvents returns where the events of a run are written: to opts.Events
+// and the configured events file, or nil if neither is set. The returned func
+// closes the events file.
+func openEvents(cfg plugin.AggregationConfig, opts RunOptions, log logrus.FieldLogger) (*eventWriter, func(), error) {
+	out := opts.Events
+	if cfg.EventsFile == "" {
+		return newEventWriter(out, log), func() {}, nil
+	}
+	f, err := os.OpenFile(cfg.EventsFile, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, nil, errors.Wrapf(err, "couldn't open events file %v", cfg.EventsFile)
+	}
+	if out != nil {
+		out = io.MultiWriter(out, f)
+	} else {
+		out = f
+	}
+	return newEventWriter(out, log), func() { f.Close() }, nil
+}
+
+// splitByDependencies splits the plugins into those which can be launched now,
+// since the plugins they depend on have completed, and those waiting on them.
+func splitByDependencies(plugins []plugin.Interface, completed map[string]string) (launchNow, waiting []plugin.Interface) {
+	for _, p := range plugins {
+		if dependenciesMet(p, completed) {
+			launchNow = append(launchNow, p)
+		} else {
+			waiting = append(waiting, p)
+		}
+	}
+	return launchNow, waiting
+}
+
+// signalResults returns a result hook which sends the results match returns
+// true for on the returned channel. Results are dropped while one is waiting
+// to be received, so that the hook never blocks.
+func signalResults(match func(*plugin.Result) bool) (resultHook, <-chan *plugin.Result) {
+	ch := make(chan *plugin.Result, 1)
+	return func(result *plugin.Result, pluginDone bool) {
+		if !match(result) {
+			return
+		}
+		select {
+		case ch <- result:
+		default:
+		}
+	}, ch
+}
+
+// isFailedResult returns true if the result failed or timed out.
+func isFailedResult(result *plugin.Result) bool {
+	status := resultStatus(result)
+	return status == FailedStatus || status == TimeoutStatus
+}
+
+// newRunHandler returns the handler which a run's results are submitted to,
+// authenticating workers with client certificates from auth.
+func newRunHandler(aggr *Aggregator, auth *ca.Authority, cfg plugin.AggregationConfig, basePath string, middleware []func(http.Handler) http.Handler, log logrus.FieldLogger) http.Handler {
+	resultsHandler := NewHandlerWithCerts(aggr.HandleHTTPResult, auth.ClientKeyPair)
+	resultsHandler.HealthCallback = aggr.health
+	resultsHandler.ProgressCallback = aggr.HandleHTTPProgress
+	resultsHandler.HeartbeatCallback = aggr.HandleHTTPHeartbeat
+	resultsHandler.Log = log
+	resultsHandler.Codecs = cfg.UploadCodecs
+	resultsHandler.BasePath = basePath
+	return withMiddleware(resultsHandler, middleware)
+}
+
+// startRunServer starts serving a run's handler: in-process if opts.InProcess
+// is set, on the shared server if there is one, or else on the listener. Once
+// it's serving, opts.Listening and opts.Ready are called. It returns a channel
+// with the error the server stops with, if it stops of its own accord, and a
+// func which stops it.
+func startRunServer(handler http.Handler, listener net.Listener, shared *Server, aggr *Aggregator, cfg plugin.AggregationConfig, auth *ca.Authority, opts RunOptions, log logrus.FieldLogger) (<-chan error, func(), error) {
+	var done <-chan error
+	var stop func()
+	switch {
+	case opts.InProcess != nil:
+		log.Info("Starting in-process aggregation server")
+		opts.InProcess.serve(handler)
+		stop = opts.InProcess.stop
+	case shared != nil:
+		log.WithField("address", shared.Addr().String()).Info("Starting run on the shared aggregation server")
+		aggr.connections = shared.connections
+		done, stop = shared.attach(handler)
+	default:
+		var err error
+		aggr.connections = newConnLimitListener(listener, cfg.MaxConnections, log)
+		if done, stop, err = serve(aggr.connections, handler, cfg, auth, log); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	if opts.Listening != nil {
+		switch {
+		case listener != nil:
+			opts.Listening(listener.Addr())
+		case shared != nil:
+			opts.Listening(shared.Addr())
+		}
+	}
+	if opts.Ready != nil {
+		close(opts.Ready)
+	}
+	return done, stop, nil
+}
+
+// startAnnotations regularly annotates the aggregator pod with the status of
+// the run until every result is in. The returned context is done once they
+// are, or once ctx is. The returned func stops the updates and, unless the
+// status was already annotated with every result in, tries one last time to
+// annotate it.
+func startAnnotations(ctx context.Context, cfg plugin.AggregationConfig, pause *AnnotationPause, aggr *Aggregator, updater *updater, log logrus.FieldLogger) (context.Context, func()) {
+	updaterCtx, cancel := context.WithCancel(ctx)
+	// pluginsdone is set by the annotation updater goroutine, so is
+	// accessed atomically.
+	var pluginsdone int32
+
+	log.Info("Starting annotation update routine")
 	go func() {
-		wait.JitterUntil(func() {
-			pluginsdone = aggr.isComplete()
-			if err := updater.Annotate(aggr.Results); err != nil {
-				logrus.WithError(err).Info("couldn't annotate sonobuoy pod")
+		annotateUntil(updaterCtx, annotationUpdateFreq(cfg), jitterFactor(cfg), maxAnnotationBackoff, pause, log, func() error {
+			complete := aggr.isComplete()
+			updater.ReceiveProgress(aggr.copyProgress())
+			if err := updater.Annotate(aggr.copyResults()); err != nil {
+				// Leave the last update to the exit cleanup
+				return err
 			}
-			if pluginsdone {
-				logrus.Info("All plugins have completed, status has been updated")
+			if complete {
+				atomic.StoreInt32(&pluginsdone, 1)
+				log.Info("All plugins have completed, status has been updated")
 				cancel()
 			}
-		}, annotationUpdateFreq, jitterFactor, true, ctx.Done())
+			return nil
+		})
 	}()
 
-	// 4. Launch each plugin, to dispatch workers which submit the results back
-	certs := map[string]*tls.Certificate{}
+	return updaterCtx, func() {
+		if atomic.LoadInt32(&pluginsdone) == 0 {
+			log.Info("Last update to annotations on exit")
+			cancel()
+			updater.ReceiveProgress(aggr.copyProgress())
+			if err := updater.Annotate(aggr.copyResults()); err != nil {
+				log.WithError(err).Info("couldn't annotate sonobuoy pod")
+			}
+		}
+	}
+}
+
+// clientCerts returns the client certificate each plugin's workers submit
+// their results with, issued by auth.
+func clientCerts(auth *ca.Authority, plugins []plugin.Interface) (map[string]*tls.Certificate, error) {
+	certs := make(map[string]*tls.Certificate, len(plugins))
 	for _, p := range plugins {
 		cert, err := auth.ClientKeyPair(p.GetName())
 		if err != nil {
-			return errors.Wrapf(err, "couldn't make certificate for plugin %v", p.GetName())
+			return nil, errors.Wrapf(err, "couldn't make certificate for plugin %v", p.GetName())
 		}
 		certs[p.GetName()] = cert
 	}
+	return certs, nil
+}
 
+// scheduleTimeouts schedules the timeouts of a run's plugins. Each plugin
+// which has a timeout is sent on the returned shutdown channel its graceful
+// shutdown period before the timeout, so it can clean up first. The returned
+// timeout channel fires once the run's timeout passes, or never if the run
+// waits indefinitely. The returned func stops the timers.
+func scheduleTimeouts(cfg plugin.AggregationConfig, plugins []plugin.Interface) (<-chan plugin.Interface, <-chan time.Time, func()) {
+	// The channel is big enough that the timers never block.
+	shutdown := make(chan plugin.Interface, len(plugins))
+	var timers []*time.Timer
 	for _, p := range plugins {
-		logrus.WithField("plugin", p.GetName()).Info("Running plugin")
-		if err = p.Run(client, cfg.AdvertiseAddress, certs[p.GetName()]); err != nil {
-			err = errors.Wrapf(err, "error running plugin %v", p.GetName())
-			logrus.Error(err)
-			monitorCh <- utils.MakeErrorResult(p.GetResultType(), map[string]interface{}{"error": err.Error()}, "")
+		p := p
+		secs := pluginTimeoutSeconds(cfg, p.GetName())
+		if secs <= 0 {
 			continue
 		}
-		// Have the plugin monitor for errors
-		go p.Monitor(client, nodes.Items, monitorCh)
+		grace := gracefulShutdownSeconds(cfg, p.GetName())
+		timers = append(timers, time.AfterFunc(time.Duration(secs-grace)*time.Second, func() {
+			shutdown <- p
+		}))
 	}
-	// 5. Have the aggregator plumb results from each plugins' monitor function
-	go aggr.IngestResults(monitorCh)
 
-	// Give the plugins a chance to cleanup before a hard timeout occurs
-	shutdownPlugins := time.After(time.Duration(cfg.TimeoutSeconds-plugin.GracefulShutdownPeriod) * time.Second)
-	// Ensure we only wait for results for a certain time
 	var timeout <-chan time.Time
-	if cfg.TimeoutSeconds > 0 {
-		timeout = time.After(time.Duration(cfg.TimeoutSeconds) * time.Second)
+	if secs := runTimeoutSeconds(cfg, plugins); secs > 0 {
+		timer := time.NewTimer(time.Duration(secs) * time.Second)
+		timers = append(timers, timer)
+		timeout = timer.C
+	}
+	return shutdown, timeout, func() {
+		for _, timer := range timers {
+			timer.Stop()
+		}
 	}
+}
 
-	// 6. Wait for aggr to show that all results are accounted for
-	for {
-		select {
-		case <-shutdownPlugins:
-			Cleanup(client, plugins)
-			logrus.Info("Gracefully shutting down plugins due to timeout.")
-		case <-timeout:
-			srv.Close()
-			stopWaitCh <- true
-			return errors.Errorf("timed out waiting for plugins, shutting down HTTP server")
-		case err := <-doneServ:
-			stopWaitCh <- true
-			return err
-		case <-doneAggr:
-			return nil
+// cleanupRun cleans up after the plugins of a run which is ending early, once
+// the diagnostics being collected are written out. The run has already
+// failed, so errors cleaning up are logged rather than returned.
+func cleanupRun(ctx context.Context, client kubernetes.Interface, plugins []plugin.Interface, aggr *Aggregator, keeper *resourceKeeper, log logrus.FieldLogger) {
+	aggr.diagnostics.wait()
+	if err := keeper.cleanupAll(ctx, client, plugins, aggr.failedResultTypes()); err != nil {
+		log.WithError(err).Info("Couldn't clean up after plugins")
+	}
+}
+
+// reportTimeout reports the results a run timed out waiting for, in the
+// annotations of the aggregator pod, the events and the webhook, and
+// collects diagnostics about them. It returns the error the run fails with.
+func reportTimeout(plugins []plugin.Interface, aggr *Aggregator, updater *updater, events *eventWriter, hook *webhook, log logrus.FieldLogger) error {
+	missing := aggr.MissingResults()
+	log.WithField("missing", len(missing)).Info("Timed out waiting for results")
+	if err := updater.AnnotateMissing(missing); err != nil {
+		log.WithError(err).Info("couldn't annotate sonobuoy pod with the missing results")
+	}
+	for _, p := range plugins {
+		pending := aggr.pendingResults(p.GetResultType())
+		for _, result := range pending {
+			events.emit(TimeoutEvent, result.ResultType, result.NodeName, TimeoutStatus)
+		}
+		if len(pending) > 0 {
+			hook.notify(p.GetResultType(), TimeoutStatus)
+		}
+		aggr.diagnostics.collectPending(p.GetResultType(), pending)
+	}
+	return timeoutError(missing)
+}
+
+// withMiddleware wraps the handler in each of the middleware, the first being
+// the outermost.
+func withMiddleware(handler http.Handler, middleware []func(http.Handler) http.Handler) http.Handler {
+	for i := len(middleware) - 1; i >= 0; i-- {
+		handler = middleware[i](handler)
+	}
+	return handler
+}
+
+// runID returns the ID the run is stamped with, or an empty string if it
+// isn't stamped.
+func runID(cfg plugin.AggregationConfig, opts RunOptions, outdir string) string {
+	if opts.RunID == "" && cfg.ResultsTTLSeconds > 0 {
+		return path.Base(outdir)
+	}
+	return opts.RunID
+}
+
+// writeExpectedResults records the expected results in the meta directory of
+// outdir, so that if the run doesn't finish it's still known what was expected.
+func writeExpectedResults(outdir string, expected []plugin.ExpectedResult) error {
+	metapath := path.Join(outdir, metaDir)
+	if err := os.MkdirAll(metapath, 0755); err != nil {
+		return errors.Wrapf(err, "couldn't create directory %v", metapath)
+	}
+
+	blob, err := json.Marshal(expected)
+	if err != nil {
+		return errors.Wrap(err, "couldn't marshal expected results")
+	}
+
+	file := path.Join(metapath, ExpectedResultsFile)
+	return errors.Wrapf(ioutil.WriteFile(file, blob, 0644), "couldn't write expected results to %v", file)
+}
+
+// writeCACert writes the PEM encoded CA certificate to the meta directory of
+// outdir, so the run's certificates and webhook signatures can be verified
+// later. The CA's private key is never written.
+func writeCACert(outdir string, cert *x509.Certificate) error {
+	metapath := path.Join(outdir, metaDir)
+	if err := os.MkdirAll(metapath, 0755); err != nil {
+		return errors.Wrapf(err, "couldn't create directory %v", metapath)
+	}
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Raw})
+	filename := path.Join(metapath, CACertFile)
+	return errors.Wrapf(ioutil.WriteFile(filename, certPEM, 0644), "couldn't write CA certificate to %v", filename)
+}
+
+// annotationUpdateFreq returns how often the status annotation should be
+// updated, falling back to the default if it isn't configured.
+func annotationUpdateFreq(cfg plugin.AggregationConfig) time.Duration {
+	if cfg.AnnotationUpdateFreqSeconds <= 0 {
+		return defaultAnnotationUpdateFreq
+	}
+	return time.Duration(cfg.AnnotationUpdateFreqSeconds) * time.Second
+}
+
+// jitterFactor returns the jitter to apply to status annotation updates,
+// falling back to the default if it isn't configured.
+func jitterFactor(cfg plugin.AggregationConfig) float64 {
+	if cfg.JitterFactor == 0 {
+		return defaultJitterFactor
+	}
+	return cfg.JitterFactor
+}
+
+// listen binds the aggregation server's address, returning an error naming
+// the address if the port is invalid or already in use.
+func listen(cfg plugin.AggregationConfig) (net.Listener, error) {
+	if cfg.BindSocket != "" {
+		return listenSocket(cfg.BindSocket)
+	}
+	if cfg.BindPort < 0 || cfg.BindPort > 65535 {
+		return nil, errors.Errorf("invalid aggregation server bind port %v, it must be between 0 (any free port) and 65535", cfg.BindPort)
+	}
+
+	address := net.JoinHostPort(cfg.BindAddress, strconv.Itoa(cfg.BindPort))
+	listener, err := net.Listen("tcp", address)
+	if err != nil {
+		return nil, errors.Wrapf(err, "couldn't listen on %v for results, check that port %v is free and %q is an address of this host", address, cfg.BindPort, cfg.BindAddress)
+	}
+	return listener, nil
+}
+
+// listenerPort returns the TCP port the listener is bound to, if it's
+// listening on one.
+func listenerPort(listener net.Listener) (int, bool) {
+	if listener == nil {
+		return 0, false
+	}
+	addr, ok := listener.Addr().(*net.TCPAddr)
+	if !ok {
+		return 0, false
+	}
+	return addr.Port, true
+}
+
+// withBindPort returns the config with the port the server was bound to in
+// place of a BindPort of 0, including in the advertise addresses, which were
+// made from it.
+func withBindPort(cfg plugin.AggregationConfig, port int) plugin.AggregationConfig {
+	cfg.BindPort = port
+	addresses := cfg.AdvertiseAddresses()
+	for i, address := range addresses {
+		if host, p, err := net.SplitHostPort(address); err == nil && p == "0" {
+			addresses[i] = net.JoinHostPort(host, strconv.Itoa(port))
+		}
+	}
+	cfg.AdvertiseAddress = strings.Join(addresses, ",")
+	return cfg
+}
+
+// listenSocket listens on a Unix domain socket at the given path, which is
+// removed when the listener is closed. A socket left behind by an earlier
+// run which didn't shut down cleanly is replaced.
+func listenSocket(socketPath string) (net.Listener, error) {
+	if info, err := os.Lstat(socketPath); err == nil && info.Mode()&os.ModeSocket != 0 {
+		if err := os.Remove(socketPath); err != nil {
+			return nil, errors.Wrapf(err, "couldn't remove stale socket %v", socketPath)
+		}
+	}
+
+	listener, err := net.Listen("unix", socketPath)
+	if err != nil {
+		return nil, errors.Wrapf(err, "couldn't listen on socket %v for results", socketPath)
+	}
+	listener.(*net.UnixListener).SetUnlinkOnClose(true)
+
+	// Workers may run as a different user in the same group
+	if err := os.Chmod(socketPath, 0660); err != nil {
+		listener.Close()
+		return nil, errors.Wrapf(err, "couldn't set permissions of socket %v", socketPath)
+	}
+	return listener, nil
+}
+
+// gracefulShutdownSeconds returns the graceful shutdown period, in seconds,
+// of the named plugin. Per-plugin periods take precedence over the global one.
+func gracefulShutdownSeconds(cfg plugin.AggregationConfig, pluginName string) int {
+	if secs := cfg.PluginGracefulShutdownSeconds[pluginName]; secs > 0 {
+		return secs
+	}
+	if cfg.GracefulShutdownSeconds > 0 {
+		return cfg.GracefulShutdownSeconds
+	}
+	return plugin.GracefulShutdownPeriod
+}
+
+// pluginTimeoutSeconds returns how long, in seconds, the run waits for the
+// named plugin's results, or 0 if it waits indefinitely. Per-plugin timeouts
+// take precedence over the global one, whether they're shorter or longer.
+func pluginTimeoutSeconds(cfg plugin.AggregationConfig, pluginName string) int {
+	if secs := cfg.PluginTimeouts[pluginName]; secs > 0 {
+		return secs
+	}
+	return cfg.TimeoutSeconds
+}
+
+// runTimeoutSeconds returns how long, in seconds, the run waits for all of
+// its results: the longest of its plugins' timeouts, or 0 if any of them
+// waits indefinitely.
+func runTimeoutSeconds(cfg plugin.AggregationConfig, plugins []plugin.Interface) int {
+	if len(plugins) == 0 {
+		return cfg.TimeoutSeconds
+	}
+	longest := 0
+	for _, p := range plugins {
+		secs := pluginTimeoutSeconds(cfg, p.GetName())
+		if secs <= 0 {
+			return 0
+		}
+		if secs > longest {
+			longest = secs
+		}
+	}
+	return longest
+}
+
+// pluginExpectedResults returns the results the plugin is expected to submit
+// from the given nodes: the ones the config overrides its estimate with, if it
+// does, or else the plugin's own estimate.
+func pluginExpectedResults(p plugin.Interface, nodes []v1.Node, cfg plugin.AggregationConfig) []plugin.ExpectedResult {
+	if override, ok := cfg.PluginExpectedResults[p.GetName()]; ok {
+		return override.ExpectedResults(p.GetResultType(), nodes)
+	}
+	return p.ExpectedResults(nodes)
+}
+
+// certValidity returns how long the CA and the client certificates it issues
+// are valid for. The CA always covers the whole run, so clients can renew their
+// certificates until the run ends. Unless configured otherwise, client
+// certificates cover the whole run too.
+func certValidity(cfg plugin.AggregationConfig) (caValidity, clientValidity time.Duration) {
+	caValidity = ca.DefaultValidity
+	timeout := cfg.TimeoutSeconds
+	for _, secs := range cfg.PluginTimeouts {
+		if secs > timeout {
+			timeout = secs
 		}
 	}
+	if run := time.Duration(timeout+gracefulShutdownSeconds(cfg, "")) * time.Second; run > caValidity {
+		caValidity = run
+	}
+
+	clientValidity = caValidity
+	if cfg.CertValiditySeconds > 0 {
+		clientValidity = time.Duration(cfg.CertValiditySeconds) * time.Second
+	}
+	if clientValidity > caValidity {
+		caValidity = clientValidity
+	}
+	return caValidity, clientValidity
 }
 
-// Cleanup calls cleanup on all plugins
-func Cleanup(client kubernetes.Interface, plugins []plugin.Interface) {
-	// Cleanup after each plugin
+// newAuthority returns the CA which issues the run's certificates: the one
+// given in opts, the one in the config's CA files, or else a new one. A CA
+// which wasn't generated for the run is checked to make sure it can issue a
+// client certificate for each plugin.
+func newAuthority(cfg plugin.AggregationConfig, opts RunOptions, plugins []plugin.Interface, log logrus.FieldLogger) (*ca.Authority, error) {
+	caValidity, clientValidity := certValidity(cfg)
+
+	auth := opts.Authority
+	switch {
+	case auth != nil:
+	case cfg.CACertFile != "":
+		certPEM, err := ioutil.ReadFile(cfg.CACertFile)
+		if err != nil {
+			return nil, errors.Wrap(err, "couldn't read CA certificate")
+		}
+		keyPEM, err := ioutil.ReadFile(cfg.CAKeyFile)
+		if err != nil {
+			return nil, errors.Wrap(err, "couldn't read CA private key")
+		}
+		if auth, err = ca.NewAuthorityFromPEM(certPEM, keyPEM, clientValidity); err != nil {
+			return nil, errors.Wrap(err, "couldn't load certificate authority for plugin aggregator")
+		}
+	default:
+		auth, err := ca.NewAuthorityWithKeyType(ca.KeyType(cfg.KeyType), caValidity, clientValidity)
+		return auth, errors.Wrap(err, "couldn't make new certificate authority for plugin aggregator")
+	}
+
+	names := make([]string, 0, len(plugins))
 	for _, p := range plugins {
+		names = append(names, p.GetName())
+	}
+	if err := auth.CheckClientNames(names...); err != nil {
+		return nil, errors.Wrap(err, "certificate authority can't issue plugin certificates")
+	}
+	if expires := auth.CACert().NotAfter; time.Until(expires) < caValidity {
+		log.WithField("expires", expires).Warn("CA certificate expires before the run times out")
+	}
+	return auth, nil
+}
+
+// runLogger returns the logger the run logs to: opts.Logger if it's set, or
+// else a logger of its own which writes where the standard logrus logger does,
+// with its level and hooks, in the configured format. Unknown formats are
+// rejected when the config is loaded, so they keep the standard logger's
+// format. The standard logger itself is left alone.
+func runLogger(cfg plugin.AggregationConfig, opts RunOptions) logrus.FieldLogger {
+	if opts.Logger != nil {
+		return opts.Logger
+	}
+	std := logrus.StandardLogger()
+	logger := logrus.New()
+	logger.Out = std.Out
+	logger.Formatter = std.Formatter
+	logger.SetLevel(std.GetLevel())
+	for level, hooks := range std.Hooks {
+		logger.Hooks[level] = append([]logrus.Hook(nil), hooks...)
+	}
+	switch cfg.LogFormat {
+	case plugin.LogFormatJSON:
+		logger.Formatter = &logrus.JSONFormatter{}
+	case plugin.LogFormatText:
+		logger.Formatter = &logrus.TextFormatter{}
+	}
+	return logger
+}
+
+// nodeCacheTTL returns how long the node list is cached for, falling back to
+// the default if it isn't configured.
+func nodeCacheTTL(cfg plugin.AggregationConfig) time.Duration {
+	if cfg.NodeCacheTTLSeconds <= 0 {
+		return defaultNodeCacheTTL
+	}
+	return time.Duration(cfg.NodeCacheTTLSeconds) * time.Second
+}
+
+// pluginNamespace returns the namespace the plugin's pods run in, which is
+// the run's namespace unless the plugin says otherwise.
+func pluginNamespace(p plugin.Interface, namespace string) string {
+	if n, ok := p.(plugin.Namespaced); ok && n.GetNamespace() != "" {
+		return n.GetNamespace()
+	}
+	return namespace
+}
+
+// ValidatePlugins checks that each of the plugins can be run, before any of
+// them is launched. Plugins which are a plugin.Validator check themselves.
+// For any others which run outside of the run's namespace, the aggregator
+// makes sure it's allowed to list pods in their namespace so that it can
+// watch them. Every problem found is returned in a single error, so they can
+// all be fixed at once.
+func ValidatePlugins(client kubernetes.Interface, plugins []plugin.Interface, namespace string) error {
+	var problems []string
+	for _, p := range plugins {
+		var errs []error
+		if v, ok := p.(plugin.Validator); ok {
+			errs = v.Validate(client)
+		} else if ns := pluginNamespace(p, namespace); ns != namespace {
+			if _, err := client.CoreV1().Pods(ns).List(metav1.ListOptions{Limit: 1}); apierrors.IsForbidden(err) {
+				errs = append(errs, errors.Errorf("the aggregator isn't allowed to list pods in namespace %v", ns))
+			} else if err != nil {
+				errs = append(errs, errors.Wrapf(err, "couldn't list pods in namespace %v", ns))
+			}
+		}
+		for _, err := range errs {
+			problems = append(problems, fmt.Sprintf("%v: %v", p.GetName(), err))
+		}
+	}
+	if len(problems) > 0 {
+		return errors.Errorf("plugins failed validation: %v", strings.Join(problems, ", "))
+	}
+	return nil
+}
+
+// nodeListTimeout returns how long listing the nodes may take, falling back
+// to the default if it isn't configured.
+func nodeListTimeout(cfg plugin.AggregationConfig) time.Duration {
+	if cfg.NodeListTimeoutSeconds <= 0 {
+		return defaultNodeListTimeout
+	}
+	return time.Duration(cfg.NodeListTimeoutSeconds) * time.Second
+}
+
+// expectNewNodes adds the results the given plugins will submit for any nodes
+// which have joined the cluster since the run started, tagged with the value
+// of the topology label on their node.
+func expectNewNodes(nodeCache *plugin.NodeCache, plugins []plugin.Interface, cfg plugin.AggregationConfig, aggr *Aggregator, u *updater) {
+	nodes, err := nodeCache.Nodes()
+	if err != nil {
+		aggr.logger().WithError(err).Info("couldn't check for new nodes")
+		return
+	}
+
+	var expected []plugin.ExpectedResult
+	for _, p := range plugins {
+		expected = append(expected, pluginExpectedResults(p, nodes, cfg)...)
+	}
+	setTopology(expected, nodes, cfg.TopologyLabel)
+
+	added := aggr.expectResults(expected)
+	if len(added) == 0 {
+		return
+	}
+	for _, result := range added {
+		aggr.logger().WithFields(logrus.Fields{
+			"plugin": result.ResultType,
+			"node":   result.NodeName,
+		}).Info("Expecting result from new node")
+	}
+	u.expect(added)
+}
+
+// dropRemovedNodes submits an error result for each pending node-specific
+// result whose node is no longer in the cluster, so the run doesn't wait for
+// it forever. The summary counts these results as removed, not failed.
+func dropRemovedNodes(nodeCache *plugin.NodeCache, aggr *Aggregator, resultsCh chan<- *plugin.Result) {
+	nodes, err := nodeCache.Nodes()
+	if err != nil {
+		aggr.logger().WithError(err).Info("couldn't check for removed nodes")
+		return
+	}
+
+	present := make(map[string]bool, len(nodes))
+	for _, node := range nodes {
+		present[node.Name] = true
+	}
+
+	for _, pending := range aggr.pendingNodeResults() {
+		if present[pending.NodeName] {
+			continue
+		}
+		aggr.logger().WithFields(logrus.Fields{
+			"plugin": pending.ResultType,
+			"node":   pending.NodeName,
+		}).Info("Node was removed, no longer expecting its result")
+		resultsCh <- utils.MakeErrorResult(pending.ResultType, map[string]interface{}{
+			"error": fmt.Sprintf("%v: node %v left the cluster during the run", nodeRemovedErrorPrefix, pending.NodeName),
+		}, pending.NodeName)
+	}
+}
+
+// pluginRunAttempts returns how many times launching a plugin should be
+// attempted, falling back to the default if it isn't configured.
+func pluginRunAttempts(cfg plugin.AggregationConfig) int {
+	if cfg.PluginRunAttempts <= 0 {
+		return defaultPluginRunAttempts
+	}
+	return cfg.PluginRunAttempts
+}
+
+// launchParameters returns the settings the plugin is launched with, with
+// defaults applied.
+func launchParameters(cfg plugin.AggregationConfig, p plugin.Interface) PluginParameters {
+	params := PluginParameters{
+		Plugin:         p.GetName(),
+		ResultType:     p.GetResultType(),
+		MasterAddress:  cfg.AdvertiseAddress,
+		TimeoutSeconds: pluginTimeoutSeconds(cfg, p.GetName()),
+		RunAttempts:    pluginRunAttempts(cfg),
+	}
+	if parameterized, ok := p.(plugin.Parameterized); ok {
+		resolved := parameterized.GetParameters()
+		params.Parameters = &resolved
+	}
+	return params
+}
+
+// isRetryable returns true if err is a transient Kubernetes API error which
+// may succeed if the request is retried.
+func isRetryable(err error) bool {
+	err = errors.Cause(err)
+	return apierrors.IsTooManyRequests(err) ||
+		apierrors.IsServerTimeout(err) ||
+		apierrors.IsTimeout(err) ||
+		apierrors.IsServiceUnavailable(err) ||
+		apierrors.IsInternalError(err) ||
+		utilnet.IsConnectionReset(err)
+}
+
+// runPlugin launches the plugin, retrying with exponential backoff up to the
+// given number of attempts while it fails with retryable errors.
+func runPlugin(client kubernetes.Interface, p plugin.Interface, address string, cert *tls.Certificate, attempts int, log logrus.FieldLogger) error {
+	backoff := pluginRunBackoff
+	backoff.Steps = attempts
+
+	var lastErr error
+	err := wait.ExponentialBackoff(backoff, func() (bool, error) {
+		lastErr = p.Run(client, address, cert)
+		switch {
+		case lastErr == nil:
+			return true, nil
+		case isRetryable(lastErr):
+			log.WithError(lastErr).WithField("plugin", p.GetName()).Info("Transient error running plugin, retrying")
+			return false, nil
+		default:
+			return false, lastErr
+		}
+	})
+	if err == wait.ErrWaitTimeout {
+		return errors.Wrapf(lastErr, "giving up after %v attempts", attempts)
+	}
+	return err
+}
+
+// launchStagger spaces plugin launches at least delay apart. With no delay,
+// launches don't wait at all.
+type launchStagger struct {
+	delay time.Duration
+	mu    sync.Mutex
+	// next is the earliest time the next launch may happen
+	next time.Time
+}
+
+// wait blocks until it's time for the next launch, returning false if ctx is
+// done first.
+func (s *launchStagger) wait(ctx context.Context) bool {
+	if s.delay <= 0 {
+		return true
+	}
+
+	s.mu.Lock()
+	at := s.next
+	if now := time.Now(); at.Before(now) {
+		at = now
+	}
+	s.next = at.Add(s.delay)
+	s.mu.Unlock()
+
+	timer := time.NewTimer(time.Until(at))
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+// configureHTTP2 has the server negotiate HTTP/2 with clients which support
+// it, so that each worker's uploads share a connection, unless it's disabled.
+// If the TLS settings don't allow HTTP/2, only HTTP/1.1 is served.
+func configureHTTP2(srv *http.Server, disable bool, log logrus.FieldLogger) {
+	if !disable {
+		err := http2.ConfigureServer(srv, nil)
+		if err == nil {
+			return
+		}
+		log.WithError(err).Warn("Couldn't enable HTTP/2, serving HTTP/1.1 only")
+	}
+	// A non-nil TLSNextProto stops net/http enabling HTTP/2 by itself.
+	srv.TLSNextProto = map[string]func(*http.Server, *tls.Conn, http.Handler){}
+	srv.TLSConfig.NextProtos = []string{"http/1.1"}
+}
+
+// serve serves the handler on the listener in the background, over TLS with
+// a server certificate issued by auth unless the listener is a Unix socket.
+// It returns a channel with the error the server stops with and a func which
+// shuts the server down.
+func serve(listener net.Listener, handler http.Handler, cfg plugin.AggregationConfig, auth *ca.Authority, log logrus.FieldLogger) (<-chan error, func(), error) {
+	done := make(chan error, 1)
+	if cfg.BindSocket != "" {
+		// Only processes which can open the socket can submit results,
+		// so there's no need for TLS.
+		srv := &http.Server{Handler: handler}
+		go func() {
+			log.WithField("socket", cfg.BindSocket).Info("Starting aggregation server")
+			done <- srv.Serve(listener)
+		}()
+		return done, func() { shutdownServer(srv, log) }, nil
+	}
+
+	// Advertise addresses often have a port, split this off if so
+	var advertiseHosts []string
+	for _, address := range cfg.AdvertiseAddresses() {
+		if host, _, err := net.SplitHostPort(address); err == nil {
+			address = host
+		}
+		advertiseHosts = append(advertiseHosts, address)
+	}
+	// Workers may reach the server by other names, e.g. through a service.
+	advertiseHosts = append(advertiseHosts, cfg.TLSServerNames...)
+	if cfg.WorkerTLSServerName != "" {
+		advertiseHosts = append(advertiseHosts, cfg.WorkerTLSServerName)
+	}
+
+	tlsOpts, err := ca.ParseTLSOptions(cfg.MinTLSVersion, cfg.CipherSuites)
+	if err != nil {
+		return nil, nil, errors.Wrap(err, "invalid TLS settings")
+	}
+	tlsCfg, err := auth.MakeServerConfigWithOptions(tlsOpts, advertiseHosts...)
+	if err != nil {
+		return nil, nil, errors.Wrap(err, "couldn't get a server certificate")
+	}
+	// Health checks are made without a client certificate, so the
+	// handler requires one for everything else instead.
+	tlsCfg.ClientAuth = tls.VerifyClientCertIfGiven
+
+	srv := &http.Server{
+		Addr:      listener.Addr().String(),
+		Handler:   handler,
+		TLSConfig: tlsCfg,
+	}
+	configureHTTP2(srv, cfg.DisableHTTP2, log)
+	go func() {
+		log.WithFields(logrus.Fields{
+			"address": cfg.BindAddress,
+			"port":    cfg.BindPort,
+		}).Info("Starting aggregation server")
+		done <- srv.ServeTLS(listener, "", "")
+	}()
+	return done, func() { shutdownServer(srv, log) }, nil
+}
+
+// shutdownServer gracefully shuts down the server, giving in-flight requests
+// up to serverDrainTimeout to complete before closing their connections.
+func shutdownServer(srv *http.Server, log logrus.FieldLogger) {
+	ctx, cancel := context.WithTimeout(context.Background(), serverDrainTimeout)
+	defer cancel()
+
+	if err := srv.Shutdown(ctx); err != nil {
+		log.WithError(err).Info("couldn't gracefully shut down aggregation server, closing it")
+		srv.Close()
+	}
+}
+
+// timeoutPlugin waits for the given timeout to pass and then cleans up the
+// plugin, submitting a timeout error result for each of its results that has
+// not been received yet. It returns early if ctx is done first.
+func timeoutPlugin(ctx context.Context, client kubernetes.Interface, p plugin.Interface, aggr *Aggregator, keeper *resourceKeeper, timeout time.Duration, resultsCh chan<- *plugin.Result) {
+	select {
+	case <-ctx.Done():
+		return
+	case <-time.After(timeout):
+	}
+
+	pending := aggr.pendingResults(p.GetResultType())
+	if len(pending) == 0 {
+		return
+	}
+
+	aggr.logger().WithFields(logrus.Fields{
+		"plugin":  p.GetName(),
+		"timeout": timeout.String(),
+	}).Info("Plugin timed out, cleaning up")
+	aggr.diagnostics.collectPending(p.GetResultType(), pending)
+	aggr.diagnostics.wait()
+	// The plugin is about to fail with the timeout errors
+	if err := keeper.cleanup(ctx, client, p, true); err != nil {
+		aggr.logger().WithError(err).WithField("plugin", p.GetName()).Info("Couldn't clean up after plugin")
+	}
+	for _, expected := range pending {
+		resultsCh <- utils.MakeErrorResult(expected.ResultType, map[string]interface{}{
+			"error":    fmt.Sprintf("%v %v after %v", timeoutErrorPrefix, p.GetName(), timeout),
+			"category": plugin.ErrorCategoryTimeout,
+		}, expected.NodeName)
+	}
+}
+
+// monitorPlugin runs the plugin's Monitor. If it panics, an error recording
+// the panic and its stack trace is submitted for each of the plugin's results
+// which haven't been received, so a buggy plugin fails rather than leaving
+// the run waiting for it until it times out.
+func monitorPlugin(client kubernetes.Interface, p plugin.Interface, nodes *plugin.NodeCache, aggr *Aggregator, resultsCh chan<- *plugin.Result) {
+	defer func() {
+		r := recover()
+		if r == nil {
+			return
+		}
+		stack := string(debug.Stack())
+		aggr.logger().WithFields(logrus.Fields{
+			"plugin": p.GetName(),
+			"panic":  r,
+		}).Error("Plugin's monitor panicked")
+		for _, expected := range aggr.pendingResults(p.GetResultType()) {
+			resultsCh <- utils.MakeErrorResult(expected.ResultType, map[string]interface{}{
+				"error":    fmt.Sprintf("monitoring plugin %v panicked: %v", p.GetName(), r),
+				"category": plugin.ErrorCategoryCrash,
+				"stack":    stack,
+			}, expected.NodeName)
+		}
+	}()
+	p.Monitor(client, nodes, resultsCh)
+}
+
+// Cleanup cleans up after all of the plugins at once, giving each of them
+// pluginCleanupTimeout to do so. The plugins which couldn't be cleaned up are
+// logged, so their resources can be deleted by hand, and returned in the
+// error.
+func Cleanup(ctx context.Context, client kubernetes.Interface, plugins []plugin.Interface, log logrus.FieldLogger) error {
+	errs := make([]error, len(plugins))
+	var wg sync.WaitGroup
+	for i, p := range plugins {
+		wg.Add(1)
+		go func(i int, p plugin.Interface) {
+			defer wg.Done()
+			errs[i] = cleanupPlugin(ctx, client, p)
+		}(i, p)
+	}
+	wg.Wait()
+
+	var failed []string
+	for i, err := range errs {
+		if err == nil {
+			continue
+		}
+		name := plugins[i].GetName()
+		log.WithError(err).WithField("plugin", name).Error("Couldn't clean up after plugin, its resources may need to be deleted by hand")
+		failed = append(failed, fmt.Sprintf("%v: %v", name, err))
+	}
+	if len(failed) > 0 {
+		return errors.Errorf("couldn't clean up after plugins: %v", strings.Join(failed, ", "))
+	}
+	return nil
+}
+
+// cleanupPlugin cleans up after the plugin, returning an error if it reports
+// one (as a plugin.CleanupReporter) or if it doesn't finish within
+// pluginCleanupTimeout or before ctx is done. A cleanup which doesn't finish
+// in time is left running in the background.
+func cleanupPlugin(ctx context.Context, client kubernetes.Interface, p plugin.Interface) error {
+	ctx, cancel := context.WithTimeout(ctx, pluginCleanupTimeout)
+	defer cancel()
+
+	done := make(chan error, 1)
+	go func() {
+		if reporter, ok := p.(plugin.CleanupReporter); ok {
+			done <- reporter.CleanupWithError(client)
+			return
+		}
 		p.Cleanup(client)
+		done <- nil
+	}()
+
+	select {
+	case err := <-done:
+		return err
+	case <-ctx.Done():
+		return errors.Wrap(ctx.Err(), "cleanup didn't finish")
 	}
 }
@@ -0,0 +1,1926 @@
+/*
+Copyright 2018 Heptio Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package aggregation
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"path"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/heptio/sonobuoy/pkg/backplane/ca"
+	"github.com/heptio/sonobuoy/pkg/encryption"
+	"github.com/heptio/sonobuoy/pkg/plugin"
+	"github.com/heptio/sonobuoy/pkg/plugin/testutil"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	testhook "github.com/sirupsen/logrus/hooks/test"
+	"golang.org/x/net/http2"
+	v1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/apimachinery/pkg/version"
+	"k8s.io/client-go/discovery"
+	"k8s.io/client-go/kubernetes"
+	corev1 "k8s.io/client-go/kubernetes/typed/core/v1"
+	"k8s.io/client-go/rest"
+)
+
+// fakeClient is a kubernetes.Interface supporting only the calls Run makes:
+// listing nodes, getting the server version and patching the status
+// annotation on the aggregator pod.
+type fakeClient struct {
+	kubernetes.Interface
+	nodes  []v1.Node
+	pods   []v1.Pod
+	events []v1.Event
+	// forbidden lists the namespaces pods can't be listed in.
+	forbidden map[string]bool
+
+	// patches records each patch made to the aggregator pod.
+	patchesMu sync.Mutex
+	patches   [][]byte
+}
+
+func (c *fakeClient) CoreV1() corev1.CoreV1Interface {
+	return &fakeCoreV1{nodes: c.nodes, client: c}
+}
+
+func (c *fakeClient) Discovery() discovery.DiscoveryInterface {
+	return &fakeDiscovery{}
+}
+
+// fakeDiscovery only has the server version, without a client for the rest
+// of the API server.
+type fakeDiscovery struct {
+	discovery.DiscoveryInterface
+}
+
+func (d *fakeDiscovery) ServerVersion() (*version.Info, error) {
+	return &version.Info{GitVersion: "v1.14.0"}, nil
+}
+
+func (d *fakeDiscovery) RESTClient() rest.Interface {
+	return nil
+}
+
+type fakeCoreV1 struct {
+	corev1.CoreV1Interface
+	nodes  []v1.Node
+	client *fakeClient
+}
+
+func (c *fakeCoreV1) Nodes() corev1.NodeInterface {
+	return &fakeNodes{nodes: c.nodes}
+}
+
+func (c *fakeCoreV1) Pods(namespace string) corev1.PodInterface {
+	return &fakePods{client: c.client, namespace: namespace}
+}
+
+func (c *fakeCoreV1) Events(namespace string) corev1.EventInterface {
+	return &fakeEvents{events: c.client.events}
+}
+
+type fakeNodes struct {
+	corev1.NodeInterface
+	nodes []v1.Node
+}
+
+func (n *fakeNodes) List(opts metav1.ListOptions) (*v1.NodeList, error) {
+	return &v1.NodeList{Items: n.nodes}, nil
+}
+
+type fakePods struct {
+	corev1.PodInterface
+	client    *fakeClient
+	namespace string
+}
+
+func (p *fakePods) List(opts metav1.ListOptions) (*v1.PodList, error) {
+	if p.client.forbidden[p.namespace] {
+		return nil, apierrors.NewForbidden(v1.Resource("pods"), "", errors.New("no RBAC policy matched"))
+	}
+	return &v1.PodList{Items: p.client.pods}, nil
+}
+
+func (p *fakePods) Patch(name string, pt types.PatchType, data []byte, subresources ...string) (*v1.Pod, error) {
+	p.client.patchesMu.Lock()
+	defer p.client.patchesMu.Unlock()
+	p.client.patches = append(p.client.patches, data)
+	return &v1.Pod{}, nil
+}
+
+type fakeEvents struct {
+	corev1.EventInterface
+	events []v1.Event
+}
+
+func (e *fakeEvents) List(opts metav1.ListOptions) (*v1.EventList, error) {
+	return &v1.EventList{Items: e.events}, nil
+}
+
+// fakePlugin is a plugin.Interface which records the calls made to it instead
+// of creating any resources.
+type fakePlugin struct {
+	name      string
+	nodes     []string
+	cleanedUp bool
+	dependsOn []string
+	// run, if set, is called when the plugin is run.
+	run func(hostname string) error
+}
+
+func (f *fakePlugin) Run(kubeClient kubernetes.Interface, hostname string, cert *tls.Certificate) error {
+	if f.run != nil {
+		return f.run(hostname)
+	}
+	return nil
+}
+
+func (f *fakePlugin) Cleanup(kubeClient kubernetes.Interface) {
+	f.cleanedUp = true
+}
+
+func (f *fakePlugin) Monitor(kubeClient kubernetes.Interface, nodes *plugin.NodeCache, resultsCh chan<- *plugin.Result) {
+}
+
+func (f *fakePlugin) ExpectedResults(nodes []v1.Node) []plugin.ExpectedResult {
+	if len(f.nodes) == 0 {
+		return []plugin.ExpectedResult{{ResultType: f.name}}
+	}
+
+	ret := make([]plugin.ExpectedResult, len(f.nodes))
+	for i, node := range f.nodes {
+		ret[i] = plugin.ExpectedResult{NodeName: node, ResultType: f.name}
+	}
+	return ret
+}
+
+func (f *fakePlugin) FillTemplate(hostname string, cert *tls.Certificate) ([]byte, error) {
+	return nil, nil
+}
+
+func (f *fakePlugin) GetResultType() string { return f.name }
+
+func (f *fakePlugin) GetName() string { return f.name }
+
+func (f *fakePlugin) GetDependsOn() []string { return f.dependsOn }
+
+// panickingPlugin's monitor panics as soon as it starts.
+type panickingPlugin struct {
+	fakePlugin
+}
+
+func (p *panickingPlugin) Monitor(kubeClient kubernetes.Interface, nodes *plugin.NodeCache, resultsCh chan<- *plugin.Result) {
+	panic("lost track of the daemonset")
+}
+
+func TestRun_monitorPanics(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sonobuoy_run_test")
+	if err != nil {
+		t.Fatalf("Could not create temp directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	srv := NewInProcessServer()
+	e2e := &fakePlugin{name: "e2e", run: func(string) error {
+		go srv.Submit("", "e2e", "application/json", strings.NewReader(`{"some": "json"}`))
+		return nil
+	}}
+	logs := &panickingPlugin{fakePlugin{name: "systemd_logs", nodes: []string{"node1", "node2"}}}
+	cfg := plugin.AggregationConfig{TimeoutSeconds: 60}
+
+	done := make(chan struct{})
+	var summary *RunSummary
+	go func() {
+		defer close(done)
+		summary, err = Run(context.Background(), &fakeClient{}, []plugin.Interface{e2e, logs}, cfg, "heptio-sonobuoy-test", dir, RunOptions{InProcess: srv})
+	}()
+	select {
+	case <-done:
+	case <-time.After(10 * time.Second):
+		t.Fatal("expected the run to finish without waiting for the plugin to time out")
+	}
+	if err != nil {
+		t.Fatalf("unexpected error from run: %v", err)
+	}
+
+	manifest := readManifest(t, dir)
+	failed := 0
+	for _, entry := range manifest.Results {
+		switch entry.ResultType {
+		case "e2e":
+			if entry.Status != CompleteStatus {
+				t.Errorf("expected e2e to be unaffected, got %+v", entry)
+			}
+		case "systemd_logs":
+			failed++
+			if entry.Status == CompleteStatus || !strings.Contains(entry.Error, "monitoring plugin systemd_logs panicked") {
+				t.Errorf("expected the panic to be recorded for %v, got %+v", entry.Node, entry)
+			}
+			blob, err := ioutil.ReadFile(path.Join(dir, entry.Files[0].Path))
+			if err != nil || !strings.Contains(string(blob), "panickingPlugin") {
+				t.Errorf("expected the error for %v to include the stack trace, got %q: %v", entry.Node, blob, err)
+			}
+		}
+	}
+	if failed != 2 || summary.Succeeded() {
+		t.Errorf("expected both results of the plugin to fail, got %v failures and %+v", failed, summary)
+	}
+}
+
+func TestTimeoutPlugin(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sonobuoy_run_test")
+	if err != nil {
+		t.Fatalf("Could not create temp directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	p := &fakePlugin{name: "systemd_logs", nodes: []string{"node1", "node2"}}
+	aggr := NewAggregator(dir, p.ExpectedResults(nil))
+	aggr.Results["systemd_logs/node1"] = &plugin.Result{NodeName: "node1", ResultType: "systemd_logs"}
+
+	resultsCh := make(chan *plugin.Result, 2)
+	timeoutPlugin(context.Background(), nil, p, aggr, nil, time.Millisecond, resultsCh)
+	close(resultsCh)
+
+	if !p.cleanedUp {
+		t.Error("expected plugin to be cleaned up after timing out")
+	}
+
+	var results []*plugin.Result
+	for result := range resultsCh {
+		results = append(results, result)
+	}
+	if len(results) != 1 {
+		t.Fatalf("expected 1 timeout result, got %v", len(results))
+	}
+	if results[0].NodeName != "node2" || results[0].IsSuccess() || results[0].ErrorCategory != plugin.ErrorCategoryTimeout {
+		t.Errorf("expected a timeout error for node2, got %+v", results[0])
+	}
+}
+
+func TestTimeoutPlugin_cancelled(t *testing.T) {
+	p := &fakePlugin{name: "e2e"}
+	aggr := NewAggregator("", p.ExpectedResults(nil))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	resultsCh := make(chan *plugin.Result, 1)
+	timeoutPlugin(ctx, nil, p, aggr, nil, time.Hour, resultsCh)
+
+	if p.cleanedUp {
+		t.Error("expected plugin not to be cleaned up when the context is done")
+	}
+	if len(resultsCh) != 0 {
+		t.Errorf("expected no timeout results, got %v", len(resultsCh))
+	}
+}
+
+func TestShutdownServer_drainsRequests(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("couldn't listen: %v", err)
+	}
+
+	started, release := make(chan bool), make(chan bool)
+	srv := &http.Server{
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			started <- true
+			<-release
+			w.Write([]byte("done"))
+		}),
+	}
+	go srv.Serve(l)
+
+	respCh := make(chan *http.Response, 1)
+	go func() {
+		resp, err := http.Get("http://" + l.Addr().String())
+		if err != nil {
+			t.Errorf("request failed during shutdown: %v", err)
+		}
+		respCh <- resp
+	}()
+
+	<-started
+	shutdownDone := make(chan bool)
+	go func() {
+		shutdownServer(srv, logrus.StandardLogger())
+		close(shutdownDone)
+	}()
+
+	select {
+	case <-shutdownDone:
+		t.Fatal("server shut down before the in-flight request finished")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	close(release)
+	<-shutdownDone
+	if resp := <-respCh; resp == nil || resp.StatusCode != http.StatusOK {
+		t.Errorf("expected in-flight request to succeed, got %+v", resp)
+	}
+}
+
+func TestServe(t *testing.T) {
+	testCases := []struct {
+		desc      string
+		disable   bool
+		wantProto string
+	}{
+		{desc: "HTTP/2", wantProto: "HTTP/2.0"},
+		{desc: "HTTP/2 disabled", disable: true, wantProto: "HTTP/1.1"},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.desc, func(t *testing.T) {
+			l, err := net.Listen("tcp", "127.0.0.1:0")
+			if err != nil {
+				t.Fatalf("couldn't listen: %v", err)
+			}
+			auth, err := ca.NewAuthority()
+			if err != nil {
+				t.Fatalf("couldn't create certificate authority: %v", err)
+			}
+
+			// Workers reaching the server through a service name trust it too
+			cfg := plugin.AggregationConfig{
+				BindAddress:      "127.0.0.1",
+				AdvertiseAddress: l.Addr().String(),
+				TLSServerNames:   []string{"sonobuoy-aggregator"},
+				DisableHTTP2:     tc.disable,
+			}
+			handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.Write([]byte(r.Proto))
+			})
+			done, stop, err := serve(l, handler, cfg, auth, logrus.StandardLogger())
+			if err != nil {
+				t.Fatalf("unexpected error serving: %v", err)
+			}
+
+			for _, serverName := range []string{"127.0.0.1", "sonobuoy-aggregator"} {
+				transport := &http.Transport{TLSClientConfig: &tls.Config{
+					RootCAs:    auth.CACertPool(),
+					ServerName: serverName,
+				}}
+				if err := http2.ConfigureTransport(transport); err != nil {
+					t.Fatalf("couldn't configure HTTP/2: %v", err)
+				}
+				resp, err := (&http.Client{Transport: transport}).Get("https://" + l.Addr().String())
+				if err != nil {
+					t.Errorf("couldn't reach the server as %v: %v", serverName, err)
+					continue
+				}
+				body, _ := ioutil.ReadAll(resp.Body)
+				resp.Body.Close()
+				if string(body) != tc.wantProto {
+					t.Errorf("expected the server to be reached as %v over %v, got %v", serverName, tc.wantProto, string(body))
+				}
+			}
+
+			stop()
+			if err := <-done; err != http.ErrServerClosed {
+				t.Errorf("expected the server to be closed, got %v", err)
+			}
+		})
+	}
+}
+
+func TestServe_invalidTLSSettings(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("couldn't listen: %v", err)
+	}
+	defer l.Close()
+	auth, err := ca.NewAuthority()
+	if err != nil {
+		t.Fatalf("couldn't create certificate authority: %v", err)
+	}
+
+	cfg := plugin.AggregationConfig{MinTLSVersion: "SSLv3"}
+	if _, _, err := serve(l, http.NotFoundHandler(), cfg, auth, logrus.StandardLogger()); err == nil {
+		t.Error("expected an error serving with invalid TLS settings")
+	}
+}
+
+func TestStartRunServer(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sonobuoy_run_test")
+	if err != nil {
+		t.Fatalf("Could not create temp directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	socketClient := func(socket string) *http.Client {
+		return &http.Client{Transport: &http.Transport{
+			DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+				var d net.Dialer
+				return d.DialContext(ctx, "unix", socket)
+			},
+		}}
+	}
+	get := func(client *http.Client) error {
+		resp, err := client.Get("http://aggregator/")
+		if err != nil {
+			return err
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			return errors.Errorf("unexpected status %v", resp.Status)
+		}
+		return nil
+	}
+
+	ownSocket := path.Join(dir, "own.sock")
+	sharedSocket := path.Join(dir, "shared.sock")
+	shared, err := NewServer(&fakeClient{}, plugin.AggregationConfig{BindSocket: sharedSocket}, "heptio-sonobuoy-test", RunOptions{})
+	if err != nil {
+		t.Fatalf("couldn't start shared server: %v", err)
+	}
+	defer shared.Close()
+	inProcess := NewInProcessServer()
+
+	testCases := []struct {
+		desc   string
+		listen bool
+		shared *Server
+		opts   RunOptions
+		// submit submits a result to the running server
+		submit func() error
+		// wantAddr is the address Listening is called with, if any
+		wantAddr string
+	}{
+		{
+			desc: "In-process",
+			opts: RunOptions{InProcess: inProcess},
+			submit: func() error {
+				_, err := inProcess.Submit("", "e2e", "application/json", strings.NewReader("{}"))
+				return err
+			},
+		}, {
+			desc:     "Shared server",
+			shared:   shared,
+			submit:   func() error { return get(socketClient(sharedSocket)) },
+			wantAddr: sharedSocket,
+		}, {
+			desc:     "Own listener",
+			listen:   true,
+			submit:   func() error { return get(socketClient(ownSocket)) },
+			wantAddr: ownSocket,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.desc, func(t *testing.T) {
+			cfg := plugin.AggregationConfig{BindSocket: ownSocket}
+			var listener net.Listener
+			if tc.listen {
+				var err error
+				if listener, err = listen(cfg); err != nil {
+					t.Fatalf("couldn't listen: %v", err)
+				}
+				defer listener.Close()
+			}
+
+			ready := make(chan struct{})
+			var listening net.Addr
+			tc.opts.Ready = ready
+			tc.opts.Listening = func(addr net.Addr) { listening = addr }
+			handled := false
+			handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) { handled = true })
+
+			aggr := NewAggregator(dir, nil)
+			done, stop, err := startRunServer(handler, listener, tc.shared, aggr, cfg, nil, tc.opts, logrus.StandardLogger())
+			if err != nil {
+				t.Fatalf("unexpected error starting server: %v", err)
+			}
+			select {
+			case <-ready:
+			default:
+				t.Error("expected ready to be closed once the server started")
+			}
+			if tc.wantAddr == "" && listening != nil {
+				t.Errorf("expected listening not to be called, got %v", listening)
+			}
+			if tc.wantAddr != "" && (listening == nil || listening.String() != tc.wantAddr) {
+				t.Errorf("expected listening to be called with %v, got %v", tc.wantAddr, listening)
+			}
+			if tc.opts.InProcess == nil && aggr.connections == nil {
+				t.Error("expected the aggregator to count the server's connections")
+			}
+
+			if err := tc.submit(); err != nil {
+				t.Errorf("couldn't submit to the server: %v", err)
+			}
+			if !handled {
+				t.Error("expected the run's handler to handle the submission")
+			}
+
+			stop()
+			if tc.submit() == nil {
+				t.Error("expected submissions to be refused once the server stopped")
+			}
+			select {
+			case err := <-done:
+				if tc.shared != nil {
+					t.Errorf("expected the shared server to keep running, got %v", err)
+				}
+			default:
+			}
+		})
+	}
+}
+
+type namespacedPlugin struct {
+	fakePlugin
+	namespace string
+}
+
+func (p *namespacedPlugin) GetNamespace() string { return p.namespace }
+
+func TestRun_pluginNamespaceForbidden(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sonobuoy_run_test")
+	if err != nil {
+		t.Fatalf("Could not create temp directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	ran := false
+	e2e := &fakePlugin{name: "e2e", run: func(string) error {
+		ran = true
+		return nil
+	}}
+	privileged := &namespacedPlugin{fakePlugin{name: "privileged"}, "privileged-plugins"}
+	client := &fakeClient{forbidden: map[string]bool{"privileged-plugins": true}}
+
+	_, err = Run(context.Background(), client, []plugin.Interface{e2e, privileged}, plugin.AggregationConfig{}, "heptio-sonobuoy-test", dir, RunOptions{InProcess: NewInProcessServer()})
+	if err == nil || !strings.Contains(err.Error(), "privileged: the aggregator isn't allowed to list pods in namespace privileged-plugins") {
+		t.Errorf("expected a forbidden error for the plugin's namespace, got %v", err)
+	}
+	if ran {
+		t.Error("expected no plugins to be launched")
+	}
+}
+
+type validatingPlugin struct {
+	fakePlugin
+	errs []error
+}
+
+func (p *validatingPlugin) Validate(kubeClient kubernetes.Interface) []error { return p.errs }
+
+func TestRun_pluginValidation(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sonobuoy_run_test")
+	if err != nil {
+		t.Fatalf("Could not create temp directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	ran := false
+	run := func(string) error {
+		ran = true
+		return nil
+	}
+	e2e := &validatingPlugin{fakePlugin{name: "e2e", run: run}, []error{errors.New("namespace e2e doesn't exist")}}
+	logs := &validatingPlugin{fakePlugin{name: "systemd_logs", run: run}, []error{
+		errors.New("no image is set for the plugin's container"),
+		errors.New("the aggregator isn't allowed to create daemonsets.apps in namespace heptio-sonobuoy-test"),
+	}}
+	valid := &validatingPlugin{fakePlugin{name: "valid", run: run}, nil}
+	plugins := []plugin.Interface{e2e, logs, valid}
+
+	_, err = Run(context.Background(), &fakeClient{}, plugins, plugin.AggregationConfig{}, "heptio-sonobuoy-test", dir, RunOptions{InProcess: NewInProcessServer()})
+	if err == nil {
+		t.Fatal("expected the plugins to fail validation")
+	}
+	for _, problem := range []string{
+		"e2e: namespace e2e doesn't exist",
+		"systemd_logs: no image is set for the plugin's container",
+		"systemd_logs: the aggregator isn't allowed to create daemonsets.apps",
+	} {
+		if !strings.Contains(err.Error(), problem) {
+			t.Errorf("expected the error to include %q, got %v", problem, err)
+		}
+	}
+	if strings.Contains(err.Error(), "valid:") {
+		t.Errorf("expected no problems with the valid plugin, got %v", err)
+	}
+	if ran {
+		t.Error("expected no plugin to run after validation failed")
+	}
+
+	// Skipping validation launches the plugins regardless
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	e2e.run = func(string) error {
+		ran = true
+		cancel()
+		return nil
+	}
+	Run(ctx, &fakeClient{}, []plugin.Interface{e2e}, plugin.AggregationConfig{SkipPluginValidation: true}, "heptio-sonobuoy-test", dir, RunOptions{InProcess: NewInProcessServer()})
+	if !ran {
+		t.Error("expected the plugins to run when validation is skipped")
+	}
+}
+
+// reportingPlugin reports the given error from cleaning up, once release is
+// closed if it's set.
+type reportingPlugin struct {
+	fakePlugin
+	err     error
+	release chan struct{}
+}
+
+func (p *reportingPlugin) CleanupWithError(kubeClient kubernetes.Interface) error {
+	if p.release != nil {
+		<-p.release
+	}
+	return p.err
+}
+
+func TestCleanup(t *testing.T) {
+	defer func(timeout time.Duration) { pluginCleanupTimeout = timeout }(pluginCleanupTimeout)
+	pluginCleanupTimeout = 50 * time.Millisecond
+
+	release := make(chan struct{})
+	defer close(release)
+	ok := &fakePlugin{name: "e2e"}
+	hung := &reportingPlugin{fakePlugin: fakePlugin{name: "stuck"}, release: release}
+	failed := &reportingPlugin{fakePlugin: fakePlugin{name: "systemd_logs"}, err: errors.New("finalizer failed")}
+	plugins := []plugin.Interface{hung, ok, failed}
+
+	logger, hook := testhook.NewNullLogger()
+	start := time.Now()
+	err := Cleanup(context.Background(), &fakeClient{}, plugins, logger)
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("expected the stuck plugin not to hold up cleanup, it took %v", elapsed)
+	}
+	if !ok.cleanedUp {
+		t.Error("expected e2e to be cleaned up")
+	}
+	if err == nil {
+		t.Fatal("expected an error cleaning up")
+	}
+	for _, problem := range []string{"stuck: cleanup didn't finish", "systemd_logs: finalizer failed"} {
+		if !strings.Contains(err.Error(), problem) {
+			t.Errorf("expected the error to include %q, got %v", problem, err)
+		}
+	}
+	if strings.Contains(err.Error(), "e2e") {
+		t.Errorf("expected no error for e2e, got %v", err)
+	}
+
+	logged := map[string]bool{}
+	for _, entry := range hook.AllEntries() {
+		if entry.Level == logrus.ErrorLevel {
+			logged[fmt.Sprint(entry.Data["plugin"])] = true
+		}
+	}
+	if !logged["stuck"] || !logged["systemd_logs"] || logged["e2e"] {
+		t.Errorf("expected the plugins which weren't cleaned up to be logged, got %v", logged)
+	}
+}
+
+func TestPluginNamespace(t *testing.T) {
+	if ns := pluginNamespace(&fakePlugin{name: "e2e"}, "heptio-sonobuoy"); ns != "heptio-sonobuoy" {
+		t.Errorf("expected the run's namespace, got %q", ns)
+	}
+	if ns := pluginNamespace(&namespacedPlugin{fakePlugin{name: "e2e"}, "privileged"}, "heptio-sonobuoy"); ns != "privileged" {
+		t.Errorf("expected the plugin's namespace, got %q", ns)
+	}
+	if ns := pluginNamespace(&namespacedPlugin{fakePlugin{name: "e2e"}, ""}, "heptio-sonobuoy"); ns != "heptio-sonobuoy" {
+		t.Errorf("expected the run's namespace for a plugin without one, got %q", ns)
+	}
+}
+
+func TestRun_failFast(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sonobuoy_run_test")
+	if err != nil {
+		t.Fatalf("Could not create temp directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	failing := &fakePlugin{name: "systemd_logs", nodes: []string{"node1"}, run: func(string) error {
+		return errors.New("couldn't create daemonset")
+	}}
+	// e2e never submits its result, so without fail fast the run would
+	// wait for the timeout.
+	waiting := &fakePlugin{name: "e2e"}
+
+	cfg := plugin.AggregationConfig{FailFast: true, PluginRunAttempts: 1, TimeoutSeconds: 600}
+	start := time.Now()
+	summary, err := Run(context.Background(), &fakeClient{}, []plugin.Interface{failing, waiting}, cfg, "heptio-sonobuoy-test", dir, RunOptions{InProcess: NewInProcessServer()})
+	if err == nil || !strings.Contains(err.Error(), "systemd_logs/node1") {
+		t.Errorf("expected the run to be aborted by the systemd_logs failure, got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Minute {
+		t.Errorf("expected the run to end as soon as the result failed, took %v", elapsed)
+	}
+	if !waiting.cleanedUp {
+		t.Error("expected the remaining plugin to be cleaned up")
+	}
+	if _, ok := summary.Failed["systemd_logs/node1"]; !ok || len(summary.Completed) != 0 {
+		t.Errorf("expected the summary to have the failure, got %+v", summary)
+	}
+	if _, err := os.Stat(path.Join(dir, "plugins/systemd_logs/errors/node1")); err != nil {
+		t.Errorf("expected the failed result to be written: %v", err)
+	}
+}
+
+func TestRun_failFastCleanupError(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sonobuoy_run_test")
+	if err != nil {
+		t.Fatalf("Could not create temp directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	failing := &fakePlugin{name: "systemd_logs", nodes: []string{"node1"}, run: func(string) error {
+		return errors.New("couldn't create daemonset")
+	}}
+	stuck := &reportingPlugin{fakePlugin: fakePlugin{name: "e2e"}, err: errors.New("finalizer failed")}
+
+	logger, hook := testhook.NewNullLogger()
+	cfg := plugin.AggregationConfig{FailFast: true, PluginRunAttempts: 1, TimeoutSeconds: 600}
+	if _, err := Run(context.Background(), &fakeClient{}, []plugin.Interface{failing, stuck}, cfg, "heptio-sonobuoy-test", dir, RunOptions{InProcess: NewInProcessServer(), Logger: logger}); err == nil {
+		t.Fatal("expected the run to be aborted by the systemd_logs failure")
+	}
+
+	for _, entry := range hook.AllEntries() {
+		if entry.Message == "Couldn't clean up after plugins" && strings.Contains(fmt.Sprint(entry.Data[logrus.ErrorKey]), "finalizer failed") {
+			return
+		}
+	}
+	t.Error("expected the error cleaning up after the aborted run to be logged")
+}
+
+func TestCleanupRun(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sonobuoy_run_test")
+	if err != nil {
+		t.Fatalf("Could not create temp directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	ok := &fakePlugin{name: "e2e"}
+	failing := &reportingPlugin{fakePlugin: fakePlugin{name: "systemd_logs"}, err: errors.New("finalizer failed")}
+	failed := &fakePlugin{name: "job"}
+	plugins := []plugin.Interface{ok, failing, failed}
+
+	// The resources of the plugin which failed are kept for debugging
+	aggr := NewAggregator(dir, nil)
+	aggr.Results["job"] = &plugin.Result{ResultType: "job", Error: "exit status 1"}
+	logger, hook := testhook.NewNullLogger()
+	keeper := newResourceKeeper(plugin.KeepPluginResourcesOnFailure, dir, logger)
+
+	cleanupRun(context.Background(), &fakeClient{}, plugins, aggr, keeper, logger)
+	if !ok.cleanedUp {
+		t.Error("expected e2e to be cleaned up")
+	}
+	if failed.cleanedUp {
+		t.Error("expected the resources of the failed plugin to be kept")
+	}
+	for _, entry := range hook.AllEntries() {
+		if entry.Message == "Couldn't clean up after plugins" && strings.Contains(fmt.Sprint(entry.Data[logrus.ErrorKey]), "finalizer failed") {
+			return
+		}
+	}
+	t.Error("expected the error cleaning up systemd_logs to be logged")
+}
+
+func TestRun_socket(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sonobuoy_run_test")
+	if err != nil {
+		t.Fatalf("Could not create temp directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	socket := path.Join(dir, "aggregator.sock")
+
+	// A socket left behind by an earlier run is replaced
+	stale, err := net.Listen("unix", socket)
+	if err != nil {
+		t.Fatalf("couldn't listen on socket: %v", err)
+	}
+	stale.(*net.UnixListener).SetUnlinkOnClose(false)
+	stale.Close()
+
+	client := &http.Client{Transport: &http.Transport{
+		DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+			var d net.Dialer
+			return d.DialContext(ctx, "unix", socket)
+		},
+	}}
+	submitErr := make(chan error, 1)
+	p := &fakePlugin{name: "e2e", run: func(string) error {
+		go func() {
+			req, _ := http.NewRequest("PUT", "http://aggregator/api/v1/results/global/e2e", strings.NewReader("{}"))
+			resp, err := client.Do(req)
+			if err == nil {
+				resp.Body.Close()
+				if resp.StatusCode != http.StatusOK {
+					err = errors.Errorf("unexpected status %v", resp.Status)
+				}
+			}
+			submitErr <- err
+		}()
+		return nil
+	}}
+
+	cfg := plugin.AggregationConfig{BindSocket: socket}
+	summary, err := Run(context.Background(), &fakeClient{}, []plugin.Interface{p}, cfg, "heptio-sonobuoy-test", dir, RunOptions{})
+	if err != nil {
+		t.Fatalf("unexpected error from run: %v", err)
+	}
+	if err := <-submitErr; err != nil {
+		t.Errorf("couldn't submit result over the socket: %v", err)
+	}
+	if !summary.Succeeded() {
+		t.Errorf("expected all results to complete, got %+v", summary)
+	}
+	if _, err := os.Stat(socket); !os.IsNotExist(err) {
+		t.Errorf("expected the socket to be removed when the run ends, got %v", err)
+	}
+
+	// The socket is also removed when the run ends early
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := Run(ctx, &fakeClient{}, []plugin.Interface{&fakePlugin{name: "e2e"}}, cfg, "heptio-sonobuoy-test", dir, RunOptions{}); err == nil {
+		t.Error("expected an error from a cancelled run")
+	}
+	if _, err := os.Stat(socket); !os.IsNotExist(err) {
+		t.Errorf("expected the socket to be removed when the run is cancelled, got %v", err)
+	}
+}
+
+func TestRun_readyBeforePlugins(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sonobuoy_run_test")
+	if err != nil {
+		t.Fatalf("Could not create temp directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("couldn't find a free port: %v", err)
+	}
+	port := l.Addr().(*net.TCPAddr).Port
+	l.Close()
+
+	ready := make(chan struct{})
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	var dialErr error
+	ranPlugin := false
+	p := &fakePlugin{name: "e2e", run: func(hostname string) error {
+		ranPlugin = true
+		select {
+		case <-ready:
+		default:
+			t.Error("plugin was run before the server was ready")
+		}
+		conn, err := net.Dial("tcp", hostname)
+		if err == nil {
+			conn.Close()
+		}
+		dialErr = err
+		cancel()
+		return nil
+	}}
+
+	cfg := plugin.AggregationConfig{
+		BindAddress:      "127.0.0.1",
+		BindPort:         port,
+		AdvertiseAddress: l.Addr().String(),
+	}
+	_, err = Run(ctx, &fakeClient{}, []plugin.Interface{p}, cfg, "heptio-sonobuoy-test", dir, RunOptions{Ready: ready})
+	if err == nil {
+		t.Error("expected an error from a cancelled run")
+	}
+	if !ranPlugin {
+		t.Fatal("expected plugin to be run")
+	}
+	if dialErr != nil {
+		t.Errorf("expected aggregation server to accept connections when plugins run, got %v", dialErr)
+	}
+}
+
+func TestRun_http2(t *testing.T) {
+	testCases := []struct {
+		desc      string
+		disable   bool
+		wantProto string
+	}{
+		{desc: "HTTP/2", wantProto: "HTTP/2.0"},
+		{desc: "HTTP/2 disabled", disable: true, wantProto: "HTTP/1.1"},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.desc, func(t *testing.T) {
+			dir, err := ioutil.TempDir("", "sonobuoy_run_test")
+			if err != nil {
+				t.Fatalf("Could not create temp directory: %v", err)
+			}
+			defer os.RemoveAll(dir)
+
+			l, err := net.Listen("tcp", "127.0.0.1:0")
+			if err != nil {
+				t.Fatalf("couldn't find a free port: %v", err)
+			}
+			port := l.Addr().(*net.TCPAddr).Port
+			l.Close()
+
+			auth, err := ca.NewAuthority()
+			if err != nil {
+				t.Fatalf("couldn't create certificate authority: %v", err)
+			}
+			cert, err := auth.ClientKeyPair("e2e")
+			if err != nil {
+				t.Fatalf("couldn't create client certificate: %v", err)
+			}
+			transport := &http.Transport{TLSClientConfig: &tls.Config{
+				Certificates: []tls.Certificate{*cert},
+				RootCAs:      auth.CACertPool(),
+			}}
+			if err := http2.ConfigureTransport(transport); err != nil {
+				t.Fatalf("couldn't configure HTTP/2: %v", err)
+			}
+
+			// Large enough to need many frames and flow control updates
+			body := bytes.Repeat([]byte("0123456789abcdef"), 1<<20)
+			var proto string
+			uploaded := make(chan error, 1)
+			p := &fakePlugin{name: "e2e", run: func(hostname string) error {
+				go func() {
+					url, err := GlobalResultURL("https://"+hostname, "e2e")
+					if err != nil {
+						uploaded <- err
+						return
+					}
+					req, err := http.NewRequest(http.MethodPut, url, bytes.NewReader(body))
+					if err != nil {
+						uploaded <- err
+						return
+					}
+					req.Header.Set("content-type", "application/octet-stream")
+					resp, err := (&http.Client{Transport: transport}).Do(req)
+					if err != nil {
+						uploaded <- err
+						return
+					}
+					resp.Body.Close()
+					proto = resp.Proto
+					uploaded <- nil
+				}()
+				return nil
+			}}
+
+			cfg := plugin.AggregationConfig{
+				BindAddress:      "127.0.0.1",
+				BindPort:         port,
+				AdvertiseAddress: fmt.Sprintf("127.0.0.1:%v", port),
+				DisableHTTP2:     tc.disable,
+			}
+			summary, err := Run(context.Background(), &fakeClient{}, []plugin.Interface{p}, cfg, "heptio-sonobuoy-test", dir, RunOptions{Authority: auth})
+			if err != nil {
+				t.Fatalf("unexpected error from run: %v", err)
+			}
+			if err := <-uploaded; err != nil {
+				t.Fatalf("couldn't upload result: %v", err)
+			}
+			if !summary.Succeeded() {
+				t.Errorf("expected the result to complete, got %+v", summary)
+			}
+			if proto != tc.wantProto {
+				t.Errorf("expected the upload to use %v, got %v", tc.wantProto, proto)
+			}
+
+			manifest := readManifest(t, dir)
+			if len(manifest.Results) != 1 || manifest.Results[0].Size != int64(len(body)) {
+				t.Errorf("expected one result of %v bytes, got %+v", len(body), manifest.Results)
+			}
+		})
+	}
+}
+
+func TestWriteExpectedResults(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sonobuoy_run_test")
+	if err != nil {
+		t.Fatalf("Could not create temp directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	expected := []plugin.ExpectedResult{
+		{NodeName: "node1", ResultType: "systemd_logs"},
+		{ResultType: "e2e"},
+	}
+	if err := writeExpectedResults(dir, expected); err != nil {
+		t.Fatalf("unexpected error writing expected results: %v", err)
+	}
+
+	blob, err := ioutil.ReadFile(path.Join(dir, "meta", ExpectedResultsFile))
+	if err != nil {
+		t.Fatalf("couldn't read expected results: %v", err)
+	}
+
+	var got []plugin.ExpectedResult
+	if err := json.Unmarshal(blob, &got); err != nil {
+		t.Fatalf("couldn't unmarshal expected results: %v", err)
+	}
+	if !reflect.DeepEqual(got, expected) {
+		t.Errorf("expected %v, got %v", expected, got)
+	}
+}
+
+func TestWriteCACert(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sonobuoy_run_test")
+	if err != nil {
+		t.Fatalf("Could not create temp directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	auth, err := ca.NewAuthority()
+	if err != nil {
+		t.Fatalf("couldn't create certificate authority: %v", err)
+	}
+	if err := writeCACert(dir, auth.CACert()); err != nil {
+		t.Fatalf("unexpected error writing CA certificate: %v", err)
+	}
+
+	certPEM, err := ioutil.ReadFile(path.Join(dir, metaDir, CACertFile))
+	if err != nil {
+		t.Fatalf("couldn't read CA certificate: %v", err)
+	}
+	block, rest := pem.Decode(certPEM)
+	if block == nil || block.Type != "CERTIFICATE" {
+		t.Fatalf("expected a PEM encoded certificate, got %q", certPEM)
+	}
+	if !bytes.Equal(block.Bytes, auth.CACert().Raw) {
+		t.Error("expected the CA's certificate to be written")
+	}
+	// Only the certificate, never the key
+	if len(bytes.TrimSpace(rest)) != 0 {
+		t.Errorf("expected nothing but the certificate to be written, got %q", rest)
+	}
+}
+
+func TestRunPlugin(t *testing.T) {
+	defer func(backoff wait.Backoff) { pluginRunBackoff = backoff }(pluginRunBackoff)
+	pluginRunBackoff = wait.Backoff{Duration: time.Millisecond, Factor: 2}
+
+	tooManyRequests := apierrors.NewTooManyRequests("slow down", 1)
+	forbidden := apierrors.NewForbidden(schema.GroupResource{Resource: "pods"}, "e2e", errors.New("no"))
+
+	testCases := []struct {
+		desc      string
+		errs      []error
+		wantCalls int
+		wantErr   bool
+	}{
+		{desc: "success", wantCalls: 1},
+		{desc: "transient error then success", errs: []error{tooManyRequests}, wantCalls: 2},
+		{desc: "wrapped transient error then success", errs: []error{errors.Wrap(tooManyRequests, "couldn't create pod")}, wantCalls: 2},
+		{desc: "non-retryable error", errs: []error{forbidden}, wantCalls: 1, wantErr: true},
+		{desc: "retries exhausted", errs: []error{tooManyRequests, tooManyRequests, tooManyRequests}, wantCalls: 3, wantErr: true},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.desc, func(t *testing.T) {
+			calls := 0
+			p := &fakePlugin{name: "e2e", run: func(string) error {
+				calls++
+				if calls <= len(tc.errs) {
+					return tc.errs[calls-1]
+				}
+				return nil
+			}}
+
+			err := runPlugin(nil, p, "", nil, 3, logrus.StandardLogger())
+			if calls != tc.wantCalls {
+				t.Errorf("expected %v calls to Run, got %v", tc.wantCalls, calls)
+			}
+			if (err != nil) != tc.wantErr {
+				t.Errorf("expected error %v, got %v", tc.wantErr, err)
+			}
+		})
+	}
+}
+
+func TestExpectNewNodes(t *testing.T) {
+	client := &fakeClient{}
+	nodeCache := plugin.NewNodeCache(client, "", 0)
+
+	daemonset := &fakePlugin{name: "systemd_logs", nodes: []string{"node1"}}
+	job := &fakePlugin{name: "e2e"}
+	plugins := []plugin.Interface{daemonset, job}
+
+	var expected []plugin.ExpectedResult
+	for _, p := range plugins {
+		expected = append(expected, p.ExpectedResults(nil)...)
+	}
+	aggr := NewAggregator("", expected)
+	u := newUpdater(expected, "", client)
+
+	// node2 joins the cluster
+	daemonset.nodes = []string{"node1", "node2"}
+	expectNewNodes(nodeCache, plugins, plugin.AggregationConfig{}, aggr, u)
+
+	if _, ok := aggr.ExpectedResults["systemd_logs/node2"]; !ok {
+		t.Errorf("expected a result from the new node, got %v", aggr.ExpectedResults)
+	}
+	if len(aggr.ExpectedResults) != 3 {
+		t.Errorf("expected 3 expected results, got %v", len(aggr.ExpectedResults))
+	}
+	if err := u.Receive(&PluginStatus{Node: "node2", Plugin: "systemd_logs", Status: CompleteStatus}); err != nil {
+		t.Errorf("expected the status to include the new node: %v", err)
+	}
+	if err := u.Receive(&PluginStatus{Node: "node1", Plugin: "systemd_logs", Status: CompleteStatus}); err != nil {
+		t.Errorf("expected the status to still include the original node: %v", err)
+	}
+}
+
+func TestDropRemovedNodes(t *testing.T) {
+	// node2 has left the cluster
+	client := &fakeClient{nodes: []v1.Node{{ObjectMeta: metav1.ObjectMeta{Name: "node1"}}}}
+	nodeCache := plugin.NewNodeCache(client, "", 0)
+
+	expected := []plugin.ExpectedResult{
+		{NodeName: "node1", ResultType: "systemd_logs"},
+		{NodeName: "node2", ResultType: "systemd_logs"},
+		{NodeName: "node3", ResultType: "systemd_logs"},
+		{ResultType: "e2e"},
+	}
+	aggr := NewAggregator("", expected)
+	// node3 has left too, but its result is already in
+	aggr.Results["systemd_logs/node3"] = &plugin.Result{NodeName: "node3", ResultType: "systemd_logs"}
+
+	resultsCh := make(chan *plugin.Result, len(expected))
+	dropRemovedNodes(nodeCache, aggr, resultsCh)
+	close(resultsCh)
+
+	var dropped []*plugin.Result
+	for result := range resultsCh {
+		dropped = append(dropped, result)
+	}
+	if len(dropped) != 1 || dropped[0].NodeName != "node2" || dropped[0].ResultType != "systemd_logs" {
+		t.Fatalf("expected only the pending node2 result to be dropped, got %v", dropped)
+	}
+	if resultStatus(dropped[0]) != NodeRemovedStatus {
+		t.Errorf("expected the dropped result to have status %v, got %v", NodeRemovedStatus, resultStatus(dropped[0]))
+	}
+}
+
+func TestRunLogger(t *testing.T) {
+	defer logrus.SetOutput(logrus.StandardLogger().Out)
+	var buf bytes.Buffer
+	logrus.SetOutput(&buf)
+	formatter := logrus.StandardLogger().Formatter
+
+	log := runLogger(plugin.AggregationConfig{LogFormat: plugin.LogFormatJSON}, RunOptions{})
+	log.WithFields(resultFields(&plugin.Result{ResultType: "systemd_logs", NodeName: "node1"})).Info("Result unexpected")
+
+	var entry map[string]interface{}
+	if err := json.Unmarshal(buf.Bytes(), &entry); err != nil {
+		t.Fatalf("expected a JSON log entry, got %q: %v", buf.String(), err)
+	}
+	for field, want := range map[string]string{"plugin": "systemd_logs", "node": "node1", "msg": "Result unexpected"} {
+		if entry[field] != want {
+			t.Errorf("expected %v to be %q, got %v", field, want, entry[field])
+		}
+	}
+	if logrus.StandardLogger().Formatter != formatter {
+		t.Error("expected the standard logger's format to be left alone")
+	}
+
+	// A logger of the caller's own is used as it is
+	logger, _ := testhook.NewNullLogger()
+	if log := runLogger(plugin.AggregationConfig{LogFormat: plugin.LogFormatJSON}, RunOptions{Logger: logger}); log != logger {
+		t.Errorf("expected the logger from the options, got %v", log)
+	}
+}
+
+func TestCertValidity(t *testing.T) {
+	testCases := []struct {
+		desc       string
+		cfg        plugin.AggregationConfig
+		wantCA     time.Duration
+		wantClient time.Duration
+	}{
+		{
+			desc:       "Defaults",
+			cfg:        plugin.AggregationConfig{TimeoutSeconds: 3600},
+			wantCA:     48 * time.Hour,
+			wantClient: 48 * time.Hour,
+		}, {
+			desc:       "Timeout longer than the default validity",
+			cfg:        plugin.AggregationConfig{TimeoutSeconds: 72 * 3600},
+			wantCA:     72*time.Hour + plugin.GracefulShutdownPeriod*time.Second,
+			wantClient: 72*time.Hour + plugin.GracefulShutdownPeriod*time.Second,
+		}, {
+			desc:       "Short lived client certificates",
+			cfg:        plugin.AggregationConfig{TimeoutSeconds: 72 * 3600, CertValiditySeconds: 3600},
+			wantCA:     72*time.Hour + plugin.GracefulShutdownPeriod*time.Second,
+			wantClient: time.Hour,
+		}, {
+			desc:       "Configured graceful shutdown period",
+			cfg:        plugin.AggregationConfig{TimeoutSeconds: 72 * 3600, GracefulShutdownSeconds: 600},
+			wantCA:     72*time.Hour + 10*time.Minute,
+			wantClient: 72*time.Hour + 10*time.Minute,
+		}, {
+			desc:       "Client certificates longer than the run",
+			cfg:        plugin.AggregationConfig{TimeoutSeconds: 3600, CertValiditySeconds: 96 * 3600},
+			wantCA:     96 * time.Hour,
+			wantClient: 96 * time.Hour,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.desc, func(t *testing.T) {
+			caValidity, clientValidity := certValidity(tc.cfg)
+			if caValidity != tc.wantCA {
+				t.Errorf("expected CA validity %v, got %v", tc.wantCA, caValidity)
+			}
+			if clientValidity != tc.wantClient {
+				t.Errorf("expected client validity %v, got %v", tc.wantClient, clientValidity)
+			}
+		})
+	}
+}
+
+func TestLaunchStagger(t *testing.T) {
+	delay := 20 * time.Millisecond
+	stagger := &launchStagger{delay: delay}
+
+	start := time.Now()
+	for i := 0; i < 3; i++ {
+		if !stagger.wait(context.Background()) {
+			t.Fatalf("expected launch %v to go ahead", i)
+		}
+	}
+	if elapsed := time.Since(start); elapsed < 2*delay {
+		t.Errorf("expected three launches to take at least %v, took %v", 2*delay, elapsed)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	stagger.next = time.Now().Add(time.Hour)
+	if stagger.wait(ctx) {
+		t.Error("expected no launch once the context is done")
+	}
+
+	if !(&launchStagger{}).wait(ctx) {
+		t.Error("expected launches without a delay to go ahead straight away")
+	}
+}
+
+func TestGracefulShutdownSeconds(t *testing.T) {
+	cfg := plugin.AggregationConfig{
+		GracefulShutdownSeconds:       120,
+		PluginGracefulShutdownSeconds: map[string]int{"e2e": 300},
+	}
+	testCases := []struct {
+		desc   string
+		cfg    plugin.AggregationConfig
+		plugin string
+		want   int
+	}{
+		{desc: "Default", plugin: "e2e", want: plugin.GracefulShutdownPeriod},
+		{desc: "Global period", cfg: cfg, plugin: "systemd-logs", want: 120},
+		{desc: "Plugin period", cfg: cfg, plugin: "e2e", want: 300},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.desc, func(t *testing.T) {
+			if got := gracefulShutdownSeconds(tc.cfg, tc.plugin); got != tc.want {
+				t.Errorf("expected %v, got %v", tc.want, got)
+			}
+		})
+	}
+}
+
+func TestRunTimeoutSeconds(t *testing.T) {
+	e2e := &fakePlugin{name: "e2e"}
+	logs := &fakePlugin{name: "systemd-logs"}
+	testCases := []struct {
+		desc       string
+		cfg        plugin.AggregationConfig
+		plugins    []plugin.Interface
+		wantE2E    int
+		wantLogs   int
+		wantTheRun int
+	}{
+		{
+			desc:       "Global timeout",
+			cfg:        plugin.AggregationConfig{TimeoutSeconds: 600},
+			plugins:    []plugin.Interface{e2e, logs},
+			wantE2E:    600,
+			wantLogs:   600,
+			wantTheRun: 600,
+		}, {
+			desc:       "Shorter plugin timeout",
+			cfg:        plugin.AggregationConfig{TimeoutSeconds: 600, PluginTimeouts: map[string]int{"systemd-logs": 60}},
+			plugins:    []plugin.Interface{e2e, logs},
+			wantE2E:    600,
+			wantLogs:   60,
+			wantTheRun: 600,
+		}, {
+			desc:       "Longer plugin timeout",
+			cfg:        plugin.AggregationConfig{TimeoutSeconds: 600, PluginTimeouts: map[string]int{"e2e": 3600}},
+			plugins:    []plugin.Interface{e2e, logs},
+			wantE2E:    3600,
+			wantLogs:   600,
+			wantTheRun: 3600,
+		}, {
+			desc:       "A plugin without a timeout",
+			cfg:        plugin.AggregationConfig{PluginTimeouts: map[string]int{"e2e": 3600}},
+			plugins:    []plugin.Interface{e2e, logs},
+			wantE2E:    3600,
+			wantLogs:   0,
+			wantTheRun: 0,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.desc, func(t *testing.T) {
+			if got := pluginTimeoutSeconds(tc.cfg, "e2e"); got != tc.wantE2E {
+				t.Errorf("expected e2e to time out after %v, got %v", tc.wantE2E, got)
+			}
+			if got := pluginTimeoutSeconds(tc.cfg, "systemd-logs"); got != tc.wantLogs {
+				t.Errorf("expected systemd-logs to time out after %v, got %v", tc.wantLogs, got)
+			}
+			if got := runTimeoutSeconds(tc.cfg, tc.plugins); got != tc.wantTheRun {
+				t.Errorf("expected the run to time out after %v, got %v", tc.wantTheRun, got)
+			}
+		})
+	}
+}
+
+func TestScheduleTimeouts(t *testing.T) {
+	e2e, logs := &fakePlugin{name: "e2e"}, &fakePlugin{name: "systemd_logs"}
+
+	// e2e is shut down straight away, since its grace period is as long as
+	// its timeout, while the run waits for systemd_logs' longer timeout
+	cfg := plugin.AggregationConfig{
+		TimeoutSeconds:          1,
+		GracefulShutdownSeconds: 1,
+		PluginTimeouts:          map[string]int{"systemd_logs": 3600},
+	}
+	shutdown, timeout, stop := scheduleTimeouts(cfg, []plugin.Interface{e2e, logs})
+	defer stop()
+	select {
+	case p := <-shutdown:
+		if p.GetName() != "e2e" {
+			t.Errorf("expected e2e to be shut down, got %v", p.GetName())
+		}
+	case <-time.After(time.Second):
+		t.Fatal("expected e2e to be shut down")
+	}
+	select {
+	case p := <-shutdown:
+		t.Errorf("expected only e2e to be shut down, got %v", p.GetName())
+	case <-timeout:
+		t.Error("expected the run not to time out before systemd_logs does")
+	case <-time.After(1500 * time.Millisecond):
+	}
+
+	// The run times out with its plugins
+	_, timeout, stop = scheduleTimeouts(plugin.AggregationConfig{TimeoutSeconds: 1}, []plugin.Interface{e2e})
+	defer stop()
+	select {
+	case <-timeout:
+	case <-time.After(2 * time.Second):
+		t.Error("expected the run to time out")
+	}
+
+	// A plugin without a timeout keeps the run waiting
+	shutdown, timeout, stop = scheduleTimeouts(plugin.AggregationConfig{PluginTimeouts: map[string]int{"e2e": 1}}, []plugin.Interface{e2e, logs})
+	defer stop()
+	if timeout != nil {
+		t.Error("expected the run never to time out")
+	}
+	if p := <-shutdown; p.GetName() != "e2e" {
+		t.Errorf("expected e2e to be shut down, got %v", p.GetName())
+	}
+}
+
+// parameterizedPlugin is a fakePlugin which reports its parameters.
+type parameterizedPlugin struct {
+	fakePlugin
+	params plugin.Parameters
+}
+
+func (p *parameterizedPlugin) GetParameters() plugin.Parameters {
+	return p.params
+}
+
+func TestLaunchParameters(t *testing.T) {
+	cfg := plugin.AggregationConfig{
+		AdvertiseAddress: "10.0.0.1:8080",
+		TimeoutSeconds:   600,
+		PluginTimeouts:   map[string]int{"e2e": 3600},
+	}
+	e2e := &parameterizedPlugin{
+		fakePlugin: fakePlugin{name: "e2e"},
+		params:     plugin.Parameters{Image: "conformance:v1.14.0", Env: []v1.EnvVar{{Name: "E2E_FOCUS", Value: "Conformance"}}},
+	}
+
+	params := launchParameters(cfg, e2e)
+	if params.Plugin != "e2e" || params.MasterAddress != "10.0.0.1:8080" {
+		t.Errorf("unexpected parameters %+v", params)
+	}
+	if params.TimeoutSeconds != 3600 {
+		t.Errorf("expected the plugin's own timeout, got %v", params.TimeoutSeconds)
+	}
+	if params.RunAttempts != defaultPluginRunAttempts {
+		t.Errorf("expected the default number of attempts, got %v", params.RunAttempts)
+	}
+	if params.Parameters == nil || !reflect.DeepEqual(*params.Parameters, e2e.params) {
+		t.Errorf("expected the plugin's parameters to be recorded, got %+v", params.Parameters)
+	}
+
+	// Everything is inlined, so the plugin's settings sit alongside the
+	// run's.
+	blob, err := json.Marshal(params)
+	if err != nil {
+		t.Fatalf("couldn't marshal parameters: %v", err)
+	}
+	if !strings.Contains(string(blob), `"timeoutseconds":3600,"runattempts":3,"image":"conformance:v1.14.0"`) {
+		t.Errorf("unexpected JSON %s", blob)
+	}
+
+	params = launchParameters(cfg, &fakePlugin{name: "systemd-logs"})
+	if params.TimeoutSeconds != 600 {
+		t.Errorf("expected the global timeout, got %v", params.TimeoutSeconds)
+	}
+	if params.Parameters != nil {
+		t.Errorf("expected no parameters for a plugin which doesn't report them, got %+v", params.Parameters)
+	}
+}
+
+func TestListen(t *testing.T) {
+	inUse, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("couldn't listen on a free port: %v", err)
+	}
+	defer inUse.Close()
+	inUsePort := inUse.Addr().(*net.TCPAddr).Port
+
+	testCases := []struct {
+		desc      string
+		cfg       plugin.AggregationConfig
+		expectErr string
+	}{
+		{
+			desc:      "Negative port",
+			cfg:       plugin.AggregationConfig{BindAddress: "127.0.0.1", BindPort: -1},
+			expectErr: "invalid aggregation server bind port -1",
+		}, {
+			desc:      "Port out of range",
+			cfg:       plugin.AggregationConfig{BindAddress: "127.0.0.1", BindPort: 70000},
+			expectErr: "invalid aggregation server bind port 70000",
+		}, {
+			desc:      "Port in use",
+			cfg:       plugin.AggregationConfig{BindAddress: "127.0.0.1", BindPort: inUsePort},
+			expectErr: fmt.Sprintf("check that port %v is free", inUsePort),
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.desc, func(t *testing.T) {
+			l, err := listen(tc.cfg)
+			if err == nil {
+				l.Close()
+				t.Fatal("expected an error")
+			}
+			if !strings.Contains(err.Error(), tc.expectErr) {
+				t.Errorf("expected error to contain %q, got %v", tc.expectErr, err)
+			}
+		})
+	}
+}
+
+func TestRun_portInUse(t *testing.T) {
+	inUse, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("couldn't listen on a free port: %v", err)
+	}
+	defer inUse.Close()
+
+	ranPlugin := false
+	p := &fakePlugin{name: "e2e", run: func(string) error {
+		ranPlugin = true
+		return nil
+	}}
+
+	cfg := plugin.AggregationConfig{
+		BindAddress: "127.0.0.1",
+		BindPort:    inUse.Addr().(*net.TCPAddr).Port,
+	}
+	if _, err := Run(context.Background(), &fakeClient{}, []plugin.Interface{p}, cfg, "heptio-sonobuoy-test", "", RunOptions{}); err == nil {
+		t.Error("expected an error when the port is in use")
+	}
+	if ranPlugin {
+		t.Error("expected no plugins to be run when the server can't listen")
+	}
+}
+
+func TestListen_freePort(t *testing.T) {
+	l, err := listen(plugin.AggregationConfig{BindAddress: "127.0.0.1"})
+	if err != nil {
+		t.Fatalf("unexpected error binding a free port: %v", err)
+	}
+	defer l.Close()
+	if port, ok := listenerPort(l); !ok || port == 0 {
+		t.Errorf("expected to be bound to a free port, got %v", l.Addr())
+	}
+}
+
+func TestWithBindPort(t *testing.T) {
+	cfg := plugin.AggregationConfig{AdvertiseAddress: "sonobuoy:0, [fd00::1]:0,other:8080,noport"}
+	cfg = withBindPort(cfg, 34567)
+	if cfg.BindPort != 34567 {
+		t.Errorf("expected bind port 34567, got %v", cfg.BindPort)
+	}
+	expected := "sonobuoy:34567,[fd00::1]:34567,other:8080,noport"
+	if cfg.AdvertiseAddress != expected {
+		t.Errorf("expected advertise address %q, got %q", expected, cfg.AdvertiseAddress)
+	}
+}
+
+func TestRun_freePort(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sonobuoy_run_test")
+	if err != nil {
+		t.Fatalf("Could not create temp directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	var listening net.Addr
+	var advertised string
+	p := &fakePlugin{name: "e2e", run: func(address string) error {
+		advertised = address
+		cancel()
+		return nil
+	}}
+	client := &fakeClient{}
+	cfg := plugin.AggregationConfig{
+		BindAddress:      "127.0.0.1",
+		AdvertiseAddress: "127.0.0.1:0",
+		TimeoutSeconds:   600,
+	}
+	opts := RunOptions{Listening: func(addr net.Addr) { listening = addr }}
+	if _, err := Run(ctx, client, []plugin.Interface{p}, cfg, "heptio-sonobuoy-test", dir, opts); err == nil {
+		t.Error("expected an error since the run was cancelled")
+	}
+
+	addr, ok := listening.(*net.TCPAddr)
+	if !ok || addr.Port == 0 {
+		t.Fatalf("expected to be told the free port the server bound to, got %v", listening)
+	}
+	port := strconv.Itoa(addr.Port)
+	if expected := "127.0.0.1:" + port; advertised != expected {
+		t.Errorf("expected the plugin to be given %v, got %v", expected, advertised)
+	}
+
+	annotated := false
+	for _, patch := range client.patches {
+		var decoded struct {
+			Metadata struct {
+				Annotations map[string]string `json:"annotations"`
+			} `json:"metadata"`
+		}
+		if err := json.Unmarshal(patch, &decoded); err != nil {
+			t.Fatalf("couldn't decode patch %s: %v", patch, err)
+		}
+		if decoded.Metadata.Annotations[PortAnnotationName] == port {
+			annotated = true
+		}
+	}
+	if !annotated {
+		t.Errorf("expected the aggregator pod to be annotated with port %v", port)
+	}
+}
+
+func TestRun_encryption(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sonobuoy_run_test")
+	if err != nil {
+		t.Fatalf("Could not create temp directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	ranPlugin := false
+	p := &fakePlugin{name: "e2e", run: func(string) error {
+		ranPlugin = true
+		return nil
+	}}
+	cfg := plugin.AggregationConfig{EncryptionKeyFile: path.Join(dir, "missing")}
+	if _, err := Run(context.Background(), &fakeClient{}, []plugin.Interface{p}, cfg, "heptio-sonobuoy-test", dir, RunOptions{InProcess: NewInProcessServer()}); err == nil || !strings.Contains(err.Error(), "encryption key") {
+		t.Errorf("expected an error for the missing key file, got %v", err)
+	}
+	if ranPlugin {
+		t.Error("expected no plugins to be run without the encryption key")
+	}
+
+	keyFile := path.Join(dir, "key")
+	if err := ioutil.WriteFile(keyFile, []byte("s3cret\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	srv := NewInProcessServer()
+	p.run = func(string) error {
+		go srv.Submit("", "e2e", "application/json", strings.NewReader(`{"some": "json"}`))
+		return nil
+	}
+	cfg.EncryptionKeyFile = keyFile
+	outdir := path.Join(dir, "results")
+	if _, err := Run(context.Background(), &fakeClient{}, []plugin.Interface{p}, cfg, "heptio-sonobuoy-test", outdir, RunOptions{InProcess: srv}); err != nil {
+		t.Fatalf("unexpected error from run: %v", err)
+	}
+
+	manifest := readManifest(t, outdir)
+	want := &ManifestEncryption{Cipher: encryption.Cipher, KeyID: encryption.KeyID([]byte("s3cret"))}
+	if !reflect.DeepEqual(manifest.Encryption, want) {
+		t.Errorf("expected the manifest to record the encryption as %+v, got %+v", want, manifest.Encryption)
+	}
+	if len(manifest.Results) != 1 || len(manifest.Results[0].Files) != 1 {
+		t.Fatalf("expected one result file, got %+v", manifest.Results)
+	}
+	f, err := os.Open(path.Join(outdir, manifest.Results[0].Files[0].Path))
+	if err != nil {
+		t.Fatalf("couldn't open result: %v", err)
+	}
+	defer f.Close()
+	if encrypted, err := encryption.IsEncrypted(bufio.NewReader(f)); err != nil || !encrypted {
+		t.Errorf("expected the result to be encrypted, got %v, %v", encrypted, err)
+	}
+}
+
+func TestRun_expectedResultsOverride(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sonobuoy_run_test")
+	if err != nil {
+		t.Fatalf("Could not create temp directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	// The plugin estimates a result from every node, but only node1 reports.
+	srv := NewInProcessServer()
+	p := &fakePlugin{name: "control-plane", nodes: []string{"node1", "node2"}, run: func(string) error {
+		go srv.Submit("node1", "control-plane", "application/json", strings.NewReader("{}"))
+		return nil
+	}}
+
+	cfg := plugin.AggregationConfig{
+		PluginExpectedResults: map[string]plugin.ExpectedResultsOverride{
+			"control-plane": {Nodes: []string{"node1", "node1"}},
+		},
+	}
+	if _, err := Run(context.Background(), &fakeClient{}, []plugin.Interface{p}, cfg, "heptio-sonobuoy-test", dir, RunOptions{InProcess: srv}); err == nil || !strings.Contains(err.Error(), "more than once") {
+		t.Errorf("expected an error for the inconsistent override, got %v", err)
+	}
+
+	cfg.PluginExpectedResults["control-plane"] = plugin.ExpectedResultsOverride{Nodes: []string{"node1"}}
+	summary, err := Run(context.Background(), &fakeClient{}, []plugin.Interface{p}, cfg, "heptio-sonobuoy-test", dir, RunOptions{InProcess: srv})
+	if err != nil {
+		t.Fatalf("unexpected error from run: %v", err)
+	}
+	if !summary.Succeeded() || summary.Expected != 1 {
+		t.Errorf("expected only the overridden result to be expected, got %+v", summary)
+	}
+}
+
+func TestRun_scriptedPlugins(t *testing.T) {
+	testCases := []struct {
+		desc string
+		cfg  plugin.AggregationConfig
+		// plugins returns the plugins of the run, submitting results to srv
+		plugins func(srv *InProcessServer) []*testutil.FakePlugin
+		// expectErr is part of the error the run should return, if any
+		expectErr     string
+		expectSummary RunSummary
+		// expectCleanedUp are the plugins which should have been cleaned up
+		expectCleanedUp []string
+	}{
+		{
+			desc: "All plugins succeed",
+			cfg:  plugin.AggregationConfig{TimeoutSeconds: 60, GracefulShutdownSeconds: 30},
+			plugins: func(srv *InProcessServer) []*testutil.FakePlugin {
+				return []*testutil.FakePlugin{
+					{Name: "e2e", Submitter: srv, Delay: 10 * time.Millisecond},
+					{Name: "systemd_logs", Nodes: []string{"node1", "node2"}, Submitter: srv},
+				}
+			},
+			expectSummary: RunSummary{Expected: 3, Completed: []string{"e2e", "systemd_logs/node1", "systemd_logs/node2"}},
+		}, {
+			desc: "A plugin fails",
+			cfg:  plugin.AggregationConfig{TimeoutSeconds: 60, GracefulShutdownSeconds: 30},
+			plugins: func(srv *InProcessServer) []*testutil.FakePlugin {
+				return []*testutil.FakePlugin{
+					{Name: "e2e", Behavior: testutil.Fail, ErrorMessage: "pod crashed"},
+					{Name: "systemd_logs", Nodes: []string{"node1"}, Submitter: srv, Delay: 10 * time.Millisecond},
+				}
+			},
+			expectSummary: RunSummary{Expected: 2, Completed: []string{"systemd_logs/node1"}, Failed: map[string]string{"e2e": "pod crashed"}},
+		}, {
+			desc: "A plugin can't be launched",
+			cfg:  plugin.AggregationConfig{TimeoutSeconds: 60, GracefulShutdownSeconds: 30},
+			plugins: func(srv *InProcessServer) []*testutil.FakePlugin {
+				return []*testutil.FakePlugin{{Name: "e2e", RunError: errors.New("images can't be pulled")}}
+			},
+			expectSummary: RunSummary{Expected: 1, Failed: map[string]string{"e2e": "error running plugin e2e: images can't be pulled"}},
+		}, {
+			desc: "A plugin hangs until the timeout",
+			cfg:  plugin.AggregationConfig{TimeoutSeconds: 2, GracefulShutdownSeconds: 1},
+			plugins: func(srv *InProcessServer) []*testutil.FakePlugin {
+				return []*testutil.FakePlugin{
+					{Name: "e2e", Behavior: testutil.Hang},
+					{Name: "systemd_logs", Nodes: []string{"node1"}, Submitter: srv},
+				}
+			},
+			expectErr:       "1 of the expected results never arrived: e2e",
+			expectSummary:   RunSummary{Expected: 2, Completed: []string{"systemd_logs/node1"}, TimedOut: []string{"e2e"}},
+			expectCleanedUp: []string{"e2e", "systemd_logs"},
+		}, {
+			desc: "A plugin's own timeout outlasts the global one",
+			cfg:  plugin.AggregationConfig{TimeoutSeconds: 2, GracefulShutdownSeconds: 1, PluginTimeouts: map[string]int{"e2e": 5}},
+			plugins: func(srv *InProcessServer) []*testutil.FakePlugin {
+				return []*testutil.FakePlugin{
+					{Name: "e2e", Submitter: srv, Delay: 2500 * time.Millisecond},
+					{Name: "systemd_logs", Nodes: []string{"node1"}, Submitter: srv},
+				}
+			},
+			expectSummary: RunSummary{Expected: 2, Completed: []string{"e2e", "systemd_logs/node1"}},
+			// systemd_logs is still shut down once the global timeout nears
+			expectCleanedUp: []string{"systemd_logs"},
+		}, {
+			desc: "Some nodes never report before the timeout",
+			cfg:  plugin.AggregationConfig{TimeoutSeconds: 2, GracefulShutdownSeconds: 1},
+			plugins: func(srv *InProcessServer) []*testutil.FakePlugin {
+				return []*testutil.FakePlugin{{Name: "systemd_logs", Nodes: []string{"node1", "node2", "node3"}, Emit: 2, Submitter: srv}}
+			},
+			expectErr:       "1 of the expected results never arrived: systemd_logs/node3",
+			expectSummary:   RunSummary{Expected: 3, Completed: []string{"systemd_logs/node1", "systemd_logs/node2"}, TimedOut: []string{"systemd_logs/node3"}},
+			expectCleanedUp: []string{"systemd_logs"},
+		}, {
+			desc: "Enough nodes report to complete the run",
+			cfg:  plugin.AggregationConfig{TimeoutSeconds: 60, GracefulShutdownSeconds: 30, CompletionThreshold: 0.5},
+			plugins: func(srv *InProcessServer) []*testutil.FakePlugin {
+				return []*testutil.FakePlugin{{Name: "systemd_logs", Nodes: []string{"node1", "node2", "node3"}, Emit: 2, Submitter: srv}}
+			},
+			expectSummary: RunSummary{Expected: 3, Completed: []string{"systemd_logs/node1", "systemd_logs/node2"}, NotReported: []string{"systemd_logs/node3"}},
+		}, {
+			desc: "A failure ends the run in fail fast mode",
+			cfg:  plugin.AggregationConfig{TimeoutSeconds: 60, GracefulShutdownSeconds: 30, FailFast: true},
+			plugins: func(srv *InProcessServer) []*testutil.FakePlugin {
+				return []*testutil.FakePlugin{
+					{Name: "e2e", Behavior: testutil.Fail, Delay: 10 * time.Millisecond},
+					{Name: "systemd_logs", Nodes: []string{"node1"}, Behavior: testutil.Hang},
+				}
+			},
+			expectErr:       "aborted the run after result e2e failed",
+			expectSummary:   RunSummary{Expected: 2, Failed: map[string]string{"e2e": "the plugin failed"}, TimedOut: []string{"systemd_logs/node1"}},
+			expectCleanedUp: []string{"e2e", "systemd_logs"},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.desc, func(t *testing.T) {
+			dir, err := ioutil.TempDir("", "sonobuoy_run_test")
+			if err != nil {
+				t.Fatalf("Could not create temp directory: %v", err)
+			}
+			defer os.RemoveAll(dir)
+
+			srv := NewInProcessServer()
+			fakes := tc.plugins(srv)
+			plugins := make([]plugin.Interface, len(fakes))
+			for i, p := range fakes {
+				plugins[i] = p
+			}
+
+			summary, err := Run(context.Background(), &fakeClient{}, plugins, tc.cfg, "heptio-sonobuoy-test", dir, RunOptions{InProcess: srv})
+			switch {
+			case tc.expectErr == "" && err != nil:
+				t.Fatalf("unexpected error from run: %v", err)
+			case tc.expectErr != "" && (err == nil || !strings.Contains(err.Error(), tc.expectErr)):
+				t.Fatalf("expected an error containing %q, got %v", tc.expectErr, err)
+			}
+			if tc.expectSummary.Failed == nil {
+				tc.expectSummary.Failed = map[string]string{}
+			}
+			if !reflect.DeepEqual(*summary, tc.expectSummary) {
+				t.Errorf("expected summary %+v, got %+v", tc.expectSummary, *summary)
+			}
+
+			var cleanedUp []string
+			for _, p := range fakes {
+				if p.Cleanups() > 0 {
+					cleanedUp = append(cleanedUp, p.Name)
+				}
+				if p.RunError == nil && p.Runs() != 1 {
+					t.Errorf("expected %v to be run once, got %v", p.Name, p.Runs())
+				}
+			}
+			if !reflect.DeepEqual(cleanedUp, tc.expectCleanedUp) {
+				t.Errorf("expected %v to be cleaned up, got %v", tc.expectCleanedUp, cleanedUp)
+			}
+		})
+	}
+}
+
+func TestRun_runStamp(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sonobuoy_run_test")
+	if err != nil {
+		t.Fatalf("Could not create temp directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	srv := NewInProcessServer()
+	p := &testutil.FakePlugin{Name: "e2e", Submitter: srv}
+	client := &fakeClient{}
+	cfg := plugin.AggregationConfig{TimeoutSeconds: 60, GracefulShutdownSeconds: 30, ResultsTTLSeconds: 3600}
+	outdir := path.Join(dir, "abc123")
+	before := time.Now()
+	if _, err := Run(context.Background(), client, []plugin.Interface{p}, cfg, "heptio-sonobuoy-test", outdir, RunOptions{InProcess: srv}); err != nil {
+		t.Fatalf("unexpected error from run: %v", err)
+	}
+
+	stamp, err := ReadRunStamp(path.Join(outdir, metaDir, RunStampFile))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stamp.RunID != "abc123" {
+		t.Errorf("expected the run ID to default to the name of the results directory, got %q", stamp.RunID)
+	}
+	if stamp.Expires == nil || stamp.Expires.Before(before.Add(time.Hour)) || stamp.Expires.Sub(stamp.Created) != time.Hour {
+		t.Errorf("expected the results to expire an hour after the run started, got %+v", stamp)
+	}
+
+	manifest := readManifest(t, outdir)
+	if manifest.RunID != "abc123" || manifest.Expires == nil || !manifest.Expires.Equal(*stamp.Expires) {
+		t.Errorf("expected the manifest to record the run ID and expiry, got %q and %v", manifest.RunID, manifest.Expires)
+	}
+
+	annotated := false
+	for _, patch := range client.patches {
+		var decoded struct {
+			Metadata struct {
+				Annotations map[string]string `json:"annotations"`
+			} `json:"metadata"`
+		}
+		if err := json.Unmarshal(patch, &decoded); err != nil {
+			t.Fatalf("couldn't decode patch %s: %v", patch, err)
+		}
+		if decoded.Metadata.Annotations[RunIDAnnotationName] == "abc123" {
+			annotated = true
+		}
+	}
+	if !annotated {
+		t.Error("expected the aggregator pod to be annotated with the run ID")
+	}
+
+	// Resuming the run keeps the stamp it started with.
+	srv = NewInProcessServer()
+	p = &testutil.FakePlugin{Name: "e2e", Submitter: srv}
+	opts := RunOptions{InProcess: srv, Resume: true, RunID: "abc123"}
+	if _, err := Run(context.Background(), &fakeClient{}, []plugin.Interface{p}, cfg, "heptio-sonobuoy-test", outdir, opts); err != nil {
+		t.Fatalf("unexpected error from resumed run: %v", err)
+	}
+	resumed, err := ReadRunStamp(path.Join(outdir, metaDir, RunStampFile))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(resumed, stamp) {
+		t.Errorf("expected the resumed run to keep stamp %+v, got %+v", stamp, resumed)
+	}
+}
@@ -0,0 +1,250 @@
+/*
+Copyright 2018 Heptio Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package aggregation
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	// s3DateFormat is the format of the x-amz-date header.
+	s3DateFormat = "20060102T150405Z"
+	// s3Algorithm is the AWS Signature Version 4 signing algorithm.
+	s3Algorithm = "AWS4-HMAC-SHA256"
+)
+
+// S3Credentials are the AWS credentials requests are signed with.
+type S3Credentials struct {
+	AccessKeyID     string
+	SecretAccessKey string
+	// SessionToken is only set for temporary credentials.
+	SessionToken string
+}
+
+// S3Sink uploads results as objects in an S3 bucket, under Prefix. Any S3
+// compatible object store (such as Google Cloud Storage with HMAC keys, or
+// MinIO) can be used by setting Endpoint.
+type S3Sink struct {
+	Bucket string
+	Region string
+	Prefix string
+	// Endpoint is the URL of the service. Defaults to the AWS endpoint for
+	// Region.
+	Endpoint    string
+	Credentials S3Credentials
+	Client      *http.Client
+
+	mu sync.Mutex
+	// failed counts the writes which failed, for Finalize.
+	failed int
+	// now is replaced in tests.
+	now func() time.Time
+}
+
+// NewS3SinkFromEnv returns an S3Sink using the credentials in the standard
+// AWS environment variables.
+func NewS3SinkFromEnv(bucket, region, prefix, endpoint string) (*S3Sink, error) {
+	creds := S3Credentials{
+		AccessKeyID:     os.Getenv("AWS_ACCESS_KEY_ID"),
+		SecretAccessKey: os.Getenv("AWS_SECRET_ACCESS_KEY"),
+		SessionToken:    os.Getenv("AWS_SESSION_TOKEN"),
+	}
+	if creds.AccessKeyID == "" || creds.SecretAccessKey == "" {
+		return nil, errors.New("the S3 result sink needs AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY to be set")
+	}
+	return &S3Sink{
+		Bucket:      bucket,
+		Region:      region,
+		Prefix:      prefix,
+		Endpoint:    endpoint,
+		Credentials: creds,
+	}, nil
+}
+
+// Write implements ResultSink, uploading the body as a single object.
+// Bodies which can't be seeked are buffered in memory, since the size and
+// checksum of an object must be sent before it is.
+func (s *S3Sink) Write(name string, body io.Reader) error {
+	err := s.put(path.Join(s.Prefix, name), body)
+	if err != nil {
+		s.mu.Lock()
+		s.failed++
+		s.mu.Unlock()
+	}
+	return err
+}
+
+// Finalize implements ResultSink, returning an error if any write failed.
+func (s *S3Sink) Finalize() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.failed > 0 {
+		return errors.Errorf("%v files couldn't be uploaded to bucket %v", s.failed, s.Bucket)
+	}
+	return nil
+}
+
+func (s *S3Sink) put(key string, body io.Reader) error {
+	seeker, ok := body.(io.ReadSeeker)
+	if !ok {
+		blob, err := ioutil.ReadAll(body)
+		if err != nil {
+			return errors.Wrapf(err, "couldn't read %v", key)
+		}
+		seeker = bytes.NewReader(blob)
+	}
+
+	hash := sha256.New()
+	size, err := io.Copy(hash, seeker)
+	if err != nil {
+		return errors.Wrapf(err, "couldn't read %v", key)
+	}
+	if _, err := seeker.Seek(-size, io.SeekCurrent); err != nil {
+		return errors.Wrapf(err, "couldn't read %v", key)
+	}
+
+	endpoint := s.Endpoint
+	if endpoint == "" {
+		endpoint = fmt.Sprintf("https://s3.%v.amazonaws.com", s.Region)
+	}
+	u, err := url.Parse(endpoint)
+	if err != nil {
+		return errors.Wrapf(err, "invalid S3 endpoint %q", endpoint)
+	}
+	// Path-style URLs work for any bucket name and S3 compatible service.
+	u.Path = path.Join("/", u.Path, s.Bucket, key)
+	u.RawPath = s3EscapePath(u.Path)
+
+	req, err := http.NewRequest(http.MethodPut, u.String(), ioutil.NopCloser(seeker))
+	if err != nil {
+		return errors.Wrapf(err, "couldn't create request for %v", key)
+	}
+	req.ContentLength = size
+	req.Header.Set("content-type", "application/octet-stream")
+	now := time.Now
+	if s.now != nil {
+		now = s.now
+	}
+	signS3Request(req, hex.EncodeToString(hash.Sum(nil)), s.Credentials, s.Region, now())
+
+	client := s.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return errors.Wrapf(err, "couldn't upload %v", key)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		msg, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 1024))
+		return errors.Errorf("couldn't upload %v: got status %v: %s", key, resp.Status, bytes.TrimSpace(msg))
+	}
+	return nil
+}
+
+// signS3Request signs the request with AWS Signature Version 4, covering its
+// host and all of its headers. The request must not have a query.
+func signS3Request(req *http.Request, payloadHash string, creds S3Credentials, region string, now time.Time) {
+	amzDate := now.UTC().Format(s3DateFormat)
+	req.Header.Set("x-amz-date", amzDate)
+	req.Header.Set("x-amz-content-sha256", payloadHash)
+	if creds.SessionToken != "" {
+		req.Header.Set("x-amz-security-token", creds.SessionToken)
+	}
+
+	headers := map[string]string{"host": req.URL.Host}
+	for name, values := range req.Header {
+		headers[strings.ToLower(name)] = strings.TrimSpace(strings.Join(values, ","))
+	}
+	names := make([]string, 0, len(headers))
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var canonicalHeaders strings.Builder
+	for _, name := range names {
+		fmt.Fprintf(&canonicalHeaders, "%v:%v\n", name, headers[name])
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		req.URL.EscapedPath(),
+		"",
+		canonicalHeaders.String(),
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+
+	date := amzDate[:8]
+	scope := strings.Join([]string{date, region, "s3", "aws4_request"}, "/")
+	stringToSign := strings.Join([]string{s3Algorithm, amzDate, scope, sha256Hex(canonicalRequest)}, "\n")
+
+	key := []byte("AWS4" + creds.SecretAccessKey)
+	for _, part := range []string{date, region, "s3", "aws4_request"} {
+		key = hmacSHA256(key, part)
+	}
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+
+	req.Header.Set("authorization", fmt.Sprintf("%v Credential=%v/%v, SignedHeaders=%v, Signature=%v",
+		s3Algorithm, creds.AccessKeyID, scope, signedHeaders, signature))
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
+
+func sha256Hex(data string) string {
+	sum := sha256.Sum256([]byte(data))
+	return hex.EncodeToString(sum[:])
+}
+
+// s3EscapePath escapes everything in the path but unreserved characters and
+// slashes, as Signature Version 4 requires.
+func s3EscapePath(p string) string {
+	var b strings.Builder
+	for i := 0; i < len(p); i++ {
+		c := p[i]
+		switch {
+		case 'a' <= c && c <= 'z', 'A' <= c && c <= 'Z', '0' <= c && c <= '9',
+			c == '-', c == '_', c == '.', c == '~', c == '/':
+			b.WriteByte(c)
+		default:
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
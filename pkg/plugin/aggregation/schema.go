@@ -0,0 +1,575 @@
+/*
+Copyright 2018 Heptio Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package aggregation
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"reflect"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/heptio/sonobuoy/pkg/plugin"
+	"github.com/pkg/errors"
+)
+
+// maxSchemaViolations is how many violations are listed in the error of a
+// result which doesn't match its schema.
+const maxSchemaViolations = 20
+
+// annotationKeywords are schema keywords which don't affect validation.
+var annotationKeywords = map[string]bool{
+	"$schema":     true,
+	"$id":         true,
+	"$comment":    true,
+	"title":       true,
+	"description": true,
+	"default":     true,
+	"examples":    true,
+	"format":      true,
+	"readOnly":    true,
+	"writeOnly":   true,
+	"definitions": true,
+	"$defs":       true,
+}
+
+// ResultSchema is a JSON Schema which a plugin's results must match. It
+// supports the keywords of draft 7 most used to describe documents:
+// type, enum, const, properties, required, additionalProperties, items,
+// minItems, maxItems, minimum, maximum, exclusiveMinimum, exclusiveMaximum,
+// minLength, maxLength, pattern, allOf, anyOf, oneOf, not and $ref to
+// definitions in the same schema. Annotations such as title and format are
+// ignored, and schemas using any other keyword are rejected rather than
+// being partly enforced.
+type ResultSchema struct {
+	root *schemaNode
+}
+
+// schemaNode is a compiled schema or subschema.
+type schemaNode struct {
+	// allow, if set, is the value of a boolean schema.
+	allow *bool
+	ref   *schemaNode
+
+	types    []string
+	enum     []interface{}
+	constant interface{}
+	hasConst bool
+
+	properties map[string]*schemaNode
+	required   []string
+	additional *schemaNode
+	items      *schemaNode
+	minItems   *int
+	maxItems   *int
+
+	minimum          *float64
+	maximum          *float64
+	exclusiveMinimum *float64
+	exclusiveMaximum *float64
+
+	minLength *int
+	maxLength *int
+	pattern   *regexp.Regexp
+
+	allOf []*schemaNode
+	anyOf []*schemaNode
+	oneOf []*schemaNode
+	not   *schemaNode
+}
+
+// ParseResultSchema compiles a JSON Schema, returning an error if it isn't
+// valid or uses keywords which aren't supported.
+func ParseResultSchema(blob []byte) (*ResultSchema, error) {
+	var doc interface{}
+	if err := json.Unmarshal(blob, &doc); err != nil {
+		return nil, errors.Wrap(err, "couldn't decode schema")
+	}
+	c := &schemaCompiler{doc: doc, refs: map[string]*schemaNode{}}
+	root, err := c.compile(doc, "#")
+	if err != nil {
+		return nil, err
+	}
+	return &ResultSchema{root: root}, nil
+}
+
+// Validate returns the ways in which the JSON document doesn't match the
+// schema, each prefixed with the JSON pointer of the value at fault, or
+// nil if it matches.
+func (s *ResultSchema) Validate(blob []byte) []string {
+	var doc interface{}
+	if err := json.Unmarshal(blob, &doc); err != nil {
+		return []string{fmt.Sprintf("result isn't valid JSON: %v", err)}
+	}
+	return s.root.validate(doc, "")
+}
+
+// schemaCompiler compiles the schema doc, resolving references within it.
+type schemaCompiler struct {
+	doc  interface{}
+	refs map[string]*schemaNode
+}
+
+func (c *schemaCompiler) compile(v interface{}, at string) (*schemaNode, error) {
+	if b, ok := v.(bool); ok {
+		return &schemaNode{allow: &b}, nil
+	}
+	m, ok := v.(map[string]interface{})
+	if !ok {
+		return nil, errors.Errorf("%v: a schema must be an object or a boolean", at)
+	}
+
+	n := &schemaNode{}
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		if err := c.compileKeyword(n, k, m[k], at+"/"+k); err != nil {
+			return nil, err
+		}
+	}
+	return n, nil
+}
+
+func (c *schemaCompiler) compileKeyword(n *schemaNode, k string, v interface{}, at string) error {
+	var err error
+	switch k {
+	case "$ref":
+		ref, ok := v.(string)
+		if !ok {
+			return errors.Errorf("%v: must be a string", at)
+		}
+		n.ref, err = c.resolve(ref, at)
+	case "type":
+		n.types, err = schemaTypes(v, at)
+	case "enum":
+		values, ok := v.([]interface{})
+		if !ok || len(values) == 0 {
+			return errors.Errorf("%v: must be a non-empty array", at)
+		}
+		n.enum = values
+	case "const":
+		n.constant, n.hasConst = v, true
+	case "properties":
+		props, ok := v.(map[string]interface{})
+		if !ok {
+			return errors.Errorf("%v: must be an object", at)
+		}
+		n.properties = map[string]*schemaNode{}
+		for name, prop := range props {
+			if n.properties[name], err = c.compile(prop, at+"/"+escapePointer(name)); err != nil {
+				return err
+			}
+		}
+	case "required":
+		names, ok := v.([]interface{})
+		if !ok {
+			return errors.Errorf("%v: must be an array of strings", at)
+		}
+		for _, name := range names {
+			s, ok := name.(string)
+			if !ok {
+				return errors.Errorf("%v: must be an array of strings", at)
+			}
+			n.required = append(n.required, s)
+		}
+	case "additionalProperties":
+		n.additional, err = c.compile(v, at)
+	case "items":
+		if _, ok := v.([]interface{}); ok {
+			return errors.Errorf("%v: arrays of item schemas aren't supported", at)
+		}
+		n.items, err = c.compile(v, at)
+	case "minItems":
+		n.minItems, err = schemaCount(v, at)
+	case "maxItems":
+		n.maxItems, err = schemaCount(v, at)
+	case "minLength":
+		n.minLength, err = schemaCount(v, at)
+	case "maxLength":
+		n.maxLength, err = schemaCount(v, at)
+	case "minimum":
+		n.minimum, err = schemaNumber(v, at)
+	case "maximum":
+		n.maximum, err = schemaNumber(v, at)
+	case "exclusiveMinimum":
+		n.exclusiveMinimum, err = schemaNumber(v, at)
+	case "exclusiveMaximum":
+		n.exclusiveMaximum, err = schemaNumber(v, at)
+	case "pattern":
+		s, ok := v.(string)
+		if !ok {
+			return errors.Errorf("%v: must be a string", at)
+		}
+		if n.pattern, err = regexp.Compile(s); err != nil {
+			return errors.Wrapf(err, "%v: invalid pattern", at)
+		}
+	case "allOf":
+		n.allOf, err = c.compileAll(v, at)
+	case "anyOf":
+		n.anyOf, err = c.compileAll(v, at)
+	case "oneOf":
+		n.oneOf, err = c.compileAll(v, at)
+	case "not":
+		n.not, err = c.compile(v, at)
+	default:
+		if !annotationKeywords[k] {
+			return errors.Errorf("%v: unsupported keyword %q", at, k)
+		}
+	}
+	return err
+}
+
+func (c *schemaCompiler) compileAll(v interface{}, at string) ([]*schemaNode, error) {
+	schemas, ok := v.([]interface{})
+	if !ok || len(schemas) == 0 {
+		return nil, errors.Errorf("%v: must be a non-empty array of schemas", at)
+	}
+	nodes := make([]*schemaNode, len(schemas))
+	for i, s := range schemas {
+		var err error
+		if nodes[i], err = c.compile(s, at+"/"+strconv.Itoa(i)); err != nil {
+			return nil, err
+		}
+	}
+	return nodes, nil
+}
+
+// resolve compiles the schema a reference within the document points to.
+// Each reference is only compiled once, so schemas can refer to themselves.
+func (c *schemaCompiler) resolve(ref, at string) (*schemaNode, error) {
+	if n, ok := c.refs[ref]; ok {
+		return n, nil
+	}
+	if ref != "#" && !strings.HasPrefix(ref, "#/") {
+		return nil, errors.Errorf("%v: only references within the schema are supported, got %q", at, ref)
+	}
+
+	v := c.doc
+	if ref != "#" {
+		for _, token := range strings.Split(ref[2:], "/") {
+			token = strings.Replace(strings.Replace(token, "~1", "/", -1), "~0", "~", -1)
+			m, ok := v.(map[string]interface{})
+			if !ok {
+				return nil, errors.Errorf("%v: reference %q not found", at, ref)
+			}
+			if v, ok = m[token]; !ok {
+				return nil, errors.Errorf("%v: reference %q not found", at, ref)
+			}
+		}
+	}
+
+	// The node is cached before it's compiled, so that references to it
+	// from within itself find it.
+	n := &schemaNode{}
+	c.refs[ref] = n
+	compiled, err := c.compile(v, ref)
+	if err != nil {
+		return nil, err
+	}
+	*n = *compiled
+	return n, nil
+}
+
+func schemaTypes(v interface{}, at string) ([]string, error) {
+	var types []interface{}
+	switch t := v.(type) {
+	case string:
+		types = []interface{}{t}
+	case []interface{}:
+		types = t
+	default:
+		return nil, errors.Errorf("%v: must be a string or an array of strings", at)
+	}
+
+	names := make([]string, len(types))
+	for i, t := range types {
+		name, _ := t.(string)
+		switch name {
+		case "null", "boolean", "object", "array", "number", "integer", "string":
+			names[i] = name
+		default:
+			return nil, errors.Errorf("%v: unknown type %v", at, t)
+		}
+	}
+	return names, nil
+}
+
+func schemaCount(v interface{}, at string) (*int, error) {
+	f, ok := v.(float64)
+	if !ok || f < 0 || f != math.Trunc(f) {
+		return nil, errors.Errorf("%v: must be a non-negative integer", at)
+	}
+	i := int(f)
+	return &i, nil
+}
+
+func schemaNumber(v interface{}, at string) (*float64, error) {
+	f, ok := v.(float64)
+	if !ok {
+		return nil, errors.Errorf("%v: must be a number", at)
+	}
+	return &f, nil
+}
+
+// escapePointer escapes a token of a JSON pointer.
+func escapePointer(token string) string {
+	return strings.Replace(strings.Replace(token, "~", "~0", -1), "/", "~1", -1)
+}
+
+// jsonType returns the JSON Schema type of a decoded JSON value.
+func jsonType(v interface{}) string {
+	switch t := v.(type) {
+	case nil:
+		return "null"
+	case bool:
+		return "boolean"
+	case map[string]interface{}:
+		return "object"
+	case []interface{}:
+		return "array"
+	case float64:
+		if t == math.Trunc(t) {
+			return "integer"
+		}
+		return "number"
+	default:
+		return "string"
+	}
+}
+
+func (n *schemaNode) validate(v interface{}, at string) []string {
+	fail := func(format string, args ...interface{}) []string {
+		where := at
+		if where == "" {
+			where = "/"
+		}
+		return []string{where + ": " + fmt.Sprintf(format, args...)}
+	}
+
+	if n.allow != nil {
+		if !*n.allow {
+			return fail("no value is allowed")
+		}
+		return nil
+	}
+
+	var violations []string
+	if n.ref != nil {
+		violations = append(violations, n.ref.validate(v, at)...)
+	}
+
+	if len(n.types) > 0 {
+		actual := jsonType(v)
+		matched := false
+		for _, t := range n.types {
+			if t == actual || (t == "number" && actual == "integer") {
+				matched = true
+			}
+		}
+		if !matched {
+			// The value's other keywords are meaningless if it's the
+			// wrong type.
+			return append(violations, fail("expected %v, got %v", strings.Join(n.types, " or "), actual)...)
+		}
+	}
+	if n.enum != nil {
+		matched := false
+		for _, e := range n.enum {
+			if reflect.DeepEqual(e, v) {
+				matched = true
+			}
+		}
+		if !matched {
+			violations = append(violations, fail("must be one of %v", jsonString(n.enum))...)
+		}
+	}
+	if n.hasConst && !reflect.DeepEqual(n.constant, v) {
+		violations = append(violations, fail("must be %v", jsonString(n.constant))...)
+	}
+
+	switch t := v.(type) {
+	case map[string]interface{}:
+		for _, name := range n.required {
+			if _, ok := t[name]; !ok {
+				violations = append(violations, fail("missing required property %q", name)...)
+			}
+		}
+		names := make([]string, 0, len(t))
+		for name := range t {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			propAt := at + "/" + escapePointer(name)
+			if prop, ok := n.properties[name]; ok {
+				violations = append(violations, prop.validate(t[name], propAt)...)
+			} else if n.additional != nil {
+				if n.additional.allow != nil && !*n.additional.allow {
+					violations = append(violations, fail("unexpected property %q", name)...)
+				} else {
+					violations = append(violations, n.additional.validate(t[name], propAt)...)
+				}
+			}
+		}
+	case []interface{}:
+		if n.minItems != nil && len(t) < *n.minItems {
+			violations = append(violations, fail("must have at least %v items, got %v", *n.minItems, len(t))...)
+		}
+		if n.maxItems != nil && len(t) > *n.maxItems {
+			violations = append(violations, fail("must have at most %v items, got %v", *n.maxItems, len(t))...)
+		}
+		if n.items != nil {
+			for i, item := range t {
+				violations = append(violations, n.items.validate(item, at+"/"+strconv.Itoa(i))...)
+			}
+		}
+	case float64:
+		if n.minimum != nil && t < *n.minimum {
+			violations = append(violations, fail("must be at least %v, got %v", *n.minimum, t)...)
+		}
+		if n.maximum != nil && t > *n.maximum {
+			violations = append(violations, fail("must be at most %v, got %v", *n.maximum, t)...)
+		}
+		if n.exclusiveMinimum != nil && t <= *n.exclusiveMinimum {
+			violations = append(violations, fail("must be greater than %v, got %v", *n.exclusiveMinimum, t)...)
+		}
+		if n.exclusiveMaximum != nil && t >= *n.exclusiveMaximum {
+			violations = append(violations, fail("must be less than %v, got %v", *n.exclusiveMaximum, t)...)
+		}
+	case string:
+		length := utf8.RuneCountInString(t)
+		if n.minLength != nil && length < *n.minLength {
+			violations = append(violations, fail("must be at least %v characters long, got %v", *n.minLength, length)...)
+		}
+		if n.maxLength != nil && length > *n.maxLength {
+			violations = append(violations, fail("must be at most %v characters long, got %v", *n.maxLength, length)...)
+		}
+		if n.pattern != nil && !n.pattern.MatchString(t) {
+			violations = append(violations, fail("must match the pattern %q", n.pattern.String())...)
+		}
+	}
+
+	for _, s := range n.allOf {
+		violations = append(violations, s.validate(v, at)...)
+	}
+	if n.anyOf != nil {
+		matched := false
+		for _, s := range n.anyOf {
+			if len(s.validate(v, at)) == 0 {
+				matched = true
+				break
+			}
+		}
+		if !matched {
+			violations = append(violations, fail("doesn't match any of the schemas in anyOf")...)
+		}
+	}
+	if n.oneOf != nil {
+		matched := 0
+		for _, s := range n.oneOf {
+			if len(s.validate(v, at)) == 0 {
+				matched++
+			}
+		}
+		if matched != 1 {
+			violations = append(violations, fail("must match exactly one of the schemas in oneOf, matched %v", matched)...)
+		}
+	}
+	if n.not != nil && len(n.not.validate(v, at)) == 0 {
+		violations = append(violations, fail("mustn't match the schema in not")...)
+	}
+	return violations
+}
+
+// jsonString returns v encoded as JSON, for error messages.
+func jsonString(v interface{}) string {
+	blob, err := json.Marshal(v)
+	if err != nil {
+		return fmt.Sprint(v)
+	}
+	return string(blob)
+}
+
+// schemaViolationsError summarises the ways a result doesn't match its
+// schema, listing up to maxSchemaViolations of them.
+func schemaViolationsError(violations []string) string {
+	listed := violations
+	if len(listed) > maxSchemaViolations {
+		listed = listed[:maxSchemaViolations]
+	}
+	msg := "result doesn't match its schema: " + strings.Join(listed, "; ")
+	if more := len(violations) - len(listed); more > 0 {
+		msg += fmt.Sprintf(" (and %v more)", more)
+	}
+	return msg
+}
+
+// validatable returns true if the result is uploaded whole, rather than in
+// parts, as a stream or as an archive, so it can be validated.
+func validatable(result *plugin.Result) bool {
+	return !result.Partial && !result.Artifact && !result.Done && !result.Streamed && result.MimeType != gzipMimeType
+}
+
+// checkResultSchema returns a rejectedResultError listing the violations if
+// the body of the result doesn't match the schema of its result type. It
+// must be called once the result has been received in full.
+func (a *Aggregator) checkResultSchema(result *plugin.Result) error {
+	body, ok := result.Body.(*resultBody)
+	if !ok || body.copy == nil || a.Schemas[result.ResultType] == nil {
+		return nil
+	}
+	violations := a.Schemas[result.ResultType].Validate(body.copy.Bytes())
+	// The copy is kept for the reducer, if the result type has one, to
+	// merge once the result is recorded.
+	if a.Reducers[result.ResultType] == nil {
+		body.copy = nil
+	}
+	if len(violations) == 0 {
+		return nil
+	}
+	return &rejectedResultError{
+		status:     http.StatusUnprocessableEntity,
+		msg:        schemaViolationsError(violations),
+		violations: violations,
+	}
+}
+
+// resultSchemas compiles the schemas the plugins declare for their results,
+// by result type.
+func resultSchemas(plugins []plugin.Interface) (map[string]*ResultSchema, error) {
+	schemas := map[string]*ResultSchema{}
+	for _, p := range plugins {
+		v, ok := p.(plugin.Validated)
+		if !ok || len(v.GetResultSchema()) == 0 {
+			continue
+		}
+		schema, err := ParseResultSchema(v.GetResultSchema())
+		if err != nil {
+			return nil, errors.Wrapf(err, "invalid result schema for plugin %v", p.GetName())
+		}
+		schemas[p.GetResultType()] = schema
+	}
+	return schemas, nil
+}
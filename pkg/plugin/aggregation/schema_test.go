@@ -0,0 +1,258 @@
+/*
+Copyright 2018 Heptio Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package aggregation
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"path"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/heptio/sonobuoy/pkg/backplane/ca/authtest"
+	"github.com/heptio/sonobuoy/pkg/plugin"
+	"github.com/heptio/sonobuoy/pkg/plugin/driver/job"
+)
+
+const testResultSchema = `{
+	"$schema": "http://json-schema.org/draft-07/schema#",
+	"title": "Check results",
+	"type": "object",
+	"required": ["version", "checks"],
+	"additionalProperties": false,
+	"properties": {
+		"version": {"const": 1},
+		"checks": {"type": "array", "minItems": 1, "items": {"$ref": "#/definitions/check"}}
+	},
+	"definitions": {
+		"check": {
+			"type": "object",
+			"required": ["name", "status"],
+			"properties": {
+				"name": {"type": "string", "pattern": "^[a-z-]+$", "maxLength": 20},
+				"status": {"enum": ["passed", "failed", "skipped"]},
+				"durationSeconds": {"type": "number", "minimum": 0},
+				"retries": {"type": "integer", "exclusiveMaximum": 5}
+			}
+		}
+	}
+}`
+
+func TestResultSchema_validate(t *testing.T) {
+	schema, err := ParseResultSchema([]byte(testResultSchema))
+	if err != nil {
+		t.Fatalf("unexpected error parsing schema: %v", err)
+	}
+
+	testCases := []struct {
+		desc string
+		doc  string
+		want []string
+	}{
+		{
+			desc: "matching",
+			doc:  `{"version":1,"checks":[{"name":"dns","status":"passed","durationSeconds":1.5,"retries":0}]}`,
+		},
+		{
+			desc: "wrong root type",
+			doc:  `[]`,
+			want: []string{"/: expected object, got array"},
+		},
+		{
+			desc: "missing and unexpected properties",
+			doc:  `{"checks":[{"name":"dns","status":"passed"}],"extra":true}`,
+			want: []string{`/: missing required property "version"`, `/: unexpected property "extra"`},
+		},
+		{
+			desc: "wrong values",
+			doc:  `{"version":2,"checks":[{"name":"DNS","status":"unknown","durationSeconds":-1,"retries":1.5},{"name":"node-checks-which-are-long","status":"failed","retries":5}]}`,
+			want: []string{
+				`/checks/0/durationSeconds: must be at least 0, got -1`,
+				`/checks/0/name: must match the pattern "^[a-z-]+$"`,
+				`/checks/0/retries: expected integer, got number`,
+				`/checks/0/status: must be one of ["passed","failed","skipped"]`,
+				`/checks/1/name: must be at most 20 characters long, got 26`,
+				`/checks/1/retries: must be less than 5, got 5`,
+				`/version: must be 1`,
+			},
+		},
+		{
+			desc: "too few items",
+			doc:  `{"version":1,"checks":[]}`,
+			want: []string{"/checks: must have at least 1 items, got 0"},
+		},
+		{
+			desc: "not JSON",
+			doc:  `version: 1`,
+			want: []string{"result isn't valid JSON: invalid character 'v' looking for beginning of value"},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.desc, func(t *testing.T) {
+			if got := schema.Validate([]byte(tc.doc)); !reflect.DeepEqual(got, tc.want) {
+				t.Errorf("expected violations %q, got %q", tc.want, got)
+			}
+		})
+	}
+}
+
+func TestResultSchema_combinators(t *testing.T) {
+	schema, err := ParseResultSchema([]byte(`{
+		"definitions": {"node": {"type": "object", "properties": {"children": {"type": "array", "items": {"$ref": "#/definitions/node"}}}}},
+		"allOf": [{"$ref": "#/definitions/node"}],
+		"anyOf": [{"required": ["name"]}, {"required": ["id"]}],
+		"oneOf": [{"required": ["name"]}, {"required": ["id"]}],
+		"not": {"required": ["deprecated"]}
+	}`))
+	if err != nil {
+		t.Fatalf("unexpected error parsing schema: %v", err)
+	}
+
+	testCases := []struct {
+		doc  string
+		want []string
+	}{
+		{doc: `{"name":"a","children":[{"children":[]}]}`},
+		{doc: `{"id":1,"children":[{"children":[1]}]}`, want: []string{"/children/0/children/0: expected object, got integer"}},
+		{doc: `{}`, want: []string{"/: doesn't match any of the schemas in anyOf", "/: must match exactly one of the schemas in oneOf, matched 0"}},
+		{doc: `{"name":"a","id":1}`, want: []string{"/: must match exactly one of the schemas in oneOf, matched 2"}},
+		{doc: `{"name":"a","deprecated":true}`, want: []string{"/: mustn't match the schema in not"}},
+	}
+	for _, tc := range testCases {
+		if got := schema.Validate([]byte(tc.doc)); !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("expected %v to have violations %q, got %q", tc.doc, tc.want, got)
+		}
+	}
+}
+
+func TestParseResultSchema_invalid(t *testing.T) {
+	testCases := []struct {
+		schema  string
+		wantErr string
+	}{
+		{schema: `"object"`, wantErr: "#: a schema must be an object or a boolean"},
+		{schema: `{"type":"map"}`, wantErr: "#/type: unknown type map"},
+		{schema: `{"properties":{"a":{"uniqueItems":true}}}`, wantErr: `#/properties/a/uniqueItems: unsupported keyword "uniqueItems"`},
+		{schema: `{"items":[{"type":"string"}]}`, wantErr: "#/items: arrays of item schemas aren't supported"},
+		{schema: `{"$ref":"#/definitions/missing"}`, wantErr: `#/$ref: reference "#/definitions/missing" not found`},
+		{schema: `{"$ref":"https://example.com/schema.json"}`, wantErr: "#/$ref: only references within the schema are supported"},
+		{schema: `{"pattern":"("}`, wantErr: "#/pattern: invalid pattern"},
+		{schema: `{"minLength":-1}`, wantErr: "#/minLength: must be a non-negative integer"},
+	}
+	for _, tc := range testCases {
+		_, err := ParseResultSchema([]byte(tc.schema))
+		if err == nil || !strings.Contains(err.Error(), tc.wantErr) {
+			t.Errorf("expected schema %v to fail with %q, got %v", tc.schema, tc.wantErr, err)
+		}
+	}
+}
+
+func TestSchemaViolationsError(t *testing.T) {
+	violations := make([]string, maxSchemaViolations+2)
+	for i := range violations {
+		violations[i] = "/: bad"
+	}
+	msg := schemaViolationsError(violations)
+	if !strings.HasPrefix(msg, "result doesn't match its schema: /: bad; ") || !strings.HasSuffix(msg, "(and 2 more)") {
+		t.Errorf("expected the violations to be summarised, got %q", msg)
+	}
+}
+
+func TestAggregation_schema(t *testing.T) {
+	schema, err := ParseResultSchema([]byte(testResultSchema))
+	if err != nil {
+		t.Fatalf("unexpected error parsing schema: %v", err)
+	}
+	expected := []plugin.ExpectedResult{
+		{NodeName: "node1", ResultType: "checks"},
+		{NodeName: "node2", ResultType: "checks"},
+		{NodeName: "node1", ResultType: "systemd_logs"},
+	}
+
+	withAggregator(t, expected, func(agg *Aggregator, srv *authtest.Server) {
+		agg.Schemas = map[string]*ResultSchema{"checks": schema}
+		put := func(node, resultType, body string) *http.Response {
+			URL, err := NodeResultURL(srv.URL, node, resultType)
+			if err != nil {
+				t.Fatalf("couldn't get test server URL: %v", err)
+			}
+			return doRequest(t, srv.Client(), "PUT", URL, []byte(body))
+		}
+
+		if resp := put("node1", "checks", `{"version":1,"checks":[{"name":"dns","status":"passed"}]}`); resp.StatusCode != http.StatusOK {
+			t.Errorf("expected a matching result to be accepted, got a %v", resp.StatusCode)
+		}
+		if resp := put("node2", "checks", `{"version":1,"checks":[{"name":"dns"}]}`); resp.StatusCode != http.StatusUnprocessableEntity {
+			t.Errorf("expected a result which doesn't match its schema to get a 422, got a %v", resp.StatusCode)
+		}
+		// Results without a schema are passed through as they are
+		if resp := put("node1", "systemd_logs", "not JSON"); resp.StatusCode != http.StatusOK {
+			t.Errorf("expected a result without a schema to be accepted, got a %v", resp.StatusCode)
+		}
+
+		if result := agg.Results["checks/node1"]; result == nil || !result.IsSuccess() {
+			t.Errorf("expected the matching result to succeed, got %+v", result)
+		}
+		if result := agg.Results["systemd_logs/node1"]; result == nil || !result.IsSuccess() {
+			t.Errorf("expected the result without a schema to succeed, got %+v", result)
+		}
+		result := agg.Results["checks/node2"]
+		if result == nil || result.IsSuccess() {
+			t.Fatalf("expected the result which doesn't match its schema to fail, got %+v", result)
+		}
+		blob, err := ioutil.ReadFile(path.Join(agg.OutputDir, result.Path()))
+		if err != nil {
+			t.Fatalf("couldn't read error result: %v", err)
+		}
+		var recorded struct {
+			Error      string   `json:"error"`
+			Violations []string `json:"violations"`
+		}
+		if err := json.Unmarshal(blob, &recorded); err != nil {
+			t.Fatalf("couldn't decode error result %s: %v", blob, err)
+		}
+		want := []string{`/checks/0: missing required property "status"`}
+		if !reflect.DeepEqual(recorded.Violations, want) || !strings.Contains(recorded.Error, want[0]) {
+			t.Errorf("expected the violations %q to be recorded, got %s", want, blob)
+		}
+	})
+}
+
+func TestResultSchemas(t *testing.T) {
+	withSchema := func(name, schema string) plugin.Interface {
+		return job.NewPlugin(plugin.Definition{Name: name, ResultType: name, ResultSchema: []byte(schema)}, "heptio-sonobuoy", "", "", "", nil)
+	}
+	plugins := []plugin.Interface{
+		withSchema("checks", `{"type":"object"}`),
+		withSchema("e2e", ""),
+		&fakePlugin{name: "other"},
+	}
+	schemas, err := resultSchemas(plugins)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(schemas) != 1 || schemas["checks"] == nil {
+		t.Errorf("expected only the checks plugin to have a schema, got %v", schemas)
+	}
+
+	if _, err := resultSchemas([]plugin.Interface{withSchema("bad", `{"type":"map"}`)}); err == nil || !strings.Contains(err.Error(), "invalid result schema for plugin bad") {
+		t.Errorf("expected an invalid schema to be rejected, got %v", err)
+	}
+}
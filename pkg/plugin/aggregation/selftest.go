@@ -0,0 +1,142 @@
+/*
+Copyright 2018 Heptio Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package aggregation
+
+import (
+	"bytes"
+	"crypto/tls"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/heptio/sonobuoy/pkg/backplane/ca"
+	"github.com/heptio/sonobuoy/pkg/plugin"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// selfTestPlugin is the name and result type of the plugin the self
+	// test submits a result as.
+	selfTestPlugin = "sonobuoy-selftest"
+	// selfTestTimeout is how long the self test's request may take.
+	selfTestTimeout = 30 * time.Second
+)
+
+// SelfTest checks that the aggregator's crypto works in the current
+// environment without launching any plugins, since some crypto libraries
+// (e.g. FIPS builds) can't use the CAs it generates. It makes a CA with the
+// config's key type, serves an aggregator on the loopback interface with the
+// config's TLS settings, and POSTs a dummy result to it with a client
+// certificate issued by the CA, as a worker would. It returns an error
+// saying which step failed, or nil if the result was recorded.
+func SelfTest(cfg plugin.AggregationConfig, log logrus.FieldLogger) error {
+	auth, err := ca.NewAuthorityWithKeyType(ca.KeyType(cfg.KeyType), ca.DefaultValidity, ca.DefaultValidity)
+	if err != nil {
+		return errors.Wrap(err, "couldn't make certificate authority")
+	}
+	log.WithField("keytype", cfg.KeyType).Info("Made certificate authority")
+
+	outdir, err := ioutil.TempDir("", selfTestPlugin)
+	if err != nil {
+		return errors.Wrap(err, "couldn't make directory for the self test's result")
+	}
+	defer os.RemoveAll(outdir)
+
+	aggr := NewAggregator(outdir, []plugin.ExpectedResult{{ResultType: selfTestPlugin}})
+	aggr.ClientNames = map[string]string{selfTestPlugin: selfTestPlugin}
+	aggr.Log = log
+	handler := NewHandlerWithCerts(aggr.HandleHTTPResult, auth.ClientKeyPair)
+	handler.Log = log
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return errors.Wrap(err, "couldn't listen on the loopback interface")
+	}
+	// The server is served as it would be for a run, but only for itself.
+	serveCfg := cfg
+	serveCfg.BindSocket = ""
+	serveCfg.BindAddress = "127.0.0.1"
+	serveCfg.BindPort = listener.Addr().(*net.TCPAddr).Port
+	serveCfg.AdvertiseAddress = listener.Addr().String()
+	serveCfg.TLSServerNames = nil
+	serveCfg.WorkerTLSServerName = ""
+	doneServ, stopServer, err := serve(listener, handler, serveCfg, auth, log)
+	if err != nil {
+		listener.Close()
+		return errors.Wrap(err, "couldn't start aggregation server")
+	}
+	defer stopServer()
+
+	cert, err := auth.ClientKeyPair(selfTestPlugin)
+	if err != nil {
+		return errors.Wrap(err, "couldn't issue client certificate")
+	}
+	tlsOpts, err := ca.ParseTLSOptions(cfg.MinTLSVersion, cfg.CipherSuites)
+	if err != nil {
+		return errors.Wrap(err, "invalid TLS settings")
+	}
+	tlsCfg := &tls.Config{
+		Certificates: []tls.Certificate{*cert},
+		RootCAs:      auth.CACertPool(),
+	}
+	tlsOpts.Apply(tlsCfg)
+	client := &http.Client{
+		Transport: &http.Transport{TLSClientConfig: tlsCfg},
+		Timeout:   selfTestTimeout,
+	}
+	defer client.Transport.(*http.Transport).CloseIdleConnections()
+
+	url, err := GlobalResultURL("https://"+listener.Addr().String(), selfTestPlugin)
+	if err != nil {
+		return errors.Wrap(err, "couldn't get result URL")
+	}
+	req, err := http.NewRequest(http.MethodPut, url, bytes.NewReader([]byte(`{"selftest":true}`)))
+	if err != nil {
+		return errors.Wrap(err, "couldn't make result request")
+	}
+	req.Header.Set("content-type", "application/json")
+	resp, err := client.Do(req)
+	if err != nil {
+		select {
+		case servErr := <-doneServ:
+			return errors.Wrap(servErr, "aggregation server stopped")
+		default:
+		}
+		return errors.Wrap(err, "couldn't submit result over TLS")
+	}
+	body, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return errors.Errorf("aggregator rejected result with status %v: %s", resp.Status, bytes.TrimSpace(body))
+	}
+	log.Info("Submitted result over TLS")
+
+	aggr.resultsMutex.Lock()
+	result := aggr.Results[selfTestPlugin]
+	aggr.resultsMutex.Unlock()
+	switch {
+	case result == nil:
+		return errors.New("aggregator didn't record the result")
+	case !result.IsSuccess():
+		return errors.Errorf("aggregator recorded an error for the result: %v", result.Error)
+	}
+	log.Info("Aggregator recorded result")
+	return nil
+}
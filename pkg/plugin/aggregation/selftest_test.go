@@ -0,0 +1,54 @@
+/*
+Copyright 2018 Heptio Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package aggregation
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/heptio/sonobuoy/pkg/backplane/ca"
+	"github.com/heptio/sonobuoy/pkg/plugin"
+	logtest "github.com/sirupsen/logrus/hooks/test"
+)
+
+func TestSelfTest(t *testing.T) {
+	testCases := []struct {
+		desc      string
+		cfg       plugin.AggregationConfig
+		expectErr string
+	}{
+		{desc: "defaults"},
+		{desc: "rsa", cfg: plugin.AggregationConfig{KeyType: string(ca.KeyTypeRSA)}},
+		{desc: "tls 1.3", cfg: plugin.AggregationConfig{MinTLSVersion: "1.3"}},
+		{desc: "http2 disabled", cfg: plugin.AggregationConfig{DisableHTTP2: true}},
+		{desc: "unsupported key type", cfg: plugin.AggregationConfig{KeyType: "dsa"}, expectErr: "couldn't make certificate authority"},
+		{desc: "invalid TLS version", cfg: plugin.AggregationConfig{MinTLSVersion: "0.9"}, expectErr: "couldn't start aggregation server"},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.desc, func(t *testing.T) {
+			log, _ := logtest.NewNullLogger()
+			err := SelfTest(tc.cfg, log)
+			switch {
+			case tc.expectErr == "" && err != nil:
+				t.Errorf("expected the self test to pass, got %v", err)
+			case tc.expectErr != "" && (err == nil || !strings.Contains(err.Error(), tc.expectErr)):
+				t.Errorf("expected error containing %q, got %v", tc.expectErr, err)
+			}
+		})
+	}
+}
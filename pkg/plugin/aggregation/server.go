@@ -0,0 +1,269 @@
+/*
+Copyright 2018 Heptio Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package aggregation
+
+import (
+	"context"
+	"encoding/json"
+	"net"
+	"net/http"
+	"sync"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"k8s.io/client-go/kubernetes"
+
+	"github.com/heptio/sonobuoy/pkg/backplane/ca"
+	"github.com/heptio/sonobuoy/pkg/plugin"
+)
+
+// IdleStatus is the health status of a Server between runs.
+const IdleStatus = "idle"
+
+// Server is a long-lived aggregation server which runs are made against one
+// at a time, e.g. for periodic diagnostics, so that they share its listener
+// and CA rather than each binding a port and issuing certificates of their
+// own. Between runs, uploads are refused and health checks report it as
+// idle.
+type Server struct {
+	client    kubernetes.Interface
+	namespace string
+	// cfg holds the settings of the listener and CA, which every run uses.
+	cfg      plugin.AggregationConfig
+	auth     *ca.Authority
+	listener net.Listener
+	// connections wraps the listener to limit and count its connections
+	connections *connLimitListener
+	stop        func()
+	log         logrus.FieldLogger
+
+	// stopped is closed once the server has stopped, with serveErr the
+	// error it stopped with.
+	stopped  chan struct{}
+	serveErr error
+
+	mu sync.Mutex
+	// handler is the handler of the run in progress, if any.
+	handler http.Handler
+	// run is the run in progress or, between runs, the last one.
+	run *serverRun
+}
+
+// serverRun is a run made against a Server.
+type serverRun struct {
+	done    chan struct{}
+	summary *RunSummary
+	err     error
+}
+
+// NewServer binds the aggregation server's address and starts serving on
+// it, ready for runs to be started. The listener and CA are set up from cfg
+// as for Run, using opts.Authority, opts.Logger and opts.Listening if
+// they're set, and are shared by every run. Since the server is shared,
+// opts.InProcess isn't supported. client and namespace are what runs are
+// made with.
+func NewServer(client kubernetes.Interface, cfg plugin.AggregationConfig, namespace string, opts RunOptions) (*Server, error) {
+	if opts.InProcess != nil {
+		return nil, errors.New("a shared aggregation server can't be in-process")
+	}
+	log := runLogger(cfg, opts)
+
+	auth, err := newAuthority(cfg, opts, nil, log)
+	if err != nil {
+		return nil, err
+	}
+	listener, err := listen(cfg)
+	if err != nil {
+		return nil, err
+	}
+	boundFreePort := false
+	if port, ok := listenerPort(listener); ok && cfg.BindPort == 0 {
+		cfg = withBindPort(cfg, port)
+		boundFreePort = true
+		log.WithField("port", cfg.BindPort).Info("Bound the aggregation server to a free port")
+	}
+
+	s := &Server{
+		client:      client,
+		namespace:   namespace,
+		cfg:         cfg,
+		auth:        auth,
+		listener:    listener,
+		connections: newConnLimitListener(listener, cfg.MaxConnections, log),
+		log:         log,
+		stopped:     make(chan struct{}),
+	}
+	done, stop, err := serve(s.connections, http.HandlerFunc(s.serveHTTP), cfg, auth, log)
+	if err != nil {
+		listener.Close()
+		return nil, err
+	}
+	s.stop = stop
+	go func() {
+		s.serveErr = <-done
+		close(s.stopped)
+	}()
+
+	if opts.Listening != nil {
+		opts.Listening(listener.Addr())
+	}
+	if boundFreePort {
+		if err := newUpdater(nil, namespace, client).AnnotatePort(cfg.BindPort); err != nil {
+			log.WithError(err).Info("couldn't annotate sonobuoy pod with the aggregation server's port")
+		}
+	}
+	return s, nil
+}
+
+// Addr returns the address the server is listening on.
+func (s *Server) Addr() net.Addr {
+	return s.listener.Addr()
+}
+
+// StartRun starts a run of the plugins in the background, writing the
+// results to outdir, as Run does. The server's listener and CA are used in
+// place of those cfg would set up: its bind address, port and socket, TLS
+// settings and CA files are replaced with the server's. WaitRun returns the
+// run's summary once it's over. Only one run can be in progress at a time.
+func (s *Server) StartRun(ctx context.Context, plugins []plugin.Interface, cfg plugin.AggregationConfig, outdir string, opts RunOptions) error {
+	if opts.InProcess != nil {
+		return errors.New("runs on a shared aggregation server can't be in-process")
+	}
+	select {
+	case <-s.stopped:
+		return errors.Wrap(s.serveErr, "the aggregation server has stopped")
+	default:
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.run != nil {
+		select {
+		case <-s.run.done:
+		default:
+			return errors.New("a run is already in progress on the aggregation server")
+		}
+	}
+
+	cfg = s.runConfig(cfg)
+	opts.Authority = s.auth
+	if opts.Logger == nil {
+		opts.Logger = s.log
+	}
+	r := &serverRun{done: make(chan struct{})}
+	s.run = r
+	go func() {
+		defer close(r.done)
+		r.summary, r.err = run(ctx, s.client, plugins, cfg, s.namespace, outdir, opts, s)
+	}()
+	return nil
+}
+
+// WaitRun waits for the last run started to end, returning its summary and
+// error as Run does. It can be called any number of times for the same run.
+func (s *Server) WaitRun() (*RunSummary, error) {
+	s.mu.Lock()
+	r := s.run
+	s.mu.Unlock()
+	if r == nil {
+		return nil, errors.New("no run has been started on the aggregation server")
+	}
+	<-r.done
+	return r.summary, r.err
+}
+
+// Close stops the server. A run in progress fails, since its results can no
+// longer be submitted.
+func (s *Server) Close() error {
+	s.stop()
+	<-s.stopped
+	if s.serveErr == http.ErrServerClosed {
+		return nil
+	}
+	return s.serveErr
+}
+
+// runConfig returns the config of a run with the server's listener and CA
+// settings in place of its own.
+func (s *Server) runConfig(cfg plugin.AggregationConfig) plugin.AggregationConfig {
+	cfg.BindAddress = s.cfg.BindAddress
+	cfg.BindPort = s.cfg.BindPort
+	cfg.BindSocket = s.cfg.BindSocket
+	cfg.AdvertiseAddress = s.cfg.AdvertiseAddress
+	cfg.MinTLSVersion = s.cfg.MinTLSVersion
+	cfg.CipherSuites = s.cfg.CipherSuites
+	cfg.DisableHTTP2 = s.cfg.DisableHTTP2
+	cfg.CACertFile = s.cfg.CACertFile
+	cfg.CAKeyFile = s.cfg.CAKeyFile
+	cfg.KeyType = s.cfg.KeyType
+	return cfg
+}
+
+// attach routes requests to the handler of a run until the returned detach
+// func is called. The returned channel gets the error the server stops with
+// if it stops while the run is attached.
+func (s *Server) attach(handler http.Handler) (<-chan error, func()) {
+	// The handler is attached behind a pointer of its own, since handlers
+	// such as http.HandlerFunc can't be compared when detaching it.
+	attached := &struct{ http.Handler }{handler}
+	s.mu.Lock()
+	s.handler = attached
+	s.mu.Unlock()
+
+	done := make(chan error, 1)
+	detached := make(chan struct{})
+	go func() {
+		select {
+		case <-s.stopped:
+			done <- s.serveErr
+		case <-detached:
+		}
+	}()
+
+	var once sync.Once
+	return done, func() {
+		once.Do(func() {
+			s.mu.Lock()
+			if s.handler == attached {
+				s.handler = nil
+			}
+			s.mu.Unlock()
+			close(detached)
+		})
+	}
+}
+
+// serveHTTP passes requests to the handler of the run in progress. Between
+// runs, uploads get a 503 and health checks report the server as idle.
+func (s *Server) serveHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	handler := s.handler
+	s.mu.Unlock()
+	if handler != nil {
+		handler.ServeHTTP(w, r)
+		return
+	}
+
+	if stripped, ok := stripBasePath(r, s.cfg.BasePath); ok && r.Method == http.MethodGet && stripped.URL.Path == healthz {
+		w.Header().Set("content-type", "application/json")
+		if err := json.NewEncoder(w).Encode(HealthStatus{Status: IdleStatus}); err != nil {
+			s.log.WithError(err).Info("couldn't write health status")
+		}
+		return
+	}
+	http.Error(w, "no aggregation run is in progress", http.StatusServiceUnavailable)
+}
@@ -0,0 +1,204 @@
+/*
+Copyright 2018 Heptio Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package aggregation
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"path"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/pkg/errors"
+
+	"github.com/heptio/sonobuoy/pkg/plugin"
+)
+
+func TestServer_runs(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sonobuoy_server_test")
+	if err != nil {
+		t.Fatalf("Could not create temp directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	socket := path.Join(dir, "aggregator.sock")
+
+	client := &http.Client{Transport: &http.Transport{
+		DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+			var d net.Dialer
+			return d.DialContext(ctx, "unix", socket)
+		},
+	}}
+	// submit uploads the e2e result once release is closed
+	submit := func(release <-chan struct{}, submitErr chan<- error) *fakePlugin {
+		return &fakePlugin{name: "e2e", run: func(string) error {
+			go func() {
+				<-release
+				req, _ := http.NewRequest("PUT", "http://aggregator/api/v1/results/global/e2e", strings.NewReader("{}"))
+				resp, err := client.Do(req)
+				if err == nil {
+					resp.Body.Close()
+					if resp.StatusCode != http.StatusOK {
+						err = errors.Errorf("unexpected status %v", resp.Status)
+					}
+				}
+				submitErr <- err
+			}()
+			return nil
+		}}
+	}
+
+	srv, err := NewServer(&fakeClient{}, plugin.AggregationConfig{BindSocket: socket}, "heptio-sonobuoy-test", RunOptions{})
+	if err != nil {
+		t.Fatalf("couldn't start server: %v", err)
+	}
+	if _, err := srv.WaitRun(); err == nil {
+		t.Error("expected an error waiting before any run was started")
+	}
+
+	for i, outdir := range []string{path.Join(dir, "run1"), path.Join(dir, "run2")} {
+		release := make(chan struct{})
+		submitErr := make(chan error, 1)
+		if err := srv.StartRun(context.Background(), []plugin.Interface{submit(release, submitErr)}, plugin.AggregationConfig{}, outdir, RunOptions{}); err != nil {
+			t.Fatalf("couldn't start run %v: %v", i+1, err)
+		}
+		if err := srv.StartRun(context.Background(), []plugin.Interface{&fakePlugin{name: "e2e"}}, plugin.AggregationConfig{}, outdir, RunOptions{}); err == nil {
+			t.Errorf("expected an error starting a run while run %v is in progress", i+1)
+		}
+		close(release)
+
+		summary, err := srv.WaitRun()
+		if err != nil {
+			t.Fatalf("unexpected error from run %v: %v", i+1, err)
+		}
+		if err := <-submitErr; err != nil {
+			t.Errorf("couldn't submit result of run %v: %v", i+1, err)
+		}
+		if !summary.Succeeded() {
+			t.Errorf("expected all results of run %v to complete, got %+v", i+1, summary)
+		}
+		if manifest := readManifest(t, outdir); len(manifest.Results) != 1 {
+			t.Errorf("expected one result from run %v, got %+v", i+1, manifest.Results)
+		}
+
+		// Between runs the server is idle
+		resp, err := client.Get("http://aggregator" + healthz)
+		if err != nil {
+			t.Fatalf("couldn't get health status: %v", err)
+		}
+		var health HealthStatus
+		err = json.NewDecoder(resp.Body).Decode(&health)
+		resp.Body.Close()
+		if err != nil || health.Status != IdleStatus {
+			t.Errorf("expected the server to be idle after run %v, got %+v (%v)", i+1, health, err)
+		}
+		req, _ := http.NewRequest("PUT", "http://aggregator/api/v1/results/global/e2e", strings.NewReader("{}"))
+		resp, err = client.Do(req)
+		if err != nil {
+			t.Fatalf("couldn't submit result: %v", err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusServiceUnavailable {
+			t.Errorf("expected results to be refused between runs, got %v", resp.Status)
+		}
+	}
+
+	if err := srv.Close(); err != nil {
+		t.Errorf("unexpected error closing server: %v", err)
+	}
+	if _, err := os.Stat(socket); !os.IsNotExist(err) {
+		t.Errorf("expected the socket to be removed when the server is closed, got %v", err)
+	}
+	if err := srv.StartRun(context.Background(), []plugin.Interface{&fakePlugin{name: "e2e"}}, plugin.AggregationConfig{}, dir, RunOptions{}); err == nil {
+		t.Error("expected an error starting a run once the server is closed")
+	}
+}
+
+func TestServer_middleware(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sonobuoy_server_test")
+	if err != nil {
+		t.Fatalf("Could not create temp directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	socket := path.Join(dir, "aggregator.sock")
+
+	srv, err := NewServer(&fakeClient{}, plugin.AggregationConfig{BindSocket: socket}, "heptio-sonobuoy-test", RunOptions{})
+	if err != nil {
+		t.Fatalf("couldn't start server: %v", err)
+	}
+	defer srv.Close()
+
+	// Middleware commonly returns an http.HandlerFunc, which the server
+	// detaches once the run is over like any other handler.
+	var requests int32
+	counting := func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			atomic.AddInt32(&requests, 1)
+			next.ServeHTTP(w, r)
+		})
+	}
+	client := &http.Client{Transport: &http.Transport{
+		DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+			var d net.Dialer
+			return d.DialContext(ctx, "unix", socket)
+		},
+	}}
+	p := &fakePlugin{name: "e2e", run: func(string) error {
+		go func() {
+			req, _ := http.NewRequest("PUT", "http://aggregator/api/v1/results/global/e2e", strings.NewReader("{}"))
+			if resp, err := client.Do(req); err == nil {
+				resp.Body.Close()
+			}
+		}()
+		return nil
+	}}
+	opts := RunOptions{Middleware: []func(http.Handler) http.Handler{counting}}
+	if err := srv.StartRun(context.Background(), []plugin.Interface{p}, plugin.AggregationConfig{}, path.Join(dir, "run"), opts); err != nil {
+		t.Fatalf("couldn't start run: %v", err)
+	}
+	summary, err := srv.WaitRun()
+	if err != nil {
+		t.Fatalf("unexpected error from run: %v", err)
+	}
+	if !summary.Succeeded() {
+		t.Errorf("expected all results to complete, got %+v", summary)
+	}
+	if atomic.LoadInt32(&requests) == 0 {
+		t.Error("expected the result to be submitted through the middleware")
+	}
+
+	resp, err := client.Get("http://aggregator" + healthz)
+	if err != nil {
+		t.Fatalf("couldn't get health status: %v", err)
+	}
+	var health HealthStatus
+	err = json.NewDecoder(resp.Body).Decode(&health)
+	resp.Body.Close()
+	if err != nil || health.Status != IdleStatus {
+		t.Errorf("expected the server to be idle after the run, got %+v (%v)", health, err)
+	}
+}
+
+func TestNewServer_inProcess(t *testing.T) {
+	if _, err := NewServer(&fakeClient{}, plugin.AggregationConfig{}, "heptio-sonobuoy-test", RunOptions{InProcess: NewInProcessServer()}); err == nil {
+		t.Error("expected an error making an in-process shared server")
+	}
+}
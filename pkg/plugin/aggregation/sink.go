@@ -0,0 +1,141 @@
+/*
+Copyright 2018 Heptio Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package aggregation
+
+import (
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/heptio/sonobuoy/pkg/plugin"
+	"github.com/pkg/errors"
+)
+
+// ResultSink is somewhere results are written to besides the local results
+// directory, so that they aren't lost if the aggregator's pod is.
+type ResultSink interface {
+	// Write stores the contents of a file at the given slash-separated path,
+	// relative to the root of the results, replacing any file already
+	// there.
+	Write(path string, body io.Reader) error
+	// Finalize is called once everything has been written, returning an
+	// error if the sink is incomplete.
+	Finalize() error
+}
+
+// NewResultSink returns the result sink the config asks for, or nil if it
+// doesn't ask for one. Results are written under runID in the sink so that
+// runs don't overwrite each other.
+func NewResultSink(cfg plugin.AggregationConfig, runID string) (ResultSink, error) {
+	switch cfg.ResultSink {
+	case "":
+		return nil, nil
+	case plugin.ResultSinkFilesystem:
+		return &FilesystemSink{Dir: filepath.Join(cfg.ResultSinkDir, runID)}, nil
+	case plugin.ResultSinkS3:
+		sink, err := NewS3SinkFromEnv(cfg.S3Bucket, cfg.S3Region, path.Join(cfg.S3Prefix, runID), cfg.S3Endpoint)
+		if err != nil {
+			return nil, err
+		}
+		return sink, nil
+	default:
+		return nil, errors.Errorf("unknown result sink %q", cfg.ResultSink)
+	}
+}
+
+// FilesystemSink writes results to a directory, the same way they are
+// written to the local results directory.
+type FilesystemSink struct {
+	Dir string
+}
+
+// Write implements ResultSink.
+func (s *FilesystemSink) Write(name string, body io.Reader) error {
+	filename := filepath.Join(s.Dir, filepath.FromSlash(name))
+	if rel, err := filepath.Rel(s.Dir, filename); err != nil || strings.HasPrefix(rel, "..") {
+		return errors.Errorf("%v is outside of the sink directory", name)
+	}
+	if err := os.MkdirAll(filepath.Dir(filename), 0755); err != nil {
+		return errors.Wrapf(err, "couldn't create directory for %v", filename)
+	}
+
+	// Write to a temporary file first so a partial file never replaces a
+	// complete one.
+	tmp := filename + ".tmp"
+	f, err := os.Create(tmp)
+	if err != nil {
+		return errors.Wrapf(err, "couldn't create %v", tmp)
+	}
+	if _, err := io.Copy(f, body); err != nil {
+		f.Close()
+		os.Remove(tmp)
+		return errors.Wrapf(err, "couldn't write %v", tmp)
+	}
+	if err := f.Close(); err != nil {
+		os.Remove(tmp)
+		return errors.Wrapf(err, "couldn't write %v", tmp)
+	}
+	return errors.Wrapf(os.Rename(tmp, filename), "couldn't write %v", filename)
+}
+
+// Finalize implements ResultSink. Every file is complete once written, so
+// there is nothing to do.
+func (s *FilesystemSink) Finalize() error {
+	return nil
+}
+
+// WriteFileToSink writes the local file to the sink at the given path.
+func WriteFileToSink(sink ResultSink, name, filename string) error {
+	f, err := os.Open(filename)
+	if err != nil {
+		return errors.Wrapf(err, "couldn't open %v", filename)
+	}
+	defer f.Close()
+	return errors.Wrapf(sink.Write(name, f), "couldn't write %v to the result sink", name)
+}
+
+// sinkResult writes each of the files written for the result to the Sink,
+// if there is one. Errors are logged rather than returned since the result
+// was already saved locally. resultsMutex must be held by the caller.
+func (a *Aggregator) sinkResult(result *plugin.Result) {
+	if a.Sink == nil {
+		return
+	}
+	log := a.logger().WithFields(resultFields(result))
+
+	// Sink paths are relative to the root of the results, which OutputDir
+	// is in.
+	root := filepath.Dir(a.OutputDir)
+	err := filepath.Walk(a.resultPath(result), func(filename string, info os.FileInfo, err error) error {
+		if err != nil || !info.Mode().IsRegular() {
+			return err
+		}
+		rel, err := filepath.Rel(root, filename)
+		if err != nil {
+			return err
+		}
+		if err := WriteFileToSink(a.Sink, filepath.ToSlash(rel), filename); err != nil {
+			log.WithError(err).Info("Couldn't write result file to the result sink")
+		}
+		return nil
+	})
+	if err != nil && !os.IsNotExist(err) {
+		log.WithError(err).Info("Couldn't list the files of result for the result sink")
+	}
+}
@@ -0,0 +1,94 @@
+/*
+Copyright 2018 Heptio Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package aggregation
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"testing"
+
+	"github.com/heptio/sonobuoy/pkg/plugin"
+)
+
+func TestAggregator_sink(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sonobuoy_sink_test")
+	if err != nil {
+		t.Fatalf("Could not create temp directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	expected := []plugin.ExpectedResult{
+		{NodeName: "node1", ResultType: "systemd_logs"},
+		{ResultType: "e2e"},
+	}
+	aggr := NewAggregator(path.Join(dir, "results", "plugins"), expected)
+	sinkDir := path.Join(dir, "sink")
+	aggr.Sink = &FilesystemSink{Dir: sinkDir}
+
+	resultsCh := make(chan *plugin.Result, 2)
+	resultsCh <- &plugin.Result{ResultType: "systemd_logs", NodeName: "node1", Body: strings.NewReader("foo")}
+	resultsCh <- &plugin.Result{ResultType: "e2e", MimeType: gzipMimeType, Body: bytes.NewReader(makeTarWithContents(t, "junit.xml", []byte("bar")))}
+	close(resultsCh)
+	aggr.IngestResults(resultsCh)
+
+	for name, want := range map[string]string{
+		"plugins/systemd_logs/results/node1": "foo",
+		"plugins/e2e/results/junit.xml":      "bar",
+	} {
+		got, err := ioutil.ReadFile(path.Join(sinkDir, name))
+		if err != nil || string(got) != want {
+			t.Errorf("expected %v in the sink to be %q, got %q: %v", name, want, got, err)
+		}
+	}
+}
+
+func TestFilesystemSink_outside(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sonobuoy_sink_test")
+	if err != nil {
+		t.Fatalf("Could not create temp directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	sink := &FilesystemSink{Dir: path.Join(dir, "sink")}
+	if err := sink.Write("../escaped", strings.NewReader("foo")); err == nil {
+		t.Error("expected an error writing outside of the sink directory")
+	}
+	if _, err := os.Stat(path.Join(dir, "escaped")); !os.IsNotExist(err) {
+		t.Errorf("expected nothing to be written outside of the sink directory, got %v", err)
+	}
+}
+
+func TestNewResultSink(t *testing.T) {
+	sink, err := NewResultSink(plugin.AggregationConfig{}, "abc")
+	if sink != nil || err != nil {
+		t.Errorf("expected no sink by default, got %v, %v", sink, err)
+	}
+
+	sink, err = NewResultSink(plugin.AggregationConfig{ResultSink: plugin.ResultSinkFilesystem, ResultSinkDir: "/mnt/results"}, "abc")
+	if fs, ok := sink.(*FilesystemSink); err != nil || !ok || fs.Dir != "/mnt/results/abc" {
+		t.Errorf("expected a filesystem sink in the run's directory, got %+v, %v", sink, err)
+	}
+
+	defer os.Setenv("AWS_ACCESS_KEY_ID", os.Getenv("AWS_ACCESS_KEY_ID"))
+	os.Setenv("AWS_ACCESS_KEY_ID", "")
+	if _, err := NewResultSink(plugin.AggregationConfig{ResultSink: plugin.ResultSinkS3, S3Bucket: "bucket", S3Region: "us-east-1"}, "abc"); err == nil {
+		t.Error("expected an error creating an S3 sink without credentials")
+	}
+}
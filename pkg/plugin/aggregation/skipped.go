@@ -0,0 +1,106 @@
+/*
+Copyright 2018 Heptio Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package aggregation
+
+import (
+	"sort"
+
+	"github.com/heptio/sonobuoy/pkg/plugin"
+)
+
+// SkipReason is why a plugin was never launched during a run.
+type SkipReason string
+
+const (
+	// SkippedNoNodes is the reason plugins which expected no results are
+	// skipped, such as daemonset plugins when no nodes match the node
+	// selector.
+	SkippedNoNodes SkipReason = "no-nodes"
+	// SkippedDependencyFailed is the reason plugins are skipped when a
+	// plugin they depend on failed. Each of their results is still
+	// recorded as an error.
+	SkippedDependencyFailed SkipReason = "dependency-failed"
+	// SkippedCompletedPreviously is the reason plugins are skipped when
+	// re-running the failed plugins of a run, if they completed in it.
+	SkippedCompletedPreviously SkipReason = "completed-previously"
+	// SkippedAllRecorded is the reason plugins aren't relaunched when a run
+	// is resumed, if all of their results were recorded before it stopped.
+	SkippedAllRecorded SkipReason = "all-recorded"
+)
+
+// SkippedPlugin records a plugin which was never launched during a run, so
+// that it can be told apart from a plugin which ran and passed.
+type SkippedPlugin struct {
+	Plugin     string     `json:"plugin"`
+	ResultType string     `json:"resulttype"`
+	Reason     SkipReason `json:"reason"`
+	// Message explains the reason, e.g. naming the dependency which failed.
+	Message string `json:"message,omitempty"`
+}
+
+func newSkippedPlugin(p plugin.Interface, reason SkipReason, message string) SkippedPlugin {
+	return SkippedPlugin{
+		Plugin:     p.GetName(),
+		ResultType: p.GetResultType(),
+		Reason:     reason,
+		Message:    message,
+	}
+}
+
+// sortSkipped sorts skipped plugins by name.
+func sortSkipped(skipped []SkippedPlugin) {
+	sort.Slice(skipped, func(i, j int) bool {
+		return skipped[i].Plugin < skipped[j].Plugin
+	})
+}
+
+// skippedRunSummary returns the summary of a run which skipped every plugin.
+func skippedRunSummary(skipped []SkippedPlugin) *RunSummary {
+	summary := newRunSummary(nil, nil)
+	summary.Skipped = append([]SkippedPlugin(nil), skipped...)
+	sortSkipped(summary.Skipped)
+	return summary
+}
+
+// skipPlugin records that a plugin was skipped, for the run's summary and
+// in the manifest. Only the first reason a plugin was skipped is kept.
+func (a *Aggregator) skipPlugin(skipped SkippedPlugin) {
+	a.resultsMutex.Lock()
+	defer a.resultsMutex.Unlock()
+	for _, s := range a.skipped {
+		if s.ResultType == skipped.ResultType {
+			return
+		}
+	}
+	a.skipped = append(a.skipped, skipped)
+	a.manifest.recordSkipped(skipped)
+}
+
+// recordSkipped records a plugin which was skipped and rewrites the manifest
+// file.
+func (m *resultsManifest) recordSkipped(skipped SkippedPlugin) {
+	if m == nil {
+		return
+	}
+	if _, ok := m.skipped[skipped.ResultType]; ok {
+		return
+	}
+	m.skipped[skipped.ResultType] = skipped
+	if err := m.write(); err != nil {
+		m.log.WithError(err).Info("Couldn't write results manifest")
+	}
+}
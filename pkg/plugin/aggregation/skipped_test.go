@@ -0,0 +1,96 @@
+/*
+Copyright 2018 Heptio Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package aggregation
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/heptio/sonobuoy/pkg/plugin"
+	v1 "k8s.io/api/core/v1"
+)
+
+// nodelessPlugin is a plugin which expects no results, like a daemonset
+// plugin when there are no nodes to run on.
+type nodelessPlugin struct {
+	fakePlugin
+}
+
+func (p *nodelessPlugin) ExpectedResults(nodes []v1.Node) []plugin.ExpectedResult {
+	return nil
+}
+
+func TestRun_skipsPluginsWithoutResults(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sonobuoy_skipped_test")
+	if err != nil {
+		t.Fatalf("Could not create temp directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	srv := NewInProcessServer()
+	logsRan := false
+	logs := &nodelessPlugin{fakePlugin{name: "systemd_logs", run: func(string) error {
+		logsRan = true
+		return nil
+	}}}
+	// Plugins depending on a skipped plugin still run.
+	e2e := &fakePlugin{name: "e2e", dependsOn: []string{"systemd_logs"}, run: func(string) error {
+		go srv.Submit("", "e2e", "application/json", strings.NewReader("{}"))
+		return nil
+	}}
+
+	cfg := plugin.AggregationConfig{NodeSelector: "pool=none"}
+	summary, err := Run(context.Background(), &fakeClient{}, []plugin.Interface{logs, e2e}, cfg, "heptio-sonobuoy-test", dir, RunOptions{InProcess: srv})
+	if err != nil {
+		t.Fatalf("unexpected error from run: %v", err)
+	}
+	if !summary.Succeeded() || summary.Expected != 1 {
+		t.Errorf("expected the e2e result to complete, got %+v", summary)
+	}
+	if logsRan {
+		t.Error("expected the plugin without results not to be run")
+	}
+
+	want := []SkippedPlugin{{Plugin: "systemd_logs", ResultType: "systemd_logs", Reason: SkippedNoNodes, Message: `no nodes match the node selector "pool=none"`}}
+	if !reflect.DeepEqual(summary.Skipped, want) {
+		t.Errorf("expected skipped plugins %+v, got %+v", want, summary.Skipped)
+	}
+	if manifest := readManifest(t, dir); !reflect.DeepEqual(manifest.Skipped, want) {
+		t.Errorf("expected the manifest to record skipped plugins %+v, got %+v", want, manifest.Skipped)
+	}
+}
+
+func TestRun_skipsEveryPlugin(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sonobuoy_skipped_test")
+	if err != nil {
+		t.Fatalf("Could not create temp directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	logs := &nodelessPlugin{fakePlugin{name: "systemd_logs"}}
+	summary, err := Run(context.Background(), &fakeClient{}, []plugin.Interface{logs}, plugin.AggregationConfig{}, "heptio-sonobuoy-test", dir, RunOptions{InProcess: NewInProcessServer()})
+	if err != nil {
+		t.Fatalf("unexpected error from run: %v", err)
+	}
+	if len(summary.Skipped) != 1 || summary.Skipped[0].Reason != SkippedNoNodes || summary.Skipped[0].Message != "no nodes to run on" {
+		t.Errorf("expected the plugin to be skipped with no nodes to run on, got %+v", summary.Skipped)
+	}
+}
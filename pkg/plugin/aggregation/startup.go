@@ -0,0 +1,145 @@
+/*
+Copyright 2018 Heptio Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package aggregation
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/heptio/sonobuoy/pkg/plugin"
+	"github.com/heptio/sonobuoy/pkg/plugin/driver/utils"
+	"github.com/sirupsen/logrus"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/fields"
+	"k8s.io/client-go/kubernetes"
+)
+
+// maxStartupCheckInterval is the longest time between checks for pods which
+// haven't started.
+const maxStartupCheckInterval = 10 * time.Second
+
+// watchPluginStartup records an error for each result of the plugin whose pod
+// is still pending after the grace period, so that a plugin which can't start
+// fails quickly instead of waiting for the run to time out. The error includes
+// the latest event for the pod, which usually says why it's stuck. It returns
+// once ctx is done or none of the plugin's results are pending.
+func watchPluginStartup(ctx context.Context, client kubernetes.Interface, p plugin.Interface, namespace string, aggr *Aggregator, grace time.Duration, resultsCh chan<- *plugin.Result) {
+	sessioned, ok := p.(plugin.Sessioned)
+	if !ok {
+		return
+	}
+	selector := plugin.SessionLabel + "=" + sessioned.GetSessionID()
+
+	interval := grace / 4
+	if interval > maxStartupCheckInterval {
+		interval = maxStartupCheckInterval
+	}
+
+	reported := map[string]bool{}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		pending := aggr.pendingResults(p.GetResultType())
+		if len(pending) == 0 {
+			return
+		}
+
+		pods, err := client.CoreV1().Pods(namespace).List(metav1.ListOptions{LabelSelector: selector})
+		if err != nil {
+			aggr.logger().WithError(err).WithField("plugin", p.GetName()).Info("couldn't list pods to check they've started, will retry")
+			continue
+		}
+
+		for i := range pods.Items {
+			pod := &pods.Items[i]
+			if reported[pod.Name] || pod.Status.Phase != v1.PodPending || time.Since(pod.CreationTimestamp.Time) < grace {
+				continue
+			}
+			expected, ok := resultForPod(pending, pod)
+			if !ok {
+				continue
+			}
+			reported[pod.Name] = true
+
+			errdata := map[string]interface{}{
+				"error":    fmt.Sprintf("pod %v of plugin %v didn't start within %v: %v", pod.Name, p.GetName(), grace, podStartupProblem(client, pod, aggr.logger())),
+				"category": utils.PendingPodCategory(pod),
+				"pod":      pod,
+			}
+			aggr.logger().WithFields(logrus.Fields{
+				"plugin": p.GetName(),
+				"pod":    pod.Name,
+			}).Info(errdata["error"])
+			resultsCh <- utils.MakeErrorResult(expected.ResultType, errdata, expected.NodeName)
+		}
+	}
+}
+
+// resultForPod returns the pending result the pod would submit: the one for
+// its node, or the plugin's only result if it isn't node-specific.
+func resultForPod(pending []plugin.ExpectedResult, pod *v1.Pod) (plugin.ExpectedResult, bool) {
+	for _, expected := range pending {
+		if expected.NodeName == "" || expected.NodeName == pod.Spec.NodeName {
+			return expected, true
+		}
+	}
+	return plugin.ExpectedResult{}, false
+}
+
+// podStartupProblem describes why the pod hasn't started, preferring the
+// message of its latest event and falling back to its containers' states.
+func podStartupProblem(client kubernetes.Interface, pod *v1.Pod, log logrus.FieldLogger) string {
+	events, err := client.CoreV1().Events(pod.Namespace).List(metav1.ListOptions{
+		FieldSelector: fields.Set{
+			"involvedObject.kind": "Pod",
+			"involvedObject.name": pod.Name,
+		}.String(),
+	})
+	if err == nil {
+		var latest *v1.Event
+		for i := range events.Items {
+			if latest == nil || events.Items[i].LastTimestamp.After(latest.LastTimestamp.Time) {
+				latest = &events.Items[i]
+			}
+		}
+		if latest != nil {
+			return fmt.Sprintf("%v: %v", latest.Reason, latest.Message)
+		}
+	} else {
+		log.WithError(err).WithField("pod", pod.Name).Info("couldn't list events for pod")
+	}
+
+	for _, cstatus := range pod.Status.ContainerStatuses {
+		if waiting := cstatus.State.Waiting; waiting != nil && waiting.Reason != "" {
+			return fmt.Sprintf("container %v is waiting: %v %v", cstatus.Name, waiting.Reason, waiting.Message)
+		}
+	}
+	for _, cond := range pod.Status.Conditions {
+		if cond.Status != v1.ConditionTrue && cond.Message != "" {
+			return fmt.Sprintf("%v: %v", cond.Reason, cond.Message)
+		}
+	}
+	return "the pod is still pending"
+}
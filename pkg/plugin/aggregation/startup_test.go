@@ -0,0 +1,110 @@
+/*
+Copyright 2018 Heptio Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package aggregation
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/heptio/sonobuoy/pkg/plugin"
+	"github.com/sirupsen/logrus"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// sessionPlugin is a fakePlugin whose pods can be found by session ID.
+type sessionPlugin struct {
+	fakePlugin
+}
+
+func (p *sessionPlugin) GetSessionID() string { return "abc123" }
+
+func pendingPod(name, node string, age time.Duration) v1.Pod {
+	return v1.Pod{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:              name,
+			CreationTimestamp: metav1.NewTime(time.Now().Add(-age)),
+		},
+		Spec:   v1.PodSpec{NodeName: node},
+		Status: v1.PodStatus{Phase: v1.PodPending},
+	}
+}
+
+func TestWatchPluginStartup(t *testing.T) {
+	running := pendingPod("systemd-logs-node1", "node1", time.Hour)
+	running.Status.Phase = v1.PodRunning
+	client := &fakeClient{
+		pods: []v1.Pod{
+			pendingPod("systemd-logs-node2", "node2", time.Hour),
+			// Still within the grace period
+			pendingPod("systemd-logs-node3", "node3", -time.Hour),
+			running,
+		},
+		events: []v1.Event{
+			{Reason: "Scheduled", Message: "Successfully assigned", LastTimestamp: metav1.NewTime(time.Now().Add(-time.Minute))},
+			{Reason: "Failed", Message: `Failed to pull image "sonobuoy:nope"`, LastTimestamp: metav1.NewTime(time.Now())},
+		},
+	}
+	p := &sessionPlugin{fakePlugin{name: "systemd_logs", nodes: []string{"node1", "node2", "node3"}}}
+	aggr := NewAggregator("", p.ExpectedResults(nil))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	resultsCh := make(chan *plugin.Result, 3)
+	go watchPluginStartup(ctx, client, p, "heptio-sonobuoy-test", aggr, 40*time.Millisecond, resultsCh)
+
+	var result *plugin.Result
+	select {
+	case result = <-resultsCh:
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected an error for the pod which didn't start")
+	}
+	if result.NodeName != "node2" || result.ResultType != "systemd_logs" {
+		t.Errorf("expected an error for systemd_logs on node2, got %+v", result)
+	}
+	if !strings.Contains(result.Error, "systemd-logs-node2") || !strings.Contains(result.Error, `Failed: Failed to pull image "sonobuoy:nope"`) {
+		t.Errorf("expected the error to name the pod and include its latest event, got %q", result.Error)
+	}
+
+	// The pod should only be reported once
+	select {
+	case result = <-resultsCh:
+		t.Errorf("expected only one error, got another for %+v", result)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+func TestWatchPluginStartup_noSession(t *testing.T) {
+	// Plugins without a session ID can't be watched, so it should return
+	// straight away.
+	p := &fakePlugin{name: "e2e"}
+	watchPluginStartup(context.Background(), &fakeClient{}, p, "heptio-sonobuoy-test", NewAggregator("", p.ExpectedResults(nil)), time.Millisecond, nil)
+}
+
+func TestPodStartupProblem(t *testing.T) {
+	pod := pendingPod("e2e", "", time.Hour)
+	pod.Status.ContainerStatuses = []v1.ContainerStatus{{
+		Name:  "e2e",
+		State: v1.ContainerState{Waiting: &v1.ContainerStateWaiting{Reason: "ImagePullBackOff", Message: "Back-off pulling image"}},
+	}}
+
+	if got, want := podStartupProblem(&fakeClient{}, &pod, logrus.StandardLogger()), "container e2e is waiting: ImagePullBackOff Back-off pulling image"; got != want {
+		t.Errorf("expected %q without events, got %q", want, got)
+	}
+}
@@ -45,6 +45,11 @@ type PluginStatus struct {
 	Plugin string `json:"plugin"`
 	Node   string `json:"node"`
 	Status string `json:"status"`
+	// ErrorCategory classifies why the plugin failed on the node, if it
+	// did, as one of the plugin.ErrorCategory constants.
+	ErrorCategory string `json:"errorcategory,omitempty"`
+	// Progress is the last progress the plugin reported, if any.
+	Progress *PluginProgress `json:"progress,omitempty"`
 }
 
 // Status represents the current status of a Sonobuoy run.
@@ -52,6 +57,52 @@ type PluginStatus struct {
 type Status struct {
 	Plugins []PluginStatus `json:"plugins"`
 	Status  string         `json:"status"`
+	// Progress is read from its own annotation, and is nil if the
+	// aggregator hasn't reported it.
+	Progress *Progress `json:"-"`
+	// Missing is read from its own annotation, which is only set if the
+	// run timed out, listing the results which never arrived.
+	Missing []MissingResult `json:"-"`
+	// DiskFull is read from its own annotation, which is only set if a
+	// result couldn't be written because the results directory is full.
+	DiskFull string `json:"-"`
+	// Stalled is read from its own annotation, which is only set if
+	// heartbeats are enabled, listing the results whose workers have
+	// stopped sending them.
+	Stalled []StalledResult `json:"-"`
+	// RunID is read from its own annotation, which is only set if the run
+	// was stamped with an ID.
+	RunID string `json:"-"`
+}
+
+// MissingResult is a result which never arrived before the run timed out.
+type MissingResult struct {
+	Plugin string `json:"plugin"`
+	Node   string `json:"node,omitempty"`
+}
+
+// Progress is how many of the results a Sonobuoy run expects have been
+// received.
+type Progress struct {
+	Received int `json:"received"`
+	Expected int `json:"expected"`
+	// Percent is the percentage of results received, rounded down.
+	Percent int `json:"percent"`
+}
+
+// NewProgress returns the progress of a run which has received the given
+// number of the results it expects.
+func NewProgress(received, expected int) Progress {
+	percent := 100
+	if expected > 0 {
+		percent = received * 100 / expected
+	}
+	return Progress{Received: received, Expected: expected, Percent: percent}
+}
+
+// String formats the progress like "312/640 results (48%)".
+func (p Progress) String() string {
+	return fmt.Sprintf("%d/%d results (%d%%)", p.Received, p.Expected, p.Percent)
 }
 
 func (s *Status) updateStatus() error {
@@ -101,5 +152,27 @@ func GetStatus(client kubernetes.Interface, namespace string) (*Status, error) {
 		return nil, errors.Wrap(err, "couldn't unmarshal the JSON status annotation")
 	}
 
+	// Progress is only informational, so don't fail if it's missing
+	if progressJSON, ok := pod.Annotations[ProgressAnnotationName]; ok {
+		var progress Progress
+		if err := json.Unmarshal([]byte(progressJSON), &progress); err != nil {
+			return nil, errors.Wrap(err, "couldn't unmarshal the JSON progress annotation")
+		}
+		status.Progress = &progress
+	}
+
+	if missingJSON, ok := pod.Annotations[MissingAnnotationName]; ok {
+		if err := json.Unmarshal([]byte(missingJSON), &status.Missing); err != nil {
+			return nil, errors.Wrap(err, "couldn't unmarshal the JSON missing results annotation")
+		}
+	}
+	status.DiskFull = pod.Annotations[DiskFullAnnotationName]
+	status.RunID = pod.Annotations[RunIDAnnotationName]
+	if stalledJSON, ok := pod.Annotations[StalledAnnotationName]; ok {
+		if err := json.Unmarshal([]byte(stalledJSON), &status.Stalled); err != nil {
+			return nil, errors.Wrap(err, "couldn't unmarshal the JSON stalled results annotation")
+		}
+	}
+
 	return &status, nil
 }
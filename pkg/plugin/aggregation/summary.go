@@ -0,0 +1,139 @@
+/*
+Copyright 2018 Heptio Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package aggregation
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/heptio/sonobuoy/pkg/plugin"
+	"github.com/pkg/errors"
+)
+
+const (
+	// timeoutErrorPrefix starts the error message of results submitted on
+	// behalf of plugins which ran out of time.
+	timeoutErrorPrefix = "timed out waiting for plugin"
+	// nodeRemovedErrorPrefix starts the error message of results submitted
+	// on behalf of nodes which were removed from the cluster during the run.
+	nodeRemovedErrorPrefix = "node removed"
+	// notReportedErrorPrefix starts the error message of results recorded
+	// for nodes which hadn't reported when the completion threshold was
+	// reached.
+	notReportedErrorPrefix = "not reported"
+	// maxListedResults limits how many results are listed in an error.
+	maxListedResults = 20
+)
+
+// RunSummary describes the outcome of an aggregation run. Results are
+// identified by their ExpectedResult ID, e.g. "e2e" or "systemd_logs/node1".
+type RunSummary struct {
+	// Expected is the number of results the run was waiting for.
+	Expected int
+	// Completed lists the results which were submitted successfully.
+	Completed []string
+	// Failed maps the results which were submitted as errors to their error.
+	Failed map[string]string
+	// TimedOut lists the results which never arrived or whose plugin was
+	// stopped by a timeout.
+	TimedOut []string
+	// Removed lists the results which were dropped because their node was
+	// removed from the cluster during the run.
+	Removed []string
+	// NotReported lists the results which hadn't arrived when the
+	// completion threshold was reached.
+	NotReported []string
+	// Skipped lists the plugins which were never launched and why, sorted
+	// by name. Any results they were expected to submit are still counted
+	// above, e.g. as failed for plugins whose dependency failed.
+	Skipped []SkippedPlugin
+	// Plan is only set for dry runs, when nothing is run.
+	Plan *RunPlan
+}
+
+// Succeeded returns true if every expected result completed successfully,
+// other than those dropped because their node was removed or which hadn't
+// reported when the completion threshold was reached.
+func (s *RunSummary) Succeeded() bool {
+	return len(s.Completed)+len(s.Removed)+len(s.NotReported) == s.Expected
+}
+
+// newRunSummary builds the summary of a run given what results were expected
+// and which of them were received.
+func newRunSummary(expected []plugin.ExpectedResult, results map[string]*plugin.Result) *RunSummary {
+	summary := &RunSummary{
+		Expected: len(expected),
+		Failed:   map[string]string{},
+	}
+
+	for _, exp := range expected {
+		id := exp.ID()
+		result, ok := results[id]
+		switch {
+		case !ok, strings.HasPrefix(result.Error, timeoutErrorPrefix):
+			summary.TimedOut = append(summary.TimedOut, id)
+		case strings.HasPrefix(result.Error, nodeRemovedErrorPrefix):
+			summary.Removed = append(summary.Removed, id)
+		case strings.HasPrefix(result.Error, notReportedErrorPrefix):
+			summary.NotReported = append(summary.NotReported, id)
+		case !result.IsSuccess():
+			summary.Failed[id] = result.Error
+		default:
+			summary.Completed = append(summary.Completed, id)
+		}
+	}
+
+	sort.Strings(summary.Completed)
+	sort.Strings(summary.TimedOut)
+	sort.Strings(summary.Removed)
+	sort.Strings(summary.NotReported)
+	return summary
+}
+
+// summarize returns the summary of the results the aggregator has seen so far.
+func (a *Aggregator) summarize() *RunSummary {
+	a.resultsMutex.Lock()
+	defer a.resultsMutex.Unlock()
+
+	expected := make([]plugin.ExpectedResult, 0, len(a.ExpectedResults))
+	for _, exp := range a.ExpectedResults {
+		expected = append(expected, *exp)
+	}
+	summary := newRunSummary(expected, a.Results)
+	summary.Skipped = append([]SkippedPlugin(nil), a.skipped...)
+	sortSkipped(summary.Skipped)
+	return summary
+}
+
+// timeoutError returns the error for a run which timed out before the given
+// results were received, listing them so it's clear what hung.
+func timeoutError(missing []plugin.ExpectedResult) error {
+	if len(missing) == 0 {
+		return errors.New("timed out waiting for plugins, shutting down HTTP server")
+	}
+
+	ids := make([]string, 0, maxListedResults)
+	for i, result := range missing {
+		if i == maxListedResults {
+			ids = append(ids, fmt.Sprintf("and %v more", len(missing)-maxListedResults))
+			break
+		}
+		ids = append(ids, result.ID())
+	}
+	return errors.Errorf("timed out waiting for plugins, shutting down HTTP server: %v of the expected results never arrived: %v", len(missing), strings.Join(ids, ", "))
+}
@@ -0,0 +1,134 @@
+/*
+Copyright 2018 Heptio Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package aggregation
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/heptio/sonobuoy/pkg/plugin"
+)
+
+func TestNewRunSummary(t *testing.T) {
+	expected := []plugin.ExpectedResult{
+		{NodeName: "node1", ResultType: "systemd_logs"},
+		{NodeName: "node2", ResultType: "systemd_logs"},
+		{NodeName: "node3", ResultType: "systemd_logs"},
+		{ResultType: "e2e"},
+		{NodeName: "node4", ResultType: "systemd_logs"},
+		{ResultType: "slow"},
+	}
+	results := map[string]*plugin.Result{
+		"systemd_logs/node1": {NodeName: "node1", ResultType: "systemd_logs"},
+		"systemd_logs/node2": {NodeName: "node2", ResultType: "systemd_logs", Error: "Can't schedule pod"},
+		"systemd_logs/node4": {NodeName: "node4", ResultType: "systemd_logs", Error: nodeRemovedErrorPrefix + ": node node4 left the cluster during the run"},
+		"slow":               {ResultType: "slow", Error: timeoutErrorPrefix + " slow after 1m0s"},
+	}
+
+	summary := newRunSummary(expected, results)
+
+	if summary.Expected != 6 {
+		t.Errorf("expected 6 expected results, got %v", summary.Expected)
+	}
+	if want := []string{"systemd_logs/node1"}; !reflect.DeepEqual(summary.Completed, want) {
+		t.Errorf("expected completed %v, got %v", want, summary.Completed)
+	}
+	if want := map[string]string{"systemd_logs/node2": "Can't schedule pod"}; !reflect.DeepEqual(summary.Failed, want) {
+		t.Errorf("expected failed %v, got %v", want, summary.Failed)
+	}
+	if want := []string{"e2e", "slow", "systemd_logs/node3"}; !reflect.DeepEqual(summary.TimedOut, want) {
+		t.Errorf("expected timed out %v, got %v", want, summary.TimedOut)
+	}
+	if want := []string{"systemd_logs/node4"}; !reflect.DeepEqual(summary.Removed, want) {
+		t.Errorf("expected removed %v, got %v", want, summary.Removed)
+	}
+	if summary.Succeeded() {
+		t.Error("expected summary with failures not to succeed")
+	}
+}
+
+func TestRunSummary_succeededWithRemovedNodes(t *testing.T) {
+	expected := []plugin.ExpectedResult{
+		{NodeName: "node1", ResultType: "systemd_logs"},
+		{NodeName: "node2", ResultType: "systemd_logs"},
+	}
+	results := map[string]*plugin.Result{
+		"systemd_logs/node1": {NodeName: "node1", ResultType: "systemd_logs"},
+		"systemd_logs/node2": {NodeName: "node2", ResultType: "systemd_logs", Error: nodeRemovedErrorPrefix + ": node node2 left the cluster during the run"},
+	}
+
+	if summary := newRunSummary(expected, results); !summary.Succeeded() {
+		t.Errorf("expected results dropped for removed nodes not to fail the run, got %+v", summary)
+	}
+}
+
+func TestRunSummary_succeededWithNotReported(t *testing.T) {
+	expected := []plugin.ExpectedResult{
+		{NodeName: "node1", ResultType: "systemd_logs"},
+		{NodeName: "node2", ResultType: "systemd_logs"},
+	}
+	results := map[string]*plugin.Result{
+		"systemd_logs/node1": {NodeName: "node1", ResultType: "systemd_logs"},
+		"systemd_logs/node2": {NodeName: "node2", ResultType: "systemd_logs", Error: notReportedErrorPrefix + ": node node2 hadn't reported when the completion threshold was reached"},
+	}
+
+	summary := newRunSummary(expected, results)
+	if want := []string{"systemd_logs/node2"}; !reflect.DeepEqual(summary.NotReported, want) {
+		t.Errorf("expected not reported %v, got %v", want, summary.NotReported)
+	}
+	if !summary.Succeeded() {
+		t.Errorf("expected results which weren't reported not to fail the run, got %+v", summary)
+	}
+}
+
+func TestTimeoutError(t *testing.T) {
+	missing := []plugin.ExpectedResult{
+		{ResultType: "e2e"},
+		{NodeName: "node2", ResultType: "systemd_logs"},
+	}
+	want := "timed out waiting for plugins, shutting down HTTP server: 2 of the expected results never arrived: e2e, systemd_logs/node2"
+	if err := timeoutError(missing); err.Error() != want {
+		t.Errorf("expected error %q, got %q", want, err)
+	}
+
+	// Only so many results are listed on large clusters
+	for i := len(missing); i < maxListedResults+5; i++ {
+		missing = append(missing, plugin.ExpectedResult{NodeName: fmt.Sprintf("node%v", i+1), ResultType: "systemd_logs"})
+	}
+	if err := timeoutError(missing); !strings.HasSuffix(err.Error(), ", and 5 more") {
+		t.Errorf("expected the list of missing results to be truncated, got %q", err)
+	}
+}
+
+func TestAggregator_MissingResults(t *testing.T) {
+	aggr := NewAggregator("", []plugin.ExpectedResult{
+		{NodeName: "node2", ResultType: "systemd_logs"},
+		{NodeName: "node1", ResultType: "systemd_logs"},
+		{ResultType: "e2e"},
+	})
+	aggr.Results["systemd_logs/node1"] = &plugin.Result{NodeName: "node1", ResultType: "systemd_logs"}
+
+	want := []plugin.ExpectedResult{
+		{ResultType: "e2e"},
+		{NodeName: "node2", ResultType: "systemd_logs"},
+	}
+	if got := aggr.MissingResults(); !reflect.DeepEqual(got, want) {
+		t.Errorf("expected missing results %v, got %v", want, got)
+	}
+}
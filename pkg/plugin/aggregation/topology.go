@@ -0,0 +1,167 @@
+/*
+Copyright 2018 Heptio Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package aggregation
+
+import (
+	"path"
+	"sort"
+	"sync"
+
+	"github.com/heptio/sonobuoy/pkg/plugin"
+	v1 "k8s.io/api/core/v1"
+)
+
+// noTopology is the directory TopologyLayout groups the results of nodes
+// without the topology label in. Label values start with an alphanumeric
+// character, so it can't be mistaken for one.
+const noTopology = "_none"
+
+// ManifestTopology groups the node results in the manifest by the value of
+// the topology label on their node.
+type ManifestTopology struct {
+	Label string `json:"label"`
+	// Groups are sorted by value.
+	Groups []TopologyGroup `json:"groups"`
+}
+
+// TopologyGroup counts the results of the nodes with the same value of the
+// topology label, e.g. the nodes in one zone.
+type TopologyGroup struct {
+	// Value is empty for the nodes without the label.
+	Value   string `json:"value"`
+	Nodes   int    `json:"nodes"`
+	Results int    `json:"results"`
+	// Statuses counts the results by status, e.g. {"complete": 40,
+	// "failed": 12}.
+	Statuses map[string]int `json:"statuses"`
+}
+
+// TopologyLayout is the nested layout, but with node results grouped by the
+// topology of their node, e.g. systemd_logs/results/us-east-1a/node1. The
+// results of nodes without the topology label are in a directory named
+// _none.
+type TopologyLayout struct{}
+
+// ResultPath returns the nested path of the result, with the topology of its
+// node, if any, ahead of the node.
+func (TopologyLayout) ResultPath(result *plugin.Result) string {
+	if result.NodeName == "" {
+		return result.Path()
+	}
+	topology := result.Topology
+	if topology == "" {
+		topology = noTopology
+	}
+	grouped := *result
+	grouped.NodeName = path.Join(topology, result.NodeName)
+	return grouped.Path()
+}
+
+// setTopology sets the topology of each node-specific expected result to the
+// value of the label on its node. Nothing is set if the label is empty.
+func setTopology(expected []plugin.ExpectedResult, nodes []v1.Node, label string) {
+	if label == "" {
+		return
+	}
+	values := make(map[string]string, len(nodes))
+	for _, node := range nodes {
+		values[node.Name] = node.Labels[label]
+	}
+	for i := range expected {
+		if expected[i].NodeName != "" {
+			expected[i].Topology = values[expected[i].NodeName]
+		}
+	}
+}
+
+// nodeTopologies maps nodes to their topology, as recorded in the results
+// expected from them. It's safe for concurrent use, since the paths of
+// results are worked out without the aggregator's resultsMutex held. Nodes
+// are never removed, so that results from nodes which left are still
+// grouped.
+type nodeTopologies struct {
+	mu     sync.RWMutex
+	values map[string]string
+}
+
+// add records the topology of the nodes of the expected results.
+func (t *nodeTopologies) add(expected []plugin.ExpectedResult) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for _, exp := range expected {
+		if exp.NodeName == "" || exp.Topology == "" {
+			continue
+		}
+		if t.values == nil {
+			t.values = map[string]string{}
+		}
+		t.values[exp.NodeName] = exp.Topology
+	}
+}
+
+// of returns the topology of the node, or an empty string if it's unknown.
+func (t *nodeTopologies) of(node string) string {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	return t.values[node]
+}
+
+// withTopology returns the result with the topology of its node set,
+// copying it rather than changing a result which may be in use elsewhere.
+func (a *Aggregator) withTopology(result *plugin.Result) *plugin.Result {
+	if result.NodeName == "" || result.Topology != "" {
+		return result
+	}
+	topology := a.topologies.of(result.NodeName)
+	if topology == "" {
+		return result
+	}
+	tagged := *result
+	tagged.Topology = topology
+	return &tagged
+}
+
+// groupByTopology counts the node results among the entries by the topology
+// of their node.
+func groupByTopology(label string, entries map[string]ManifestEntry) *ManifestTopology {
+	groups := map[string]*TopologyGroup{}
+	nodes := map[string]map[string]bool{}
+	for _, entry := range entries {
+		if entry.Node == "" {
+			continue
+		}
+		group := groups[entry.Topology]
+		if group == nil {
+			group = &TopologyGroup{Value: entry.Topology, Statuses: map[string]int{}}
+			groups[entry.Topology] = group
+			nodes[entry.Topology] = map[string]bool{}
+		}
+		group.Results++
+		group.Statuses[entry.Status]++
+		nodes[entry.Topology][entry.Node] = true
+	}
+
+	topology := &ManifestTopology{Label: label, Groups: make([]TopologyGroup, 0, len(groups))}
+	for value, group := range groups {
+		group.Nodes = len(nodes[value])
+		topology.Groups = append(topology.Groups, *group)
+	}
+	sort.Slice(topology.Groups, func(i, j int) bool {
+		return topology.Groups[i].Value < topology.Groups[j].Value
+	})
+	return topology
+}
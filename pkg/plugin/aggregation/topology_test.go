@@ -0,0 +1,140 @@
+/*
+Copyright 2018 Heptio Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package aggregation
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/heptio/sonobuoy/pkg/plugin"
+	pluginutils "github.com/heptio/sonobuoy/pkg/plugin/driver/utils"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+const zoneLabel = "topology.kubernetes.io/zone"
+
+func zonedNode(name, zone string) v1.Node {
+	node := v1.Node{ObjectMeta: metav1.ObjectMeta{Name: name}}
+	if zone != "" {
+		node.Labels = map[string]string{zoneLabel: zone}
+	}
+	return node
+}
+
+func TestTopologyLayout(t *testing.T) {
+	testCases := []struct {
+		desc   string
+		result *plugin.Result
+		want   string
+	}{
+		{desc: "global", result: &plugin.Result{ResultType: "e2e", Topology: "us-east-1a"}, want: "e2e/results"},
+		{desc: "node", result: &plugin.Result{ResultType: "systemd_logs", NodeName: "node1", Topology: "us-east-1a"}, want: "systemd_logs/results/us-east-1a/node1"},
+		{desc: "node error", result: &plugin.Result{ResultType: "systemd_logs", NodeName: "node1", Topology: "us-east-1a", Error: "foo"}, want: "systemd_logs/errors/us-east-1a/node1"},
+		{desc: "partial", result: &plugin.Result{ResultType: "systemd_logs", NodeName: "node1", Topology: "us-east-1a", Partial: true, Sequence: 3}, want: "systemd_logs/partial/us-east-1a/node1/00000003"},
+		{desc: "unlabelled node", result: &plugin.Result{ResultType: "systemd_logs", NodeName: "node1"}, want: "systemd_logs/results/_none/node1"},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.desc, func(t *testing.T) {
+			if got := (TopologyLayout{}).ResultPath(tc.result); got != tc.want {
+				t.Errorf("expected %v, got %v", tc.want, got)
+			}
+		})
+	}
+}
+
+func TestSetTopology(t *testing.T) {
+	nodes := []v1.Node{zonedNode("node1", "us-east-1a"), zonedNode("node2", "")}
+	expected := []plugin.ExpectedResult{
+		{NodeName: "node1", ResultType: "systemd_logs"},
+		{NodeName: "node2", ResultType: "systemd_logs"},
+		{ResultType: "e2e"},
+	}
+	setTopology(expected, nodes, zoneLabel)
+
+	want := []plugin.ExpectedResult{
+		{NodeName: "node1", ResultType: "systemd_logs", Topology: "us-east-1a"},
+		{NodeName: "node2", ResultType: "systemd_logs"},
+		{ResultType: "e2e"},
+	}
+	if !reflect.DeepEqual(expected, want) {
+		t.Errorf("expected %+v, got %+v", want, expected)
+	}
+}
+
+func TestAggregation_topology(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sonobuoy_topology_test")
+	if err != nil {
+		t.Fatalf("Could not create temp directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	expected := []plugin.ExpectedResult{
+		{NodeName: "node1", ResultType: "systemd_logs", Topology: "us-east-1a"},
+		{NodeName: "node2", ResultType: "systemd_logs", Topology: "us-east-1a"},
+		{NodeName: "node3", ResultType: "systemd_logs", Topology: "us-east-1b"},
+		{ResultType: "e2e"},
+	}
+	aggr := NewAggregator(path.Join(dir, "plugins"), expected)
+	aggr.Layout = TopologyLayout{}
+	aggr.manifest = newResultsManifest(dir, nil)
+	aggr.manifest.topologyLabel = zoneLabel
+
+	// node4 joins without the label
+	aggr.expectResults([]plugin.ExpectedResult{{NodeName: "node4", ResultType: "systemd_logs"}})
+
+	resultsCh := make(chan *plugin.Result, 5)
+	resultsCh <- &plugin.Result{ResultType: "systemd_logs", NodeName: "node1", Body: strings.NewReader("foo")}
+	resultsCh <- pluginutils.MakeErrorResult("systemd_logs", map[string]interface{}{"error": "foo"}, "node2")
+	resultsCh <- pluginutils.MakeErrorResult("systemd_logs", map[string]interface{}{"error": "foo"}, "node3")
+	resultsCh <- &plugin.Result{ResultType: "systemd_logs", NodeName: "node4", Body: strings.NewReader("foo")}
+	resultsCh <- &plugin.Result{ResultType: "e2e", Body: strings.NewReader("foo")}
+	close(resultsCh)
+	aggr.IngestResults(resultsCh)
+
+	for _, p := range []string{
+		"systemd_logs/results/us-east-1a/node1",
+		"systemd_logs/errors/us-east-1a/node2",
+		"systemd_logs/errors/us-east-1b/node3",
+		"systemd_logs/results/_none/node4",
+		"e2e/results",
+	} {
+		if _, err := os.Stat(path.Join(dir, "plugins", p)); err != nil {
+			t.Errorf("expected a result at %v: %v", p, err)
+		}
+	}
+
+	manifest := readManifest(t, dir)
+	for _, entry := range manifest.Results {
+		if entry.Node == "node1" && entry.Topology != "us-east-1a" {
+			t.Errorf("expected node1's result to be tagged with its zone, got %+v", entry)
+		}
+	}
+	want := &ManifestTopology{Label: zoneLabel, Groups: []TopologyGroup{
+		{Value: "", Nodes: 1, Results: 1, Statuses: map[string]int{CompleteStatus: 1}},
+		{Value: "us-east-1a", Nodes: 2, Results: 2, Statuses: map[string]int{CompleteStatus: 1, FailedStatus: 1}},
+		{Value: "us-east-1b", Nodes: 1, Results: 1, Statuses: map[string]int{FailedStatus: 1}},
+	}}
+	if !reflect.DeepEqual(manifest.Topology, want) {
+		t.Errorf("expected the node results to be grouped by zone as %+v, got %+v", want, manifest.Topology)
+	}
+}
@@ -0,0 +1,198 @@
+/*
+Copyright 2018 Heptio Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package aggregation
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+
+	"github.com/heptio/sonobuoy/pkg/encryption"
+	"github.com/heptio/sonobuoy/pkg/plugin"
+	"github.com/pkg/errors"
+)
+
+// ResultTransform rewrites the body of a result from the given plugin before
+// it is written to disk, e.g. to redact sensitive data. Archives are
+// transformed one file at a time once they have been extracted.
+type ResultTransform func(plugin string, r io.Reader) (io.Reader, error)
+
+// redactedText replaces everything RedactSecrets removes.
+const redactedText = "[REDACTED]"
+
+// maxRedactLine is the longest line RedactSecrets matches patterns against.
+// Longer lines are redacted in pieces so binary data doesn't have to fit
+// in memory.
+const maxRedactLine = 64 * 1024
+
+var (
+	secretPatterns = []struct {
+		re   *regexp.Regexp
+		repl []byte
+	}{
+		// Authorization headers, e.g. in logged requests
+		{regexp.MustCompile(`(?i)(\bbearer\s+)[A-Za-z0-9\-._~+/]+=*`), []byte("${1}" + redactedText)},
+		// JSON web tokens, such as service account tokens
+		{regexp.MustCompile(`\beyJ[A-Za-z0-9_-]{4,}\.[A-Za-z0-9_-]{4,}\.[A-Za-z0-9_-]+`), []byte(redactedText)},
+		// kubeconfig credentials and other secrets as YAML, JSON or flags
+		{regexp.MustCompile(`(?i)(\b(?:client-key-data|client-certificate-data|token|access-token|id-token|refresh-token|password)["']?\s*[:=]\s*["']?)[^\s"',}]+`), []byte("${1}" + redactedText)},
+	}
+	privateKeyBegin = regexp.MustCompile(`-----BEGIN [A-Z ]*PRIVATE KEY-----`)
+	privateKeyEnd   = regexp.MustCompile(`-----END [A-Z ]*PRIVATE KEY-----`)
+)
+
+// RedactSecrets is a ResultTransform which redacts common Kubernetes secrets:
+// bearer tokens, service account tokens, credentials in kubeconfigs and the
+// contents of PEM encoded private keys.
+func RedactSecrets(_ string, r io.Reader) (io.Reader, error) {
+	return &redactingReader{r: bufio.NewReaderSize(r, maxRedactLine)}, nil
+}
+
+// redactingReader redacts secrets a line at a time.
+type redactingReader struct {
+	r   *bufio.Reader
+	buf []byte
+	err error
+	// inKey is true between the BEGIN and END lines of a private key.
+	inKey bool
+}
+
+func (rr *redactingReader) Read(p []byte) (int, error) {
+	for len(rr.buf) == 0 {
+		if rr.err != nil {
+			return 0, rr.err
+		}
+		line, err := rr.r.ReadSlice('\n')
+		if err == bufio.ErrBufferFull {
+			err = nil
+		}
+		rr.err = err
+		rr.buf = rr.redact(line)
+	}
+	n := copy(p, rr.buf)
+	rr.buf = rr.buf[n:]
+	return n, nil
+}
+
+func (rr *redactingReader) redact(line []byte) []byte {
+	switch {
+	case rr.inKey && privateKeyEnd.Match(line):
+		rr.inKey = false
+	case rr.inKey:
+		// Keep the line ending so line numbers are unchanged
+		if bytes.HasSuffix(line, []byte("\n")) {
+			return []byte(redactedText + "\n")
+		}
+		return []byte(redactedText)
+	case privateKeyBegin.Match(line):
+		rr.inKey = !privateKeyEnd.Match(line)
+		if !rr.inKey {
+			// A key on a single line, e.g. in JSON
+			return privateKeyBegin.ReplaceAll(append([]byte(nil), line...), []byte(redactedText))
+		}
+	}
+
+	// ReadSlice's buffer is reused, so always return a copy
+	out := append([]byte(nil), line...)
+	for _, pattern := range secretPatterns {
+		out = pattern.re.ReplaceAll(out, pattern.repl)
+	}
+	return out
+}
+
+// EncryptResults returns a ResultTransform which encrypts results with a key
+// derived from the secret. It must be the last transform, since the others
+// can't make sense of what it returns.
+func EncryptResults(secret []byte) ResultTransform {
+	return func(_ string, r io.Reader) (io.Reader, error) {
+		return encryption.NewEncrypter(r, secret)
+	}
+}
+
+// transformError is returned when a transform fails. The result is recorded
+// as an error rather than keeping what may be a partly transformed file.
+func transformError(err error) error {
+	return &rejectedResultError{
+		status: http.StatusInternalServerError,
+		msg:    fmt.Sprintf("couldn't transform result: %v", err),
+	}
+}
+
+// transform passes the body of the result through each of the Transforms.
+func (a *Aggregator) transform(result *plugin.Result, body io.Reader) (io.Reader, error) {
+	for _, t := range a.Transforms {
+		var err error
+		if body, err = t(result.ResultType, body); err != nil {
+			return nil, transformError(err)
+		}
+	}
+	return body, nil
+}
+
+// transformArchive applies the Transforms to each file extracted from an
+// archive result.
+func (a *Aggregator) transformArchive(result *plugin.Result) error {
+	if len(a.Transforms) == 0 {
+		return nil
+	}
+
+	resultsDir := a.resultPath(result)
+	return filepath.Walk(resultsDir, func(filename string, info os.FileInfo, err error) error {
+		if err != nil {
+			return errors.Wrapf(err, "couldn't walk %v", filename)
+		}
+		if !info.Mode().IsRegular() {
+			return nil
+		}
+		return a.transformFile(result, filename, info.Mode())
+	})
+}
+
+// transformFile replaces the file with its transformed contents.
+func (a *Aggregator) transformFile(result *plugin.Result, filename string, mode os.FileMode) error {
+	in, err := os.Open(filename)
+	if err != nil {
+		return errors.Wrapf(err, "couldn't open %v", filename)
+	}
+	defer in.Close()
+
+	body, err := a.transform(result, in)
+	if err != nil {
+		return err
+	}
+
+	tmp := filename + ".tmp"
+	out, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, mode)
+	if err != nil {
+		return errors.Wrapf(err, "couldn't create %v", tmp)
+	}
+	if _, err := io.Copy(out, body); err != nil {
+		out.Close()
+		os.Remove(tmp)
+		return transformError(err)
+	}
+	if err := out.Close(); err != nil {
+		os.Remove(tmp)
+		return errors.Wrapf(err, "couldn't write %v", tmp)
+	}
+	return errors.Wrapf(os.Rename(tmp, filename), "couldn't replace %v", filename)
+}
@@ -17,13 +17,18 @@ limitations under the License.
 package aggregation
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
+	"math"
+	"strconv"
 	"sync"
+	"time"
 
 	"github.com/pkg/errors"
 	"github.com/sirupsen/logrus"
 	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/wait"
 	"k8s.io/client-go/kubernetes"
 
 	"github.com/heptio/sonobuoy/pkg/plugin"
@@ -31,7 +36,31 @@ import (
 
 const (
 	StatusAnnotationName = "sonobuoy.hept.io/status"
-	StatusPodName        = "sonobuoy"
+	// ProgressAnnotationName is the annotation recording how many of the
+	// expected results have been received.
+	ProgressAnnotationName = "sonobuoy.hept.io/progress"
+	// MissingAnnotationName is the annotation listing the results which
+	// never arrived, set when the run times out.
+	MissingAnnotationName = "sonobuoy.hept.io/missing"
+	// DiskFullAnnotationName is the annotation with the error of the first
+	// result which couldn't be written because the results directory is
+	// full.
+	DiskFullAnnotationName = "sonobuoy.hept.io/disk-full"
+	// StalledAnnotationName is the annotation listing the results whose
+	// workers have stopped sending heartbeats, set while heartbeats are
+	// enabled.
+	StalledAnnotationName = "sonobuoy.hept.io/stalled"
+	// PortAnnotationName is the annotation with the port the aggregation
+	// server bound to, set when BindPort is 0 so the OS chose it.
+	PortAnnotationName = "sonobuoy.hept.io/port"
+	// RunIDAnnotationName is the annotation with the ID of the run, set
+	// when the run is stamped with one.
+	RunIDAnnotationName = "sonobuoy.hept.io/run-id"
+	StatusPodName       = "sonobuoy"
+
+	// maxAnnotationBackoff caps how long annotation updates back off for
+	// while they keep failing.
+	maxAnnotationBackoff = 2 * time.Minute
 )
 
 // node and name uniquely identify a single plugin result
@@ -46,6 +75,7 @@ type updater struct {
 	status         Status
 	namespace      string
 	client         kubernetes.Interface
+	log            logrus.FieldLogger
 }
 
 // newUpdater creates an an updater that expects ExpectedResult.
@@ -58,6 +88,7 @@ func newUpdater(expected []plugin.ExpectedResult, namespace string, client kuber
 		},
 		namespace: namespace,
 		client:    client,
+		log:       logrus.StandardLogger(),
 	}
 
 	for i, result := range expected {
@@ -77,6 +108,29 @@ func expectedToKey(result plugin.ExpectedResult) key {
 	return key{node: result.NodeName, name: result.ResultType}
 }
 
+// expect adds the given results to the status as running.
+func (u *updater) expect(expected []plugin.ExpectedResult) {
+	u.Lock()
+	defer u.Unlock()
+
+	for _, result := range expected {
+		if _, ok := u.positionLookup[expectedToKey(result)]; ok {
+			continue
+		}
+		u.status.Plugins = append(u.status.Plugins, PluginStatus{
+			Node:   result.NodeName,
+			Plugin: result.ResultType,
+			Status: RunningStatus,
+		})
+	}
+
+	// Appending may have moved the statuses, so rebuild the lookup
+	for i := range u.status.Plugins {
+		u.positionLookup[key{node: u.status.Plugins[i].Node, name: u.status.Plugins[i].Plugin}] = &u.status.Plugins[i]
+	}
+	u.status.updateStatus()
+}
+
 // Receive updates an individual plugin's status.
 func (u *updater) Receive(update *PluginStatus) error {
 	u.Lock()
@@ -88,9 +142,24 @@ func (u *updater) Receive(update *PluginStatus) error {
 	}
 
 	status.Status = update.Status
+	status.ErrorCategory = update.ErrorCategory
 	return u.status.updateStatus()
 }
 
+// ReceiveProgress records the progress plugins have reported in the status.
+func (u *updater) ReceiveProgress(reports []ProgressReport) {
+	u.Lock()
+	defer u.Unlock()
+	for _, report := range reports {
+		status, ok := u.positionLookup[key{node: report.NodeName, name: report.ResultType}]
+		if !ok {
+			continue
+		}
+		progress := report.Progress
+		status.Progress = &progress
+	}
+}
+
 // Serialize json-encodes the status object.
 func (u *updater) Serialize() (string, error) {
 	u.RLock()
@@ -99,17 +168,39 @@ func (u *updater) Serialize() (string, error) {
 	return string(bytes), errors.Wrap(err, "couldn't marshall status")
 }
 
-// Annotate serialises the status json, then annotates the aggregator pod with the status.
-func (u *updater) Annotate(results map[string]*plugin.Result) error {
-	u.ReceiveAll(results)
+// Progress returns how many of the expected results have been received.
+// Every node a plugin runs on counts separately.
+func (u *updater) Progress() Progress {
 	u.RLock()
 	defer u.RUnlock()
+
+	received := 0
+	for _, status := range u.status.Plugins {
+		if status.Status != RunningStatus {
+			received++
+		}
+	}
+	return NewProgress(received, len(u.status.Plugins))
+}
+
+// Annotate serialises the status json, then annotates the aggregator pod with the status
+// and progress.
+func (u *updater) Annotate(results map[string]*plugin.Result) error {
+	u.ReceiveAll(results)
 	str, err := u.Serialize()
 	if err != nil {
 		return errors.Wrap(err, "couldn't serialize status")
 	}
 
-	patch := GetPatch(str)
+	progress, err := json.Marshal(u.Progress())
+	if err != nil {
+		return errors.Wrap(err, "couldn't marshal progress")
+	}
+
+	patch := getPatch(map[string]string{
+		StatusAnnotationName:   str,
+		ProgressAnnotationName: string(progress),
+	})
 	bytes, err := json.Marshal(patch)
 	if err != nil {
 		return errors.Wrap(err, "couldn't encode patch")
@@ -119,6 +210,204 @@ func (u *updater) Annotate(results map[string]*plugin.Result) error {
 	return errors.Wrap(err, "couldn't patch pod annotation")
 }
 
+// AnnotateMissing annotates the aggregator pod with the results which never
+// arrived.
+func (u *updater) AnnotateMissing(missing []plugin.ExpectedResult) error {
+	results := make([]MissingResult, len(missing))
+	for i, result := range missing {
+		results[i] = MissingResult{Plugin: result.ResultType, Node: result.NodeName}
+	}
+	blob, err := json.Marshal(results)
+	if err != nil {
+		return errors.Wrap(err, "couldn't marshal missing results")
+	}
+
+	bytes, err := json.Marshal(getPatch(map[string]string{MissingAnnotationName: string(blob)}))
+	if err != nil {
+		return errors.Wrap(err, "couldn't encode patch")
+	}
+
+	_, err = u.client.CoreV1().Pods(u.namespace).Patch(StatusPodName, types.MergePatchType, bytes)
+	return errors.Wrap(err, "couldn't patch pod annotation")
+}
+
+// AnnotateStalled annotates the aggregator pod with the results whose
+// workers have stopped sending heartbeats, which may be none once they've
+// all resumed.
+func (u *updater) AnnotateStalled(stalled []StalledResult) error {
+	if stalled == nil {
+		stalled = []StalledResult{}
+	}
+	blob, err := json.Marshal(stalled)
+	if err != nil {
+		return errors.Wrap(err, "couldn't marshal stalled results")
+	}
+
+	bytes, err := json.Marshal(getPatch(map[string]string{StalledAnnotationName: string(blob)}))
+	if err != nil {
+		return errors.Wrap(err, "couldn't encode patch")
+	}
+
+	_, err = u.client.CoreV1().Pods(u.namespace).Patch(StatusPodName, types.MergePatchType, bytes)
+	return errors.Wrap(err, "couldn't patch pod annotation")
+}
+
+// AnnotateDiskFull annotates the aggregator pod with the error of a result
+// which couldn't be written because the results directory is full.
+func (u *updater) AnnotateDiskFull(errMsg string) error {
+	bytes, err := json.Marshal(getPatch(map[string]string{DiskFullAnnotationName: errMsg}))
+	if err != nil {
+		return errors.Wrap(err, "couldn't encode patch")
+	}
+
+	_, err = u.client.CoreV1().Pods(u.namespace).Patch(StatusPodName, types.MergePatchType, bytes)
+	return errors.Wrap(err, "couldn't patch pod annotation")
+}
+
+// AnnotatePort annotates the aggregator pod with the port the aggregation
+// server is listening on.
+func (u *updater) AnnotatePort(port int) error {
+	bytes, err := json.Marshal(getPatch(map[string]string{PortAnnotationName: strconv.Itoa(port)}))
+	if err != nil {
+		return errors.Wrap(err, "couldn't encode patch")
+	}
+
+	_, err = u.client.CoreV1().Pods(u.namespace).Patch(StatusPodName, types.MergePatchType, bytes)
+	return errors.Wrap(err, "couldn't patch pod annotation")
+}
+
+// AnnotateRunID annotates the aggregator pod with the ID of the run.
+func (u *updater) AnnotateRunID(runID string) error {
+	bytes, err := json.Marshal(getPatch(map[string]string{RunIDAnnotationName: runID}))
+	if err != nil {
+		return errors.Wrap(err, "couldn't encode patch")
+	}
+
+	_, err = u.client.CoreV1().Pods(u.namespace).Patch(StatusPodName, types.MergePatchType, bytes)
+	return errors.Wrap(err, "couldn't patch pod annotation")
+}
+
+// AnnotationPause pauses the regular annotation of the aggregator pod, e.g.
+// while the API server rejects writes during maintenance, without stopping
+// the run. Results are still collected while annotations are paused, and
+// the status is annotated as soon as they're resumed. It's safe to use from
+// any goroutine, and the zero value isn't paused.
+type AnnotationPause struct {
+	mu sync.Mutex
+	// resumed is closed when annotations are resumed; it's nil unless
+	// they're paused.
+	resumed chan struct{}
+}
+
+// Pause pauses annotations, returning false if they already were.
+func (p *AnnotationPause) Pause() bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.resumed != nil {
+		return false
+	}
+	p.resumed = make(chan struct{})
+	return true
+}
+
+// Resume resumes annotations, returning false if they weren't paused.
+func (p *AnnotationPause) Resume() bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.resumed == nil {
+		return false
+	}
+	close(p.resumed)
+	p.resumed = nil
+	return true
+}
+
+// Paused returns whether annotations are paused.
+func (p *AnnotationPause) Paused() bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.resumed != nil
+}
+
+// waitCh returns a channel which is closed once annotations are resumed, or
+// nil if they aren't paused.
+func (p *AnnotationPause) waitCh() <-chan struct{} {
+	if p == nil {
+		return nil
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.resumed
+}
+
+// annotateUntil calls annotate straight away and then every period, with
+// the given jitter, until ctx is done. While annotate keeps failing, e.g.
+// because the API server is flapping, the interval is doubled after each
+// failure up to maxInterval so that it isn't hammered, and reset as soon as
+// annotate succeeds. While pause, if set, is paused annotate isn't called;
+// it's called straight away on resuming, with the backoff reset.
+func annotateUntil(ctx context.Context, period time.Duration, jitter float64, maxInterval time.Duration, pause *AnnotationPause, log logrus.FieldLogger, annotate func() error) {
+	if maxInterval < period {
+		maxInterval = period
+	}
+	newBackoff := func() wait.Backoff {
+		return wait.Backoff{
+			Duration: period,
+			Factor:   2,
+			Jitter:   jitter,
+			Steps:    math.MaxInt32,
+			Cap:      maxInterval,
+		}
+	}
+	backoff := newBackoff()
+	failures := 0
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		default:
+		}
+
+		if resumed := pause.waitCh(); resumed != nil {
+			log.Info("Annotation updates paused")
+			select {
+			case <-ctx.Done():
+				return
+			case <-resumed:
+			}
+			log.Info("Annotation updates resumed")
+			failures = 0
+			backoff = newBackoff()
+		}
+
+		var interval time.Duration
+		if err := annotate(); err != nil {
+			failures++
+			interval = backoff.Step()
+			log.WithError(err).WithFields(logrus.Fields{
+				"failures": failures,
+				"retry_in": interval,
+			}).Info("couldn't annotate sonobuoy pod")
+		} else {
+			failures = 0
+			backoff = newBackoff()
+			interval = period
+			if jitter > 0 {
+				interval = wait.Jitter(period, jitter)
+			}
+		}
+
+		t := time.NewTimer(interval)
+		select {
+		case <-ctx.Done():
+			t.Stop()
+			return
+		case <-t.C:
+		}
+	}
+}
+
 // TODO (tstclair): Evaluate if this should be exported.
 // ReceiveAll takes a map of plugin.Result and calls Receive on all of them.
 func (u *updater) ReceiveAll(results map[string]*plugin.Result) {
@@ -129,13 +418,14 @@ func (u *updater) ReceiveAll(results map[string]*plugin.Result) {
 			state = "failed"
 		}
 		update := PluginStatus{
-			Node:   result.NodeName,
-			Plugin: result.ResultType,
-			Status: state,
+			Node:          result.NodeName,
+			Plugin:        result.ResultType,
+			Status:        state,
+			ErrorCategory: errorCategory(result),
 		}
 
 		if err := u.Receive(&update); err != nil {
-			logrus.WithFields(
+			u.log.WithFields(
 				logrus.Fields{
 					"node":   update.Node,
 					"plugin": update.Plugin,
@@ -149,11 +439,15 @@ func (u *updater) ReceiveAll(results map[string]*plugin.Result) {
 // GetPatch takes a json encoded string and creates a map which can be used as
 // a patch to indicate the Sonobuoy status.
 func GetPatch(annotation string) map[string]interface{} {
+	return getPatch(map[string]string{StatusAnnotationName: annotation})
+}
+
+// getPatch creates a map which can be used as a patch to set the given
+// annotations.
+func getPatch(annotations map[string]string) map[string]interface{} {
 	return map[string]interface{}{
 		"metadata": map[string]interface{}{
-			"annotations": map[string]string{
-				StatusAnnotationName: annotation,
-			},
+			"annotations": annotations,
 		},
 	}
 }
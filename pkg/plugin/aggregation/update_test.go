@@ -17,9 +17,14 @@ limitations under the License.
 package aggregation
 
 import (
+	"context"
+	"encoding/json"
 	"testing"
+	"time"
 
 	"github.com/heptio/sonobuoy/pkg/plugin"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
 )
 
 func TestCreateUpdater(t *testing.T) {
@@ -47,3 +52,158 @@ func TestCreateUpdater(t *testing.T) {
 		t.Errorf("expected status to be failed, got %v", updater.status.Status)
 	}
 }
+
+func TestUpdaterReceiveAll_errorCategory(t *testing.T) {
+	expected := []plugin.ExpectedResult{
+		{NodeName: "node1", ResultType: "systemd"},
+		{NodeName: "node2", ResultType: "systemd"},
+		{NodeName: "node3", ResultType: "systemd"},
+	}
+	updater := newUpdater(expected, "heptio-sonobuoy-test", nil)
+	updater.ReceiveAll(map[string]*plugin.Result{
+		"systemd/node1": {NodeName: "node1", ResultType: "systemd"},
+		"systemd/node2": {NodeName: "node2", ResultType: "systemd", Error: "can't pull", ErrorCategory: plugin.ErrorCategoryImagePull},
+		"systemd/node3": {NodeName: "node3", ResultType: "systemd", Error: "failed"},
+	})
+
+	want := map[string]string{"node1": "", "node2": plugin.ErrorCategoryImagePull, "node3": plugin.ErrorCategoryUnknown}
+	for _, status := range updater.status.Plugins {
+		if status.ErrorCategory != want[status.Node] {
+			t.Errorf("expected %v to have error category %q, got %q", status.Node, want[status.Node], status.ErrorCategory)
+		}
+	}
+}
+
+func TestUpdaterProgress(t *testing.T) {
+	expected := []plugin.ExpectedResult{
+		{NodeName: "node1", ResultType: "systemd"},
+		{NodeName: "node2", ResultType: "systemd"},
+		{NodeName: "node3", ResultType: "systemd"},
+		{NodeName: "", ResultType: "e2e"},
+	}
+	client := &fakeClient{}
+	updater := newUpdater(expected, "heptio-sonobuoy-test", client)
+
+	// Each node counts towards the progress, not just each plugin
+	results := map[string]*plugin.Result{
+		"systemd/node1": {NodeName: "node1", ResultType: "systemd"},
+		"systemd/node2": {NodeName: "node2", ResultType: "systemd", Error: "failed"},
+	}
+	if err := updater.Annotate(results); err != nil {
+		t.Fatalf("unexpected error annotating: %v", err)
+	}
+
+	want := Progress{Received: 2, Expected: 4, Percent: 50}
+	if got := updater.Progress(); got != want {
+		t.Errorf("expected progress %+v, got %+v", want, got)
+	}
+	if got := want.String(); got != "2/4 results (50%)" {
+		t.Errorf("expected progress to be formatted as %q, got %q", "2/4 results (50%)", got)
+	}
+
+	if len(client.patches) != 1 {
+		t.Fatalf("expected 1 patch, got %v", len(client.patches))
+	}
+	var patch struct {
+		Metadata struct {
+			Annotations map[string]string `json:"annotations"`
+		} `json:"metadata"`
+	}
+	if err := json.Unmarshal(client.patches[0], &patch); err != nil {
+		t.Fatalf("couldn't unmarshal patch: %v", err)
+	}
+	var progress Progress
+	if err := json.Unmarshal([]byte(patch.Metadata.Annotations[ProgressAnnotationName]), &progress); err != nil {
+		t.Fatalf("couldn't unmarshal progress annotation: %v", err)
+	}
+	if progress != want {
+		t.Errorf("expected progress annotation %+v, got %+v", want, progress)
+	}
+	if _, ok := patch.Metadata.Annotations[StatusAnnotationName]; !ok {
+		t.Error("expected the status annotation to still be set")
+	}
+}
+
+func TestAnnotateUntil_backoff(t *testing.T) {
+	const period = 20 * time.Millisecond
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	// Fail three times, succeed once, then fail again
+	var calls []time.Time
+	annotate := func() error {
+		calls = append(calls, time.Now())
+		switch len(calls) {
+		case 4:
+			return nil
+		case 6:
+			cancel()
+		}
+		return errors.New("the server is currently unable to handle the request")
+	}
+	annotateUntil(ctx, period, 0, 4*period, nil, logrus.StandardLogger(), annotate)
+
+	if len(calls) != 6 {
+		t.Fatalf("expected annotations to stop once cancelled, got %v calls", len(calls))
+	}
+	// The interval doubles after each failure up to the cap, and goes back
+	// to the period after a success.
+	minGaps := []time.Duration{period, 2 * period, 4 * period, period, period}
+	for i, min := range minGaps {
+		if gap := calls[i+1].Sub(calls[i]); gap < min {
+			t.Errorf("expected at least %v before annotation %v, got %v", min, i+2, gap)
+		}
+	}
+	if gap := calls[4].Sub(calls[3]); gap >= 4*period {
+		t.Errorf("expected the interval to be reset after a success, got %v", gap)
+	}
+}
+
+func TestAnnotateUntil_pause(t *testing.T) {
+	const period = 20 * time.Millisecond
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	pause := &AnnotationPause{}
+	if !pause.Pause() || pause.Pause() {
+		t.Fatal("expected only the first pause to take effect")
+	}
+	calls := make(chan time.Time, 10)
+	done := make(chan struct{})
+	go func() {
+		annotateUntil(ctx, time.Hour, 0, time.Hour, pause, logrus.StandardLogger(), func() error {
+			calls <- time.Now()
+			return nil
+		})
+		close(done)
+	}()
+
+	select {
+	case <-calls:
+		t.Fatal("expected no annotations while paused")
+	case <-time.After(5 * period):
+	}
+
+	// Resuming annotates straight away rather than waiting for the period
+	resumed := time.Now()
+	if !pause.Resume() || pause.Resume() {
+		t.Fatal("expected only the first resume to take effect")
+	}
+	select {
+	case <-calls:
+	case <-time.After(time.Second):
+		t.Fatalf("expected an annotation as soon as updates were resumed, waited %v", time.Since(resumed))
+	}
+	if pause.Paused() {
+		t.Error("expected annotations not to be paused after resuming")
+	}
+
+	// Cancelling stops the updates whether or not they're paused
+	pause.Pause()
+	cancel()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("expected annotations to stop once cancelled while paused")
+	}
+}
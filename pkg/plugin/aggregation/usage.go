@@ -0,0 +1,216 @@
+/*
+Copyright 2018 Heptio Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package aggregation
+
+import (
+	"context"
+	"encoding/json"
+	"sort"
+	"time"
+
+	"github.com/heptio/sonobuoy/pkg/plugin"
+	"github.com/pkg/errors"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+)
+
+const (
+	// UsageCollected is the status of plugins whose resource usage was
+	// sampled at least once.
+	UsageCollected = "collected"
+	// UsageUnavailable is the status of plugins whose resource usage
+	// couldn't be sampled, e.g. because metrics-server isn't installed.
+	UsageUnavailable = "unavailable"
+
+	// metricsAPIPath is where metrics-server serves the metrics API.
+	metricsAPIPath = "/apis/metrics.k8s.io/v1beta1"
+)
+
+// PluginUsage is the resource usage of each pod of a plugin, as sampled from
+// the metrics API while the plugin ran.
+type PluginUsage struct {
+	Plugin     string `json:"plugin"`
+	ResultType string `json:"resulttype"`
+	Status     string `json:"status"`
+	// Error says why usage is unavailable.
+	Error string     `json:"error,omitempty"`
+	Pods  []PodUsage `json:"pods,omitempty"`
+}
+
+// PodUsage is the peak and average CPU and memory used by a plugin pod,
+// summed over its containers.
+type PodUsage struct {
+	Pod                  string `json:"pod"`
+	Samples              int    `json:"samples"`
+	PeakCPUMillicores    int64  `json:"peakcpumillicores"`
+	AverageCPUMillicores int64  `json:"averagecpumillicores"`
+	PeakMemoryBytes      int64  `json:"peakmemorybytes"`
+	AverageMemoryBytes   int64  `json:"averagememorybytes"`
+}
+
+// podSample is the CPU and memory a pod was using when it was sampled.
+type podSample struct {
+	cpuMillicores int64
+	memoryBytes   int64
+}
+
+// podMetricsFunc returns a sample of the usage of each pod in the namespace
+// matching the label selector, keyed by pod name.
+type podMetricsFunc func(namespace, selector string) (map[string]podSample, error)
+
+// podMetricsList is the subset of the metrics API's PodMetricsList which is
+// needed, since its client isn't vendored.
+type podMetricsList struct {
+	Items []struct {
+		metav1.ObjectMeta `json:"metadata"`
+		Containers        []struct {
+			Usage v1.ResourceList `json:"usage"`
+		} `json:"containers"`
+	} `json:"items"`
+}
+
+// metricsAPIUsage returns a podMetricsFunc which queries the metrics API.
+func metricsAPIUsage(client kubernetes.Interface) podMetricsFunc {
+	return func(namespace, selector string) (map[string]podSample, error) {
+		blob, err := client.CoreV1().RESTClient().Get().
+			AbsPath(metricsAPIPath, "namespaces", namespace, "pods").
+			Param("labelSelector", selector).
+			DoRaw()
+		if err != nil {
+			return nil, errors.Wrap(err, "couldn't query the metrics API, is metrics-server installed?")
+		}
+
+		var list podMetricsList
+		if err := json.Unmarshal(blob, &list); err != nil {
+			return nil, errors.Wrap(err, "couldn't decode pod metrics")
+		}
+
+		samples := make(map[string]podSample, len(list.Items))
+		for _, pod := range list.Items {
+			var sample podSample
+			for _, container := range pod.Containers {
+				sample.cpuMillicores += container.Usage.Cpu().MilliValue()
+				sample.memoryBytes += container.Usage.Memory().Value()
+			}
+			samples[pod.Name] = sample
+		}
+		return samples, nil
+	}
+}
+
+// podStats accumulates the samples of a single pod.
+type podStats struct {
+	podName  string
+	samples  int
+	cpuTotal int64
+	cpuPeak  int64
+	memTotal int64
+	memPeak  int64
+}
+
+func (s *podStats) add(sample podSample) {
+	s.samples++
+	s.cpuTotal += sample.cpuMillicores
+	s.memTotal += sample.memoryBytes
+	if sample.cpuMillicores > s.cpuPeak {
+		s.cpuPeak = sample.cpuMillicores
+	}
+	if sample.memoryBytes > s.memPeak {
+		s.memPeak = sample.memoryBytes
+	}
+}
+
+func (s *podStats) usage() PodUsage {
+	return PodUsage{
+		Pod:                  s.podName,
+		Samples:              s.samples,
+		PeakCPUMillicores:    s.cpuPeak,
+		AverageCPUMillicores: s.cpuTotal / int64(s.samples),
+		PeakMemoryBytes:      s.memPeak,
+		AverageMemoryBytes:   s.memTotal / int64(s.samples),
+	}
+}
+
+// collectPluginUsage samples the resource usage of the plugin's pods every
+// interval until ctx is done or none of its results are pending, recording
+// it in the results manifest after each sample. If the usage can't be
+// sampled, the plugin's usage is recorded as unavailable rather than failing
+// the run.
+func collectPluginUsage(ctx context.Context, fetch podMetricsFunc, p plugin.Interface, namespace string, aggr *Aggregator, interval time.Duration) {
+	sessioned, ok := p.(plugin.Sessioned)
+	if !ok {
+		return
+	}
+	selector := plugin.SessionLabel + "=" + sessioned.GetSessionID()
+	log := aggr.logger().WithField("plugin", p.GetName())
+
+	usage := PluginUsage{Plugin: p.GetName(), ResultType: p.GetResultType(), Status: UsageUnavailable}
+	pods := map[string]*podStats{}
+	defer func() {
+		if len(pods) == 0 && usage.Error == "" {
+			usage.Error = "the plugin's pods weren't sampled before it finished"
+		}
+		aggr.recordUsage(usage)
+	}()
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		if len(aggr.pendingResults(p.GetResultType())) == 0 {
+			return
+		}
+
+		samples, err := fetch(namespace, selector)
+		if err != nil {
+			if usage.Error == "" {
+				log.WithError(err).Info("Couldn't sample plugin resource usage, will retry")
+			}
+			if len(pods) == 0 {
+				usage.Error = err.Error()
+			}
+			continue
+		}
+
+		for name, sample := range samples {
+			stats, ok := pods[name]
+			if !ok {
+				stats = &podStats{podName: name}
+				pods[name] = stats
+			}
+			stats.add(sample)
+		}
+		if len(pods) == 0 {
+			continue
+		}
+
+		usage.Status = UsageCollected
+		usage.Error = ""
+		usage.Pods = make([]PodUsage, 0, len(pods))
+		for _, stats := range pods {
+			usage.Pods = append(usage.Pods, stats.usage())
+		}
+		sort.Slice(usage.Pods, func(i, j int) bool { return usage.Pods[i].Pod < usage.Pods[j].Pod })
+		aggr.recordUsage(usage)
+	}
+}
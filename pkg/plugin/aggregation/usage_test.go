@@ -0,0 +1,119 @@
+/*
+Copyright 2018 Heptio Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package aggregation
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/heptio/sonobuoy/pkg/plugin"
+	"github.com/pkg/errors"
+)
+
+func TestCollectPluginUsage(t *testing.T) {
+	outdir, err := ioutil.TempDir("", "sonobuoy_usage_test")
+	if err != nil {
+		t.Fatalf("Could not create temp directory: %v", err)
+	}
+	defer os.RemoveAll(outdir)
+
+	p := &sessionPlugin{fakePlugin{name: "systemd_logs", nodes: []string{"node1"}}}
+	aggr := NewAggregator(path.Join(outdir, "plugins"), p.ExpectedResults(nil))
+	aggr.manifest = newResultsManifest(outdir, []plugin.Interface{p})
+
+	samples := []map[string]podSample{
+		{"sonobuoy-systemd-logs-abc123": {cpuMillicores: 100, memoryBytes: 300}},
+		{"sonobuoy-systemd-logs-abc123": {cpuMillicores: 300, memoryBytes: 100}},
+	}
+	var selector string
+	calls := 0
+	fetch := func(namespace, sel string) (map[string]podSample, error) {
+		selector = sel
+		calls++
+		if calls > len(samples) {
+			// Finish the plugin once every sample has been taken
+			aggr.resultsMutex.Lock()
+			aggr.Results["systemd_logs/node1"] = &plugin.Result{ResultType: "systemd_logs", NodeName: "node1"}
+			aggr.resultsMutex.Unlock()
+			return map[string]podSample{}, nil
+		}
+		return samples[calls-1], nil
+	}
+
+	collectPluginUsage(context.Background(), fetch, p, "heptio-sonobuoy", aggr, time.Millisecond)
+
+	if selector != plugin.SessionLabel+"=abc123" {
+		t.Errorf("expected the plugin's pods to be selected by session, got %q", selector)
+	}
+	manifest := readManifest(t, outdir)
+	if len(manifest.Usage) != 1 {
+		t.Fatalf("expected usage for 1 plugin, got %+v", manifest.Usage)
+	}
+	usage := manifest.Usage[0]
+	if usage.Plugin != "systemd_logs" || usage.Status != UsageCollected || len(usage.Pods) != 1 {
+		t.Fatalf("unexpected usage %+v", usage)
+	}
+	want := PodUsage{
+		Pod:                  "sonobuoy-systemd-logs-abc123",
+		Samples:              2,
+		PeakCPUMillicores:    300,
+		AverageCPUMillicores: 200,
+		PeakMemoryBytes:      300,
+		AverageMemoryBytes:   200,
+	}
+	if usage.Pods[0] != want {
+		t.Errorf("expected pod usage %+v, got %+v", want, usage.Pods[0])
+	}
+}
+
+func TestCollectPluginUsage_unavailable(t *testing.T) {
+	outdir, err := ioutil.TempDir("", "sonobuoy_usage_test")
+	if err != nil {
+		t.Fatalf("Could not create temp directory: %v", err)
+	}
+	defer os.RemoveAll(outdir)
+
+	p := &sessionPlugin{fakePlugin{name: "e2e"}}
+	aggr := NewAggregator(path.Join(outdir, "plugins"), p.ExpectedResults(nil))
+	aggr.manifest = newResultsManifest(outdir, []plugin.Interface{p})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	calls := 0
+	fetch := func(namespace, selector string) (map[string]podSample, error) {
+		if calls++; calls == 3 {
+			cancel()
+		}
+		return nil, errors.New("the server could not find the requested resource")
+	}
+
+	// The run carries on without usage rather than failing
+	collectPluginUsage(ctx, fetch, p, "heptio-sonobuoy", aggr, time.Millisecond)
+
+	manifest := readManifest(t, outdir)
+	if len(manifest.Usage) != 1 {
+		t.Fatalf("expected usage for 1 plugin, got %+v", manifest.Usage)
+	}
+	usage := manifest.Usage[0]
+	if usage.Status != UsageUnavailable || !strings.Contains(usage.Error, "could not find the requested resource") || len(usage.Pods) != 0 {
+		t.Errorf("expected usage to be unavailable with the metrics API error, got %+v", usage)
+	}
+}
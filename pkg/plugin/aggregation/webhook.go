@@ -0,0 +1,193 @@
+/*
+Copyright 2018 Heptio Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package aggregation
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/heptio/sonobuoy/pkg/plugin"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// WebhookSignatureHeader carries the base64 encoded signature of the
+	// SHA-256 digest of a webhook's body, made with the run's CA key.
+	WebhookSignatureHeader = "X-Sonobuoy-Signature"
+
+	// defaultWebhookAttempts is how many times a webhook is sent before
+	// giving up, unless configured otherwise.
+	defaultWebhookAttempts = 3
+	// defaultWebhookTimeout is how long each attempt has, unless configured
+	// otherwise.
+	defaultWebhookTimeout = 10 * time.Second
+	// webhookRetryDelay is how long to wait between attempts.
+	webhookRetryDelay = time.Second
+)
+
+// WebhookPayload is the body POSTed to the webhook each time a plugin
+// reaches a terminal state.
+type WebhookPayload struct {
+	Time   time.Time `json:"time"`
+	Plugin string    `json:"plugin"`
+	// Status is CompleteStatus, FailedStatus or TimeoutStatus.
+	Status string `json:"status"`
+}
+
+// webhook POSTs signed notifications to a URL. Notifications are sent in the
+// background so a slow or dead receiver never holds up the run. A nil
+// webhook discards all notifications.
+type webhook struct {
+	url        string
+	client     *http.Client
+	attempts   int
+	retryDelay time.Duration
+	sign       func([]byte) ([]byte, error)
+	wg         sync.WaitGroup
+	log        logrus.FieldLogger
+}
+
+func newWebhook(cfg plugin.AggregationConfig, sign func([]byte) ([]byte, error)) *webhook {
+	if cfg.WebhookURL == "" {
+		return nil
+	}
+
+	attempts := cfg.WebhookAttempts
+	if attempts <= 0 {
+		attempts = defaultWebhookAttempts
+	}
+	timeout := defaultWebhookTimeout
+	if cfg.WebhookTimeoutSeconds > 0 {
+		timeout = time.Duration(cfg.WebhookTimeoutSeconds) * time.Second
+	}
+
+	return &webhook{
+		url:        cfg.WebhookURL,
+		client:     &http.Client{Timeout: timeout},
+		attempts:   attempts,
+		retryDelay: webhookRetryDelay,
+		sign:       sign,
+		log:        logrus.StandardLogger(),
+	}
+}
+
+// notify sends a notification that the plugin has reached the given status.
+func (w *webhook) notify(pluginName, status string) {
+	if w == nil {
+		return
+	}
+
+	log := w.log.WithFields(logrus.Fields{"plugin": pluginName, "webhook": w.url})
+	body, err := json.Marshal(WebhookPayload{
+		Time:   time.Now().UTC(),
+		Plugin: pluginName,
+		Status: status,
+	})
+	if err != nil {
+		log.WithError(err).Info("couldn't encode webhook")
+		return
+	}
+	sig, err := w.sign(body)
+	if err != nil {
+		log.WithError(err).Info("couldn't sign webhook")
+		return
+	}
+
+	w.wg.Add(1)
+	go func() {
+		defer w.wg.Done()
+		for attempt := 1; ; attempt++ {
+			err := w.post(body, sig)
+			if err == nil {
+				return
+			}
+			if attempt >= w.attempts {
+				log.WithError(err).Info("giving up sending webhook")
+				return
+			}
+			log.WithError(err).Info("couldn't send webhook, retrying")
+			time.Sleep(w.retryDelay)
+		}
+	}()
+}
+
+func (w *webhook) post(body, sig []byte) error {
+	req, err := http.NewRequest(http.MethodPost, w.url, bytes.NewReader(body))
+	if err != nil {
+		return errors.Wrap(err, "couldn't create webhook request")
+	}
+	req.Header.Set("content-type", "application/json")
+	req.Header.Set(WebhookSignatureHeader, base64.StdEncoding.EncodeToString(sig))
+
+	resp, err := w.client.Do(req)
+	if err != nil {
+		return errors.Wrap(err, "couldn't send webhook")
+	}
+	defer resp.Body.Close()
+	// Drain the body so the connection can be reused
+	io.Copy(ioutil.Discard, resp.Body)
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return errors.Errorf("webhook returned status %v", resp.Status)
+	}
+	return nil
+}
+
+// wait blocks until every notification has been sent or given up on.
+func (w *webhook) wait() {
+	if w == nil {
+		return
+	}
+	w.wg.Wait()
+}
+
+// resultHook returns a hook which notifies the webhook as each plugin
+// completes.
+func (w *webhook) resultHook(a *Aggregator) resultHook {
+	return func(result *plugin.Result, pluginDone bool) {
+		if pluginDone {
+			w.notify(result.ResultType, a.pluginStatus(result.ResultType))
+		}
+	}
+}
+
+// pluginStatus returns TimeoutStatus if any of the recorded results of the
+// given type timed out, FailedStatus if any failed, and CompleteStatus
+// otherwise, so results dropped for removed nodes or not reported don't count
+// as failures.
+// resultsMutex must be held by the caller.
+func (a *Aggregator) pluginStatus(resultType string) string {
+	status := CompleteStatus
+	for _, result := range a.Results {
+		if result.ResultType != resultType {
+			continue
+		}
+		switch resultStatus(result) {
+		case TimeoutStatus:
+			return TimeoutStatus
+		case FailedStatus:
+			status = FailedStatus
+		}
+	}
+	return status
+}
@@ -0,0 +1,202 @@
+/*
+Copyright 2018 Heptio Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package aggregation
+
+import (
+	"context"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/heptio/sonobuoy/pkg/backplane/ca"
+	"github.com/heptio/sonobuoy/pkg/plugin"
+	pluginutils "github.com/heptio/sonobuoy/pkg/plugin/driver/utils"
+)
+
+// webhookReceiver records the webhooks it's sent, failing the first
+// failFirst requests.
+type webhookReceiver struct {
+	sync.Mutex
+	failFirst  int
+	requests   int
+	payloads   []WebhookPayload
+	signatures [][]byte
+	bodies     [][]byte
+}
+
+func (rcv *webhookReceiver) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	rcv.Lock()
+	defer rcv.Unlock()
+
+	rcv.requests++
+	if rcv.requests <= rcv.failFirst {
+		http.Error(w, "unavailable", http.StatusServiceUnavailable)
+		return
+	}
+
+	body, _ := ioutil.ReadAll(r.Body)
+	var payload WebhookPayload
+	if err := json.Unmarshal(body, &payload); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	sig, _ := base64.StdEncoding.DecodeString(r.Header.Get(WebhookSignatureHeader))
+	rcv.payloads = append(rcv.payloads, payload)
+	rcv.signatures = append(rcv.signatures, sig)
+	rcv.bodies = append(rcv.bodies, body)
+}
+
+func TestWebhook_retries(t *testing.T) {
+	auth, err := ca.NewAuthority()
+	if err != nil {
+		t.Fatalf("couldn't create certificate authority: %v", err)
+	}
+
+	rcv := &webhookReceiver{failFirst: 2}
+	srv := httptest.NewServer(rcv)
+	defer srv.Close()
+
+	hook := newWebhook(plugin.AggregationConfig{WebhookURL: srv.URL}, auth.Sign)
+	hook.retryDelay = 0
+	hook.notify("e2e", FailedStatus)
+	hook.wait()
+
+	if rcv.requests != 3 || len(rcv.payloads) != 1 {
+		t.Fatalf("expected the webhook to succeed on the third attempt, got %v requests and %v payloads", rcv.requests, len(rcv.payloads))
+	}
+	if p := rcv.payloads[0]; p.Plugin != "e2e" || p.Status != FailedStatus || p.Time.IsZero() {
+		t.Errorf("unexpected payload %+v", p)
+	}
+	if err := auth.CACert().CheckSignature(x509.ECDSAWithSHA256, rcv.bodies[0], rcv.signatures[0]); err != nil {
+		t.Errorf("expected payload to be signed by the CA: %v", err)
+	}
+}
+
+func TestWebhook_givesUp(t *testing.T) {
+	auth, err := ca.NewAuthority()
+	if err != nil {
+		t.Fatalf("couldn't create certificate authority: %v", err)
+	}
+
+	rcv := &webhookReceiver{failFirst: 10}
+	srv := httptest.NewServer(rcv)
+	defer srv.Close()
+
+	hook := newWebhook(plugin.AggregationConfig{WebhookURL: srv.URL, WebhookAttempts: 2}, auth.Sign)
+	hook.retryDelay = 0
+	hook.notify("e2e", CompleteStatus)
+	hook.wait()
+
+	if rcv.requests != 2 {
+		t.Errorf("expected 2 attempts, got %v", rcv.requests)
+	}
+}
+
+func TestWebhook_nil(t *testing.T) {
+	// Without a URL notifications should silently be discarded
+	hook := newWebhook(plugin.AggregationConfig{}, nil)
+	hook.notify("e2e", CompleteStatus)
+	hook.wait()
+}
+
+func TestPluginStatus(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sonobuoy_webhook_test")
+	if err != nil {
+		t.Fatalf("Could not create temp directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	aggr := NewAggregator(dir, []plugin.ExpectedResult{
+		{NodeName: "node1", ResultType: "systemd_logs"},
+		{NodeName: "node2", ResultType: "systemd_logs"},
+		{ResultType: "e2e"},
+		{ResultType: "heptio-e2e"},
+	})
+	resultsCh := make(chan *plugin.Result, 4)
+	resultsCh <- pluginutils.MakeErrorResult("systemd_logs", map[string]interface{}{"error": "foo"}, "node1")
+	resultsCh <- pluginutils.MakeErrorResult("systemd_logs", map[string]interface{}{"error": timeoutErrorPrefix + " systemd_logs"}, "node2")
+	resultsCh <- pluginutils.MakeErrorResult("e2e", map[string]interface{}{"error": "foo"}, "")
+	resultsCh <- &plugin.Result{ResultType: "heptio-e2e", Body: strings.NewReader("{}"), MimeType: "application/json"}
+	close(resultsCh)
+	aggr.IngestResults(resultsCh)
+
+	aggr.resultsMutex.Lock()
+	defer aggr.resultsMutex.Unlock()
+	for resultType, want := range map[string]string{
+		"systemd_logs": TimeoutStatus,
+		"e2e":          FailedStatus,
+		"heptio-e2e":   CompleteStatus,
+	} {
+		if got := aggr.pluginStatus(resultType); got != want {
+			t.Errorf("expected %v to be %v, got %v", resultType, want, got)
+		}
+	}
+}
+
+func TestRun_webhook(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sonobuoy_webhook_test")
+	if err != nil {
+		t.Fatalf("Could not create temp directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	rcv := &webhookReceiver{}
+	hookSrv := httptest.NewServer(rcv)
+	defer hookSrv.Close()
+
+	srv := NewInProcessServer()
+	p := &fakePlugin{name: "e2e", run: func(string) error {
+		go srv.Submit("", "e2e", "application/json", strings.NewReader("{}"))
+		return nil
+	}}
+
+	cfg := plugin.AggregationConfig{WebhookURL: hookSrv.URL}
+	if _, err := Run(context.Background(), &fakeClient{}, []plugin.Interface{p}, cfg, "heptio-sonobuoy-test", dir, RunOptions{InProcess: srv}); err != nil {
+		t.Fatalf("unexpected error from run: %v", err)
+	}
+
+	rcv.Lock()
+	defer rcv.Unlock()
+	if len(rcv.payloads) != 1 || rcv.payloads[0].Plugin != "e2e" || rcv.payloads[0].Status != CompleteStatus {
+		t.Fatalf("expected one webhook for e2e completing, got %+v", rcv.payloads)
+	}
+
+	certPEM, err := ioutil.ReadFile(path.Join(dir, metaDir, CACertFile))
+	if err != nil {
+		t.Fatalf("couldn't read CA certificate: %v", err)
+	}
+	block, _ := pem.Decode(certPEM)
+	if block == nil {
+		t.Fatalf("couldn't decode CA certificate %q", certPEM)
+	}
+	cert, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		t.Fatalf("couldn't parse CA certificate: %v", err)
+	}
+	if err := cert.CheckSignature(x509.ECDSAWithSHA256, rcv.bodies[0], rcv.signatures[0]); err != nil {
+		t.Errorf("expected webhook to be signed by the run's CA: %v", err)
+	}
+}
@@ -19,4 +19,73 @@ package plugin
 const (
 	// GracefulShutdownPeriod is how long plugins have to cleanly finish before they are terminated.
 	GracefulShutdownPeriod = 60
+
+	// SessionLabel is the label identifying the pods of a plugin, whose
+	// value is the plugin's session ID.
+	SessionLabel = "sonobuoy-run"
+
+	// LogFormatText is the log format for human readable text logs.
+	LogFormatText = "text"
+	// LogFormatJSON is the log format for one JSON object per log line.
+	LogFormatJSON = "json"
+
+	// DuplicateResultsIgnore is the duplicate result policy which keeps the
+	// first result submitted and ignores the rest.
+	DuplicateResultsIgnore = "ignore"
+	// DuplicateResultsOverwrite is the duplicate result policy which replaces
+	// a result each time it is submitted again.
+	DuplicateResultsOverwrite = "overwrite"
+
+	// ResultsLayoutNested is the default results layout, which groups
+	// results by result type and outcome.
+	ResultsLayoutNested = "nested"
+	// ResultsLayoutFlat is the results layout which writes every result
+	// directly in the plugins directory.
+	ResultsLayoutFlat = "flat"
+	// ResultsLayoutTopology is the results layout which is nested, but
+	// groups node results by the value of the topology label on their node,
+	// e.g. their zone.
+	ResultsLayoutTopology = "topology"
+
+	// KeepPluginResourcesNone is the default policy for keeping plugin
+	// resources, which cleans up after every plugin.
+	KeepPluginResourcesNone = "none"
+	// KeepPluginResourcesOnFailure keeps the resources of plugins with a
+	// result which failed or timed out, cleaning up after the rest.
+	KeepPluginResourcesOnFailure = "on-failure"
+	// KeepPluginResourcesAll keeps the resources of every plugin.
+	KeepPluginResourcesAll = "all"
+
+	// OrphanedResourcesReport is the orphaned resources policy which logs
+	// the resources earlier runs left behind without deleting them.
+	OrphanedResourcesReport = "report"
+	// OrphanedResourcesDelete is the orphaned resources policy which
+	// deletes the resources earlier runs left behind before any plugin is
+	// launched.
+	OrphanedResourcesDelete = "delete"
+
+	// ResultFormatRaw is the format of results which are stored as they are
+	// submitted, and of results whose plugin doesn't declare a format.
+	ResultFormatRaw = "raw"
+	// ResultFormatJUnit is the format of JUnit XML test reports.
+	ResultFormatJUnit = "junit"
+	// ResultFormatSARIF is the format of SARIF static analysis reports, as
+	// emitted by security scanners.
+	ResultFormatSARIF = "sarif"
+
+	// ResultReducerJUnit merges the JUnit results of a plugin, such as one
+	// report from each node, into a single report.
+	ResultReducerJUnit = "junit"
+
+	// UploadCodecIdentity is the codec of uploads which aren't compressed.
+	UploadCodecIdentity = "identity"
+	// UploadCodecGzip is the codec of uploads compressed with gzip.
+	UploadCodecGzip = "gzip"
+
+	// ResultSinkFilesystem is the result sink which copies results to
+	// another directory, such as a persistent volume.
+	ResultSinkFilesystem = "filesystem"
+	// ResultSinkS3 is the result sink which uploads results to an S3
+	// compatible object store.
+	ResultSinkS3 = "s3"
 )
@@ -17,12 +17,12 @@ limitations under the License.
 package driver
 
 import (
-	"crypto/ecdsa"
 	"crypto/tls"
-	"crypto/x509"
 	"encoding/pem"
 	"fmt"
+	"strings"
 
+	"github.com/heptio/sonobuoy/pkg/backplane/ca"
 	"github.com/heptio/sonobuoy/pkg/plugin"
 	"github.com/heptio/sonobuoy/pkg/plugin/manifest"
 	"github.com/pkg/errors"
@@ -41,6 +41,27 @@ type Base struct {
 	ImagePullPolicy   string
 	ImagePullSecrets  string
 	CustomAnnotations map[string]string
+	// MinTLSVersion and CipherSuites are passed on to the plugin's workers.
+	MinTLSVersion string
+	CipherSuites  []string
+	// TLSServerName is the server name the plugin's workers verify the
+	// aggregator's certificate against, if it isn't the advertise address.
+	TLSServerName string
+	// UploadPathPrefix is the path prefix the plugin's workers put before
+	// the paths they submit results to, if the aggregator has a base path.
+	UploadPathPrefix string
+	// ProxyURL is the proxy the plugin's workers submit results through.
+	ProxyURL string
+	// UploadRetries and UploadTimeoutSeconds are how the plugin's workers
+	// retry failed uploads.
+	UploadRetries        int
+	UploadTimeoutSeconds int
+	// HeartbeatIntervalSeconds is how often the plugin's workers send
+	// heartbeats, or zero if they don't.
+	HeartbeatIntervalSeconds int
+	// GracefulShutdownSeconds is the grace period the plugin's pods are
+	// deleted with. Defaults to plugin.GracefulShutdownPeriod if unset.
+	GracefulShutdownSeconds int
 }
 
 // TemplateData is all the fields available to plugin driver templates.
@@ -58,6 +79,14 @@ type TemplateData struct {
 	CACert            string
 	SecretName        string
 	ExtraVolumes      []string
+	MinTLSVersion     string
+	CipherSuites      string
+	TLSServerName     string
+	UploadPathPrefix  string
+	ProxyURL          string
+	UploadRetries     int
+	UploadTimeout     int
+	HeartbeatInterval int
 }
 
 // GetSessionID returns the session id associated with the plugin.
@@ -65,11 +94,102 @@ func (b *Base) GetSessionID() string {
 	return b.SessionID
 }
 
+// SetTLSOptions sets the TLS settings the plugin's workers use (to adhere to
+// plugin.TLSConfigurable).
+func (b *Base) SetTLSOptions(minVersion string, cipherSuites []string) {
+	b.MinTLSVersion = minVersion
+	b.CipherSuites = cipherSuites
+}
+
+// SetTLSServerName sets the server name the plugin's workers verify the
+// aggregator's certificate against (to adhere to
+// plugin.ServerNameConfigurable).
+func (b *Base) SetTLSServerName(name string) {
+	b.TLSServerName = name
+}
+
+// SetUploadPathPrefix sets the path prefix the plugin's workers put before
+// the paths they submit results to (to adhere to
+// plugin.PathPrefixConfigurable).
+func (b *Base) SetUploadPathPrefix(prefix string) {
+	b.UploadPathPrefix = prefix
+}
+
+// SetProxyURL sets the proxy the plugin's workers submit results through
+// (to adhere to plugin.ProxyConfigurable).
+func (b *Base) SetProxyURL(proxyURL string) {
+	b.ProxyURL = proxyURL
+}
+
+// SetUploadOptions sets how the plugin's workers retry failed uploads (to
+// adhere to plugin.UploadConfigurable).
+func (b *Base) SetUploadOptions(retries, timeoutSeconds int) {
+	b.UploadRetries = retries
+	b.UploadTimeoutSeconds = timeoutSeconds
+}
+
+// SetHeartbeatInterval sets how often the plugin's workers send heartbeats
+// (to adhere to plugin.HeartbeatConfigurable).
+func (b *Base) SetHeartbeatInterval(seconds int) {
+	b.HeartbeatIntervalSeconds = seconds
+}
+
+// SetGracefulShutdownPeriod sets the grace period the plugin's pods are
+// deleted with (to adhere to plugin.GracefulShutdownConfigurable).
+func (b *Base) SetGracefulShutdownPeriod(seconds int) {
+	b.GracefulShutdownSeconds = seconds
+}
+
+// GracefulShutdownPeriod returns the grace period, in seconds, the plugin's
+// pods are deleted with.
+func (b *Base) GracefulShutdownPeriod() int {
+	if b.GracefulShutdownSeconds > 0 {
+		return b.GracefulShutdownSeconds
+	}
+	return plugin.GracefulShutdownPeriod
+}
+
 // GetName returns the name of this Job plugin.
 func (b *Base) GetName() string {
 	return b.Definition.Name
 }
 
+// GetResultFormat returns the format of the plugin's results (to adhere to
+// plugin.Formatted).
+func (b *Base) GetResultFormat() string {
+	return b.Definition.ResultFormat
+}
+
+// GetResultSchema returns the JSON Schema of the plugin's results (to adhere
+// to plugin.Validated).
+func (b *Base) GetResultSchema() []byte {
+	return b.Definition.ResultSchema
+}
+
+// GetResultReducer returns the name of the reducer the plugin's results are
+// merged with (to adhere to plugin.Reduced).
+func (b *Base) GetResultReducer() string {
+	return b.Definition.ResultReducer
+}
+
+// GetResultPriority returns the priority of the plugin's results (to adhere
+// to plugin.Prioritized).
+func (b *Base) GetResultPriority() int {
+	return b.Definition.ResultPriority
+}
+
+// GetDependsOn returns the names of the plugins this plugin depends on (to
+// adhere to plugin.Dependent).
+func (b *Base) GetDependsOn() []string {
+	return b.Definition.DependsOn
+}
+
+// GetNamespace returns the namespace the plugin's pods run in (to adhere to
+// plugin.Namespaced).
+func (b *Base) GetNamespace() string {
+	return b.Namespace
+}
+
 // GetSecretName gets a name for a secret based on the plugin name and session ID.
 func (b *Base) GetSecretName() string {
 	return fmt.Sprintf("sonobuoy-plugin-%s-%s", b.GetName(), b.GetSessionID())
@@ -113,29 +233,22 @@ func (b *Base) GetTemplateData(masterAddress string, cert *tls.Certificate) (*Te
 		CACert:            cacert,
 		SecretName:        b.GetSecretName(),
 		ExtraVolumes:      volumes,
+		MinTLSVersion:     b.MinTLSVersion,
+		CipherSuites:      strings.Join(b.CipherSuites, ","),
+		TLSServerName:     b.TLSServerName,
+		UploadPathPrefix:  b.UploadPathPrefix,
+		ProxyURL:          b.ProxyURL,
+		UploadRetries:     b.UploadRetries,
+		UploadTimeout:     b.UploadTimeoutSeconds,
+		HeartbeatInterval: b.HeartbeatIntervalSeconds,
 	}, nil
 }
 
 // MakeTLSSecret makes a Kubernetes secret object for the given TLS certificate.
 func (b *Base) MakeTLSSecret(cert *tls.Certificate) (*v1.Secret, error) {
-	rsaKey, ok := cert.PrivateKey.(*ecdsa.PrivateKey)
-	if !ok {
-		return nil, errors.New("private key not ECDSA")
-	}
-
-	if len(cert.Certificate) <= 0 {
-		return nil, errors.New("no certs in tls.certificate")
-	}
-
-	certDER := cert.Certificate[0]
-	certPEM := pem.EncodeToMemory(&pem.Block{
-		Type:  "CERTIFICATE",
-		Bytes: certDER,
-	})
-
-	keyPEM, err := getKeyPEM(rsaKey)
+	certPEM, keyPEM, err := ca.EncodePEM(cert)
 	if err != nil {
-		return nil, errors.Wrap(err, "couldn't PEM encode TLS key")
+		return nil, errors.Wrap(err, "couldn't PEM encode TLS certificate")
 	}
 
 	return &v1.Secret{
@@ -166,15 +279,3 @@ func getCACertPEM(cert *tls.Certificate) string {
 	}
 	return cacert
 }
-
-// getKeyPEM turns an RSA Private Key into a PEM-encoded string
-func getKeyPEM(key *ecdsa.PrivateKey) ([]byte, error) {
-	derKEY, err := x509.MarshalECPrivateKey(key)
-	if err != nil {
-		return nil, err
-	}
-	return pem.EncodeToMemory(&pem.Block{
-		Type:  "EC PRIVATE KEY",
-		Bytes: derKEY,
-	}), nil
-}
@@ -20,10 +20,12 @@ import (
 	"bytes"
 	"crypto/tls"
 	"fmt"
+	"strings"
 	"time"
 
 	appsv1 "k8s.io/api/apps/v1"
 	v1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	kuberuntime "k8s.io/apimachinery/pkg/runtime"
 	"k8s.io/client-go/kubernetes"
@@ -45,6 +47,9 @@ type Plugin struct {
 // Ensure DaemonSetPlugin implements plugin.Interface
 var _ plugin.Interface = &Plugin{}
 
+// monitorInterval is how often Monitor checks on the plugin's pods.
+const monitorInterval = 10 * time.Second
+
 // NewPlugin creates a new DaemonSet plugin from the given Plugin Definition
 // and sonobuoy master address.
 func NewPlugin(dfn plugin.Definition, namespace, sonobuoyImage, imagePullPolicy, imagePullSecrets string, customAnnotations map[string]string) *Plugin {
@@ -76,8 +81,15 @@ func (p *Plugin) ExpectedResults(nodes []v1.Node) []plugin.ExpectedResult {
 	return ret
 }
 
+// getMasterAddress returns the results URL for the given hostname. If hostname
+// is a comma separated list, a URL is returned for each entry.
 func getMasterAddress(hostname string) string {
-	return fmt.Sprintf("https://%s/api/v1/results/by-node", hostname)
+	hosts := strings.Split(hostname, ",")
+	urls := make([]string, len(hosts))
+	for i, host := range hosts {
+		urls[i] = fmt.Sprintf("https://%s/api/v1/results/by-node", strings.TrimSpace(host))
+	}
+	return strings.Join(urls, ",")
 }
 
 //FillTemplate populates the internal Job YAML template with the values for this particular daemonset.
@@ -112,22 +124,47 @@ func (p *Plugin) Run(kubeclient kubernetes.Interface, hostname string, cert *tls
 		return errors.Wrapf(err, "couldn't make secret for daemonset plugin %v", p.GetName())
 	}
 
-	if _, err := kubeclient.CoreV1().Secrets(p.Namespace).Create(secret); err != nil {
+	// Resource names include the session ID, so anything which already exists
+	// was created by an earlier attempt to run this plugin.
+	if _, err := kubeclient.CoreV1().Secrets(p.Namespace).Create(secret); err != nil && !apierrors.IsAlreadyExists(err) {
 		return errors.Wrapf(err, "couldn't create TLS secret for daemonset plugin %v", p.GetName())
 	}
 
 	// TODO(EKF): Move to v1 in 1.11
-	if _, err := kubeclient.AppsV1().DaemonSets(p.Namespace).Create(&daemonSet); err != nil {
+	if _, err := kubeclient.AppsV1().DaemonSets(p.Namespace).Create(&daemonSet); err != nil && !apierrors.IsAlreadyExists(err) {
 		return errors.Wrapf(err, "could not create DaemonSet for daemonset plugin %v", p.GetName())
 	}
 
 	return nil
 }
 
+// requiredAccess is what the aggregator needs to be allowed to do in the
+// plugin's namespace to run it.
+var requiredAccess = []driver.Access{
+	{Resource: "secrets", Verb: "create"},
+	{Group: "apps", Resource: "daemonsets", Verb: "create"},
+	{Group: "apps", Resource: "daemonsets", Verb: "list"},
+	{Group: "apps", Resource: "daemonsets", Verb: "deletecollection"},
+	{Resource: "pods", Verb: "list"},
+}
+
+// Validate checks the plugin can be run (to adhere to plugin.Validator).
+func (p *Plugin) Validate(kubeclient kubernetes.Interface) []error {
+	return p.ValidateAccess(kubeclient, requiredAccess)
+}
+
 // Cleanup cleans up the k8s DaemonSet and ConfigMap created by this plugin instance.
 func (p *Plugin) Cleanup(kubeclient kubernetes.Interface) {
+	if err := p.CleanupWithError(kubeclient); err != nil {
+		errlog.LogError(err)
+	}
+}
+
+// CleanupWithError cleans up like Cleanup, returning any error deleting the
+// plugin's DaemonSet (to adhere to plugin.CleanupReporter).
+func (p *Plugin) CleanupWithError(kubeclient kubernetes.Interface) error {
 	p.CleanedUp = true
-	gracePeriod := int64(1)
+	gracePeriod := int64(p.GracefulShutdownPeriod())
 	deletionPolicy := metav1.DeletePropagationBackground
 
 	listOptions := p.listOptions()
@@ -142,9 +179,7 @@ func (p *Plugin) Cleanup(kubeclient kubernetes.Interface) {
 		&deleteOptions,
 		listOptions,
 	)
-	if err != nil {
-		errlog.LogError(errors.Wrapf(err, "could not delete DaemonSet-%v for daemonset plugin %v", p.GetSessionID(), p.GetName()))
-	}
+	return errors.Wrapf(err, "could not delete DaemonSet-%v for daemonset plugin %v", p.GetSessionID(), p.GetName())
 }
 
 func (p *Plugin) listOptions() metav1.ListOptions {
@@ -170,23 +205,27 @@ func (p *Plugin) findDaemonSet(kubeclient kubernetes.Interface) (*appsv1.DaemonS
 
 // Monitor adheres to plugin.Interface by ensuring the DaemonSet is correctly
 // configured and that each pod is running normally.
-func (p *Plugin) Monitor(kubeclient kubernetes.Interface, availableNodes []v1.Node, resultsCh chan<- *plugin.Result) {
+func (p *Plugin) Monitor(kubeclient kubernetes.Interface, nodes *plugin.NodeCache, resultsCh chan<- *plugin.Result) {
 	podsReported := make(map[string]bool)
-	podsFound := make(map[string]bool, len(availableNodes))
-	for _, node := range availableNodes {
-		podsFound[node.Name] = false
-		podsReported[node.Name] = false
-	}
+	podsFound := make(map[string]bool)
 
 	for {
 		// Sleep between each poll, which should give the DaemonSet
 		// enough time to create pods
-		time.Sleep(10 * time.Second)
+		time.Sleep(monitorInterval)
 		// If we've cleaned up after ourselves, stop monitoring
 		if p.CleanedUp {
 			break
 		}
 
+		// Nodes may join while the plugin is running, so check the
+		// current list each time.
+		availableNodes, err := nodes.Nodes()
+		if err != nil {
+			errlog.LogError(errors.Wrapf(err, "could not list nodes for plugin %v, will retry", p.GetName()))
+			continue
+		}
+
 		// If we don't have a daemonset created, retry next time.  We
 		// only send errors if we successfully see that an expected pod
 		// is having issues.
@@ -214,12 +253,13 @@ func (p *Plugin) Monitor(kubeclient kubernetes.Interface, availableNodes []v1.No
 
 			podsFound[nodeName] = true
 			// Check if it's failing and submit the error result
-			if isFailing, reason := utils.IsPodFailing(&pod); isFailing {
+			if reason, category := utils.ClassifyPodFailure(&pod); reason != "" {
 				podsReported[nodeName] = true
 
 				resultsCh <- utils.MakeErrorResult(p.GetResultType(), map[string]interface{}{
-					"error": reason,
-					"pod":   pod,
+					"error":    reason,
+					"category": category,
+					"pod":      pod,
 				}, nodeName)
 			}
 		}
@@ -230,6 +270,11 @@ func (p *Plugin) Monitor(kubeclient kubernetes.Interface, availableNodes []v1.No
 		// state.)  So take any nodes we didn't see pods on, and report
 		// issues scheduling them.
 		for _, node := range availableNodes {
+			// Give the DaemonSet a chance to schedule onto nodes
+			// which only just joined.
+			if time.Since(node.CreationTimestamp.Time) < monitorInterval {
+				continue
+			}
 			if !podsFound[node.Name] && !podsReported[node.Name] {
 				podsReported[node.Name] = true
 				resultsCh <- utils.MakeErrorResult(p.GetResultType(), map[string]interface{}{
@@ -239,6 +284,7 @@ func (p *Plugin) Monitor(kubeclient kubernetes.Interface, availableNodes []v1.No
 						time.Now().Sub(ds.CreationTimestamp.Time),
 						p.Definition.Name,
 					),
+					"category": plugin.ErrorCategoryUnschedulable,
 				}, node.Name)
 			}
 		}
@@ -28,8 +28,11 @@ import (
 
 	appsv1 "k8s.io/api/apps/v1"
 	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	kuberuntime "k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes"
 	"k8s.io/client-go/kubernetes/scheme"
+	appsv1client "k8s.io/client-go/kubernetes/typed/apps/v1"
 )
 
 const (
@@ -166,3 +169,70 @@ func TestFillTemplate(t *testing.T) {
 		t.Errorf("Expected annotations key1:val1 and key2:val2 to be set, but got %v", daemonSet.Spec.Template.Annotations)
 	}
 }
+
+type fakeClient struct {
+	kubernetes.Interface
+	daemonSets *fakeDaemonSets
+}
+
+func (c *fakeClient) AppsV1() appsv1client.AppsV1Interface {
+	return &fakeAppsV1{daemonSets: c.daemonSets}
+}
+
+type fakeAppsV1 struct {
+	appsv1client.AppsV1Interface
+	daemonSets *fakeDaemonSets
+}
+
+func (a *fakeAppsV1) DaemonSets(namespace string) appsv1client.DaemonSetInterface {
+	return a.daemonSets
+}
+
+type fakeDaemonSets struct {
+	appsv1client.DaemonSetInterface
+	// deleteOptions are the options the daemonsets were last deleted with.
+	deleteOptions *metav1.DeleteOptions
+}
+
+func (d *fakeDaemonSets) DeleteCollection(options *metav1.DeleteOptions, listOptions metav1.ListOptions) error {
+	d.deleteOptions = options
+	return nil
+}
+
+func TestCleanup_gracePeriod(t *testing.T) {
+	testCases := []struct {
+		desc     string
+		period   int
+		expected int64
+	}{
+		{
+			desc:     "default",
+			expected: plugin.GracefulShutdownPeriod,
+		}, {
+			desc:     "configured",
+			period:   5,
+			expected: 5,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.desc, func(t *testing.T) {
+			p := NewPlugin(plugin.Definition{Name: "test-plugin"}, expectedNamespace, expectedImageName, "Always", "", nil)
+			if tc.period != 0 {
+				p.SetGracefulShutdownPeriod(tc.period)
+			}
+			client := &fakeClient{daemonSets: &fakeDaemonSets{}}
+
+			if err := p.CleanupWithError(client); err != nil {
+				t.Fatalf("unexpected error cleaning up: %v", err)
+			}
+			opts := client.daemonSets.deleteOptions
+			if opts == nil || opts.GracePeriodSeconds == nil {
+				t.Fatalf("expected daemonsets to be deleted with a grace period, got options %v", opts)
+			}
+			if *opts.GracePeriodSeconds != tc.expected {
+				t.Errorf("expected grace period of %v seconds, got %v", tc.expected, *opts.GracePeriodSeconds)
+			}
+		})
+	}
+}
@@ -67,6 +67,38 @@ spec:
           value: '{{.MasterAddress}}'
         - name: RESULT_TYPE
           value: {{.ResultType}}
+        {{- if .MinTLSVersion }}
+        - name: MIN_TLS_VERSION
+          value: '{{.MinTLSVersion}}'
+        {{- end }}
+        {{- if .CipherSuites }}
+        - name: TLS_CIPHER_SUITES
+          value: '{{.CipherSuites}}'
+        {{- end }}
+        {{- if .TLSServerName }}
+        - name: TLS_SERVER_NAME
+          value: '{{.TLSServerName}}'
+        {{- end }}
+        {{- if .UploadPathPrefix }}
+        - name: UPLOAD_PATH_PREFIX
+          value: '{{.UploadPathPrefix}}'
+        {{- end }}
+        {{- if .ProxyURL }}
+        - name: PROXY_URL
+          value: '{{.ProxyURL}}'
+        {{- end }}
+        {{- if .UploadRetries }}
+        - name: UPLOAD_RETRIES
+          value: '{{.UploadRetries}}'
+        {{- end }}
+        {{- if .UploadTimeout }}
+        - name: UPLOAD_TIMEOUT_SECONDS
+          value: '{{.UploadTimeout}}'
+        {{- end }}
+        {{- if .HeartbeatInterval }}
+        - name: HEARTBEAT_INTERVAL_SECONDS
+          value: '{{.HeartbeatInterval}}'
+        {{- end }}
         - name: CA_CERT
           value: |
             {{.CACert | indent 12}}
@@ -20,10 +20,12 @@ import (
 	"bytes"
 	"crypto/tls"
 	"fmt"
+	"strings"
 	"time"
 
 	"github.com/pkg/errors"
 	v1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	kuberuntime "k8s.io/apimachinery/pkg/runtime"
 	"k8s.io/client-go/kubernetes"
@@ -69,8 +71,15 @@ func (p *Plugin) ExpectedResults(nodes []v1.Node) []plugin.ExpectedResult {
 	}
 }
 
+// getMasterAddress returns the results URL for the given hostname. If hostname
+// is a comma separated list, a URL is returned for each entry.
 func getMasterAddress(hostname string) string {
-	return fmt.Sprintf("https://%s/api/v1/results/global", hostname)
+	hosts := strings.Split(hostname, ",")
+	urls := make([]string, len(hosts))
+	for i, host := range hosts {
+		urls[i] = fmt.Sprintf("https://%s/api/v1/results/global", strings.TrimSpace(host))
+	}
+	return strings.Join(urls, ",")
 }
 
 //FillTemplate populates the internal Job YAML template with the values for this particular job.
@@ -108,11 +117,13 @@ func (p *Plugin) Run(kubeclient kubernetes.Interface, hostname string, cert *tls
 		return errors.Wrapf(err, "couldn't make secret for Job plugin %v", p.GetName())
 	}
 
-	if _, err := kubeclient.CoreV1().Secrets(p.Namespace).Create(secret); err != nil {
+	// Resource names include the session ID, so anything which already exists
+	// was created by an earlier attempt to run this plugin.
+	if _, err := kubeclient.CoreV1().Secrets(p.Namespace).Create(secret); err != nil && !apierrors.IsAlreadyExists(err) {
 		return errors.Wrapf(err, "couldn't create TLS secret for job plugin %v", p.GetName())
 	}
 
-	if _, err := kubeclient.CoreV1().Pods(p.Namespace).Create(&job); err != nil {
+	if _, err := kubeclient.CoreV1().Pods(p.Namespace).Create(&job); err != nil && !apierrors.IsAlreadyExists(err) {
 		return errors.Wrapf(err, "could not create Job resource for Job plugin %v", p.GetName())
 	}
 
@@ -121,7 +132,7 @@ func (p *Plugin) Run(kubeclient kubernetes.Interface, hostname string, cert *tls
 
 // Monitor adheres to plugin.Interface by ensuring the pod created by the job
 // doesn't have any urecoverable failures.
-func (p *Plugin) Monitor(kubeclient kubernetes.Interface, _ []v1.Node, resultsCh chan<- *plugin.Result) {
+func (p *Plugin) Monitor(kubeclient kubernetes.Interface, _ *plugin.NodeCache, resultsCh chan<- *plugin.Result) {
 	for {
 		// Sleep between each poll, which should give the Job
 		// enough time to create a Pod
@@ -135,25 +146,51 @@ func (p *Plugin) Monitor(kubeclient kubernetes.Interface, _ []v1.Node, resultsCh
 		// Make sure there's a pod
 		pod, err := p.findPod(kubeclient)
 		if err != nil {
-			resultsCh <- utils.MakeErrorResult(p.GetResultType(), map[string]interface{}{"error": err.Error()}, "")
+			resultsCh <- utils.MakeErrorResult(p.GetResultType(), map[string]interface{}{
+				"error":    err.Error(),
+				"category": utils.ClassifyError(err),
+			}, "")
 			break
 		}
 
 		// Make sure the pod isn't failing
-		if isFailing, reason := utils.IsPodFailing(pod); isFailing {
+		if reason, category := utils.ClassifyPodFailure(pod); reason != "" {
 			resultsCh <- utils.MakeErrorResult(p.GetResultType(), map[string]interface{}{
-				"error": reason,
-				"pod":   pod,
+				"error":    reason,
+				"category": category,
+				"pod":      pod,
 			}, "")
 			break
 		}
 	}
 }
 
+// requiredAccess is what the aggregator needs to be allowed to do in the
+// plugin's namespace to run it.
+var requiredAccess = []driver.Access{
+	{Resource: "secrets", Verb: "create"},
+	{Resource: "pods", Verb: "create"},
+	{Resource: "pods", Verb: "list"},
+	{Resource: "pods", Verb: "deletecollection"},
+}
+
+// Validate checks the plugin can be run (to adhere to plugin.Validator).
+func (p *Plugin) Validate(kubeclient kubernetes.Interface) []error {
+	return p.ValidateAccess(kubeclient, requiredAccess)
+}
+
 // Cleanup cleans up the k8s Job and ConfigMap created by this plugin instance
 func (p *Plugin) Cleanup(kubeclient kubernetes.Interface) {
+	if err := p.CleanupWithError(kubeclient); err != nil {
+		errlog.LogError(err)
+	}
+}
+
+// CleanupWithError cleans up like Cleanup, returning any error deleting the
+// plugin's pods (to adhere to plugin.CleanupReporter).
+func (p *Plugin) CleanupWithError(kubeclient kubernetes.Interface) error {
 	p.CleanedUp = true
-	gracePeriod := int64(plugin.GracefulShutdownPeriod)
+	gracePeriod := int64(p.GracefulShutdownPeriod())
 	deletionPolicy := metav1.DeletePropagationBackground
 
 	listOptions := metav1.ListOptions{
@@ -174,9 +211,7 @@ func (p *Plugin) Cleanup(kubeclient kubernetes.Interface) {
 		&deleteOptions,
 		listOptions,
 	)
-	if err != nil {
-		errlog.LogError(errors.Wrapf(err, "error deleting pods for Job-%v", p.GetSessionID()))
-	}
+	return errors.Wrapf(err, "error deleting pods for Job-%v", p.GetSessionID())
 }
 
 func (p *Plugin) listOptions() metav1.ListOptions {
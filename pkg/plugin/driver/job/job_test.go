@@ -78,6 +78,11 @@ func TestFillTemplate(t *testing.T) {
 		t.Fatalf("couldn't make client certificate %v", err)
 	}
 
+	testJob.SetUploadOptions(5, 600)
+	testJob.SetHeartbeatInterval(30)
+	testJob.SetTLSServerName("sonobuoy-aggregator.heptio-sonobuoy.svc")
+	testJob.SetUploadPathPrefix("/sonobuoy")
+
 	var pod corev1.Pod
 	b, err := testJob.FillTemplate("", clientCert)
 	if err != nil {
@@ -127,6 +132,19 @@ func TestFillTemplate(t *testing.T) {
 		env[envVar.Name] = envVar.Value
 	}
 
+	if env["UPLOAD_RETRIES"] != "5" || env["UPLOAD_TIMEOUT_SECONDS"] != "600" {
+		t.Errorf("Expected the upload options to be passed to the worker, got retries %q and timeout %q", env["UPLOAD_RETRIES"], env["UPLOAD_TIMEOUT_SECONDS"])
+	}
+	if env["HEARTBEAT_INTERVAL_SECONDS"] != "30" {
+		t.Errorf("Expected the heartbeat interval to be passed to the worker, got %q", env["HEARTBEAT_INTERVAL_SECONDS"])
+	}
+	if env["TLS_SERVER_NAME"] != "sonobuoy-aggregator.heptio-sonobuoy.svc" {
+		t.Errorf("Expected the TLS server name to be passed to the worker, got %q", env["TLS_SERVER_NAME"])
+	}
+	if env["UPLOAD_PATH_PREFIX"] != "/sonobuoy" {
+		t.Errorf("Expected the upload path prefix to be passed to the worker, got %q", env["UPLOAD_PATH_PREFIX"])
+	}
+
 	caCertPEM, ok := env["CA_CERT"]
 	if !ok {
 		t.Fatal("no env var CA_CERT")
@@ -0,0 +1,69 @@
+/*
+Copyright 2018 Heptio Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package driver
+
+import (
+	"strings"
+
+	"github.com/heptio/sonobuoy/pkg/plugin"
+	v1 "k8s.io/api/core/v1"
+)
+
+// GetParameters returns the settings the plugin's pods are created with (to
+// adhere to plugin.Parameterized).
+func (b *Base) GetParameters() plugin.Parameters {
+	spec := b.Definition.Spec
+	return plugin.Parameters{
+		Image:                    spec.Image,
+		ImagePullPolicy:          string(imagePullPolicy(spec.Image, spec.ImagePullPolicy)),
+		Command:                  spec.Command,
+		Args:                     spec.Args,
+		Env:                      spec.Env,
+		WorkingDir:               spec.WorkingDir,
+		ResultFormat:             b.Definition.ResultFormat,
+		DependsOn:                b.Definition.DependsOn,
+		Namespace:                b.Namespace,
+		SessionID:                b.SessionID,
+		SonobuoyImage:            b.SonobuoyImage,
+		MinTLSVersion:            b.MinTLSVersion,
+		CipherSuites:             b.CipherSuites,
+		TLSServerName:            b.TLSServerName,
+		UploadPathPrefix:         b.UploadPathPrefix,
+		ProxyURL:                 b.ProxyURL,
+		UploadRetries:            b.UploadRetries,
+		UploadTimeoutSeconds:     b.UploadTimeoutSeconds,
+		HeartbeatIntervalSeconds: b.HeartbeatIntervalSeconds,
+		GracefulShutdownSeconds:  b.GracefulShutdownPeriod(),
+	}
+}
+
+// imagePullPolicy returns the pull policy Kubernetes gives a container with
+// the given image if the policy is unset: images tagged latest, or not
+// tagged at all, are always pulled.
+func imagePullPolicy(image string, policy v1.PullPolicy) v1.PullPolicy {
+	if policy != "" {
+		return policy
+	}
+	if strings.Contains(image, "@") {
+		return v1.PullIfNotPresent
+	}
+	name := image[strings.LastIndex(image, "/")+1:]
+	if i := strings.LastIndex(name, ":"); i < 0 || name[i+1:] == "latest" {
+		return v1.PullAlways
+	}
+	return v1.PullIfNotPresent
+}
@@ -0,0 +1,88 @@
+/*
+Copyright 2018 Heptio Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package driver
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/heptio/sonobuoy/pkg/plugin"
+	"github.com/heptio/sonobuoy/pkg/plugin/manifest"
+	v1 "k8s.io/api/core/v1"
+)
+
+func TestGetParameters(t *testing.T) {
+	env := []v1.EnvVar{
+		{Name: "E2E_FOCUS", Value: "Conformance"},
+		{Name: "TOKEN", ValueFrom: &v1.EnvVarSource{SecretKeyRef: &v1.SecretKeySelector{Key: "token"}}},
+	}
+	b := &Base{
+		Definition: plugin.Definition{
+			Name:         "e2e",
+			ResultFormat: "junit",
+			Spec: manifest.Container{Container: v1.Container{
+				Image:   "gcr.io/heptio-images/kube-conformance:v1.14.0",
+				Command: []string{"/run_e2e.sh"},
+				Env:     env,
+			}},
+		},
+		Namespace:     "heptio-sonobuoy",
+		SessionID:     "abc123",
+		SonobuoyImage: "gcr.io/heptio-images/sonobuoy:v0.14.0",
+		MinTLSVersion: "1.2",
+	}
+
+	want := plugin.Parameters{
+		Image:                   "gcr.io/heptio-images/kube-conformance:v1.14.0",
+		ImagePullPolicy:         "IfNotPresent",
+		Command:                 []string{"/run_e2e.sh"},
+		Env:                     env,
+		ResultFormat:            "junit",
+		Namespace:               "heptio-sonobuoy",
+		SessionID:               "abc123",
+		SonobuoyImage:           "gcr.io/heptio-images/sonobuoy:v0.14.0",
+		MinTLSVersion:           "1.2",
+		GracefulShutdownSeconds: plugin.GracefulShutdownPeriod,
+	}
+	if got := b.GetParameters(); !reflect.DeepEqual(got, want) {
+		t.Errorf("expected %+v, got %+v", want, got)
+	}
+}
+
+func TestImagePullPolicy(t *testing.T) {
+	testCases := []struct {
+		image  string
+		policy v1.PullPolicy
+		want   v1.PullPolicy
+	}{
+		{image: "busybox", want: v1.PullAlways},
+		{image: "busybox:latest", want: v1.PullAlways},
+		{image: "busybox:1.30", want: v1.PullIfNotPresent},
+		{image: "localhost:5000/busybox", want: v1.PullAlways},
+		{image: "localhost:5000/busybox:1.30", want: v1.PullIfNotPresent},
+		{image: "busybox@sha256:abcd", want: v1.PullIfNotPresent},
+		{image: "busybox", policy: v1.PullNever, want: v1.PullNever},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.image, func(t *testing.T) {
+			if got := imagePullPolicy(tc.image, tc.policy); got != tc.want {
+				t.Errorf("expected %v, got %v", tc.want, got)
+			}
+		})
+	}
+}
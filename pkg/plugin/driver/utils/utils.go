@@ -21,11 +21,15 @@ import (
 	"encoding/hex"
 	"encoding/json"
 	"fmt"
+	"net"
 
 	"github.com/heptio/sonobuoy/pkg/plugin"
+	"github.com/pkg/errors"
 	gouuid "github.com/satori/go.uuid"
 
 	v1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	utilnet "k8s.io/apimachinery/pkg/util/net"
 )
 
 // GetSessionID generates a new session id.
@@ -39,13 +43,21 @@ func GetSessionID() string {
 
 // IsPodFailing returns whether a plugin's pod is failing and isn't likely to
 // succeed.
+func IsPodFailing(pod *v1.Pod) (bool, string) {
+	reason, _ := ClassifyPodFailure(pod)
+	return reason != "", reason
+}
+
+// ClassifyPodFailure returns why a plugin's pod is failing and one of the
+// plugin.ErrorCategory constants for it, or empty strings if the pod isn't
+// failing.
 // TODO: this may require more revisions as we get more experience with
 // various types of failures that can occur.
-func IsPodFailing(pod *v1.Pod) (bool, string) {
+func ClassifyPodFailure(pod *v1.Pod) (reason, category string) {
 	// Check if the pod is unschedulable
 	for _, cond := range pod.Status.Conditions {
 		if cond.Reason == "Unschedulable" {
-			return true, fmt.Sprintf("Can't schedule pod: %v", cond.Message)
+			return fmt.Sprintf("Can't schedule pod: %v", cond.Message), plugin.ErrorCategoryUnschedulable
 		}
 	}
 
@@ -53,39 +65,101 @@ func IsPodFailing(pod *v1.Pod) (bool, string) {
 		// Check if a container in the pod is restarting multiple times
 		if cstatus.RestartCount > 2 {
 			errstr := fmt.Sprintf("Container %v has restarted unsuccessfully %v times", cstatus.Name, cstatus.RestartCount)
-			return true, errstr
+			return errstr, plugin.ErrorCategoryCrash
 		}
 
 		// Check if it can't fetch its image
-		if waiting := cstatus.State.Waiting; waiting != nil {
-			if waiting.Reason == "ImagePullBackOff" || waiting.Reason == "ErrImagePull" {
-				errstr := fmt.Sprintf("Container %v is in state %v", cstatus.Name, waiting.Reason)
-				return true, errstr
-			}
+		if waiting := cstatus.State.Waiting; waiting != nil && isImagePullReason(waiting.Reason) {
+			errstr := fmt.Sprintf("Container %v is in state %v", cstatus.Name, waiting.Reason)
+			return errstr, plugin.ErrorCategoryImagePull
 		}
 	}
 
-	return false, ""
+	return "", ""
+}
+
+// PendingPodCategory returns one of the plugin.ErrorCategory constants for
+// why the pod hasn't started: its image isn't being pulled, it can't be
+// scheduled, or ErrorCategoryUnknown.
+func PendingPodCategory(pod *v1.Pod) string {
+	for _, cond := range pod.Status.Conditions {
+		if cond.Type == v1.PodScheduled && cond.Status == v1.ConditionFalse {
+			return plugin.ErrorCategoryUnschedulable
+		}
+	}
+	for _, cstatus := range pod.Status.ContainerStatuses {
+		if waiting := cstatus.State.Waiting; waiting != nil && isImagePullReason(waiting.Reason) {
+			return plugin.ErrorCategoryImagePull
+		}
+	}
+	return plugin.ErrorCategoryUnknown
+}
+
+// isImagePullReason returns true if a container is waiting for the given
+// reason because its image can't be pulled.
+func isImagePullReason(reason string) bool {
+	switch reason {
+	case "ImagePullBackOff", "ErrImagePull", "InvalidImageName", "ErrImageNeverPull":
+		return true
+	}
+	return false
+}
+
+// ClassifyError returns one of the plugin.ErrorCategory constants for an
+// error talking to the Kubernetes API: ErrorCategoryRBAC if the request
+// wasn't allowed, ErrorCategoryNetwork if it failed in transit or timed
+// out, and ErrorCategoryUnknown otherwise.
+func ClassifyError(err error) string {
+	err = errors.Cause(err)
+	switch {
+	case err == nil:
+		return ""
+	case apierrors.IsForbidden(err), apierrors.IsUnauthorized(err):
+		return plugin.ErrorCategoryRBAC
+	case apierrors.IsTimeout(err), apierrors.IsServerTimeout(err), apierrors.IsServiceUnavailable(err), utilnet.IsConnectionReset(err):
+		return plugin.ErrorCategoryNetwork
+	}
+	if _, ok := err.(net.Error); ok {
+		return plugin.ErrorCategoryNetwork
+	}
+	return plugin.ErrorCategoryUnknown
 }
 
 // MakeErrorResult constructs a plugin.Result given an error message and error
 // data.  errdata is a map that will be placed in the sonobuoy results tarball
 // for this plugin as a JSON file, so it's what users will see for why the
 // plugin failed.  If errdata["error"] is not set, it will be filled in with an
-// "Unknown error" string.
+// "Unknown error" string. errdata["category"] is the ErrorCategory of the
+// result, one of the plugin.ErrorCategory constants, which is
+// plugin.ErrorCategoryUnknown if it isn't set. The category is only left in
+// the JSON file if the error was classified.
 func MakeErrorResult(resultType string, errdata map[string]interface{}, nodeName string) *plugin.Result {
-	errJSON, _ := json.Marshal(errdata)
-
 	errstr := "Unknown error"
 	if e, ok := errdata["error"]; ok {
 		errstr = e.(string)
 	}
 
+	category, _ := errdata["category"].(string)
+	if category == "" || category == plugin.ErrorCategoryUnknown {
+		category = plugin.ErrorCategoryUnknown
+		if _, ok := errdata["category"]; ok {
+			unclassified := make(map[string]interface{}, len(errdata))
+			for k, v := range errdata {
+				if k != "category" {
+					unclassified[k] = v
+				}
+			}
+			errdata = unclassified
+		}
+	}
+	errJSON, _ := json.Marshal(errdata)
+
 	return &plugin.Result{
-		Body:       bytes.NewReader(errJSON),
-		Error:      errstr,
-		ResultType: resultType,
-		NodeName:   nodeName,
-		MimeType:   "application/json",
+		Body:          bytes.NewReader(errJSON),
+		Error:         errstr,
+		ErrorCategory: category,
+		ResultType:    resultType,
+		NodeName:      nodeName,
+		MimeType:      "application/json",
 	}
 }
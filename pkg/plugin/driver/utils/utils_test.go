@@ -0,0 +1,157 @@
+/*
+Copyright 2018 Heptio Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package utils
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"reflect"
+	"testing"
+
+	"github.com/heptio/sonobuoy/pkg/plugin"
+	"github.com/pkg/errors"
+	v1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+)
+
+func waitingPod(reason string) *v1.Pod {
+	return &v1.Pod{Status: v1.PodStatus{ContainerStatuses: []v1.ContainerStatus{{
+		Name:  "plugin",
+		State: v1.ContainerState{Waiting: &v1.ContainerStateWaiting{Reason: reason}},
+	}}}}
+}
+
+func TestClassifyPodFailure(t *testing.T) {
+	testCases := []struct {
+		desc     string
+		pod      *v1.Pod
+		reason   string
+		category string
+	}{
+		{desc: "Running", pod: &v1.Pod{}},
+		{
+			desc:     "Unschedulable",
+			pod:      &v1.Pod{Status: v1.PodStatus{Conditions: []v1.PodCondition{{Reason: "Unschedulable", Message: "0/3 nodes are available"}}}},
+			reason:   "Can't schedule pod: 0/3 nodes are available",
+			category: plugin.ErrorCategoryUnschedulable,
+		}, {
+			desc:     "Restarting",
+			pod:      &v1.Pod{Status: v1.PodStatus{ContainerStatuses: []v1.ContainerStatus{{Name: "plugin", RestartCount: 3}}}},
+			reason:   "Container plugin has restarted unsuccessfully 3 times",
+			category: plugin.ErrorCategoryCrash,
+		}, {
+			desc:     "Image pull",
+			pod:      waitingPod("ImagePullBackOff"),
+			reason:   "Container plugin is in state ImagePullBackOff",
+			category: plugin.ErrorCategoryImagePull,
+		},
+		{desc: "Creating", pod: waitingPod("ContainerCreating")},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.desc, func(t *testing.T) {
+			reason, category := ClassifyPodFailure(tc.pod)
+			if reason != tc.reason || category != tc.category {
+				t.Errorf("expected %q (%v), got %q (%v)", tc.reason, tc.category, reason, category)
+			}
+			if failing, _ := IsPodFailing(tc.pod); failing != (tc.reason != "") {
+				t.Errorf("expected IsPodFailing to agree, got %v", failing)
+			}
+		})
+	}
+}
+
+func TestPendingPodCategory(t *testing.T) {
+	unscheduled := &v1.Pod{Status: v1.PodStatus{Conditions: []v1.PodCondition{{Type: v1.PodScheduled, Status: v1.ConditionFalse}}}}
+	if got := PendingPodCategory(unscheduled); got != plugin.ErrorCategoryUnschedulable {
+		t.Errorf("expected an unscheduled pod to be unschedulable, got %v", got)
+	}
+	if got := PendingPodCategory(waitingPod("ErrImagePull")); got != plugin.ErrorCategoryImagePull {
+		t.Errorf("expected a pod pulling its image to be an image pull failure, got %v", got)
+	}
+	if got := PendingPodCategory(waitingPod("ContainerCreating")); got != plugin.ErrorCategoryUnknown {
+		t.Errorf("expected a pod still being created to be unknown, got %v", got)
+	}
+}
+
+func TestClassifyError(t *testing.T) {
+	resource := schema.GroupResource{Resource: "pods"}
+	testCases := []struct {
+		desc string
+		err  error
+		want string
+	}{
+		{desc: "None"},
+		{desc: "Forbidden", err: errors.Wrap(apierrors.NewForbidden(resource, "e2e", errors.New("no")), "couldn't create pod"), want: plugin.ErrorCategoryRBAC},
+		{desc: "Unauthorized", err: apierrors.NewUnauthorized("no"), want: plugin.ErrorCategoryRBAC},
+		{desc: "Server timeout", err: apierrors.NewServerTimeout(resource, "create", 1), want: plugin.ErrorCategoryNetwork},
+		{desc: "Connection refused", err: &net.OpError{Op: "dial", Net: "tcp", Err: errors.New("connection refused")}, want: plugin.ErrorCategoryNetwork},
+		{desc: "Invalid", err: apierrors.NewBadRequest("bad pod"), want: plugin.ErrorCategoryUnknown},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.desc, func(t *testing.T) {
+			if got := ClassifyError(tc.err); got != tc.want {
+				t.Errorf("expected %q, got %q", tc.want, got)
+			}
+		})
+	}
+}
+
+func TestMakeErrorResult(t *testing.T) {
+	testCases := []struct {
+		desc     string
+		errdata  map[string]interface{}
+		category string
+	}{
+		{desc: "Category", errdata: map[string]interface{}{"error": "timed out", "category": plugin.ErrorCategoryTimeout}, category: plugin.ErrorCategoryTimeout},
+		{desc: "No category", errdata: map[string]interface{}{"error": "failed"}, category: plugin.ErrorCategoryUnknown},
+		{desc: "Unknown category", errdata: map[string]interface{}{"error": "failed", "category": plugin.ErrorCategoryUnknown}, category: plugin.ErrorCategoryUnknown},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.desc, func(t *testing.T) {
+			given := len(tc.errdata)
+			result := MakeErrorResult("e2e", tc.errdata, "")
+			if result.ErrorCategory != tc.category {
+				t.Errorf("expected category %v, got %v", tc.category, result.ErrorCategory)
+			}
+			if len(tc.errdata) != given {
+				t.Errorf("expected the error data not to be modified, got %v", tc.errdata)
+			}
+
+			blob, err := ioutil.ReadAll(result.Body)
+			if err != nil {
+				t.Fatalf("couldn't read body: %v", err)
+			}
+			var body map[string]interface{}
+			if err := json.Unmarshal(blob, &body); err != nil {
+				t.Fatalf("couldn't unmarshal body %s: %v", blob, err)
+			}
+			// Only classified errors have their category in the body
+			want := map[string]interface{}{"error": tc.errdata["error"]}
+			if tc.category != plugin.ErrorCategoryUnknown {
+				want["category"] = tc.category
+			}
+			if !reflect.DeepEqual(body, want) {
+				t.Errorf("expected the body %v, got %v", want, body)
+			}
+		})
+	}
+}
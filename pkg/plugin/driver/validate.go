@@ -0,0 +1,88 @@
+/*
+Copyright 2018 Heptio Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package driver
+
+import (
+	"fmt"
+
+	"github.com/pkg/errors"
+	authv1 "k8s.io/api/authorization/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+)
+
+// Access is something a driver needs to be allowed to do in the plugin's
+// namespace, such as create pods.
+type Access struct {
+	// Group is the API group of the resource, empty for the core group.
+	Group    string
+	Resource string
+	Verb     string
+}
+
+// ValidateAccess checks that the plugin's namespace exists, that its images
+// are set and that the aggregator is allowed everything in required there,
+// returning every problem found. Images can't be pulled to check they
+// exist, so they're only checked for being set.
+func (b *Base) ValidateAccess(client kubernetes.Interface, required []Access) (errs []error) {
+	if b.Definition.Spec.Image == "" {
+		errs = append(errs, errors.New("no image is set for the plugin's container"))
+	}
+	if b.SonobuoyImage == "" {
+		errs = append(errs, errors.New("no image is set for the sonobuoy worker"))
+	}
+
+	// Not being allowed to get namespaces doesn't stop the plugin running,
+	// so it's only the namespace not existing which is a problem.
+	_, err := client.CoreV1().Namespaces().Get(b.Namespace, metav1.GetOptions{})
+	switch {
+	case apierrors.IsNotFound(err):
+		return append(errs, errors.Errorf("namespace %v doesn't exist", b.Namespace))
+	case err != nil && !apierrors.IsForbidden(err):
+		errs = append(errs, errors.Wrapf(err, "couldn't check namespace %v exists", b.Namespace))
+	}
+
+	for _, access := range required {
+		review := &authv1.SelfSubjectAccessReview{
+			Spec: authv1.SelfSubjectAccessReviewSpec{
+				ResourceAttributes: &authv1.ResourceAttributes{
+					Namespace: b.Namespace,
+					Group:     access.Group,
+					Resource:  access.Resource,
+					Verb:      access.Verb,
+				},
+			},
+		}
+		review, err := client.AuthorizationV1().SelfSubjectAccessReviews().Create(review)
+		switch {
+		case err != nil:
+			errs = append(errs, errors.Wrapf(err, "couldn't check whether the aggregator can %v", access))
+		case !review.Status.Allowed:
+			errs = append(errs, errors.Errorf("the aggregator isn't allowed to %v in namespace %v", access, b.Namespace))
+		}
+	}
+	return errs
+}
+
+// String describes the access, e.g. "create daemonsets.apps".
+func (a Access) String() string {
+	if a.Group == "" {
+		return fmt.Sprintf("%v %v", a.Verb, a.Resource)
+	}
+	return fmt.Sprintf("%v %v.%v", a.Verb, a.Resource, a.Group)
+}
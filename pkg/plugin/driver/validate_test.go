@@ -0,0 +1,146 @@
+/*
+Copyright 2018 Heptio Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package driver
+
+import (
+	"strings"
+	"testing"
+
+	authv1 "k8s.io/api/authorization/v1"
+	v1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/kubernetes"
+	authorizationv1 "k8s.io/client-go/kubernetes/typed/authorization/v1"
+	corev1 "k8s.io/client-go/kubernetes/typed/core/v1"
+)
+
+type fakeClient struct {
+	kubernetes.Interface
+	// namespaceErr is returned when getting a namespace.
+	namespaceErr error
+	// denied lists the accesses the aggregator isn't allowed.
+	denied map[string]bool
+}
+
+func (c *fakeClient) CoreV1() corev1.CoreV1Interface {
+	return &fakeCoreV1{err: c.namespaceErr}
+}
+
+func (c *fakeClient) AuthorizationV1() authorizationv1.AuthorizationV1Interface {
+	return &fakeAuthorizationV1{denied: c.denied}
+}
+
+type fakeCoreV1 struct {
+	corev1.CoreV1Interface
+	err error
+}
+
+func (c *fakeCoreV1) Namespaces() corev1.NamespaceInterface {
+	return &fakeNamespaces{err: c.err}
+}
+
+type fakeNamespaces struct {
+	corev1.NamespaceInterface
+	err error
+}
+
+func (n *fakeNamespaces) Get(name string, opts metav1.GetOptions) (*v1.Namespace, error) {
+	return &v1.Namespace{}, n.err
+}
+
+type fakeAuthorizationV1 struct {
+	authorizationv1.AuthorizationV1Interface
+	denied map[string]bool
+}
+
+func (a *fakeAuthorizationV1) SelfSubjectAccessReviews() authorizationv1.SelfSubjectAccessReviewInterface {
+	return &fakeReviews{denied: a.denied}
+}
+
+type fakeReviews struct {
+	authorizationv1.SelfSubjectAccessReviewInterface
+	denied map[string]bool
+}
+
+func (r *fakeReviews) Create(review *authv1.SelfSubjectAccessReview) (*authv1.SelfSubjectAccessReview, error) {
+	attrs := review.Spec.ResourceAttributes
+	access := Access{Group: attrs.Group, Resource: attrs.Resource, Verb: attrs.Verb}
+	review.Status.Allowed = !r.denied[access.String()]
+	return review, nil
+}
+
+func TestValidateAccess(t *testing.T) {
+	required := []Access{
+		{Resource: "pods", Verb: "create"},
+		{Group: "apps", Resource: "daemonsets", Verb: "create"},
+	}
+	notFound := apierrors.NewNotFound(schema.GroupResource{Resource: "namespaces"}, "missing")
+	forbidden := apierrors.NewForbidden(schema.GroupResource{Resource: "namespaces"}, "heptio-sonobuoy", nil)
+
+	testCases := []struct {
+		desc     string
+		image    string
+		client   *fakeClient
+		expected []string
+	}{
+		{
+			desc:   "everything allowed",
+			image:  "gcr.io/heptio-images/sonobuoy-plugin-e2e:latest",
+			client: &fakeClient{},
+		}, {
+			desc:     "no plugin image",
+			client:   &fakeClient{},
+			expected: []string{"no image is set for the plugin's container"},
+		}, {
+			desc:     "namespace missing",
+			image:    "gcr.io/heptio-images/sonobuoy-plugin-e2e:latest",
+			client:   &fakeClient{namespaceErr: notFound},
+			expected: []string{"namespace heptio-sonobuoy doesn't exist"},
+		}, {
+			desc:   "not allowed to get namespaces",
+			image:  "gcr.io/heptio-images/sonobuoy-plugin-e2e:latest",
+			client: &fakeClient{namespaceErr: forbidden},
+		}, {
+			desc:   "access denied",
+			image:  "gcr.io/heptio-images/sonobuoy-plugin-e2e:latest",
+			client: &fakeClient{denied: map[string]bool{"create pods": true, "create daemonsets.apps": true}},
+			expected: []string{
+				"the aggregator isn't allowed to create pods in namespace heptio-sonobuoy",
+				"the aggregator isn't allowed to create daemonsets.apps in namespace heptio-sonobuoy",
+			},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.desc, func(t *testing.T) {
+			b := &Base{Namespace: "heptio-sonobuoy", SonobuoyImage: "gcr.io/heptio-images/sonobuoy:latest"}
+			b.Definition.Spec.Image = tc.image
+
+			errs := b.ValidateAccess(tc.client, required)
+			if len(errs) != len(tc.expected) {
+				t.Fatalf("expected %v errors, got %v", len(tc.expected), errs)
+			}
+			for i, err := range errs {
+				if !strings.Contains(err.Error(), tc.expected[i]) {
+					t.Errorf("expected error %q, got %q", tc.expected[i], err)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,96 @@
+/*
+Copyright 2018 Heptio Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package plugin
+
+import (
+	"github.com/pkg/errors"
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/labels"
+)
+
+// ExpectedResultsOverride is the results a plugin is expected to submit in
+// place of the ones it estimates itself, for plugins which know better than
+// their driver which nodes report, e.g. only control plane nodes. Exactly one
+// of its fields must be set.
+type ExpectedResultsOverride struct {
+	// Nodes are the names of the nodes a result is expected from, whether
+	// or not they're in the cluster.
+	Nodes []string `json:"nodes,omitempty"`
+	// NodeSelector is a label selector picking the nodes a result is
+	// expected from, out of those the run covers, e.g.
+	// "node-role.kubernetes.io/control-plane".
+	NodeSelector string `json:"nodeselector,omitempty"`
+	// Global expects a single result which isn't from any node.
+	Global bool `json:"global,omitempty"`
+}
+
+// Validate returns an error if the override doesn't say which results are
+// expected, says so more than one way, or names a node twice.
+func (o ExpectedResultsOverride) Validate() error {
+	set := 0
+	for _, isSet := range []bool{len(o.Nodes) > 0, o.NodeSelector != "", o.Global} {
+		if isSet {
+			set++
+		}
+	}
+	if set != 1 {
+		return errors.New("exactly one of nodes, nodeselector or global must be set")
+	}
+
+	seen := map[string]bool{}
+	for _, node := range o.Nodes {
+		if node == "" {
+			return errors.New("node names must not be empty")
+		}
+		if seen[node] {
+			return errors.Errorf("node %v is listed more than once", node)
+		}
+		seen[node] = true
+	}
+
+	if o.NodeSelector != "" {
+		if _, err := labels.Parse(o.NodeSelector); err != nil {
+			return errors.Wrapf(err, "invalid node selector %q", o.NodeSelector)
+		}
+	}
+	return nil
+}
+
+// ExpectedResults returns the results of the given type expected by the
+// override from the given nodes. The override must be valid.
+func (o ExpectedResultsOverride) ExpectedResults(resultType string, nodes []v1.Node) []ExpectedResult {
+	if o.Global {
+		return []ExpectedResult{{ResultType: resultType}}
+	}
+
+	var ret []ExpectedResult
+	for _, node := range o.Nodes {
+		ret = append(ret, ExpectedResult{NodeName: node, ResultType: resultType})
+	}
+	if o.NodeSelector != "" {
+		selector, err := labels.Parse(o.NodeSelector)
+		if err != nil {
+			return nil
+		}
+		for _, node := range nodes {
+			if selector.Matches(labels.Set(node.Labels)) {
+				ret = append(ret, ExpectedResult{NodeName: node.Name, ResultType: resultType})
+			}
+		}
+	}
+	return ret
+}
@@ -0,0 +1,91 @@
+/*
+Copyright 2018 Heptio Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package plugin
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestExpectedResultsOverride(t *testing.T) {
+	nodes := []v1.Node{
+		{ObjectMeta: metav1.ObjectMeta{Name: "master", Labels: map[string]string{"node-role.kubernetes.io/control-plane": ""}}},
+		{ObjectMeta: metav1.ObjectMeta{Name: "worker"}},
+	}
+
+	testCases := []struct {
+		desc      string
+		override  ExpectedResultsOverride
+		expectErr string
+		expected  []ExpectedResult
+	}{
+		{
+			desc:     "Nodes",
+			override: ExpectedResultsOverride{Nodes: []string{"worker", "elsewhere"}},
+			expected: []ExpectedResult{{NodeName: "worker", ResultType: "logs"}, {NodeName: "elsewhere", ResultType: "logs"}},
+		}, {
+			desc:     "Node selector",
+			override: ExpectedResultsOverride{NodeSelector: "node-role.kubernetes.io/control-plane"},
+			expected: []ExpectedResult{{NodeName: "master", ResultType: "logs"}},
+		}, {
+			desc:     "Global",
+			override: ExpectedResultsOverride{Global: true},
+			expected: []ExpectedResult{{ResultType: "logs"}},
+		}, {
+			desc:      "Nothing set",
+			expectErr: "exactly one of nodes, nodeselector or global must be set",
+		}, {
+			desc:      "More than one set",
+			override:  ExpectedResultsOverride{Nodes: []string{"worker"}, Global: true},
+			expectErr: "exactly one of nodes, nodeselector or global must be set",
+		}, {
+			desc:      "Duplicate node",
+			override:  ExpectedResultsOverride{Nodes: []string{"worker", "master", "worker"}},
+			expectErr: "node worker is listed more than once",
+		}, {
+			desc:      "Empty node name",
+			override:  ExpectedResultsOverride{Nodes: []string{""}},
+			expectErr: "node names must not be empty",
+		}, {
+			desc:      "Invalid node selector",
+			override:  ExpectedResultsOverride{NodeSelector: "role in (a"},
+			expectErr: `invalid node selector "role in (a"`,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.desc, func(t *testing.T) {
+			err := tc.override.Validate()
+			if tc.expectErr != "" {
+				if err == nil || !strings.HasPrefix(err.Error(), tc.expectErr) {
+					t.Errorf("expected error %q, got %v", tc.expectErr, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if got := tc.override.ExpectedResults("logs", nodes); !reflect.DeepEqual(got, tc.expected) {
+				t.Errorf("expected %+v, got %+v", tc.expected, got)
+			}
+		})
+	}
+}
@@ -18,8 +18,12 @@ package plugin
 
 import (
 	"crypto/tls"
+	"fmt"
 	"io"
+	"net/url"
 	"path"
+	"strings"
+	"time"
 
 	"github.com/heptio/sonobuoy/pkg/plugin/manifest"
 	v1 "k8s.io/api/core/v1"
@@ -37,8 +41,9 @@ type Interface interface {
 	// Monitor continually checks for problems in the resources created by a
 	// plugin (either because it won't schedule, or the image won't
 	// download, too many failed executions, etc) and sends the errors as
-	// Result objects through the provided channel.
-	Monitor(kubeClient kubernetes.Interface, availableNodes []v1.Node, resultsCh chan<- *Result)
+	// Result objects through the provided channel. The nodes the plugin
+	// may run on are read from the shared node cache.
+	Monitor(kubeClient kubernetes.Interface, nodes *NodeCache, resultsCh chan<- *Result)
 	// ExpectedResults is an array of Result objects that a plugin should
 	// expect to submit.
 	ExpectedResults(nodes []v1.Node) []ExpectedResult
@@ -51,22 +56,231 @@ type Interface interface {
 	GetName() string
 }
 
+// Dependent is implemented by plugins which must not be run until other
+// plugins have completed successfully.
+type Dependent interface {
+	// GetDependsOn returns the names of the plugins this plugin depends on.
+	GetDependsOn() []string
+}
+
+// Formatted is implemented by plugins which declare the format of their
+// results.
+type Formatted interface {
+	// GetResultFormat returns the format of the plugin's results, or an
+	// empty string if it doesn't declare one.
+	GetResultFormat() string
+}
+
+// Validated is implemented by plugins which declare a JSON Schema their
+// results must match.
+type Validated interface {
+	// GetResultSchema returns the JSON Schema of the plugin's results, or
+	// nil if it doesn't declare one.
+	GetResultSchema() []byte
+}
+
+// Reduced is implemented by plugins which opt in to having their results
+// merged into one more artifact once they've all arrived.
+type Reduced interface {
+	// GetResultReducer returns the name of the reducer the plugin's results
+	// are merged with, or an empty string if they aren't merged.
+	GetResultReducer() string
+}
+
+// Prioritized is implemented by plugins which declare the priority of their
+// results, which decides the order results are handled in when more arrive
+// than the aggregator can handle at once.
+type Prioritized interface {
+	// GetResultPriority returns the priority of the plugin's results,
+	// higher first, or 0 if it doesn't declare one.
+	GetResultPriority() int
+}
+
+// Sessioned is implemented by plugins whose pods are labelled with
+// SessionLabel and their session ID.
+type Sessioned interface {
+	// GetSessionID returns the session ID of this instance of the plugin.
+	GetSessionID() string
+}
+
+// TLSConfigurable is implemented by plugins whose workers can be told which
+// TLS settings to use when submitting results.
+type TLSConfigurable interface {
+	// SetTLSOptions sets the minimum TLS version and cipher suites, as in
+	// the aggregation config, the plugin's workers use.
+	SetTLSOptions(minVersion string, cipherSuites []string)
+}
+
+// ServerNameConfigurable is implemented by plugins whose workers can be told
+// which server name to expect the aggregator's certificate to be valid for.
+type ServerNameConfigurable interface {
+	// SetTLSServerName sets the server name the plugin's workers verify
+	// the aggregator's certificate against, as in the aggregation config.
+	SetTLSServerName(name string)
+}
+
+// PathPrefixConfigurable is implemented by plugins whose workers can be told
+// which path prefix the aggregator's routes are reached under.
+type PathPrefixConfigurable interface {
+	// SetUploadPathPrefix sets the path prefix the plugin's workers put
+	// before the paths they submit results to, as in the aggregation
+	// config.
+	SetUploadPathPrefix(prefix string)
+}
+
+// ProxyConfigurable is implemented by plugins whose workers can be told
+// which proxy to submit results through.
+type ProxyConfigurable interface {
+	// SetProxyURL sets the URL of the proxy the plugin's workers submit
+	// results through, as in the aggregation config.
+	SetProxyURL(proxyURL string)
+}
+
+// UploadConfigurable is implemented by plugins whose workers can be told how
+// to retry submitting results which fail.
+type UploadConfigurable interface {
+	// SetUploadOptions sets how many times the plugin's workers retry a
+	// failed upload and how long, in seconds, they keep trying altogether,
+	// as in the aggregation config.
+	SetUploadOptions(retries, timeoutSeconds int)
+}
+
+// HeartbeatConfigurable is implemented by plugins whose workers can be told
+// to send the aggregator heartbeats while they wait for the plugin.
+type HeartbeatConfigurable interface {
+	// SetHeartbeatInterval sets how often, in seconds, the plugin's workers
+	// send heartbeats, as in the aggregation config. Zero disables them.
+	SetHeartbeatInterval(seconds int)
+}
+
+// GracefulShutdownConfigurable is implemented by plugins which can be told
+// how long their pods have to finish when they're cleaned up.
+type GracefulShutdownConfigurable interface {
+	// SetGracefulShutdownPeriod sets the grace period, in seconds, given to
+	// the plugin's pods when they're deleted.
+	SetGracefulShutdownPeriod(seconds int)
+}
+
+// Validator is implemented by plugins which can check they're able to run
+// before any plugin is launched.
+type Validator interface {
+	// Validate returns every problem which would stop the plugin running,
+	// such as its namespace not existing or missing RBAC permissions.
+	Validate(kubeClient kubernetes.Interface) []error
+}
+
+// CleanupReporter is implemented by plugins which can report whether
+// cleaning up after them failed.
+type CleanupReporter interface {
+	// CleanupWithError cleans up all resources created by the plugin, like
+	// Cleanup, returning any error doing so.
+	CleanupWithError(kubeClient kubernetes.Interface) error
+}
+
+// Namespaced is implemented by plugins which know the namespace their pods
+// run in.
+type Namespaced interface {
+	// GetNamespace returns the namespace of the plugin's pods.
+	GetNamespace() string
+}
+
+// Parameterized is implemented by plugins which can report the settings
+// they're launched with.
+type Parameterized interface {
+	// GetParameters returns the settings the plugin is launched with, with
+	// any defaults applied.
+	GetParameters() Parameters
+}
+
+// Parameters are the settings a plugin is launched with, which are recorded
+// alongside its results so that the run can be reproduced.
+type Parameters struct {
+	Image           string   `json:"image"`
+	ImagePullPolicy string   `json:"imagepullpolicy,omitempty"`
+	Command         []string `json:"command,omitempty"`
+	Args            []string `json:"args,omitempty"`
+	// Env is the environment of the plugin's container. Variables set from
+	// a source, such as a secret, only record where they're from.
+	Env          []v1.EnvVar `json:"env,omitempty"`
+	WorkingDir   string      `json:"workingdir,omitempty"`
+	ResultFormat string      `json:"resultformat,omitempty"`
+	DependsOn    []string    `json:"dependson,omitempty"`
+	Namespace    string      `json:"namespace"`
+	SessionID    string      `json:"sessionid,omitempty"`
+	// SonobuoyImage is the image of the worker which submits the results.
+	SonobuoyImage string   `json:"sonobuoyimage"`
+	MinTLSVersion string   `json:"mintlsversion,omitempty"`
+	CipherSuites  []string `json:"ciphersuites,omitempty"`
+	// TLSServerName is the server name the worker verifies the
+	// aggregator's certificate against, if it isn't the advertise address.
+	TLSServerName string `json:"tlsservername,omitempty"`
+	// UploadPathPrefix is the path prefix the worker puts before the paths
+	// it submits results to.
+	UploadPathPrefix string `json:"uploadpathprefix,omitempty"`
+	// ProxyURL is the proxy the worker submits results through.
+	ProxyURL string `json:"proxyurl,omitempty"`
+	// UploadRetries and UploadTimeoutSeconds are how the worker retries
+	// failed uploads.
+	UploadRetries        int `json:"uploadretries,omitempty"`
+	UploadTimeoutSeconds int `json:"uploadtimeoutseconds,omitempty"`
+	// HeartbeatIntervalSeconds is how often the worker sends heartbeats.
+	HeartbeatIntervalSeconds int `json:"heartbeatintervalseconds,omitempty"`
+	// GracefulShutdownSeconds is the grace period the plugin's pods are
+	// deleted with.
+	GracefulShutdownSeconds int `json:"gracefulshutdownseconds"`
+}
+
 // Definition defines a plugin's features, method of launch, and other
 // metadata about it.
 type Definition struct {
 	Name         string
 	ResultType   string
-	Spec         manifest.Container
-	ExtraVolumes []manifest.Volume
+	ResultFormat string
+	// ResultSchema, if set, is the JSON Schema the plugin's results must
+	// match.
+	ResultSchema []byte
+	// ResultReducer, if set, names the reducer the plugin's results are
+	// merged with.
+	ResultReducer string
+	// ResultPriority is the priority of the plugin's results.
+	ResultPriority int
+	Spec           manifest.Container
+	ExtraVolumes   []manifest.Volume
+	DependsOn      []string
 }
 
 // ExpectedResult is an expected result that a plugin will submit.  This is so
 // the aggregation server can know when it all results have been received.
 type ExpectedResult struct {
-	NodeName   string
-	ResultType string
+	NodeName   string `json:"node"`
+	ResultType string `json:"resulttype"`
+	// Topology is the value of the topology label on the node, e.g. its
+	// zone, for node-specific results if a label is configured.
+	Topology string `json:"topology,omitempty"`
 }
 
+// Error categories classify why a result failed, so that failures can be
+// grouped by cause.
+const (
+	// ErrorCategoryImagePull is for images which couldn't be pulled.
+	ErrorCategoryImagePull = "ImagePull"
+	// ErrorCategoryRBAC is for requests the aggregator wasn't allowed to
+	// make.
+	ErrorCategoryRBAC = "RBAC"
+	// ErrorCategoryTimeout is for plugins which didn't finish in time.
+	ErrorCategoryTimeout = "Timeout"
+	// ErrorCategoryCrash is for containers which kept restarting, and
+	// monitors which panicked.
+	ErrorCategoryCrash = "Crash"
+	// ErrorCategoryNetwork is for requests and uploads which failed in
+	// transit.
+	ErrorCategoryNetwork = "Network"
+	// ErrorCategoryUnschedulable is for pods which couldn't be scheduled.
+	ErrorCategoryUnschedulable = "Unschedulable"
+	// ErrorCategoryUnknown is for every other failure.
+	ErrorCategoryUnknown = "Unknown"
+)
+
 // Result represents a result we got from a dispatched plugin, returned to the
 // aggregation server over HTTP.  Errors running a plugin are also considered a
 // Result, if they have an Error property set.
@@ -76,6 +290,56 @@ type Result struct {
 	MimeType   string
 	Body       io.Reader
 	Error      string
+	// ErrorCategory classifies why the result failed, one of the
+	// ErrorCategory constants. It is only set along with Error.
+	ErrorCategory string
+	// Partial is true for the chunks a plugin may stream before submitting
+	// its final result. They are saved as they arrive but don't complete
+	// the expected result.
+	Partial bool
+	// Sequence orders the partial results of a plugin on a node.
+	Sequence int
+	// Filename, if set, is the name the plugin gave the result, possibly
+	// in a subdirectory, which it's written under in the directory of its
+	// node instead of the name the aggregator would pick.
+	Filename string
+	// Artifact is true for the named files a plugin may submit, any number
+	// of, before marking its result done. They're kept in the directory of
+	// the result but don't complete it.
+	Artifact bool
+	// Done is true for the marker which completes a result made up of
+	// artifacts. It has no body of its own; the result is its artifacts.
+	Done bool
+	// Streamed is true for results whose body is sent as the plugin writes
+	// it, over a request held open until the plugin finishes. They are
+	// received without holding up other results.
+	Streamed bool
+	// Replace is true for uploads which are retries, which replace what
+	// an earlier attempt uploaded to the same path, so that retrying an
+	// upload is safe. Otherwise results are only accepted once, unless the
+	// duplicate policy says to overwrite them.
+	Replace bool
+	// Checksum, if set, is the hex encoded SHA-256 checksum the body must
+	// match for the result to be accepted.
+	Checksum string
+	// Codec is the content coding the result was uploaded with, such as
+	// "gzip", or "identity" if it was sent uncompressed. It is empty for
+	// results which weren't uploaded.
+	Codec string
+	// ClientName is the common name of the verified client certificate the
+	// result was submitted with, if any.
+	ClientName string
+	// Submitted is when the worker says it submitted the result, by the
+	// clock of its node, which may be skewed. It is zero if the worker
+	// didn't say.
+	Submitted time.Time
+	// Topology is the value of the topology label on the node of a
+	// node-specific result, e.g. its zone, if a label is configured. It's
+	// set by the aggregator from the result it was expected as.
+	Topology string
+	// Annotations is metadata the plugin attached to the result, such as
+	// the version of its test suite, to be recorded with it.
+	Annotations map[string]string
 }
 
 // IsSuccess returns whether the Result represents a successful plugin result,
@@ -88,11 +352,18 @@ func (r *Result) IsSuccess() bool {
 // Path is the path within the "plugins" section of the results tarball where
 // this Result should be stored, not including a file extension.
 func (r *Result) Path() string {
+	if r.Partial {
+		if r.Filename != "" {
+			return path.Join(r.ResultType, "partial", r.NodeName, r.Filename)
+		}
+		return path.Join(r.ResultType, "partial", r.NodeName, fmt.Sprintf("%08d", r.Sequence))
+	}
+
 	if !r.IsSuccess() {
 		return path.Join(r.ResultType, "errors", r.NodeName)
 	}
 
-	return path.Join(r.ResultType, "results", r.NodeName)
+	return path.Join(r.ResultType, "results", r.NodeName, r.Filename)
 }
 
 // Selection is the user specified input to load and initialize plugins
@@ -102,15 +373,321 @@ type Selection struct {
 
 // AggregationConfig are the config settings for the server that aggregates plugin results
 type AggregationConfig struct {
-	BindAddress      string `json:"bindaddress"`
-	BindPort         int    `json:"bindport"`
+	BindAddress string `json:"bindaddress"`
+	BindPort    int    `json:"bindport"`
+	// BindSocket, if set, is the path of a Unix domain socket the server
+	// listens on instead of BindAddress and BindPort. Results are then
+	// served over plain HTTP, relying on the socket's permissions, for
+	// workers sharing the aggregator's pod.
+	BindSocket string `json:"bindsocket,omitempty"`
+	// AdvertiseAddress is the address workers dial to submit results. It may
+	// be a comma separated list (e.g. for dual-stack clusters), in which case
+	// workers try each address in order.
 	AdvertiseAddress string `json:"advertiseaddress"`
 	TimeoutSeconds   int    `json:"timeoutseconds"`
+	// PluginTimeouts maps plugin names to a timeout, in seconds, which
+	// overrides TimeoutSeconds for that plugin. It may be longer than
+	// TimeoutSeconds, in which case the run waits for the longest one.
+	PluginTimeouts map[string]int `json:"plugintimeouts,omitempty"`
+	// MaxRunSeconds, if set, is a hard cap on how long the whole run may
+	// take. Once it passes, the server, updater and plugins are torn down
+	// and the run returns, even if cleanup is still in progress. It's a
+	// backstop for when TimeoutSeconds can't end the run, so it must be at
+	// least as long.
+	MaxRunSeconds int `json:"maxrunseconds,omitempty"`
+	// GracefulShutdownSeconds is how long before TimeoutSeconds plugins are
+	// told to shut down, and how long their pods are given to do so.
+	// Defaults to GracefulShutdownPeriod if unset.
+	GracefulShutdownSeconds int `json:"gracefulshutdownseconds,omitempty"`
+	// PluginGracefulShutdownSeconds maps plugin names to a graceful shutdown
+	// period, in seconds, which overrides GracefulShutdownSeconds for that
+	// plugin.
+	PluginGracefulShutdownSeconds map[string]int `json:"plugingracefulshutdownseconds,omitempty"`
+	// AnnotationUpdateFreqSeconds is how often the aggregator pod's status
+	// annotation is updated. Defaults to 5 seconds if unset.
+	AnnotationUpdateFreqSeconds int `json:"annotationupdatefreqseconds,omitempty"`
+	// JitterFactor is the jitter applied to the annotation update period.
+	// Defaults to 1.2 if unset.
+	JitterFactor float64 `json:"jitterfactor,omitempty"`
+	// EventsFile, if set, is the file to which a newline-delimited JSON
+	// stream of events is appended as the run progresses.
+	EventsFile string `json:"eventsfile,omitempty"`
+	// PluginRunAttempts is how many times launching a plugin is attempted
+	// when it fails with a transient Kubernetes API error. Defaults to 3 if
+	// unset.
+	PluginRunAttempts int `json:"pluginrunattempts,omitempty"`
+	// NodeCacheTTLSeconds is how long the list of nodes is cached before
+	// it is listed again to find nodes which joined during the run.
+	// Defaults to 5 minutes if unset.
+	NodeCacheTTLSeconds int `json:"nodecachettlseconds,omitempty"`
+	// NodeListTimeoutSeconds limits how long listing the nodes may take,
+	// before the run starts and each time the list is refreshed. Defaults
+	// to 1 minute if unset.
+	NodeListTimeoutSeconds int `json:"nodelisttimeoutseconds,omitempty"`
+	// SkipPluginValidation launches plugins without first checking that
+	// each of them can be run.
+	SkipPluginValidation bool `json:"skippluginvalidation,omitempty"`
+	// NodeSelector is a label selector limiting the nodes plugins are
+	// expected to submit results from, e.g. "kubernetes.io/os=linux". All
+	// nodes are used if it is empty.
+	NodeSelector string `json:"nodeselector,omitempty"`
+	// PluginExpectedResults maps plugin names to the results they're
+	// expected to submit, which override the ones the plugins estimate
+	// from the nodes.
+	PluginExpectedResults map[string]ExpectedResultsOverride `json:"pluginexpectedresults,omitempty"`
+	// LogFormat is the format of the logs written during the run, either
+	// "text" or "json". Defaults to "text" if unset.
+	LogFormat string `json:"logformat,omitempty"`
+	// CertValiditySeconds is how long the client certificates issued to
+	// plugins are valid for. Workers renew their certificate before it
+	// expires. Defaults to 48 hours, or the run timeout plus the graceful
+	// shutdown period if that is longer.
+	CertValiditySeconds int `json:"certvalidityseconds,omitempty"`
+	// CACertFile and CAKeyFile, if set, are paths to a PEM encoded CA
+	// certificate and private key which are used to issue the run's
+	// certificates, rather than generating a new CA for each run.
+	CACertFile string `json:"cacertfile,omitempty"`
+	CAKeyFile  string `json:"cakeyfile,omitempty"`
+	// KeyType is the type of key generated for the run's CA and the
+	// certificates it issues, either "ecdsa" (the default) or "rsa".
+	KeyType string `json:"keytype,omitempty"`
+	// MinTLSVersion is the minimum TLS version the aggregator and workers
+	// use, either "1.2" or "1.3". Defaults to "1.2" if unset.
+	MinTLSVersion string `json:"mintlsversion,omitempty"`
+	// CipherSuites are the Go names of the TLS 1.2 cipher suites the
+	// aggregator and workers use. Defaults to ECDHE suites with AES-GCM or
+	// ChaCha20-Poly1305 if unset.
+	CipherSuites []string `json:"ciphersuites,omitempty"`
+	// TLSServerNames are more DNS names or IP addresses the aggregator's
+	// certificate is valid for, besides its advertise addresses, e.g. the
+	// DNS name of a service workers reach it through in a service mesh.
+	TLSServerNames []string `json:"tlsservernames,omitempty"`
+	// WorkerTLSServerName, if set, is the server name workers verify the
+	// aggregator's certificate against, and send with SNI, instead of the
+	// host of the address they dial. The certificate is always valid for
+	// it.
+	WorkerTLSServerName string `json:"workertlsservername,omitempty"`
+	// BasePath, if set, is the path prefix the aggregator serves all of its
+	// routes under, including /healthz and /metrics, e.g. "/sonobuoy" for
+	// an aggregator exposed through an Ingress which keeps the prefix.
+	BasePath string `json:"basepath,omitempty"`
+	// WorkerUploadPathPrefix is the path prefix workers put before the
+	// paths they submit results to, e.g. for workers which reach the
+	// aggregator through an Ingress which strips the prefix. Defaults to
+	// BasePath if unset.
+	WorkerUploadPathPrefix string `json:"workeruploadpathprefix,omitempty"`
+	// WorkerProxyURL, if set, is the URL of an HTTP or SOCKS5 proxy, such as
+	// an egress gateway, which workers submit results through. Workers
+	// otherwise use the proxy named by their HTTPS_PROXY, HTTP_PROXY and
+	// NO_PROXY environment variables, if any.
+	WorkerProxyURL string `json:"workerproxyurl,omitempty"`
+	// WorkerUploadRetries is how many times workers retry an upload which
+	// fails with a server error or a network error before giving up.
+	// Uploads rejected by the aggregator, with a 4xx, aren't retried.
+	// Defaults to 3 if unset.
+	WorkerUploadRetries int `json:"workeruploadretries,omitempty"`
+	// WorkerUploadTimeoutSeconds, if set, is how long workers keep trying
+	// to submit an upload, over all of its attempts, before giving up.
+	WorkerUploadTimeoutSeconds int `json:"workeruploadtimeoutseconds,omitempty"`
+	// HeartbeatIntervalSeconds, if set, is how often workers send the
+	// aggregator a heartbeat while they wait for their plugin, give or
+	// take some jitter so that they don't all send them at once.
+	HeartbeatIntervalSeconds int `json:"heartbeatintervalseconds,omitempty"`
+	// HeartbeatStallSeconds is how long a result's worker may go without
+	// a heartbeat before the result is reported as stalled on the
+	// aggregator pod. Results are only reported once their worker has
+	// sent a heartbeat. Defaults to 5 times HeartbeatIntervalSeconds.
+	HeartbeatStallSeconds int `json:"heartbeatstallseconds,omitempty"`
+	// FailStalledResults, if true, records stalled results as errors
+	// rather than only reporting them, so the run doesn't wait on them
+	// until it times out.
+	FailStalledResults bool `json:"failstalledresults,omitempty"`
+	// UploadCodecs are the codecs offered to workers which negotiate how
+	// to compress their results, in order of preference. Uncompressed
+	// uploads, and uploads with any codec the aggregator supports, are
+	// accepted whatever it's set to. Defaults to every codec the
+	// aggregator supports.
+	UploadCodecs []string `json:"uploadcodecs,omitempty"`
+	// DuplicateResults is what happens when a result is submitted again
+	// after it was recorded, either "ignore" or "overwrite". Defaults to
+	// "ignore" if unset.
+	DuplicateResults string `json:"duplicateresults,omitempty"`
+	// MaxResultSizeBytes limits the size of each result a plugin uploads.
+	// Larger results are rejected and recorded as errors. Results aren't
+	// limited if it is 0.
+	MaxResultSizeBytes int64 `json:"maxresultsizebytes"`
+	// AbortOnDiskFull, if true, ends the run as soon as a result can't be
+	// written because the results directory is full.
+	AbortOnDiskFull bool `json:"abortondiskfull,omitempty"`
+	// MinFreeDiskBytes, if set, is how much space must be free for results
+	// before any plugin is launched, e.g. an estimate of their total size.
+	MinFreeDiskBytes int64 `json:"minfreediskbytes,omitempty"`
+	// MonitorBufferSize is how many results reported on behalf of plugins,
+	// e.g. by their monitors or timeouts, are buffered before being queued
+	// for the aggregator. Reporting never waits on results being handled, so
+	// this only needs to cover bursts. Defaults to 64 if unset.
+	MonitorBufferSize int `json:"monitorbuffersize,omitempty"`
+	// MaxConnections, if set, is how many connections the aggregation
+	// server accepts at once. Further connections wait in the listen
+	// backlog until one closes.
+	MaxConnections int `json:"maxconnections,omitempty"`
+	// MaxConcurrentWrites is how many uploaded results are written out at
+	// once, other than streamed results. Further uploads wait for one to
+	// finish. Defaults to 16 if unset.
+	MaxConcurrentWrites int `json:"maxconcurrentwrites,omitempty"`
+	// CompletionThreshold is the fraction, between 0 and 1, of each
+	// plugin's expected results which must arrive for the run to complete
+	// successfully. The rest are recorded as not reported. Defaults to 1,
+	// every result, if unset.
+	CompletionThreshold float64 `json:"completionthreshold,omitempty"`
+	// MetricsBindPort, if set, is the port on localhost on which progress
+	// metrics are served in the Prometheus format at /metrics.
+	MetricsBindPort int `json:"metricsbindport,omitempty"`
+	// WebhookURL, if set, is POSTed to each time a plugin completes, fails
+	// or times out. The payload is signed with the run's CA.
+	WebhookURL string `json:"webhookurl,omitempty"`
+	// WebhookAttempts is how many times sending each webhook is attempted
+	// before giving up. Defaults to 3 if unset.
+	WebhookAttempts int `json:"webhookattempts,omitempty"`
+	// WebhookTimeoutSeconds is how long each attempt to send a webhook has.
+	// Defaults to 10 seconds if unset.
+	WebhookTimeoutSeconds int `json:"webhooktimeoutseconds,omitempty"`
+	// ReconcileNodes, if true, drops the pending results of nodes which are
+	// removed from the cluster during the run rather than waiting for them.
+	ReconcileNodes bool `json:"reconcilenodes,omitempty"`
+	// RedactSecrets, if true, redacts common Kubernetes secrets such as
+	// tokens and kubeconfig credentials from results before they're written.
+	RedactSecrets bool `json:"redactsecrets,omitempty"`
+	// CollectDiagnostics, if true, writes the pods of plugins whose results
+	// fail, the tail of their logs and the latest events in their namespace
+	// to the diagnostics directory of the results before the plugins are
+	// cleaned up.
+	CollectDiagnostics bool `json:"collectdiagnostics,omitempty"`
+	// KeepPluginResources is whose resources are left in place rather than
+	// cleaned up after the run, for debugging: "none" (the default),
+	// "on-failure" for plugins with a result which failed or timed out, or
+	// "all".
+	KeepPluginResources string `json:"keeppluginresources,omitempty"`
+	// OrphanedResources is what's done at startup with the daemonsets and
+	// pods earlier runs' plugins left behind in the namespaces of this
+	// run: nothing if unset, "report" to log them, or "delete" to delete
+	// them.
+	OrphanedResources string `json:"orphanedresources,omitempty"`
+	// DiagnosticsLogLines is how many lines of each container's log are
+	// kept in diagnostics. Defaults to 500 if unset.
+	DiagnosticsLogLines int64 `json:"diagnosticsloglines,omitempty"`
+	// DiagnosticsMaxEvents is how many of the latest namespace events are
+	// kept in diagnostics. Defaults to 100 if unset.
+	DiagnosticsMaxEvents int `json:"diagnosticsmaxevents,omitempty"`
+	// EncryptionKeyFile, if set, is a file with a secret, e.g. mounted from
+	// a Kubernetes secret, from which a key is derived to encrypt each
+	// result file with before it's written. The same secret is needed to
+	// retrieve the results.
+	EncryptionKeyFile string `json:"encryptionkeyfile,omitempty"`
+	// ResultsLayout is how results are laid out in the plugins directory:
+	// "nested" (the default), "flat" or "topology", which needs a
+	// TopologyLabel.
+	ResultsLayout string `json:"resultslayout,omitempty"`
+	// TopologyLabel, if set, is the node label node results are grouped by
+	// in the results manifest, e.g. "topology.kubernetes.io/zone", so that
+	// failures can be traced to a zone or node pool.
+	TopologyLabel string `json:"topologylabel,omitempty"`
+	// ResultsTTLSeconds, if set, is how long a run's results are kept on
+	// the aggregator's volume. Runs whose results have expired are purged
+	// when the next aggregator starts, so that a volume shared by a series
+	// of runs doesn't fill up with stale results.
+	ResultsTTLSeconds int `json:"resultsttlseconds,omitempty"`
+	// PluginStartupTimeoutSeconds, if set, is how long a plugin's pods may
+	// stay pending, e.g. because their image can't be pulled, before an
+	// error is recorded for their results.
+	PluginStartupTimeoutSeconds int `json:"pluginstartuptimeoutseconds,omitempty"`
+	// PluginLaunchDelaySeconds, if set, is how long to wait between
+	// launching each plugin, to spread out the pulls of their images.
+	PluginLaunchDelaySeconds int `json:"pluginlaunchdelayseconds,omitempty"`
+	// ReadyGate, if set, is a condition of a Kubernetes object the run
+	// waits for before launching any plugin.
+	ReadyGate *ReadyGate `json:"readygate,omitempty"`
+	// DisableHTTP2, if true, only serves HTTP/1.1 to workers, which can
+	// help when debugging uploads.
+	DisableHTTP2 bool `json:"disablehttp2,omitempty"`
+	// ResourceUsageIntervalSeconds, if set, is how often the CPU and memory
+	// used by each plugin's pods is sampled from the metrics API, to be
+	// recorded in the results manifest.
+	ResourceUsageIntervalSeconds int `json:"resourceusageintervalseconds,omitempty"`
+	// DryRun, if true, logs and returns the plan for the run without
+	// starting the server or launching any plugins.
+	DryRun bool `json:"dryrun,omitempty"`
+	// FailFast, if true, ends the run as soon as any result fails or times
+	// out, cleaning up the remaining plugins rather than waiting for them.
+	FailFast bool `json:"failfast,omitempty"`
+	// ResultSink, if set, is where each result is also written as soon as
+	// it's recorded, along with the final tarball: ResultSinkFilesystem or
+	// ResultSinkS3. Results are always written to the local results
+	// directory.
+	ResultSink string `json:"resultsink,omitempty"`
+	// ResultSinkDir is the directory the filesystem result sink writes to.
+	ResultSinkDir string `json:"resultsinkdir,omitempty"`
+	// S3Bucket, S3Region and S3Prefix say where the S3 result sink uploads
+	// results. S3Endpoint, if set, is the URL of an S3 compatible service
+	// to use instead of AWS. Credentials are read from the environment so
+	// they aren't copied into the results with the config.
+	S3Bucket   string `json:"s3bucket,omitempty"`
+	S3Region   string `json:"s3region,omitempty"`
+	S3Prefix   string `json:"s3prefix,omitempty"`
+	S3Endpoint string `json:"s3endpoint,omitempty"`
+}
+
+// ReadyGate is a condition in the status of a Kubernetes object, such as a
+// Job being complete or a CRD being established, which must be met before
+// plugins are launched.
+type ReadyGate struct {
+	// APIVersion is the group and version of the object, e.g. "batch/v1",
+	// or just the version for the core group.
+	APIVersion string `json:"apiversion"`
+	// Resource is the plural name of the object's resource, e.g. "jobs".
+	Resource string `json:"resource"`
+	// Namespace is left empty for cluster scoped objects.
+	Namespace string `json:"namespace,omitempty"`
+	Name      string `json:"name"`
+	// Condition is the type of the condition in the object's
+	// status.conditions, e.g. "Complete".
+	Condition string `json:"condition"`
+	// Status is the status the condition must have. Defaults to "True".
+	Status string `json:"status,omitempty"`
+	// TimeoutSeconds is how long to wait for the condition before failing
+	// the run. Defaults to 10 minutes.
+	TimeoutSeconds int `json:"timeoutseconds,omitempty"`
+	// IntervalSeconds is how often the object is checked. Defaults to 5.
+	IntervalSeconds int `json:"intervalseconds,omitempty"`
+}
+
+// String describes the condition, e.g. "Complete=True of jobs/setup in
+// default".
+func (g ReadyGate) String() string {
+	name := g.Resource + "/" + g.Name
+	if g.Namespace != "" {
+		name += " in " + g.Namespace
+	}
+	return fmt.Sprintf("%v=%v of %v", g.Condition, g.WantStatus(), name)
+}
+
+// WantStatus returns the status the condition must have.
+func (g ReadyGate) WantStatus() string {
+	if g.Status == "" {
+		return "True"
+	}
+	return g.Status
+}
+
+// AdvertiseAddresses returns each of the addresses in AdvertiseAddress.
+func (c AggregationConfig) AdvertiseAddresses() []string {
+	return splitList(c.AdvertiseAddress)
 }
 
 // WorkerConfig is the file given to the sonobuoy worker to configure it to phone home.
 type WorkerConfig struct {
-	// MasterURL is the URL we talk to for submitting results
+	// MasterURL is the URL we talk to for submitting results. It may be a
+	// comma separated list of URLs to try in order.
 	MasterURL string `json:"masterurl,omitempty" mapstructure:"masterurl"`
 	// NodeName is the node name we should call ourselves when sending results
 	NodeName string `json:"nodename,omitempty" mapstructure:"nodename"`
@@ -122,6 +699,141 @@ type WorkerConfig struct {
 	CACert     string `json:"cacert,omitempty" mapstructure:"cacert"`
 	ClientCert string `json:"clientcert,omitempty" mapstructure:"clientcert"`
 	ClientKey  string `json:"clientkey,omitempty" mapstructure:"clientkey"`
+
+	// StreamPartial enables submitting the files the plugin writes to the
+	// partial directory under ResultsDir before its final results.
+	StreamPartial bool `json:"streampartial,omitempty" mapstructure:"streampartial"`
+	// StreamResults enables streaming the stream file the plugin writes
+	// under ResultsDir to the aggregator as it's written, rather than
+	// submitting its results once it's done.
+	StreamResults bool `json:"streamresults,omitempty" mapstructure:"streamresults"`
+	// UploadArtifacts enables submitting the files the plugin writes to the
+	// artifacts directory under ResultsDir as the artifacts making up its
+	// result, along with the file named in the done file.
+	UploadArtifacts bool `json:"uploadartifacts,omitempty" mapstructure:"uploadartifacts"`
+	// KeepFilenames enables sending the name of each file submitted so that
+	// the aggregator keeps it, rather than naming results itself.
+	KeepFilenames bool `json:"keepfilenames,omitempty" mapstructure:"keepfilenames"`
+	// CompressResults enables compressing the results submitted to the
+	// aggregator, with a codec negotiated with it. Aggregators which don't
+	// negotiate are sent gzipped results.
+	CompressResults bool `json:"compressresults,omitempty" mapstructure:"compressresults"`
+	// ChecksumResults enables sending the checksum of each result so that
+	// the aggregator can reject results corrupted in transit.
+	ChecksumResults bool `json:"checksumresults,omitempty" mapstructure:"checksumresults"`
+	// MinTLSVersion is the minimum TLS version used to talk to the
+	// aggregator, either "1.2" or "1.3". Defaults to "1.2" if unset.
+	MinTLSVersion string `json:"mintlsversion,omitempty" mapstructure:"mintlsversion"`
+	// CipherSuites is a comma separated list of the Go names of the TLS 1.2
+	// cipher suites used to talk to the aggregator.
+	CipherSuites string `json:"ciphersuites,omitempty" mapstructure:"ciphersuites"`
+	// TLSServerName, if set, is the server name the aggregator's
+	// certificate is verified against, and sent with SNI, instead of the
+	// host of MasterURL.
+	TLSServerName string `json:"tlsservername,omitempty" mapstructure:"tlsservername"`
+	// AggregatorSocket, if set, is the path of the Unix domain socket of an
+	// aggregator in the same pod. Results are submitted over it without
+	// TLS, to the paths of MasterURL.
+	AggregatorSocket string `json:"aggregatorsocket,omitempty" mapstructure:"aggregatorsocket"`
+	// UploadPathPrefix, if set, is the path prefix put before the paths of
+	// MasterURL, the certificate renewal path and the health check, for an
+	// aggregator served under a base path.
+	UploadPathPrefix string `json:"uploadpathprefix,omitempty" mapstructure:"uploadpathprefix"`
+	// ProxyURL, if set, is the URL of the proxy results are submitted
+	// through, instead of the one named by the HTTPS_PROXY, HTTP_PROXY and
+	// NO_PROXY environment variables.
+	ProxyURL string `json:"proxyurl,omitempty" mapstructure:"proxyurl"`
+	// UploadRetries is how many times a failed upload is retried. Defaults
+	// to 3 if unset.
+	UploadRetries int `json:"uploadretries,omitempty" mapstructure:"uploadretries"`
+	// UploadTimeoutSeconds, if set, is how long an upload is tried for over
+	// all of its attempts.
+	UploadTimeoutSeconds int `json:"uploadtimeoutseconds,omitempty" mapstructure:"uploadtimeoutseconds"`
+	// HeartbeatIntervalSeconds, if set, is how often the worker sends the
+	// aggregator a heartbeat until its result is submitted.
+	HeartbeatIntervalSeconds int `json:"heartbeatintervalseconds,omitempty" mapstructure:"heartbeatintervalseconds"`
+}
+
+// MasterURLs returns each of the URLs in MasterURL.
+func (c *WorkerConfig) MasterURLs() []string {
+	return splitList(c.MasterURL)
+}
+
+// CipherSuiteList returns each of the cipher suites in CipherSuites.
+func (c *WorkerConfig) CipherSuiteList() []string {
+	return splitList(c.CipherSuites)
+}
+
+// splitList splits a comma separated list, ignoring any empty entries.
+func splitList(list string) []string {
+	var ret []string
+	for _, item := range strings.Split(list, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			ret = append(ret, item)
+		}
+	}
+	return ret
+}
+
+// WorkerPathPrefix returns the path prefix workers submit results under.
+func (c AggregationConfig) WorkerPathPrefix() string {
+	if c.WorkerUploadPathPrefix != "" {
+		return c.WorkerUploadPathPrefix
+	}
+	return c.BasePath
+}
+
+// CleanPathPrefix checks that prefix is an absolute URL path, such as
+// "/sonobuoy/", and returns it without a trailing slash. The root path and
+// the empty prefix are both returned as "".
+func CleanPathPrefix(prefix string) (string, error) {
+	if prefix == "" {
+		return "", nil
+	}
+	if !strings.HasPrefix(prefix, "/") {
+		return "", fmt.Errorf("invalid path prefix %q, it must start with /", prefix)
+	}
+	if strings.ContainsAny(prefix, "?#{}") {
+		return "", fmt.Errorf("invalid path prefix %q, it must be a plain path", prefix)
+	}
+	cleaned := path.Clean(prefix)
+	if cleaned == "/" {
+		return "", nil
+	}
+	return cleaned, nil
+}
+
+// ParseProxyURL parses the URL of a proxy workers submit results through,
+// which must be an http:// or socks5:// URL. HTTPS proxies aren't supported
+// since workers only trust the run's CA, so couldn't verify the proxy's
+// certificate.
+func ParseProxyURL(proxyURL string) (*url.URL, error) {
+	u, err := url.Parse(proxyURL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid proxy URL: %v", err)
+	}
+	if u.Scheme != "http" && u.Scheme != "socks5" {
+		return nil, fmt.Errorf("invalid proxy URL %q, it must be an http:// or socks5:// URL", RedactedURL(u))
+	}
+	if u.Host == "" {
+		return nil, fmt.Errorf("invalid proxy URL %q, it has no host", RedactedURL(u))
+	}
+	return u, nil
+}
+
+// RedactedURL returns the URL as a string with any password replaced by
+// "xxxxx", so that it can be logged or shown in errors.
+func RedactedURL(u *url.URL) string {
+	if u == nil {
+		return ""
+	}
+	redacted := *u
+	if redacted.User != nil {
+		if _, ok := redacted.User.Password(); ok {
+			redacted.User = url.UserPassword(redacted.User.Username(), "xxxxx")
+		}
+	}
+	return redacted.String()
 }
 
 // ID returns a unique identifier for this expected result to distinguish it
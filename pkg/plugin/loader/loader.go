@@ -125,10 +125,18 @@ func loadDefinition(bytes []byte) (*manifest.Manifest, error) {
 
 func loadPlugin(def *manifest.Manifest, namespace, sonobuoyImage, imagePullPolicy, imagePullSecrets string, customAnnotations map[string]string) (plugin.Interface, error) {
 	pluginDef := plugin.Definition{
-		Name:         def.SonobuoyConfig.PluginName,
-		ResultType:   def.SonobuoyConfig.ResultType,
-		ExtraVolumes: def.ExtraVolumes,
-		Spec:         def.Spec,
+		Name:           def.SonobuoyConfig.PluginName,
+		ResultType:     def.SonobuoyConfig.ResultType,
+		ResultFormat:   def.SonobuoyConfig.ResultFormat,
+		ResultSchema:   def.SonobuoyConfig.ResultSchema,
+		ResultReducer:  def.SonobuoyConfig.ResultReducer,
+		ResultPriority: def.SonobuoyConfig.ResultPriority,
+		ExtraVolumes:   def.ExtraVolumes,
+		Spec:           def.Spec,
+		DependsOn:      def.SonobuoyConfig.DependsOn,
+	}
+	if def.SonobuoyConfig.Namespace != "" {
+		namespace = def.SonobuoyConfig.Namespace
 	}
 
 	switch strings.ToLower(def.SonobuoyConfig.Driver) {
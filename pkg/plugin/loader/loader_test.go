@@ -17,6 +17,7 @@ limitations under the License.
 package loader
 
 import (
+	"encoding/json"
 	"path"
 	"reflect"
 	"sort"
@@ -140,6 +141,54 @@ func TestLoadJobPlugin(t *testing.T) {
 	}
 }
 
+func TestLoadPlugin_namespace(t *testing.T) {
+	def := &manifest.Manifest{
+		SonobuoyConfig: manifest.SonobuoyConfig{
+			Driver:     "DaemonSet",
+			PluginName: "privileged-plugin",
+			Namespace:  "privileged",
+		},
+	}
+
+	pluginIface, err := loadPlugin(def, "loader_test", "gcr.io/heptio-images/sonobuoy:latest", "Always", "", nil)
+	if err != nil {
+		t.Fatalf("unexpected error loading plugin: %v", err)
+	}
+	if ns := pluginIface.(plugin.Namespaced).GetNamespace(); ns != "privileged" {
+		t.Errorf("expected the plugin to run in its own namespace, got %q", ns)
+	}
+}
+
+func TestLoadPlugin_resultSchema(t *testing.T) {
+	def, err := loadDefinition([]byte(`sonobuoy-config:
+  driver: Job
+  plugin-name: checks
+  result-type: checks
+  result-schema:
+    type: object
+    required: [checks]
+spec:
+  image: example.com/checks:v1
+  name: plugin
+`))
+	if err != nil {
+		t.Fatalf("unexpected error loading definition: %v", err)
+	}
+
+	pluginIface, err := loadPlugin(def, "loader_test", "gcr.io/heptio-images/sonobuoy:latest", "Always", "", nil)
+	if err != nil {
+		t.Fatalf("unexpected error loading plugin: %v", err)
+	}
+	var schema map[string]interface{}
+	if err := json.Unmarshal(pluginIface.(plugin.Validated).GetResultSchema(), &schema); err != nil {
+		t.Fatalf("expected the schema to be JSON: %v", err)
+	}
+	want := map[string]interface{}{"type": "object", "required": []interface{}{"checks"}}
+	if !reflect.DeepEqual(schema, want) {
+		t.Errorf("expected schema %v, got %v", want, schema)
+	}
+}
+
 func TestLoadDaemonSet(t *testing.T) {
 	namespace := "loader_test"
 	image := "gcr.io/heptio-images/sonobuoy:latest"
@@ -17,6 +17,8 @@ limitations under the License.
 package manifest
 
 import (
+	"encoding/json"
+
 	corev1 "k8s.io/api/core/v1"
 	kuberuntime "k8s.io/apimachinery/pkg/runtime"
 	"k8s.io/apimachinery/pkg/runtime/schema"
@@ -27,16 +29,42 @@ type SonobuoyConfig struct {
 	Driver     string `json:"driver"`
 	PluginName string `json:"plugin-name"`
 	ResultType string `json:"result-type"`
+	// ResultFormat is the format of the plugin's results, such as "junit"
+	// or "sarif". It is recorded as is, so any format can be used.
+	ResultFormat string `json:"result-format,omitempty"`
+	// ResultSchema, if set, is a JSON Schema which every result of the
+	// plugin must match, given inline.
+	ResultSchema json.RawMessage `json:"result-schema,omitempty"`
+	// ResultReducer, if set, names the reducer which merges the plugin's
+	// results into one more artifact once they've all arrived, such as
+	// "junit".
+	ResultReducer string `json:"result-reducer,omitempty"`
+	// ResultPriority orders the plugin's results against other plugins'
+	// when more arrive than the aggregator can handle at once: results of
+	// higher priority are handled first. Defaults to 0.
+	ResultPriority int `json:"result-priority,omitempty"`
+	// DependsOn lists the plugins which must complete successfully before
+	// this plugin is run.
+	DependsOn []string `json:"depends-on,omitempty"`
+	// Namespace, if set, is the namespace the plugin's pods are run in,
+	// rather than the namespace of the run.
+	Namespace string `json:"namespace,omitempty"`
 	objectKind
 }
 
 // DeepCopy makes a deep copy (needed by DeepCopyObject)
 func (s *SonobuoyConfig) DeepCopy() *SonobuoyConfig {
 	return &SonobuoyConfig{
-		Driver:     s.Driver,
-		PluginName: s.PluginName,
-		ResultType: s.ResultType,
-		objectKind: objectKind{s.objectKind.gvk},
+		Driver:         s.Driver,
+		PluginName:     s.PluginName,
+		ResultType:     s.ResultType,
+		ResultFormat:   s.ResultFormat,
+		ResultSchema:   append(json.RawMessage(nil), s.ResultSchema...),
+		ResultReducer:  s.ResultReducer,
+		ResultPriority: s.ResultPriority,
+		DependsOn:      append([]string(nil), s.DependsOn...),
+		Namespace:      s.Namespace,
+		objectKind:     objectKind{s.objectKind.gvk},
 	}
 }
 
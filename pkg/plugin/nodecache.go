@@ -0,0 +1,128 @@
+/*
+Copyright 2018 Heptio Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package plugin
+
+import (
+	"context"
+	"math"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+)
+
+// NodeCache lists the nodes in the cluster once and shares that list between
+// everything which needs it, listing them again once the list is older than
+// its TTL. It is safe for concurrent use.
+type NodeCache struct {
+	client   kubernetes.Interface
+	selector string
+	ttl      time.Duration
+	timeout  time.Duration
+
+	mu     sync.Mutex
+	nodes  []v1.Node
+	listed time.Time
+	// now is overridden in tests.
+	now func() time.Time
+}
+
+// NewNodeCache returns a cache of the nodes matching the given label selector,
+// or every node if the selector is empty. A ttl of zero means the nodes are
+// only ever listed once.
+func NewNodeCache(client kubernetes.Interface, selector string, ttl time.Duration) *NodeCache {
+	return &NodeCache{
+		client:   client,
+		selector: selector,
+		ttl:      ttl,
+		now:      time.Now,
+	}
+}
+
+// SetListTimeout limits how long listing the nodes may take before it fails,
+// so a wedged API server can't block whatever needs them. A timeout of zero
+// means listing them is never timed out.
+func (c *NodeCache) SetListTimeout(timeout time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.timeout = timeout
+}
+
+// Nodes returns the cached nodes, listing them first if they haven't been
+// listed yet or the list has expired. If listing them again fails, the stale
+// list is returned rather than an error. The returned slice is shared and
+// must not be modified.
+func (c *NodeCache) Nodes() ([]v1.Node, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if !c.listed.IsZero() && (c.ttl == 0 || c.now().Sub(c.listed) < c.ttl) {
+		return c.nodes, nil
+	}
+
+	nodes, err := c.list()
+	if err != nil {
+		if c.listed.IsZero() {
+			return nil, errors.Wrap(err, "couldn't list nodes")
+		}
+		logrus.WithError(err).Info("couldn't refresh node list, using cached nodes")
+		return c.nodes, nil
+	}
+
+	// Replace rather than update the slice so lists already handed out
+	// are never modified.
+	c.nodes = nodes.Items
+	c.listed = c.now()
+	return c.nodes, nil
+}
+
+// list lists the nodes, giving up once the list timeout is up. The API server
+// is asked to time the list out too, but the client doesn't take a context so
+// the request is abandoned, rather than cancelled, if it doesn't.
+func (c *NodeCache) list() (*v1.NodeList, error) {
+	opts := metav1.ListOptions{LabelSelector: c.selector}
+	if c.timeout <= 0 {
+		return c.client.CoreV1().Nodes().List(opts)
+	}
+	seconds := int64(math.Ceil(c.timeout.Seconds()))
+	opts.TimeoutSeconds = &seconds
+
+	ctx, cancel := context.WithTimeout(context.Background(), c.timeout)
+	defer cancel()
+
+	type listed struct {
+		nodes *v1.NodeList
+		err   error
+	}
+	// Buffered so the request can finish after it's abandoned
+	done := make(chan listed, 1)
+	go func() {
+		nodes, err := c.client.CoreV1().Nodes().List(opts)
+		done <- listed{nodes, err}
+	}()
+
+	select {
+	case l := <-done:
+		return l.nodes, l.err
+	case <-ctx.Done():
+		return nil, errors.Errorf("listing nodes didn't finish within %v, is the API server responding?", c.timeout)
+	}
+}
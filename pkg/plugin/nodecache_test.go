@@ -0,0 +1,192 @@
+/*
+Copyright 2018 Heptio Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package plugin
+
+import (
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	corev1 "k8s.io/client-go/kubernetes/typed/core/v1"
+)
+
+// fakeNodeClient is a kubernetes.Interface which only supports listing nodes,
+// counting how many times they're listed.
+type fakeNodeClient struct {
+	kubernetes.Interface
+	corev1.CoreV1Interface
+	corev1.NodeInterface
+
+	sync.Mutex
+	nodes     []v1.Node
+	err       error
+	lists     int
+	selectors []string
+	timeouts  []*int64
+	// block, if set, is received from before the nodes are listed.
+	block chan struct{}
+}
+
+func (c *fakeNodeClient) CoreV1() corev1.CoreV1Interface { return c }
+
+func (c *fakeNodeClient) Nodes() corev1.NodeInterface { return c }
+
+func (c *fakeNodeClient) List(opts metav1.ListOptions) (*v1.NodeList, error) {
+	if c.block != nil {
+		<-c.block
+	}
+	c.Lock()
+	defer c.Unlock()
+	c.lists++
+	c.selectors = append(c.selectors, opts.LabelSelector)
+	c.timeouts = append(c.timeouts, opts.TimeoutSeconds)
+	if c.err != nil {
+		return nil, c.err
+	}
+	return &v1.NodeList{Items: c.nodes}, nil
+}
+
+func node(name string) v1.Node {
+	return v1.Node{ObjectMeta: metav1.ObjectMeta{Name: name}}
+}
+
+func TestNodeCache_refresh(t *testing.T) {
+	client := &fakeNodeClient{nodes: []v1.Node{node("node1")}}
+	cache := NewNodeCache(client, "kubernetes.io/os=linux", time.Minute)
+	now := time.Now()
+	cache.now = func() time.Time { return now }
+
+	nodes, err := cache.Nodes()
+	if err != nil {
+		t.Fatalf("unexpected error listing nodes: %v", err)
+	}
+	if len(nodes) != 1 {
+		t.Fatalf("expected 1 node, got %v", len(nodes))
+	}
+
+	// A new node isn't seen until the TTL expires
+	client.nodes = []v1.Node{node("node1"), node("node2")}
+	if nodes, _ = cache.Nodes(); len(nodes) != 1 {
+		t.Errorf("expected cached list of 1 node, got %v", len(nodes))
+	}
+
+	now = now.Add(time.Minute)
+	if nodes, _ = cache.Nodes(); len(nodes) != 2 {
+		t.Errorf("expected refreshed list of 2 nodes, got %v", len(nodes))
+	}
+
+	if client.lists != 2 {
+		t.Errorf("expected nodes to be listed twice, got %v", client.lists)
+	}
+	for _, selector := range client.selectors {
+		if selector != "kubernetes.io/os=linux" {
+			t.Errorf("expected nodes to be listed with the label selector, got %q", selector)
+		}
+	}
+}
+
+func TestNodeCache_staleOnError(t *testing.T) {
+	client := &fakeNodeClient{err: errors.New("apiserver unavailable")}
+	cache := NewNodeCache(client, "", time.Minute)
+	now := time.Now()
+	cache.now = func() time.Time { return now }
+
+	if _, err := cache.Nodes(); err == nil {
+		t.Fatal("expected an error if the nodes have never been listed")
+	}
+
+	client.err = nil
+	client.nodes = []v1.Node{node("node1")}
+	if _, err := cache.Nodes(); err != nil {
+		t.Fatalf("unexpected error listing nodes: %v", err)
+	}
+
+	client.err = errors.New("apiserver unavailable")
+	now = now.Add(time.Minute)
+	nodes, err := cache.Nodes()
+	if err != nil {
+		t.Fatalf("expected the stale list rather than an error, got %v", err)
+	}
+	if len(nodes) != 1 {
+		t.Errorf("expected stale list of 1 node, got %v", len(nodes))
+	}
+}
+
+func TestNodeCache_listTimeout(t *testing.T) {
+	client := &fakeNodeClient{nodes: []v1.Node{node("node1")}, block: make(chan struct{})}
+	defer close(client.block)
+	cache := NewNodeCache(client, "", time.Minute)
+	cache.SetListTimeout(10 * time.Millisecond)
+
+	start := time.Now()
+	if _, err := cache.Nodes(); err == nil {
+		t.Fatal("expected an error when listing the nodes times out")
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("expected listing the nodes to give up after the timeout, took %v", elapsed)
+	}
+}
+
+func TestNodeCache_listTimeoutSeconds(t *testing.T) {
+	client := &fakeNodeClient{nodes: []v1.Node{node("node1")}}
+	cache := NewNodeCache(client, "", time.Nanosecond)
+	if _, err := cache.Nodes(); err != nil {
+		t.Fatalf("unexpected error listing nodes: %v", err)
+	}
+	cache.SetListTimeout(1500 * time.Millisecond)
+	if _, err := cache.Nodes(); err != nil {
+		t.Fatalf("unexpected error listing nodes: %v", err)
+	}
+
+	client.Lock()
+	defer client.Unlock()
+	if client.timeouts[0] != nil {
+		t.Errorf("expected no server timeout without a list timeout, got %v", *client.timeouts[0])
+	}
+	if client.timeouts[1] == nil || *client.timeouts[1] != 2 {
+		t.Errorf("expected the server timeout to be rounded up to 2 seconds, got %v", client.timeouts[1])
+	}
+}
+
+func TestNodeCache_concurrent(t *testing.T) {
+	client := &fakeNodeClient{nodes: []v1.Node{node("node1"), node("node2")}}
+	// A tiny TTL so the list is regularly replaced while being read
+	cache := NewNodeCache(client, "", time.Nanosecond)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				nodes, err := cache.Nodes()
+				if err != nil {
+					t.Errorf("unexpected error listing nodes: %v", err)
+					return
+				}
+				for _, n := range nodes {
+					_ = n.Name
+				}
+			}
+		}()
+	}
+	wg.Wait()
+}
@@ -0,0 +1,282 @@
+/*
+Copyright 2018 Heptio Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package testutil provides a fake plugin whose behaviour can be scripted,
+// for testing runs end to end without a cluster.
+package testutil
+
+import (
+	"crypto/tls"
+	"io"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/heptio/sonobuoy/pkg/plugin"
+	"github.com/heptio/sonobuoy/pkg/plugin/driver/utils"
+	"github.com/pkg/errors"
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/client-go/kubernetes"
+)
+
+// Submitter submits results on behalf of a plugin.
+// aggregation.InProcessServer is one.
+type Submitter interface {
+	Submit(nodeName, resultType, mimeType string, body io.Reader) (int, error)
+}
+
+// Behavior is what a FakePlugin does with its results once it's run.
+type Behavior int
+
+const (
+	// Succeed submits a successful result for each result, through the
+	// plugin's Submitter.
+	Succeed Behavior = iota
+	// Fail has the plugin's monitor report an error for each result, like
+	// a plugin whose pods keep crashing.
+	Fail
+	// Hang never does anything, like a plugin which is stuck.
+	Hang
+)
+
+// String returns the name of the behavior.
+func (b Behavior) String() string {
+	switch b {
+	case Succeed:
+		return "succeed"
+	case Fail:
+		return "fail"
+	case Hang:
+		return "hang"
+	}
+	return "unknown"
+}
+
+// FakePlugin is a plugin.Interface which creates no resources. Instead, once
+// it's run, it waits for Delay and then does what its Behavior says with its
+// results. Its fields must not be changed once it has been run.
+type FakePlugin struct {
+	// Name is the plugin's name and result type.
+	Name string
+	// Nodes are the nodes the plugin expects a result from. Without any,
+	// it expects a single global result.
+	Nodes []string
+	// DependsOn are the names of the plugins it depends on.
+	DependsOn []string
+	// Submitter is what results are submitted through when the Behavior
+	// is Succeed, which Run fails without.
+	Submitter Submitter
+
+	// RunError, if set, is returned by Run, as if the plugin couldn't be
+	// launched, and nothing else happens.
+	RunError error
+	// Delay is how long after being run the plugin acts on its results.
+	Delay time.Duration
+	// Behavior is what the plugin does with its results.
+	Behavior Behavior
+	// Emit, if positive, is how many of the plugin's results it acts on,
+	// in the order of Nodes. The rest never arrive.
+	Emit int
+	// Body is the body of results it submits. Defaults to "{}".
+	Body string
+	// ErrorMessage is the error its monitor reports when the Behavior is
+	// Fail. Defaults to "the plugin failed".
+	ErrorMessage string
+	// CleanupDelay is how long Cleanup takes.
+	CleanupDelay time.Duration
+	// CleanupBlock, if set, holds up Cleanup until it's closed, like a
+	// plugin whose resources can't be deleted.
+	CleanupBlock chan struct{}
+
+	mu        sync.Mutex
+	ran       int
+	cleaned   int
+	started   chan struct{}
+	stopped   chan struct{}
+	startOnce sync.Once
+	stopOnce  sync.Once
+	errs      []error
+}
+
+// Run starts acting on the plugin's results in the background, unless
+// RunError is set or there's no Submitter to submit successful results
+// through (to adhere to plugin.Interface).
+func (f *FakePlugin) Run(kubeClient kubernetes.Interface, hostname string, cert *tls.Certificate) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.ran++
+	if f.RunError != nil {
+		return f.RunError
+	}
+	if f.Behavior == Succeed && f.Submitter == nil {
+		return errors.Errorf("fake plugin %v has no Submitter to submit its results through", f.Name)
+	}
+	started, stopped := f.channels()
+	f.startOnce.Do(func() { close(started) })
+	if f.Behavior == Succeed {
+		go f.submit(stopped)
+	}
+	return nil
+}
+
+// channels returns the channel closed once the plugin is run and the one
+// closed once it's cleaned up. mu must be held by the caller.
+func (f *FakePlugin) channels() (started, stopped chan struct{}) {
+	if f.started == nil {
+		f.started = make(chan struct{})
+	}
+	if f.stopped == nil {
+		f.stopped = make(chan struct{})
+	}
+	return f.started, f.stopped
+}
+
+// after returns false if the plugin is cleaned up before Delay passes.
+func (f *FakePlugin) after(stopped <-chan struct{}) bool {
+	select {
+	case <-time.After(f.Delay):
+		return true
+	case <-stopped:
+		return false
+	}
+}
+
+// submit submits a successful result for each result the plugin acts on.
+func (f *FakePlugin) submit(stopped <-chan struct{}) {
+	if !f.after(stopped) {
+		return
+	}
+	body := f.Body
+	if body == "" {
+		body = "{}"
+	}
+	for _, expected := range f.acted() {
+		if _, err := f.Submitter.Submit(expected.NodeName, expected.ResultType, "application/json", strings.NewReader(body)); err != nil {
+			f.mu.Lock()
+			f.errs = append(f.errs, err)
+			f.mu.Unlock()
+		}
+	}
+}
+
+// acted returns the results the plugin acts on.
+func (f *FakePlugin) acted() []plugin.ExpectedResult {
+	expected := f.ExpectedResults(nil)
+	if f.Emit > 0 && f.Emit < len(expected) {
+		expected = expected[:f.Emit]
+	}
+	return expected
+}
+
+// Cleanup stops the plugin acting on its results, if it hasn't yet, taking
+// CleanupDelay and waiting for CleanupBlock (to adhere to plugin.Interface).
+func (f *FakePlugin) Cleanup(kubeClient kubernetes.Interface) {
+	f.mu.Lock()
+	_, stopped := f.channels()
+	f.mu.Unlock()
+	f.stopOnce.Do(func() { close(stopped) })
+
+	time.Sleep(f.CleanupDelay)
+	if f.CleanupBlock != nil {
+		<-f.CleanupBlock
+	}
+	f.mu.Lock()
+	f.cleaned++
+	f.mu.Unlock()
+}
+
+// Monitor reports an error for each result the plugin acts on once Delay has
+// passed, if the Behavior is Fail, and otherwise does nothing. It returns
+// once it's done or the plugin is cleaned up (to adhere to
+// plugin.Interface).
+func (f *FakePlugin) Monitor(kubeClient kubernetes.Interface, nodes *plugin.NodeCache, resultsCh chan<- *plugin.Result) {
+	if f.Behavior != Fail {
+		return
+	}
+	f.mu.Lock()
+	started, stopped := f.channels()
+	f.mu.Unlock()
+	select {
+	case <-started:
+	case <-stopped:
+		return
+	}
+	if !f.after(stopped) {
+		return
+	}
+
+	msg := f.ErrorMessage
+	if msg == "" {
+		msg = "the plugin failed"
+	}
+	for _, expected := range f.acted() {
+		resultsCh <- utils.MakeErrorResult(expected.ResultType, map[string]interface{}{
+			"error":    msg,
+			"category": plugin.ErrorCategoryCrash,
+		}, expected.NodeName)
+	}
+}
+
+// ExpectedResults returns a result for each of Nodes, or a single global one
+// if there are none (to adhere to plugin.Interface).
+func (f *FakePlugin) ExpectedResults(nodes []v1.Node) []plugin.ExpectedResult {
+	if len(f.Nodes) == 0 {
+		return []plugin.ExpectedResult{{ResultType: f.Name}}
+	}
+
+	ret := make([]plugin.ExpectedResult, len(f.Nodes))
+	for i, node := range f.Nodes {
+		ret[i] = plugin.ExpectedResult{NodeName: node, ResultType: f.Name}
+	}
+	return ret
+}
+
+// FillTemplate returns nothing, since the plugin has no resources (to
+// adhere to plugin.Interface).
+func (f *FakePlugin) FillTemplate(hostname string, cert *tls.Certificate) ([]byte, error) {
+	return nil, nil
+}
+
+// GetResultType returns Name (to adhere to plugin.Interface).
+func (f *FakePlugin) GetResultType() string { return f.Name }
+
+// GetName returns Name (to adhere to plugin.Interface).
+func (f *FakePlugin) GetName() string { return f.Name }
+
+// GetDependsOn returns DependsOn (to adhere to plugin.Dependent).
+func (f *FakePlugin) GetDependsOn() []string { return f.DependsOn }
+
+// Runs returns how many times the plugin has been run.
+func (f *FakePlugin) Runs() int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.ran
+}
+
+// Cleanups returns how many times the plugin has finished cleaning up.
+func (f *FakePlugin) Cleanups() int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.cleaned
+}
+
+// SubmitErrors returns the errors submitting the plugin's results, such as
+// the server rejecting them once the run is over.
+func (f *FakePlugin) SubmitErrors() []error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]error(nil), f.errs...)
+}
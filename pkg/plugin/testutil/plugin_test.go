@@ -0,0 +1,331 @@
+/*
+Copyright 2018 Heptio Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package testutil
+
+import (
+	"io"
+	"io/ioutil"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/heptio/sonobuoy/pkg/plugin"
+	"github.com/pkg/errors"
+)
+
+// recordingSubmitter records the results submitted through it.
+type recordingSubmitter struct {
+	mu        sync.Mutex
+	submitted []string
+	bodies    []string
+	err       error
+	done      chan struct{}
+	expected  int
+}
+
+func newRecordingSubmitter(expected int) *recordingSubmitter {
+	return &recordingSubmitter{done: make(chan struct{}), expected: expected}
+}
+
+func (r *recordingSubmitter) Submit(nodeName, resultType, mimeType string, body io.Reader) (int, error) {
+	b, err := ioutil.ReadAll(body)
+	if err != nil {
+		return 0, err
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.submitted = append(r.submitted, resultType+"/"+nodeName)
+	r.bodies = append(r.bodies, string(b))
+	if len(r.submitted) == r.expected {
+		close(r.done)
+	}
+	return len(b), r.err
+}
+
+func (r *recordingSubmitter) results() []string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	ret := append([]string(nil), r.submitted...)
+	sort.Strings(ret)
+	return ret
+}
+
+// monitor runs the plugin's Monitor until it returns, returning the results it
+// reported.
+func monitor(f *FakePlugin) []*plugin.Result {
+	resultsCh := make(chan *plugin.Result)
+	go func() {
+		f.Monitor(nil, nil, resultsCh)
+		close(resultsCh)
+	}()
+
+	var ret []*plugin.Result
+	for result := range resultsCh {
+		ret = append(ret, result)
+	}
+	return ret
+}
+
+func TestFakePlugin_ExpectedResults(t *testing.T) {
+	testCases := []struct {
+		desc     string
+		nodes    []string
+		expected []plugin.ExpectedResult
+	}{
+		{
+			desc:     "global",
+			expected: []plugin.ExpectedResult{{ResultType: "fake"}},
+		}, {
+			desc:  "per node",
+			nodes: []string{"node1", "node2"},
+			expected: []plugin.ExpectedResult{
+				{NodeName: "node1", ResultType: "fake"},
+				{NodeName: "node2", ResultType: "fake"},
+			},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.desc, func(t *testing.T) {
+			f := &FakePlugin{Name: "fake", Nodes: tc.nodes}
+			if got := f.ExpectedResults(nil); !reflect.DeepEqual(got, tc.expected) {
+				t.Errorf("expected results %v, got %v", tc.expected, got)
+			}
+		})
+	}
+}
+
+func TestFakePlugin_succeed(t *testing.T) {
+	testCases := []struct {
+		desc     string
+		nodes    []string
+		emit     int
+		body     string
+		expected []string
+		bodies   []string
+	}{
+		{
+			desc:     "global",
+			expected: []string{"fake/"},
+			bodies:   []string{"{}"},
+		}, {
+			desc:     "per node",
+			nodes:    []string{"node1", "node2"},
+			body:     `{"ok": true}`,
+			expected: []string{"fake/node1", "fake/node2"},
+			bodies:   []string{`{"ok": true}`, `{"ok": true}`},
+		}, {
+			desc:     "emit some",
+			nodes:    []string{"node1", "node2", "node3"},
+			emit:     2,
+			expected: []string{"fake/node1", "fake/node2"},
+			bodies:   []string{"{}", "{}"},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.desc, func(t *testing.T) {
+			submitter := newRecordingSubmitter(len(tc.expected))
+			f := &FakePlugin{
+				Name:      "fake",
+				Nodes:     tc.nodes,
+				Emit:      tc.emit,
+				Body:      tc.body,
+				Delay:     10 * time.Millisecond,
+				Submitter: submitter,
+			}
+			if err := f.Run(nil, "", nil); err != nil {
+				t.Fatalf("unexpected error running plugin: %v", err)
+			}
+
+			select {
+			case <-submitter.done:
+			case <-time.After(5 * time.Second):
+				t.Fatalf("expected %v results to be submitted, got %v", len(tc.expected), submitter.results())
+			}
+			// Give the plugin the chance to submit anything it shouldn't.
+			time.Sleep(20 * time.Millisecond)
+			f.Cleanup(nil)
+
+			if got := submitter.results(); !reflect.DeepEqual(got, tc.expected) {
+				t.Errorf("expected results %v to be submitted, got %v", tc.expected, got)
+			}
+			if !reflect.DeepEqual(submitter.bodies, tc.bodies) {
+				t.Errorf("expected bodies %q, got %q", tc.bodies, submitter.bodies)
+			}
+			if results := monitor(f); len(results) != 0 {
+				t.Errorf("expected the monitor not to report anything, got %v", results)
+			}
+			if f.Runs() != 1 || f.Cleanups() != 1 {
+				t.Errorf("expected 1 run and 1 cleanup, got %v and %v", f.Runs(), f.Cleanups())
+			}
+		})
+	}
+}
+
+func TestFakePlugin_submitErrors(t *testing.T) {
+	submitter := newRecordingSubmitter(1)
+	submitter.err = errors.New("run is over")
+	f := &FakePlugin{Name: "fake", Submitter: submitter}
+	if err := f.Run(nil, "", nil); err != nil {
+		t.Fatalf("unexpected error running plugin: %v", err)
+	}
+
+	select {
+	case <-submitter.done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected the result to be submitted")
+	}
+	f.Cleanup(nil)
+
+	// The error is recorded after Submit returns.
+	deadline := time.Now().Add(5 * time.Second)
+	for len(f.SubmitErrors()) == 0 && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	if errs := f.SubmitErrors(); len(errs) != 1 || errs[0] != submitter.err {
+		t.Errorf("expected submit error %v, got %v", submitter.err, errs)
+	}
+}
+
+func TestFakePlugin_fail(t *testing.T) {
+	testCases := []struct {
+		desc     string
+		message  string
+		emit     int
+		expected []string
+		errorMsg string
+	}{
+		{
+			desc:     "default message",
+			expected: []string{"node1", "node2"},
+			errorMsg: "the plugin failed",
+		}, {
+			desc:     "custom message",
+			message:  "image pull backoff",
+			emit:     1,
+			expected: []string{"node1"},
+			errorMsg: "image pull backoff",
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.desc, func(t *testing.T) {
+			f := &FakePlugin{
+				Name:         "fake",
+				Nodes:        []string{"node1", "node2"},
+				Behavior:     Fail,
+				Emit:         tc.emit,
+				ErrorMessage: tc.message,
+				Delay:        10 * time.Millisecond,
+			}
+			if err := f.Run(nil, "", nil); err != nil {
+				t.Fatalf("unexpected error running plugin: %v", err)
+			}
+
+			results := monitor(f)
+			var nodes []string
+			for _, result := range results {
+				nodes = append(nodes, result.NodeName)
+				if result.ResultType != "fake" || result.IsSuccess() {
+					t.Errorf("expected a failed fake result, got %+v", result)
+				}
+				if !strings.Contains(result.Error, tc.errorMsg) {
+					t.Errorf("expected error containing %q, got %q", tc.errorMsg, result.Error)
+				}
+			}
+			if !reflect.DeepEqual(nodes, tc.expected) {
+				t.Errorf("expected failures for nodes %v, got %v", tc.expected, nodes)
+			}
+			f.Cleanup(nil)
+		})
+	}
+}
+
+func TestFakePlugin_hang(t *testing.T) {
+	f := &FakePlugin{Name: "fake", Behavior: Hang}
+	if err := f.Run(nil, "", nil); err != nil {
+		t.Fatalf("unexpected error running plugin: %v", err)
+	}
+	if results := monitor(f); len(results) != 0 {
+		t.Errorf("expected the monitor not to report anything, got %v", results)
+	}
+	f.Cleanup(nil)
+	if f.Cleanups() != 1 {
+		t.Errorf("expected 1 cleanup, got %v", f.Cleanups())
+	}
+}
+
+func TestFakePlugin_cleanupBeforeDelay(t *testing.T) {
+	submitter := newRecordingSubmitter(1)
+	f := &FakePlugin{Name: "fake", Delay: time.Hour, Submitter: submitter}
+	if err := f.Run(nil, "", nil); err != nil {
+		t.Fatalf("unexpected error running plugin: %v", err)
+	}
+	f.Cleanup(nil)
+
+	// Nothing's submitted once the plugin is cleaned up.
+	time.Sleep(20 * time.Millisecond)
+	if got := submitter.results(); len(got) != 0 {
+		t.Errorf("expected nothing to be submitted, got %v", got)
+	}
+}
+
+func TestFakePlugin_runErrors(t *testing.T) {
+	runErr := errors.New("couldn't create pods")
+	testCases := []struct {
+		desc      string
+		plugin    *FakePlugin
+		expectErr string
+	}{
+		{
+			desc:      "run error",
+			plugin:    &FakePlugin{Name: "fake", RunError: runErr, Submitter: newRecordingSubmitter(1)},
+			expectErr: "couldn't create pods",
+		}, {
+			desc:      "succeed without a submitter",
+			plugin:    &FakePlugin{Name: "fake"},
+			expectErr: "has no Submitter",
+		}, {
+			desc:   "fail without a submitter",
+			plugin: &FakePlugin{Name: "fake", Behavior: Fail},
+		}, {
+			desc:   "hang without a submitter",
+			plugin: &FakePlugin{Name: "fake", Behavior: Hang},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.desc, func(t *testing.T) {
+			err := tc.plugin.Run(nil, "", nil)
+			switch {
+			case tc.expectErr == "" && err != nil:
+				t.Errorf("unexpected error running plugin: %v", err)
+			case tc.expectErr != "" && (err == nil || !strings.Contains(err.Error(), tc.expectErr)):
+				t.Errorf("expected error containing %q, got %v", tc.expectErr, err)
+			}
+			if tc.plugin.Runs() != 1 {
+				t.Errorf("expected 1 run, got %v", tc.plugin.Runs())
+			}
+			tc.plugin.Cleanup(nil)
+		})
+	}
+}
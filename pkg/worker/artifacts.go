@@ -0,0 +1,155 @@
+/*
+Copyright 2018 Heptio Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package worker
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/heptio/sonobuoy/pkg/plugin/aggregation"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+// artifactUploader submits the files a plugin places in its artifacts
+// directory, each named by its path within the directory, and marks the
+// result done once the plugin has finished.
+type artifactUploader struct {
+	dir      string
+	urls     []string
+	client   *http.Client
+	policy   UploadPolicy
+	checksum bool
+	// sent is the set of paths, relative to dir, which have already been
+	// submitted
+	sent map[string]bool
+}
+
+func newArtifactUploader(dir string, urls []string, client *http.Client, policy UploadPolicy, checksum bool) *artifactUploader {
+	return &artifactUploader{
+		dir:      dir,
+		urls:     urls,
+		client:   client,
+		policy:   policy,
+		checksum: checksum,
+		sent:     map[string]bool{},
+	}
+}
+
+// upload submits any new files in the artifacts directory or its
+// subdirectories. Hidden files and directories are skipped so that plugins
+// can write artifacts under a temporary name and rename them once complete.
+// It stops at the first file which can't be submitted, which is retried on
+// the next call.
+func (a *artifactUploader) upload() error {
+	if a == nil {
+		return nil
+	}
+
+	err := filepath.Walk(a.dir, func(file string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if strings.HasPrefix(info.Name(), ".") && file != a.dir {
+			if info.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if info.IsDir() {
+			return nil
+		}
+
+		rel, err := filepath.Rel(a.dir, file)
+		if err != nil {
+			return errors.WithStack(err)
+		}
+		name := filepath.ToSlash(rel)
+		if a.sent[name] {
+			return nil
+		}
+		if err := a.submit(file, name); err != nil {
+			return err
+		}
+		a.sent[name] = true
+		return nil
+	})
+	if os.IsNotExist(errors.Cause(err)) {
+		return nil
+	}
+	return err
+}
+
+// contains returns true if the file is in the artifacts directory, in which
+// case it was already submitted.
+func (a *artifactUploader) contains(file string) bool {
+	rel, err := filepath.Rel(a.dir, file)
+	return err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator))
+}
+
+// submit submits the file as the artifact with the given name.
+func (a *artifactUploader) submit(file, name string) error {
+	artifactURLs := make([]string, len(a.urls))
+	for i, url := range a.urls {
+		artifactURLs[i] = aggregation.ArtifactURL(url)
+	}
+	if err := handleWaitFile(file, artifactURLs, a.client, a.policy, a.checksum, name, ""); err != nil {
+		return errors.Wrapf(err, "couldn't submit artifact %v", name)
+	}
+	logrus.WithField("artifact", name).Info("Submitted artifact")
+	return nil
+}
+
+// finish submits the rest of the artifacts, as well as the file named in the
+// done file if it's outside the artifacts directory, then marks the result
+// done with the given annotations, if any.
+func (a *artifactUploader) finish(resultFile, annotations string) error {
+	if err := a.upload(); err != nil {
+		return err
+	}
+	if resultFile != "" && !a.contains(resultFile) {
+		if err := a.submit(resultFile, filepath.Base(resultFile)); err != nil {
+			return err
+		}
+	}
+
+	if len(a.urls) == 0 {
+		return errors.New("no master URLs to submit results to")
+	}
+	header := http.Header{}
+	header.Set(dateHeader, time.Now().UTC().Format(http.TimeFormat))
+	if annotations != "" {
+		header.Set(aggregation.AnnotationsHeader, annotations)
+	}
+	var err error
+	for _, url := range a.urls {
+		err = doRequest(aggregation.DoneURL(url), a.client, a.policy, header, func() (io.Reader, string, error) {
+			return bytes.NewReader(nil), "", nil
+		})
+		if err == nil {
+			logrus.WithField("artifacts", len(a.sent)).Info("Marked result done")
+			return nil
+		}
+		logrus.WithError(err).WithField("url", url).Info("Couldn't mark result done, trying next master URL")
+	}
+	return err
+}
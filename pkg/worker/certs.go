@@ -0,0 +1,173 @@
+/*
+Copyright 2018 Heptio Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package worker
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/heptio/sonobuoy/pkg/backplane/ca"
+	"github.com/heptio/sonobuoy/pkg/plugin/aggregation"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+// renewCheckInterval is how often the client certificate is checked to see if
+// it needs renewing.
+const renewCheckInterval = time.Minute
+
+// CertRenewer holds the client certificate the worker authenticates with,
+// fetching a new one from the aggregator before the current one expires. This
+// keeps long-running plugins able to submit their results.
+type CertRenewer struct {
+	mu      sync.RWMutex
+	cert    *tls.Certificate
+	rootCAs *x509.CertPool
+	urls    []string
+	// TLSOptions restrict the connections made to renew the certificate.
+	TLSOptions ca.TLSOptions
+	// Proxy, if set, picks the proxy certificates are renewed through.
+	Proxy Proxy
+	// ServerName, if set, is what the aggregator's certificate is verified
+	// against instead of the host of the URL.
+	ServerName string
+	// Transport, if set, is cloned for the connections made to renew the
+	// certificate, keeping its settings other than the proxy and those of
+	// its TLS config which are set for the worker's uploads.
+	Transport *http.Transport
+	// now is overridden in tests.
+	now func() time.Time
+}
+
+// NewCertRenewer returns a CertRenewer for the given certificate, which must
+// have its Leaf set, that renews it from the first of the given URLs to
+// respond.
+func NewCertRenewer(cert *tls.Certificate, rootCAs *x509.CertPool, urls []string) *CertRenewer {
+	return &CertRenewer{
+		cert:    cert,
+		rootCAs: rootCAs,
+		urls:    urls,
+		now:     time.Now,
+	}
+}
+
+// GetClientCertificate returns the current client certificate. It can be used
+// as the GetClientCertificate callback of a tls.Config.
+func (r *CertRenewer) GetClientCertificate(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.cert, nil
+}
+
+// NeedsRenewal returns true once less than a third of the current
+// certificate's lifetime remains.
+func (r *CertRenewer) NeedsRenewal() bool {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	leaf := r.cert.Leaf
+	lifetime := leaf.NotAfter.Sub(leaf.NotBefore)
+	return leaf.NotAfter.Sub(r.now()) < lifetime/3
+}
+
+// Renew fetches a new client certificate, authenticating with the current
+// one.
+func (r *CertRenewer) Renew() error {
+	if len(r.urls) == 0 {
+		return errors.New("no URLs to renew the client certificate from")
+	}
+
+	// The current certificate is used directly rather than through the
+	// renewer so that this client is unaffected by the swap below.
+	current, _ := r.GetClientCertificate(nil)
+	tlsCfg := uploadTLSConfig(r.Transport, r.rootCAs, r.ServerName, r.TLSOptions)
+	tlsCfg.Certificates = []tls.Certificate{*current}
+	transport := &http.Transport{}
+	if r.Transport != nil {
+		transport = cloneTransport(r.Transport)
+	}
+	transport.TLSClientConfig = tlsCfg
+	transport.Proxy = r.Proxy
+	client := &http.Client{
+		Transport: NewServerNameTransport(transport),
+	}
+
+	var err error
+	for _, url := range r.urls {
+		var cert *tls.Certificate
+		if cert, err = fetchCert(client, url); err == nil {
+			r.mu.Lock()
+			r.cert = cert
+			r.mu.Unlock()
+			logrus.WithField("expires", cert.Leaf.NotAfter).Info("Renewed client certificate")
+			return nil
+		}
+		logrus.WithError(err).WithField("url", url).Info("Couldn't renew client certificate, trying next URL")
+	}
+	return err
+}
+
+// RenewPeriodically renews the certificate whenever it nears expiry until
+// stopc is closed.
+func (r *CertRenewer) RenewPeriodically(stopc <-chan struct{}) {
+	ticker := time.NewTicker(renewCheckInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if !r.NeedsRenewal() {
+				continue
+			}
+			if err := r.Renew(); err != nil {
+				logrus.WithError(err).Info("Couldn't renew client certificate, will retry")
+			}
+		case <-stopc:
+			return
+		}
+	}
+}
+
+// fetchCert requests a new certificate from the given URL.
+func fetchCert(client *http.Client, url string) (*tls.Certificate, error) {
+	resp, err := client.Post(url, "application/json", nil)
+	if err != nil {
+		return nil, errors.Wrapf(err, "error requesting certificate from %v", url)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status code %d renewing certificate", resp.StatusCode)
+	}
+
+	var renewed aggregation.RenewedCert
+	if err := json.NewDecoder(resp.Body).Decode(&renewed); err != nil {
+		return nil, errors.Wrap(err, "couldn't decode renewed certificate")
+	}
+
+	cert, err := tls.X509KeyPair([]byte(renewed.Cert), []byte(renewed.Key))
+	if err != nil {
+		return nil, errors.Wrap(err, "couldn't parse renewed certificate")
+	}
+	if cert.Leaf, err = x509.ParseCertificate(cert.Certificate[0]); err != nil {
+		return nil, errors.Wrap(err, "couldn't parse renewed certificate")
+	}
+	return &cert, nil
+}
@@ -0,0 +1,84 @@
+/*
+Copyright 2018 Heptio Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package worker
+
+import (
+	"crypto/tls"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/heptio/sonobuoy/pkg/backplane/ca/authtest"
+	"github.com/heptio/sonobuoy/pkg/plugin"
+	"github.com/heptio/sonobuoy/pkg/plugin/aggregation"
+)
+
+func TestCertRenewer_renew(t *testing.T) {
+	var srv *authtest.Server
+	handler := aggregation.NewHandlerWithCerts(
+		func(*plugin.Result, http.ResponseWriter) {},
+		func(name string) (*tls.Certificate, error) { return srv.ClientKeyPair(name) },
+	)
+	srv = authtest.NewTLSServer(handler, t)
+	defer srv.Close()
+
+	cert, err := srv.ClientKeyPair("e2e")
+	if err != nil {
+		t.Fatalf("couldn't get client cert: %v", err)
+	}
+	rootCAs := srv.Client().Transport.(*http.Transport).TLSClientConfig.RootCAs
+
+	url, err := aggregation.CertURL(srv.URL)
+	if err != nil {
+		t.Fatalf("couldn't get certificate URL: %v", err)
+	}
+
+	renewer := NewCertRenewer(cert, rootCAs, []string{"https://127.0.0.1:1/api/v1/cert", url})
+	if err := renewer.Renew(); err != nil {
+		t.Fatalf("unexpected error renewing certificate: %v", err)
+	}
+
+	renewed, _ := renewer.GetClientCertificate(nil)
+	if renewed.Leaf.SerialNumber.Cmp(cert.Leaf.SerialNumber) == 0 {
+		t.Error("expected a new certificate")
+	}
+	if renewed.Leaf.Subject.CommonName != "e2e" {
+		t.Errorf("expected the renewed certificate to keep the name e2e, got %v", renewed.Leaf.Subject.CommonName)
+	}
+}
+
+func TestCertRenewer_needsRenewal(t *testing.T) {
+	srv := authtest.NewTLSServer(http.NotFoundHandler(), t)
+	defer srv.Close()
+
+	cert, err := srv.ClientKeyPair("e2e")
+	if err != nil {
+		t.Fatalf("couldn't get client cert: %v", err)
+	}
+	renewer := NewCertRenewer(cert, nil, nil)
+	lifetime := cert.Leaf.NotAfter.Sub(cert.Leaf.NotBefore)
+
+	renewer.now = func() time.Time { return cert.Leaf.NotBefore.Add(lifetime / 2) }
+	if renewer.NeedsRenewal() {
+		t.Error("expected a certificate half way through its lifetime not to need renewal")
+	}
+
+	renewer.now = func() time.Time { return cert.Leaf.NotAfter.Add(-lifetime / 4) }
+	if !renewer.NeedsRenewal() {
+		t.Error("expected a certificate near expiry to need renewal")
+	}
+}
@@ -0,0 +1,229 @@
+/*
+Copyright 2018 Heptio Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package worker
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"net/http"
+
+	"github.com/heptio/sonobuoy/pkg/backplane/ca"
+	"github.com/heptio/sonobuoy/pkg/plugin"
+	"github.com/heptio/sonobuoy/pkg/plugin/aggregation"
+	"github.com/pkg/errors"
+	"golang.org/x/net/http2"
+)
+
+// ClientOptions customize the client a worker submits results with, for
+// programs which need more control over its connections than the worker
+// config gives.
+type ClientOptions struct {
+	// Base, if set, is copied to make the client rather than starting
+	// from an empty one, keeping its timeout, redirect policy and cookie
+	// jar. Its Transport, if set, must be an *http.Transport, which is
+	// cloned to keep its dialer, timeouts and connection limits, and its
+	// proxy unless the worker config sets one. Its TLS config, if set, is
+	// kept too, e.g. for VerifyPeerCertificate, but the run's client
+	// certificate, root CAs, server name and TLS options always replace
+	// its own. Base isn't modified.
+	Base *http.Client
+	// RootCAs are trusted to have issued the aggregator's certificate
+	// along with the run's CA, e.g. a corporate intermediate CA when the
+	// aggregator is reached through a proxy which terminates TLS.
+	RootCAs []*x509.Certificate
+}
+
+// NewClient returns the client results are submitted with, which presents
+// the client certificate in the worker config, renewing it in the background
+// as it nears expiry, and trusts the config's CA. Results are compressed if
+// the config says to. A worker sharing the aggregator's pod submits results
+// over its socket without TLS instead.
+func NewClient(cfg *plugin.WorkerConfig, opts ClientOptions) (*http.Client, error) {
+	client := &http.Client{}
+	if opts.Base != nil {
+		copied := *opts.Base
+		client = &copied
+	}
+	var base *http.Transport
+	if client.Transport != nil {
+		var ok bool
+		if base, ok = client.Transport.(*http.Transport); !ok {
+			return nil, errors.Errorf("base client's transport must be an *http.Transport, got %T", client.Transport)
+		}
+	}
+
+	// An aggregator in the same pod is trusted by virtue of being able to
+	// open its socket, so no certificates are needed.
+	if cfg.AggregatorSocket != "" {
+		transport := NewSocketTransport(cfg.AggregatorSocket)
+		if cfg.CompressResults {
+			transport = NewCodecTransport(transport)
+		}
+		client.Transport = transport
+		return client, nil
+	}
+
+	caCertDER, _ := pem.Decode([]byte(cfg.CACert))
+	if caCertDER == nil {
+		return nil, errors.New("Couldn't parse CaCert PEM")
+	}
+	clientCertDER, _ := pem.Decode([]byte(cfg.ClientCert))
+	if clientCertDER == nil {
+		return nil, errors.New("Couldn't parse ClientCert PEM")
+	}
+
+	caCert, err := x509.ParseCertificate(caCertDER.Bytes)
+	if err != nil {
+		return nil, errors.Wrap(err, "couldn't parse CaCert")
+	}
+	clientCert, err := x509.ParseCertificate(clientCertDER.Bytes)
+	if err != nil {
+		return nil, errors.Wrap(err, "couldn't parse ClientCert")
+	}
+	clientKey, err := ca.ParsePrivateKey([]byte(cfg.ClientKey))
+	if err != nil {
+		return nil, errors.Wrap(err, "couldn't parse ClientKey")
+	}
+
+	certPool := x509.NewCertPool()
+	certPool.AddCert(caCert)
+	for _, cert := range opts.RootCAs {
+		certPool.AddCert(cert)
+	}
+
+	proxy, err := NewProxy(cfg.ProxyURL)
+	if err != nil {
+		return nil, err
+	}
+	if base != nil && cfg.ProxyURL == "" {
+		proxy = base.Proxy
+	}
+
+	var renewURLs []string
+	for _, masterURL := range cfg.MasterURLs() {
+		renewURL, err := aggregation.CertURL(masterURL)
+		if err != nil {
+			return nil, err
+		}
+		if renewURL, err = aggregation.WithPathPrefix(renewURL, cfg.UploadPathPrefix); err != nil {
+			return nil, err
+		}
+		renewURLs = append(renewURLs, renewURL)
+	}
+
+	// Long-running plugins may outlive the client certificate, so renew it
+	// in the background for as long as the worker runs.
+	renewer := NewCertRenewer(&tls.Certificate{
+		Certificate: [][]byte{clientCertDER.Bytes},
+		PrivateKey:  clientKey,
+		Leaf:        clientCert,
+	}, certPool, renewURLs)
+
+	// The worker holds itself to the same TLS minimums as the aggregator.
+	tlsOpts, err := ca.ParseTLSOptions(cfg.MinTLSVersion, cfg.CipherSuiteList())
+	if err != nil {
+		return nil, errors.Wrap(err, "invalid TLS settings")
+	}
+	renewer.TLSOptions = tlsOpts
+	renewer.Proxy = proxy
+	renewer.ServerName = cfg.TLSServerName
+	renewer.Transport = base
+	go renewer.RenewPeriodically(nil)
+
+	tlsCfg := uploadTLSConfig(base, certPool, cfg.TLSServerName, tlsOpts)
+	tlsCfg.GetClientCertificate = renewer.GetClientCertificate
+	var tlsTransport *http.Transport
+	if base == nil {
+		if tlsTransport, err = NewTLSTransport(tlsCfg, proxy); err != nil {
+			return nil, err
+		}
+	} else if tlsTransport, err = cloneTLSTransport(base, tlsCfg, proxy); err != nil {
+		return nil, err
+	}
+	transport := NewServerNameTransport(tlsTransport)
+	if cfg.CompressResults {
+		transport = NewCodecTransport(transport)
+	}
+	client.Transport = transport
+	return client, nil
+}
+
+// uploadTLSConfig returns the TLS config for connecting to the aggregator: a
+// copy of the base transport's, if it has one, trusting the given root CAs
+// and verifying the aggregator's certificate against the server name, if
+// set. No client certificate is set.
+func uploadTLSConfig(base *http.Transport, rootCAs *x509.CertPool, serverName string, opts ca.TLSOptions) *tls.Config {
+	tlsCfg := &tls.Config{}
+	if base != nil && base.TLSClientConfig != nil {
+		tlsCfg = base.TLSClientConfig.Clone()
+		tlsCfg.Certificates = nil
+		tlsCfg.GetClientCertificate = nil
+	}
+	tlsCfg.RootCAs = rootCAs
+	tlsCfg.ServerName = serverName
+	opts.Apply(tlsCfg)
+	return tlsCfg
+}
+
+// cloneTLSTransport is NewTLSTransport for a clone of base, keeping its
+// settings other than the TLS config and proxy.
+func cloneTLSTransport(base *http.Transport, tlsCfg *tls.Config, proxy Proxy) (*http.Transport, error) {
+	transport := cloneTransport(base)
+	transport.TLSClientConfig = tlsCfg
+	transport.Proxy = proxy
+	if transport.TLSNextProto != nil {
+		// The base transport turned HTTP/2 off with an empty map.
+		return transport, nil
+	}
+	if err := http2.ConfigureTransport(transport); err != nil {
+		return nil, errors.Wrap(err, "couldn't configure HTTP/2")
+	}
+	return transport, nil
+}
+
+// cloneTransport returns a new transport with the settings of base, as
+// Transport.Clone does in Go 1.13 and later. Only the settings Go 1.12 has
+// are copied. HTTP/2 support configured on base isn't, since it hands
+// connections to base's own HTTP/2 transport, but an empty TLSNextProto,
+// which turns HTTP/2 off, is.
+func cloneTransport(base *http.Transport) *http.Transport {
+	transport := &http.Transport{
+		Proxy:                  base.Proxy,
+		DialContext:            base.DialContext,
+		Dial:                   base.Dial,
+		DialTLS:                base.DialTLS,
+		TLSHandshakeTimeout:    base.TLSHandshakeTimeout,
+		DisableKeepAlives:      base.DisableKeepAlives,
+		DisableCompression:     base.DisableCompression,
+		MaxIdleConns:           base.MaxIdleConns,
+		MaxIdleConnsPerHost:    base.MaxIdleConnsPerHost,
+		MaxConnsPerHost:        base.MaxConnsPerHost,
+		IdleConnTimeout:        base.IdleConnTimeout,
+		ResponseHeaderTimeout:  base.ResponseHeaderTimeout,
+		ExpectContinueTimeout:  base.ExpectContinueTimeout,
+		ProxyConnectHeader:     base.ProxyConnectHeader,
+		MaxResponseHeaderBytes: base.MaxResponseHeaderBytes,
+	}
+	if base.TLSClientConfig != nil {
+		transport.TLSClientConfig = base.TLSClientConfig.Clone()
+	}
+	if base.TLSNextProto != nil && len(base.TLSNextProto) == 0 {
+		transport.TLSNextProto = map[string]func(string, *tls.Conn) http.RoundTripper{}
+	}
+	return transport
+}
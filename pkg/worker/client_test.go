@@ -0,0 +1,205 @@
+/*
+Copyright 2018 Heptio Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package worker
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/heptio/sonobuoy/pkg/backplane/ca"
+	"github.com/heptio/sonobuoy/pkg/plugin"
+	"golang.org/x/net/http2"
+)
+
+// clientTestServer serves the name on the client certificate of each
+// request, with a server certificate issued by serverAuth, accepting client
+// certificates issued by auth.
+func clientTestServer(t *testing.T, auth, serverAuth *ca.Authority) *httptest.Server {
+	tlsCfg, err := serverAuth.MakeServerConfig("127.0.0.1")
+	if err != nil {
+		t.Fatalf("couldn't get server config: %v", err)
+	}
+	tlsCfg.ClientCAs = auth.CACertPool()
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(r.TLS.PeerCertificates[0].Subject.CommonName))
+	}))
+	srv.TLS = tlsCfg
+	srv.StartTLS()
+	return srv
+}
+
+// clientTestConfig returns a worker config submitting to the URL with a
+// client certificate issued by auth.
+func clientTestConfig(t *testing.T, auth *ca.Authority, url string) *plugin.WorkerConfig {
+	cert, err := auth.ClientKeyPair("e2e")
+	if err != nil {
+		t.Fatalf("couldn't get client cert: %v", err)
+	}
+	certPEM, keyPEM, err := ca.EncodePEM(cert)
+	if err != nil {
+		t.Fatalf("couldn't encode client cert: %v", err)
+	}
+	return &plugin.WorkerConfig{
+		MasterURL:  url,
+		CACert:     string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: auth.CACert().Raw})),
+		ClientCert: string(certPEM),
+		ClientKey:  string(keyPEM),
+	}
+}
+
+func getName(client *http.Client, url string) (string, error) {
+	resp, err := client.Get(url)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	return string(body), err
+}
+
+func TestNewClient(t *testing.T) {
+	auth, err := ca.NewAuthority()
+	if err != nil {
+		t.Fatalf("couldn't create certificate authority: %v", err)
+	}
+	srv := clientTestServer(t, auth, auth)
+	defer srv.Close()
+	cfg := clientTestConfig(t, auth, srv.URL)
+
+	client, err := NewClient(cfg, ClientOptions{})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if name, err := getName(client, srv.URL); err != nil || name != "e2e" {
+		t.Errorf("expected the request to be made with the client cert, got %q, %v", name, err)
+	}
+}
+
+func TestNewClient_base(t *testing.T) {
+	auth, err := ca.NewAuthority()
+	if err != nil {
+		t.Fatalf("couldn't create certificate authority: %v", err)
+	}
+	srv := clientTestServer(t, auth, auth)
+	defer srv.Close()
+	cfg := clientTestConfig(t, auth, srv.URL)
+
+	var dials int32
+	dialer := &net.Dialer{}
+	verified := false
+	base := &http.Client{
+		Timeout: time.Minute,
+		Transport: &http.Transport{
+			DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+				atomic.AddInt32(&dials, 1)
+				return dialer.DialContext(ctx, network, addr)
+			},
+			TLSClientConfig: &tls.Config{
+				VerifyPeerCertificate: func([][]byte, [][]*x509.Certificate) error {
+					verified = true
+					return nil
+				},
+			},
+		},
+	}
+
+	client, err := NewClient(cfg, ClientOptions{Base: base})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if name, err := getName(client, srv.URL); err != nil || name != "e2e" {
+		t.Errorf("expected the request to be made with the client cert, got %q, %v", name, err)
+	}
+	if client.Timeout != time.Minute {
+		t.Errorf("expected the base client's timeout to be kept, got %v", client.Timeout)
+	}
+	if atomic.LoadInt32(&dials) == 0 {
+		t.Error("expected the base transport's dialer to be used")
+	}
+	if !verified {
+		t.Error("expected the base transport's TLS config to be kept")
+	}
+	if tlsCfg := base.Transport.(*http.Transport).TLSClientConfig; tlsCfg.RootCAs != nil || tlsCfg.GetClientCertificate != nil {
+		t.Error("expected the base transport to be left as it was")
+	}
+
+	if _, err := NewClient(cfg, ClientOptions{Base: &http.Client{Transport: NewGzipTransport(nil)}}); err == nil {
+		t.Error("expected an error for a base transport which isn't an *http.Transport")
+	}
+}
+
+func TestNewClient_rootCAs(t *testing.T) {
+	auth, err := ca.NewAuthority()
+	if err != nil {
+		t.Fatalf("couldn't create certificate authority: %v", err)
+	}
+	// e.g. a proxy in front of the aggregator with a corporate certificate
+	corporate, err := ca.NewAuthority()
+	if err != nil {
+		t.Fatalf("couldn't create certificate authority: %v", err)
+	}
+	srv := clientTestServer(t, auth, corporate)
+	defer srv.Close()
+	cfg := clientTestConfig(t, auth, srv.URL)
+
+	client, err := NewClient(cfg, ClientOptions{})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if _, err := getName(client, srv.URL); err == nil {
+		t.Error("expected a certificate issued by another CA not to be trusted")
+	}
+
+	client, err = NewClient(cfg, ClientOptions{RootCAs: []*x509.Certificate{corporate.CACert()}})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if name, err := getName(client, srv.URL); err != nil || name != "e2e" {
+		t.Errorf("expected the extra root CA to be trusted, got %q, %v", name, err)
+	}
+}
+
+func TestCloneTransport(t *testing.T) {
+	base := &http.Transport{MaxConnsPerHost: 2, IdleConnTimeout: time.Minute, TLSClientConfig: &tls.Config{ServerName: "sonobuoy"}}
+	if err := http2.ConfigureTransport(base); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	clone := cloneTransport(base)
+	if clone.MaxConnsPerHost != 2 || clone.IdleConnTimeout != time.Minute || clone.TLSClientConfig.ServerName != "sonobuoy" {
+		t.Errorf("expected the base transport's settings to be copied, got %+v", clone)
+	}
+	if clone.TLSClientConfig == base.TLSClientConfig {
+		t.Error("expected the TLS config to be copied rather than shared")
+	}
+	if clone.TLSNextProto != nil {
+		t.Error("expected the base transport's HTTP/2 support not to be shared")
+	}
+
+	base.TLSNextProto = map[string]func(string, *tls.Conn) http.RoundTripper{}
+	if clone := cloneTransport(base); clone.TLSNextProto == nil || len(clone.TLSNextProto) != 0 {
+		t.Error("expected HTTP/2 to be left off")
+	}
+}
@@ -0,0 +1,235 @@
+/*
+Copyright 2018 Heptio Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package worker
+
+import (
+	"compress/gzip"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/heptio/sonobuoy/pkg/plugin"
+	"github.com/heptio/sonobuoy/pkg/plugin/aggregation"
+)
+
+const gzipMimeType = "application/gzip"
+
+// codecEncoders compress request bodies with each codec the worker supports,
+// other than identity.
+var codecEncoders = map[string]func(io.Writer) io.WriteCloser{
+	plugin.UploadCodecGzip: func(w io.Writer) io.WriteCloser { return gzip.NewWriter(w) },
+}
+
+// defaultCodecs are the codecs workers offer, in order of preference.
+var defaultCodecs = []string{plugin.UploadCodecGzip, plugin.UploadCodecIdentity}
+
+// compress returns a request with the body of req compressed with the codec
+// and the Content-Encoding header set, or req itself for identity.
+func compress(req *http.Request, codec string) *http.Request {
+	encode, ok := codecEncoders[codec]
+	if !ok {
+		return req
+	}
+
+	body := req.Body
+	pr, pw := io.Pipe()
+	go func() {
+		w := encode(pw)
+		_, err := io.Copy(w, body)
+		if err == nil {
+			err = w.Close()
+		}
+		body.Close()
+		pw.CloseWithError(err)
+	}()
+
+	// WithContext makes a shallow copy of the request; its header is copied
+	// too so that setting Content-Encoding doesn't change req.
+	compressed := req.WithContext(req.Context())
+	compressed.Header = make(http.Header, len(req.Header))
+	for key, values := range req.Header {
+		compressed.Header[key] = append([]string(nil), values...)
+	}
+	compressed.Body = pr
+	compressed.GetBody = nil
+	compressed.ContentLength = -1
+	compressed.Header.Set("content-encoding", codec)
+	return compressed
+}
+
+// gzipTransport compresses the body of each request it sends, setting the
+// Content-Encoding header so the aggregator can decompress it.
+type gzipTransport struct {
+	next http.RoundTripper
+}
+
+// NewGzipTransport returns a RoundTripper which gzips request bodies before
+// sending them with next, or http.DefaultTransport if next is nil. Bodies
+// which are already gzipped archives are sent as they are. Unlike
+// NewCodecTransport, it doesn't check that the aggregator supports gzip.
+func NewGzipTransport(next http.RoundTripper) http.RoundTripper {
+	if next == nil {
+		next = http.DefaultTransport
+	}
+	return &gzipTransport{next: next}
+}
+
+func (t *gzipTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.Body == nil || req.Header.Get("content-encoding") != "" || req.Header.Get("content-type") == gzipMimeType {
+		return t.next.RoundTrip(req)
+	}
+	return t.next.RoundTrip(compress(req, plugin.UploadCodecGzip))
+}
+
+// codecTransport compresses results with the codec negotiated with each
+// aggregator it sends them to.
+type codecTransport struct {
+	next http.RoundTripper
+	// offer is the Accept-Encoding header listing the codecs offered
+	offer   string
+	offered map[string]bool
+	// legacy is the codec for aggregators which don't negotiate
+	legacy string
+
+	mu sync.Mutex
+	// negotiated is the codec chosen by each aggregator, by host
+	negotiated map[string]string
+}
+
+// NewCodecTransport returns a RoundTripper which compresses the bodies of
+// results before sending them with next, or http.DefaultTransport if next is
+// nil. Before the first result it sends to an aggregator, it offers the
+// aggregator the given codecs, in order of preference, and uses the one it
+// picks. The codecs default to every codec the worker supports, and ones it
+// doesn't are left out.
+//
+// Aggregators which don't negotiate, because they predate it, are sent
+// results compressed with gzip if it's offered, since the aggregators which
+// workers compressed results for before negotiation only supported gzip.
+// Requests which aren't results, such as progress reports, and results
+// which are already gzipped archives are sent as they are.
+func NewCodecTransport(next http.RoundTripper, codecs ...string) http.RoundTripper {
+	if next == nil {
+		next = http.DefaultTransport
+	}
+	if len(codecs) == 0 {
+		codecs = defaultCodecs
+	}
+
+	t := &codecTransport{
+		next:       next,
+		offered:    map[string]bool{},
+		legacy:     plugin.UploadCodecIdentity,
+		negotiated: map[string]string{},
+	}
+	var offer []string
+	for _, codec := range codecs {
+		if _, ok := codecEncoders[codec]; (!ok && codec != plugin.UploadCodecIdentity) || t.offered[codec] {
+			continue
+		}
+		offer = append(offer, codecWeight(codec, len(offer)))
+		t.offered[codec] = true
+	}
+	t.offer = strings.Join(offer, ", ")
+	if t.offered[plugin.UploadCodecGzip] {
+		t.legacy = plugin.UploadCodecGzip
+	}
+	return t
+}
+
+// codecWeight returns the codec as listed in an Accept-Encoding header, with
+// a weight spelling out its place in the order of preference, since the
+// aggregator goes by the weights first.
+func codecWeight(codec string, place int) string {
+	if place == 0 {
+		return codec
+	}
+	q := 1 - float64(place)/10
+	if q < 0.1 {
+		q = 0.1
+	}
+	return codec + ";q=" + strconv.FormatFloat(q, 'f', 1, 64)
+}
+
+func (t *codecTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	_, isResult := aggregation.RequestResultInfo(req)
+	if req.Body == nil || req.Method != http.MethodPut || !isResult || req.Header.Get("content-encoding") != "" || req.Header.Get("content-type") == gzipMimeType {
+		return t.next.RoundTrip(req)
+	}
+
+	resp, err := t.next.RoundTrip(compress(req, t.codec(req)))
+	// The aggregator may have been replaced by one with other codecs, so
+	// negotiate again before the upload is retried.
+	if err == nil && resp.StatusCode == http.StatusUnsupportedMediaType {
+		t.mu.Lock()
+		delete(t.negotiated, req.URL.Host)
+		t.mu.Unlock()
+	}
+	return resp, err
+}
+
+// codec returns the codec to compress the request with, negotiating it with
+// the aggregator it's sent to if it hasn't been already. If negotiating
+// fails it's tried again with the next request, and the request is sent
+// uncompressed, which every aggregator accepts.
+func (t *codecTransport) codec(req *http.Request) string {
+	t.mu.Lock()
+	codec, ok := t.negotiated[req.URL.Host]
+	t.mu.Unlock()
+	if ok {
+		return codec
+	}
+
+	codec, ok = t.negotiate(req)
+	if ok {
+		t.mu.Lock()
+		t.negotiated[req.URL.Host] = codec
+		t.mu.Unlock()
+	}
+	return codec
+}
+
+// negotiate asks the aggregator which codec to use with an OPTIONS request
+// to the path of req, returning false if it should be asked again.
+func (t *codecTransport) negotiate(req *http.Request) (string, bool) {
+	options, err := http.NewRequest(http.MethodOptions, req.URL.String(), nil)
+	if err != nil {
+		return plugin.UploadCodecIdentity, false
+	}
+	options = options.WithContext(req.Context())
+	options.Header.Set(aggregation.AcceptEncodingHeader, t.offer)
+	resp, err := t.next.RoundTrip(options)
+	if err != nil {
+		return plugin.UploadCodecIdentity, false
+	}
+	resp.Body.Close()
+
+	chosen := strings.ToLower(strings.TrimSpace(resp.Header.Get(aggregation.AcceptEncodingHeader)))
+	switch {
+	case resp.StatusCode == http.StatusNotFound || resp.StatusCode == http.StatusMethodNotAllowed || resp.StatusCode == http.StatusNotImplemented:
+		return t.legacy, true
+	case resp.StatusCode >= 300:
+		return plugin.UploadCodecIdentity, resp.StatusCode == http.StatusNotAcceptable
+	case t.offered[chosen] || chosen == plugin.UploadCodecIdentity:
+		return chosen, true
+	}
+	// A successful response from an aggregator which ignored the
+	// negotiation, or picked a codec which wasn't offered.
+	return t.legacy, true
+}
@@ -0,0 +1,289 @@
+/*
+Copyright 2018 Heptio Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package worker
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/heptio/sonobuoy/pkg/backplane/ca/authtest"
+	"github.com/heptio/sonobuoy/pkg/plugin"
+	"github.com/heptio/sonobuoy/pkg/plugin/aggregation"
+)
+
+// nopWriteCloser is the encoder of a codec which only the worker supports,
+// standing in for one added to workers before aggregators.
+type nopWriteCloser struct{ io.Writer }
+
+func (nopWriteCloser) Close() error { return nil }
+
+// TestCodecConformance uploads results from each kind of worker to each kind
+// of aggregator, checking they're stored as they were written and which
+// codec they were sent with.
+func TestCodecConformance(t *testing.T) {
+	codecEncoders["x-future"] = func(w io.Writer) io.WriteCloser { return nopWriteCloser{w} }
+	defer delete(codecEncoders, "x-future")
+
+	workers := []struct {
+		desc      string
+		transport func(http.RoundTripper) http.RoundTripper
+	}{
+		{desc: "uncompressed worker", transport: func(next http.RoundTripper) http.RoundTripper { return next }},
+		{desc: "gzip worker from before negotiation", transport: NewGzipTransport},
+		{desc: "negotiating worker", transport: func(next http.RoundTripper) http.RoundTripper { return NewCodecTransport(next) }},
+		{desc: "negotiating worker without compression", transport: func(next http.RoundTripper) http.RoundTripper {
+			return NewCodecTransport(next, plugin.UploadCodecIdentity)
+		}},
+		{desc: "negotiating worker with a newer codec", transport: func(next http.RoundTripper) http.RoundTripper {
+			return NewCodecTransport(next, "x-future", plugin.UploadCodecGzip, plugin.UploadCodecIdentity)
+		}},
+	}
+	aggregators := []struct {
+		desc    string
+		handler func(*aggregation.Handler) http.Handler
+	}{
+		{desc: "aggregator", handler: func(h *aggregation.Handler) http.Handler { return h }},
+		{desc: "aggregator without compression", handler: func(h *aggregation.Handler) http.Handler {
+			h.Codecs = []string{plugin.UploadCodecIdentity}
+			return h
+		}},
+		{desc: "aggregator from before negotiation", handler: func(h *aggregation.Handler) http.Handler {
+			return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if r.Method == http.MethodOptions {
+					http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+					return
+				}
+				h.ServeHTTP(w, r)
+			})
+		}},
+	}
+	// The codec each worker uploads with to each aggregator
+	want := [][]string{
+		{"identity", "identity", "identity"},
+		{"gzip", "gzip", "gzip"},
+		{"gzip", "identity", "gzip"},
+		{"identity", "identity", "identity"},
+		{"gzip", "identity", "gzip"},
+	}
+
+	body := strings.Repeat(`{"some": "logs"}`, 100)
+	for i, w := range workers {
+		for j, a := range aggregators {
+			t.Run(w.desc+" to "+a.desc, func(t *testing.T) {
+				withTempDir(t, func(tmpdir string) {
+					aggr := aggregation.NewAggregator(tmpdir, []plugin.ExpectedResult{{NodeName: "node1", ResultType: "systemd_logs"}})
+					srv := authtest.NewTLSServer(a.handler(aggregation.NewHandler(aggr.HandleHTTPResult)), t)
+					defer srv.Close()
+
+					URL, err := aggregation.NodeResultURL(srv.URL, "node1", "systemd_logs")
+					if err != nil {
+						t.Fatalf("unexpected error getting node result url %v", err)
+					}
+					client := srv.Client()
+					client.Transport = w.transport(client.Transport)
+					err = DoRequest(URL, client, func() (io.Reader, string, error) {
+						return strings.NewReader(body), "application/json", nil
+					})
+					if err != nil {
+						t.Fatalf("unexpected error submitting result: %v", err)
+					}
+
+					got, err := ioutil.ReadFile(path.Join(tmpdir, "systemd_logs", "results", "node1"))
+					if err != nil || string(got) != body {
+						t.Errorf("expected the result to be stored as it was written, got %d bytes: %v", len(got), err)
+					}
+					if result := aggr.Results["systemd_logs/node1"]; result == nil || result.Codec != want[i][j] {
+						t.Errorf("expected the result to be uploaded with %v, got %+v", want[i][j], result)
+					}
+				})
+			})
+		}
+	}
+}
+
+// recordingTransport records the requests sent through it, responding to
+// each with the next of its responses.
+type recordingTransport struct {
+	requests  []*http.Request
+	bodies    []string
+	responses []*http.Response
+}
+
+func (r *recordingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	body := ""
+	if req.Body != nil {
+		blob, _ := ioutil.ReadAll(req.Body)
+		body = string(blob)
+	}
+	r.requests = append(r.requests, req)
+	r.bodies = append(r.bodies, body)
+	resp := r.responses[0]
+	r.responses = r.responses[1:]
+	resp.Body = ioutil.NopCloser(&bytes.Buffer{})
+	return resp, nil
+}
+
+func negotiated(codec string) *http.Response {
+	return &http.Response{StatusCode: http.StatusNoContent, Header: http.Header{aggregation.AcceptEncodingHeader: []string{codec}}}
+}
+
+func TestCodecTransport(t *testing.T) {
+	next := &recordingTransport{responses: []*http.Response{
+		negotiated("gzip"),
+		{StatusCode: http.StatusOK},
+		{StatusCode: http.StatusOK},
+		{StatusCode: http.StatusUnsupportedMediaType},
+		negotiated("identity"),
+		{StatusCode: http.StatusOK},
+	}}
+	transport := NewCodecTransport(next)
+	send := func(method, url string) {
+		req, err := http.NewRequest(method, url, strings.NewReader("body"))
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if _, err := transport.RoundTrip(req); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if encoding := req.Header.Get("content-encoding"); encoding != "" {
+			t.Errorf("expected the request sent to be left as it was, got content-encoding %v", encoding)
+		}
+	}
+
+	result := "https://sonobuoy:8080/api/v1/results/by-node/node1/e2e"
+	send("PUT", result)
+	// Progress reports aren't results, so aren't compressed
+	send("PUT", result+"/progress")
+	// The aggregator rejects the codec, so it's negotiated again
+	send("PUT", result)
+	send("PUT", result)
+
+	var methods []string
+	for _, req := range next.requests {
+		methods = append(methods, req.Method)
+	}
+	if got := strings.Join(methods, " "); got != "OPTIONS PUT PUT PUT OPTIONS PUT" {
+		t.Fatalf("expected the codec to be negotiated before the first result and after the 415, got %v", got)
+	}
+	if offer := next.requests[0].Header.Get(aggregation.AcceptEncodingHeader); offer != "gzip, identity;q=0.9" {
+		t.Errorf("expected the worker's codecs to be offered in order, got %q", offer)
+	}
+	for i, want := range []string{"", "gzip", "", "gzip", "", ""} {
+		if got := next.requests[i].Header.Get("content-encoding"); got != want {
+			t.Errorf("expected request %d to have content encoding %q, got %q", i, want, got)
+		}
+	}
+	if next.bodies[2] != "body" || next.bodies[5] != "body" {
+		t.Errorf("expected the progress report and the uncompressed result to be sent as they are, got %q", next.bodies)
+	}
+}
+
+// benchmarkResults are real results, from the results test data, which
+// BenchmarkCompress uploads.
+var benchmarkResults = []string{
+	"plugins/systemd_logs/results/ip-10-0-9-206.us-west-2.compute.internal",
+	"plugins/e2e/results/junit_01.xml",
+}
+
+// readTestResults returns the contents of the named files in the results
+// test data.
+func readTestResults(b *testing.B, names []string) map[string][]byte {
+	f, err := os.Open("../client/results/testdata/results-0.10.tar.gz")
+	if err != nil {
+		b.Fatalf("couldn't open results: %v", err)
+	}
+	defer f.Close()
+	gz, err := gzip.NewReader(f)
+	if err != nil {
+		b.Fatalf("couldn't decompress results: %v", err)
+	}
+
+	contents := map[string][]byte{}
+	tr := tar.NewReader(gz)
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			b.Fatalf("couldn't read results: %v", err)
+		}
+		for _, name := range names {
+			if path.Clean(header.Name) == name {
+				if contents[name], err = ioutil.ReadAll(tr); err != nil {
+					b.Fatalf("couldn't read %v: %v", name, err)
+				}
+			}
+		}
+	}
+	if len(contents) != len(names) {
+		b.Fatalf("expected results %v, got %v", names, len(contents))
+	}
+	return contents
+}
+
+// BenchmarkCompress uploads real results with and without compression,
+// logging how many bytes of each reach the aggregator.
+func BenchmarkCompress(b *testing.B) {
+	contents := readTestResults(b, benchmarkResults)
+	transports := map[string]http.RoundTripper{
+		plugin.UploadCodecIdentity: http.DefaultTransport,
+		plugin.UploadCodecGzip:     NewGzipTransport(nil),
+	}
+
+	for _, name := range benchmarkResults {
+		for _, codec := range []string{plugin.UploadCodecIdentity, plugin.UploadCodecGzip} {
+			result := contents[name]
+			transport := transports[codec]
+			b.Run(path.Base(path.Dir(path.Dir(name)))+"/"+codec, func(b *testing.B) {
+				var sent int64
+				server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+					n, _ := io.Copy(ioutil.Discard, r.Body)
+					atomic.StoreInt64(&sent, n)
+				}))
+				defer server.Close()
+				client := &http.Client{Transport: transport}
+
+				b.SetBytes(int64(len(result)))
+				b.ResetTimer()
+				for i := 0; i < b.N; i++ {
+					req, err := http.NewRequest(http.MethodPut, server.URL, bytes.NewReader(result))
+					if err != nil {
+						b.Fatalf("couldn't make request: %v", err)
+					}
+					resp, err := client.Do(req)
+					if err != nil {
+						b.Fatalf("couldn't upload result: %v", err)
+					}
+					resp.Body.Close()
+				}
+				b.StopTimer()
+				b.Logf("sent %d of %d bytes (%.0f%%)", atomic.LoadInt64(&sent), len(result), 100*float64(atomic.LoadInt64(&sent))/float64(len(result)))
+			})
+		}
+	}
+}
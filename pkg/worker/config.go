@@ -48,6 +48,21 @@ func LoadConfig() (*plugin.WorkerConfig, error) {
 	viper.BindEnv("nodename", "NODE_NAME")
 	viper.BindEnv("resultsdir", "RESULTS_DIR")
 	viper.BindEnv("resulttype", "RESULT_TYPE")
+	viper.BindEnv("streampartial", "STREAM_PARTIAL_RESULTS")
+	viper.BindEnv("streamresults", "STREAM_RESULTS")
+	viper.BindEnv("keepfilenames", "KEEP_RESULT_FILENAMES")
+	viper.BindEnv("uploadartifacts", "UPLOAD_ARTIFACTS")
+	viper.BindEnv("compressresults", "COMPRESS_RESULTS")
+	viper.BindEnv("checksumresults", "CHECKSUM_RESULTS")
+	viper.BindEnv("mintlsversion", "MIN_TLS_VERSION")
+	viper.BindEnv("ciphersuites", "TLS_CIPHER_SUITES")
+	viper.BindEnv("tlsservername", "TLS_SERVER_NAME")
+	viper.BindEnv("uploadpathprefix", "UPLOAD_PATH_PREFIX")
+	viper.BindEnv("aggregatorsocket", "AGGREGATOR_SOCKET")
+	viper.BindEnv("proxyurl", "PROXY_URL")
+	viper.BindEnv("uploadretries", "UPLOAD_RETRIES")
+	viper.BindEnv("uploadtimeoutseconds", "UPLOAD_TIMEOUT_SECONDS")
+	viper.BindEnv("heartbeatintervalseconds", "HEARTBEAT_INTERVAL_SECONDS")
 
 	viper.BindEnv("cacert", "CA_CERT")
 	viper.BindEnv("clientcert", "CLIENT_CERT")
@@ -0,0 +1,103 @@
+/*
+Copyright 2018 Heptio Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package worker
+
+import (
+	"context"
+	"math/rand"
+	"net/http"
+	"time"
+
+	"github.com/heptio/sonobuoy/pkg/plugin/aggregation"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+// heartbeatJitter is how far, as a fraction of the interval, each heartbeat
+// may be sent early or late, so that the workers of a daemonset don't all
+// send theirs at once.
+const heartbeatJitter = 0.2
+
+// startHeartbeats sends a heartbeat to the first aggregator which accepts it
+// about every interval, until the returned func is called. The first is sent
+// at a random point within the interval, since the workers of a daemonset
+// tend to start together. Nothing is sent if the interval isn't positive.
+func startHeartbeats(urls []string, client *http.Client, interval time.Duration) (stop func()) {
+	if interval <= 0 {
+		return func() {}
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		random := rand.New(rand.NewSource(time.Now().UnixNano()))
+		timer := time.NewTimer(time.Duration(random.Int63n(int64(interval))))
+		defer timer.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-timer.C:
+			}
+
+			// A heartbeat which takes longer than the interval is
+			// already late, so the next one is sent instead.
+			beatCtx, done := context.WithTimeout(ctx, interval)
+			if err := sendHeartbeat(beatCtx, urls, client); err != nil && ctx.Err() == nil {
+				logrus.WithError(err).Info("Couldn't send heartbeat, will retry")
+			}
+			done()
+
+			jitter := (random.Float64()*2 - 1) * heartbeatJitter
+			timer.Reset(time.Duration(float64(interval) * (1 + jitter)))
+		}
+	}()
+	return func() {
+		cancel()
+		<-stopped
+	}
+}
+
+// sendHeartbeat sends a heartbeat to the first of the URLs which accepts it.
+func sendHeartbeat(ctx context.Context, urls []string, client *http.Client) error {
+	var err error
+	for _, url := range urls {
+		if err = putHeartbeat(ctx, aggregation.HeartbeatURL(url), client); err == nil {
+			return nil
+		}
+	}
+	return err
+}
+
+// putHeartbeat sends a heartbeat to the given URL.
+func putHeartbeat(ctx context.Context, url string, client *http.Client) error {
+	req, err := http.NewRequest(http.MethodPut, url, http.NoBody)
+	if err != nil {
+		return errors.Wrapf(err, "error constructing heartbeat request to %v", url)
+	}
+
+	resp, err := client.Do(req.WithContext(ctx))
+	if err != nil {
+		return errors.Wrapf(err, "error sending heartbeat to %v", url)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return errors.Errorf("got a %v response sending heartbeat to %v", resp.StatusCode, url)
+	}
+	return nil
+}
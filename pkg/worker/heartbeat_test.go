@@ -0,0 +1,62 @@
+/*
+Copyright 2018 Heptio Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package worker
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/heptio/sonobuoy/pkg/plugin"
+	"github.com/heptio/sonobuoy/pkg/plugin/aggregation"
+)
+
+func TestStartHeartbeats(t *testing.T) {
+	aggr := aggregation.NewAggregator("", []plugin.ExpectedResult{{NodeName: "node1", ResultType: "systemd_logs"}})
+	h := aggregation.NewHandler(aggr.HandleHTTPResult)
+	var beats int32
+	h.HeartbeatCallback = func(report *aggregation.HeartbeatReport, w http.ResponseWriter) {
+		atomic.AddInt32(&beats, 1)
+		aggr.HandleHTTPHeartbeat(report, w)
+	}
+	srv := httptest.NewServer(h)
+	defer srv.Close()
+
+	URL, err := aggregation.NodeResultURL(srv.URL, "node1", "systemd_logs")
+	if err != nil {
+		t.Fatalf("unexpected error getting node result url %v", err)
+	}
+	// The first aggregator is unreachable, so heartbeats go to the second.
+	stop := startHeartbeats([]string{"http://127.0.0.1:1/", URL}, srv.Client(), 20*time.Millisecond)
+	time.Sleep(200 * time.Millisecond)
+	stop()
+
+	sent := atomic.LoadInt32(&beats)
+	// Each is sent within 20% of the interval of the last
+	if sent < 5 || sent > 12 {
+		t.Errorf("expected about 10 heartbeats in 10 intervals, got %v", sent)
+	}
+	time.Sleep(50 * time.Millisecond)
+	if after := atomic.LoadInt32(&beats); after != sent {
+		t.Errorf("expected no heartbeats once stopped, got %v more", after-sent)
+	}
+
+	// Heartbeats are disabled with no interval
+	startHeartbeats([]string{URL}, srv.Client(), 0)()
+}
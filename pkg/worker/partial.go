@@ -0,0 +1,97 @@
+/*
+Copyright 2018 Heptio Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package worker
+
+import (
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/heptio/sonobuoy/pkg/plugin/aggregation"
+	"github.com/sirupsen/logrus"
+)
+
+// partialUploader submits the files a plugin places in its partial results
+// directory, each as the next chunk in the sequence of partial results.
+type partialUploader struct {
+	dir      string
+	urls     []string
+	client   *http.Client
+	policy   UploadPolicy
+	checksum bool
+	// filenames sends the name of each file with it
+	filenames bool
+	// sent is the set of file names which have already been submitted
+	sent map[string]bool
+	seq  int
+}
+
+func newPartialUploader(dir string, urls []string, client *http.Client, policy UploadPolicy, checksum, filenames bool) *partialUploader {
+	return &partialUploader{
+		dir:       dir,
+		urls:      urls,
+		client:    client,
+		policy:    policy,
+		checksum:  checksum,
+		filenames: filenames,
+		sent:      map[string]bool{},
+	}
+}
+
+// upload submits any new files in the partial results directory in name
+// order. Hidden files are skipped so that plugins can write chunks under a
+// temporary name and rename them once complete. Files which can't be
+// submitted are retried on the next call.
+func (p *partialUploader) upload() {
+	if p == nil {
+		return
+	}
+
+	files, err := ioutil.ReadDir(p.dir)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			logrus.WithError(err).WithField("dir", p.dir).Info("Couldn't read partial results directory")
+		}
+		return
+	}
+
+	for _, file := range files {
+		name := file.Name()
+		if file.IsDir() || strings.HasPrefix(name, ".") || p.sent[name] {
+			continue
+		}
+
+		partialURLs := make([]string, len(p.urls))
+		for i, url := range p.urls {
+			partialURLs[i] = aggregation.PartialResultURL(url, p.seq)
+		}
+		var filename string
+		if p.filenames {
+			filename = name
+		}
+		if err := handleWaitFile(filepath.Join(p.dir, name), partialURLs, p.client, p.policy, p.checksum, filename, ""); err != nil {
+			logrus.WithError(err).WithField("file", name).Info("Couldn't submit partial result, will retry")
+			return
+		}
+
+		logrus.WithFields(logrus.Fields{"file": name, "sequence": p.seq}).Info("Submitted partial result")
+		p.sent[name] = true
+		p.seq++
+	}
+}
@@ -0,0 +1,90 @@
+/*
+Copyright 2018 Heptio Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package worker
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"os"
+
+	"github.com/heptio/sonobuoy/pkg/plugin/aggregation"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+// progressReporter relays the progress a plugin writes to its progress file
+// to the aggregator, each time the file changes.
+type progressReporter struct {
+	file   string
+	urls   []string
+	client *http.Client
+	// sent is the contents of the file last reported
+	sent []byte
+}
+
+func newProgressReporter(file string, urls []string, client *http.Client) *progressReporter {
+	return &progressReporter{file: file, urls: urls, client: client}
+}
+
+// report sends the contents of the progress file to the first aggregator
+// which accepts it, if they changed since they were last sent. Progress which
+// can't be sent is retried on the next call. Plugins should replace the file
+// by renaming a new one over it, so that it's never read half written.
+func (p *progressReporter) report() {
+	if p == nil {
+		return
+	}
+
+	blob, err := ioutil.ReadFile(p.file)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			logrus.WithError(err).WithField("file", p.file).Info("Couldn't read progress file")
+		}
+		return
+	}
+	if bytes.Equal(blob, p.sent) {
+		return
+	}
+
+	for _, url := range p.urls {
+		if err = putProgress(aggregation.ProgressURL(url), p.client, blob); err == nil {
+			p.sent = blob
+			return
+		}
+	}
+	logrus.WithError(err).Info("Couldn't report progress, will retry")
+}
+
+// putProgress sends a progress report to the given URL.
+func putProgress(url string, client *http.Client, blob []byte) error {
+	req, err := http.NewRequest(http.MethodPut, url, bytes.NewReader(blob))
+	if err != nil {
+		return errors.Wrapf(err, "error constructing progress request to %v", url)
+	}
+	req.Header.Set("content-type", "application/json")
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return errors.Wrapf(err, "error reporting progress to %v", url)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return errors.Errorf("got a %v response reporting progress to %v", resp.StatusCode, url)
+	}
+	return nil
+}
@@ -0,0 +1,69 @@
+/*
+Copyright 2018 Heptio Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package worker
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestProgressReporter(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sonobuoy_progress_test")
+	if err != nil {
+		t.Fatalf("Could not create temp directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	var reports []string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/api/v1/results/global/e2e/progress" {
+			http.NotFound(w, r)
+			return
+		}
+		blob, _ := ioutil.ReadAll(r.Body)
+		reports = append(reports, string(blob))
+	}))
+	defer srv.Close()
+
+	file := filepath.Join(dir, "progress.json")
+	p := newProgressReporter(file, []string{srv.URL + "/api/v1/results/global/e2e"}, srv.Client())
+
+	// Nothing is reported until the plugin writes the file
+	p.report()
+	if len(reports) != 0 {
+		t.Fatalf("expected no reports without a progress file, got %v", reports)
+	}
+
+	write := func(body string) {
+		if err := ioutil.WriteFile(file, []byte(body), 0644); err != nil {
+			t.Fatalf("couldn't write progress file: %v", err)
+		}
+	}
+	write(`{"completed": 1}`)
+	p.report()
+	p.report()
+	write(`{"completed": 2}`)
+	p.report()
+
+	if len(reports) != 2 || reports[0] != `{"completed": 1}` || reports[1] != `{"completed": 2}` {
+		t.Errorf("expected each change to be reported once, got %v", reports)
+	}
+}
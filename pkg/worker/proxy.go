@@ -0,0 +1,108 @@
+/*
+Copyright 2018 Heptio Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package worker
+
+import (
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+
+	"github.com/heptio/sonobuoy/pkg/plugin"
+	"github.com/heptio/sonobuoy/pkg/plugin/aggregation"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+// Proxy picks the proxy, if any, a request is sent through, as for
+// http.Transport.
+type Proxy func(*http.Request) (*url.URL, error)
+
+// NewProxy returns the proxy results are submitted through: proxyURL if it's
+// set, otherwise the one named by the HTTPS_PROXY, HTTP_PROXY and NO_PROXY
+// environment variables, if any. Requests to the aggregator are tunnelled
+// through the proxy with CONNECT, so its certificate is still verified
+// against the host of the master URL, i.e. the advertise address.
+func NewProxy(proxyURL string) (Proxy, error) {
+	if proxyURL == "" {
+		return http.ProxyFromEnvironment, nil
+	}
+	u, err := plugin.ParseProxyURL(proxyURL)
+	if err != nil {
+		return nil, err
+	}
+	return http.ProxyURL(u), nil
+}
+
+// CheckConnectivity checks that the aggregator's health check can be
+// reached at each master URL in turn, under the path prefix if there is one,
+// logging the proxy requests go through, until one succeeds. It only diagnoses connectivity problems
+// before the results are submitted, which are retried anyway, so it returns
+// an error for the last URL tried rather than failing the worker itself.
+func CheckConnectivity(masterURLs []string, prefix string, client *http.Client, proxy Proxy) error {
+	if len(masterURLs) == 0 {
+		return errors.New("no master URLs to check")
+	}
+
+	var err error
+	for _, masterURL := range masterURLs {
+		log := logrus.WithField("url", masterURL)
+		if err = checkConnectivity(masterURL, prefix, client, proxy, log); err == nil {
+			log.Info("The aggregator is reachable")
+			return nil
+		}
+		log.WithError(err).Warn("Couldn't reach the aggregator")
+	}
+	return err
+}
+
+// checkConnectivity GETs the health check under the master URL.
+func checkConnectivity(masterURL, prefix string, client *http.Client, proxy Proxy, log logrus.FieldLogger) error {
+	healthURL, err := aggregation.HealthURL(masterURL)
+	if err != nil {
+		return err
+	}
+	if healthURL, err = aggregation.WithPathPrefix(healthURL, prefix); err != nil {
+		return err
+	}
+	req, err := http.NewRequest(http.MethodGet, healthURL, nil)
+	if err != nil {
+		return errors.Wrapf(err, "error constructing request to %v", healthURL)
+	}
+
+	if proxy != nil {
+		proxyURL, err := proxy(req)
+		if err != nil {
+			return errors.Wrap(err, "couldn't pick a proxy")
+		}
+		if proxyURL != nil {
+			log = log.WithField("proxy", plugin.RedactedURL(proxyURL))
+		}
+	}
+	log.Info("Checking the aggregator is reachable")
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return errors.Wrapf(err, "couldn't reach the aggregator at %v", healthURL)
+	}
+	defer resp.Body.Close()
+	io.Copy(ioutil.Discard, resp.Body)
+	if resp.StatusCode != http.StatusOK {
+		return errors.Errorf("got a %v response from the aggregator's health check at %v", resp.StatusCode, healthURL)
+	}
+	return nil
+}
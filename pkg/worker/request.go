@@ -18,24 +18,96 @@ package worker
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"fmt"
 	"io"
 	"net/http"
+	"time"
 
 	"github.com/heptio/sonobuoy/pkg/errlog"
+	"github.com/heptio/sonobuoy/pkg/plugin/aggregation"
 	"github.com/pkg/errors"
 	"github.com/sethgrid/pester"
+	"github.com/sirupsen/logrus"
 )
 
+// DefaultUploadRetries is how many times a failed upload is retried if its
+// UploadPolicy doesn't say.
+const DefaultUploadRetries = 3
+
+// maxUploadBackoff caps the wait between attempts at an upload, which
+// doubles with each retry.
+const maxUploadBackoff = 30 * time.Second
+
+// UploadPolicy is how uploads to the aggregator are retried. Uploads which
+// fail with a server error, such as a 503 while the aggregator is busy, or
+// a network error, such as a connection reset, are retried with exponential
+// backoff. Those rejected with a 4xx aren't, since they'd only be rejected
+// again.
+type UploadPolicy struct {
+	// Retries is how many times a failed upload is retried. Defaults to
+	// DefaultUploadRetries if unset.
+	Retries int
+	// Timeout, if set, bounds how long an upload is tried for over all of
+	// its attempts. An attempt still in progress when it passes is
+	// cancelled.
+	Timeout time.Duration
+	// backoff returns how long to wait before the given retry, counted
+	// from 1. Defaults to doubling from a second, up to maxUploadBackoff.
+	backoff func(retry int) time.Duration
+}
+
+// retries returns how many times a failed upload is retried.
+func (p UploadPolicy) retries() int {
+	if p.Retries == 0 {
+		return DefaultUploadRetries
+	}
+	return p.Retries
+}
+
+// wait returns how long to wait before the given retry, without waiting
+// past the deadline, if any.
+func (p UploadPolicy) wait(retry int, deadline time.Time) time.Duration {
+	var wait time.Duration
+	if p.backoff != nil {
+		wait = p.backoff(retry)
+	} else {
+		wait = maxUploadBackoff
+		if retry < 6 {
+			wait = time.Duration(1<<uint(retry-1)) * time.Second
+		}
+	}
+	if !deadline.IsZero() {
+		if left := time.Until(deadline); left < wait {
+			wait = left
+		}
+	}
+	return wait
+}
+
 // DoRequest calls the given callback which returns an io.Reader, and submits
 // the results, with error handling, and falls back on uploading JSON with the
 // error message if the callback fails. (This way, problems gathering data
 // don't result in the server waiting forever for results that will never
-// come.)
+// come.) Failed uploads are retried as in the default UploadPolicy.
 func DoRequest(url string, client *http.Client, callback func() (io.Reader, string, error)) error {
+	return doRequest(url, client, UploadPolicy{}, nil, callback)
+}
+
+// doRequest is DoRequest, retrying as in the policy and sending the given
+// headers along with the results.
+func doRequest(url string, client *http.Client, policy UploadPolicy, header http.Header, callback func() (io.Reader, string, error)) error {
 	input, mimeType, err := callback()
-	pesterClient := pester.NewExtendedClient(client)
+	ctx := context.Background()
+	var deadline time.Time
+	if policy.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, policy.Timeout)
+		defer cancel()
+		deadline, _ = ctx.Deadline()
+	}
+	pesterClient := newUploadClient(url, client, policy, deadline)
 	if err != nil {
 		errlog.LogError(errors.Wrap(err, "error gathering host data"))
 
@@ -49,15 +121,18 @@ func DoRequest(url string, client *http.Client, callback func() (io.Reader, stri
 			return errors.WithStack(err)
 		}
 		req, err := http.NewRequest(http.MethodPut, url, bytes.NewReader(errbody))
-		req.Header.Add("content-type", mimeType)
 		if err != nil {
 			return errors.WithStack(err)
 		}
+		req.Header.Add("content-type", mimeType)
 
 		// And if we can't even do that, log it.
-		resp, err := pesterClient.Do(req)
-		if err == nil && resp.StatusCode != http.StatusOK {
-			err = fmt.Errorf("unexpected status code %d", resp.StatusCode)
+		resp, err := pesterClient.Do(req.WithContext(ctx))
+		if err == nil {
+			resp.Body.Close()
+			if resp.StatusCode != http.StatusOK {
+				err = fmt.Errorf("unexpected status code %d", resp.StatusCode)
+			}
 		}
 		if err != nil {
 			errlog.LogError(errors.Wrapf(err, "could not send error message to master URL (%s)", url))
@@ -70,15 +145,102 @@ func DoRequest(url string, client *http.Client, callback func() (io.Reader, stri
 	if err != nil {
 		return errors.Wrapf(err, "error constructing master request to %v", url)
 	}
+	for key, values := range header {
+		req.Header[key] = values
+	}
 	req.Header.Add("content-type", mimeType)
 
-	resp, err := pesterClient.Do(req)
+	resp, err := pesterClient.Do(req.WithContext(ctx))
 	if err != nil {
+		if ctx.Err() != nil {
+			return errors.Wrapf(err, "gave up submitting to master at %v after %v", url, policy.Timeout)
+		}
 		return errors.Wrapf(err, "error encountered dialing master at %v", url)
 	}
+	resp.Body.Close()
 	if resp.StatusCode != http.StatusOK {
-		// TODO: retry logic for something like a 429 or otherwise
 		return errors.Errorf("got a %v response when dialing master to %v", resp.StatusCode, url)
 	}
 	return nil
 }
+
+// newUploadClient returns a client which retries uploads to the URL as in
+// the policy, logging each attempt.
+func newUploadClient(url string, client *http.Client, policy UploadPolicy, deadline time.Time) *pester.Client {
+	transport := client.Transport
+	if transport == nil {
+		transport = http.DefaultTransport
+	}
+	retries := policy.retries()
+	pesterClient := pester.NewExtendedClient(&http.Client{
+		Transport:     &attemptLogger{next: &retryMarker{next: transport}, url: url, retries: retries},
+		CheckRedirect: client.CheckRedirect,
+		Jar:           client.Jar,
+		Timeout:       client.Timeout,
+	})
+	// pester counts the first attempt as well as the retries
+	pesterClient.MaxRetries = retries + 1
+	pesterClient.Backoff = func(retry int) time.Duration {
+		return policy.wait(retry, deadline)
+	}
+	return pesterClient
+}
+
+// attemptLogger logs each attempt at an upload along with the aggregator's
+// response, so that it's clear from the worker's logs why a result was
+// retried or given up on.
+type attemptLogger struct {
+	next    http.RoundTripper
+	url     string
+	retries int
+	// attempts is only used by one attempt at a time, since uploads
+	// aren't made concurrently
+	attempts int
+}
+
+func (a *attemptLogger) RoundTrip(req *http.Request) (*http.Response, error) {
+	resp, err := a.next.RoundTrip(req)
+	a.attempts++
+	log := logrus.WithFields(logrus.Fields{"url": a.url, "attempt": a.attempts})
+	switch {
+	case err != nil:
+		log = log.WithError(err)
+	case resp.StatusCode == http.StatusOK:
+		log.WithField("status", resp.StatusCode).Info("Submitted to the aggregator")
+		return resp, err
+	default:
+		log = log.WithField("status", resp.StatusCode)
+	}
+
+	retryable := err != nil || resp.StatusCode >= 500
+	if retryable && a.attempts <= a.retries && req.Context().Err() == nil {
+		log.Info("Couldn't submit to the aggregator, will retry")
+	} else {
+		log.Info("Couldn't submit to the aggregator")
+	}
+	return resp, err
+}
+
+// retryMarker sends each attempt at an upload after the first with the
+// aggregation.ReplaceHeader, so that a retry replaces what an earlier attempt
+// uploaded if it reached the aggregator but its response never made it back.
+type retryMarker struct {
+	next http.RoundTripper
+	// attempts is only used by one attempt at a time, as in attemptLogger
+	attempts int
+}
+
+func (r *retryMarker) RoundTrip(req *http.Request) (*http.Response, error) {
+	r.attempts++
+	if r.attempts == 1 {
+		return r.next.RoundTrip(req)
+	}
+	// The request must be left as it was, so the header goes on a copy
+	retry := req.WithContext(req.Context())
+	retry.Header = make(http.Header, len(req.Header)+1)
+	for key, values := range req.Header {
+		retry.Header[key] = values
+	}
+	retry.Header.Set(aggregation.ReplaceHeader, "true")
+	return r.next.RoundTrip(retry)
+}
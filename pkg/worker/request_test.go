@@ -19,11 +19,16 @@ package worker
 import (
 	"bytes"
 	"io"
+	"io/ioutil"
 	"net/http"
 	"net/http/httptest"
+	"reflect"
+	"strings"
 	"sync"
 	"testing"
+	"time"
 
+	"github.com/heptio/sonobuoy/pkg/plugin/aggregation"
 	"github.com/pkg/errors"
 )
 
@@ -70,10 +75,140 @@ func TestErrorRequestRetry(t *testing.T) {
 	}
 }
 
+func TestDoRequest_policy(t *testing.T) {
+	noBackoff := func(int) time.Duration { return 0 }
+	tests := []struct {
+		name          string
+		responseCodes []int
+		policy        UploadPolicy
+		expectErr     bool
+		expectCount   int
+	}{
+		{
+			name:          "server errors are retried",
+			responseCodes: []int{500, 503, 200},
+			policy:        UploadPolicy{backoff: noBackoff},
+			expectCount:   3,
+		},
+		{
+			name:          "retries are bounded",
+			responseCodes: []int{500, 500, 500, 500},
+			policy:        UploadPolicy{Retries: 2, backoff: noBackoff},
+			expectErr:     true,
+			expectCount:   3,
+		},
+		{
+			name:          "client errors aren't retried",
+			responseCodes: []int{400, 200},
+			policy:        UploadPolicy{backoff: noBackoff},
+			expectErr:     true,
+			expectCount:   1,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			testServer := &testServer{responseCodes: test.responseCodes}
+			server := httptest.NewTLSServer(testServer)
+			defer server.Close()
+
+			err := doRequest(server.URL, server.Client(), test.policy, nil, func() (io.Reader, string, error) {
+				return strings.NewReader("results"), "text/plain", nil
+			})
+			if test.expectErr != (err != nil) {
+				t.Errorf("expected error %v, got %v", test.expectErr, err)
+			}
+			if testServer.responseCount != test.expectCount {
+				t.Errorf("expected %d requests, got %d", test.expectCount, testServer.responseCount)
+			}
+			// Each attempt sends the whole body
+			for i, body := range testServer.bodies {
+				if body != "results" {
+					t.Errorf("expected attempt %d to send the results, got %q", i+1, body)
+				}
+			}
+		})
+	}
+}
+
+func TestDoRequest_connectionReset(t *testing.T) {
+	var count int
+	var replace []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		count++
+		replace = append(replace, r.Header.Get(aggregation.ReplaceHeader))
+		if count == 1 {
+			// Drop the connection without responding
+			conn, _, err := w.(http.Hijacker).Hijack()
+			if err != nil {
+				t.Errorf("couldn't hijack connection: %v", err)
+				return
+			}
+			conn.Close()
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer server.Close()
+
+	policy := UploadPolicy{backoff: func(int) time.Duration { return 0 }}
+	err := doRequest(server.URL, server.Client(), policy, nil, func() (io.Reader, string, error) {
+		return strings.NewReader("results"), "text/plain", nil
+	})
+	if err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+	if count != 2 {
+		t.Errorf("expected the upload to be retried after the connection was dropped, got %d requests", count)
+	}
+	// The first attempt may have been received, so the retry replaces it
+	if want := []string{"", "true"}; !reflect.DeepEqual(replace, want) {
+		t.Errorf("expected the replace headers %q, got %q", want, replace)
+	}
+}
+
+func TestDoRequest_timeout(t *testing.T) {
+	testServer := &testServer{}
+	server := httptest.NewTLSServer(testServer)
+	defer server.Close()
+
+	// The server always fails, so only the timeout stops the retries
+	policy := UploadPolicy{
+		Retries: 1000,
+		Timeout: 200 * time.Millisecond,
+		backoff: func(int) time.Duration { return 50 * time.Millisecond },
+	}
+	start := time.Now()
+	err := doRequest(server.URL, server.Client(), policy, nil, func() (io.Reader, string, error) {
+		return strings.NewReader("results"), "text/plain", nil
+	})
+	if err == nil {
+		t.Error("expected an error once the timeout passed")
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("expected the upload to give up after its timeout, took %v", elapsed)
+	}
+}
+
+func TestUploadPolicyWait(t *testing.T) {
+	var policy UploadPolicy
+	for retry, want := range map[int]time.Duration{1: time.Second, 2: 2 * time.Second, 5: 16 * time.Second, 6: maxUploadBackoff, 100: maxUploadBackoff} {
+		if got := policy.wait(retry, time.Time{}); got != want {
+			t.Errorf("expected retry %v to wait %v, got %v", retry, want, got)
+		}
+	}
+	// The wait doesn't go past the deadline
+	if got := policy.wait(5, time.Now().Add(time.Second)); got > time.Second {
+		t.Errorf("expected the wait to end by the deadline, got %v", got)
+	}
+}
+
 type testServer struct {
 	sync.Mutex
 	responseCodes []int
 	responseCount int
+	// bodies are the bodies of the requests received
+	bodies []string
 }
 
 func (t *testServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
@@ -86,6 +221,9 @@ func (t *testServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		responseCode, t.responseCodes = t.responseCodes[0], t.responseCodes[1:]
 	}
 
+	body, _ := ioutil.ReadAll(r.Body)
+	t.bodies = append(t.bodies, string(body))
+
 	w.WriteHeader(responseCode)
 	w.Write([]byte("ok!"))
 
@@ -0,0 +1,125 @@
+/*
+Copyright 2018 Heptio Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package worker
+
+import (
+	"context"
+	"io"
+	"mime"
+	"net/http"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/heptio/sonobuoy/pkg/plugin/aggregation"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+// streamPollInterval is how often a stream file is checked for more data
+// once everything written to it so far has been sent.
+var streamPollInterval = 100 * time.Millisecond
+
+// streamReader reads a file the plugin is still writing to. At the end of
+// the file it waits for the plugin to write more, only returning io.EOF once
+// the plugin has written the done file and the rest of the file is read.
+type streamReader struct {
+	file     *os.File
+	waitfile string
+	poll     time.Duration
+	ctx      context.Context
+	// done is set once the done file has been seen
+	done bool
+}
+
+func (s *streamReader) Read(p []byte) (int, error) {
+	for {
+		n, err := s.file.Read(p)
+		if n > 0 || (err != nil && err != io.EOF) {
+			return n, err
+		}
+		if s.done {
+			return 0, io.EOF
+		}
+		// The plugin may write more before the done file, so the file
+		// is read once more after seeing it.
+		if _, err := os.Stat(s.waitfile); err == nil {
+			s.done = true
+			continue
+		}
+		select {
+		case <-time.After(s.poll):
+		case <-s.ctx.Done():
+			return 0, errors.Wrap(s.ctx.Err(), "stopped streaming results before the plugin finished")
+		}
+	}
+}
+
+// startStream streams the stream file to the first of the given URLs which
+// accepts it, sending the error, if any, on the returned channel once the
+// plugin has finished and the stream is closed. Cancelling ctx drops the
+// stream, which the aggregator records as a failure.
+func startStream(ctx context.Context, streamFile, waitfile string, urls []string, client *http.Client) <-chan error {
+	errc := make(chan error, 1)
+	go func() {
+		if len(urls) == 0 {
+			errc <- errors.New("no master URLs to stream results to")
+			return
+		}
+
+		var err error
+		for _, url := range urls {
+			if err = streamFileTo(ctx, streamFile, waitfile, url, client); err == nil || ctx.Err() != nil {
+				break
+			}
+			logrus.WithError(err).WithField("url", url).Info("Couldn't stream results, trying next master URL")
+		}
+		errc <- err
+	}()
+	return errc
+}
+
+// streamFileTo streams the file from its start to the stream URL of the given
+// result URL. The stream isn't retried since what was sent can't be taken
+// back.
+func streamFileTo(ctx context.Context, streamFile, waitfile, url string, client *http.Client) error {
+	f, err := os.Open(streamFile)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	defer f.Close()
+
+	body := &streamReader{file: f, waitfile: waitfile, poll: streamPollInterval, ctx: ctx}
+	req, err := http.NewRequest(http.MethodPut, aggregation.StreamURL(url), body)
+	if err != nil {
+		return errors.Wrapf(err, "error constructing master request to %v", url)
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set(dateHeader, time.Now().UTC().Format(http.TimeFormat))
+	req.Header.Set("content-type", mime.TypeByExtension(filepath.Ext(streamFile)))
+
+	logrus.WithField("url", req.URL.String()).Info("Streaming results")
+	resp, err := client.Do(req)
+	if err != nil {
+		return errors.Wrapf(err, "error streaming results to master at %v", url)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return errors.Errorf("got a %v response when streaming results to %v", resp.StatusCode, url)
+	}
+	return nil
+}
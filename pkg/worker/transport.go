@@ -0,0 +1,111 @@
+/*
+Copyright 2018 Heptio Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package worker
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/pkg/errors"
+	"golang.org/x/net/http2"
+)
+
+// NewTLSTransport returns a transport which submits results over TLS with the
+// given config, through the proxy if it picks one. HTTP/2 is negotiated with
+// aggregators which support it, so that all of a worker's requests share one
+// connection; otherwise HTTP/1.1 is used.
+func NewTLSTransport(tlsCfg *tls.Config, proxy Proxy) (*http.Transport, error) {
+	transport := &http.Transport{TLSClientConfig: tlsCfg, Proxy: proxy}
+	if err := http2.ConfigureTransport(transport); err != nil {
+		return nil, errors.Wrap(err, "couldn't configure HTTP/2")
+	}
+	return transport, nil
+}
+
+// serverNameTransport explains handshakes which fail because the aggregator's
+// certificate doesn't match the server name it was verified against.
+type serverNameTransport struct {
+	next http.RoundTripper
+}
+
+// NewServerNameTransport returns a RoundTripper which sends requests with
+// next. If the handshake fails because the aggregator's certificate isn't
+// valid for the server name the worker verified it against, e.g. when it's
+// reached through a service the certificate doesn't name, the generic TLS
+// error is replaced with one listing the names it is valid for.
+func NewServerNameTransport(next http.RoundTripper) http.RoundTripper {
+	return &serverNameTransport{next: next}
+}
+
+func (t *serverNameTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	resp, err := t.next.RoundTrip(req)
+	if err != nil {
+		err = explainServerNameError(err)
+	}
+	return resp, err
+}
+
+// explainServerNameError returns an error saying how the server name and the
+// certificate's names differ if err is a handshake failing for that reason,
+// and err itself otherwise.
+func explainServerNameError(err error) error {
+	hostErr, ok := hostnameError(err)
+	if !ok || hostErr.Certificate == nil {
+		return err
+	}
+
+	names := append([]string{}, hostErr.Certificate.DNSNames...)
+	for _, ip := range hostErr.Certificate.IPAddresses {
+		names = append(names, ip.String())
+	}
+	return errors.Errorf(
+		"the aggregator's certificate is valid for %v but not for %q, the server name it was verified against: add %[2]q to the aggregator's tlsservernames, or set workertlsservername to one of the names it's valid for",
+		strings.Join(names, ", "), hostErr.Host,
+	)
+}
+
+// hostnameError returns the x509.HostnameError err wraps, if any. Errors are
+// unwrapped by hand rather than with errors.As so the worker builds with Go
+// releases before 1.13: by their Unwrap method, if they have one, as
+// verification errors do in later releases, by their Cause, as errors
+// wrapped with github.com/pkg/errors do, and otherwise by the fields of the
+// standard library's wrapping errors.
+func hostnameError(err error) (x509.HostnameError, bool) {
+	for err != nil {
+		switch e := err.(type) {
+		case x509.HostnameError:
+			return e, true
+		case *x509.HostnameError:
+			return *e, true
+		case *url.Error:
+			err = e.Err
+		case *net.OpError:
+			err = e.Err
+		case interface{ Unwrap() error }:
+			err = e.Unwrap()
+		case interface{ Cause() error }:
+			err = e.Cause()
+		default:
+			return x509.HostnameError{}, false
+		}
+	}
+	return x509.HostnameError{}, false
+}
@@ -0,0 +1,132 @@
+/*
+Copyright 2018 Heptio Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package worker
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/heptio/sonobuoy/pkg/backplane/ca"
+	"github.com/pkg/errors"
+)
+
+func TestNewTLSTransport(t *testing.T) {
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(r.Proto))
+	}))
+	// Offering only h2 has the server negotiate HTTP/2 without needing
+	// EnableHTTP2, which isn't available before Go 1.14.
+	srv.TLS = &tls.Config{NextProtos: []string{"h2"}}
+	srv.StartTLS()
+	defer srv.Close()
+
+	roots := x509.NewCertPool()
+	roots.AddCert(srv.Certificate())
+	transport, err := NewTLSTransport(&tls.Config{RootCAs: roots}, nil)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	resp, err := (&http.Client{Transport: transport}).Get(srv.URL)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer resp.Body.Close()
+	if resp.ProtoMajor != 2 {
+		t.Errorf("expected HTTP/2 to be negotiated, got %v", resp.Proto)
+	}
+}
+
+func TestServerNameTransport(t *testing.T) {
+	auth, err := ca.NewAuthority()
+	if err != nil {
+		t.Fatalf("couldn't create certificate authority: %v", err)
+	}
+	tlsCfg, err := auth.MakeServerConfig("127.0.0.1", "sonobuoy-aggregator.heptio-sonobuoy.svc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tlsCfg.ClientAuth = tls.NoClientCert
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	srv.TLS = tlsCfg
+	srv.StartTLS()
+	defer srv.Close()
+
+	get := func(serverName string) error {
+		transport, err := NewTLSTransport(&tls.Config{RootCAs: auth.CACertPool(), ServerName: serverName}, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp, err := (&http.Client{Transport: NewServerNameTransport(transport)}).Get(srv.URL)
+		if err == nil {
+			resp.Body.Close()
+		}
+		return err
+	}
+
+	for _, name := range []string{"", "sonobuoy-aggregator.heptio-sonobuoy.svc"} {
+		if err := get(name); err != nil {
+			t.Errorf("expected the certificate to be valid for server name %q, got %v", name, err)
+		}
+	}
+
+	err = get("sonobuoy.mesh.local")
+	if err == nil {
+		t.Fatal("expected an error for a server name the certificate isn't valid for")
+	}
+	expected := `the aggregator's certificate is valid for sonobuoy-aggregator.heptio-sonobuoy.svc, 127.0.0.1 but not for "sonobuoy.mesh.local"`
+	if !strings.Contains(err.Error(), expected) {
+		t.Errorf("expected an error explaining the mismatch, containing %q, got %v", expected, err)
+	}
+}
+
+// unwrapping wraps an error with an Unwrap method, as later Go releases do.
+type unwrapping struct{ err error }
+
+func (u *unwrapping) Error() string { return u.err.Error() }
+func (u *unwrapping) Unwrap() error { return u.err }
+
+func TestHostnameError(t *testing.T) {
+	hostErr := x509.HostnameError{Certificate: &x509.Certificate{}, Host: "sonobuoy.mesh.local"}
+	testCases := []struct {
+		desc   string
+		err    error
+		wantOK bool
+	}{
+		{desc: "bare", err: hostErr, wantOK: true},
+		{desc: "pointer", err: &hostErr, wantOK: true},
+		{desc: "url error", err: &url.Error{Op: "Get", URL: "https://sonobuoy.mesh.local", Err: hostErr}, wantOK: true},
+		{desc: "pkg/errors", err: errors.Wrap(&net.OpError{Op: "remote error", Err: hostErr}, "handshake failed"), wantOK: true},
+		{desc: "unwrapped", err: &unwrapping{err: hostErr}, wantOK: true},
+		{desc: "other error", err: &url.Error{Op: "Get", Err: errors.New("connection refused")}},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.desc, func(t *testing.T) {
+			got, ok := hostnameError(tc.err)
+			if ok != tc.wantOK || (ok && got.Host != hostErr.Host) {
+				t.Errorf("expected found %v, got %v and %+v", tc.wantOK, ok, got)
+			}
+		})
+	}
+}
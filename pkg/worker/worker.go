@@ -17,6 +17,10 @@ limitations under the License.
 package worker
 
 import (
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
 	"io"
 	"io/ioutil"
 	"mime"
@@ -25,10 +29,21 @@ import (
 	"path/filepath"
 	"time"
 
+	"github.com/heptio/sonobuoy/pkg/plugin/aggregation"
 	"github.com/pkg/errors"
 	"github.com/sirupsen/logrus"
 )
 
+const (
+	// checksumHeader is the header the checksum of results is sent in.
+	checksumHeader = "Digest"
+	// dispositionHeader is the header the filename of results is sent in.
+	dispositionHeader = "Content-Disposition"
+	// dateHeader is the header the time results are submitted is sent in,
+	// so the aggregator can spot nodes whose clocks are skewed.
+	dateHeader = "Date"
+)
+
 func init() {
 	mime.AddExtensionType(".gz", "application/gzip")
 }
@@ -39,25 +54,161 @@ func init() {
 // 1. Output data will be placed into an agreed upon results directory.
 // 2. The Job will wait for a done file
 // 3. The done file contains a single string of the results to be sent to the master
-func GatherResults(waitfile string, url string, client *http.Client, stopc <-chan struct{}) error {
+//
+// The results are submitted to the first of the given URLs which accepts them.
+func GatherResults(waitfile string, urls []string, client *http.Client, stopc <-chan struct{}) error {
+	return GatherResultsWithOptions(waitfile, urls, client, stopc, GatherOptions{})
+}
+
+// GatherOptions are the optional behaviours of GatherResultsWithOptions.
+type GatherOptions struct {
+	// PartialDir, if set, is watched while waiting for the done file, and
+	// each file placed in it is submitted as a partial result so that the
+	// aggregator has some data even if the plugin never finishes.
+	PartialDir string
+	// Checksum sends the SHA-256 checksum of each result so the aggregator
+	// can reject results which were corrupted in transit.
+	Checksum bool
+	// ProgressFile, if set, is checked while waiting for the done file, and
+	// its contents are reported to the aggregator as the plugin's progress
+	// whenever they change. See aggregation.PluginProgress for its format.
+	ProgressFile string
+	// Filenames sends the name of each file submitted so the aggregator
+	// writes it under that name, in the directory of the plugin's results
+	// on the node, instead of naming it itself.
+	Filenames bool
+	// ArtifactsDir, if set, is watched while waiting for the done file, and
+	// each file placed in it or its subdirectories is submitted as an
+	// artifact named by its path within it. Once the done file is written,
+	// the file it names is submitted as an artifact too and the result is
+	// marked done, so the result is made up of all of the artifacts.
+	ArtifactsDir string
+	// StreamFile, if set, is streamed to the aggregator as the plugin
+	// writes it, from when it's created until the done file is written,
+	// instead of submitting the file named in the done file. Results are
+	// submitted as usual if the plugin doesn't create it.
+	StreamFile string
+	// Upload is how failed uploads are retried.
+	Upload UploadPolicy
+	// HeartbeatInterval, if set, is about how often a heartbeat is sent to
+	// the aggregator until the result is submitted, so that it can tell a
+	// worker which is still waiting on its plugin from one which is gone.
+	HeartbeatInterval time.Duration
+	// AnnotationsFile, if set, is read once the done file is written and,
+	// if the plugin wrote it, sent along with the result as its
+	// annotations: a JSON object of strings, up to
+	// aggregation.MaxAnnotationsBytes once compacted. Streamed results
+	// aren't annotated.
+	AnnotationsFile string
+}
+
+// GatherPartialResults is like GatherResults, but while waiting for the done
+// file it also submits each file placed in partialDir as a partial result, so
+// that the aggregator has some data even if the plugin never finishes. No
+// partial results are submitted if partialDir is empty.
+//
+// Deprecated: use GatherResultsWithOptions with GatherOptions.PartialDir.
+func GatherPartialResults(waitfile, partialDir string, urls []string, client *http.Client, stopc <-chan struct{}) error {
+	return GatherResultsWithOptions(waitfile, urls, client, stopc, GatherOptions{PartialDir: partialDir})
+}
+
+// GatherResultsWithOptions is like GatherResults with the given options.
+func GatherResultsWithOptions(waitfile string, urls []string, client *http.Client, stopc <-chan struct{}, opts GatherOptions) error {
+	var partials *partialUploader
+	if opts.PartialDir != "" {
+		partials = newPartialUploader(opts.PartialDir, urls, client, opts.Upload, opts.Checksum, opts.Filenames)
+	}
+	var artifacts *artifactUploader
+	if opts.ArtifactsDir != "" {
+		artifacts = newArtifactUploader(opts.ArtifactsDir, urls, client, opts.Upload, opts.Checksum)
+	}
+	var progress *progressReporter
+	if opts.ProgressFile != "" {
+		progress = newProgressReporter(opts.ProgressFile, urls, client)
+	}
+	// Heartbeats carry on while the result is submitted, which can take a
+	// while for big results.
+	stopHeartbeats := startHeartbeats(urls, client, opts.HeartbeatInterval)
+	defer stopHeartbeats()
+
+	// streamed is nil until the plugin starts writing the stream file
+	var streamed <-chan error
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
 	logrus.WithField("waitfile", waitfile).Info("Waiting for waitfile")
 	ticker := time.Tick(1 * time.Second)
 	// TODO(chuckha) evaluate wait.Until [https://github.com/kubernetes/apimachinery/blob/e9ff529c66f83aeac6dff90f11ea0c5b7c4d626a/pkg/util/wait/wait.go]
 	for {
 		select {
 		case <-ticker:
+			partials.upload()
+			if err := artifacts.upload(); err != nil {
+				logrus.WithError(err).Info("Couldn't submit artifacts, will retry")
+			}
+			progress.report()
+			if streamed != nil {
+				// The stream ends once the done file is written
+				continue
+			}
+			if opts.StreamFile != "" && fileExists(opts.StreamFile) {
+				streamed = startStream(ctx, opts.StreamFile, waitfile, urls, client)
+				continue
+			}
 			if resultFile, err := ioutil.ReadFile(waitfile); err == nil {
+				// Catch any partial results written since the last upload
+				partials.upload()
+				annotations := readAnnotations(opts.AnnotationsFile)
+				if artifacts != nil {
+					logrus.WithField("resultFile", string(resultFile)).Info("Detected done file, submitting the rest of the artifacts")
+					return artifacts.finish(string(resultFile), annotations)
+				}
 				logrus.WithField("resultFile", string(resultFile)).Info("Detected done file, transmitting result file")
-				return handleWaitFile(string(resultFile), url, client)
+				var filename string
+				if opts.Filenames {
+					filename = filepath.Base(string(resultFile))
+				}
+				return handleWaitFile(string(resultFile), urls, client, opts.Upload, opts.Checksum, filename, annotations)
+			}
+		case err := <-streamed:
+			partials.upload()
+			if err == nil {
+				logrus.Info("Finished streaming results")
 			}
+			return err
 		case <-stopc:
 			logrus.Info("Did not receive plugin results in time. Shutting down worker.")
+			if streamed != nil {
+				// Drop the stream, rather than it looking complete
+				cancel()
+				<-streamed
+			}
 			return nil
 		}
 	}
 }
 
-func handleWaitFile(resultFile, url string, client *http.Client) error {
+// handleWaitFile submits the results file to the first of the URLs which
+// accepts it, retrying each as in the policy. It's given the filename and
+// annotations to send, if any.
+func handleWaitFile(resultFile string, urls []string, client *http.Client, policy UploadPolicy, checksum bool, filename, annotations string) error {
+	if len(urls) == 0 {
+		return errors.New("no master URLs to submit results to")
+	}
+
+	var err error
+	for _, url := range urls {
+		if err = submitFile(resultFile, url, client, policy, checksum, filename, annotations); err == nil {
+			return nil
+		}
+		logrus.WithError(err).WithField("url", url).Info("Couldn't submit results, trying next master URL")
+	}
+	return err
+}
+
+// submitFile transmits the results file to the given URL, along with its
+// checksum if requested and the filename and annotations, if any.
+func submitFile(resultFile, url string, client *http.Client, policy UploadPolicy, checksum bool, filename, annotations string) error {
 	var outfile *os.File
 	var err error
 
@@ -65,6 +216,21 @@ func handleWaitFile(resultFile, url string, client *http.Client) error {
 	extension := filepath.Ext(resultFile)
 	mimeType := mime.TypeByExtension(extension)
 
+	header := http.Header{}
+	header.Set(dateHeader, time.Now().UTC().Format(http.TimeFormat))
+	if checksum {
+		// If the file can't be read, the request below sends the error
+		if digest, err := fileDigest(resultFile); err == nil {
+			header.Set(checksumHeader, digest)
+		}
+	}
+	if filename != "" {
+		header.Set(dispositionHeader, mime.FormatMediaType("attachment", map[string]string{"filename": filename}))
+	}
+	if annotations != "" {
+		header.Set(aggregation.AnnotationsHeader, annotations)
+	}
+
 	defer func() {
 		if outfile != nil {
 			outfile.Close()
@@ -72,8 +238,63 @@ func handleWaitFile(resultFile, url string, client *http.Client) error {
 	}()
 
 	// transmit back the results file.
-	return DoRequest(url, client, func() (io.Reader, string, error) {
+	return doRequest(url, client, policy, header, func() (io.Reader, string, error) {
 		outfile, err = os.Open(resultFile)
 		return outfile, mimeType, errors.WithStack(err)
 	})
 }
+
+// readAnnotations returns the annotations in the given file, compacted to be
+// sent in a header, or an empty string if there's no file. Annotations which
+// aren't valid are logged and left out so that the result is still accepted.
+func readAnnotations(file string) string {
+	if file == "" {
+		return ""
+	}
+	b, err := ioutil.ReadFile(file)
+	if os.IsNotExist(err) {
+		return ""
+	}
+	log := logrus.WithField("file", file)
+	if err != nil {
+		log.WithError(err).Warning("Couldn't read annotations, submitting the result without them")
+		return ""
+	}
+
+	var annotations map[string]string
+	if err := json.Unmarshal(b, &annotations); err != nil {
+		log.WithError(err).Warning("Annotations must be a JSON object of strings, submitting the result without them")
+		return ""
+	}
+	compacted, err := json.Marshal(annotations)
+	if err != nil {
+		log.WithError(err).Warning("Couldn't encode annotations, submitting the result without them")
+		return ""
+	}
+	if _, err := aggregation.ParseAnnotations(string(compacted)); err != nil {
+		log.WithError(err).Warning("Invalid annotations, submitting the result without them")
+		return ""
+	}
+	return string(compacted)
+}
+
+// fileExists returns true if the file can be found.
+func fileExists(file string) bool {
+	_, err := os.Stat(file)
+	return err == nil
+}
+
+// fileDigest returns the value of the Digest header for the given file.
+func fileDigest(file string) (string, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return "", errors.WithStack(err)
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", errors.Wrapf(err, "couldn't read %v", file)
+	}
+	return "SHA-256=" + base64.StdEncoding.EncodeToString(h.Sum(nil)), nil
+}
@@ -17,12 +17,16 @@ limitations under the License.
 package worker
 
 import (
+	"fmt"
 	"io/ioutil"
+	"net"
 	"net/http"
 	"os"
 	"os/exec"
 	"path"
+	"reflect"
 	"testing"
+	"time"
 
 	"github.com/heptio/sonobuoy/pkg/backplane/ca/authtest"
 	"github.com/heptio/sonobuoy/pkg/plugin"
@@ -51,7 +55,7 @@ func TestRun(t *testing.T) {
 			withTempDir(t, func(tmpdir string) {
 				ioutil.WriteFile(tmpdir+"/systemd_logs", []byte("{}"), 0755)
 				ioutil.WriteFile(tmpdir+"/done", []byte(tmpdir+"/systemd_logs"), 0755)
-				err := GatherResults(tmpdir+"/done", URL, srv.Client(), nil)
+				err := GatherResults(tmpdir+"/done", []string{URL}, srv.Client(), nil)
 				if err != nil {
 					t.Fatalf("Got error running agent: %v", err)
 				}
@@ -78,7 +82,7 @@ func TestRunGlobal(t *testing.T) {
 		withTempDir(t, func(tmpdir string) {
 			ioutil.WriteFile(tmpdir+"/systemd_logs.json", []byte("{}"), 0755)
 			ioutil.WriteFile(tmpdir+"/done", []byte(tmpdir+"/systemd_logs.json"), 0755)
-			err := GatherResults(tmpdir+"/done", url, srv.Client(), nil)
+			err := GatherResults(tmpdir+"/done", []string{url}, srv.Client(), nil)
 			if err != nil {
 				t.Fatalf("Got error running agent: %v", err)
 			}
@@ -103,7 +107,7 @@ func TestRunGlobal_noExtension(t *testing.T) {
 		withTempDir(t, func(tmpdir string) {
 			ioutil.WriteFile(tmpdir+"/systemd_logs", []byte("{}"), 0755)
 			ioutil.WriteFile(tmpdir+"/done", []byte(tmpdir+"/systemd_logs"), 0755)
-			err := GatherResults(tmpdir+"/done", url, srv.Client(), nil)
+			err := GatherResults(tmpdir+"/done", []string{url}, srv.Client(), nil)
 			if err != nil {
 				t.Fatalf("Got error running agent: %v", err)
 			}
@@ -113,6 +117,286 @@ func TestRunGlobal_noExtension(t *testing.T) {
 	})
 }
 
+func TestRunGlobal_fallbackURL(t *testing.T) {
+	expectedResults := []plugin.ExpectedResult{
+		plugin.ExpectedResult{ResultType: "systemd_logs"},
+	}
+
+	withAggregator(t, expectedResults, func(aggr *aggregation.Aggregator, srv *authtest.Server) {
+		url, err := aggregation.GlobalResultURL(srv.URL, "systemd_logs")
+		if err != nil {
+			t.Fatalf("unexpected error getting global result url %v", err)
+		}
+		unreachable, err := aggregation.GlobalResultURL("https://127.0.0.1:1/", "systemd_logs")
+		if err != nil {
+			t.Fatalf("unexpected error getting global result url %v", err)
+		}
+
+		withTempDir(t, func(tmpdir string) {
+			ioutil.WriteFile(tmpdir+"/systemd_logs.json", []byte("{}"), 0755)
+			ioutil.WriteFile(tmpdir+"/done", []byte(tmpdir+"/systemd_logs.json"), 0755)
+			err := GatherResults(tmpdir+"/done", []string{unreachable, url}, srv.Client(), nil)
+			if err != nil {
+				t.Fatalf("Got error running agent: %v", err)
+			}
+
+			ensureExists(t, path.Join(aggr.OutputDir, "systemd_logs", "results"))
+		})
+	})
+}
+
+func TestRunPartial(t *testing.T) {
+	expectedResults := []plugin.ExpectedResult{
+		plugin.ExpectedResult{NodeName: "node1", ResultType: "systemd_logs"},
+	}
+
+	withAggregator(t, expectedResults, func(aggr *aggregation.Aggregator, srv *authtest.Server) {
+		URL, err := aggregation.NodeResultURL(srv.URL, "node1", "systemd_logs")
+		if err != nil {
+			t.Fatalf("unexpected error getting node result url %v", err)
+		}
+
+		withTempDir(t, func(tmpdir string) {
+			partialDir := tmpdir + "/partial"
+			if err := os.Mkdir(partialDir, 0755); err != nil {
+				t.Fatalf("couldn't create partial results dir: %v", err)
+			}
+			ioutil.WriteFile(partialDir+"/a", []byte("first"), 0755)
+			ioutil.WriteFile(partialDir+"/b", []byte("second"), 0755)
+			ioutil.WriteFile(partialDir+"/.c", []byte("incomplete"), 0755)
+			ioutil.WriteFile(tmpdir+"/systemd_logs", []byte("{}"), 0755)
+			ioutil.WriteFile(tmpdir+"/done", []byte(tmpdir+"/systemd_logs"), 0755)
+
+			err := GatherResultsWithOptions(tmpdir+"/done", []string{URL}, srv.Client(), nil, GatherOptions{PartialDir: partialDir})
+			if err != nil {
+				t.Fatalf("Got error running agent: %v", err)
+			}
+
+			for seq, want := range []string{"first", "second"} {
+				got, err := ioutil.ReadFile(path.Join(aggr.OutputDir, "systemd_logs", "partial", "node1", fmt.Sprintf("%08d", seq)))
+				if err != nil || string(got) != want {
+					t.Errorf("expected partial result %v to be %q, got %q: %v", seq, want, string(got), err)
+				}
+			}
+			ensureExists(t, path.Join(aggr.OutputDir, "systemd_logs", "results", "node1"))
+			if _, err := os.Stat(path.Join(aggr.OutputDir, "systemd_logs", "partial", "node1", fmt.Sprintf("%08d", 2))); err == nil {
+				t.Error("expected hidden files not to be submitted")
+			}
+		})
+	})
+}
+
+func TestRunFilenames(t *testing.T) {
+	expectedResults := []plugin.ExpectedResult{
+		plugin.ExpectedResult{NodeName: "node1", ResultType: "systemd_logs"},
+	}
+
+	withAggregator(t, expectedResults, func(aggr *aggregation.Aggregator, srv *authtest.Server) {
+		URL, err := aggregation.NodeResultURL(srv.URL, "node1", "systemd_logs")
+		if err != nil {
+			t.Fatalf("unexpected error getting node result url %v", err)
+		}
+
+		withTempDir(t, func(tmpdir string) {
+			partialDir := tmpdir + "/partial"
+			if err := os.Mkdir(partialDir, 0755); err != nil {
+				t.Fatalf("couldn't create partial results dir: %v", err)
+			}
+			ioutil.WriteFile(partialDir+"/cluster-dump.json", []byte("{}"), 0755)
+			ioutil.WriteFile(tmpdir+"/junit.xml", []byte("<testsuite/>"), 0755)
+			ioutil.WriteFile(tmpdir+"/done", []byte(tmpdir+"/junit.xml"), 0755)
+
+			err := GatherResultsWithOptions(tmpdir+"/done", []string{URL}, srv.Client(), nil, GatherOptions{PartialDir: partialDir, Filenames: true})
+			if err != nil {
+				t.Fatalf("Got error running agent: %v", err)
+			}
+
+			ensureExists(t, path.Join(aggr.OutputDir, "systemd_logs", "partial", "node1", "cluster-dump.json"))
+			ensureExists(t, path.Join(aggr.OutputDir, "systemd_logs", "results", "node1", "junit.xml"))
+		})
+	})
+}
+
+func TestRunArtifacts(t *testing.T) {
+	expectedResults := []plugin.ExpectedResult{
+		plugin.ExpectedResult{NodeName: "node1", ResultType: "e2e"},
+	}
+
+	withAggregator(t, expectedResults, func(aggr *aggregation.Aggregator, srv *authtest.Server) {
+		URL, err := aggregation.NodeResultURL(srv.URL, "node1", "e2e")
+		if err != nil {
+			t.Fatalf("unexpected error getting node result url %v", err)
+		}
+
+		withTempDir(t, func(tmpdir string) {
+			artifactsDir := tmpdir + "/artifacts"
+			if err := os.MkdirAll(artifactsDir+"/screenshots", 0755); err != nil {
+				t.Fatalf("couldn't create artifacts dir: %v", err)
+			}
+			ioutil.WriteFile(artifactsDir+"/cluster-dump.json", []byte("{}"), 0755)
+			ioutil.WriteFile(artifactsDir+"/screenshots/login.png", []byte("<png>"), 0755)
+			ioutil.WriteFile(artifactsDir+"/.incomplete", []byte("half"), 0755)
+			ioutil.WriteFile(tmpdir+"/junit.xml", []byte("<testsuite/>"), 0755)
+			ioutil.WriteFile(tmpdir+"/done", []byte(tmpdir+"/junit.xml"), 0755)
+
+			err := GatherResultsWithOptions(tmpdir+"/done", []string{URL}, srv.Client(), nil, GatherOptions{ArtifactsDir: artifactsDir})
+			if err != nil {
+				t.Fatalf("Got error running agent: %v", err)
+			}
+
+			if missing := aggr.MissingResults(); len(missing) > 0 {
+				t.Errorf("expected the result to be marked done, missing %v", missing)
+			}
+			for _, name := range []string{"cluster-dump.json", "screenshots/login.png", "junit.xml"} {
+				ensureExists(t, path.Join(aggr.OutputDir, "e2e", "results", "node1", name))
+			}
+			if _, err := os.Stat(path.Join(aggr.OutputDir, "e2e", "results", "node1", ".incomplete")); err == nil {
+				t.Error("expected hidden files not to be submitted")
+			}
+		})
+	})
+}
+
+func TestRunCompressed(t *testing.T) {
+	expectedResults := []plugin.ExpectedResult{
+		plugin.ExpectedResult{NodeName: "node1", ResultType: "systemd_logs"},
+	}
+
+	withAggregator(t, expectedResults, func(aggr *aggregation.Aggregator, srv *authtest.Server) {
+		URL, err := aggregation.NodeResultURL(srv.URL, "node1", "systemd_logs")
+		if err != nil {
+			t.Fatalf("unexpected error getting node result url %v", err)
+		}
+
+		client := srv.Client()
+		client.Transport = NewGzipTransport(client.Transport)
+
+		withTempDir(t, func(tmpdir string) {
+			ioutil.WriteFile(tmpdir+"/systemd_logs", []byte(`{"some": "logs"}`), 0755)
+			ioutil.WriteFile(tmpdir+"/done", []byte(tmpdir+"/systemd_logs"), 0755)
+			err := GatherResults(tmpdir+"/done", []string{URL}, client, nil)
+			if err != nil {
+				t.Fatalf("Got error running agent: %v", err)
+			}
+
+			got, err := ioutil.ReadFile(path.Join(aggr.OutputDir, "systemd_logs", "results", "node1"))
+			if err != nil || string(got) != `{"some": "logs"}` {
+				t.Errorf("expected the result to be decompressed, got %q: %v", string(got), err)
+			}
+		})
+	})
+}
+
+func TestRunChecksum(t *testing.T) {
+	expectedResults := []plugin.ExpectedResult{
+		plugin.ExpectedResult{ResultType: "systemd_logs"},
+	}
+
+	withAggregator(t, expectedResults, func(aggr *aggregation.Aggregator, srv *authtest.Server) {
+		URL, err := aggregation.GlobalResultURL(srv.URL, "systemd_logs")
+		if err != nil {
+			t.Fatalf("unexpected error getting global result url %v", err)
+		}
+
+		withTempDir(t, func(tmpdir string) {
+			ioutil.WriteFile(tmpdir+"/systemd_logs", []byte("{}"), 0755)
+			ioutil.WriteFile(tmpdir+"/done", []byte(tmpdir+"/systemd_logs"), 0755)
+			err := GatherResultsWithOptions(tmpdir+"/done", []string{URL}, srv.Client(), nil, GatherOptions{Checksum: true})
+			if err != nil {
+				t.Fatalf("Got error running agent: %v", err)
+			}
+
+			// The SHA-256 checksum of "{}"
+			want := "44136fa355b3678a1146ad16f7e8649e94fb4fc21fe77e8310c060f61caaff8a"
+			result, ok := aggr.Results["systemd_logs"]
+			if !ok || !result.IsSuccess() || result.Checksum != want {
+				t.Errorf("expected a successful result with checksum %v, got %+v", want, result)
+			}
+		})
+	})
+}
+
+func TestRunAnnotations(t *testing.T) {
+	expectedResults := []plugin.ExpectedResult{
+		plugin.ExpectedResult{NodeName: "node1", ResultType: "systemd_logs"},
+		plugin.ExpectedResult{NodeName: "node1", ResultType: "e2e"},
+	}
+
+	withAggregator(t, expectedResults, func(aggr *aggregation.Aggregator, srv *authtest.Server) {
+		for _, tc := range []struct {
+			resultType  string
+			annotations string
+			opts        GatherOptions
+			want        map[string]string
+		}{
+			{
+				resultType:  "systemd_logs",
+				annotations: "{\n  \"suite-version\": \"1.2.3\"\n}",
+				want:        map[string]string{"suite-version": "1.2.3"},
+			},
+			// Invalid annotations are left out rather than losing the result
+			{resultType: "e2e", annotations: `{"retries": 3}`, opts: GatherOptions{ArtifactsDir: "artifacts"}},
+		} {
+			URL, err := aggregation.NodeResultURL(srv.URL, "node1", tc.resultType)
+			if err != nil {
+				t.Fatalf("unexpected error getting node result url %v", err)
+			}
+
+			withTempDir(t, func(tmpdir string) {
+				opts := tc.opts
+				if opts.ArtifactsDir != "" {
+					opts.ArtifactsDir = path.Join(tmpdir, opts.ArtifactsDir)
+					os.Mkdir(opts.ArtifactsDir, 0755)
+				}
+				opts.AnnotationsFile = tmpdir + "/annotations.json"
+				ioutil.WriteFile(opts.AnnotationsFile, []byte(tc.annotations), 0755)
+				ioutil.WriteFile(tmpdir+"/results.json", []byte("{}"), 0755)
+				ioutil.WriteFile(tmpdir+"/done", []byte(tmpdir+"/results.json"), 0755)
+
+				if err := GatherResultsWithOptions(tmpdir+"/done", []string{URL}, srv.Client(), nil, opts); err != nil {
+					t.Fatalf("Got error running agent: %v", err)
+				}
+				result, ok := aggr.Results[tc.resultType+"/node1"]
+				if !ok || !result.IsSuccess() || !reflect.DeepEqual(result.Annotations, tc.want) {
+					t.Errorf("expected a successful %v result with annotations %v, got %+v", tc.resultType, tc.want, result)
+				}
+			})
+		}
+	})
+}
+
+func TestRunSocket(t *testing.T) {
+	expectedResults := []plugin.ExpectedResult{
+		plugin.ExpectedResult{ResultType: "systemd_logs"},
+	}
+
+	withTempDir(t, func(tmpdir string) {
+		socket := path.Join(tmpdir, "aggregator.sock")
+		listener, err := net.Listen("unix", socket)
+		if err != nil {
+			t.Fatalf("couldn't listen on socket: %v", err)
+		}
+		aggr := aggregation.NewAggregator(path.Join(tmpdir, "plugins"), expectedResults)
+		srv := &http.Server{Handler: aggregation.NewHandler(aggr.HandleHTTPResult)}
+		go srv.Serve(listener)
+		defer srv.Close()
+
+		// The host is ignored, every request goes over the socket
+		URL, err := aggregation.GlobalResultURL("http://sonobuoy-aggregator/", "systemd_logs")
+		if err != nil {
+			t.Fatalf("unexpected error getting global result url %v", err)
+		}
+		client := &http.Client{Transport: NewSocketTransport(socket)}
+
+		ioutil.WriteFile(tmpdir+"/systemd_logs", []byte("{}"), 0755)
+		ioutil.WriteFile(tmpdir+"/done", []byte(tmpdir+"/systemd_logs"), 0755)
+		if err := GatherResults(tmpdir+"/done", []string{URL}, client, nil); err != nil {
+			t.Fatalf("Got error running agent: %v", err)
+		}
+		ensureExists(t, path.Join(aggr.OutputDir, "systemd_logs", "results"))
+	})
+}
+
 func TestRunGlobalCleanup(t *testing.T) {
 
 	// Create an expectedResults array
@@ -128,10 +412,101 @@ func TestRunGlobalCleanup(t *testing.T) {
 		}
 
 		withTempDir(t, func(tmpdir string) {
-			err := GatherResults(tmpdir+"/done", url, srv.Client(), stopc)
+			err := GatherResults(tmpdir+"/done", []string{url}, srv.Client(), stopc)
+			if err != nil {
+				t.Fatalf("Got error running agent: %v", err)
+			}
+		})
+	})
+}
+
+func TestRunStreamed(t *testing.T) {
+	expectedResults := []plugin.ExpectedResult{
+		plugin.ExpectedResult{NodeName: "node1", ResultType: "systemd_logs"},
+	}
+
+	withAggregator(t, expectedResults, func(aggr *aggregation.Aggregator, srv *authtest.Server) {
+		URL, err := aggregation.NodeResultURL(srv.URL, "node1", "systemd_logs")
+		if err != nil {
+			t.Fatalf("unexpected error getting node result url %v", err)
+		}
+
+		withTempDir(t, func(tmpdir string) {
+			f, err := os.Create(tmpdir + "/stream")
 			if err != nil {
+				t.Fatalf("couldn't create stream file: %v", err)
+			}
+			defer f.Close()
+			f.WriteString("first ")
+
+			done := make(chan error)
+			go func() {
+				done <- GatherResultsWithOptions(tmpdir+"/done", []string{URL}, srv.Client(), nil, GatherOptions{StreamFile: tmpdir + "/stream"})
+			}()
+
+			// Wait for the stream to start before finishing it
+			received := path.Join(aggr.OutputDir, "systemd_logs", "results", "node1")
+			for i := 0; i < 500; i++ {
+				if got, _ := ioutil.ReadFile(received); string(got) == "first " {
+					break
+				}
+				time.Sleep(10 * time.Millisecond)
+			}
+			f.WriteString("second")
+			ioutil.WriteFile(tmpdir+"/systemd_logs", []byte("not sent"), 0755)
+			ioutil.WriteFile(tmpdir+"/done", []byte(tmpdir+"/systemd_logs"), 0755)
+
+			if err := <-done; err != nil {
 				t.Fatalf("Got error running agent: %v", err)
 			}
+			if got, err := ioutil.ReadFile(received); string(got) != "first second" {
+				t.Errorf("expected the whole stream to be received, got %q: %v", got, err)
+			}
+		})
+	})
+}
+
+func TestRunStreamed_stopped(t *testing.T) {
+	expectedResults := []plugin.ExpectedResult{
+		plugin.ExpectedResult{ResultType: "systemd_logs"},
+	}
+
+	withAggregator(t, expectedResults, func(aggr *aggregation.Aggregator, srv *authtest.Server) {
+		url, err := aggregation.GlobalResultURL(srv.URL, "systemd_logs")
+		if err != nil {
+			t.Fatalf("unexpected error getting global result url %v", err)
+		}
+
+		withTempDir(t, func(tmpdir string) {
+			ioutil.WriteFile(tmpdir+"/stream", []byte("unfinished"), 0755)
+
+			stopc := make(chan struct{})
+			done := make(chan error)
+			go func() {
+				done <- GatherResultsWithOptions(tmpdir+"/done", []string{url}, srv.Client(), stopc, GatherOptions{StreamFile: tmpdir + "/stream"})
+			}()
+
+			received := path.Join(aggr.OutputDir, "systemd_logs", "results")
+			for i := 0; i < 500; i++ {
+				if got, _ := ioutil.ReadFile(received); string(got) == "unfinished" {
+					break
+				}
+				time.Sleep(10 * time.Millisecond)
+			}
+			stopc <- struct{}{}
+			if err := <-done; err != nil {
+				t.Fatalf("Got error running agent: %v", err)
+			}
+
+			for i := 0; i < 500 && len(aggr.MissingResults()) > 0; i++ {
+				time.Sleep(10 * time.Millisecond)
+			}
+			if missing := aggr.MissingResults(); len(missing) > 0 {
+				t.Fatalf("expected the dropped stream to be recorded, missing %v", missing)
+			}
+			if result := aggr.Results["systemd_logs"]; result.IsSuccess() {
+				t.Errorf("expected the dropped stream to be recorded as a failure, got %+v", result)
+			}
 		})
 	})
 }